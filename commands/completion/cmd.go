@@ -0,0 +1,108 @@
+// Package completion implements a command that generates shell completion
+// scripts for the taskcluster-worker command line interface.
+package completion
+
+import (
+	"os"
+	"sort"
+	"text/template"
+
+	"github.com/taskcluster/taskcluster-worker/commands"
+	"github.com/taskcluster/taskcluster-worker/engines"
+	"github.com/taskcluster/taskcluster-worker/plugins"
+)
+
+func init() {
+	commands.Register("completion", cmd{})
+}
+
+type cmd struct{}
+
+func (cmd) Summary() string {
+	return "Generate shell completion script"
+}
+
+func (cmd) Usage() string {
+	return `
+taskcluster-worker completion will print a script that provides completion of
+commands, sub-commands and options for the given shell. Completions are
+generated from the usage strings of the commands, and include the names of
+engines and plugins compiled into this build.
+
+To load completions in bash:
+  source <(taskcluster-worker completion bash)
+To load completions in zsh:
+  taskcluster-worker completion zsh > "${fpath[1]}/_taskcluster-worker"
+To load completions in fish:
+  taskcluster-worker completion fish > ~/.config/fish/completions/taskcluster-worker.fish
+
+usage:
+  taskcluster-worker completion (bash|zsh|fish)
+
+options:
+  -h --help     Show this screen.
+`
+}
+
+// completionData is the data rendered by the completion templates
+type completionData struct {
+	Commands    []string
+	Completions []commandCompletion
+	// Mapping from placeholder to values that can be completed
+	Values map[string][]string
+}
+
+func (cmd) Execute(arguments map[string]interface{}) bool {
+	data := completionData{
+		Values: map[string][]string{
+			"engine":  engineNames(),
+			"plugin":  pluginNames(),
+			"command": nil,
+		},
+	}
+
+	providers := commands.Commands()
+	for name := range providers {
+		data.Commands = append(data.Commands, name)
+	}
+	sort.Strings(data.Commands)
+	data.Values["command"] = data.Commands
+
+	for _, name := range data.Commands {
+		c := parseUsage(name, providers[name].Usage(), data.Values)
+		c.Summary = providers[name].Summary()
+		data.Completions = append(data.Completions, c)
+	}
+
+	var t *template.Template
+	switch {
+	case arguments["bash"].(bool):
+		t = bashTemplate
+	case arguments["zsh"].(bool):
+		t = zshTemplate
+	case arguments["fish"].(bool):
+		t = fishTemplate
+	}
+	if err := t.Execute(os.Stdout, data); err != nil {
+		panic(err) // templates are static, so this shouldn't happen
+	}
+	return true
+}
+
+func engineNames() []string {
+	var names []string
+	for name := range engines.Engines() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func pluginNames() []string {
+	var names []string
+	for name := range plugins.Plugins() {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
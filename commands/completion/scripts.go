@@ -0,0 +1,70 @@
+package completion
+
+import (
+	"strings"
+	"text/template"
+)
+
+var funcs = template.FuncMap{
+	"join": strings.Join,
+	"quote": func(s string) string {
+		return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+	},
+	"trim": func(s string) string {
+		return strings.TrimPrefix(s, "--")
+	},
+}
+
+var bashTemplate = template.Must(template.New("bash").Funcs(funcs).Parse(`# bash completion for taskcluster-worker
+_taskcluster_worker() {
+  local cur="${COMP_WORDS[COMP_CWORD]}"
+  local prev="${COMP_WORDS[COMP_CWORD-1]}"
+  COMPREPLY=()
+  if [ "$COMP_CWORD" -eq 1 ]; then
+    COMPREPLY=( $(compgen -W "{{join .Commands " "}}" -- "$cur") )
+    return 0
+  fi
+  case "${COMP_WORDS[1]}" in
+{{- range .Completions}}
+    {{.Name}})
+      case "$prev" in
+{{- range $option, $placeholder := .Arguments}}{{with index $.Values $placeholder}}
+        {{$option}}) COMPREPLY=( $(compgen -W "{{join . " "}}" -- "$cur") ); return 0 ;;
+{{- end}}{{end}}
+      esac
+      COMPREPLY=( $(compgen -W "{{join .Words " "}} {{join .Options " "}}" -- "$cur") )
+      ;;
+{{- end}}
+  esac
+  if [ "${#COMPREPLY[@]}" -eq 0 ]; then
+    COMPREPLY=( $(compgen -f -- "$cur") )
+  fi
+  return 0
+}
+complete -F _taskcluster_worker taskcluster-worker
+`))
+
+// zsh can use the bash completion through bashcompinit
+var zshTemplate = template.Must(template.New("zsh").Funcs(funcs).Parse(`#compdef taskcluster-worker
+# zsh completion for taskcluster-worker
+autoload -U +X bashcompinit && bashcompinit
+{{template "bash" .}}`))
+
+var fishTemplate = template.Must(template.New("fish").Funcs(funcs).Parse(`# fish completion for taskcluster-worker
+{{- range .Completions}}
+complete -c taskcluster-worker -n '__fish_use_subcommand' -a {{quote .Name}} -d {{quote .Summary}}
+{{- $name := .Name}}
+{{- $arguments := .Arguments}}
+{{- if .Words}}
+complete -c taskcluster-worker -n '__fish_seen_subcommand_from {{$name}}' -a {{quote (join .Words " ")}}
+{{- end}}
+{{- range .Options}}
+complete -c taskcluster-worker -n '__fish_seen_subcommand_from {{$name}}' -l {{trim .}}
+{{- with index $arguments .}} -r{{with index $.Values .}} -a {{quote (join . " ")}}{{end}}{{end}}
+{{- end}}
+{{- end}}
+`))
+
+func init() {
+	template.Must(zshTemplate.AddParseTree("bash", bashTemplate.Tree))
+}
@@ -0,0 +1,99 @@
+package completion
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	optionPattern         = regexp.MustCompile(`(?:^|[\s\[(|])(--[a-zA-Z0-9][a-zA-Z0-9-]*)`)
+	optionArgumentPattern = regexp.MustCompile(`(--[a-zA-Z0-9][a-zA-Z0-9-]*)[ =]<([a-zA-Z0-9_.-]+)>`)
+	wordPattern           = regexp.MustCompile(`^[a-z][a-z0-9-]*$`)
+	placeholderPattern    = regexp.MustCompile(`^<([a-zA-Z0-9_.-]+)>$`)
+)
+
+// commandCompletion holds the words and options that can follow a command
+type commandCompletion struct {
+	Name    string
+	Summary string
+	Words   []string
+	Options []string
+	// Mapping from option to argument placeholder, for options taking a value
+	Arguments map[string]string
+}
+
+// parseUsage extracts sub-command words and options from the docopt usage
+// string of the command given by name.
+//
+// Positional arguments with a placeholder in values, such as '<engine>', are
+// completed with the given values.
+func parseUsage(name, usage string, values map[string][]string) commandCompletion {
+	c := commandCompletion{
+		Name:      name,
+		Arguments: make(map[string]string),
+	}
+	words := make(map[string]bool)
+	options := make(map[string]bool)
+
+	prefix := "taskcluster-worker " + name
+	inUsage := false
+	for _, line := range strings.Split(usage, "\n") {
+		// Options may be mentioned anywhere in the usage string
+		for _, m := range optionPattern.FindAllStringSubmatch(line, -1) {
+			options[m[1]] = true
+		}
+		for _, m := range optionArgumentPattern.FindAllStringSubmatch(line, -1) {
+			c.Arguments[m[1]] = m[2]
+		}
+
+		// Usage patterns follow 'usage:' until the first empty line, like docopt
+		if i := strings.Index(strings.ToLower(line), "usage:"); i != -1 {
+			inUsage = true
+			line = line[i+len("usage:"):]
+		} else if strings.TrimSpace(line) == "" {
+			inUsage = false
+		}
+		if !inUsage {
+			continue
+		}
+
+		// Words are literals in usage patterns, after the command name
+		i := strings.Index(line, prefix)
+		if i == -1 {
+			continue
+		}
+		pattern := strings.NewReplacer("(", " ", ")", " ", "[", " ", "]", " ", "|", " ").Replace(
+			line[i+len(prefix):],
+		)
+		previous := ""
+		for _, word := range strings.Fields(pattern) {
+			if wordPattern.MatchString(word) {
+				words[word] = true
+			}
+			// Complete positional arguments, unless it's an option argument
+			m := placeholderPattern.FindStringSubmatch(word)
+			if m != nil && !strings.HasPrefix(previous, "--") {
+				for _, value := range values[m[1]] {
+					words[value] = true
+				}
+			}
+			previous = word
+		}
+	}
+	delete(options, "--")
+	delete(words, "options")
+
+	c.Words = sortedKeys(words)
+	c.Options = sortedKeys(options)
+	return c
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
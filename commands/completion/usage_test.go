@@ -0,0 +1,65 @@
+package completion
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testUsage = `
+taskcluster-worker schema can be used to export JSON schema documents.
+
+usage:
+  taskcluster-worker schema config [options]
+  taskcluster-worker schema payload [options] --engine <engine> <config.yml>
+
+options:
+  -f --format <format>          Set the format json or yaml [Default: json].
+  -o --output <file>            Write output to a file [Default: -].
+`
+
+func TestParseUsage(t *testing.T) {
+	c := parseUsage("schema", testUsage, map[string][]string{
+		"engine": {"qemu", "docker"},
+	})
+	assert.Equal(t, []string{"config", "payload"}, c.Words)
+	assert.Equal(t, []string{"--engine", "--format", "--output"}, c.Options)
+	assert.Equal(t, "engine", c.Arguments["--engine"])
+	assert.Equal(t, "format", c.Arguments["--format"])
+}
+
+func TestParseUsagePositional(t *testing.T) {
+	c := parseUsage("help", "usage: taskcluster-worker help <command>", map[string][]string{
+		"command": {"help", "schema"},
+	})
+	assert.Equal(t, []string{"help", "schema"}, c.Words)
+	assert.Empty(t, c.Options)
+}
+
+func TestTemplates(t *testing.T) {
+	data := completionData{
+		Commands: []string{"schema"},
+		Values:   map[string][]string{"engine": {"qemu", "docker"}},
+	}
+	c := parseUsage("schema", testUsage, data.Values)
+	c.Summary = "Dump schema for config or payload"
+	data.Completions = append(data.Completions, c)
+
+	for _, shell := range []string{"bash", "zsh", "fish"} {
+		t.Run(shell, func(t *testing.T) {
+			b := bytes.NewBuffer(nil)
+			switch shell {
+			case "bash":
+				require.NoError(t, bashTemplate.Execute(b, data))
+			case "zsh":
+				require.NoError(t, zshTemplate.Execute(b, data))
+			case "fish":
+				require.NoError(t, fishTemplate.Execute(b, data))
+			}
+			assert.Contains(t, b.String(), "schema")
+			assert.Contains(t, b.String(), "qemu docker")
+		})
+	}
+}
@@ -0,0 +1,94 @@
+// Package configtest implements a command for testing a worker configuration
+// file without claiming any tasks.
+package configtest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/taskcluster/taskcluster-worker/commands"
+	"github.com/taskcluster/taskcluster-worker/config"
+	"github.com/taskcluster/taskcluster-worker/runtime/monitoring"
+	"github.com/taskcluster/taskcluster-worker/worker"
+)
+
+func init() {
+	commands.Register("config-test", cmd{})
+}
+
+type cmd struct{}
+
+func (cmd) Summary() string {
+	return "Test a configuration file without claiming tasks"
+}
+
+func (cmd) Usage() string {
+	return `
+taskcluster-worker config-test will load and validate the given configuration
+file, apply transforms, create the engine and plugins, and run the health
+checks the worker runs before claiming tasks. No tasks will be claimed.
+
+This prints a report and exits non-zero if any step fails, which is useful for
+testing configuration changes before deploying them.
+
+usage:
+  taskcluster-worker config-test <config.yml>
+
+options:
+  -h --help     Show this screen.
+`
+}
+
+func (cmd) Execute(args map[string]interface{}) bool {
+	monitor := monitoring.PreConfig()
+	filename := args["<config.yml>"].(string)
+
+	// Load and validate configuration
+	c, err := config.LoadFromFile(filename, monitor)
+	if !report("load configuration", err) {
+		return false
+	}
+	if m, ok := c.(map[string]interface{}); ok {
+		fmt.Printf("  engine:  %v\n", m["engine"])
+		if p, ok := m["plugins"].(map[string]interface{}); ok {
+			var names []string
+			for name := range p {
+				if name != "disabled" {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			fmt.Printf("  plugins: %s\n", strings.Join(names, ", "))
+		}
+	}
+
+	// Create worker, this creates engine and plugins
+	w, err := worker.New(c)
+	if !report("create engine and plugins", err) {
+		return false
+	}
+
+	// Run health checks
+	success := report("preflight checks", w.PreflightCheck())
+
+	// Free resources held by engine and plugins
+	if !report("dispose engine and plugins", w.Dispose()) {
+		success = false
+	}
+
+	if success {
+		fmt.Println("Configuration is valid")
+	}
+	return success
+}
+
+// report prints the result of a step, returns true if err is nil
+func report(step string, err error) bool {
+	if err != nil {
+		fmt.Printf("FAIL %s\n  error: %s\n", step, err)
+		return false
+	}
+	fmt.Printf("OK   %s\n", step)
+	return true
+}
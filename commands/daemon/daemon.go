@@ -27,7 +27,17 @@ func (cmd) Summary() string {
 }
 
 func usage() string {
-	return `Usage:
+	return `
+When running under systemd, 'daemon run' signals readiness and sends watchdog
+keepalives using sd_notify, hence, the service can use Type=notify and
+WatchdogSec. SIGTERM stops the worker gracefully, waiting for active tasks to
+finish, while SIGINT or a second SIGTERM stops the worker immediately.
+
+Before creating engines 'daemon run' applies the 'daemon' options from the
+configuration file, setting oom_score_adj for the worker and its child
+processes, the umask and ulimits.
+
+Usage:
   taskcluster-worker daemon (install | run) <config-file>
   taskcluster-worker daemon (start | stop | remove)
 `
@@ -0,0 +1,7 @@
+// Package daemon implements a command for installing and running
+// taskcluster-worker as a system service.
+package daemon
+
+import "github.com/taskcluster/taskcluster-worker/runtime/util"
+
+var debug = util.Debug("daemon")
@@ -0,0 +1,72 @@
+package daemon
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// sdNotify sends state to the systemd service manager, see sd_notify(3).
+//
+// If NOTIFY_SOCKET isn't set, we're not running under systemd (or the service
+// isn't Type=notify) and this does nothing.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	// Sockets in the abstract namespace are given with a leading '@'
+	if socket[0] == '@' {
+		socket = "\x00" + socket[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to NOTIFY_SOCKET")
+	}
+	defer conn.Close()
+
+	if _, err = conn.Write([]byte(state)); err != nil {
+		return errors.Wrap(err, "failed to write to NOTIFY_SOCKET")
+	}
+	return nil
+}
+
+// sdWatchdogInterval returns the interval at which systemd expects watchdog
+// keepalives, or zero if the watchdog isn't enabled for this process.
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	// If WATCHDOG_PID is set, it must be our PID
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// sdWatchdog sends watchdog keepalives at half the interval expected by
+// systemd, until done is closed. Keepalives are skipped while alive returns
+// false, such that systemd restarts the service if the worker stalls.
+func sdWatchdog(interval time.Duration, alive func() bool, done <-chan struct{}) {
+	ticker := time.NewTicker(interval / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if !alive() {
+				debug("worker isn't making progress, skipping watchdog keepalive")
+				continue
+			}
+			if err := sdNotify("WATCHDOG=1"); err != nil {
+				debug("failed to send watchdog keepalive, error: %s", err)
+			}
+		}
+	}
+}
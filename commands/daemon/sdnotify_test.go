@@ -0,0 +1,77 @@
+// +build linux
+
+package daemon
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/runtime/atomics"
+)
+
+func TestSdNotify(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "taskcluster-worker-sdnotify-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	socket := filepath.Join(tmp, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	require.NoError(t, sdNotify("READY=1"))
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "READY=1", string(buf[:n]))
+}
+
+func TestSdWatchdogInterval(t *testing.T) {
+	os.Setenv("WATCHDOG_USEC", "30000000")
+	defer os.Unsetenv("WATCHDOG_USEC")
+	require.Equal(t, 30*time.Second, sdWatchdogInterval())
+
+	os.Setenv("WATCHDOG_PID", "-1")
+	defer os.Unsetenv("WATCHDOG_PID")
+	require.Equal(t, time.Duration(0), sdWatchdogInterval())
+}
+
+func TestSdWatchdog(t *testing.T) {
+	tmp, err := ioutil.TempDir("", "taskcluster-worker-sdnotify-")
+	require.NoError(t, err)
+	defer os.RemoveAll(tmp)
+
+	socket := filepath.Join(tmp, "notify.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	var alive atomics.Bool
+	done := make(chan struct{})
+	defer close(done)
+	go sdWatchdog(20*time.Millisecond, alive.Get, done)
+
+	// No keepalives are sent while the worker isn't alive
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = conn.Read(buf)
+	require.Error(t, err)
+
+	alive.Set(true)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "WATCHDOG=1", string(buf[:n]))
+}
@@ -8,6 +8,7 @@ import (
 	"github.com/takama/daemon"
 	"github.com/taskcluster/taskcluster-worker/config"
 	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/limits"
 	"github.com/taskcluster/taskcluster-worker/runtime/monitoring"
 	"github.com/taskcluster/taskcluster-worker/worker"
 )
@@ -26,19 +27,55 @@ func (svc *service) Run(monitor runtime.Monitor) (string, error) {
 		return "Failed to open configuration file", err
 	}
 
+	// Apply process tuning before creating engines, so it's inherited by
+	// processes spawned by engines.
+	if options, ok := config.(map[string]interface{})["daemon"]; ok {
+		if err = limits.Apply(options); err != nil {
+			monitor.ReportError(err, "Failed to apply daemon process tuning")
+			return "Failed to apply daemon process tuning", err
+		}
+	}
+
 	w, err := worker.New(config)
 	if err != nil {
 		monitor.ReportError(err, "Could not create worker")
 		return "Could not create worker", err
 	}
 
-	sigTerm := make(chan os.Signal, 1)
-	signal.Notify(sigTerm, os.Interrupt, syscall.SIGTERM)
+	// SIGTERM (sent by systemd when stopping the service) stops the worker
+	// gracefully, draining active tasks. SIGINT or a second SIGTERM stops now.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 	go func() {
-		<-sigTerm
-		w.StopNow()
+		stopping := false
+		for sig := range signals {
+			if sig == syscall.SIGTERM && !stopping {
+				stopping = true
+				monitor.Info("received SIGTERM, stopping gracefully")
+				if err := sdNotify("STOPPING=1\nSTATUS=Waiting for active tasks to finish"); err != nil {
+					monitor.ReportWarning(err, "failed to notify systemd")
+				}
+				w.StopGracefully()
+				continue
+			}
+			monitor.Infof("received %s, stopping now", sig)
+			w.StopNow()
+		}
 	}()
 
+	// Send watchdog keepalives while the worker makes progress, if systemd
+	// watchdog is enabled
+	done := make(chan struct{})
+	defer close(done)
+	if interval := sdWatchdogInterval(); interval != 0 {
+		go sdWatchdog(interval, func() bool { return w.Alive(interval) }, done)
+	}
+
+	// Tell systemd that we are ready, if we are running as Type=notify service
+	if err := sdNotify("READY=1\nSTATUS=Processing tasks"); err != nil {
+		monitor.ReportWarning(err, "failed to notify systemd")
+	}
+
 	w.Start()
 	return "Worker successfully started", nil
 }
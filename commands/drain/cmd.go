@@ -0,0 +1,133 @@
+// Package drain implements a command for migrating running tasks to another
+// worker through the localhost control API, before planned host maintenance.
+package drain
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/taskcluster/taskcluster-worker/commands"
+	"github.com/taskcluster/taskcluster-worker/worker"
+)
+
+func init() {
+	commands.Register("drain", cmd{})
+}
+
+type cmd struct{}
+
+func (cmd) Summary() string {
+	return "Migrate running tasks to another worker, before host maintenance"
+}
+
+func (cmd) Usage() string {
+	return `
+taskcluster-worker drain asks a worker running on this host, through the
+control API, to stop claiming tasks and migrate all running tasks to the worker
+at <target>, given as 'host:port' where port is the 'migration.port' of the
+target worker. Tasks are migrated one at the time, and execution continues on
+the target worker without the tasks being restarted.
+
+Tasks that can't be migrated, because the engine or the task uses features
+that don't support migration, continue on this host. The worker stops when
+they are done, and this command exits non-zero if any task wasn't migrated.
+
+Migration must be configured with the 'migration' option on both workers, and
+they must have the same 'provisionerId' and 'workerType'. The control API must
+be enabled with the 'controlPort' configuration option, and is only exposed on
+localhost. Requests are authenticated with the token the worker writes to the
+file given in the 'controlTokenFile' option.
+
+usage:
+  taskcluster-worker drain [options] --token-file <file> <target>
+
+options:
+  -t --token-file <file>  File with the control API token, see 'controlTokenFile'.
+  -p --port <port>        Port the control API is exposed on [default: 60023].
+  -j --json               Print report as JSON.
+  -h --help               Show this screen.
+
+examples:
+  taskcluster-worker drain --token-file /var/run/tc-worker-control.token worker-2.example.com:60024
+`
+}
+
+func (cmd) Execute(args map[string]interface{}) bool {
+	port, err := strconv.Atoi(args["--port"].(string))
+	if err != nil || port <= 0 || port > 65535 {
+		fmt.Println("Invalid port: ", args["--port"])
+		return false
+	}
+	target := args["<target>"].(string)
+	if !strings.Contains(target, ":") {
+		fmt.Printf("Invalid <target>: '%s', expected 'host:port'\n", target)
+		return false
+	}
+
+	token, err := ioutil.ReadFile(args["--token-file"].(string))
+	if err != nil {
+		fmt.Println("Failed to read control API token, error: ", err)
+		return false
+	}
+
+	// Migrating tasks may take a long time, as disks and memory are transferred
+	u := fmt.Sprintf("http://127.0.0.1:%d/drain?target=%s", port, url.QueryEscape(target))
+	req, _ := http.NewRequest(http.MethodPost, u, nil)
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	c := http.Client{Timeout: 24 * time.Hour}
+	res, err := c.Do(req)
+	if err != nil {
+		fmt.Printf("Failed to reach worker on localhost:%d, is the control API enabled? error: %s\n", port, err)
+		return false
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		fmt.Println("Failed to read response from control API, error: ", err)
+		return false
+	}
+	if res.StatusCode != http.StatusOK {
+		fmt.Printf("Drain failed, status: %d, response: %s\n", res.StatusCode, string(data))
+		return false
+	}
+
+	var r worker.DrainReport
+	if err = json.Unmarshal(data, &r); err != nil {
+		fmt.Println("Failed to parse response from control API, error: ", err)
+		return false
+	}
+
+	if args["--json"].(bool) {
+		data, _ = json.MarshalIndent(r, "", "  ")
+		fmt.Println(string(data))
+	} else {
+		printReport(r)
+	}
+	for _, t := range r.Tasks {
+		if !t.Migrated {
+			return false
+		}
+	}
+	return true
+}
+
+func printReport(r worker.DrainReport) {
+	migrated := 0
+	fmt.Printf("Migrating %d tasks to %s:\n", len(r.Tasks), r.Target)
+	for _, t := range r.Tasks {
+		if t.Migrated {
+			migrated++
+			fmt.Printf("  %s/%d  migrated\n", t.TaskID, t.RunID)
+		} else {
+			fmt.Printf("  %s/%d  failed: %s\n", t.TaskID, t.RunID, t.Error)
+		}
+	}
+	fmt.Println("")
+	fmt.Printf("%d of %d tasks migrated, the worker stops when remaining tasks are done\n", migrated, len(r.Tasks))
+}
@@ -0,0 +1,130 @@
+// Package gc implements a command for triggering garbage collection in a
+// running worker through the localhost control API.
+package gc
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	units "github.com/docker/go-units"
+	"github.com/taskcluster/taskcluster-worker/commands"
+	"github.com/taskcluster/taskcluster-worker/worker"
+)
+
+func init() {
+	commands.Register("gc", cmd{})
+}
+
+type cmd struct{}
+
+func (cmd) Summary() string {
+	return "Trigger garbage collection in a running worker"
+}
+
+func (cmd) Usage() string {
+	return `
+taskcluster-worker gc asks a worker running on this host, through the control
+API, to dispose cached resources such as images, caches and downloads, until
+<free-space> is available on the disk holding the temporary folder. Resources
+currently in use will not be disposed, and resources are disposed in the same
+order as the worker would, low priority and least-recently-used first.
+
+If <free-space> is omitted all resources not in use will be disposed. This is
+useful for recovering from a full disk without restarting the worker.
+
+The control API must be enabled with the 'controlPort' configuration option,
+and is only exposed on localhost. Requests are authenticated with the token
+the worker writes to the file given in the 'controlTokenFile' option.
+
+usage:
+  taskcluster-worker gc [options] --token-file <file> [<free-space>]
+
+options:
+  -t --token-file <file>  File with the control API token, see 'controlTokenFile'.
+  -p --port <port>        Port the control API is exposed on [default: 60023].
+  -j --json               Print report as JSON.
+  -h --help               Show this screen.
+
+examples:
+  taskcluster-worker gc --token-file /var/run/tc-worker-control.token 20GB
+`
+}
+
+func (cmd) Execute(args map[string]interface{}) bool {
+	port, err := strconv.Atoi(args["--port"].(string))
+	if err != nil || port <= 0 || port > 65535 {
+		fmt.Println("Invalid port: ", args["--port"])
+		return false
+	}
+	var freeSpace int64
+	if s, ok := args["<free-space>"].(string); ok {
+		freeSpace, err = units.FromHumanSize(s)
+		if err != nil || freeSpace < 0 {
+			fmt.Printf("Invalid <free-space>: '%s', expected a size such as '20GB'\n", s)
+			return false
+		}
+	}
+
+	token, err := ioutil.ReadFile(args["--token-file"].(string))
+	if err != nil {
+		fmt.Println("Failed to read control API token, error: ", err)
+		return false
+	}
+
+	// Garbage collection may take a while, when disposing docker images etc.
+	u := fmt.Sprintf("http://127.0.0.1:%d/gc?freeSpace=%d", port, freeSpace)
+	req, _ := http.NewRequest(http.MethodPost, u, nil)
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	c := http.Client{Timeout: 30 * time.Minute}
+	res, err := c.Do(req)
+	if err != nil {
+		fmt.Printf("Failed to reach worker on localhost:%d, is the control API enabled? error: %s\n", port, err)
+		return false
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		fmt.Println("Failed to read response from control API, error: ", err)
+		return false
+	}
+	if res.StatusCode != http.StatusOK {
+		fmt.Printf("Garbage collection failed, status: %d, response: %s\n", res.StatusCode, string(data))
+		return false
+	}
+
+	var r worker.GarbageCollectionReport
+	if err = json.Unmarshal(data, &r); err != nil {
+		fmt.Println("Failed to parse response from control API, error: ", err)
+		return false
+	}
+
+	if args["--json"].(bool) {
+		data, _ = json.MarshalIndent(r, "", "  ")
+		fmt.Println(string(data))
+		return true
+	}
+
+	printReport(r)
+	return r.FreeSpace == 0 || r.DiskFreeAfter >= uint64(r.FreeSpace)
+}
+
+func printReport(r worker.GarbageCollectionReport) {
+	var total uint64
+	fmt.Printf("Evicted %d resources:\n", len(r.Evicted))
+	for _, e := range r.Evicted {
+		total += e.DiskSize
+		fmt.Printf("  %10s  %s (last used %s)\n",
+			units.HumanSize(float64(e.DiskSize)), e.Description, e.LastUsed.Format(time.RFC3339))
+	}
+	fmt.Println("")
+	fmt.Printf("disk free before: %s\n", units.HumanSize(float64(r.DiskFreeBefore)))
+	fmt.Printf("disk free after:  %s (%s evicted)\n", units.HumanSize(float64(r.DiskFreeAfter)), units.HumanSize(float64(total)))
+	if r.FreeSpace != 0 && r.DiskFreeAfter < uint64(r.FreeSpace) {
+		fmt.Printf("Unable to free %s, remaining resources are in use\n", units.HumanSize(float64(r.FreeSpace)))
+	}
+}
@@ -0,0 +1,205 @@
+// Package image implements commands for inspecting, extracting, verifying and
+// converting image archives for the QEMU engine.
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	units "github.com/docker/go-units"
+	qemuimage "github.com/taskcluster/taskcluster-worker/engines/qemu/image"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+type cmd struct{}
+
+func (cmd) Summary() string {
+	return "Inspect, extract, verify or convert QEMU image archives"
+}
+
+func (cmd) Usage() string {
+	return `
+taskcluster-worker image operates on image archives for the QEMU engine, the
+images are validated in the same way the QEMU engine validates images before
+use. This allows for debugging image pipelines without booting a VM. The
+<image> may be a file or an http:// or https:// URL to download it from.
+
+The "inspect" command prints the machine definition, archive digests, the
+compressed and virtual sizes, and 'qemu-img info' for the disk files contained
+in the archive, including the backing chain.
+
+The "extract" command extracts the files from the archive into <folder>.
+
+The "verify" command validates the archive, and if --sha256 or --sha512 is
+given checks that the archive has the given digest. If --signature is given,
+it checks that the signature is an ed25519 signature of 'sha512:<hex>' or
+'sha256:<hex>' made with --key, as used for signed images in task payloads.
+Exits non-zero, if verification fails.
+
+The "convert" command flattens the disk files from the archive into a single
+disk image in the given format, such that it can be used with other tools.
+
+usage:
+  taskcluster-worker image inspect [--json] <image>
+  taskcluster-worker image extract <image> <folder>
+  taskcluster-worker image verify [--sha256 <hash>] [--sha512 <hash>]
+                                  [--signature <signature> --key <key>] <image>
+  taskcluster-worker image convert [--format <format>] <image> <output>
+
+options:
+  -j --json             Print information as JSON.
+     --sha256 <hash>    Expected hex encoded sha256 digest of the archive.
+     --sha512 <hash>    Expected hex encoded sha512 digest of the archive.
+     --signature <signature>
+                        Base64 encoded ed25519 signature of the archive digest.
+     --key <key>        Base64 encoded ed25519 public key to check the
+                        signature with.
+     --format <format>  Format to convert to, one of: qcow2, raw, vmdk, vdi
+                        [default: qcow2].
+  -h --help             Show this screen.
+`
+}
+
+func (cmd) Execute(args map[string]interface{}) bool {
+	source := args["<image>"].(string)
+
+	// Create a temporary folder for downloading and extracting the image
+	tempFolder, err := ioutil.TempDir("", "taskcluster-worker-image-")
+	if err != nil {
+		fmt.Println("Failed to create temporary folder, error: ", err)
+		return false
+	}
+	defer os.RemoveAll(tempFolder)
+
+	// Download the image, if given as URL
+	if isURL(source) {
+		fmt.Printf("Downloading %s\n", source)
+	}
+	imageFile, err := fetchImage(source, tempFolder)
+	if err != nil {
+		fmt.Println("FAIL: ", err)
+		return false
+	}
+
+	// extract writes directly to the target folder
+	if args["extract"].(bool) {
+		folder := args["<folder>"].(string)
+		if err = os.MkdirAll(folder, 0777); err != nil {
+			fmt.Println("Failed to create folder, error: ", err)
+			return false
+		}
+		_, err = qemuimage.ExtractArchive(imageFile, folder)
+		if !reportError(err) {
+			return false
+		}
+		fmt.Printf("Extracted disk.img, layer.qcow2 and machine.json to %s\n", folder)
+		return true
+	}
+
+	// Other commands extract to a sub-folder of the temporary folder
+	folder := filepath.Join(tempFolder, "image")
+	if err = os.Mkdir(folder, 0777); err != nil {
+		fmt.Println("Failed to create temporary folder, error: ", err)
+		return false
+	}
+
+	switch {
+	case args["inspect"].(bool):
+		info, err := qemuimage.InspectArchive(imageFile, folder)
+		if !reportError(err) {
+			return false
+		}
+		if args["--json"].(bool) {
+			data, _ := json.MarshalIndent(info, "", "  ")
+			fmt.Println(string(data))
+		} else {
+			printInfo(info)
+		}
+		return true
+
+	case args["verify"].(bool):
+		info, err := qemuimage.InspectArchive(imageFile, folder)
+		if !reportError(err) {
+			return false
+		}
+		if hash, ok := args["--sha256"].(string); ok && !strings.EqualFold(hash, info.SHA256) {
+			fmt.Printf("FAIL: archive has sha256: %s, expected: %s\n", info.SHA256, hash)
+			return false
+		}
+		if hash, ok := args["--sha512"].(string); ok && !strings.EqualFold(hash, info.SHA512) {
+			fmt.Printf("FAIL: archive has sha512: %s, expected: %s\n", info.SHA512, hash)
+			return false
+		}
+		if signature, ok := args["--signature"].(string); ok {
+			message, serr := verifySignature(info, args["--key"].(string), signature)
+			if serr != nil {
+				fmt.Println("FAIL: ", serr)
+				return false
+			}
+			fmt.Printf("Signature of '%s' is valid\n", message)
+		}
+		fmt.Printf("OK: %s (sha256: %s)\n", source, info.SHA256)
+		return true
+
+	case args["convert"].(bool):
+		if _, err = qemuimage.ExtractArchive(imageFile, folder); !reportError(err) {
+			return false
+		}
+		format := args["--format"].(string)
+		output := args["<output>"].(string)
+		if err = qemuimage.ConvertImage(folder, format, output); err != nil {
+			fmt.Println("Failed to convert image, error: ", err)
+			return false
+		}
+		fmt.Printf("Wrote %s image to %s\n", format, output)
+		return true
+	}
+	panic("unknown image subcommand")
+}
+
+// reportError prints err and returns false, if err is non-nil
+func reportError(err error) bool {
+	if e, ok := runtime.IsMalformedPayloadError(err); ok {
+		fmt.Println("FAIL: invalid image archive:")
+		for _, msg := range e.Messages() {
+			fmt.Println("  ", msg)
+		}
+		return false
+	}
+	if err != nil {
+		fmt.Println("FAIL: failed to read image archive, error: ", err)
+		return false
+	}
+	return true
+}
+
+func printInfo(info *qemuimage.ArchiveInfo) {
+	fmt.Printf("compressed size: %s\n", units.HumanSize(float64(info.Size)))
+	fmt.Printf("virtual size:    %s\n", units.HumanSize(float64(info.Files["layer.qcow2"].VirtualSize)))
+	fmt.Printf("archive sha256:  %s\n", info.SHA256)
+	fmt.Printf("archive sha512:  %s\n", info.SHA512)
+	fmt.Println("")
+
+	for _, name := range []string{"disk.img", "layer.qcow2"} {
+		d := info.Files[name]
+		fmt.Printf("%s:\n", name)
+		fmt.Printf("  format:       %s\n", d.Format)
+		fmt.Printf("  virtual size: %s\n", units.HumanSize(float64(d.VirtualSize)))
+		fmt.Printf("  actual size:  %s\n", units.HumanSize(float64(d.ActualSize)))
+		if d.BackingFile != "" {
+			fmt.Printf("  backing file: %s (%s)\n", d.BackingFile, d.BackingFormat)
+		}
+		fmt.Printf("  dirty flag:   %t\n", d.DirtyFlag)
+		fmt.Printf("  snapshots:    %d\n", d.Snapshots)
+		fmt.Printf("  sha256:       %s\n", d.SHA256)
+	}
+	fmt.Println("")
+
+	data, _ := json.MarshalIndent(info.Machine, "", "  ")
+	fmt.Println("machine.json:")
+	fmt.Println(string(data))
+}
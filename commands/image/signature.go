@@ -0,0 +1,31 @@
+package image
+
+import (
+	"encoding/base64"
+
+	"github.com/pkg/errors"
+	qemuimage "github.com/taskcluster/taskcluster-worker/engines/qemu/image"
+	"golang.org/x/crypto/ed25519"
+)
+
+// verifySignature checks that signature is a base64 encoded ed25519 signature
+// of 'sha512:<hex>' or 'sha256:<hex>' for the archive, made with the base64
+// encoded public key given. This is how signed images are referenced in task
+// payloads for the QEMU engine. Returns the message that was signed.
+func verifySignature(info *qemuimage.ArchiveInfo, key, signature string) (string, error) {
+	k, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(k) != ed25519.PublicKeySize {
+		return "", errors.New("--key isn't a base64 encoded ed25519 public key")
+	}
+	s, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(s) != ed25519.SignatureSize {
+		return "", errors.New("--signature isn't a base64 encoded ed25519 signature")
+	}
+
+	for _, message := range []string{"sha512:" + info.SHA512, "sha256:" + info.SHA256} {
+		if ed25519.Verify(ed25519.PublicKey(k), []byte(message), s) {
+			return message, nil
+		}
+	}
+	return "", errors.New("signature doesn't match the sha256 or sha512 digest of the archive")
+}
@@ -0,0 +1,72 @@
+package image
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	qemuimage "github.com/taskcluster/taskcluster-worker/engines/qemu/image"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestVerifySignature(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key := base64.StdEncoding.EncodeToString(public)
+	sign := func(message string) string {
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(private, []byte(message)))
+	}
+	info := &qemuimage.ArchiveInfo{
+		SHA256: strings.Repeat("a", 64),
+		SHA512: strings.Repeat("b", 128),
+	}
+
+	message, err := verifySignature(info, key, sign("sha256:"+info.SHA256))
+	require.NoError(t, err)
+	require.Equal(t, "sha256:"+info.SHA256, message)
+
+	message, err = verifySignature(info, key, sign("sha512:"+info.SHA512))
+	require.NoError(t, err)
+	require.Equal(t, "sha512:"+info.SHA512, message)
+
+	_, err = verifySignature(info, key, sign("sha256:"+strings.Repeat("c", 64)))
+	require.Error(t, err)
+	_, err = verifySignature(info, "not-a-key", sign("sha256:"+info.SHA256))
+	require.Error(t, err)
+	_, err = verifySignature(info, key, "not-a-signature")
+	require.Error(t, err)
+}
+
+func TestFetchImage(t *testing.T) {
+	folder, err := ioutil.TempDir("", "image-fetch-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/image.tar.zst" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("image-data"))
+	}))
+	defer s.Close()
+
+	imageFile, err := fetchImage("local/image.tar.zst", folder)
+	require.NoError(t, err)
+	require.Equal(t, "local/image.tar.zst", imageFile)
+
+	imageFile, err = fetchImage(s.URL+"/image.tar.zst", folder)
+	require.NoError(t, err)
+	data, err := ioutil.ReadFile(imageFile)
+	require.NoError(t, err)
+	require.Equal(t, "image-data", string(data))
+
+	_, err = fetchImage(s.URL+"/missing.tar.zst", folder)
+	require.Error(t, err)
+}
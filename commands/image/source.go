@@ -0,0 +1,47 @@
+package image
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// isURL returns true, if source is an http:// or https:// URL
+func isURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+// fetchImage returns the image file for source, if source is a URL the image
+// is downloaded to folder first.
+func fetchImage(source, folder string) (string, error) {
+	if !isURL(source) {
+		return source, nil
+	}
+
+	res, err := http.Get(source)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to fetch image")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", errors.Errorf("failed to fetch image from %s, status: %s", source, res.Status)
+	}
+
+	imageFile := filepath.Join(folder, "image.tar.zst")
+	f, err := os.Create(imageFile)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create image file")
+	}
+	defer f.Close()
+	if _, err = io.Copy(f, res.Body); err != nil {
+		return "", errors.Wrap(err, "failed to download image")
+	}
+	if err = f.Close(); err != nil {
+		return "", errors.Wrap(err, "failed to write image file")
+	}
+	return imageFile, nil
+}
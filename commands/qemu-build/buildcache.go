@@ -0,0 +1,161 @@
+package qemubuild
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+// indexBaseURL is the baseUrl for taskcluster-index, images are fetched from
+// the index without credentials, so indexed images must be public.
+var indexBaseURL = "https://index.taskcluster.net/v1"
+
+// inputHash returns the hex encoded sha256 of the contents of files and the
+// options given. File names are not included, so the same input files give the
+// same hash, regardless of where they are stored.
+func inputHash(files []string, options ...string) (string, error) {
+	h := sha256.New()
+	for _, option := range options {
+		fmt.Fprintf(h, "option:%s\n", option)
+	}
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to open input file '%s'", file)
+		}
+		fh := sha256.New()
+		_, err = io.Copy(fh, f)
+		f.Close()
+		if err != nil {
+			return "", errors.Wrapf(err, "failed to read input file '%s'", file)
+		}
+		fmt.Fprintf(h, "file:%s\n", hex.EncodeToString(fh.Sum(nil)))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// buildCache finds images previously built from the same inputs, in a local
+// folder and/or indexed under '<namespace>.<input-hash>'.
+type buildCache struct {
+	Folder    string // local folder with '<input-hash>.tar.zst', if non-empty
+	Namespace string // index namespace, if non-empty
+	Artifact  string // name of image artifact for indexed tasks
+}
+
+// Fetch writes the image built from inputs with hash to outputFile, returns
+// false if no such image was found.
+func (c *buildCache) Fetch(hash, outputFile string) (bool, error) {
+	if c.Folder != "" {
+		f, err := os.Open(filepath.Join(c.Folder, hash+".tar.zst"))
+		if err == nil {
+			defer f.Close()
+			return true, writeFile(outputFile, f)
+		}
+		if !os.IsNotExist(err) {
+			return false, errors.Wrap(err, "failed to open cached image")
+		}
+	}
+
+	if c.Namespace != "" {
+		u := fmt.Sprintf("%s/task/%s.%s/artifacts/%s", indexBaseURL, c.Namespace, hash, c.Artifact)
+		res, err := http.Get(u)
+		if err != nil {
+			return false, errors.Wrap(err, "failed to fetch indexed image")
+		}
+		defer res.Body.Close()
+		if res.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		if res.StatusCode != http.StatusOK {
+			return false, errors.Errorf("failed to fetch indexed image from %s, status: %s", u, res.Status)
+		}
+		return true, writeFile(outputFile, res.Body)
+	}
+
+	return false, nil
+}
+
+// Store copies outputFile to the local folder as the image built from inputs
+// with hash, if a local folder is configured.
+func (c *buildCache) Store(hash, outputFile string) error {
+	if c.Folder == "" {
+		return nil
+	}
+	if err := os.MkdirAll(c.Folder, 0777); err != nil {
+		return errors.Wrap(err, "failed to create cache folder")
+	}
+	f, err := os.Open(outputFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to open image")
+	}
+	defer f.Close()
+	return writeFile(filepath.Join(c.Folder, hash+".tar.zst"), f)
+}
+
+// writeFile writes r to a temporary file and renames it to file, such that
+// file is never partially written.
+func writeFile(file string, r io.Reader) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+"-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temporary file")
+	}
+	_, err = io.Copy(tmp, r)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), file)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return errors.Wrapf(err, "failed to write '%s'", file)
+	}
+	return nil
+}
+
+// withCache returns the image built from files and options, if found in
+// cache, otherwise it calls build and stores the image built in cache. The
+// input hash is logged, so image build tasks can index the image.
+func withCache(
+	monitor runtime.Monitor,
+	cache buildCache,
+	outputFile string,
+	files []string,
+	options []string,
+	build func() error,
+) bool {
+	if cache.Folder == "" && cache.Namespace == "" {
+		return build() == nil
+	}
+
+	hash, err := inputHash(files, options...)
+	if err != nil {
+		monitor.Error("Failed to hash inputs, error: ", err)
+		return false
+	}
+	monitor.Info("Input hash: ", hash)
+
+	found, err := cache.Fetch(hash, outputFile)
+	if err != nil {
+		monitor.Warn("Failed to fetch cached image, building it, error: ", err)
+	} else if found {
+		monitor.Info("Reusing image built from the same inputs")
+		return true
+	}
+
+	if err = build(); err != nil {
+		return false
+	}
+	if err = cache.Store(hash, outputFile); err != nil {
+		monitor.Warn("Failed to store image in cache, error: ", err)
+	}
+	return true
+}
@@ -0,0 +1,97 @@
+package qemubuild
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/runtime/mocks"
+)
+
+func TestInputHash(t *testing.T) {
+	folder, err := ioutil.TempDir("", "qemu-build-cache-")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+
+	a := filepath.Join(folder, "a.iso")
+	b := filepath.Join(folder, "b.iso")
+	require.NoError(t, ioutil.WriteFile(a, []byte("hello"), 0600))
+	require.NoError(t, ioutil.WriteFile(b, []byte("hello"), 0600))
+
+	h1, err := inputHash([]string{a}, "from-new")
+	require.NoError(t, err)
+	h2, err := inputHash([]string{b}, "from-new")
+	require.NoError(t, err)
+	require.Equal(t, h1, h2, "file names shouldn't matter")
+
+	h3, err := inputHash([]string{a}, "from-image")
+	require.NoError(t, err)
+	require.NotEqual(t, h1, h3)
+
+	require.NoError(t, ioutil.WriteFile(b, []byte("world"), 0600))
+	h4, err := inputHash([]string{b}, "from-new")
+	require.NoError(t, err)
+	require.NotEqual(t, h1, h4)
+
+	_, err = inputHash([]string{filepath.Join(folder, "missing")})
+	require.Error(t, err)
+}
+
+func TestBuildCache(t *testing.T) {
+	folder, err := ioutil.TempDir("", "qemu-build-cache-")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/task/project.images.indexed-hash/artifacts/public/image.tar.zst" {
+			w.Write([]byte("indexed image"))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer s.Close()
+	defer func(u string) { indexBaseURL = u }(indexBaseURL)
+	indexBaseURL = s.URL
+
+	monitor := mocks.NewMockMonitor(true)
+	cache := buildCache{
+		Folder:    filepath.Join(folder, "cache"),
+		Namespace: "project.images",
+		Artifact:  "public/image.tar.zst",
+	}
+	outputFile := filepath.Join(folder, "image.tar.zst")
+	input := filepath.Join(folder, "machine.json")
+	require.NoError(t, ioutil.WriteFile(input, []byte("{}"), 0600))
+
+	builds := 0
+	build := func() error {
+		builds++
+		return ioutil.WriteFile(outputFile, []byte("built image"), 0600)
+	}
+
+	// Build and store in cache, then reuse from cache
+	require.True(t, withCache(monitor, cache, outputFile, []string{input}, nil, build))
+	require.Equal(t, 1, builds)
+	require.NoError(t, os.Remove(outputFile))
+	require.True(t, withCache(monitor, cache, outputFile, []string{input}, nil, build))
+	require.Equal(t, 1, builds, "expected image to be reused from cache")
+	data, err := ioutil.ReadFile(outputFile)
+	require.NoError(t, err)
+	require.Equal(t, "built image", string(data))
+
+	// Fetch from index
+	found, err := (&buildCache{Namespace: "project.images", Artifact: "public/image.tar.zst"}).Fetch("indexed-hash", outputFile)
+	require.NoError(t, err)
+	require.True(t, found)
+	data, err = ioutil.ReadFile(outputFile)
+	require.NoError(t, err)
+	require.Equal(t, "indexed image", string(data))
+
+	found, err = (&buildCache{Namespace: "project.images", Artifact: "public/image.tar.zst"}).Fetch("other-hash", outputFile)
+	require.NoError(t, err)
+	require.False(t, found)
+}
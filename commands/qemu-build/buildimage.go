@@ -7,11 +7,14 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	schematypes "github.com/taskcluster/go-schematypes"
 	"github.com/taskcluster/taskcluster-worker/commands/qemu-run"
 	"github.com/taskcluster/taskcluster-worker/engines/qemu/image"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/metaservice"
 	"github.com/taskcluster/taskcluster-worker/engines/qemu/network"
 	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
 	"github.com/taskcluster/taskcluster-worker/runtime"
@@ -21,6 +24,9 @@ import (
 
 var debug = util.Debug("qemubuild")
 
+// buildImage boots a virtual machine from a new or existing image, and packages
+// the image to outputFile once the guest powers off. If done is non-nil the
+// guest may also signal that it's done, see completion.
 func buildImage(
 	monitor runtime.Monitor,
 	inputFile, outputFile string,
@@ -29,6 +35,8 @@ func buildImage(
 	boot, cdrom string,
 	linuxBootOptions vm.LinuxBootOptions,
 	size int,
+	compression image.Compression,
+	done *completion,
 ) error {
 	// Find absolute outputFile
 	outputFile, err := filepath.Abs(outputFile)
@@ -87,7 +95,40 @@ func buildImage(
 
 	// Setup logService so that logs can be posted to meta-service at:
 	// http://169.254.169.254/engine/v1/log
-	net.SetHandler(&logService{Destination: os.Stdout})
+	logs := &logService{Destination: os.Stdout}
+	doneRequested := make(chan struct{}, 1)
+	failed := make(chan error, 1)
+	var timeout <-chan time.Time
+	if done != nil {
+		// Non-interactive builds may also signal they're done with a POST to:
+		// http://169.254.169.254/engine/v1/done
+		logs.Done = doneRequested
+		logs.Sentinel = done.Sentinel
+		timer := time.NewTimer(done.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	if done != nil && done.Command != nil {
+		// Serve the meta-data service, so guest-tools runs the command
+		storage, serr := runtime.NewTemporaryStorage(tempFolder)
+		if serr != nil {
+			monitor.Error("Failed to create temporary storage, error: ", serr)
+			return serr
+		}
+		environment := &runtime.Environment{TemporaryStorage: storage}
+		net.SetHandler(metaservice.New(done.Command, done.Env, os.Stdout, func(result bool) {
+			if result {
+				notify(doneRequested)
+				return
+			}
+			select {
+			case failed <- errors.New("The setup script failed, see log for details"):
+			default:
+			}
+		}, environment))
+	} else {
+		net.SetHandler(logs)
+	}
 
 	// Create virtual machine
 	monitor.Info("Creating virtual machine")
@@ -101,10 +142,29 @@ func buildImage(
 		return err
 	}
 
+	// Abort, if the host runs out of space
+	machine.SetEventHandler(func(e vm.Event) {
+		if ferr := blockIOError(e); ferr != nil {
+			select {
+			case failed <- ferr:
+			default:
+			}
+		}
+	})
+
 	// Start the virtual machine
 	monitor.Info("Starting virtual machine")
 	machine.Start()
 
+	// Report progress, and abort if the guest fills the disk
+	var progress sync.WaitGroup
+	progressDone := make(chan struct{})
+	progress.Add(1)
+	go func() {
+		defer progress.Done()
+		reportProgress(monitor, machine, img, failed, progressDone)
+	}()
+
 	// Expose VNC socket
 	if vncPort != 0 {
 		go qemurun.ExposeVNC(machine.VNCSocket(), vncPort, machine.Done)
@@ -114,15 +174,28 @@ func buildImage(
 	interrupted := make(chan os.Signal, 1)
 	signal.Notify(interrupted, os.Interrupt)
 
-	// Wait for virtual machine to be done, or we get interrupted
+	// Wait for virtual machine to be done, we get interrupted or fail
 	select {
 	case <-interrupted:
 		machine.Kill()
 		err = errors.New("SIGINT received, aborting virtual machine")
+	case err = <-failed:
+		monitor.Error(err)
+		machine.Kill()
+	case <-doneRequested:
+		monitor.Info("Guest signaled that it's done, powering down")
+		machine.Shutdown(shutdownGracePeriod)
+		err = machine.Error
+	case <-timeout:
+		err = errors.Errorf("The guest didn't finish within %s", done.Timeout)
+		monitor.Error(err)
+		machine.Kill()
 	case <-machine.Done:
 		err = machine.Error
 	}
 	<-machine.Done
+	close(progressDone)
+	progress.Wait()
 	signal.Stop(interrupted)
 	defer img.Dispose()
 
@@ -134,9 +207,18 @@ func buildImage(
 		return err
 	}
 
+	// Compact the disk, so deleted files don't take up space in the image
+	monitor.Info("Compacting virtual machine image")
+	reclaimed, err := img.Compact()
+	if err != nil {
+		monitor.Error("Failed to compact image, error: ", err)
+		return err
+	}
+	monitor.Infof("Reclaimed %d MiB by compacting the image", reclaimed/1024/1024)
+
 	// Package up the finished image
 	monitor.Info("Package virtual machine image")
-	err = img.Package(outputFile)
+	err = img.PackageWithCompression(outputFile, compression)
 	if err != nil {
 		monitor.Error("Failed to package finished image, error: ", err)
 		return err
@@ -145,7 +227,7 @@ func buildImage(
 	return nil
 }
 
-// load vm.Machine from file without migration
+// load vm.Machine from file, migrating it to the current format
 func newMachineFromFile(machineFile string) (*vm.Machine, error) {
 	// Read machine.json
 	machineData, err := ioext.BoundedReadFile(machineFile, 1024*1024)
@@ -164,6 +246,14 @@ func newMachineFromFile(machineFile string) (*vm.Machine, error) {
 			"Invalid JSON in 'machine.json', error: ", err)
 	}
 
+	// Migrate if possible
+	migrated := vm.MigrateMachineDefinition(data)
+	if migrated != nil {
+		// If this fails we want to show schema error against
+		// most recent schema.
+		data = migrated
+	}
+
 	// Validate against schema
 	verr := vm.MachineSchema.Validate(data)
 	if e, ok := verr.(*schematypes.ValidationError); ok {
@@ -178,6 +268,12 @@ func newMachineFromFile(machineFile string) (*vm.Machine, error) {
 	} else if verr != nil {
 		return nil, runtime.NewMalformedPayloadError("task.payload schema violation: ", verr)
 	}
+	if migrated == nil {
+		return nil, runtime.NewMalformedPayloadError(
+			"Invalid machine definition in 'machine.json', options 'display' and ",
+			"'devices' require 'version: 2'",
+		)
+	}
 
 	// Create machine
 	m := vm.NewMachine(data)
@@ -2,7 +2,9 @@ package qemubuild
 
 import (
 	"strconv"
+	"time"
 
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/image"
 	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
 	"github.com/taskcluster/taskcluster-worker/runtime/monitoring"
 )
@@ -19,9 +21,52 @@ taskcluster-worker qemu-build takes a machine definition as JSON or an existing
 image and two ISO files to mounted as CDs and creates a virtual machine that
 will be saved to disk when terminated.
 
+Before the image is packaged, blocks of zeros in the disk are deallocated. To
+keep images small, the guest should run 'qemu-guest-tools compact' before it
+shuts down, such that blocks of deleted files are freed or zeroed.
+
+The snapshot command boots an existing image and waits for the guest to request
+a snapshot by POST to http://169.254.169.254/engine/v1/snapshot. Then the
+running-state of the virtual machine is saved as an internal snapshot in
+layer.qcow2, such that the QEMU engine resumes from it instead of booting.
+
+The convert command converts a VMware or Hyper-V disk (vmdk, vhdx or vhd), or
+the disk from an OVA bundle, to an image with the given machine definition,
+using qemu-img convert. The image is packaged without booting it.
+
+With --script, from-image boots the image and guest-tools in the guest runs
+<file> as the task command, with the user guest-tools is configured to use.
+When the script succeeds the guest is powered down, and the image is
+packaged, if the script fails or doesn't finish within --timeout the build
+fails. This allows small changes to an image without interaction. The script
+is written to a temporary file and executed, so the guest must be able to run
+it from its shebang line, or with /bin/sh, and it can be at most 64 KiB.
+
+The install command builds an image without any interaction, for automated
+image builds. The files in the <provision> folder, such as a kickstart, preseed
+or autounattend.xml file, are written to an ISO with volume label --label,
+which is attached as cd-rom 2, while <installer.iso> is booted as cd-rom 1.
+Kickstart finds ks.cfg on a volume labeled OEMDRV, Windows setup finds
+autounattend.xml on any drive, cloud-init and Ubuntu autoinstall read a volume
+labeled cidata, and --kernel, --append and --initrd can be used for installers
+that must be given a kernel command line. The install is done when the guest
+powers off, POSTs to http://169.254.169.254/engine/v1/done, or posts a log
+containing --sentinel to http://169.254.169.254/engine/v1/log, for example with
+'qemu-guest-tools post-log'. If the install isn't done within --timeout the
+build fails.
+
+The --cache and --index options make qemu-build compute a hash of the input
+files and options, and skip the build, if an image built from the same inputs
+is found in the cache folder, or indexed under <ns>.<input-hash> with the
+--artifact name. Images built are stored in the cache folder, and the
+input hash is logged, so image build tasks can index the image.
+
 usage:
   taskcluster-worker qemu-build [options] from-new <machine.json> <result.tar.zst>
-  taskcluster-worker qemu-build [options] from-image <image.tar.zst> <result.tar.zst>
+  taskcluster-worker qemu-build [options] from-image [--script <file>] <image.tar.zst> <result.tar.zst>
+  taskcluster-worker qemu-build [options] snapshot <image.tar.zst> <result.tar.zst>
+  taskcluster-worker qemu-build [options] convert <machine.json> <disk> <result.tar.zst>
+  taskcluster-worker qemu-build [options] install <machine.json> <installer.iso> <provision> <result.tar.zst>
 
 options:
      --vnc <port>       Expose VNC on given port.
@@ -31,6 +76,16 @@ options:
      --kernel <image>   Multi-boot option -kernel for QEMU.
      --append <cmdline> Multi-boot option -append for QEMU.
      --initrd <file>    Multi-boot option -initrd for QEMU.
+     --name <snapshot>  Name of snapshot to save [default: booted].
+     --level <level>    zstd compression level from 1 to 22 [default: 3].
+     --threads <n>      Compression threads, 0 for one per core [default: 0].
+     --cache <folder>   Reuse images built from the same inputs in folder.
+     --index <ns>       Reuse images indexed under <ns>.<input-hash>.
+     --artifact <name>  Name of indexed image artifact [default: public/image.tar.zst].
+     --script <file>    Setup script for guest-tools to run in the image.
+     --label <label>    Volume label of the provisioning ISO [default: OEMDRV].
+     --sentinel <text>  Text in logs from the guest signaling install is done.
+     --timeout <min>    Minutes before an install or script is aborted [default: 180].
   -h --help             Show this screen.
 `
 }
@@ -43,6 +98,9 @@ func (cmd) Execute(arguments map[string]interface{}) bool {
 	outputFile := arguments["<result.tar.zst>"].(string)
 	fromNew := arguments["from-new"].(bool)
 	fromImage := arguments["from-image"].(bool)
+	snapshot := arguments["snapshot"].(bool)
+	convert := arguments["convert"].(bool)
+	install := arguments["install"].(bool)
 	var vncPort int64
 	var err error
 	if vnc, ok := arguments["--vnc"].(string); ok {
@@ -60,23 +118,135 @@ func (cmd) Execute(arguments map[string]interface{}) bool {
 	if size > 80 {
 		monitor.Panic("Images have a sanity limit of 80 GiB!")
 	}
+	level, err := strconv.ParseInt(arguments["--level"].(string), 10, 32)
+	if err != nil {
+		monitor.Panic("Couldn't parse --level, error: ", err)
+	}
+	threads, err := strconv.ParseInt(arguments["--threads"].(string), 10, 32)
+	if err != nil {
+		monitor.Panic("Couldn't parse --threads, error: ", err)
+	}
+	compression := image.Compression{Level: int(level), Threads: int(threads)}
+	if err = compression.Validate(); err != nil {
+		monitor.Panic("Invalid compression options, error: ", err)
+	}
+	cache := buildCache{Artifact: arguments["--artifact"].(string)}
+	cache.Folder, _ = arguments["--cache"].(string)
+	cache.Namespace, _ = arguments["--index"].(string)
+	kernel, _ := arguments["--kernel"].(string)
+	initrd, _ := arguments["--initrd"].(string)
+	cmdline, _ := arguments["--append"].(string)
+	linuxBootOptions := vm.LinuxBootOptions{
+		Kernel: kernel,
+		Append: cmdline,
+		Initrd: initrd,
+	}
+	// Only files given are hashed, so record which of kernel and initrd are
+	// given, options are only added if used to keep hashes of other builds
+	var bootFiles, bootOptions []string
+	if kernel != "" || initrd != "" || cmdline != "" {
+		for _, f := range []string{kernel, initrd} {
+			if f != "" {
+				bootFiles = append(bootFiles, f)
+			}
+		}
+		bootOptions = []string{
+			"kernel=" + strconv.FormatBool(kernel != ""),
+			"initrd=" + strconv.FormatBool(initrd != ""),
+			"append=" + cmdline,
+		}
+	}
+
+	if snapshot {
+		inputFile := arguments["<image.tar.zst>"].(string)
+		name := arguments["--name"].(string)
+		return withCache(monitor, cache, outputFile, []string{inputFile}, []string{"snapshot", name}, func() error {
+			return snapshotImage(monitor, inputFile, outputFile, int(vncPort), name, compression)
+		})
+	}
+	if convert {
+		machineFile := arguments["<machine.json>"].(string)
+		diskFile := arguments["<disk>"].(string)
+		return withCache(monitor, cache, outputFile, []string{machineFile, diskFile}, []string{"convert"}, func() error {
+			return convertImage(monitor, machineFile, diskFile, outputFile, compression)
+		})
+	}
+	timeout, err := strconv.ParseInt(arguments["--timeout"].(string), 10, 32)
+	if err != nil || timeout <= 0 {
+		monitor.Panic("Couldn't parse --timeout as a positive number of minutes")
+	}
+
+	if install {
+		machineFile := arguments["<machine.json>"].(string)
+		installer := arguments["<installer.iso>"].(string)
+		provision := arguments["<provision>"].(string)
+		label := arguments["--label"].(string)
+		sentinel, _ := arguments["--sentinel"].(string)
+		provisionFiles, provisionNames, err := folderFiles(provision)
+		if err != nil {
+			monitor.Error("Failed to read provisioning files, error: ", err)
+			return false
+		}
+		files := append([]string{machineFile, installer}, provisionFiles...)
+		files = append(files, bootFiles...)
+		options := []string{"install", "size=" + strconv.Itoa(int(size)), "label=" + label}
+		for _, name := range provisionNames {
+			options = append(options, "provision="+name)
+		}
+		options = append(options, bootOptions...)
+		return withCache(monitor, cache, outputFile, files, options, func() error {
+			return installImage(
+				monitor, machineFile, installer, provision, outputFile,
+				int(vncPort), label, linuxBootOptions,
+				int(size), compression, completion{
+					Sentinel: sentinel,
+					Timeout:  time.Duration(timeout) * time.Minute,
+				},
+			)
+		})
+	}
 	if fromNew == fromImage {
 		panic("Impossible arguments")
 	}
 
 	var inputFile string
+	options := []string{"from-image"}
 	if !fromImage {
 		inputFile = arguments["<machine.json>"].(string)
+		options = []string{"from-new", "size=" + strconv.Itoa(int(size))}
 	} else {
 		inputFile = arguments["<image.tar.zst>"].(string)
 	}
+	inputFiles := []string{inputFile}
+	for _, f := range []string{boot, cdrom} {
+		if f != "" {
+			inputFiles = append(inputFiles, f)
+		}
+	}
+	inputFiles = append(inputFiles, bootFiles...)
+	// Only files given are hashed, so record which of boot and cdrom are given
+	options = append(options, "boot="+strconv.FormatBool(boot != ""), "cdrom="+strconv.FormatBool(cdrom != ""))
+	options = append(options, bootOptions...)
 
-	linuxBootOptions := vm.LinuxBootOptions{}
+	// Run setup script with guest-tools, if given
+	var done *completion
+	if script, ok := arguments["--script"].(string); ok {
+		c, err := scriptCompletion(script, time.Duration(timeout)*time.Minute)
+		if err != nil {
+			monitor.Error("Failed to load setup script, error: ", err)
+			return false
+		}
+		done = &c
+		inputFiles = append(inputFiles, script)
+		options = append(options, "script=true")
+	}
 
-	return buildImage(
-		monitor, inputFile, outputFile,
-		fromImage, int(vncPort),
-		boot, cdrom, linuxBootOptions,
-		int(size),
-	) == nil
+	return withCache(monitor, cache, outputFile, inputFiles, options, func() error {
+		return buildImage(
+			monitor, inputFile, outputFile,
+			fromImage, int(vncPort),
+			boot, cdrom, linuxBootOptions,
+			int(size), compression, done,
+		)
+	})
 }
@@ -0,0 +1,66 @@
+package qemubuild
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/image"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+// convertImage converts diskFile, which may be a vmdk, vhdx or vhd disk or an
+// OVA bundle, to an image with the machine definition from machineFile, and
+// packages the image to outputFile without booting it.
+func convertImage(
+	monitor runtime.Monitor,
+	machineFile, diskFile, outputFile string,
+	compression image.Compression,
+) error {
+	// Find absolute outputFile
+	outputFile, err := filepath.Abs(outputFile)
+	if err != nil {
+		monitor.Error("Failed to resolve output file, error: ", err)
+		return err
+	}
+
+	// Read machine definition
+	machine, err := newMachineFromFile(machineFile)
+	if err != nil {
+		monitor.Error("Failed to load machine file from ", machineFile, " error: ", err)
+		return err
+	}
+
+	// Create temp folder for the image
+	tempFolder, err := ioutil.TempDir("", "taskcluster-worker-build-image-")
+	if err != nil {
+		monitor.Error("Failed to create temporary folder, error: ", err)
+		return err
+	}
+	defer os.RemoveAll(tempFolder)
+
+	// Convert disk, reporting progress for every 10 %
+	monitor.Info("Converting ", diskFile)
+	reported := -1
+	img, err := image.NewMutableImageFromDisk(diskFile, tempFolder, machine, func(progress float64) {
+		if step := int(progress * 10); step > reported {
+			reported = step
+			monitor.Infof("Converting %s - %d %%", filepath.Base(diskFile), step*10)
+		}
+	})
+	if err != nil {
+		monitor.Error("Failed to convert disk, error: ", err)
+		return err
+	}
+	defer img.Dispose()
+
+	// Package up the converted image
+	monitor.Info("Package virtual machine image")
+	err = img.PackageWithCompression(outputFile, compression)
+	if err != nil {
+		monitor.Error("Failed to package converted image, error: ", err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+package qemubuild
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/image"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+// shutdownGracePeriod is the time the guest is given to power down, after it
+// signaled that a non-interactive build is done.
+const shutdownGracePeriod = 5 * time.Minute
+
+// completion specifies how buildImage detects that a non-interactive build is
+// done, besides the guest powering off.
+//
+// If Command is non-nil, the meta-data service is served instead of logService,
+// such that guest-tools runs Command, and the build is done when Command
+// succeeds, or fails if Command fails.
+type completion struct {
+	Sentinel string            // text in logs from the guest signaling it's done
+	Timeout  time.Duration     // time after which the build is aborted
+	Command  []string          // command for guest-tools to run, if non-nil
+	Env      map[string]string // environment variables for Command
+}
+
+// isoTools are the commands we can create ISO files with, in order of
+// preference, these all accept the mkisofs options used.
+var isoTools = [][]string{
+	{"genisoimage"},
+	{"mkisofs"},
+	{"xorriso", "-as", "mkisofs"},
+}
+
+// maxLabelLength is the maximum length of an ISO 9660 volume label
+const maxLabelLength = 32
+
+// createConfigISO creates isoFile with the files from folder and the volume
+// label given. Installers look for configuration files on volumes with a
+// specific label, such as 'OEMDRV' for kickstart and 'cidata' for cloud-init.
+func createConfigISO(folder, label, isoFile string) error {
+	if label == "" || len(label) > maxLabelLength {
+		return errors.Errorf("volume label must be 1 to %d characters", maxLabelLength)
+	}
+	for _, tool := range isoTools {
+		if _, err := exec.LookPath(tool[0]); err != nil {
+			continue
+		}
+		args := append(append([]string{}, tool[1:]...),
+			"-quiet", "-o", isoFile, "-V", label, "-J", "-r", folder,
+		)
+		output, err := exec.Command(tool[0], args...).CombinedOutput()
+		if err != nil {
+			return errors.Errorf("%s failed to create ISO, error: %s, output: %s", tool[0], err, output)
+		}
+		return nil
+	}
+	return errors.New("creating an ISO file requires genisoimage, mkisofs or xorriso")
+}
+
+// folderFiles returns the files in folder and their paths relative to folder,
+// sorted by relative path, such that the input hash is stable.
+func folderFiles(folder string) (files, names []string, err error) {
+	err = filepath.Walk(folder, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		name, err := filepath.Rel(folder, file)
+		if err != nil {
+			return err
+		}
+		names = append(names, filepath.ToSlash(name))
+		return nil
+	})
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "failed to list provisioning files")
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		files = append(files, filepath.Join(folder, filepath.FromSlash(name)))
+	}
+	return files, names, nil
+}
+
+// installImage creates a new image from machineFile by booting installer with
+// an ISO of the files in the provision folder attached as second CD. The
+// installer must be configured to install without interaction, and signal that
+// it's done as specified by done, then the image is packaged to outputFile.
+func installImage(
+	monitor runtime.Monitor,
+	machineFile, installer, provision, outputFile string,
+	vncPort int,
+	label string,
+	linuxBootOptions vm.LinuxBootOptions,
+	size int,
+	compression image.Compression,
+	done completion,
+) error {
+	tempFolder, err := ioutil.TempDir("", "taskcluster-worker-install-")
+	if err != nil {
+		monitor.Error("Failed to create temporary folder, error: ", err)
+		return err
+	}
+	defer os.RemoveAll(tempFolder)
+
+	monitor.Info("Creating provisioning ISO with label: ", label)
+	isoFile := filepath.Join(tempFolder, "provision.iso")
+	if err = createConfigISO(provision, label, isoFile); err != nil {
+		monitor.Error("Failed to create provisioning ISO, error: ", err)
+		return err
+	}
+
+	return buildImage(
+		monitor, machineFile, outputFile,
+		false, vncPort,
+		installer, isoFile, linuxBootOptions,
+		size, compression, &done,
+	)
+}
@@ -0,0 +1,96 @@
+package qemubuild
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFolderFiles(t *testing.T) {
+	folder, err := ioutil.TempDir("", "qemu-build-provision-")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(folder, "scripts"), 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(folder, "ks.cfg"), []byte("text"), 0600))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(folder, "scripts", "setup.sh"), []byte("true"), 0600))
+
+	files, names, err := folderFiles(folder)
+	require.NoError(t, err)
+	require.Equal(t, []string{"ks.cfg", "scripts/setup.sh"}, names)
+	require.Equal(t, []string{
+		filepath.Join(folder, "ks.cfg"),
+		filepath.Join(folder, "scripts", "setup.sh"),
+	}, files)
+
+	_, _, err = folderFiles(filepath.Join(folder, "missing"))
+	require.Error(t, err)
+}
+
+func TestLogServiceDone(t *testing.T) {
+	post := func(l *logService, path, body string) int {
+		w := httptest.NewRecorder()
+		l.ServeHTTP(w, httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)))
+		return w.Code
+	}
+
+	t.Run("done", func(t *testing.T) {
+		done := make(chan struct{}, 1)
+		l := &logService{Destination: ioutil.Discard}
+		require.Equal(t, http.StatusForbidden, post(l, "/engine/v1/done", ""))
+		l.Done = done
+		require.Equal(t, http.StatusOK, post(l, "/engine/v1/done", ""))
+		require.Len(t, done, 1)
+		require.Equal(t, http.StatusOK, post(l, "/engine/v1/done", ""))
+	})
+
+	t.Run("sentinel", func(t *testing.T) {
+		done := make(chan struct{}, 1)
+		var log bytes.Buffer
+		l := &logService{Destination: &log, Done: done, Sentinel: "INSTALL-DONE"}
+		require.Equal(t, http.StatusOK, post(l, "/engine/v1/log", "installing packages\nINSTALL-"))
+		require.Len(t, done, 0)
+		require.Equal(t, http.StatusOK, post(l, "/engine/v1/log", "DONE\n"))
+		require.Len(t, done, 1)
+		require.Equal(t, "installing packages\nINSTALL-DONE\n", log.String())
+	})
+}
+
+func TestCreateConfigISO(t *testing.T) {
+	folder, err := ioutil.TempDir("", "qemu-build-provision-")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+
+	require.Error(t, createConfigISO(folder, "", filepath.Join(folder, "empty.iso")))
+	require.Error(t, createConfigISO(folder, strings.Repeat("A", 33), filepath.Join(folder, "long.iso")))
+
+	found := false
+	for _, tool := range isoTools {
+		if _, err = exec.LookPath(tool[0]); err == nil {
+			found = true
+		}
+	}
+	if !found {
+		t.Skip("genisoimage, mkisofs or xorriso is required")
+	}
+
+	provision := filepath.Join(folder, "provision")
+	require.NoError(t, os.Mkdir(provision, 0700))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(provision, "ks.cfg"), []byte("text"), 0600))
+	isoFile := filepath.Join(folder, "provision.iso")
+	require.NoError(t, createConfigISO(provision, "OEMDRV", isoFile))
+
+	// The volume label is stored at offset 40 of the primary volume descriptor
+	data, err := ioutil.ReadFile(isoFile)
+	require.NoError(t, err)
+	require.True(t, len(data) > 16*2048+72, "ISO file is too small")
+	require.Equal(t, "OEMDRV", strings.TrimSpace(string(data[16*2048+40:16*2048+72])))
+}
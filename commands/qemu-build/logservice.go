@@ -1,20 +1,59 @@
 package qemubuild
 
 import (
+	"bytes"
 	"io"
 	"net/http"
+	"sync"
 )
 
 // logService is a minimalistic implementation of metadata service that allows
 // for streaming out logs. This is useful for when we do automatic image builds.
+//
+// If Snapshot is non-nil, the guest can request a snapshot by POST to
+// /engine/v1/snapshot, which is signaled by a non-blocking send on Snapshot.
+//
+// If Done is non-nil, the guest can signal that it's done by POST to
+// /engine/v1/done, or by posting a log containing Sentinel, if non-empty. This
+// is signaled by a non-blocking send on Done.
 type logService struct {
 	Destination io.Writer
+	Snapshot    chan<- struct{}
+	Done        chan<- struct{}
+	Sentinel    string
+	m           sync.Mutex
+	tail        []byte // end of the log, as Sentinel may span two writes
+}
+
+// Write scans the log for Sentinel and writes p to Destination
+func (l *logService) Write(p []byte) (int, error) {
+	if l.Done != nil && l.Sentinel != "" {
+		l.m.Lock()
+		data := append(l.tail, p...)
+		if bytes.Contains(data, []byte(l.Sentinel)) {
+			notify(l.Done)
+		}
+		if keep := len(l.Sentinel) - 1; len(data) > keep {
+			data = data[len(data)-keep:]
+		}
+		l.tail = append([]byte{}, data...)
+		l.m.Unlock()
+	}
+	return l.Destination.Write(p)
+}
+
+// notify does a non-blocking send on c
+func notify(c chan<- struct{}) {
+	select {
+	case c <- struct{}{}:
+	default: // already signaled
+	}
 }
 
 func (l *logService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	debug("log service: %s -- %s", r.Method, r.URL.Path)
 	if r.Method == http.MethodPost && r.URL.Path == "/engine/v1/log" {
-		_, err := io.Copy(l.Destination, r.Body)
+		_, err := io.Copy(l, r.Body)
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
 			return
@@ -23,6 +62,18 @@ func (l *logService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if r.Method == http.MethodPost && r.URL.Path == "/engine/v1/snapshot" && l.Snapshot != nil {
+		notify(l.Snapshot)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if r.Method == http.MethodPost && r.URL.Path == "/engine/v1/done" && l.Done != nil {
+		notify(l.Done)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
 	if r.Method == http.MethodGet && r.URL.Path == "/engine/v1/ping" {
 		w.WriteHeader(http.StatusOK)
 		return
@@ -0,0 +1,123 @@
+package qemubuild
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/image"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+// progressInterval is the time between progress reports while building
+const progressInterval = 30 * time.Second
+
+// diskFullThreshold is the fraction of the disk allocated, at which we
+// consider the disk full.
+const diskFullThreshold = 0.99
+
+// diskFullTimeout is how long the disk may be full without any writes, before
+// we conclude that the guest is stuck. Guests often fill the disk with zeros
+// on purpose to make the image compress better, so a full disk is only an
+// error, if the guest stops writing.
+const diskFullTimeout = 5 * time.Minute
+
+// blockIOError returns an error, if e is a BLOCK_IO_ERROR event reporting
+// that the host ran out of space.
+//
+// Disks are attached with werror=report, so the guest sees I/O errors, which
+// may otherwise cause installers to fail with unhelpful messages.
+func blockIOError(e vm.Event) error {
+	if e.Name != "BLOCK_IO_ERROR" {
+		return nil
+	}
+	if nospace, _ := e.Data["nospace"].(bool); nospace {
+		return fmt.Errorf(
+			"The host ran out of space when the guest wrote to the disk, free " +
+				"space in the temporary folder and try again",
+		)
+	}
+	return nil
+}
+
+// diskWatcher tracks disk usage of the guest, to detect when the disk is
+// full and the guest has stopped writing.
+type diskWatcher struct {
+	written  int64     // bytes written at last update
+	fullFrom time.Time // time the disk was full and written unchanged from
+	warned   bool      // true, if we warned that the disk is full
+}
+
+// update returns an error if the disk has been full for diskFullTimeout
+// without any writes, and true if this is the first time the disk is full.
+func (d *diskWatcher) update(written, allocated, size int64, now time.Time) (bool, error) {
+	full := size > 0 && float64(allocated) >= diskFullThreshold*float64(size)
+	if !full || written != d.written {
+		d.fullFrom = time.Time{}
+	}
+	if full && d.fullFrom.IsZero() {
+		d.fullFrom = now
+	}
+	d.written = written
+
+	warn := full && !d.warned
+	if full {
+		d.warned = true
+	}
+	if !d.fullFrom.IsZero() && now.Sub(d.fullFrom) >= diskFullTimeout {
+		return warn, fmt.Errorf(
+			"The guest filled the disk (%d MiB) and hasn't written anything for %s, "+
+				"build the image again with a larger --size",
+			size/1024/1024, diskFullTimeout,
+		)
+	}
+	return warn, nil
+}
+
+// reportProgress reports bytes written and disk usage every progressInterval,
+// until done is closed. If the guest has filled the disk an error is sent on
+// failed.
+func reportProgress(
+	monitor runtime.Monitor,
+	machine *vm.VirtualMachine,
+	img *image.MutableImage,
+	failed chan<- error,
+	done <-chan struct{},
+) {
+	var d diskWatcher
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(progressInterval):
+		}
+
+		_, written, err := machine.BlockStats()
+		if err != nil {
+			debug("failed to get block stats, error: %s", err)
+			continue
+		}
+		allocated, size, err := img.DiskUsage()
+		if err != nil {
+			monitor.Warn("Failed to get disk usage, error: ", err)
+			continue
+		}
+		monitor.Infof(
+			"Progress: written %d MiB, disk usage %d of %d MiB (%.0f%%)",
+			written/1024/1024, allocated/1024/1024, size/1024/1024,
+			100*float64(allocated)/float64(size),
+		)
+
+		warn, err := d.update(written, allocated, size, time.Now())
+		if warn {
+			monitor.Warn("The guest has filled the disk, use a larger --size if the build fails")
+		}
+		if err != nil {
+			select {
+			case failed <- err:
+			default:
+			}
+			return
+		}
+	}
+}
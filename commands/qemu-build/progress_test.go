@@ -0,0 +1,46 @@
+package qemubuild
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
+)
+
+func TestBlockIOError(t *testing.T) {
+	require.NoError(t, blockIOError(vm.Event{Name: "RESET"}))
+	require.NoError(t, blockIOError(vm.Event{
+		Name: "BLOCK_IO_ERROR",
+		Data: map[string]interface{}{"nospace": false, "reason": "Input/output error"},
+	}))
+	require.Error(t, blockIOError(vm.Event{
+		Name: "BLOCK_IO_ERROR",
+		Data: map[string]interface{}{"nospace": true, "reason": "No space left on device"},
+	}))
+}
+
+func TestDiskWatcher(t *testing.T) {
+	const size = 1024 * 1024 * 1024
+	var d diskWatcher
+	now := time.Now()
+
+	// Not full
+	warn, err := d.update(100, size/2, size, now)
+	require.False(t, warn)
+	require.NoError(t, err)
+
+	// Full, but the guest keeps writing, as when zero filling the disk
+	warn, err = d.update(200, size, size, now.Add(time.Minute))
+	require.True(t, warn)
+	require.NoError(t, err)
+	warn, err = d.update(300, size, size, now.Add(2*time.Minute+diskFullTimeout))
+	require.False(t, warn, "only warn once")
+	require.NoError(t, err)
+
+	// Full and no writes for diskFullTimeout
+	_, err = d.update(300, size, size, now.Add(3*time.Minute+diskFullTimeout))
+	require.NoError(t, err)
+	_, err = d.update(300, size, size, now.Add(2*time.Minute+2*diskFullTimeout))
+	require.Error(t, err)
+}
@@ -0,0 +1,39 @@
+package qemubuild
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/runtime/ioext"
+)
+
+// maxScriptSize is the maximum size of a setup script, the script is given to
+// the guest in an environment variable, and these are limited to 128 KiB on
+// Linux.
+const maxScriptSize = 64 * 1024
+
+// scriptEnvName is the environment variable holding the setup script
+const scriptEnvName = "QEMU_BUILD_SCRIPT"
+
+// scriptCommand is the command guest-tools runs to execute the setup script,
+// the script is written to a file, so the interpreter is picked from the
+// shebang line, defaulting to /bin/sh.
+var scriptCommand = []string{"/bin/sh", "-c", `f="$(mktemp)" && printf '%s' "$` +
+	scriptEnvName + `" > "$f" && chmod +x "$f" && "$f"; r=$?; rm -f "$f"; exit $r`}
+
+// scriptCompletion returns a completion running scriptFile with guest-tools,
+// failing the build if it hasn't finished within timeout.
+func scriptCompletion(scriptFile string, timeout time.Duration) (completion, error) {
+	script, err := ioext.BoundedReadFile(scriptFile, maxScriptSize)
+	if err == ioext.ErrFileTooBig {
+		return completion{}, errors.Errorf("setup script is larger than %d KiB", maxScriptSize/1024)
+	}
+	if err != nil {
+		return completion{}, errors.Wrap(err, "failed to read setup script")
+	}
+	return completion{
+		Timeout: timeout,
+		Command: scriptCommand,
+		Env:     map[string]string{scriptEnvName: string(script)},
+	}, nil
+}
@@ -0,0 +1,58 @@
+package qemubuild
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScriptCompletion(t *testing.T) {
+	folder, err := ioutil.TempDir("", "qemu-build-script-")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+
+	script := filepath.Join(folder, "setup.sh")
+	require.NoError(t, ioutil.WriteFile(script, []byte("#!/bin/sh\necho hello\n"), 0600))
+	c, err := scriptCompletion(script, time.Minute)
+	require.NoError(t, err)
+	require.Equal(t, time.Minute, c.Timeout)
+	require.Equal(t, scriptCommand, c.Command)
+	require.Equal(t, "#!/bin/sh\necho hello\n", c.Env[scriptEnvName])
+
+	require.NoError(t, ioutil.WriteFile(script, bytes.Repeat([]byte("#"), maxScriptSize+1), 0600))
+	_, err = scriptCompletion(script, time.Minute)
+	require.Error(t, err)
+
+	_, err = scriptCompletion(filepath.Join(folder, "missing.sh"), time.Minute)
+	require.Error(t, err)
+}
+
+func TestScriptCommand(t *testing.T) {
+	if _, err := exec.LookPath("mktemp"); err != nil {
+		t.Skip("mktemp is required")
+	}
+	run := func(script string) (string, error) {
+		cmd := exec.Command(scriptCommand[0], scriptCommand[1:]...)
+		cmd.Env = append(os.Environ(), scriptEnvName+"="+script)
+		output, err := cmd.Output()
+		return string(output), err
+	}
+
+	output, err := run("echo 'hello world'\n")
+	require.NoError(t, err)
+	require.Equal(t, "hello world\n", output)
+
+	// Scripts are run with the interpreter from the shebang line
+	output, err = run("#!/bin/cat\nhello\n")
+	require.NoError(t, err)
+	require.Equal(t, "#!/bin/cat\nhello\n", output)
+
+	_, err = run("exit 3\n")
+	require.Error(t, err)
+}
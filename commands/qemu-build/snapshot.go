@@ -0,0 +1,140 @@
+package qemubuild
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/commands/qemu-run"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/image"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/network"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+// snapshotDelay is the time we wait after the guest requested a snapshot,
+// before we pause the virtual machine. This gives the guest a chance to read
+// the response, so it doesn't resume with a pending request.
+const snapshotDelay = 2 * time.Second
+
+// snapshotImage boots the image in inputFile and waits for the guest to request
+// a snapshot by POST to http://169.254.169.254/engine/v1/snapshot, then saves
+// a running-state snapshot and packages the image to outputFile.
+func snapshotImage(
+	monitor runtime.Monitor,
+	inputFile, outputFile string,
+	vncPort int,
+	snapshot string,
+	compression image.Compression,
+) error {
+	// Find absolute outputFile
+	outputFile, err := filepath.Abs(outputFile)
+	if err != nil {
+		monitor.Error("Failed to resolve output file, error: ", err)
+		return err
+	}
+
+	// Create temp folder for the image
+	tempFolder, err := ioutil.TempDir("", "taskcluster-worker-build-image-")
+	if err != nil {
+		monitor.Error("Failed to create temporary folder, error: ", err)
+		return err
+	}
+	defer os.RemoveAll(tempFolder)
+
+	img, err := image.NewSnapshotImage(inputFile, tempFolder, snapshot)
+	if err != nil {
+		monitor.Error("Failed to load image, error: ", err)
+		return err
+	}
+
+	// Create temp folder for sockets
+	socketFolder, err := ioutil.TempDir("", "taskcluster-worker-sockets-")
+	if err != nil {
+		monitor.Error("Failed to create temporary folder, error: ", err)
+		return err
+	}
+	defer os.RemoveAll(socketFolder)
+
+	// Setup a user-space network
+	monitor.Info("Creating user-space network")
+	net, err := network.NewUserNetwork(tempFolder)
+	if err != nil {
+		monitor.Error("Failed to create user-space network, error: ", err)
+		return err
+	}
+
+	// Setup logService so that logs can be posted to meta-service at:
+	// http://169.254.169.254/engine/v1/log, and snapshots requested at:
+	// http://169.254.169.254/engine/v1/snapshot
+	snapshotRequested := make(chan struct{}, 1)
+	net.SetHandler(&logService{
+		Destination: os.Stdout,
+		Snapshot:    snapshotRequested,
+	})
+
+	// Create virtual machine
+	monitor.Info("Creating virtual machine")
+	machine, err := vm.NewVirtualMachine(
+		img.Machine().DeriveLimits(), img, net, socketFolder,
+		"", "", vm.LinuxBootOptions{},
+		monitor.WithTag("component", "vm"),
+	)
+	if err != nil {
+		monitor.Error("Failed to recreated virtual-machine, error: ", err)
+		return err
+	}
+
+	// Start the virtual machine
+	monitor.Info("Starting virtual machine")
+	machine.Start()
+
+	// Expose VNC socket
+	if vncPort != 0 {
+		go qemurun.ExposeVNC(machine.VNCSocket(), vncPort, machine.Done)
+	}
+
+	// Wait for interrupt to gracefully kill everything
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+
+	// Wait for snapshot request, virtual machine to be done, or interrupt
+	monitor.Info("Waiting for guest to request snapshot")
+	select {
+	case <-snapshotRequested:
+		time.Sleep(snapshotDelay)
+		monitor.Info("Saving snapshot: ", snapshot)
+		err = machine.SaveSnapshot(snapshot)
+		// Quit rather than kill, so layer.qcow2 isn't left with the dirty-flag
+		machine.Quit()
+	case <-interrupted:
+		machine.Kill()
+		err = errors.New("SIGINT received, aborting virtual machine")
+	case <-machine.Done:
+		err = machine.Error
+		if err == nil {
+			err = errors.New("virtual machine stopped before snapshot was requested")
+		}
+	}
+	<-machine.Done
+	signal.Stop(interrupted)
+	defer img.Dispose()
+
+	if err != nil {
+		monitor.Info("Error taking snapshot of virtual machine: ", err)
+		return err
+	}
+
+	// Package up the image with snapshot
+	monitor.Info("Package virtual machine image")
+	err = img.PackageWithCompression(outputFile, compression)
+	if err != nil {
+		monitor.Error("Failed to package image, error: ", err)
+		return err
+	}
+
+	return nil
+}
@@ -120,6 +120,18 @@ func TestGuestToolsProcessingActions(t *testing.T) {
 	assert(t, files == nil, "Expected files == nil, we hopefully have an error")
 	assert(t, err == engines.ErrResourceNotFound, "Expected ErrResourceNotFound")
 
+	////////////////////
+	debug("### Test meta.GetArtifact (folder)")
+	r, err = meta.GetArtifact(testFolder)
+	assert(t, r == nil, "Expected error wihtout a reader")
+	assert(t, err == engines.ErrResourceNotFound, "Expected ErrResourceNotFound")
+
+	////////////////////
+	debug("### Test meta.ListFolder (file)")
+	files, err = meta.ListFolder(testFile)
+	assert(t, files == nil, "Expected files == nil, we hopefully have an error")
+	assert(t, err == engines.ErrResourceNotFound, "Expected ErrResourceNotFound")
+
 	////////////////////
 	debug("### Test meta.ListFolder (empty folder)")
 	emptyFolder := filepath.Join(f.Path(), "empty-folder")
@@ -152,6 +164,15 @@ func TestGuestToolsProcessingActions(t *testing.T) {
 		}
 		testShellTTY(t, meta)
 	})
+	t.Run("Shell TTY Resize", func(t *testing.T) {
+		if goruntime.GOOS == "windows" {
+			t.Skip("Not supported - test doesn't pass on windows yet")
+		}
+		testShellTTYResize(t, meta)
+	})
+	t.Run("Shell Start Failure", func(t *testing.T) {
+		testShellStartFailure(t, meta)
+	})
 }
 
 func testShellHello(t *testing.T, meta *metaservice.MetaService) {
@@ -290,3 +311,51 @@ func testShellTTY(t *testing.T, meta *metaservice.MetaService) {
 	nilOrFatal(t, err, "Got an error from shell.Wait, error: ", err)
 	assert(t, success, "Expected success from shell, we closed with end of stdin")
 }
+
+func testShellTTYResize(t *testing.T, meta *metaservice.MetaService) {
+	debug("### Test meta.Shell (using 'stty size' in TTY)")
+	shell, err := meta.ExecShell(nil, true)
+	nilOrFatal(t, err, "Failed to call meta.ExecShell()")
+
+	err = shell.SetSize(123, 45)
+	nilOrFatal(t, err, "Failed to call shell.SetSize()")
+
+	var output []byte
+	outputDone := sync.WaitGroup{}
+	outputDone.Add(1)
+	go func() {
+		output, _ = ioutil.ReadAll(shell.StdoutPipe())
+		outputDone.Done()
+	}()
+	go func() {
+		time.Sleep(200 * time.Millisecond) // Just to give sh a chance to sit idle
+		shell.StdinPipe().Write([]byte("stty size\nexit 0\n"))
+	}()
+
+	success, err := shell.Wait()
+	nilOrFatal(t, err, "Got an error from shell.Wait, error: ", err)
+	assert(t, success, "Expected success from shell, we exited with 0")
+	outputDone.Wait()
+	assert(t, strings.Contains(string(output), "45 123"), "Expected TTY size '45 123', got: ", string(output))
+}
+
+func testShellStartFailure(t *testing.T, meta *metaservice.MetaService) {
+	debug("### Test meta.Shell (using a command that doesn't exist)")
+	shell, err := meta.ExecShell([]string{"no-such-command-for-guest-tools"}, false)
+	nilOrFatal(t, err, "Failed to call meta.ExecShell()")
+
+	go io.Copy(ioutil.Discard, shell.StderrPipe())
+	var output []byte
+	outputDone := sync.WaitGroup{}
+	outputDone.Add(1)
+	go func() {
+		output, _ = ioutil.ReadAll(shell.StdoutPipe())
+		outputDone.Done()
+	}()
+
+	success, err := shell.Wait()
+	nilOrFatal(t, err, "Got an error from shell.Wait, error: ", err)
+	assert(t, !success, "Expected failure from shell, the command doesn't exist")
+	outputDone.Wait()
+	assert(t, strings.Contains(string(output), "Failed to start shell"), "Expected error message, got: ", string(output))
+}
@@ -17,6 +17,7 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"strconv"
 
 	yaml "gopkg.in/yaml.v2"
 
@@ -47,17 +48,62 @@ service, upload the log and result as success/failed. The command will also
 continuously poll the meta-data service for actions, such as put-artifact,
 list-folder or start an interactive shell.
 
+Before running the command, "run" checks if the host offers guest-tools built
+from another revision, in which case it downloads the binary and executes it
+with the same arguments instead. This is only supported on Linux guests.
+
+On Linux guests, if the host added the virtio-serial port
+org.taskcluster.guest-tools.0, the meta-data service is reached over the port
+instead of the network. This way logs, artifacts and interactive shells work,
+even if the task breaks networking in the guest. Only one process can open the
+port, other commands fall back to the network while "run" is using it.
+
 The "post-log" command will upload <log-file> to the meta-data service. If - is
 given it will read the log from standard input. This command is useful as
 meta-data can handle more than one log stream, granted they might get mangled.
 
+The "upload" command will upload <file> as an artifact named <artifact-name>
+through the meta-data service. This allows scripts inside the virtual machine
+to upload artifacts while the task is running. If --mimetype isn't given, it is
+guessed from the file extension. Large files are sent in chunks, resuming from
+where an interrupted chunk stopped, and the SHA-256 of the file is checked by
+the host before the artifact is uploaded.
+
+The "secret" command will write the secret named <secret-name> to standard
+output as JSON. The secret is fetched from taskcluster-secrets by the host
+using the credentials for the task, so task.scopes must include
+'secrets:get:<secret-name>'.
+
+The "progress" command will report <step> as the current step of the task,
+and --percent as the percentage completed, if given. Progress is written to
+the task log.
+
+The "summary" command will report the JSON object in <summary-file> as the
+result summary of the task, which is uploaded as the artifact
+public/result-summary.json when the task is resolved. If - is given it will
+read the summary from standard input. The summary must be reported before the
+task is resolved, reporting it again replaces the previous summary.
+
+The "compact" command frees unused blocks on the file system of <folder> (or /,
+if not given), such that images built with qemu-build stay small. This runs
+fstrim, or fills the free space with zeros if the disk doesn't support discard.
+Image build scripts should run this before shutting down the guest. This is
+only supported on Linux guests.
+
 Usage:
   taskcluster-worker qemu-guest-tools [options] [run]
   taskcluster-worker qemu-guest-tools [options] post-log [--] <log-file>
+  taskcluster-worker qemu-guest-tools [options] upload [--mimetype <type>] [--] <file> <artifact-name>
+  taskcluster-worker qemu-guest-tools [options] secret [--] <secret-name>
+  taskcluster-worker qemu-guest-tools [options] progress [--percent <percent>] [--] <step>
+  taskcluster-worker qemu-guest-tools [options] summary [--] <summary-file>
+  taskcluster-worker qemu-guest-tools [options] compact [--] [<folder>]
 
 Options:
   -c, --config <file>  Load YAML configuration for file.
       --host <ip>      IP-address of meta-data server [default: 169.254.169.254].
+      --mimetype <type>  Mimetype of the artifact uploaded.
+      --percent <percent>  Percentage of the task completed, from 0 to 100.
   -h, --help           Show this screen.
 
 Configuration:
@@ -122,6 +168,79 @@ func (cmd) Execute(arguments map[string]interface{}) bool {
 		return err == nil
 	}
 
+	if arguments["upload"].(bool) {
+		file := arguments["<file>"].(string)
+		name := arguments["<artifact-name>"].(string)
+		mimetype, _ := arguments["--mimetype"].(string)
+		if err := g.UploadArtifact(file, name, mimetype); err != nil {
+			monitor.Error("Failed to upload artifact, error: ", err)
+			return false
+		}
+		return true
+	}
+
+	if arguments["secret"].(bool) {
+		secret, err := g.FetchSecret(arguments["<secret-name>"].(string))
+		if err != nil {
+			monitor.Error("Failed to fetch secret, error: ", err)
+			return false
+		}
+		_, err = os.Stdout.Write(secret)
+		return err == nil
+	}
+
+	if arguments["progress"].(bool) {
+		percent := -1
+		if p, ok := arguments["--percent"].(string); ok {
+			var err error
+			if percent, err = strconv.Atoi(p); err != nil || percent < 0 || percent > 100 {
+				monitor.Error("--percent must be an integer between 0 and 100")
+				return false
+			}
+		}
+		if err := g.ReportProgress(percent, arguments["<step>"].(string)); err != nil {
+			monitor.Error("Failed to report progress, error: ", err)
+			return false
+		}
+		return true
+	}
+
+	if arguments["summary"].(bool) {
+		summaryFile := arguments["<summary-file>"].(string)
+		var r io.Reader
+		if summaryFile == "-" {
+			r = os.Stdin
+		} else {
+			f, err := os.Open(summaryFile)
+			if err != nil {
+				monitor.Error("Failed to open summary-file, error: ", err)
+				return false
+			}
+			defer f.Close()
+			r = f
+		}
+		if err := g.ReportSummary(r); err != nil {
+			monitor.Error("Failed to report summary, error: ", err)
+			return false
+		}
+		return true
+	}
+
+	if arguments["compact"].(bool) {
+		folder, _ := arguments["<folder>"].(string)
+		if folder == "" {
+			folder = "/"
+		}
+		if err := compactDisk(folder); err != nil {
+			monitor.Error("Failed to compact disk, error: ", err)
+			return false
+		}
+		return true
+	}
+
+	// Replace this process with guest-tools offered by the host, if any
+	g.SelfUpdate()
+
 	go g.Run()
 	// Process actions forever, this must run in the main thread as exiting the
 	// main thread will cause the go program to exit.
@@ -0,0 +1,56 @@
+package qemuguesttools
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+)
+
+// compactBlockSize is the size of writes when filling free space with zeros
+const compactBlockSize = 1024 * 1024
+
+// compactDisk frees unused blocks on the file system of folder, such that
+// the image is small when packaged. This runs fstrim, which frees the blocks
+// on the host, if the disk supports discard. Otherwise, free space is filled
+// with zeros, which the host deallocates before the image is packaged.
+func compactDisk(folder string) error {
+	output, err := exec.Command("fstrim", "-v", folder).CombinedOutput()
+	if err == nil {
+		debug("fstrim: %s", strings.TrimSpace(string(output)))
+		return nil
+	}
+	debug("fstrim failed, filling free space with zeros, error: %s, output: %s",
+		err, strings.TrimSpace(string(output)))
+	return zeroFreeSpace(folder)
+}
+
+// zeroFreeSpace fills the free space on the file system of folder with zeros,
+// by writing a file until the file system is full, and then removing it.
+func zeroFreeSpace(folder string) error {
+	f, err := ioutil.TempFile(folder, ".compact-")
+	if err != nil {
+		return errors.Wrap(err, "failed to create file for zero filling")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	zeros := make([]byte, compactBlockSize)
+	for {
+		_, err = f.Write(zeros)
+		if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENOSPC {
+			break
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to write zeros")
+		}
+	}
+	// Ensure the zeros are written to disk, before the file is removed
+	if err = f.Sync(); err != nil {
+		return errors.Wrap(err, "failed to sync file with zeros")
+	}
+	return nil
+}
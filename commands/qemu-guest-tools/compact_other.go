@@ -0,0 +1,11 @@
+// +build !linux
+
+package qemuguesttools
+
+import "errors"
+
+// compactDisk returns an error, as compacting the disk is only supported for
+// linux guests.
+func compactDisk(folder string) error {
+	return errors.New("compacting the disk is only supported on linux guests")
+}
@@ -4,8 +4,12 @@ import (
 	"bufio"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	goruntime "runtime"
@@ -13,6 +17,7 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
 	"github.com/taskcluster/go-got"
 	"github.com/taskcluster/taskcluster-worker/engines/native/system"
 	"github.com/taskcluster/taskcluster-worker/engines/qemu/metaservice"
@@ -30,6 +35,9 @@ type guestTools struct {
 	baseURL       string
 	got           *got.Got
 	gotpoll       *got.Got
+	token         string
+	transport     http.RoundTripper
+	dialer        *websocket.Dialer
 	monitor       runtime.Monitor
 	taskLog       io.Writer
 	pollingCtx    context.Context
@@ -44,8 +52,28 @@ var backOff = &got.BackOff{
 }
 
 func new(config config, host string, monitor runtime.Monitor) *guestTools {
+	// Read the token for the meta-data service, if the host set one
+	token, err := readMetaDataToken()
+	if err != nil {
+		monitor.Error("Failed to read meta-data token, error: ", err)
+	}
+
+	// Use the serial channel, if the host added one, as this works even if the
+	// task breaks networking in the guest
+	base := http.DefaultTransport
+	dialer := shellDialer
+	serial, err := newSerialDialer(tokenHeader(token))
+	if err == nil {
+		monitor.Info("Using serial channel to reach the meta-data service")
+		base = serial.Transport()
+		dialer.NetDial = serial.Dial
+	} else if err != errSerialNotAvailable {
+		monitor.Error("Failed to open serial channel, error: ", err)
+	}
+	transport := newTokenTransport(token, base)
+
 	got := got.New()
-	got.Client = &http.Client{Timeout: 5 * time.Second}
+	got.Client = &http.Client{Timeout: 5 * time.Second, Transport: transport}
 	got.MaxSize = 10 * 1024 * 1024
 	got.Log = monitor.WithTag("guest-tools", "http-got")
 	got.Retries = 15
@@ -53,7 +81,7 @@ func new(config config, host string, monitor runtime.Monitor) *guestTools {
 
 	// Create got client for polling
 	gotpoll := *got
-	gotpoll.Client = &http.Client{Timeout: pollTimeout + 5*time.Second}
+	gotpoll.Client = &http.Client{Timeout: pollTimeout + 5*time.Second, Transport: transport}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	return &guestTools{
@@ -61,6 +89,9 @@ func new(config config, host string, monitor runtime.Monitor) *guestTools {
 		baseURL:       "http://" + host + "/",
 		got:           got,
 		gotpoll:       &gotpoll,
+		token:         token,
+		transport:     transport,
+		dialer:        &dialer,
 		monitor:       monitor,
 		pollingCtx:    ctx,
 		cancelPolling: cancel,
@@ -94,6 +125,11 @@ func (g *guestTools) Run() {
 		time.Sleep(200 * time.Millisecond)
 	}
 
+	// Send heartbeats until the result is reported
+	stopHeartbeats := make(chan struct{})
+	defer close(stopHeartbeats)
+	go g.sendHeartbeats(stopHeartbeats)
+
 	// Start sending task log
 	taskLog, logSent := g.CreateTaskLog()
 
@@ -126,6 +162,13 @@ func (g *guestTools) Run() {
 		}
 	}
 
+	// Mount shared folders and disks for volumes
+	if err = mountVolumes(task.Mounts); err != nil {
+		g.monitor.Error("Failed to mount volumes, error: ", err)
+		io.WriteString(taskLog, "[qemu-guest-tools] "+err.Error()+"\n")
+		goto resolved
+	}
+
 	// Execute the task
 	proc, err = system.StartProcess(system.ProcessOptions{
 		Arguments:     append(g.config.Entrypoint, task.Command...),
@@ -176,25 +219,136 @@ resolved:
 
 func (g *guestTools) CreateTaskLog() (io.WriteCloser, <-chan struct{}) {
 	reader, writer := nio.Pipe(buffer.New(4 * 1024 * 1024))
-	req, err := http.NewRequest("POST", g.url("engine/v1/log"), reader)
-	if err != nil {
-		g.monitor.Panic("Failed to create request for log, error: ", err)
-	}
 
 	done := make(chan struct{})
 	go func() {
-		client := http.Client{Timeout: 0}
-		res, err := client.Do(req)
+		defer close(done)
+
+		// Resend the remaining log if the request fails, as the connection is
+		// broken when the virtual machine is migrated to another host
+		var pending []byte
+		for attempt := 1; ; attempt++ {
+			remaining, retry, err := g.sendTaskLog(reader, pending)
+			if err == nil {
+				return
+			}
+			if !retry || attempt >= maxTaskLogAttempts {
+				g.monitor.Println("Failed to send log, error: ", err)
+				break
+			}
+			g.monitor.Println("Failed to send log, retrying, error: ", err)
+			pending = remaining
+			time.Sleep(1 * time.Second)
+		}
+		// Discard the remaining log, so the task isn't blocked writing to it
+		io.Copy(ioutil.Discard, reader)
+	}()
+
+	return writer, done
+}
 
+// maxTaskLogAttempts is the number of requests we make to send the task log,
+// before discarding the remaining log.
+const maxTaskLogAttempts = 30
+
+// sendTaskLog sends pending followed by the log from reader in a request. If
+// the request fails before the log was sent, this returns the log that was read
+// from reader but not written to the request, and retry is true.
+func (g *guestTools) sendTaskLog(reader io.Reader, pending []byte) (remaining []byte, retry bool, err error) {
+	body, bodyWriter := io.Pipe()
+	result := make(chan error, 1)
+	go func() {
+		req, err := http.NewRequest("POST", g.url("engine/v1/log"), body)
 		if err != nil {
-			g.monitor.Println("Failed to send log, error: ", err)
-		} else if res.StatusCode != http.StatusOK {
-			g.monitor.Println("Failed to send log, status: ", res.StatusCode)
+			g.monitor.Panic("Failed to create request for log, error: ", err)
 		}
-		close(done)
+		client := http.Client{Timeout: 0, Transport: g.transport}
+		res, err := client.Do(req)
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				err = fmt.Errorf("meta-data service responded %d", res.StatusCode)
+			}
+		}
+		body.Close() // Ensure writes fail, when the request is done
+		result <- err
 	}()
 
-	return writer, done
+	// Read from reader only when pending has been written, so we don't lose log
+	// if the request fails
+	buf := make([]byte, 32*1024)
+	eof := false
+	for !eof || len(pending) > 0 {
+		if len(pending) == 0 {
+			n, rerr := reader.Read(buf)
+			pending, eof = buf[:n], rerr != nil
+			continue
+		}
+		n, werr := bodyWriter.Write(pending)
+		pending = pending[n:]
+		if werr != nil {
+			err = <-result
+			if err == nil {
+				err = errors.New("meta-data service responded before the log was sent")
+			}
+			return pending, true, err
+		}
+	}
+	bodyWriter.Close()
+	return nil, false, <-result
+}
+
+// UploadArtifact uploads file as an artifact named name through the meta-data
+// service, if mimetype is empty it is guessed from the file extension.
+func (g *guestTools) UploadArtifact(file, name, mimetype string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return errors.Wrap(err, "failed to open file")
+	}
+	defer f.Close()
+
+	if mimetype == "" {
+		mimetype = mime.TypeByExtension(filepath.Ext(file))
+	}
+	if mimetype == "" {
+		mimetype = "application/octet-stream"
+	}
+
+	// Upload in chunks, falling back to a single request for older hosts
+	err = g.uploadResumable(f, name, mimetype)
+	if err != errResumableUploadNotSupported {
+		if err == nil {
+			g.monitor.Info("Uploaded artifact: ", name)
+		}
+		return err
+	}
+	if _, err = f.Seek(0, io.SeekStart); err != nil {
+		return errors.Wrap(err, "failed to seek file")
+	}
+
+	req, err := http.NewRequest(http.MethodPut, g.url("engine/v1/artifact?name="+url.QueryEscape(name)), bufio.NewReader(f))
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Content-Type", mimetype)
+
+	// Upload may take time for large files, so we don't use a timeout
+	client := http.Client{Timeout: 0, Transport: g.transport}
+	res, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to send artifact")
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var e metaservice.Error
+		data, _ := ioext.ReadAtMost(res.Body, 64*1024)
+		if json.Unmarshal(data, &e) == nil && e.Message != "" {
+			return errors.Errorf("upload failed, status: %d, error: %s", res.StatusCode, e.Message)
+		}
+		return errors.Errorf("upload failed, status: %d", res.StatusCode)
+	}
+	g.monitor.Info("Uploaded artifact: ", name)
+	return nil
 }
 
 func (g *guestTools) ProcessActions() {
@@ -259,11 +413,15 @@ func (g *guestTools) doGetArtifact(ID, path string) {
 
 	// Construct body as buffered file read, if there is an error it's because
 	// the file doesn't exist and we set the body the nil, as we still have to
-	// report this in the reply (just with an empty body)
+	// report this in the reply (just with an empty body). Folders are reported
+	// as missing too, they can only be fetched with list-folder.
 	var body io.Reader
 	f, err := os.Open(path)
 	if err == nil {
-		body = bufio.NewReader(f)
+		defer f.Close()
+		if info, serr := f.Stat(); serr == nil && !info.IsDir() {
+			body = bufio.NewReader(f)
+		}
 	}
 
 	// Create reply
@@ -277,7 +435,8 @@ func (g *guestTools) doGetArtifact(ID, path string) {
 	}
 
 	// Send the reply
-	res, err := http.DefaultClient.Do(req)
+	client := http.Client{Transport: g.transport}
+	res, err := client.Do(req)
 	if err != nil {
 		g.monitor.Error("Reply with artifact for path: ", path, " failed error: ", err)
 		return
@@ -306,6 +465,12 @@ func (g *guestTools) doListFolder(ID, path string) {
 		}
 		return nil // Ignore other errors
 	})
+	// Paths that aren't folders are reported as missing, just as get-artifact
+	// reports folders as missing.
+	if info, serr := os.Stat(path); serr != nil || !info.IsDir() {
+		files = []string{}
+		err = errors.New("path is not a folder")
+	}
 	notFound := err != nil
 
 	// Create reply request... We use got here, this means that we get retries...
@@ -348,7 +513,7 @@ func (g *guestTools) doKillProcess(ID string) {
 	}
 }
 
-var dialer = websocket.Dialer{
+var shellDialer = websocket.Dialer{
 	HandshakeTimeout: shellconsts.ShellHandshakeTimeout,
 	ReadBufferSize:   shellconsts.ShellMaxMessageSize,
 	WriteBufferSize:  shellconsts.ShellMaxMessageSize,
@@ -356,7 +521,7 @@ var dialer = websocket.Dialer{
 
 func (g *guestTools) doExecShell(ID string, command []string, tty bool) {
 	// Establish a websocket reply
-	ws, _, err := dialer.Dial("ws:"+g.url("engine/v1/reply?id=" + ID)[5:], nil)
+	ws, _, err := g.dialer.Dial("ws:"+g.url("engine/v1/reply?id=" + ID)[5:], g.authHeader())
 	if err != nil {
 		g.monitor.Error("Failed to establish websocket for reply to ID = ", ID)
 		return
@@ -415,6 +580,15 @@ func (g *guestTools) doExecShell(ID string, command []string, tty bool) {
 		Stderr:        stderr,
 	})
 
+	if err != nil {
+		// Report the error to the user, as there is no process to resize or kill
+		g.monitor.Errorf("Failed to start shell, command: %v, error: %s", command, err)
+		handler.Communicate(nil, nil)
+		fmt.Fprintf(handler.StdoutPipe(), "Failed to start shell, error: %s\n", err)
+		handler.Terminated(false)
+		return
+	}
+
 	handler.Communicate(func(cols, rows uint16) error {
 		proc.SetSize(cols, rows)
 		return nil
@@ -422,10 +596,5 @@ func (g *guestTools) doExecShell(ID string, command []string, tty bool) {
 		return system.KillProcessTree(proc)
 	})
 
-	result := false
-	if err == nil {
-		result = proc.Wait()
-	}
-
-	handler.Terminated(result)
+	handler.Terminated(proc.Wait())
 }
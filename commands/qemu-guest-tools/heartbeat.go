@@ -0,0 +1,33 @@
+package qemuguesttools
+
+import (
+	"time"
+
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/metaservice"
+)
+
+// sendHeartbeats sends a heartbeat to the meta-data service every
+// metaservice.HeartbeatInterval until stop is closed, so the host can detect
+// if qemu-guest-tools stops responding.
+func (g *guestTools) sendHeartbeats(stop <-chan struct{}) {
+	ticker := time.NewTicker(metaservice.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		g.sendHeartbeat()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (g *guestTools) sendHeartbeat() {
+	// Don't retry, we'll send another heartbeat soon
+	req := g.got.Put(g.url("engine/v1/heartbeat"), nil)
+	req.Retries = 0
+	if _, err := req.Send(); err != nil {
+		g.monitor.Println("Failed to send heartbeat, error: ", err)
+	}
+}
@@ -0,0 +1,98 @@
+package qemuguesttools
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/metaservice"
+)
+
+// mountVolumes mounts shared folders exposed by the host using virtio-9p, and
+// disk volumes exposed as virtio-blk or virtio-scsi disks, creating
+// mount-points as needed.
+func mountVolumes(mounts []metaservice.Mount) error {
+	for _, m := range mounts {
+		if err := os.MkdirAll(m.MountPoint, 0777); err != nil {
+			return errors.Wrapf(err, "failed to create mount-point: '%s'", m.MountPoint)
+		}
+		var args []string
+		switch m.Type {
+		case metaservice.MountTypeDisk:
+			device := findDisk(m.Tag)
+			if err := formatDisk(device, m.ReadOnly); err != nil {
+				return errors.Wrapf(err, "failed to format volume for '%s'", m.MountPoint)
+			}
+			// Discard freed blocks, this shrinks the disk on the host with virtio-scsi
+			args = []string{"-t", "ext4", "-o", "discard", device, m.MountPoint}
+		case metaservice.MountTypeSharedFolder, "":
+			options := "trans=virtio,version=9p2000.L,msize=262144"
+			args = []string{"-t", "9p", "-o", options, m.Tag, m.MountPoint}
+		default:
+			return errors.Errorf("volume type '%s' for '%s' is not supported", m.Type, m.MountPoint)
+		}
+		if m.ReadOnly {
+			args = append([]string{"-o", "ro"}, args...)
+		}
+		output, err := exec.Command("mount", args...).CombinedOutput()
+		if err != nil {
+			return errors.Errorf(
+				"failed to mount volume at '%s', error: %s, output: %s",
+				m.MountPoint, err, strings.TrimSpace(string(output)),
+			)
+		}
+	}
+	return nil
+}
+
+// diskPrefixes are the prefixes of disks in /dev/disk/by-id/ named by serial
+// number, for virtio-blk and virtio-scsi disks respectively.
+var diskPrefixes = []string{"virtio-", "scsi-0QEMU_QEMU_HARDDISK_"}
+
+// diskTimeout is the time to wait for a disk to appear, disk volumes are
+// hot-plugged when the virtual machine is resumed from snapshot, so udev may
+// not have created the device yet.
+const diskTimeout = 30 * time.Second
+
+// findDisk returns the device for the disk with tag as serial number, waiting
+// for it to appear, if no such device exists the virtio-blk device is returned.
+func findDisk(tag string) string {
+	deadline := time.Now().Add(diskTimeout)
+	for {
+		for _, prefix := range diskPrefixes {
+			device := "/dev/disk/by-id/" + prefix + tag
+			if _, err := os.Stat(device); err == nil {
+				return device
+			}
+		}
+		if time.Now().After(deadline) {
+			return "/dev/disk/by-id/" + diskPrefixes[0] + tag
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// formatDisk creates an ext4 filesystem on device, if it doesn't have a
+// filesystem already, as disk volumes are empty when first created.
+func formatDisk(device string, readOnly bool) error {
+	// blkid exits 2, if no filesystem was found
+	err := exec.Command("blkid", "-p", device).Run()
+	if err == nil {
+		return nil
+	}
+	e, ok := err.(*exec.ExitError)
+	if !ok || e.Sys().(syscall.WaitStatus).ExitStatus() != 2 {
+		return errors.Wrap(err, "blkid failed")
+	}
+	if readOnly {
+		return errors.New("read-only disk volume doesn't have a filesystem")
+	}
+	output, err := exec.Command("mkfs.ext4", "-q", device).CombinedOutput()
+	if err != nil {
+		return errors.Errorf("mkfs.ext4 failed, error: %s, output: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
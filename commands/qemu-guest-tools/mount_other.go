@@ -0,0 +1,18 @@
+// +build !linux
+
+package qemuguesttools
+
+import (
+	"errors"
+
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/metaservice"
+)
+
+// mountVolumes returns an error, as volumes are only supported for linux
+// guests.
+func mountVolumes(mounts []metaservice.Mount) error {
+	if len(mounts) > 0 {
+		return errors.New("mounting volumes is only supported on linux guests")
+	}
+	return nil
+}
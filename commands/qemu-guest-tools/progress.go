@@ -0,0 +1,39 @@
+package qemuguesttools
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/metaservice"
+)
+
+// ReportProgress reports progress to the meta-data service, which writes it to
+// the task log. If percent is negative only the step is reported.
+func (g *guestTools) ReportProgress(percent int, step string) error {
+	p := metaservice.Progress{Step: step}
+	if percent >= 0 {
+		p.Percent = &percent
+	}
+	req := g.got.Put(g.url("engine/v1/progress"), nil)
+	if err := req.JSON(p); err != nil {
+		return errors.Wrap(err, "failed to serialize progress")
+	}
+	if _, err := req.Send(); err != nil {
+		return errors.Wrap(responseError(err), "failed to report progress")
+	}
+	return nil
+}
+
+// ReportSummary reports the JSON object read from r as result summary, which
+// is uploaded as an artifact when the task is resolved.
+func (g *guestTools) ReportSummary(r io.Reader) error {
+	data, err := ioutil.ReadAll(io.LimitReader(r, metaservice.MaxSummarySize+1))
+	if err != nil {
+		return errors.Wrap(err, "failed to read summary")
+	}
+	if _, err = g.got.Put(g.url("engine/v1/summary"), data).Send(); err != nil {
+		return errors.Wrap(responseError(err), "failed to report summary")
+	}
+	return nil
+}
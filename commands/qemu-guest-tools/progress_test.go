@@ -0,0 +1,42 @@
+package qemuguesttools
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/metaservice"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/mocks"
+)
+
+func TestGuestToolsReportProgress(t *testing.T) {
+	storage, err := runtime.NewTemporaryStorage(os.TempDir())
+	nilOrFatal(t, err, "Failed to create TemporaryStorage")
+	s := metaservice.New([]string{"true"}, map[string]string{}, ioutil.Discard, func(bool) {}, &runtime.Environment{
+		TemporaryStorage: storage,
+	})
+	var reports []metaservice.Progress
+	s.SetProgressHandler(func(p metaservice.Progress) {
+		reports = append(reports, p)
+	})
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	nilOrFatal(t, err, "Failed to parse url")
+	g := new(config{}, u.Host, mocks.NewMockMonitor(true))
+
+	nilOrFatal(t, g.ReportProgress(50, "Building"), "Failed to report progress")
+	nilOrFatal(t, g.ReportProgress(-1, "Testing"), "Failed to report progress")
+	assert(t, len(reports) == 2, "Expected 2 reports, got: ", len(reports))
+	assert(t, *reports[0].Percent == 50 && reports[0].Step == "Building")
+	assert(t, reports[1].Percent == nil && reports[1].Step == "Testing")
+
+	nilOrFatal(t, g.ReportSummary(bytes.NewBufferString(`{"passed": 3}`)), "Failed to report summary")
+	assert(t, string(s.Summary()) == `{"passed": 3}`, "Unexpected summary: ", string(s.Summary()))
+	assert(t, g.ReportSummary(bytes.NewBufferString(`"not an object"`)) != nil, "Expected error")
+}
@@ -0,0 +1,17 @@
+package qemuguesttools
+
+import (
+	"net/url"
+
+	"github.com/pkg/errors"
+)
+
+// FetchSecret returns the secret named name from taskcluster-secrets as JSON,
+// fetched by the host using the credentials for the task.
+func (g *guestTools) FetchSecret(name string) ([]byte, error) {
+	res, err := g.got.Get(g.url("engine/v1/secret?name=" + url.QueryEscape(name))).Send()
+	if err != nil {
+		return nil, errors.Wrap(responseError(err), "failed to fetch secret")
+	}
+	return res.Body, nil
+}
@@ -0,0 +1,134 @@
+package qemuguesttools
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	goruntime "runtime"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/go-got"
+	"github.com/taskcluster/taskcluster-worker/commands/version"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/metaservice"
+)
+
+// updatedEnvVar is set for the binary executed by SelfUpdate(), so guest-tools
+// don't update in a loop, if the binary reports another revision than offered.
+const updatedEnvVar = "TASKCLUSTER_GUEST_TOOLS_UPDATED"
+
+// SelfUpdate replaces the running process with the guest-tools binary offered
+// by the host, if it was built from another git revision. This returns if the
+// host doesn't offer guest-tools, the binary is the same or can't be used.
+func (g *guestTools) SelfUpdate() {
+	if os.Getenv(updatedEnvVar) != "" {
+		return
+	}
+
+	res, err := g.got.Get(g.url("engine/v1/guest-tools")).Send()
+	if e, ok := err.(got.BadResponseCodeError); ok && e.StatusCode == http.StatusNotFound {
+		debug("host doesn't offer guest-tools")
+		return
+	}
+	if err != nil {
+		g.monitor.Error("Failed to check for guest-tools update, error: ", responseError(err))
+		return
+	}
+	var info metaservice.GuestTools
+	if err = json.Unmarshal(res.Body, &info); err != nil {
+		g.monitor.Error("Failed to parse guest-tools update, error: ", err)
+		return
+	}
+
+	if info.Revision == version.Revision() {
+		debug("guest-tools are up to date, revision: %s", info.Revision)
+		return
+	}
+	if info.OS != goruntime.GOOS || info.Arch != goruntime.GOARCH {
+		g.monitor.Infof("Guest-tools offered by the host are for %s/%s, can't update", info.OS, info.Arch)
+		return
+	}
+
+	file, err := g.downloadGuestTools(info)
+	if err != nil {
+		g.monitor.Error("Failed to download guest-tools update, error: ", err)
+		return
+	}
+	defer os.Remove(file)
+
+	g.monitor.Infof("Updating guest-tools from revision '%s' to '%s'", version.Revision(), info.Revision)
+	env := append(os.Environ(), updatedEnvVar+"="+info.Revision)
+	err = execBinary(file, os.Args, env) // only returns on error
+	g.monitor.Error("Failed to execute guest-tools update, error: ", err)
+}
+
+// downloadGuestTools downloads the binary described by info to an executable
+// file, and returns the path. The caller is responsible for removing the file.
+func (g *guestTools) downloadGuestTools(info metaservice.GuestTools) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, g.url("engine/v1/guest-tools/binary"), nil)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create request")
+	}
+	client := http.Client{Transport: g.transport}
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", errors.Errorf("status: %d", res.StatusCode)
+	}
+
+	// Temporary folders are often mounted noexec, so we try next to the running
+	// binary first
+	f, err := createExecutable()
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), io.LimitReader(res.Body, info.Size+1))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n != info.Size {
+		err = errors.Errorf("expected %d bytes, received %d bytes", info.Size, n)
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); err == nil && sum != info.SHA256 {
+		err = errors.Errorf("expected SHA-256: %s, received: %s", info.SHA256, sum)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// createExecutable creates an executable file next to the running binary, or
+// in the temporary folder, if this isn't possible.
+func createExecutable() (*os.File, error) {
+	var folders []string
+	if exe, err := os.Executable(); err == nil {
+		folders = append(folders, filepath.Dir(exe))
+	}
+	folders = append(folders, os.TempDir())
+
+	var err error
+	for _, folder := range folders {
+		var f *os.File
+		f, err = ioutil.TempFile(folder, "qemu-guest-tools-")
+		if err != nil {
+			continue
+		}
+		if err = f.Chmod(0755); err != nil {
+			f.Close()
+			os.Remove(f.Name())
+			continue
+		}
+		return f, nil
+	}
+	return nil, errors.Wrap(err, "failed to create file for guest-tools update")
+}
@@ -0,0 +1,9 @@
+package qemuguesttools
+
+import "syscall"
+
+// execBinary replaces the running process with file, this only returns if
+// there is an error.
+func execBinary(file string, args, env []string) error {
+	return syscall.Exec(file, args, env)
+}
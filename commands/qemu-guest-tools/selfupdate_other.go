@@ -0,0 +1,11 @@
+// +build !linux
+
+package qemuguesttools
+
+import "github.com/pkg/errors"
+
+// execBinary returns an error, as replacing the running process is only
+// supported for linux guests.
+func execBinary(file string, args, env []string) error {
+	return errors.New("updating guest-tools is only supported for linux guests")
+}
@@ -0,0 +1,68 @@
+package qemuguesttools
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	goruntime "runtime"
+	"testing"
+
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/metaservice"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/mocks"
+)
+
+func TestGuestToolsSelfUpdate(t *testing.T) {
+	storage, err := runtime.NewTemporaryStorage(os.TempDir())
+	nilOrFatal(t, err, "Failed to create TemporaryStorage")
+	s := metaservice.New([]string{"true"}, map[string]string{}, ioutil.Discard, func(bool) {}, &runtime.Environment{
+		TemporaryStorage: storage,
+	})
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	nilOrFatal(t, err, "Failed to parse url")
+	g := new(config{}, u.Host, mocks.NewMockMonitor(true))
+
+	// Returns when the host doesn't offer guest-tools
+	g.SelfUpdate()
+
+	folder, err := storage.NewFolder()
+	nilOrFatal(t, err, "Failed to create folder")
+	defer folder.Remove()
+	binary := []byte("#!/bin/sh\necho 'hello'\n")
+	file := filepath.Join(folder.Path(), "taskcluster-worker")
+	nilOrFatal(t, ioutil.WriteFile(file, binary, 0755), "Failed to write binary")
+	sum := sha256.Sum256(binary)
+	info := metaservice.GuestTools{
+		Revision: "2b9e2f8fbe2a6a35a5c4e7b8a5d9c3e1f0a1b2c3",
+		OS:       goruntime.GOOS,
+		Arch:     goruntime.GOARCH,
+		SHA256:   hex.EncodeToString(sum[:]),
+		Size:     int64(len(binary)),
+	}
+	s.SetGuestTools(info, file)
+
+	debug("### Test downloadGuestTools")
+	result, err := g.downloadGuestTools(info)
+	nilOrFatal(t, err, "Failed to download guest-tools")
+	defer os.Remove(result)
+	data, err := ioutil.ReadFile(result)
+	nilOrFatal(t, err, "Failed to read guest-tools")
+	assert(t, string(data) == string(binary), "Unexpected binary: ", string(data))
+	if goruntime.GOOS != "windows" {
+		fi, err := os.Stat(result)
+		nilOrFatal(t, err, "Failed to stat guest-tools")
+		assert(t, fi.Mode()&0100 != 0, "Expected binary to be executable")
+	}
+
+	debug("### Test downloadGuestTools (checksum mismatch)")
+	info.SHA256 = hex.EncodeToString(make([]byte, sha256.Size))
+	_, err = g.downloadGuestTools(info)
+	assert(t, err != nil, "Expected checksum mismatch to fail")
+}
@@ -0,0 +1,137 @@
+package qemuguesttools
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/taskcluster/webhooktunnel/wsmux"
+)
+
+// serialPortName is the name of the virtio-serial port, see vm.SerialPortName
+const serialPortName = "org.taskcluster.guest-tools.0"
+
+// serialChannelPath is the path of the websocket upgrade request that opens
+// the serial channel, see vm.SerialChannelPath
+const serialChannelPath = "/engine/v1/serial-channel"
+
+// serialStreamBufferSize is the buffer size for streams multiplexed over the
+// serial channel, this matches the host.
+const serialStreamBufferSize = 64 * 1024
+
+// serialHandshakeTimeout is the time to wait for the host to accept the
+// websocket upgrade request over the serial port.
+const serialHandshakeTimeout = 30 * time.Second
+
+var errSerialNotAvailable = errors.New("serial channel isn't available")
+
+// serialDialer opens streams to the meta-data service over the virtio-serial
+// port added by the host, see vm.EnableSerialChannel(). If the channel is lost
+// the serial port is opened again on the next Dial().
+type serialDialer struct {
+	m       sync.Mutex
+	port    *os.File
+	session *wsmux.Session
+	header  http.Header
+}
+
+// newSerialDialer opens the serial channel and returns a serialDialer, or
+// errSerialNotAvailable if the host didn't add a serial port. The serial port
+// can only be opened by one process at the time.
+func newSerialDialer(header http.Header) (*serialDialer, error) {
+	d := &serialDialer{header: header}
+	if err := d.connect(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// connect opens the serial port and sends the websocket upgrade request, the
+// caller must hold the lock, if d is shared.
+func (d *serialDialer) connect() error {
+	if d.port != nil {
+		d.session.Close()
+		d.port.Close()
+		d.port, d.session = nil, nil
+	}
+
+	port, err := openSerialPort()
+	if err != nil {
+		return err
+	}
+	conn := &fileConn{File: port}
+	conn.SetDeadline(time.Now().Add(serialHandshakeTimeout))
+	u := &url.URL{Scheme: "ws", Host: "serial", Path: serialChannelPath}
+	ws, _, err := websocket.NewClient(conn, u, d.header, 4*1024, 4*1024)
+	if err != nil {
+		port.Close()
+		return errors.Wrap(err, "failed to open serial channel")
+	}
+	conn.SetDeadline(time.Time{})
+
+	d.port = port
+	d.session = wsmux.Client(ws, wsmux.Config{StreamBufferSize: serialStreamBufferSize})
+	return nil
+}
+
+// Dial opens a new stream to the meta-data service, network and addr are
+// ignored as the serial channel only connects to the meta-data service.
+func (d *serialDialer) Dial(network, addr string) (net.Conn, error) {
+	d.m.Lock()
+	defer d.m.Unlock()
+
+	if d.session == nil || d.session.IsClosed() {
+		if err := d.connect(); err != nil {
+			return nil, err
+		}
+	}
+	conn, _, err := d.session.Open()
+	return conn, err
+}
+
+// Transport returns an http.RoundTripper sending requests over the serial
+// channel.
+func (d *serialDialer) Transport() http.RoundTripper {
+	return &http.Transport{
+		Dial:                d.Dial,
+		MaxIdleConnsPerHost: 4,
+	}
+}
+
+// fileConn wraps the serial port as a net.Conn, deadlines are ignored if the
+// serial port doesn't support them, as websocket.NewClient() requires them.
+type fileConn struct {
+	*os.File
+}
+
+func (c *fileConn) SetDeadline(t time.Time) error {
+	return ignoreNoDeadline(c.File.SetDeadline(t))
+}
+
+func (c *fileConn) SetReadDeadline(t time.Time) error {
+	return ignoreNoDeadline(c.File.SetReadDeadline(t))
+}
+
+func (c *fileConn) SetWriteDeadline(t time.Time) error {
+	return ignoreNoDeadline(c.File.SetWriteDeadline(t))
+}
+
+func ignoreNoDeadline(err error) error {
+	if err == os.ErrNoDeadline {
+		return nil
+	}
+	return err
+}
+
+func (c *fileConn) LocalAddr() net.Addr  { return serialAddr{} }
+func (c *fileConn) RemoteAddr() net.Addr { return serialAddr{} }
+
+type serialAddr struct{}
+
+func (serialAddr) Network() string { return "virtio-serial" }
+func (serialAddr) String() string  { return serialPortName }
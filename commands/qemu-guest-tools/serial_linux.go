@@ -0,0 +1,17 @@
+package qemuguesttools
+
+import "os"
+
+// serialPortFile is where udev exposes the virtio-serial port added by the host
+const serialPortFile = "/dev/virtio-ports/" + serialPortName
+
+// openSerialPort opens the serial port, or returns errSerialNotAvailable if
+// the host didn't add it, or it's already opened by another process.
+func openSerialPort() (*os.File, error) {
+	port, err := os.OpenFile(serialPortFile, os.O_RDWR, 0)
+	if err != nil {
+		debug("unable to open %s, error: %s", serialPortFile, err)
+		return nil, errSerialNotAvailable
+	}
+	return port, nil
+}
@@ -0,0 +1,11 @@
+// +build !linux
+
+package qemuguesttools
+
+import "os"
+
+// openSerialPort returns errSerialNotAvailable, as the serial channel is only
+// supported for linux guests.
+func openSerialPort() (*os.File, error) {
+	return nil, errSerialNotAvailable
+}
@@ -0,0 +1,43 @@
+package qemuguesttools
+
+import "net/http"
+
+// tokenTransport is an http.RoundTripper that adds the meta-data token to
+// requests as 'Authorization: Bearer <token>'.
+type tokenTransport struct {
+	token string
+	base  http.RoundTripper
+}
+
+// newTokenTransport returns an http.RoundTripper that sends token with all
+// requests using base, if token is empty base is returned.
+func newTokenTransport(token string, base http.RoundTripper) http.RoundTripper {
+	if token == "" {
+		return base
+	}
+	return &tokenTransport{token: token, base: base}
+}
+
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrip must not modify the request, so we copy it with new headers
+	r := *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("Authorization", "Bearer "+t.token)
+	return t.base.RoundTrip(&r)
+}
+
+// authHeader returns headers for websocket requests to the meta-data service
+func (g *guestTools) authHeader() http.Header {
+	return tokenHeader(g.token)
+}
+
+// tokenHeader returns headers with token, or nil if token is empty
+func tokenHeader(token string) http.Header {
+	if token == "" {
+		return nil
+	}
+	return http.Header{"Authorization": []string{"Bearer " + token}}
+}
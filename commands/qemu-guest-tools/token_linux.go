@@ -0,0 +1,24 @@
+package qemuguesttools
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// metaDataTokenFile is where the qemu_fw_cfg module exposes the token set by
+// the host, see vm.MetaDataTokenName
+const metaDataTokenFile = "/sys/firmware/qemu_fw_cfg/by_name/opt/org.taskcluster/meta-data-token/raw"
+
+// readMetaDataToken returns the token for the meta-data service, or an empty
+// string if the host didn't set a token.
+func readMetaDataToken() (string, error) {
+	data, err := ioutil.ReadFile(metaDataTokenFile)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(data)), nil
+}
@@ -0,0 +1,9 @@
+// +build !linux
+
+package qemuguesttools
+
+// readMetaDataToken returns an empty string, as the token is only supported
+// for linux guests.
+func readMetaDataToken() (string, error) {
+	return "", nil
+}
@@ -0,0 +1,27 @@
+package qemuguesttools
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTokenTransport(t *testing.T) {
+	var auth string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer s.Close()
+
+	req, err := http.NewRequest(http.MethodGet, s.URL, nil)
+	nilOrFatal(t, err, "Failed to create request")
+	client := http.Client{Transport: newTokenTransport("secret-token", http.DefaultTransport)}
+	res, err := client.Do(req)
+	nilOrFatal(t, err, "Request failed")
+	res.Body.Close()
+	assert(t, auth == "Bearer secret-token", "Expected token, got: ", auth)
+	assert(t, req.Header.Get("Authorization") == "", "Request was modified")
+
+	// No token means no header
+	assert(t, newTokenTransport("", http.DefaultTransport) == http.DefaultTransport, "Expected default transport")
+}
@@ -0,0 +1,153 @@
+package qemuguesttools
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/go-got"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/metaservice"
+	"github.com/taskcluster/taskcluster-worker/runtime/ioext"
+)
+
+// uploadChunkSize is the size of chunks sent when uploading artifacts, if a
+// chunk is interrupted only the part not received by the host is resent.
+const uploadChunkSize = 64 * 1024 * 1024
+
+// uploadChunkRetries is the number of times we retry sending a chunk without
+// making progress, before the upload fails.
+const uploadChunkRetries = 15
+
+// errResumableUploadNotSupported is returned by uploadResumable, if the host
+// doesn't support resumable uploads.
+var errResumableUploadNotSupported = errors.New("resumable uploads are not supported by the host")
+
+// uploadResumable uploads f as artifact named name in chunks, resuming from
+// the offset received by the host when a chunk is interrupted. The host checks
+// the SHA-256 of the content before uploading the artifact.
+func (g *guestTools) uploadResumable(f *os.File, name, mimetype string) error {
+	info, err := f.Stat()
+	if err != nil {
+		return errors.Wrap(err, "failed to stat file")
+	}
+	size := info.Size()
+
+	// Hash the file up-front, so we can resume from any offset
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return errors.Wrap(err, "failed to read file")
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+
+	// Create upload
+	req := g.got.Post(g.url("engine/v1/upload?name="+url.QueryEscape(name)), nil)
+	req.Header.Set("Content-Type", mimetype)
+	res, err := req.Send()
+	if e, ok := err.(got.BadResponseCodeError); ok && e.StatusCode == http.StatusNotFound {
+		return errResumableUploadNotSupported
+	}
+	if err != nil {
+		return errors.Wrap(responseError(err), "failed to create upload")
+	}
+	var u metaservice.Upload
+	if err = json.Unmarshal(res.Body, &u); err != nil {
+		return errors.Wrap(err, "failed to parse upload")
+	}
+	uploadURL := g.url("engine/v1/upload/" + url.PathEscape(u.ID))
+
+	// Send chunks, resuming from the offset reported by the host on failure
+	offset := int64(0)
+	attempts := 0
+	for offset < size {
+		n := size - offset
+		if n > uploadChunkSize {
+			n = uploadChunkSize
+		}
+		var next int64
+		next, err = g.sendChunk(uploadURL, f, offset, n)
+		if err == nil {
+			offset = next
+			attempts = 0
+			continue
+		}
+
+		attempts++
+		if attempts > uploadChunkRetries {
+			g.got.Delete(uploadURL).Send()
+			return errors.Wrapf(err, "failed to send chunk at offset %d", offset)
+		}
+		g.monitor.Warn("Failed to send chunk at offset ", offset, " retrying, error: ", err)
+		time.Sleep(backOff.Delay(attempts))
+
+		// Get the offset reached, as part of the chunk may have been received
+		res, err = g.got.Get(uploadURL).Send()
+		if err != nil {
+			return errors.Wrap(responseError(err), "failed to get upload offset")
+		}
+		if err = json.Unmarshal(res.Body, &u); err != nil {
+			return errors.Wrap(err, "failed to parse upload")
+		}
+		offset = u.Offset
+	}
+
+	// Finish upload
+	_, err = g.got.Post(uploadURL+"?sha256="+sum, nil).Send()
+	if err != nil {
+		return errors.Wrap(responseError(err), "failed to finish upload")
+	}
+	return nil
+}
+
+// sendChunk sends n bytes from f starting at offset, and returns the offset
+// reached by the host.
+func (g *guestTools) sendChunk(uploadURL string, f *os.File, offset, n int64) (int64, error) {
+	req, err := http.NewRequest(http.MethodPut, uploadURL+"?offset="+strconv.FormatInt(offset, 10), io.NewSectionReader(f, offset, n))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to create request")
+	}
+	req.ContentLength = n
+
+	// Chunks may take time to send, so we don't use a timeout
+	client := http.Client{Timeout: 0, Transport: g.transport}
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	data, err := ioext.ReadAtMost(res.Body, 64*1024)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read response")
+	}
+	if res.StatusCode != http.StatusOK {
+		return 0, responseError(got.BadResponseCodeError{Response: &got.Response{
+			StatusCode: res.StatusCode,
+			Body:       data,
+		}})
+	}
+	var u metaservice.Upload
+	if err = json.Unmarshal(data, &u); err != nil {
+		return 0, errors.Wrap(err, "failed to parse response")
+	}
+	return u.Offset, nil
+}
+
+// responseError returns err with the message from the meta-data service, if
+// err is a got.BadResponseCodeError with an error payload.
+func responseError(err error) error {
+	e, ok := err.(got.BadResponseCodeError)
+	if !ok {
+		return err
+	}
+	var payload metaservice.Error
+	if json.Unmarshal(e.Body, &payload) == nil && payload.Message != "" {
+		return errors.Errorf("status: %d, error: %s", e.StatusCode, payload.Message)
+	}
+	return errors.Errorf("status: %d", e.StatusCode)
+}
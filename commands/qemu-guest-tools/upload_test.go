@@ -0,0 +1,47 @@
+package qemuguesttools
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/metaservice"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/mocks"
+)
+
+func TestGuestToolsUploadArtifact(t *testing.T) {
+	storage, err := runtime.NewTemporaryStorage(os.TempDir())
+	nilOrFatal(t, err, "Failed to create TemporaryStorage")
+	s := metaservice.New([]string{"true"}, map[string]string{}, ioutil.Discard, func(bool) {}, &runtime.Environment{
+		TemporaryStorage: storage,
+	})
+	var uploaded runtime.S3Artifact
+	var data []byte
+	s.SetArtifactUploader(func(artifact runtime.S3Artifact) error {
+		uploaded = artifact
+		data, err = ioutil.ReadAll(artifact.Stream)
+		return err
+	})
+
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	u, err := url.Parse(ts.URL)
+	nilOrFatal(t, err, "Failed to parse url")
+
+	folder, err := ioutil.TempDir("", "qemu-guest-tools-upload")
+	nilOrFatal(t, err, "Failed to create temporary folder")
+	defer os.RemoveAll(folder)
+	file := filepath.Join(folder, "hello.txt")
+	nilOrFatal(t, ioutil.WriteFile(file, []byte("hello world"), 0644), "Failed to write file")
+
+	g := new(config{}, u.Host, mocks.NewMockMonitor(true))
+	err = g.UploadArtifact(file, "public/hello.txt", "text/plain")
+	nilOrFatal(t, err, "Failed to upload artifact")
+	assert(t, uploaded.Name == "public/hello.txt", "Unexpected name: ", uploaded.Name)
+	assert(t, uploaded.Mimetype == "text/plain", "Unexpected mimetype: ", uploaded.Mimetype)
+	assert(t, string(data) == "hello world", "Unexpected artifact: ", string(data))
+}
@@ -27,11 +27,17 @@ func (cmd) Usage() string {
 	return `
 taskcluster-worker schema can be used to export JSON schema document
 for the worker configuration file. Given a configuration file the command can
-also be used to export payload schema.
+also be used to export payload schema, this is the combined schema for the
+engine and plugins enabled in the configuration file.
+
+Using 'all' exports a single document with the properties 'config' and
+'payload' holding the two schemas, this is useful for tooling that generates
+or validates tasks and configuration files.
 
 usage:
   taskcluster-worker schema config [options]
   taskcluster-worker schema payload [options] <config.yml>
+  taskcluster-worker schema all [options] <config.yml>
 
 options:
   -f --format <format>          Set the format json or yaml [Default: json].
@@ -44,7 +50,7 @@ func (cmd) Execute(args map[string]interface{}) bool {
 	var schema interface{}
 
 	if args["config"].(bool) {
-		schema = worker.ConfigSchema().Schema()
+		schema = withMetaSchema(worker.ConfigSchema().Schema())
 	} else {
 		config, err := config.LoadFromFile(args["<config.yml>"].(string), monitor)
 		if err != nil {
@@ -57,7 +63,15 @@ func (cmd) Execute(args map[string]interface{}) bool {
 			fmt.Printf("Failed to initialize worker, error: %s\n", err)
 			return false
 		}
-		schema = w.PayloadSchema().Schema()
+		payload := withMetaSchema(w.PayloadSchema().Schema())
+		if args["all"].(bool) {
+			schema = map[string]interface{}{
+				"config":  withMetaSchema(worker.ConfigSchema().Schema()),
+				"payload": payload,
+			}
+		} else {
+			schema = payload
+		}
 	}
 
 	// Format schema to JSON or YAML
@@ -86,3 +100,10 @@ func (cmd) Execute(args map[string]interface{}) bool {
 
 	return true
 }
+
+// withMetaSchema declares the JSON schema draft used, such that the exported
+// schema can be consumed by off-the-shelf validators.
+func withMetaSchema(schema map[string]interface{}) map[string]interface{} {
+	schema["$schema"] = "http://json-schema.org/draft-04/schema#"
+	return schema
+}
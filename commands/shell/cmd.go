@@ -5,6 +5,7 @@ import (
 	"io"
 	"net/url"
 	"os"
+	"strconv"
 
 	"github.com/gorilla/websocket"
 	isatty "github.com/mattn/go-isatty"
@@ -29,10 +30,27 @@ func (cmd) Usage() string {
 taskcluster-worker shell will open a websocket to an interactive task, start
 a shell and expose it in your terminal. This is similar to using an SSH client.
 
-usage: taskcluster-worker shell [options] <URL> [--] [<command>...]
+Given --task-id the websocket URL is read from the 'sockets.json' artifact
+created by the interactive plugin. This artifact is private, so credentials
+must be given in the environment variables TASKCLUSTER_CLIENT_ID,
+TASKCLUSTER_ACCESS_TOKEN and TASKCLUSTER_CERTIFICATE, and these must have the
+scope 'queue:get-artifact:<prefix>sockets.json'.
+
+Given --vnc a display offered by the task (e.g. the screen of a qemu virtual
+machine) is exposed as VNC on localhost:<port>, instead of opening a shell.
+
+usage:
+  taskcluster-worker shell [options] <URL> [--] [<command>...]
+  taskcluster-worker shell [options] --task-id <taskId> [--] [<command>...]
+  taskcluster-worker shell [options] --task-id <taskId> --vnc <port> [--display <display>]
 
 options:
-  -h --help     Show this screen.
+  --task-id <taskId>            TaskId of a running interactive task.
+  --artifact-prefix <prefix>    Artifact prefix used by the interactive plugin
+                                [default: ` + defaultArtifactPrefix + `].
+  --vnc <port>                  Expose display as VNC on the given port.
+  --display <display>           Display to expose, defaults to the first display.
+  -h --help                     Show this screen.
 `
 }
 
@@ -43,10 +61,40 @@ var dialer = websocket.Dialer{
 }
 
 func (cmd) Execute(arguments map[string]interface{}) bool {
-	URL := arguments["<URL>"].(string)
-	command := arguments["<command>"].([]string)
+	URL, _ := arguments["<URL>"].(string)
+	command, _ := arguments["<command>"].([]string)
 	tty := isatty.IsTerminal(os.Stdout.Fd())
 
+	// Find socket URLs from the task, if given a taskId
+	if taskID, ok := arguments["--task-id"].(string); ok {
+		prefix := arguments["--artifact-prefix"].(string)
+		s, err := fetchSockets(credentialsFromEnv(), taskID, prefix)
+		if err != nil {
+			fmt.Println("Failed to find interactive sockets, error: ", err)
+			return false
+		}
+
+		if vnc, ok := arguments["--vnc"].(string); ok {
+			port, err := strconv.ParseInt(vnc, 10, 32)
+			if err != nil {
+				fmt.Println("Couldn't parse --vnc, error: ", err)
+				return false
+			}
+			if s.DisplaysURL == "" {
+				fmt.Println("The task doesn't offer any displays")
+				return false
+			}
+			display, _ := arguments["--display"].(string)
+			return exposeDisplay(s.DisplaysURL, display, int(port))
+		}
+
+		if s.ShellSocketURL == "" {
+			fmt.Println("The task doesn't offer an interactive shell")
+			return false
+		}
+		URL = s.ShellSocketURL
+	}
+
 	// Parse URL
 	u, err := url.Parse(URL)
 	if err != nil {
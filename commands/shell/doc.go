@@ -1,6 +1,6 @@
 // Package shell provides a CommandProvider that implements a CLI tool for
 // opening to a interactive shell to an interactive taskcluster-worker task
-// in your terminal.
+// in your terminal, or exposing a display from the task as VNC.
 package shell
 
 import "github.com/taskcluster/taskcluster-worker/runtime/util"
@@ -0,0 +1,84 @@
+package shell
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	got "github.com/taskcluster/go-got"
+	tcclient "github.com/taskcluster/taskcluster-client-go"
+	"github.com/taskcluster/taskcluster-client-go/tcqueue"
+)
+
+// defaultArtifactPrefix is the default artifact prefix used by the interactive
+// plugin.
+const defaultArtifactPrefix = "private/interactive/"
+
+// sockets is the structure of the sockets.json artifact created by the
+// interactive plugin.
+type sockets struct {
+	Version          int    `json:"version"`
+	ShellSocketURL   string `json:"shellSocketUrl"`
+	DisplaysURL      string `json:"displaysUrl"`
+	DisplaySocketURL string `json:"displaySocketUrl"`
+}
+
+// credentialsFromEnv returns the taskcluster credentials from the environment
+// variables used by other taskcluster tools.
+func credentialsFromEnv() *tcclient.Credentials {
+	return &tcclient.Credentials{
+		ClientID:    os.Getenv("TASKCLUSTER_CLIENT_ID"),
+		AccessToken: os.Getenv("TASKCLUSTER_ACCESS_TOKEN"),
+		Certificate: os.Getenv("TASKCLUSTER_CERTIFICATE"),
+	}
+}
+
+// fetchSockets fetches the sockets.json artifact from the latest run of the
+// task given by taskID, using the credentials given.
+//
+// The artifact is private, so the credentials must have the scope:
+// 'queue:get-artifact:<artifactPrefix>sockets.json'.
+func fetchSockets(creds *tcclient.Credentials, taskID, artifactPrefix string) (*sockets, error) {
+	name := artifactPrefix + "sockets.json"
+	q := tcqueue.New(creds)
+	if baseURL := os.Getenv("QUEUE_BASE_URL"); baseURL != "" {
+		q.BaseURL = baseURL
+	}
+	u, err := q.GetLatestArtifact_SignedURL(taskID, name, 15*time.Minute)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sign artifact url")
+	}
+
+	debug("fetching %s from task %s", name, taskID)
+	g := got.New()
+	g.Client = &http.Client{Timeout: 30 * time.Second}
+	g.MaxSize = 1024 * 1024
+	res, err := g.Get(u.String()).Send()
+	if rerr, ok := err.(got.BadResponseCodeError); ok {
+		switch rerr.StatusCode {
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return nil, fmt.Errorf(
+				"not authorized to fetch '%s', your credentials must have the scope: 'queue:get-artifact:%s'",
+				name, name,
+			)
+		case http.StatusNotFound:
+			return nil, fmt.Errorf(
+				"task %s has no artifact '%s', the task may not be running or may not be interactive",
+				taskID, name,
+			)
+		}
+		return nil, fmt.Errorf("failed to fetch '%s', status: %d", name, rerr.StatusCode)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch '%s'", name)
+	}
+
+	var s sockets
+	if err = json.Unmarshal(res.Body, &s); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse '%s'", name)
+	}
+	return &s, nil
+}
@@ -0,0 +1,91 @@
+package shell
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	tcclient "github.com/taskcluster/taskcluster-client-go"
+)
+
+func TestFetchSockets(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Name is escaped by the client, so only match the end of the path
+		if !strings.HasSuffix(r.URL.Path, "/artifacts/"+defaultArtifactPrefix+"sockets.json") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if r.URL.Query().Get("bewit") == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/task/running-task/"):
+			w.Write([]byte(`{
+				"version": 1,
+				"shellSocketUrl": "wss://example.com/shell/",
+				"displaysUrl": "https://example.com/displays/",
+				"displaySocketUrl": "wss://example.com/display/"
+			}`))
+		case strings.HasPrefix(r.URL.Path, "/task/forbidden-task/"):
+			w.WriteHeader(http.StatusForbidden)
+		case strings.HasPrefix(r.URL.Path, "/task/bad-request-task/"):
+			w.WriteHeader(http.StatusBadRequest)
+		case strings.HasPrefix(r.URL.Path, "/task/invalid-task/"):
+			w.Write([]byte(`{"version":`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+
+	defer os.Setenv("QUEUE_BASE_URL", os.Getenv("QUEUE_BASE_URL"))
+	os.Setenv("QUEUE_BASE_URL", s.URL)
+
+	creds := &tcclient.Credentials{
+		ClientID:    "tester",
+		AccessToken: "no-secret",
+	}
+
+	t.Run("running task", func(t *testing.T) {
+		sockets, err := fetchSockets(creds, "running-task", defaultArtifactPrefix)
+		require.NoError(t, err)
+		require.Equal(t, 1, sockets.Version)
+		require.Equal(t, "wss://example.com/shell/", sockets.ShellSocketURL)
+		require.Equal(t, "https://example.com/displays/", sockets.DisplaysURL)
+		require.Equal(t, "wss://example.com/display/", sockets.DisplaySocketURL)
+	})
+
+	t.Run("unknown artifact prefix", func(t *testing.T) {
+		_, err := fetchSockets(creds, "running-task", "public/")
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "may not be interactive")
+	})
+
+	t.Run("unknown task", func(t *testing.T) {
+		_, err := fetchSockets(creds, "unknown-task", defaultArtifactPrefix)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "may not be interactive")
+	})
+
+	t.Run("missing scope", func(t *testing.T) {
+		_, err := fetchSockets(creds, "forbidden-task", defaultArtifactPrefix)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "queue:get-artifact:"+defaultArtifactPrefix+"sockets.json")
+	})
+
+	t.Run("unexpected status", func(t *testing.T) {
+		_, err := fetchSockets(creds, "bad-request-task", defaultArtifactPrefix)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "400")
+	})
+
+	t.Run("invalid sockets.json", func(t *testing.T) {
+		_, err := fetchSockets(creds, "invalid-task", defaultArtifactPrefix)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "failed to parse")
+	})
+}
@@ -0,0 +1,83 @@
+package shell
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+
+	"github.com/taskcluster/taskcluster-worker/plugins/interactive/displayclient"
+)
+
+// exposeDisplay lists displays from displaysURL and exposes the display given
+// (or the first display, if empty) as a VNC server on localhost:port, until
+// interrupted.
+func exposeDisplay(displaysURL, display string, port int) bool {
+	displays, err := displayclient.ListDisplays(displaysURL)
+	if err != nil {
+		fmt.Println("Failed to list displays, error: ", err)
+		return false
+	}
+	if len(displays) == 0 {
+		fmt.Println("The task doesn't offer any displays")
+		return false
+	}
+	var target *displayclient.Display
+	for i := range displays {
+		if display == "" || displays[i].Display == display {
+			target = &displays[i]
+			break
+		}
+	}
+	if target == nil {
+		fmt.Printf("The task doesn't offer a display named '%s', displays offered:\n", display)
+		for _, d := range displays {
+			fmt.Printf("  %s (%dx%d)\n", d.Display, d.Width, d.Height)
+		}
+		return false
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("localhost:%d", port))
+	if err != nil {
+		fmt.Printf("Failed to listen on port %d, error: %s\n", port, err)
+		return false
+	}
+	fmt.Printf("Exposing display '%s' as VNC on localhost:%d, press Ctrl+C to stop\n", target.Display, port)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			client, err := target.OpenDisplay()
+			if err != nil {
+				fmt.Println("Failed to open display, error: ", err)
+				conn.Close()
+				continue
+			}
+			debug("connected display '%s'", target.Display)
+			go connect(conn, client)
+		}
+	}()
+
+	// Wait for interrupt
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	<-c
+	listener.Close()
+	return true
+}
+
+// connect copies data between c1 and c2, closing both when done
+func connect(c1 net.Conn, c2 io.ReadWriteCloser) {
+	go func() {
+		io.Copy(c1, c2)
+		c1.Close()
+		c2.Close()
+	}()
+	io.Copy(c2, c1)
+	c1.Close()
+	c2.Close()
+}
@@ -0,0 +1,134 @@
+// Package status implements a command for querying the status of a running
+// worker through the localhost control API.
+package status
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	units "github.com/docker/go-units"
+	"github.com/taskcluster/taskcluster-worker/commands"
+	"github.com/taskcluster/taskcluster-worker/worker"
+)
+
+func init() {
+	commands.Register("status", cmd{})
+}
+
+type cmd struct{}
+
+func (cmd) Summary() string {
+	return "Query the status of a running worker"
+}
+
+func (cmd) Usage() string {
+	return `
+taskcluster-worker status queries a worker running on this host, through the
+control API, and prints the worker state, active tasks, resource usage and
+recent errors.
+
+The control API must be enabled with the 'controlPort' configuration option,
+and is only exposed on localhost. Requests are authenticated with the token
+the worker writes to the file given in the 'controlTokenFile' option.
+
+usage:
+  taskcluster-worker status [options] --token-file <file>
+
+options:
+  -t --token-file <file>  File with the control API token, see 'controlTokenFile'.
+  -p --port <port>        Port the control API is exposed on [default: 60023].
+  -j --json               Print status as JSON.
+  -h --help               Show this screen.
+`
+}
+
+func (cmd) Execute(args map[string]interface{}) bool {
+	port, err := strconv.Atoi(args["--port"].(string))
+	if err != nil || port <= 0 || port > 65535 {
+		fmt.Println("Invalid port: ", args["--port"])
+		return false
+	}
+
+	token, err := ioutil.ReadFile(args["--token-file"].(string))
+	if err != nil {
+		fmt.Println("Failed to read control API token, error: ", err)
+		return false
+	}
+
+	u := fmt.Sprintf("http://127.0.0.1:%d/status", port)
+	req, _ := http.NewRequest(http.MethodGet, u, nil)
+	req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	c := http.Client{Timeout: 30 * time.Second}
+	res, err := c.Do(req)
+	if err != nil {
+		fmt.Printf("Failed to query worker on localhost:%d, is the control API enabled? error: %s\n", port, err)
+		return false
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		fmt.Printf("Unexpected response from control API, status: %d\n", res.StatusCode)
+		return false
+	}
+
+	var s worker.Status
+	if err = json.NewDecoder(res.Body).Decode(&s); err != nil {
+		fmt.Println("Failed to parse response from control API, error: ", err)
+		return false
+	}
+
+	if args["--json"].(bool) {
+		data, _ := json.MarshalIndent(s, "", "  ")
+		fmt.Println(string(data))
+		return true
+	}
+
+	printStatus(s)
+	return true
+}
+
+func printStatus(s worker.Status) {
+	state := "running"
+	if s.Stopping {
+		state = "stopping"
+	}
+	health := "healthy"
+	if !s.Healthy {
+		health = "unhealthy: " + s.HealthError
+	}
+	fmt.Printf("worker:      %s/%s\n", s.WorkerGroup, s.WorkerID)
+	fmt.Printf("state:       %s (%s)\n", state, health)
+	if !s.Started.IsZero() {
+		fmt.Printf("started:     %s (uptime %s)\n", s.Started.Format(time.RFC3339), s.Uptime)
+	}
+	fmt.Printf("claimed:     %d tasks\n", s.ClaimedTasks)
+	fmt.Println("")
+
+	fmt.Printf("Active tasks (%d):\n", len(s.ActiveTasks))
+	for _, t := range s.ActiveTasks {
+		fmt.Printf("  %s/%d  stage: %s, running for %s\n",
+			t.TaskID, t.RunID, t.Stage, time.Since(t.Started)/time.Second*time.Second)
+	}
+	fmt.Println("")
+
+	r := s.Resources
+	fmt.Println("Resources:")
+	fmt.Printf("  memory:     %s\n", units.HumanSize(float64(r.MemoryRSS)))
+	fmt.Printf("  cpu:        %.1fs user, %.1fs system\n", r.CPUUserSeconds, r.CPUSysSeconds)
+	fmt.Printf("  goroutines: %d\n", r.Goroutines)
+	fmt.Printf("  disk:       %s free of %s\n", units.HumanSize(float64(r.DiskFree)), units.HumanSize(float64(r.DiskTotal)))
+	fmt.Println("")
+
+	fmt.Printf("Recent errors (%d):\n", len(s.RecentErrors))
+	for _, e := range s.RecentErrors {
+		incident := ""
+		if e.IncidentID != "" {
+			incident = " (incidentId: " + e.IncidentID + ")"
+		}
+		fmt.Printf("  %s [%s] %s%s\n", e.Time.Format(time.RFC3339), e.Level, e.Message, incident)
+	}
+}
@@ -0,0 +1,136 @@
+// Package testengine implements a command for running the engine conformance
+// test suite from engines/enginetest against a configured engine.
+package testengine
+
+import (
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/taskcluster/taskcluster-worker/commands"
+	"github.com/taskcluster/taskcluster-worker/config"
+	"github.com/taskcluster/taskcluster-worker/engines"
+	"github.com/taskcluster/taskcluster-worker/engines/enginetest"
+	"github.com/taskcluster/taskcluster-worker/runtime/monitoring"
+)
+
+func init() {
+	commands.Register("test-engine", cmd{})
+}
+
+type cmd struct{}
+
+func (cmd) Summary() string {
+	return "Run engine conformance tests against a configured engine"
+}
+
+func (cmd) Usage() string {
+	return `
+taskcluster-worker test-engine runs the standardized engine test suite against
+<engine> on this host. This covers starting, killing and aborting sandboxes,
+interactive shells, artifact extraction, log output, cache volume attachment,
+environment variables, proxies and displays.
+
+Task payloads are engine specific, so the test cases are given in <suite.yml>,
+test cases not given in the suite file are skipped. The engine configuration is
+read from the 'config' property of <suite.yml>, unless --config is given, in
+which case the engine configuration is read from the worker configuration file.
+
+usage:
+  taskcluster-worker test-engine [options] <engine> <suite.yml>
+
+options:
+  -c --config <config.yml>  Worker configuration file to read engine config from.
+  -r --run <regexp>         Only run tests with names matching <regexp>.
+  -l --list                 List tests without running them.
+  -h --help                 Show this screen.
+`
+}
+
+func (cmd) Execute(args map[string]interface{}) bool {
+	engine := args["<engine>"].(string)
+	if _, ok := engines.Engines()[engine]; !ok {
+		fmt.Printf("Unknown engine: '%s'\n", engine)
+		return false
+	}
+
+	s, err := loadSuite(args["<suite.yml>"].(string))
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+
+	// Find engine configuration
+	engineConfig := s.Config
+	if configFile, ok := args["--config"].(string); ok {
+		c, err := config.LoadFromFile(configFile, monitoring.PreConfig())
+		if err != nil {
+			fmt.Println("Failed to load configuration file, error: ", err)
+			return false
+		}
+		engineConfig = c.(map[string]interface{})["engines"].(map[string]interface{})[engine]
+	}
+	if engineConfig == nil {
+		fmt.Printf("No configuration given for engine: '%s'\n", engine)
+		return false
+	}
+	if err = engines.Engines()[engine].ConfigSchema().Validate(engineConfig); err != nil {
+		fmt.Println("Invalid engine configuration, error: ", err)
+		return false
+	}
+
+	var filter *regexp.Regexp
+	if pattern, ok := args["--run"].(string); ok {
+		filter, err = regexp.Compile(pattern)
+		if err != nil {
+			fmt.Println("Invalid --run <regexp>, error: ", err)
+			return false
+		}
+	}
+
+	provider := &enginetest.EngineProvider{
+		Engine: engine,
+		Config: toJSON(engineConfig),
+	}
+	tests := s.tests(provider, filter)
+	if len(tests) == 0 {
+		fmt.Println("No tests to run")
+		return false
+	}
+	if args["--list"].(bool) {
+		for _, t := range tests {
+			fmt.Println(t.Name)
+		}
+		return true
+	}
+
+	// Reuse the engine between tests, creating engines can be slow
+	provider.SetupEngine()
+	defer provider.TearDownEngine()
+
+	failed := 0
+	for _, t := range tests {
+		start := time.Now()
+		err := runTest(t)
+		duration := time.Since(start) / time.Millisecond * time.Millisecond
+		if err != nil {
+			failed++
+			fmt.Printf("FAIL  %s (%s)\n      %s\n", t.Name, duration, err)
+		} else {
+			fmt.Printf("PASS  %s (%s)\n", t.Name, duration)
+		}
+	}
+	fmt.Printf("\n%d passed, %d failed\n", len(tests)-failed, failed)
+	return failed == 0
+}
+
+// runTest runs t, returning an error if the test panics
+func runTest(t test) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	t.Run()
+	return nil
+}
@@ -0,0 +1,384 @@
+package testengine
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	schematypes "github.com/taskcluster/go-schematypes"
+	"github.com/taskcluster/taskcluster-worker/engines"
+	"github.com/taskcluster/taskcluster-worker/engines/enginetest"
+	"github.com/taskcluster/taskcluster-worker/runtime/util"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// suite is a test suite definition, as loaded from a suite file
+type suite struct {
+	Config      interface{}   `json:"config"`
+	Kill        *killCase     `json:"kill"`
+	Logging     *loggingCase  `json:"logging"`
+	Shell       *shellCase    `json:"shell"`
+	Artifacts   *artifactCase `json:"artifacts"`
+	Volume      *volumeCase   `json:"volume"`
+	Environment *envVarCase   `json:"environment"`
+	Proxy       *proxyCase    `json:"proxy"`
+	Display     *displayCase  `json:"display"`
+}
+
+type killCase struct {
+	Target  string      `json:"target"`
+	Payload interface{} `json:"payload"`
+}
+
+type loggingCase struct {
+	Target         string      `json:"target"`
+	TargetPayload  interface{} `json:"targetPayload"`
+	FailingPayload interface{} `json:"failingPayload"`
+	SilentPayload  interface{} `json:"silentPayload"`
+}
+
+type shellCase struct {
+	Command      string      `json:"command"`
+	Stdout       string      `json:"stdout"`
+	Stderr       string      `json:"stderr"`
+	BadCommand   string      `json:"badCommand"`
+	SleepCommand string      `json:"sleepCommand"`
+	Payload      interface{} `json:"payload"`
+}
+
+type artifactCase struct {
+	Text               string      `json:"text"`
+	TextFilePath       string      `json:"textFilePath"`
+	FileNotFoundPath   string      `json:"fileNotFoundPath"`
+	FolderNotFoundPath string      `json:"folderNotFoundPath"`
+	NestedFolderFiles  []string    `json:"nestedFolderFiles"`
+	NestedFolderPath   string      `json:"nestedFolderPath"`
+	Payload            interface{} `json:"payload"`
+}
+
+type volumeCase struct {
+	Mountpoint         string      `json:"mountpoint"`
+	WriteVolumePayload interface{} `json:"writeVolumePayload"`
+	CheckVolumePayload interface{} `json:"checkVolumePayload"`
+}
+
+type envVarCase struct {
+	VariableName         string      `json:"variableName"`
+	InvalidVariableNames []string    `json:"invalidVariableNames"`
+	Payload              interface{} `json:"payload"`
+}
+
+type proxyCase struct {
+	ProxyName        string      `json:"proxyName"`
+	PingProxyPayload interface{} `json:"pingProxyPayload"`
+}
+
+type displayCase struct {
+	Displays []struct {
+		Name        string `json:"name"`
+		Description string `json:"description"`
+		Width       int    `json:"width"`
+		Height      int    `json:"height"`
+	} `json:"displays"`
+	InvalidDisplayName string      `json:"invalidDisplayName"`
+	Payload            interface{} `json:"payload"`
+}
+
+// payloadSchema accepts any task.payload, payloads are validated against the
+// engine payload schema when the tests are executed.
+var payloadSchema = schematypes.Object{
+	Title:                "Task Payload",
+	Description:          "A `task.payload` as accepted by the engine being tested.",
+	AdditionalProperties: true,
+}
+
+var str = schematypes.String{}
+
+var strList = schematypes.Array{Items: schematypes.String{}}
+
+// suiteSchema is the schema for suite files, properties are explained in the
+// documentation for the matching test case in engines/enginetest.
+var suiteSchema = schematypes.Object{
+	Title: "Engine Test Suite",
+	Description: util.Markdown(`
+		Definition of the engine test suite. Each test case is optional, test
+		cases not given will be skipped. See 'engines/enginetest' for detailed
+		documentation of each test case.
+	`),
+	Properties: schematypes.Properties{
+		"config": schematypes.Object{
+			Title:                "Engine Configuration",
+			Description:          "Engine configuration, ignored if '--config' is given.",
+			AdditionalProperties: true,
+		},
+		"kill": schematypes.Object{
+			Title: "Kill Test Case",
+			Properties: schematypes.Properties{
+				"target":  str,
+				"payload": payloadSchema,
+			},
+			Required: []string{"target", "payload"},
+		},
+		"logging": schematypes.Object{
+			Title: "Logging Test Case",
+			Properties: schematypes.Properties{
+				"target":         str,
+				"targetPayload":  payloadSchema,
+				"failingPayload": payloadSchema,
+				"silentPayload":  payloadSchema,
+			},
+			Required: []string{"target", "targetPayload", "failingPayload", "silentPayload"},
+		},
+		"shell": schematypes.Object{
+			Title: "Shell Test Case",
+			Properties: schematypes.Properties{
+				"command":      str,
+				"stdout":       str,
+				"stderr":       str,
+				"badCommand":   str,
+				"sleepCommand": str,
+				"payload":      payloadSchema,
+			},
+			Required: []string{"command", "stdout", "stderr", "badCommand", "sleepCommand", "payload"},
+		},
+		"artifacts": schematypes.Object{
+			Title: "Artifact Extraction Test Case",
+			Properties: schematypes.Properties{
+				"text":               str,
+				"textFilePath":       str,
+				"fileNotFoundPath":   str,
+				"folderNotFoundPath": str,
+				"nestedFolderFiles":  strList,
+				"nestedFolderPath":   str,
+				"payload":            payloadSchema,
+			},
+			Required: []string{
+				"text", "textFilePath", "fileNotFoundPath", "folderNotFoundPath",
+				"nestedFolderFiles", "nestedFolderPath", "payload",
+			},
+		},
+		"volume": schematypes.Object{
+			Title: "Cache Volume Test Case",
+			Properties: schematypes.Properties{
+				"mountpoint":         str,
+				"writeVolumePayload": payloadSchema,
+				"checkVolumePayload": payloadSchema,
+			},
+			Required: []string{"mountpoint", "writeVolumePayload", "checkVolumePayload"},
+		},
+		"environment": schematypes.Object{
+			Title: "Environment Variable Test Case",
+			Properties: schematypes.Properties{
+				"variableName":         str,
+				"invalidVariableNames": strList,
+				"payload":              payloadSchema,
+			},
+			Required: []string{"variableName", "invalidVariableNames", "payload"},
+		},
+		"proxy": schematypes.Object{
+			Title: "Proxy Test Case",
+			Properties: schematypes.Properties{
+				"proxyName":        str,
+				"pingProxyPayload": payloadSchema,
+			},
+			Required: []string{"proxyName", "pingProxyPayload"},
+		},
+		"display": schematypes.Object{
+			Title: "Display Test Case",
+			Properties: schematypes.Properties{
+				"displays": schematypes.Array{
+					Items: schematypes.Object{
+						Properties: schematypes.Properties{
+							"name":        str,
+							"description": str,
+							"width":       schematypes.Integer{Minimum: 0, Maximum: 65535},
+							"height":      schematypes.Integer{Minimum: 0, Maximum: 65535},
+						},
+						Required: []string{"name", "description", "width", "height"},
+					},
+				},
+				"invalidDisplayName": str,
+				"payload":            payloadSchema,
+			},
+			Required: []string{"displays", "invalidDisplayName", "payload"},
+		},
+	},
+}
+
+// test is a named test from the suite
+type test struct {
+	Name string
+	Run  func()
+}
+
+// loadSuite loads and validates a suite from a YAML file
+func loadSuite(filename string) (*suite, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read suite file '%s': %s", filename, err)
+	}
+	var value interface{}
+	if err = yaml.Unmarshal(data, &value); err != nil {
+		return nil, fmt.Errorf("failed to parse suite file '%s': %s", filename, err)
+	}
+	value = convertSimpleJSONTypes(value)
+	if err = suiteSchema.Validate(value); err != nil {
+		return nil, fmt.Errorf("invalid suite file '%s': %s", filename, err)
+	}
+	var s suite
+	schematypes.MustMap(suiteSchema, value, &s)
+	return &s, nil
+}
+
+// tests returns the tests in the suite with names matching filter, using the
+// engine from provider.
+func (s *suite) tests(p *enginetest.EngineProvider, filter *regexp.Regexp) []test {
+	var tests []test
+	add := func(name string, fn func()) {
+		if filter == nil || filter.MatchString(name) {
+			tests = append(tests, test{Name: name, Run: fn})
+		}
+	}
+
+	if c := s.Kill; c != nil {
+		k := enginetest.KillTestCase{
+			EngineProvider: p,
+			Target:         c.Target,
+			Payload:        toJSON(c.Payload),
+		}
+		add("kill", k.Test)
+	}
+	if c := s.Logging; c != nil {
+		l := &enginetest.LoggingTestCase{
+			EngineProvider: p,
+			Target:         c.Target,
+			TargetPayload:  toJSON(c.TargetPayload),
+			FailingPayload: toJSON(c.FailingPayload),
+			SilentPayload:  toJSON(c.SilentPayload),
+		}
+		add("logging/log-target", l.TestLogTarget)
+		add("logging/log-target-when-failing", l.TestLogTargetWhenFailing)
+		add("logging/silent-task", l.TestSilentTask)
+	}
+	if c := s.Shell; c != nil {
+		sh := &enginetest.ShellTestCase{
+			EngineProvider: p,
+			Command:        c.Command,
+			Stdout:         c.Stdout,
+			Stderr:         c.Stderr,
+			BadCommand:     c.BadCommand,
+			SleepCommand:   c.SleepCommand,
+			Payload:        toJSON(c.Payload),
+		}
+		add("shell/command", sh.TestCommand)
+		add("shell/bad-command", sh.TestBadCommand)
+		add("shell/abort-sleep-command", sh.TestAbortSleepCommand)
+		add("shell/kill-sleep-command", sh.TestKillSleepCommand)
+	}
+	if c := s.Artifacts; c != nil {
+		a := &enginetest.ArtifactTestCase{
+			EngineProvider:     p,
+			Text:               c.Text,
+			TextFilePath:       c.TextFilePath,
+			FileNotFoundPath:   c.FileNotFoundPath,
+			FolderNotFoundPath: c.FolderNotFoundPath,
+			NestedFolderFiles:  c.NestedFolderFiles,
+			NestedFolderPath:   c.NestedFolderPath,
+			Payload:            toJSON(c.Payload),
+		}
+		add("artifacts/extract-text-file", a.TestExtractTextFile)
+		add("artifacts/extract-file-not-found", a.TestExtractFileNotFound)
+		add("artifacts/extract-folder-not-found", a.TestExtractFolderNotFound)
+		add("artifacts/extract-nested-folder-path", a.TestExtractNestedFolderPath)
+		add("artifacts/extract-folder-handler-interrupt", a.TestExtractFolderHandlerInterrupt)
+	}
+	if c := s.Volume; c != nil {
+		v := &enginetest.VolumeTestCase{
+			EngineProvider:     p,
+			Mountpoint:         c.Mountpoint,
+			WriteVolumePayload: toJSON(c.WriteVolumePayload),
+			CheckVolumePayload: toJSON(c.CheckVolumePayload),
+		}
+		add("volume/write-read-volume", v.TestWriteReadVolume)
+		add("volume/read-empty-volume", v.TestReadEmptyVolume)
+		add("volume/write-to-read-only-volume", v.TestWriteToReadOnlyVolume)
+		add("volume/read-to-read-only-volume", v.TestReadToReadOnlyVolume)
+	}
+	if c := s.Environment; c != nil {
+		e := &enginetest.EnvVarTestCase{
+			EngineProvider:       p,
+			VariableName:         c.VariableName,
+			InvalidVariableNames: c.InvalidVariableNames,
+			Payload:              toJSON(c.Payload),
+		}
+		add("environment/print-variable", e.TestPrintVariable)
+		add("environment/variable-name-conflict", e.TestVariableNameConflict)
+		add("environment/invalid-variable-names", e.TestInvalidVariableNames)
+	}
+	if c := s.Proxy; c != nil {
+		px := &enginetest.ProxyTestCase{
+			EngineProvider:   p,
+			ProxyName:        c.ProxyName,
+			PingProxyPayload: toJSON(c.PingProxyPayload),
+		}
+		add("proxy/ping-proxy-payload", px.TestPingProxyPayload)
+		add("proxy/ping-404-is-unsuccessful", px.TestPing404IsUnsuccessful)
+		add("proxy/live-logging", px.TestLiveLogging)
+		add("proxy/parallel-pings", px.TestParallelPings)
+	}
+	if c := s.Display; c != nil {
+		d := &enginetest.DisplayTestCase{
+			EngineProvider:     p,
+			InvalidDisplayName: c.InvalidDisplayName,
+			Payload:            toJSON(c.Payload),
+		}
+		for _, display := range c.Displays {
+			d.Displays = append(d.Displays, engines.Display{
+				Name:        display.Name,
+				Description: display.Description,
+				Width:       display.Width,
+				Height:      display.Height,
+			})
+		}
+		add("display/list-displays", d.TestListDisplays)
+		add("display/displays", d.TestDisplays)
+		add("display/kill-display", d.TestKillDisplay)
+		add("display/invalid-display-name", d.TestInvalidDisplayName)
+	}
+	return tests
+}
+
+// toJSON serializes value as JSON, as expected by engines/enginetest
+func toJSON(value interface{}) string {
+	data, err := json.Marshal(value)
+	if err != nil {
+		panic(fmt.Sprintf("failed to serialize JSON compatible value, error: %s", err))
+	}
+	return string(data)
+}
+
+func convertSimpleJSONTypes(val interface{}) interface{} {
+	switch val := val.(type) {
+	case []interface{}:
+		r := make([]interface{}, len(val))
+		for i, v := range val {
+			r[i] = convertSimpleJSONTypes(v)
+		}
+		return r
+	case map[interface{}]interface{}:
+		r := make(map[string]interface{})
+		for k, v := range val {
+			s, ok := k.(string)
+			if !ok {
+				s = fmt.Sprintf("%v", k)
+			}
+			r[s] = convertSimpleJSONTypes(v)
+		}
+		return r
+	case int:
+		return float64(val)
+	default:
+		return val
+	}
+}
@@ -0,0 +1,36 @@
+package testengine
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/engines/enginetest"
+	_ "github.com/taskcluster/taskcluster-worker/engines/mock"
+)
+
+func TestMockEngineSuite(t *testing.T) {
+	s, err := loadSuite("testdata/mock.yml")
+	require.NoError(t, err)
+
+	provider := &enginetest.EngineProvider{
+		Engine: "mock",
+		Config: toJSON(s.Config),
+	}
+	provider.SetupEngine()
+	defer provider.TearDownEngine()
+
+	tests := s.tests(provider, nil)
+	require.Len(t, tests, 24)
+	for _, test := range tests {
+		require.NoError(t, runTest(test), "test %s failed", test.Name)
+	}
+
+	tests = s.tests(provider, regexp.MustCompile("^shell/"))
+	require.Len(t, tests, 4)
+}
+
+func TestRunTestRecoversPanic(t *testing.T) {
+	err := runTest(test{Name: "panic", Run: func() { panic("test failed") }})
+	require.EqualError(t, err, "test failed")
+}
@@ -0,0 +1,109 @@
+// Package validatepayload implements a command for validating task payloads
+// against the payload schema given by a worker configuration file.
+package validatepayload
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/commands"
+	"github.com/taskcluster/taskcluster-worker/config"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/monitoring"
+	"github.com/taskcluster/taskcluster-worker/worker"
+	"github.com/taskcluster/taskcluster-worker/worker/taskrun"
+)
+
+func init() {
+	commands.Register("validate-payload", cmd{})
+}
+
+type cmd struct{}
+
+func (cmd) Summary() string {
+	return "Validate a task payload against the payload schema"
+}
+
+func (cmd) Usage() string {
+	return `
+taskcluster-worker validate-payload will validate a task payload against the
+payload schema for the engine and plugins enabled in the given configuration
+file. Schema violations are printed as they would be reported in the task log,
+allowing task authors to catch errors before submitting the task.
+
+If --task is given the JSON file is read as a task definition and the 'payload'
+property is validated.
+
+usage:
+  taskcluster-worker validate-payload [options] <config.yml> <payload.json>
+
+options:
+  --task        Read <payload.json> as a task definition.
+  -h --help     Show this screen.
+`
+}
+
+func (cmd) Execute(args map[string]interface{}) bool {
+	monitor := monitoring.PreConfig()
+
+	payload, err := readPayload(args["<payload.json>"].(string), args["--task"].(bool))
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+
+	config, err := config.LoadFromFile(args["<config.yml>"].(string), monitor)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+
+	e, err := validatePayload(config, payload)
+	if err != nil {
+		fmt.Println(err)
+		return false
+	}
+	if e != nil {
+		fmt.Println(e.Error())
+		return false
+	}
+
+	fmt.Println("Payload is valid")
+	return true
+}
+
+// readPayload reads the payload from a JSON file, if isTask is true the file
+// is read as a task definition and the 'payload' property is returned.
+func readPayload(filename string, isTask bool) (interface{}, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read payload file")
+	}
+	var payload interface{}
+	if err = json.Unmarshal(data, &payload); err != nil {
+		return nil, errors.Wrap(err, "Failed to parse payload file as JSON")
+	}
+	if isTask {
+		task, ok := payload.(map[string]interface{})
+		if !ok || task["payload"] == nil {
+			return nil, errors.New("Task definition doesn't have a 'payload' property")
+		}
+		payload = task["payload"]
+	}
+	return payload, nil
+}
+
+// validatePayload creates a worker from config and validates payload against
+// the payload schema for the engine and plugins. Returns an error if the
+// worker can't be created.
+func validatePayload(config, payload interface{}) (*runtime.MalformedPayloadError, error) {
+	w, err := worker.New(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to initialize worker")
+	}
+	defer w.Dispose()
+
+	return taskrun.ValidatePayload(w.PayloadSchema(), payload), nil
+}
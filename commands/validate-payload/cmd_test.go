@@ -0,0 +1,130 @@
+package validatepayload
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	_ "github.com/taskcluster/taskcluster-worker/engines/mock"
+	_ "github.com/taskcluster/taskcluster-worker/plugins/maxruntime"
+)
+
+func testConfig(t *testing.T, folder string) interface{} {
+	tempFolder, _ := json.Marshal(filepath.Join(folder, "tmp"))
+	raw := `{
+		"engine": "mock",
+		"engines": {
+			"mock": {}
+		},
+		"plugins": {
+			"disabled": [],
+			"maxruntime": {
+				"maxRunTime": "3 hours",
+				"perTaskLimit": "require"
+			}
+		},
+		"webHookServer": {"provider": "localhost"},
+		"temporaryFolder": ` + string(tempFolder) + `,
+		"minimumDiskSpace": 0,
+		"minimumMemory": 0,
+		"monitor": {"type": "mock", "panicOnError": true},
+		"credentials": {
+			"clientId": "my-test-client-id",
+			"accessToken": "my-super-secret-access-token"
+		},
+		"worker": {
+			"provisionerId": "test-provisioner-id",
+			"workerType": "test-worker-type",
+			"workerGroup": "test-worker-group",
+			"workerId": "test-worker-id",
+			"pollingInterval": 1,
+			"reclaimOffset": 1,
+			"minimumReclaimDelay": 1,
+			"concurrency": 1
+		}
+	}`
+	var config interface{}
+	require.NoError(t, json.Unmarshal([]byte(raw), &config))
+	return config
+}
+
+func TestValidatePayload(t *testing.T) {
+	folder, err := ioutil.TempDir("", "validate-payload-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+	config := testConfig(t, folder)
+
+	validate := func(payload string) error {
+		var p interface{}
+		require.NoError(t, json.Unmarshal([]byte(payload), &p))
+		e, verr := validatePayload(config, p)
+		require.NoError(t, verr)
+		if e == nil {
+			return nil // avoid returning a typed nil
+		}
+		return e
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		require.NoError(t, validate(`{
+			"delay": 0, "function": "true", "argument": "", "maxRunTime": 60
+		}`))
+	})
+
+	t.Run("engine schema violation", func(t *testing.T) {
+		err := validate(`{
+			"delay": 0, "function": "no-such-function", "argument": "", "maxRunTime": 60
+		}`)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "function")
+	})
+
+	t.Run("plugin schema violation", func(t *testing.T) {
+		err := validate(`{"delay": 0, "function": "true", "argument": ""}`)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "maxRunTime")
+	})
+
+	t.Run("unknown property", func(t *testing.T) {
+		err := validate(`{
+			"delay": 0, "function": "true", "argument": "", "maxRunTime": 60, "image": "x"
+		}`)
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "image")
+	})
+}
+
+func TestReadPayload(t *testing.T) {
+	folder, err := ioutil.TempDir("", "validate-payload-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+
+	write := func(name, data string) string {
+		file := filepath.Join(folder, name)
+		require.NoError(t, ioutil.WriteFile(file, []byte(data), 0600))
+		return file
+	}
+	payload := write("payload.json", `{"function": "true"}`)
+	task := write("task.json", `{"workerType": "test", "payload": {"function": "true"}}`)
+	invalid := write("invalid.json", `{"function":`)
+
+	p, err := readPayload(payload, false)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"function": "true"}, p)
+
+	p, err = readPayload(task, true)
+	require.NoError(t, err)
+	require.Equal(t, map[string]interface{}{"function": "true"}, p)
+
+	_, err = readPayload(payload, true)
+	require.Error(t, err, "expected an error for a task without 'payload'")
+
+	_, err = readPayload(invalid, false)
+	require.Error(t, err)
+
+	_, err = readPayload(filepath.Join(folder, "missing.json"), false)
+	require.Error(t, err)
+}
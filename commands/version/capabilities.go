@@ -0,0 +1,100 @@
+package version
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"os/exec"
+	goruntime "runtime"
+	"sort"
+	"strings"
+	"time"
+
+	schematypes "github.com/taskcluster/go-schematypes"
+	"github.com/taskcluster/taskcluster-worker/engines"
+	"github.com/taskcluster/taskcluster-worker/plugins"
+)
+
+// component is an engine or plugin compiled into this build
+type component struct {
+	Name string `json:"name"`
+	// Hash of the config schema, this changes when the config schema changes
+	SchemaHash string `json:"schemaHash"`
+}
+
+// capabilities of the host detected at runtime
+type capabilities struct {
+	OS     string `json:"os"`
+	Arch   string `json:"arch"`
+	Go     string `json:"go"`
+	KVM    bool   `json:"kvm"`
+	Docker string `json:"docker,omitempty"`
+}
+
+// schemaHash returns a short hash of the JSON schema, or empty-string if nil
+func schemaHash(schema schematypes.Schema) string {
+	if schema == nil {
+		return ""
+	}
+	data, err := json.Marshal(schema.Schema())
+	if err != nil {
+		return ""
+	}
+	h := sha256.Sum256(data)
+	return hex.EncodeToString(h[:])[:12]
+}
+
+// listEngines returns engines compiled into this build
+func listEngines() []component {
+	var result []component
+	for name, provider := range engines.Engines() {
+		result = append(result, component{
+			Name:       name,
+			SchemaHash: schemaHash(provider.ConfigSchema()),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// listPlugins returns plugins compiled into this build
+func listPlugins() []component {
+	var result []component
+	for name, provider := range plugins.Plugins() {
+		result = append(result, component{
+			Name:       name,
+			SchemaHash: schemaHash(provider.ConfigSchema()),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+// detectCapabilities returns capabilities of the current host
+func detectCapabilities() capabilities {
+	c := capabilities{
+		OS:   goruntime.GOOS,
+		Arch: goruntime.GOARCH,
+		Go:   goruntime.Version(),
+	}
+
+	// KVM is available if we can open /dev/kvm
+	if f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0); err == nil {
+		f.Close()
+		c.KVM = true
+	}
+
+	// Ask docker for the server version, if docker is installed
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "docker", "version", "--format", "{{.Server.Version}}").Output()
+	if err == nil {
+		c.Docker = strings.TrimSpace(string(out))
+	} else {
+		debug("failed to detect docker version, error: %s", err)
+	}
+
+	return c
+}
@@ -19,7 +19,11 @@ func (cmd) Summary() string {
 
 func (cmd) Usage() string {
 	return `
-taskcluster-worker version will display version information.
+taskcluster-worker version will display version information, engines and
+plugins compiled into this build, and capabilities detected on this host.
+
+Engines and plugins are listed with a hash of their configuration schema, this
+changes when the configuration schema changes.
 
 usage: taskcluster-worker version [options] [semver|revision]
 
@@ -34,44 +38,76 @@ func (cmd) Execute(arguments map[string]interface{}) bool {
 	semver := arguments["semver"].(bool)
 	revision := arguments["revision"].(bool)
 
-	// Determine what to print
-	var result map[string]string
-	switch {
-	case semver:
-		result = map[string]string{
-			"version": Version(),
-		}
-	case revision:
-		result = map[string]string{
-			"revision": Revision(),
+	// Print only version or revision, if requested
+	if semver || revision {
+		var result map[string]string
+		if semver {
+			result = map[string]string{"version": orUnknown(Version())}
+		} else {
+			result = map[string]string{"revision": orUnknown(Revision())}
 		}
-	default:
-		result = map[string]string{
-			"version":  Version(),
-			"revision": Revision(),
+		if formatJSON {
+			data, _ := json.Marshal(result)
+			fmt.Println(string(data))
+		} else {
+			for key, value := range result {
+				fmt.Printf("%s: %s\n", key, value)
+			}
 		}
+		return true
 	}
 
-	// Add defaults
-	if v, ok := result["version"]; ok && v == "" {
-		result["version"] = "unknown"
-	}
-	if v, ok := result["revision"]; ok && v == "" {
-		result["revision"] = "unknown"
+	result := struct {
+		Version   string       `json:"version"`
+		Revision  string       `json:"revision"`
+		BuildDate string       `json:"buildDate"`
+		Engines   []component  `json:"engines"`
+		Plugins   []component  `json:"plugins"`
+		Host      capabilities `json:"host"`
+	}{
+		Version:   orUnknown(Version()),
+		Revision:  orUnknown(Revision()),
+		BuildDate: orUnknown(BuildDate()),
+		Engines:   listEngines(),
+		Plugins:   listPlugins(),
+		Host:      detectCapabilities(),
 	}
 
 	// Print as JSON or text
 	if formatJSON {
-		data, _ := json.Marshal(result)
+		data, _ := json.MarshalIndent(result, "", "  ")
 		fmt.Println(string(data))
+		return true
+	}
+
+	fmt.Printf("version:   %s\n", result.Version)
+	fmt.Printf("revision:  %s\n", result.Revision)
+	fmt.Printf("buildDate: %s\n", result.BuildDate)
+	fmt.Println("engines:")
+	for _, e := range result.Engines {
+		fmt.Printf("  %-20s schema: %s\n", e.Name, e.SchemaHash)
+	}
+	fmt.Println("plugins:")
+	for _, p := range result.Plugins {
+		fmt.Printf("  %-20s schema: %s\n", p.Name, p.SchemaHash)
+	}
+	fmt.Println("host:")
+	fmt.Printf("  os:     %s/%s\n", result.Host.OS, result.Host.Arch)
+	fmt.Printf("  go:     %s\n", result.Host.Go)
+	fmt.Printf("  kvm:    %t\n", result.Host.KVM)
+	if result.Host.Docker != "" {
+		fmt.Printf("  docker: %s\n", result.Host.Docker)
 	} else {
-		if _, ok := result["version"]; ok {
-			fmt.Printf("version:  %s\n", result["version"])
-		}
-		if _, ok := result["revision"]; ok {
-			fmt.Printf("revision: %s\n", result["revision"])
-		}
+		fmt.Println("  docker: not detected")
 	}
 
 	return true
 }
+
+// orUnknown returns value, or "unknown" if value is empty-string
+func orUnknown(value string) string {
+	if value == "" {
+		return "unknown"
+	}
+	return value
+}
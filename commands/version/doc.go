@@ -1,6 +1,7 @@
-// Package version provides a CommandProvider that displays version number and
-// git revision, these values are also exported through methods so that they
-// can be read from other packages.
+// Package version provides a CommandProvider that displays version number,
+// git revision and build date, these values are also exported through methods
+// so that they can be read from other packages. The command also lists engines
+// and plugins compiled into the build, and capabilities detected on the host.
 package version
 
 import "github.com/taskcluster/taskcluster-worker/runtime/util"
@@ -1,9 +1,13 @@
 package version
 
-import "regexp"
+import (
+	"regexp"
+	"time"
+)
 
-var version = ""  // -ldflags "-X github.com/taskcluster/taskcluster-worker/commands/version.version=`git tag -l 'v*.*.*' --points-at HEAD | head -n1`"
-var revision = "" // -ldflags "-X github.com/taskcluster/taskcluster-worker/commands/version.revision=`git rev-parse HEAD`"
+var version = ""   // -ldflags "-X github.com/taskcluster/taskcluster-worker/commands/version.version=`git tag -l 'v*.*.*' --points-at HEAD | head -n1`"
+var revision = ""  // -ldflags "-X github.com/taskcluster/taskcluster-worker/commands/version.revision=`git rev-parse HEAD`"
+var buildDate = "" // -ldflags "-X github.com/taskcluster/taskcluster-worker/commands/version.buildDate=`date -u +%Y-%m-%dT%H:%M:%SZ`"
 
 func init() {
 	debug("version: '%s' from linker flag", version)
@@ -22,7 +26,13 @@ func init() {
 		revision = ""
 	}
 
-	debug("detected version: '%s', revision: '%s'", version, revision)
+	debug("buildDate: '%s' from linker flag", buildDate)
+	// Sanity check that build date is a timestamp
+	if _, err := time.Parse(time.RFC3339, buildDate); err != nil {
+		buildDate = ""
+	}
+
+	debug("detected version: '%s', revision: '%s', buildDate: '%s'", version, revision, buildDate)
 }
 
 // Version returns the semver version of this taskcluster-worker build on the
@@ -36,3 +46,9 @@ func Version() string {
 func Revision() string {
 	return revision
 }
+
+// BuildDate returns the time this taskcluster-worker was built in RFC3339
+// format, or empty string if not injected at build-time.
+func BuildDate() string {
+	return buildDate
+}
@@ -0,0 +1,14 @@
+// +build !windows
+
+package work
+
+import (
+	"os"
+	"syscall"
+)
+
+// reexec replaces the current process with executable, using the same
+// arguments and environment variables.
+func reexec(executable string) error {
+	return syscall.Exec(executable, os.Args, os.Environ())
+}
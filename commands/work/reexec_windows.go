@@ -0,0 +1,28 @@
+package work
+
+import (
+	"os"
+	"os/exec"
+)
+
+// reexec starts executable with the same arguments and environment variables,
+// and exits when it's done, as windows doesn't support replacing the current
+// process.
+func reexec(executable string) error {
+	cmd := exec.Command(executable, os.Args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	if err := cmd.Wait(); err != nil {
+		if e, ok := err.(*exec.ExitError); ok && !e.Success() {
+			os.Exit(1)
+		}
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
+	"time"
 
 	"github.com/taskcluster/taskcluster-worker/commands"
 	"github.com/taskcluster/taskcluster-worker/config"
@@ -23,8 +25,22 @@ func (cmd) Summary() string {
 }
 
 func (cmd) Usage() string {
-	return `Usage:
-  taskcluster-worker work <config.yml>
+	return `
+taskcluster-worker work will start the worker and process tasks until stopped.
+
+Given --max-tasks or --max-duration the worker will stop gracefully after
+claiming the given number of tasks or running for the given duration, waiting
+for active tasks to be resolved before exiting. This is useful for one-shot
+autoscaling systems and integration tests.
+
+Usage:
+  taskcluster-worker work [options] <config.yml>
+
+Options:
+  --max-tasks <N>               Stop after claiming N tasks.
+  --max-duration <duration>     Stop claiming tasks after the given duration,
+                                given as Go duration, e.g. '2h30m'.
+  -h --help                     Show this screen.
 `
 }
 
@@ -37,12 +53,41 @@ func (cmd) Execute(args map[string]interface{}) bool {
 		return false
 	}
 
+	// Parse limits before we create the worker
+	var maxTasks int64
+	if v, ok := args["--max-tasks"].(string); ok {
+		maxTasks, err = strconv.ParseInt(v, 10, 32)
+		if err != nil || maxTasks <= 0 {
+			fmt.Fprintln(os.Stderr, "--max-tasks must be a positive integer")
+			return false
+		}
+	}
+	var maxDuration time.Duration
+	if v, ok := args["--max-duration"].(string); ok {
+		maxDuration, err = time.ParseDuration(v)
+		if err != nil || maxDuration <= 0 {
+			fmt.Fprintln(os.Stderr, "--max-duration must be a positive duration, e.g. '2h30m'")
+			return false
+		}
+	}
+
 	w, err := worker.New(config)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		return false
 	}
 
+	if maxTasks > 0 {
+		w.LimitTasks(int(maxTasks))
+	}
+	if maxDuration > 0 {
+		go func() {
+			time.Sleep(maxDuration)
+			monitor.Infof("ran for %s, stopping gracefully", maxDuration)
+			w.StopGracefully()
+		}()
+	}
+
 	done := make(chan struct{})
 	go func() {
 		w.Start()
@@ -56,6 +101,19 @@ func (cmd) Execute(args map[string]interface{}) bool {
 		w.StopNow()
 		<-done
 	case <-done:
+		// If the worker stopped to install an update, we re-execute the updated
+		// binary with the same arguments.
+		if binary := w.UpdatedBinary(); binary != "" {
+			executable, err := worker.InstallUpdate(binary)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Failed to install update, error: ", err)
+				return false
+			}
+			if err = reexec(executable); err != nil {
+				fmt.Fprintln(os.Stderr, "Failed to execute updated binary, error: ", err)
+				return false
+			}
+		}
 	}
 
 	return true
@@ -103,6 +103,13 @@ func (e *engine) PayloadSchema() schematypes.Object {
 	return payloadSchema
 }
 
+func (e *engine) HealthCheck() error {
+	if err := e.docker.Ping(); err != nil {
+		return errors.Wrapf(err, "docker daemon at %s isn't reachable", e.config.DockerSocket)
+	}
+	return nil
+}
+
 func (e *engine) NewSandboxBuilder(options engines.SandboxOptions) (engines.SandboxBuilder, error) {
 	var p payloadType
 	schematypes.MustValidateAndMap(e.PayloadSchema(), options.Payload, &p)
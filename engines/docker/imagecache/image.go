@@ -43,6 +43,14 @@ func (i *image) DiskSize() (uint64, error) {
 	return uint64(i.size), nil
 }
 
+func (i *image) Describe() string {
+	return "docker image: " + i.ImageName
+}
+
+func (i *image) Priority() gc.Priority {
+	return gc.PriorityHigh
+}
+
 func (i *image) Dispose() error {
 	i.disposed.Do(func() {
 		debug("disposing image: %s", i.ImageName)
@@ -15,6 +15,7 @@ import (
 	"github.com/taskcluster/taskcluster-worker/runtime"
 	"github.com/taskcluster/taskcluster-worker/runtime/atomics"
 	"github.com/taskcluster/taskcluster-worker/runtime/ioext"
+	"github.com/taskcluster/taskcluster-worker/runtime/limits"
 )
 
 const dockerEngineKillTimeout = 5 * time.Second
@@ -52,6 +53,9 @@ func newSandbox(sb *sandboxBuilder) (*sandbox, error) {
 		return nil, errors.Wrap(err, "docker.CreateNetwork failed")
 	}
 
+	// Make the OOM killer prefer the container over the worker, if configured
+	oomScoreAdj, _ := limits.ChildOOMScoreAdj()
+
 	// Create the container
 	container, err := sb.e.docker.CreateContainer(docker.CreateContainerOptions{
 		Config: &docker.Config{
@@ -68,8 +72,9 @@ func newSandbox(sb *sandboxBuilder) (*sandbox, error) {
 			Privileged: sb.payload.Privileged,
 			// gateway IP is also the host machine that we're listening for requests
 			// to the proxies added to proxyMux above..
-			ExtraHosts: []string{fmt.Sprintf("taskcluster:%s", networkHandle.Gateway())},
-			Mounts:     sb.mounts,
+			ExtraHosts:  []string{fmt.Sprintf("taskcluster:%s", networkHandle.Gateway())},
+			Mounts:      sb.mounts,
+			OomScoreAdj: oomScoreAdj,
 		},
 		NetworkingConfig: &docker.NetworkingConfig{
 			EndpointsConfig: map[string]*docker.EndpointConfig{
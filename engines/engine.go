@@ -18,6 +18,14 @@ type SandboxOptions struct {
 	Payload map[string]interface{}
 	// Monitor object tagged with task identifiers for logging and error reporting
 	Monitor runtime.Monitor
+	// TemporaryStorage for files created on behalf of the task, writes to this
+	// storage count towards the per-task quota, if one is configured. If nil,
+	// the TemporaryStorage from runtime.Environment should be used.
+	TemporaryStorage runtime.TemporaryStorage
+	// Migration is non-nil, if the sandbox is migrated from another host, rather
+	// than started from scratch. This is only given to engines that declare
+	// Capabilities.Migration.
+	Migration IncomingMigration
 }
 
 // An Engine implementation provides a backend upon which tasks can be
@@ -101,6 +109,16 @@ type Engine interface {
 	// Non-fatal errors: ErrFeatureNotSupported
 	NewVolume(options interface{}) (Volume, error)
 
+	// HealthCheck verifies that host prerequisites for the engine are
+	// satisfied, such as devices, daemons and utilities being available.
+	//
+	// The worker calls this at startup and periodically before claiming tasks,
+	// and won't claim tasks while an error is returned. The error message should
+	// explain what is wrong, as it'll be logged and reported.
+	//
+	// Implementors should return nil, if there is nothing to check.
+	HealthCheck() error
+
 	// Dispose cleans up any resources held by the engine. The engine object
 	// cannot be used after Dispose() has been called.
 	//
@@ -129,6 +147,9 @@ type Engine interface {
 type Capabilities struct {
 	// Maximum number of parallel sandboxes, leave 0 if unbounded.
 	MaxConcurrency int
+	// Sandboxes can be migrated between hosts, see Sandbox.Migrate() and
+	// SandboxOptions.Migration.
+	Migration bool
 	// Note: the zero value of Capabilities should always indicate the sane
 	// defaults, typically that a feature isn't supported.
 }
@@ -177,6 +198,11 @@ func (EngineBase) NewVolume(options interface{}) (Volume, error) {
 	return nil, ErrFeatureNotSupported
 }
 
+// HealthCheck returns nil indicating that there is nothing to check.
+func (EngineBase) HealthCheck() error {
+	return nil
+}
+
 // Dispose trivially implements cleanup by doing nothing.
 func (EngineBase) Dispose() error {
 	return nil
@@ -40,6 +40,10 @@ var ErrSandboxTerminated = errors.New("The Sandbox has terminated")
 // ErrSandboxAborted is used to indicate that a Sandbox has been aborted.
 var ErrSandboxAborted = errors.New("Execution of sandbox was aborted")
 
+// ErrSandboxMigrated is returned from Sandbox.WaitForResult(), when the
+// sandbox has been migrated to another host with Sandbox.Migrate().
+var ErrSandboxMigrated = errors.New("The Sandbox was migrated to another host")
+
 // ErrShellTerminated is used to indicate that a shell has already terminated
 var ErrShellTerminated = errors.New("The shell has already terminated")
 
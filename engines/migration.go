@@ -0,0 +1,43 @@
+package engines
+
+import "io"
+
+// A MigrationTarget is the host a running sandbox is migrated to, see
+// Sandbox.Migrate(). This is implemented by the worker, which hands the task
+// over to the worker on the target host.
+type MigrationTarget interface {
+	// Prepare the target host for receiving the sandbox. The engine specific
+	// state is given to the engine on the target host, which will create a
+	// sandbox for the task with SandboxOptions.Migration.
+	Prepare(state []byte) error
+	// Transfer returns a stream to which the engine writes the sandbox. Close()
+	// returns when the target host has loaded the sandbox, and returns an error
+	// if it failed to do so.
+	Transfer() (io.WriteCloser, error)
+	// Commit hands the task over to the target host, which resumes execution of
+	// the sandbox. This must be called after execution has been stopped on this
+	// host. If an error is returned execution should be resumed on this host.
+	Commit() error
+	// Abort tells the target host to discard the sandbox, this must be called if
+	// the migration fails after Prepare() has returned successfully.
+	Abort()
+}
+
+// IncomingMigration is given as SandboxOptions.Migration, when a sandbox is
+// migrated from another host. The engine must create a sandbox that loads the
+// stream from Receive(), and doesn't resume execution until Committed()
+// returns.
+//
+// This is only given to engines that set Capabilities.Migration.
+type IncomingMigration interface {
+	// State returns the engine specific state given to
+	// MigrationTarget.Prepare() on the source host.
+	State() []byte
+	// Receive blocks until the source host starts the transfer, and returns the
+	// stream written by the engine on the source host. The engine must call done
+	// when the stream has been loaded, with an error if loading failed.
+	Receive() (stream io.Reader, done func(error), err error)
+	// Committed blocks until the source host has handed the task over, and
+	// returns an error if the migration was aborted.
+	Committed() error
+}
@@ -204,3 +204,11 @@ func TestContext(t *testing.T) {
 		c.Test()
 	})
 }
+
+func TestIsPinnedReference(t *testing.T) {
+	digest := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	require.True(t, isPinnedReference(map[string]interface{}{"url": "https://example.com/a", "sha256": digest}))
+	require.False(t, isPinnedReference("https://example.com/a"))
+	require.False(t, isPinnedReference(map[string]interface{}{"url": "https://example.com/a", "md5": digest[:32]}))
+	require.False(t, isPinnedReference(map[string]interface{}{"namespace": "a.b", "artifact": "public/a"}))
+}
@@ -2,12 +2,12 @@ package nativeengine
 
 import (
 	schematypes "github.com/taskcluster/go-schematypes"
-	"github.com/taskcluster/taskcluster-worker/runtime/util"
+	"github.com/taskcluster/taskcluster-worker/runtime/fetcher"
 )
 
 type payload struct {
-	Command []string `json:"command"`
-	Context string   `json:"context"`
+	Command []string    `json:"command"`
+	Context interface{} `json:"context"`
 }
 
 var payloadSchema = schematypes.Object{
@@ -17,13 +17,7 @@ var payloadSchema = schematypes.Object{
 			Description: "Command to execute",
 			Items:       schematypes.String{},
 		},
-		"context": schematypes.URI{
-			Title: "Task Context",
-			Description: util.Markdown(`
-				Optional URL for a gzipped tar-ball to downloaded
-				and extracted in the 'HOME' directory for running the command.
-			`),
-		},
+		"context": fetcher.Default.Schema(),
 	},
 	Required: []string{"command"},
 }
@@ -2,8 +2,12 @@ package nativeengine
 
 import (
 	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/taskcluster/taskcluster-worker/engines"
@@ -11,8 +15,8 @@ import (
 	"github.com/taskcluster/taskcluster-worker/engines/native/unpack"
 	"github.com/taskcluster/taskcluster-worker/runtime"
 	"github.com/taskcluster/taskcluster-worker/runtime/atomics"
+	"github.com/taskcluster/taskcluster-worker/runtime/fetcher"
 	"github.com/taskcluster/taskcluster-worker/runtime/ioext"
-	"github.com/taskcluster/taskcluster-worker/runtime/util"
 )
 
 type sandbox struct {
@@ -72,10 +76,13 @@ func newSandbox(b *sandboxBuilder) (engines.Sandbox, error) {
 		}
 	}
 
-	if b.payload.Context != "" {
-		if err = fetchContext(b.payload.Context, user); err != nil {
+	if b.payload.Context != nil {
+		if err = fetchContext(b.context, b.engine.environment.FetchCache, b.payload.Context, user); err != nil {
+			if e, ok := runtime.IsMalformedPayloadError(err); ok {
+				return nil, e
+			}
 			return nil, runtime.NewMalformedPayloadError(
-				fmt.Sprintf("Error downloading %s: %v", b.payload.Context, err),
+				fmt.Sprintf("Error fetching task context: %v", err),
 			)
 		}
 	}
@@ -122,12 +129,98 @@ func newSandbox(b *sandboxBuilder) (engines.Sandbox, error) {
 	return s, nil
 }
 
-func fetchContext(context string, user *system.User) error {
-	// TODO: use future cache subsystem, when we have it
-	// TODO: use the soon to be merged fetcher subsystem
-	filename, err := util.Download(context, user.Home())
+type fetchContextContext struct {
+	*runtime.TaskContext
+}
+
+func (c fetchContextContext) Progress(description string, percent float64) {
+	c.Log(fmt.Sprintf("Fetching task context: %s - %.0f %%", description, percent*100))
+}
+
+// contextFilename returns the filename a context reference should be stored as
+func contextFilename(reference interface{}) string {
+	var name string
+	switch r := reference.(type) {
+	case string:
+		name = r
+	case map[string]interface{}:
+		if u, ok := r["url"].(string); ok {
+			name = u
+		} else if a, ok := r["artifact"].(string); ok {
+			name = a
+		}
+	}
+	if u, err := url.Parse(name); err == nil && u.Path != "" {
+		name = u.Path
+	}
+	name = path.Base(name)
+	if name == "." || name == "/" || name == "" {
+		return "context"
+	}
+	return name
+}
+
+// isPinnedReference returns true, if reference is a URL with a sha256 or
+// sha512 digest. Only these can be fetched from the cache, as other references
+// may refer to a resource that changes, such as a URL or an index namespace.
+func isPinnedReference(reference interface{}) bool {
+	r, ok := reference.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, hasSHA256 := r["sha256"]
+	_, hasSHA512 := r["sha512"]
+	return hasSHA256 || hasSHA512
+}
+
+func fetchContext(context *runtime.TaskContext, cache *fetcher.Cache, reference interface{}, user *system.User) error {
+	ctx := fetchContextContext{context}
+	ref, err := fetcher.Default.NewReference(ctx, reference)
+	if err != nil {
+		if fetcher.IsBrokenReferenceError(err) {
+			return runtime.NewMalformedPayloadError("unable to fetch task context, error: ", err)
+		}
+		return err
+	}
+
+	// Check that task.scopes satisfies one of required scope-sets
+	scopeSets := ref.Scopes()
+	if !context.HasScopes(scopeSets...) {
+		var options []string
+		for _, scopes := range scopeSets {
+			options = append(options, strings.Join(scopes, ", "))
+		}
+		return runtime.NewMalformedPayloadError(
+			`task.scopes must satisfy at-least one of the scope-sets: ` + strings.Join(options, " or "),
+		)
+	}
+
+	// Fetch to file in the home folder, through the cache if we have one and
+	// the reference is pinned to a digest
+	filename := filepath.Join(user.Home(), contextFilename(reference))
+	file, err := os.Create(filename)
+	if err != nil {
+		return fmt.Errorf("Error creating file '%s': %v", filename, err)
+	}
+	if cache != nil && isPinnedReference(reference) {
+		var cached *fetcher.CachedFile
+		cached, err = cache.Fetch(ctx, ref)
+		if err == nil {
+			err = copyFromCache(file, cached)
+			cached.Release()
+		}
+	} else {
+		err = ref.Fetch(ctx, &fetcher.FileReseter{File: file})
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
 	if err != nil {
-		return fmt.Errorf("Error downloading '%s': %v", context, err)
+		os.Remove(filename)
+		if fetcher.IsBrokenReferenceError(err) {
+			return runtime.NewMalformedPayloadError("unable to fetch task context, error: ", err)
+		}
+		return err
 	}
 
 	// TODO: verify if this will harm Windows
@@ -162,6 +255,17 @@ func fetchContext(context string, user *system.User) error {
 	return nil
 }
 
+// copyFromCache copies a file from the fetcher cache to target
+func copyFromCache(target io.Writer, cached *fetcher.CachedFile) error {
+	source, err := cached.Open()
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	_, err = io.Copy(target, source)
+	return err
+}
+
 func (s *sandbox) NewShell(command []string, tty bool) (engines.Shell, error) {
 	s.mShells.Lock()
 	defer s.mShells.Unlock()
@@ -18,6 +18,7 @@ import (
 	"github.com/taskcluster/taskcluster-worker/plugins/interactive/pty"
 	"github.com/taskcluster/taskcluster-worker/runtime/atomics"
 	"github.com/taskcluster/taskcluster-worker/runtime/ioext"
+	"github.com/taskcluster/taskcluster-worker/runtime/limits"
 )
 
 const systemPKill = "/usr/bin/pkill"
@@ -214,6 +215,11 @@ func StartProcess(options ProcessOptions) (*Process, error) {
 	}
 	debug("Started process with %v", options.Arguments)
 
+	// Make the OOM killer prefer the task over the worker, if configured
+	if err = limits.ApplyChildOOMScoreAdj(p.cmd.Process.Pid); err != nil {
+		debug("Failed to set oom_score_adj for process, error: %s", err)
+	}
+
 	// Go wait for result
 	go p.waitForResult()
 
@@ -0,0 +1,123 @@
+package qemuengine
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/ioext"
+)
+
+// maxAudioRecordingSize is the maximum size of audio recordings uploaded as
+// artifacts, this is about 50 minutes of 16 bit stereo audio at 44.1 kHz.
+const maxAudioRecordingSize = 512 * 1024 * 1024
+
+// wavHeaderSize is the size of the WAV header written by QEMU, which always
+// has a 16 byte 'fmt ' chunk followed by the 'data' chunk.
+const wavHeaderSize = 44
+
+// finishWAV writes the sizes to the header of the WAV file written by QEMU,
+// as QEMU only does so when it terminates, and returns the size of the file
+// to upload and the duration of the recording. Recordings larger than
+// maxAudioRecordingSize are truncated, the returned size is never larger.
+func finishWAV(f *os.File) (int64, time.Duration, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	size := info.Size()
+	if size < wavHeaderSize {
+		return 0, 0, errors.New("audio recording is missing the WAV header")
+	}
+	if size > maxAudioRecordingSize {
+		size = maxAudioRecordingSize
+	}
+
+	header := make([]byte, wavHeaderSize)
+	if _, err = f.ReadAt(header, 0); err != nil {
+		return 0, 0, err
+	}
+	if string(header[0:4]) != "RIFF" || string(header[8:12]) != "WAVE" || string(header[36:40]) != "data" {
+		return 0, 0, errors.New("audio recording doesn't have the WAV header written by QEMU")
+	}
+	// Round down to whole frames, QEMU may be writing while we read
+	frameSize := int64(binary.LittleEndian.Uint16(header[32:34]))
+	if frameSize > 0 {
+		size -= (size - wavHeaderSize) % frameSize
+	}
+	binary.LittleEndian.PutUint32(header[4:8], uint32(size-8))
+	binary.LittleEndian.PutUint32(header[40:44], uint32(size-wavHeaderSize))
+	if _, err = f.WriteAt(header[4:8], 4); err != nil {
+		return 0, 0, err
+	}
+	if _, err = f.WriteAt(header[40:44], 40); err != nil {
+		return 0, 0, err
+	}
+
+	var duration time.Duration
+	if byteRate := int64(binary.LittleEndian.Uint32(header[28:32])); byteRate > 0 {
+		duration = time.Duration((size - wavHeaderSize) * int64(time.Second) / byteRate)
+	}
+	return size, duration, nil
+}
+
+// uploadAudioRecording uploads the WAV file written by QEMU as the artifact
+// named by task.payload.audioRecording, and writes the SHA-256 of the samples
+// to the task log, such that audio output can be compared without downloading
+// the recording. Errors are only logged, as the task is resolved regardless.
+func (s *sandbox) uploadAudioRecording() {
+	if s.audioFile == "" {
+		return
+	}
+	defer os.Remove(s.audioFile)
+
+	f, err := os.OpenFile(s.audioFile, os.O_RDWR, 0)
+	if err != nil {
+		s.monitor.Warn("failed to open audio recording, error: ", err)
+		s.context.LogError("Failed to open audio recording")
+		return
+	}
+	defer f.Close()
+
+	size, duration, err := finishWAV(f)
+	if err != nil {
+		s.monitor.ReportError(err, "failed to finish audio recording")
+		s.context.LogError("Failed to finish audio recording")
+		return
+	}
+	if size == maxAudioRecordingSize {
+		s.context.LogWarning(fmt.Sprintf(
+			"Audio recording exceeded %d MiB, later audio was not uploaded",
+			maxAudioRecordingSize/(1024*1024),
+		))
+	}
+
+	h := sha256.New()
+	if _, err = io.Copy(h, io.NewSectionReader(f, wavHeaderSize, size-wavHeaderSize)); err != nil {
+		s.monitor.ReportError(err, "failed to read audio recording")
+		s.context.LogError("Failed to read audio recording")
+		return
+	}
+
+	err = s.context.UploadS3Artifact(runtime.S3Artifact{
+		Name:     s.audio,
+		Mimetype: "audio/wav",
+		Expires:  s.context.TaskInfo.Expires,
+		Stream:   ioext.NopCloser(io.NewSectionReader(f, 0, size)),
+	})
+	if err != nil {
+		s.monitor.Warn("failed to upload audio recording, error: ", err)
+		s.context.LogError(fmt.Sprintf("Failed to upload audio recording as artifact: %s", s.audio))
+		return
+	}
+	s.context.Log(fmt.Sprintf(
+		"Uploaded audio recording of %s as artifact: %s, SHA-256 of samples: %s",
+		duration, s.audio, hex.EncodeToString(h.Sum(nil)),
+	))
+}
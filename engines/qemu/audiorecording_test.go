@@ -0,0 +1,62 @@
+package qemuengine
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFinishWAV(t *testing.T) {
+	f, err := ioutil.TempFile("", "audio-recording-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// Header as written by QEMU before it terminates, for 16 bit stereo at 44.1 kHz
+	header := make([]byte, wavHeaderSize)
+	copy(header[0:], "RIFF")
+	copy(header[8:], "WAVEfmt ")
+	binary.LittleEndian.PutUint32(header[16:], 16)
+	binary.LittleEndian.PutUint16(header[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(header[22:], 2)
+	binary.LittleEndian.PutUint32(header[24:], 44100)
+	binary.LittleEndian.PutUint32(header[28:], 44100*4)
+	binary.LittleEndian.PutUint16(header[32:], 4)
+	binary.LittleEndian.PutUint16(header[34:], 16)
+	copy(header[36:], "data")
+	_, err = f.Write(header)
+	require.NoError(t, err)
+
+	// Write half a second of samples and a partial frame
+	_, err = f.Write(make([]byte, 44100*2+3))
+	require.NoError(t, err)
+
+	size, duration, err := finishWAV(f)
+	require.NoError(t, err)
+	require.Equal(t, int64(wavHeaderSize+44100*2), size)
+	require.Equal(t, 500*time.Millisecond, duration)
+
+	_, err = f.ReadAt(header, 0)
+	require.NoError(t, err)
+	require.Equal(t, uint32(size-8), binary.LittleEndian.Uint32(header[4:]))
+	require.Equal(t, uint32(44100*2), binary.LittleEndian.Uint32(header[40:]))
+}
+
+func TestFinishWAVInvalid(t *testing.T) {
+	f, err := ioutil.TempFile("", "audio-recording-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	_, _, err = finishWAV(f)
+	require.Error(t, err, "expected empty file to fail")
+
+	_, err = f.Write(make([]byte, 2*wavHeaderSize))
+	require.NoError(t, err)
+	_, _, err = finishWAV(f)
+	require.Error(t, err, "expected file without WAV header to fail")
+}
@@ -0,0 +1,270 @@
+package qemuengine
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	schematypes "github.com/taskcluster/go-schematypes"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/util"
+)
+
+// balloonConfig configures the balloonController, memory sizes are in MiB.
+type balloonConfig struct {
+	MinHostMemory    int           `json:"minHostMemory"`
+	GuaranteedMemory int           `json:"guaranteedMemory"`
+	StepSize         int           `json:"stepSize"`
+	Interval         time.Duration `json:"interval"`
+}
+
+// Defaults for optional balloonConfig properties
+const (
+	defaultBalloonGuaranteedMemory = 50 // percent
+	defaultBalloonStepSize         = 256
+	defaultBalloonInterval         = 5 * time.Second
+)
+
+var balloonSchema = schematypes.Object{
+	Title: "Memory Ballooning",
+	Description: util.Markdown(`
+		Reclaim memory from virtual machines using the virtio-balloon device,
+		when the host is low on memory. If not specified memory is never
+		reclaimed.
+
+		When the memory available on the host drops below 'minHostMemory', memory
+		the guest reports as free is reclaimed by inflating the balloon, one
+		'stepSize' at the time. When the host has sufficient memory again, the
+		memory is returned to the virtual machines. Memory is only reclaimed from
+		guests with a balloon driver reporting memory statistics, and never below
+		the memory guaranteed to the task.
+	`),
+	Properties: schematypes.Properties{
+		"minHostMemory": schematypes.Integer{
+			Title:       "Minimum Host Memory",
+			Description: `Available host memory in MiB below which memory is reclaimed.`,
+			Minimum:     1,
+			Maximum:     64 * 1024 * 1024, // 64 TiB
+		},
+		"guaranteedMemory": schematypes.Integer{
+			Title: "Guaranteed Memory",
+			Description: util.Markdown(`
+				Percentage of the machine memory guaranteed to each virtual machine,
+				defaults to 50. Tasks may require more using 'guaranteedMemory' in
+				the task payload.
+			`),
+			Minimum: 1,
+			Maximum: 100,
+		},
+		"stepSize": schematypes.Integer{
+			Title:       "Step Size",
+			Description: `Memory in MiB reclaimed or returned at the time, defaults to 256.`,
+			Minimum:     1,
+			Maximum:     1024 * 1024,
+		},
+		"interval": schematypes.Duration{
+			Title:       "Interval",
+			Description: `Interval at which host memory is checked, defaults to 5s.`,
+		},
+	},
+	Required: []string{"minHostMemory"},
+}
+
+// balloonController monitors host memory and resizes the memory of virtual
+// machines using the virtio-balloon device.
+type balloonController struct {
+	m       sync.Mutex
+	config  balloonConfig
+	vms     map[*balloonedVM]bool
+	monitor runtime.Monitor
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// balloonedVM is a virtual machine managed by the balloonController
+type balloonedVM struct {
+	vm           *vm.VirtualMachine
+	memory       int // machine memory in MiB
+	guaranteed   int // guaranteed memory in MiB
+	statsEnabled bool
+}
+
+func newBalloonController(config balloonConfig, monitor runtime.Monitor) *balloonController {
+	if config.GuaranteedMemory == 0 {
+		config.GuaranteedMemory = defaultBalloonGuaranteedMemory
+	}
+	if config.StepSize == 0 {
+		config.StepSize = defaultBalloonStepSize
+	}
+	if config.Interval == 0 {
+		config.Interval = defaultBalloonInterval
+	}
+	b := &balloonController{
+		config:  config,
+		vms:     make(map[*balloonedVM]bool),
+		monitor: monitor,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// guarantee returns the memory in MiB guaranteed to a machine with the given
+// memory, requested is guaranteedMemory from the task payload, zero if omitted.
+func (b *balloonController) guarantee(memory, requested int) int {
+	guaranteed := memory * b.config.GuaranteedMemory / 100
+	if requested > guaranteed {
+		guaranteed = requested
+	}
+	if guaranteed > memory {
+		guaranteed = memory
+	}
+	return guaranteed
+}
+
+// add starts managing the memory of machine, returns a function that must be
+// called when the virtual machine is stopped.
+func (b *balloonController) add(machine *vm.VirtualMachine, memory, guaranteed int) func() {
+	v := &balloonedVM{
+		vm:         machine,
+		memory:     memory,
+		guaranteed: guaranteed,
+	}
+	b.m.Lock()
+	b.vms[v] = true
+	b.m.Unlock()
+
+	return func() {
+		b.m.Lock()
+		delete(b.vms, v)
+		b.m.Unlock()
+	}
+}
+
+func (b *balloonController) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.config.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+			b.adjust()
+		}
+	}
+}
+
+// adjust resizes the memory of all virtual machines based on host memory
+func (b *balloonController) adjust() {
+	available, err := hostAvailableMemory()
+	if err != nil {
+		b.monitor.ReportError(err, "failed to read available host memory")
+		return
+	}
+
+	b.m.Lock()
+	vms := make([]*balloonedVM, 0, len(b.vms))
+	for v := range b.vms {
+		vms = append(vms, v)
+	}
+	b.m.Unlock()
+
+	for _, v := range vms {
+		actual, err := v.vm.QueryBalloon()
+		if err != nil {
+			debug("failed to query balloon, error: %s", err) // VM may not be running yet
+			continue
+		}
+		if !v.statsEnabled {
+			if err = v.vm.EnableBalloonStats(b.config.Interval); err != nil {
+				debug("failed to enable balloon statistics, error: %s", err)
+				continue
+			}
+			v.statsEnabled = true
+		}
+		free, err := v.vm.BalloonFreeMemory()
+		if err != nil {
+			debug("failed to read balloon statistics, error: %s", err)
+			continue
+		}
+
+		target := balloonTarget(actual, v.memory, v.guaranteed, free, available, b.config)
+		if target == actual {
+			continue
+		}
+		debug("resizing balloon from %d MiB to %d MiB, host has %d MiB available", actual, target, available)
+		if err = v.vm.SetBalloon(target); err != nil {
+			b.monitor.Warn("failed to resize balloon, error: ", err)
+			continue
+		}
+		// Account for the change, so we don't overshoot with the next machine
+		available += actual - target
+	}
+}
+
+// balloonTarget returns the memory in MiB a virtual machine should have.
+// Memory is reclaimed if available host memory is low, and returned when there
+// is room for another step without dropping below minHostMemory again. If the
+// guest doesn't report free memory (free < 0), memory isn't reclaimed.
+func balloonTarget(actual, memory, guaranteed, free, available int, c balloonConfig) int {
+	target := actual
+	if available < c.MinHostMemory {
+		reclaim := c.StepSize
+		if free < reclaim {
+			reclaim = free
+		}
+		if reclaim > 0 {
+			target = actual - reclaim
+		}
+	} else if available >= c.MinHostMemory+2*c.StepSize {
+		target = actual + c.StepSize
+	}
+	if target < guaranteed {
+		target = guaranteed
+	}
+	if target > memory {
+		target = memory
+	}
+	return target
+}
+
+// hostAvailableMemory returns MemAvailable from /proc/meminfo in MiB
+func hostAvailableMemory() (int, error) {
+	data, err := ioutil.ReadFile("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	return parseMemAvailable(data)
+}
+
+func parseMemAvailable(meminfo []byte) (int, error) {
+	s := bufio.NewScanner(bytes.NewReader(meminfo))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || fields[0] != "MemAvailable:" {
+			continue
+		}
+		kb, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return 0, errors.New("unable to parse MemAvailable in /proc/meminfo")
+		}
+		return kb / 1024, nil
+	}
+	return 0, errors.New("MemAvailable not found in /proc/meminfo")
+}
+
+// Dispose stops the balloonController, memory is not returned to virtual
+// machines still running.
+func (b *balloonController) Dispose() {
+	close(b.stop)
+	<-b.done
+}
@@ -0,0 +1,45 @@
+package qemuengine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBalloonTarget(t *testing.T) {
+	c := balloonConfig{MinHostMemory: 1024, StepSize: 256}
+
+	// Reclaim a step from an idle guest when host memory is low
+	require.Equal(t, 1792, balloonTarget(2048, 2048, 1024, 1500, 512, c))
+	// Only reclaim memory the guest reports as free
+	require.Equal(t, 1948, balloonTarget(2048, 2048, 1024, 100, 512, c))
+	// Don't reclaim if the guest doesn't report free memory
+	require.Equal(t, 2048, balloonTarget(2048, 2048, 1024, -1, 512, c))
+	// Never reclaim below the guaranteed memory
+	require.Equal(t, 1024, balloonTarget(1100, 2048, 1024, 1000, 512, c))
+	// Don't return memory until there is room for another step
+	require.Equal(t, 1024, balloonTarget(1024, 2048, 1024, 1000, 1200, c))
+	// Return memory, but never more than the machine memory
+	require.Equal(t, 1280, balloonTarget(1024, 2048, 1024, 1000, 4096, c))
+	require.Equal(t, 2048, balloonTarget(2000, 2048, 1024, 1000, 4096, c))
+}
+
+func TestBalloonGuarantee(t *testing.T) {
+	b := &balloonController{config: balloonConfig{GuaranteedMemory: 50}}
+	require.Equal(t, 1024, b.guarantee(2048, 0))
+	require.Equal(t, 1536, b.guarantee(2048, 1536))
+	require.Equal(t, 2048, b.guarantee(2048, 4096))
+}
+
+func TestParseMemAvailable(t *testing.T) {
+	available, err := parseMemAvailable([]byte(
+		"MemTotal:       16314248 kB\n" +
+			"MemFree:         1213344 kB\n" +
+			"MemAvailable:    8388608 kB\n",
+	))
+	require.NoError(t, err)
+	require.Equal(t, 8192, available)
+
+	_, err = parseMemAvailable([]byte("MemTotal:       16314248 kB\n"))
+	require.Error(t, err)
+}
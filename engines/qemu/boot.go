@@ -0,0 +1,127 @@
+package qemuengine
+
+import (
+	schematypes "github.com/taskcluster/go-schematypes"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/fetcher"
+	"github.com/taskcluster/taskcluster-worker/runtime/util"
+)
+
+// bootType is task.payload.boot for booting the image with a kernel from the
+// task, rather than the boot loader on the image.
+type bootType struct {
+	Kernel  interface{} `json:"kernel"`
+	Initrd  interface{} `json:"initrd,omitempty"`
+	Cmdline string      `json:"cmdline,omitempty"`
+}
+
+var bootSchema = schematypes.Object{
+	Title: "Direct Kernel Boot",
+	Description: util.Markdown(`
+		Boot the image with a Linux kernel and initrd fetched for the task,
+		instead of the boot loader installed on the image. This allows booting a
+		fresh kernel against a stable root filesystem image, without rebuilding
+		the image.
+
+		The kernel is given the 'cmdline', which should specify the root
+		filesystem, for example 'root=/dev/vda1 console=ttyS0'. This cannot be
+		used with images resuming from a snapshot.
+	`),
+	Properties: schematypes.Properties{
+		"kernel": imageFetcher.Schema(),
+		"initrd": imageFetcher.Schema(),
+		"cmdline": schematypes.String{
+			Title:         "Kernel Command Line",
+			Description:   `Arguments passed to the kernel.`,
+			MaximumLength: 4096,
+		},
+	},
+	Required: []string{"kernel"},
+}
+
+// bootFiles holds the kernel and initrd fetched for direct kernel boot, these
+// are temporary files that must be removed with Close().
+type bootFiles struct {
+	kernel  runtime.TemporaryFile
+	initrd  runtime.TemporaryFile // nil, if no initrd was given
+	cmdline string
+}
+
+// fetchBootFiles fetches the kernel and initrd referenced in boot to temporary
+// files. Returns a MalformedPayloadError if a reference is invalid.
+func fetchBootFiles(c *runtime.TaskContext, boot *bootType, storage runtime.TemporaryStorage) (*bootFiles, error) {
+	var err error
+	b := &bootFiles{cmdline: boot.Cmdline}
+	b.kernel, err = fetchBootFile(c, "kernel", boot.Kernel, storage)
+	if err != nil {
+		return nil, err
+	}
+	if boot.Initrd != nil {
+		b.initrd, err = fetchBootFile(c, "initrd", boot.Initrd, storage)
+		if err != nil {
+			b.Close()
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// fetchBootFile fetches reference to a temporary file, name is used for
+// progress and error messages.
+func fetchBootFile(
+	c *runtime.TaskContext, name string, reference interface{}, storage runtime.TemporaryStorage,
+) (runtime.TemporaryFile, error) {
+	ctx := &fetchBootContext{TaskContext: c, name: name}
+	ref, err := imageFetcher.NewReference(ctx, reference)
+	if err == nil {
+		err = checkScopes(c, ref)
+	}
+	if err != nil {
+		if fetcher.IsBrokenReferenceError(err) {
+			err = runtime.NewMalformedPayloadError("unable to fetch ", name, ", error:", err)
+		}
+		return nil, err
+	}
+
+	f, err := storage.NewFile()
+	if err != nil {
+		return nil, err
+	}
+	debug("fetching %s: %#v", name, reference)
+	if err = ref.Fetch(ctx, &fetcher.FileReseter{File: f}); err != nil {
+		f.Close()
+		if fetcher.IsBrokenReferenceError(err) {
+			err = runtime.NewMalformedPayloadError("unable to fetch ", name, ", error:", err)
+		}
+		return nil, err
+	}
+	return f, nil
+}
+
+// options returns the boot options for vm.NewVirtualMachine, this is the zero
+// value if b is nil.
+func (b *bootFiles) options() vm.LinuxBootOptions {
+	if b == nil {
+		return vm.LinuxBootOptions{}
+	}
+	options := vm.LinuxBootOptions{
+		Kernel: b.kernel.Path(),
+		Append: b.cmdline,
+	}
+	if b.initrd != nil {
+		options.Initrd = b.initrd.Path()
+	}
+	return options
+}
+
+// Close removes the temporary files, this is safe to call if b is nil.
+func (b *bootFiles) Close() {
+	if b == nil {
+		return
+	}
+	b.kernel.Close()
+	if b.initrd != nil {
+		b.initrd.Close()
+	}
+}
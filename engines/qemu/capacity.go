@@ -0,0 +1,161 @@
+package qemuengine
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	schematypes "github.com/taskcluster/go-schematypes"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/util"
+)
+
+// capacityConfig is the host capacity available for virtual machines, zero
+// values means there is no limit.
+type capacityConfig struct {
+	Memory int `json:"memory"`
+	CPUs   int `json:"cpus"`
+	Disk   int `json:"disk"`
+}
+
+var capacitySchema = schematypes.Object{
+	Title: "Host Capacity",
+	Description: util.Markdown(`
+		Total resources available for virtual machines running in parallel.
+
+		Before a virtual machine is started the memory, CPUs and scratch disk
+		space it requires is reserved, if the host doesn't have sufficient
+		capacity left the task will be resolved 'internal-error', so it can be
+		retried elsewhere. Resources not specified are not accounted for, and
+		the number of virtual machines running in parallel is only limited by
+		'maxConcurrency' and the network pool.
+	`),
+	Properties: schematypes.Properties{
+		"memory": schematypes.Integer{
+			Title:       "Memory",
+			Description: `Total memory in MiB available for virtual machines.`,
+			Minimum:     1,
+			Maximum:     64 * 1024 * 1024, // 64 TiB
+		},
+		"cpus": schematypes.Integer{
+			Title:       "CPUs",
+			Description: `Total number of CPUs available for virtual machines.`,
+			Minimum:     1,
+			Maximum:     64 * 1024,
+		},
+		"disk": schematypes.Integer{
+			Title: "Disk Space",
+			Description: util.Markdown(`
+				Total disk space in MiB available for scratch disks, this should
+				leave room for images and the copy-on-write overlays of running
+				virtual machines.
+			`),
+			Minimum: 1,
+			Maximum: 1024 * 1024 * 1024, // 1 PiB
+		},
+	},
+}
+
+// errInsufficientCapacity is returned from capacity.reserve() if the resources
+// required are currently reserved by other virtual machines.
+var errInsufficientCapacity = errors.New("insufficient host capacity for virtual machine")
+
+// capacity tracks resources reserved by running virtual machines.
+type capacity struct {
+	m      sync.Mutex
+	config capacityConfig
+	memory int // memory in use
+	cpus   int // cpus in use
+	disk   int // disk space in use
+}
+
+// reserve memory and cpus for machine, and disk MiB for scratch disks, returns
+// a function that must be called to release the reservation. Reservations are
+// reported to monitor, so the partitioning of the host can be debugged.
+//
+// Returns MalformedPayloadError if the machine can never fit on this host, and
+// errInsufficientCapacity if there isn't sufficient capacity left right now.
+func (c *capacity) reserve(monitor runtime.Monitor, machine vm.Machine, disk int) (func(), error) {
+	memory, cpus := machine.Memory(), machine.CPUs()
+
+	if c.config.Memory != 0 && memory > c.config.Memory {
+		return nil, runtime.NewMalformedPayloadError(
+			"Machine memory ", memory, " MiB is larger than the total memory ",
+			c.config.Memory, " MiB available on this worker",
+		)
+	}
+	if c.config.CPUs != 0 && cpus > c.config.CPUs {
+		return nil, runtime.NewMalformedPayloadError(
+			"Machine requires ", cpus, " CPUs which is more than the total number of ",
+			c.config.CPUs, " CPUs available on this worker",
+		)
+	}
+	if c.config.Disk != 0 && disk > c.config.Disk {
+		return nil, runtime.NewMalformedPayloadError(
+			"Scratch disks of ", disk, " MiB is larger than the total disk space ",
+			c.config.Disk, " MiB available on this worker",
+		)
+	}
+
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	var insufficient []string
+	if c.config.Memory != 0 && c.memory+memory > c.config.Memory {
+		insufficient = append(insufficient, "memory")
+	}
+	if c.config.CPUs != 0 && c.cpus+cpus > c.config.CPUs {
+		insufficient = append(insufficient, "cpus")
+	}
+	if c.config.Disk != 0 && c.disk+disk > c.config.Disk {
+		insufficient = append(insufficient, "disk")
+	}
+	if len(insufficient) > 0 {
+		monitor.Warnf("insufficient %s to reserve memory: %d MiB, cpus: %d, disk: %d MiB, %s",
+			strings.Join(insufficient, ", "), memory, cpus, disk, c.usage())
+		return nil, errInsufficientCapacity
+	}
+	c.memory += memory
+	c.cpus += cpus
+	c.disk += disk
+	monitor.Infof("reserved memory: %d MiB, cpus: %d, disk: %d MiB, %s", memory, cpus, disk, c.usage())
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			c.m.Lock()
+			defer c.m.Unlock()
+			c.memory -= memory
+			c.cpus -= cpus
+			c.disk -= disk
+			monitor.Infof("released memory: %d MiB, cpus: %d, disk: %d MiB, %s", memory, cpus, disk, c.usage())
+		})
+	}, nil
+}
+
+// usage returns a summary of resources in use for logging, c.m must be held.
+func (c *capacity) usage() string {
+	return fmt.Sprintf(
+		"in use memory: %d/%s MiB, cpus: %d/%s, disk: %d/%s MiB",
+		c.memory, formatCapacity(c.config.Memory), c.cpus, formatCapacity(c.config.CPUs),
+		c.disk, formatCapacity(c.config.Disk),
+	)
+}
+
+func (c capacityConfig) String() string {
+	return fmt.Sprintf(
+		"memory: %s MiB, cpus: %s, disk: %s MiB",
+		formatCapacity(c.Memory), formatCapacity(c.CPUs), formatCapacity(c.Disk),
+	)
+}
+
+// formatCapacity formats a capacity value, where zero means unlimited
+func formatCapacity(value int) string {
+	if value == 0 {
+		return "unlimited"
+	}
+	return strconv.Itoa(value)
+}
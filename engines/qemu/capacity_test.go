@@ -0,0 +1,70 @@
+package qemuengine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/mocks"
+)
+
+func TestCapacityReserve(t *testing.T) {
+	monitor := mocks.NewMockMonitor(false)
+	c := &capacity{config: capacityConfig{Memory: 4096, CPUs: 4, Disk: 10240}}
+	m := vm.NewMachine(map[string]interface{}{
+		"version": float64(1),
+		"memory":  float64(2048),
+		"threads": float64(1),
+		"cores":   float64(2),
+		"sockets": float64(1),
+	})
+
+	release1, err := c.reserve(monitor, m, 0)
+	require.NoError(t, err)
+	release2, err := c.reserve(monitor, m, 0)
+	require.NoError(t, err)
+
+	_, err = c.reserve(monitor, m, 0)
+	require.Equal(t, errInsufficientCapacity, err)
+
+	// Releasing twice has no effect
+	release1()
+	release1()
+	release3, err := c.reserve(monitor, m, 0)
+	require.NoError(t, err)
+	release2()
+	release3()
+	require.Equal(t, 0, c.memory)
+	require.Equal(t, 0, c.cpus)
+
+	// Machine that can never fit is malformed-payload
+	big := vm.NewMachine(map[string]interface{}{
+		"version": float64(1),
+		"memory":  float64(8192),
+	})
+	_, err = c.reserve(monitor, big, 0)
+	_, ok := runtime.IsMalformedPayloadError(err)
+	require.True(t, ok)
+}
+
+func TestCapacityReserveDisk(t *testing.T) {
+	monitor := mocks.NewMockMonitor(false)
+	c := &capacity{config: capacityConfig{Disk: 10240}}
+	m := vm.NewMachine(map[string]interface{}{
+		"version": float64(1),
+		"memory":  float64(2048),
+	})
+
+	release, err := c.reserve(monitor, m, 8192)
+	require.NoError(t, err)
+	_, err = c.reserve(monitor, m, 4096)
+	require.Equal(t, errInsufficientCapacity, err)
+	release()
+	require.Equal(t, 0, c.disk)
+
+	// Scratch disks that can never fit is malformed-payload
+	_, err = c.reserve(monitor, m, 20480)
+	_, ok := runtime.IsMalformedPayloadError(err)
+	require.True(t, ok)
+}
@@ -0,0 +1,96 @@
+package qemuengine
+
+import (
+	"net"
+
+	"github.com/pkg/errors"
+	schematypes "github.com/taskcluster/go-schematypes"
+	"github.com/taskcluster/taskcluster-worker/runtime/util"
+)
+
+// maxEgressAllow is the maximum number of entries in egressPolicy.Allow
+const maxEgressAllow = 64
+
+// egressPolicy restricts the destinations virtual machines can reach outside
+// the host.
+type egressPolicy struct {
+	DenyExternal bool     `json:"denyExternal"`
+	Allow        []string `json:"allow"`
+}
+
+var egressPolicySchema = schematypes.Object{
+	Title: "Egress Policy",
+	Description: util.Markdown(`
+		Restrict the destinations the virtual machine can reach, this is only
+		supported in 'tap' network mode. The meta-data service and DNS are always
+		reachable, and private subnets are always rejected, unless routed through
+		a VPN configured for the worker.
+
+		If 'denyExternal' is set, all traffic leaving the host is rejected,
+		except traffic to destinations in 'allow'. If 'allow' is given, traffic
+		to all other destinations is rejected. The policy in the engine config
+		applies to all tasks, a policy in the task payload can only restrict
+		access further.
+	`),
+	Properties: schematypes.Properties{
+		"denyExternal": schematypes.Boolean{
+			Title: "Deny External",
+			Description: util.Markdown(`
+				Reject all traffic leaving the host, except destinations in 'allow'.
+			`),
+		},
+		"allow": schematypes.Array{
+			Title: "Allow",
+			Description: util.Markdown(`
+				Destinations the virtual machine can reach, at most 64 entries. Each
+				entry is an IPv4 or IPv6 address, a subnet in CIDR notation, such as
+				'203.0.113.0/24', or a hostname. Hostnames are resolved on the host
+				when the task starts, and all addresses returned are allowed.
+			`),
+			Items: schematypes.String{
+				Pattern:       `^[0-9a-zA-Z.:/-]+$`,
+				MaximumLength: 255,
+			},
+			Unique: true,
+		},
+	},
+}
+
+// restricted returns true, if the policy restricts egress
+func (p *egressPolicy) restricted() bool {
+	return p != nil && (p.DenyExternal || len(p.Allow) > 0)
+}
+
+// resolve returns the subnets allowed by the policy, hostnames are resolved to
+// all their addresses.
+func (p *egressPolicy) resolve() ([]*net.IPNet, error) {
+	if len(p.Allow) > maxEgressAllow {
+		return nil, errors.Errorf("egress policy cannot allow more than %d destinations", maxEgressAllow)
+	}
+	var subnets []*net.IPNet
+	for _, entry := range p.Allow {
+		if _, subnet, err := net.ParseCIDR(entry); err == nil {
+			subnets = append(subnets, subnet)
+			continue
+		}
+		ips := []net.IP{net.ParseIP(entry)}
+		if ips[0] == nil {
+			var err error
+			if ips, err = net.LookupIP(entry); err != nil {
+				return nil, errors.Wrapf(err, "unable to resolve '%s' allowed by egress policy", entry)
+			}
+		}
+		for _, ip := range ips {
+			subnets = append(subnets, hostSubnet(ip))
+		}
+	}
+	return subnets, nil
+}
+
+// hostSubnet returns the subnet containing only ip
+func hostSubnet(ip net.IP) *net.IPNet {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return &net.IPNet{IP: ipv4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
@@ -0,0 +1,37 @@
+package qemuengine
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEgressPolicyResolve(t *testing.T) {
+	var p *egressPolicy
+	require.False(t, p.restricted())
+	require.False(t, (&egressPolicy{}).restricted())
+	require.True(t, (&egressPolicy{DenyExternal: true}).restricted())
+
+	p = &egressPolicy{Allow: []string{"203.0.113.0/24", "198.51.100.7", "2001:db8::1", "localhost"}}
+	require.True(t, p.restricted())
+	subnets, err := p.resolve()
+	require.NoError(t, err)
+	require.True(t, len(subnets) >= 4)
+	require.Equal(t, "203.0.113.0/24", subnets[0].String())
+	require.Equal(t, "198.51.100.7/32", subnets[1].String())
+	require.Equal(t, "2001:db8::1/128", subnets[2].String())
+
+	// Hostnames that can't be resolved is an error
+	p = &egressPolicy{Allow: []string{"does-not-exist.invalid"}}
+	_, err = p.resolve()
+	require.Error(t, err)
+
+	// Too many entries is an error
+	p = &egressPolicy{}
+	for i := 0; i <= maxEgressAllow; i++ {
+		p.Allow = append(p.Allow, fmt.Sprintf("10.0.0.%d", i))
+	}
+	_, err = p.resolve()
+	require.Error(t, err)
+}
@@ -1,13 +1,21 @@
 package qemuengine
 
 import (
+	"net"
+	"os"
+	"os/exec"
+	"time"
+
 	"github.com/pkg/errors"
 	schematypes "github.com/taskcluster/go-schematypes"
 	"github.com/taskcluster/taskcluster-worker/engines"
 	"github.com/taskcluster/taskcluster-worker/engines/qemu/image"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/imagepeers"
 	"github.com/taskcluster/taskcluster-worker/engines/qemu/network"
 	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
 	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/fetcher"
+	"github.com/taskcluster/taskcluster-worker/runtime/util"
 )
 
 type engine struct {
@@ -16,10 +24,27 @@ type engine struct {
 	defaultMachine vm.Machine
 	monitor        runtime.Monitor
 	imageManager   *image.Manager
-	networkPool    *network.Pool
+	networkPool    networkPool
+	vpns           int // Number of VPN connections, openvpn is required if non-zero
 	Environment    *runtime.Environment
 	maxConcurrency int
-	socketFolder   runtime.TemporaryFolder
+	capacity       *capacity
+	balloon        *balloonController // nil, if ballooning is disabled
+	gpus           *gpuPool
+	usbDevices     *usbPool
+	socketFolder   folder
+	scratchFolder  runtime.TemporaryFolder // nil, unless socketFolder is a tmpfs
+	guestTools     *guestToolsBinary       // nil, unless guestToolsUpdate is set
+	imageVerifier  *imageVerifier
+	imageDownloads *fetcher.RangeOptions // nil, unless imageDownloads is set
+	imagePeers     *imagepeers.Peers     // nil, unless imagePeers is set
+}
+
+// folder is a folder that must be removed when the engine is disposed, such as
+// a runtime.TemporaryFolder.
+type folder interface {
+	Path() string
+	Remove() error
 }
 
 type engineProvider struct {
@@ -27,19 +52,259 @@ type engineProvider struct {
 }
 
 type configType struct {
-	Network       interface{}      `json:"network"`
-	MachineLimits vm.MachineLimits `json:"limits"`
-	Machine       interface{}      `json:"machine"`
+	Network             interface{}       `json:"network"`
+	MachineLimits       vm.MachineLimits  `json:"limits"`
+	Machine             interface{}       `json:"machine"`
+	Capacity            capacityConfig    `json:"capacity"`
+	ShutdownGracePeriod time.Duration     `json:"shutdownGracePeriod"`
+	SocketFolder        string            `json:"socketFolder"`
+	SocketTimeout       time.Duration     `json:"socketTimeout"`
+	NetworkMode         string            `json:"networkMode"`
+	UserNetworks        int               `json:"userNetworks"`
+	MaxConcurrency      int               `json:"maxConcurrency"`
+	AllowTCG            bool              `json:"allowTCG"`
+	Nested              bool              `json:"nestedVirtualization"`
+	ScreenshotOnFailure string            `json:"screenshotOnFailure"`
+	Balloon             *balloonConfig    `json:"balloon,omitempty"`
+	GPUs                []gpuConfig       `json:"gpus"`
+	USBDevices          []usbDeviceConfig `json:"usbDevices"`
+	EgressPolicy        *egressPolicy     `json:"egressPolicy,omitempty"`
+	HostRecords         []hostRecord      `json:"hostRecords,omitempty"`
+	MetaDataToken       bool              `json:"metaDataToken"`
+	SerialChannel       bool              `json:"serialChannel"`
+	GuestToolsUpdate    bool              `json:"guestToolsUpdate"`
+	SecretsBaseURL      string            `json:"secretsBaseUrl"`
+	HeartbeatTimeout    time.Duration     `json:"heartbeatTimeout"`
+	RequireImageDigest  bool              `json:"requireImageDigest"`
+	ImageSigningKeys    []string          `json:"imageSigningKeys"`
+	ImageDownloads      *downloadsConfig  `json:"imageDownloads,omitempty"`
+	ImagePeers          *peersConfig      `json:"imagePeers,omitempty"`
+	ImageDeduplication  bool              `json:"imageDeduplication"`
 }
 
 var configSchema = schematypes.Object{
 	Properties: schematypes.Properties{
-		"network": network.PoolConfigSchema,
-		"limits":  vm.MachineLimitsSchema,
-		"machine": vm.MachineSchema,
+		"network":  network.PoolConfigSchema,
+		"limits":   vm.MachineLimitsSchema,
+		"machine":  vm.MachineSchema,
+		"capacity": capacitySchema,
+		"shutdownGracePeriod": schematypes.Duration{
+			Title: "Shutdown Grace Period",
+			Description: util.Markdown(`
+				Time to wait for the guest to power down after an ACPI shutdown
+				request, before QEMU is killed. This gives the guest a chance to
+				flush disks and finish in-progress artifact uploads when the task
+				is aborted or the virtual machine is disposed.
+
+				If not specified QEMU is killed immediately.
+			`),
+		},
+		"socketFolder": schematypes.String{
+			Title: "Socket Folder",
+			Description: util.Markdown(`
+				Folder at which a tmpfs is mounted for the VNC, QMP and other sockets
+				of virtual machines, for example '/run/taskcluster-worker/qemu'. This
+				requires root privileges.
+
+				Workers sharing the folder each use a sub-folder locked while the
+				worker is running, sub-folders left by crashed workers are removed
+				when the engine starts. Scratch disks are created in temporary
+				storage, rather than on the tmpfs.
+
+				If not specified sockets are created in temporary storage.
+			`),
+			Pattern: `^/.+$`,
+		},
+		"socketTimeout": schematypes.Duration{
+			Title: "Socket Timeout",
+			Description: util.Markdown(`
+				Time to wait for QEMU to create the VNC and QMP sockets, when starting
+				a virtual machine, defaults to 90 seconds. This may need to be
+				increased on heavily loaded hosts.
+			`),
+		},
+		"heartbeatTimeout": schematypes.Duration{
+			Title: "Heartbeat Timeout",
+			Description: util.Markdown(`
+				Time without heartbeats from 'qemu-guest-tools' after which the task
+				fails with reason 'guest-tools-lost', defaults to 5 minutes. A
+				screenshot is captured, if 'screenshotOnFailure' is configured.
+
+				'qemu-guest-tools' sends a heartbeat every 15 seconds while the
+				command is running, so this should be at least a minute. Images with
+				'qemu-guest-tools' that don't send heartbeats are not monitored.
+			`),
+		},
+		"networkMode": schematypes.StringEnum{
+			Title: "Network Mode",
+			Description: util.Markdown(`
+				Networking used for virtual machines, defaults to 'tap'.
+
+				In 'tap' mode each virtual machine is given a TAP device from a pool
+				configured by the 'network' option, this requires root privileges.
+				In 'user' mode the QEMU user-space network stack is used, this
+				doesn't require root privileges, but offers less isolation and is
+				considerably slower. This is mostly useful for testing.
+			`),
+			Options: []string{networkModeTAP, networkModeUser},
+		},
+		"userNetworks": schematypes.Integer{
+			Title: "User-space Networks",
+			Description: util.Markdown(`
+				Maximum number of virtual machines to run concurrently in 'user'
+				network mode, defaults to 1. In 'tap' mode this is determined by
+				the number of subnets in the 'network' option.
+			`),
+			Minimum: 1,
+			Maximum: 100,
+		},
+		"maxConcurrency": schematypes.Integer{
+			Title: "Max Concurrency",
+			Description: util.Markdown(`
+				Maximum number of virtual machines to run concurrently, defaults to
+				the number of networks available, see 'network' and 'userNetworks'.
+
+				When running more than one virtual machine, 'capacity' should be
+				configured to partition host memory, CPUs and disk space among
+				virtual machines, otherwise concurrent virtual machines may exhaust
+				the resources of the host.
+			`),
+			Minimum: 1,
+			Maximum: 1000,
+		},
+		"allowTCG": schematypes.Boolean{
+			Title: "Allow TCG",
+			Description: util.Markdown(`
+				Allow virtual machines to run with TCG software emulation when KVM
+				isn't available, defaults to false.
+
+				TCG is considerably slower than KVM, but makes it possible to run on
+				hosts without '/dev/kvm', such as CI containers and nested
+				virtualization environments. A warning is written to the task log
+				when a virtual machine is started without KVM.
+			`),
+		},
+		"nestedVirtualization": schematypes.Boolean{
+			Title: "Nested Virtualization",
+			Description: util.Markdown(`
+				Let virtual machines run virtual machines with KVM, such as the
+				Android emulator or docker-machine, defaults to false. This requires
+				that 'kvm_intel' or 'kvm_amd' is loaded with 'nested=1' on the host,
+				and enables the 'vmx' or 'svm' CPU flag for virtual machines, unless
+				the machine explicitly disables it. This doesn't apply to images
+				resuming from snapshot, as the CPU must match the snapshot.
+
+				Nested virtual machines consume memory and CPU from the virtual
+				machine running the task, so tasks running emulators should request
+				a machine with enough memory for both. Nested virtualization is
+				slower than running directly on the host, and increases the attack
+				surface of KVM exposed to tasks.
+			`),
+		},
+		"screenshotOnFailure": schematypes.String{
+			Title: "Screenshot on Failure",
+			Description: util.Markdown(`
+				Artifact name for a PNG screenshot of the virtual machine screen,
+				captured when a task fails, is killed or aborted, for example
+				'public/screenshot.png'. This is useful for debugging hanging GUI
+				tests.
+
+				If not specified no screenshot is captured.
+			`),
+			MinimumLength: 1,
+		},
+		"balloon":      balloonSchema,
+		"gpus":         gpusSchema,
+		"usbDevices":   usbDevicesSchema,
+		"egressPolicy": egressPolicySchema,
+		"hostRecords":  hostRecordsSchema,
+		"metaDataToken": schematypes.Boolean{
+			Title: "Meta-Data Token",
+			Description: util.Markdown(`
+				Require guests to present a per-task token when talking to the
+				meta-data service, defaults to false. This prevents other processes
+				in the virtual machine from impersonating 'qemu-guest-tools', for
+				example to upload artifacts or respond to interactive shells.
+
+				The token is exposed to the guest as the fw_cfg item
+				'opt/org.taskcluster/meta-data-token', which 'qemu-guest-tools' reads
+				on Linux guests where the 'qemu_fw_cfg' module is loaded. Only root
+				can read the token, so the 'qemu-guest-tools' commands 'upload',
+				'post-log' and 'secret' must run as root. Images not supporting this
+				will fail to fetch the command. The token isn't required for images
+				resuming from snapshot, as the guest has already booted.
+			`),
+		},
+		"serialChannel": schematypes.Boolean{
+			Title: "Serial Channel",
+			Description: util.Markdown(`
+				Serve the meta-data service over a virtio-serial port named
+				'org.taskcluster.guest-tools.0', in addition to the network,
+				defaults to false. 'qemu-guest-tools' uses the port when it's
+				present, so tasks that break networking in the guest, such as network
+				test suites, still get logs, artifacts and interactive shells.
+
+				The port isn't added for images resuming from snapshot, as the
+				virtual hardware must match the snapshot.
+			`),
+		},
+		"guestToolsUpdate": schematypes.Boolean{
+			Title: "Guest-Tools Update",
+			Description: util.Markdown(`
+				Offer the taskcluster-worker binary running on the host to guests
+				through the meta-data service, defaults to false. When started,
+				'qemu-guest-tools' replaces itself with this binary, if it was built
+				from another git revision, so images don't have to be rebuilt when
+				the protocol between the worker and 'qemu-guest-tools' changes.
+
+				This only works for guests with the same operating system as the
+				host, and only if taskcluster-worker was built with a git revision.
+			`),
+		},
+		"requireImageDigest": schematypes.Boolean{
+			Title: "Require Image Digest",
+			Description: util.Markdown(`
+				Require tasks to reference images by 'url' with 'sha256' or 'sha512',
+				defaults to false. Images are verified against the digest before
+				they are extracted, and cached by digest, so a task can't be given
+				another image than the one it declared.
+			`),
+		},
+		"imageSigningKeys": schematypes.Array{
+			Title: "Image Signing Keys",
+			Description: util.Markdown(`
+				List of base64 encoded ed25519 public keys, if given tasks must
+				reference images by 'url' with a digest and a 'signature' of the
+				digest made with one of these keys.
+			`),
+			Items: schematypes.String{
+				Pattern: `^[A-Za-z0-9+/]{43}=$`,
+			},
+		},
+		"imageDownloads": imageDownloadsSchema,
+		"imagePeers":     imagePeersSchema,
+		"imageDeduplication": schematypes.Boolean{
+			Title: "Image Deduplication",
+			Description: util.Markdown(`
+				Share identical chunks between the disks of cached images, defaults
+				to false. This allows many versions of a large image to be cached
+				without each taking up the full size of the disk. This requires
+				temporary storage on btrfs or xfs with 'reflink=1', otherwise it
+				does nothing.
+			`),
+		},
+		"secretsBaseUrl": schematypes.URI{
+			Title: "BaseUrl for Secrets Service",
+			Description: util.Markdown(`
+				This is the baseUrl for the taskcluster-secrets service, from which
+				guests can fetch secrets through the meta-data service.
+
+				This defaults to the production value from taskcluster-client libraries.
+				You do not need to set this in production.
+			`),
+		},
 	},
 	Required: []string{
-		"network",
 		"limits",
 	},
 }
@@ -52,8 +317,118 @@ func (p engineProvider) NewEngine(options engines.EngineOptions) (engines.Engine
 	var c configType
 	schematypes.MustValidateAndMap(configSchema, options.Config, &c)
 
-	// Create socket folder
-	socketFolder, err := options.Environment.TemporaryStorage.NewFolder()
+	// Sanity check that limits doesn't exceed host capacity
+	if c.Capacity.Memory != 0 && c.MachineLimits.MaxMemory > c.Capacity.Memory {
+		return nil, errors.Errorf(
+			"limits.maxMemory: %d MiB exceeds capacity.memory: %d MiB",
+			c.MachineLimits.MaxMemory, c.Capacity.Memory,
+		)
+	}
+	if c.Capacity.CPUs != 0 && c.MachineLimits.MaxCPUs > c.Capacity.CPUs {
+		return nil, errors.Errorf(
+			"limits.maxCPUs: %d exceeds capacity.cpus: %d",
+			c.MachineLimits.MaxCPUs, c.Capacity.CPUs,
+		)
+	}
+	if err := c.MachineLimits.DiskThrottling.Validate(); err != nil {
+		return nil, errors.Wrap(err, "invalid limits")
+	}
+
+	// Check that GPUs can be passed through, so we don't fail every GPU task
+	seen := make(map[string]bool)
+	for i, gpu := range c.GPUs {
+		if len(gpu.Devices) == 0 {
+			return nil, errors.Errorf("gpus[%d].devices must list at-least one PCI device", i)
+		}
+		for _, address := range gpu.Devices {
+			if seen[address] {
+				return nil, errors.Errorf("gpus[%d].devices: PCI device %s is listed twice", i, address)
+			}
+			seen[address] = true
+			if err := vm.CheckPassthroughDevice(address); err != nil {
+				return nil, errors.Wrapf(err, "gpus[%d] cannot be passed through", i)
+			}
+		}
+	}
+
+	// Check that USB devices are fully specified and have unique names
+	names := make(map[string]bool)
+	for i, d := range c.USBDevices {
+		if names[d.Name] {
+			return nil, errors.Errorf("usbDevices[%d]: name '%s' is used twice", i, d.Name)
+		}
+		names[d.Name] = true
+		if err := d.device().Validate(); err != nil {
+			return nil, errors.Wrapf(err, "usbDevices[%d] is invalid", i)
+		}
+	}
+
+	// Check that the egress policy can be enforced
+	if c.EgressPolicy.restricted() {
+		if c.NetworkMode == networkModeUser {
+			return nil, errors.New("egressPolicy is only supported when networkMode is 'tap'")
+		}
+		if len(c.EgressPolicy.Allow) > maxEgressAllow {
+			return nil, errors.Errorf("egressPolicy.allow cannot have more than %d entries", maxEgressAllow)
+		}
+	}
+
+	if err := validateHostRecords(c.HostRecords); err != nil {
+		return nil, errors.Wrap(err, "invalid hostRecords")
+	}
+
+	verifier, err := newImageVerifier(c.ImageSigningKeys, c.RequireImageDigest)
+	if err != nil {
+		return nil, err
+	}
+
+	// Setup folder for partial image downloads, if enabled
+	var imageDownloads *fetcher.RangeOptions
+	if c.ImageDownloads != nil {
+		imageDownloads, err = newImageDownloads(*c.ImageDownloads)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Check that KVM is available, unless we're allowed to fallback to TCG
+	if !vm.KVMAvailable() {
+		if !c.AllowTCG {
+			return nil, errors.New("unable to open /dev/kvm, KVM is required unless 'allowTCG' is set")
+		}
+		options.Monitor.Warn("KVM isn't available, virtual machines will use TCG software emulation")
+	}
+
+	// Check that the host can run nested virtual machines, if enabled
+	if c.Nested && !vm.NestedVirtualizationAvailable() {
+		return nil, errors.New(
+			"'nestedVirtualization' requires that 'kvm_intel' or 'kvm_amd' is loaded with 'nested=1'",
+		)
+	}
+
+	// Detect QEMU version, so unsupported chipsets are reported as malformed
+	// payloads rather than QEMU failing to start
+	qemuInfo, err := vm.ProbeQEMU(vm.HostArchitecture())
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to detect QEMU version")
+	}
+	options.Monitor.Info("Using QEMU version ", qemuInfo.Version)
+
+	// Create socket folder, on a tmpfs if configured, in which case scratch
+	// disks must be created elsewhere
+	var socketFolder folder
+	var scratchFolder runtime.TemporaryFolder
+	if c.SocketFolder != "" {
+		socketFolder, err = newTmpfsSocketFolder(c.SocketFolder, options.Monitor.WithPrefix("socket-folder"))
+		if err == nil {
+			scratchFolder, err = options.Environment.TemporaryStorage.NewFolder()
+			if err != nil {
+				socketFolder.Remove()
+			}
+		}
+	} else {
+		socketFolder, err = options.Environment.TemporaryStorage.NewFolder()
+	}
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create socket folder")
 	}
@@ -67,57 +442,359 @@ func (p engineProvider) NewEngine(options engines.EngineOptions) (engines.Engine
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create image manager")
 	}
+	if c.ImageDeduplication {
+		imageManager.DeduplicateDisks()
+	}
 
 	// Create network pool
-	networkPool, err := network.NewPool(network.PoolOptions{
-		Config:           c.Network,
-		Monitor:          options.Monitor.WithPrefix("network"),
-		TemporaryStorage: options.Environment.TemporaryStorage,
-	})
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to create network pool")
+	var networks networkPool
+	var guestSubnets []*net.IPNet
+	vpns := 0
+	switch c.NetworkMode {
+	case networkModeUser:
+		size := c.UserNetworks
+		if size == 0 {
+			size = 1
+		}
+		networks = &userNetworkPool{
+			size:         size,
+			socketFolder: socketFolder.Path(),
+		}
+	case networkModeTAP, "":
+		if c.Network == nil {
+			return nil, errors.New("the 'network' option is required when networkMode is 'tap'")
+		}
+		pool, err2 := network.NewPool(network.PoolOptions{
+			Config:           c.Network,
+			Monitor:          options.Monitor.WithPrefix("network"),
+			TemporaryStorage: options.Environment.TemporaryStorage,
+		})
+		if err2 != nil {
+			return nil, errors.Wrap(err2, "failed to create network pool")
+		}
+		networks = tapNetworkPool{pool}
+		guestSubnets = pool.Subnets()
+		vpns = pool.VPNs()
 	}
 
+	// Limit concurrency below the number of networks, if configured
+	maxConcurrency := networks.Size()
+	if c.MaxConcurrency != 0 {
+		if c.MaxConcurrency > maxConcurrency {
+			networks.Dispose()
+			return nil, errors.Errorf(
+				"maxConcurrency: %d exceeds the number of networks available: %d",
+				c.MaxConcurrency, maxConcurrency,
+			)
+		}
+		if c.MaxConcurrency < maxConcurrency {
+			maxConcurrency = c.MaxConcurrency
+			networks = &limitedNetworkPool{networkPool: networks, size: maxConcurrency}
+		}
+	}
+
+	// Report how host resources are partitioned, and warn if concurrent virtual
+	// machines can exhaust host resources
+	if maxConcurrency > 1 && (c.Capacity.Memory == 0 || c.Capacity.CPUs == 0) {
+		options.Monitor.Warnf(
+			"running up to %d virtual machines concurrently without 'capacity.memory' "+
+				"and 'capacity.cpus', virtual machines may exhaust host resources",
+			maxConcurrency,
+		)
+	}
+	options.Monitor.Infof(
+		"running up to %d virtual machines concurrently, with capacity %s",
+		maxConcurrency, c.Capacity,
+	)
+
 	// Create defaultMachine machine from config
 	var defaultMachine vm.Machine
 	if c.Machine != nil {
+		if vm.MigrateMachineDefinition(c.Machine) == nil {
+			return nil, errors.New(
+				"machine: options 'display' and 'devices' require format version 2",
+			)
+		}
 		defaultMachine = vm.NewMachine(c.Machine)
 	}
 
+	// Copy this binary, so it can be offered to guests, if enabled
+	var guestTools *guestToolsBinary
+	if c.GuestToolsUpdate {
+		guestTools, err = newGuestToolsBinary(options.Environment.TemporaryStorage.NewFilePath())
+		if err == errNoRevision {
+			options.Monitor.Warn("'guestToolsUpdate' is ignored, as taskcluster-worker wasn't built with a git revision")
+		} else if err != nil {
+			networks.Dispose()
+			return nil, err
+		}
+	}
+
+	// Share cached images with workers on the local network, if enabled
+	var peers *imagepeers.Peers
+	if c.ImagePeers != nil {
+		imageManager.KeepArchives()
+		peers, err = imagepeers.New(imagepeers.Options{
+			Interface:        c.ImagePeers.Interface,
+			Port:             c.ImagePeers.Port,
+			BroadcastAddress: c.ImagePeers.BroadcastAddress,
+			Images:           imageManager,
+			Monitor:          options.Monitor.WithPrefix("image-peers"),
+			Reject:           guestSubnets,
+		})
+		if err != nil {
+			networks.Dispose()
+			if guestTools != nil {
+				guestTools.Remove()
+			}
+			return nil, err
+		}
+	}
+
+	// Start controlling memory balloons, if enabled
+	var balloon *balloonController
+	if c.Balloon != nil {
+		balloon = newBalloonController(*c.Balloon, options.Monitor.WithPrefix("balloon"))
+	}
+
 	// Construct engine object
 	return &engine{
 		engineConfig:   c,
 		defaultMachine: defaultMachine,
 		monitor:        options.Monitor,
 		imageManager:   imageManager,
-		networkPool:    networkPool,
-		maxConcurrency: networkPool.Size(),
+		networkPool:    networks,
+		vpns:           vpns,
+		maxConcurrency: maxConcurrency,
+		capacity:       &capacity{config: c.Capacity},
+		balloon:        balloon,
+		gpus:           newGPUPool(c.GPUs),
+		usbDevices:     newUSBPool(c.USBDevices),
 		Environment:    options.Environment,
 		socketFolder:   socketFolder,
+		scratchFolder:  scratchFolder,
+		guestTools:     guestTools,
+		imageVerifier:  verifier,
+		imageDownloads: imageDownloads,
+		imagePeers:     peers,
 	}, nil
 }
 
 func (e *engine) Capabilities() engines.Capabilities {
 	return engines.Capabilities{
 		MaxConcurrency: e.maxConcurrency,
+		Migration:      true,
 	}
 }
 
 type payloadType struct {
-	Image   interface{} `json:"image"`
-	Command []string    `json:"command"`
-	Machine interface{} `json:"machine,omitempty"`
+	Image            interface{}        `json:"image"`
+	Command          []string           `json:"command"`
+	Machine          interface{}        `json:"machine,omitempty"`
+	ScreenRecording  string             `json:"screenRecording,omitempty"`
+	AudioRecording   string             `json:"audioRecording,omitempty"`
+	PacketCapture    *packetCaptureType `json:"packetCapture,omitempty"`
+	CrashDump        string             `json:"crashDump,omitempty"`
+	ResourceUsage    string             `json:"resourceUsage,omitempty"`
+	GuaranteedMemory int                `json:"guaranteedMemory,omitempty"`
+	Poweroff         bool               `json:"completeOnPoweroff,omitempty"`
+	ImageArtifact    string             `json:"imageArtifact,omitempty"`
+	ScratchDisks     []scratchDiskType  `json:"scratchDisks,omitempty"`
+	GPUs             int                `json:"gpus,omitempty"`
+	USBDevices       []string           `json:"usbDevices,omitempty"`
+	ForwardPorts     []int              `json:"forwardPorts,omitempty"`
+	EgressPolicy     *egressPolicy      `json:"egressPolicy,omitempty"`
+	HostRecords      []hostRecord       `json:"hostRecords,omitempty"`
+	Boot             *bootType          `json:"boot,omitempty"`
+}
+
+type scratchDiskType struct {
+	Size int `json:"size"`
 }
 
 var payloadSchema = schematypes.Object{
 	Properties: schematypes.Properties{
-		"image": imageFetcher.Schema(),
+		"image": imageSchema,
 		"command": schematypes.Array{
 			Title:       "Command to run",
 			Description: `Command and arguments to execute on the guest.`,
 			Items:       schematypes.String{},
 		},
 		"machine": vm.MachineSchema,
+		"boot":    bootSchema,
+		"screenRecording": schematypes.String{
+			Title: "Screen Recording",
+			Description: util.Markdown(`
+				Artifact name for a recording of the virtual machine screen, for
+				example 'public/screen-recording.tar'. If specified the screen is
+				recorded for the duration of the task and uploaded as artifact when
+				the task is resolved.
+
+				The recording is a tar-archive of PNG frames captured every second,
+				frames are only captured when the screen has changed and are named
+				by the number of milliseconds since the recording started.
+			`),
+			MinimumLength: 1,
+		},
+		"audioRecording": schematypes.String{
+			Title: "Audio Recording",
+			Description: util.Markdown(`
+				Artifact name for a recording of the audio output of the virtual
+				machine, for example 'public/audio-recording.wav'. If specified the
+				output of the sound device is recorded for the duration of the task
+				and uploaded as artifact when the task is resolved, the machine
+				must have a 'sound' device.
+
+				The recording is a WAV file with 16 bit stereo samples at 44.1 kHz,
+				it's truncated at 512 MiB. The SHA-256 of the samples is written to
+				the task log, such that audio output can be verified without
+				downloading the recording.
+			`),
+			MinimumLength: 1,
+		},
+		"packetCapture": packetCaptureSchema,
+		"crashDump": schematypes.String{
+			Title: "Crash Dump",
+			Description: util.Markdown(`
+				Artifact name for a dump of the guest memory, for example
+				'public/crash-dump.kdump'. If specified and the guest panics, the
+				guest memory is dumped and uploaded as artifact, such that kernel
+				crashes can be analyzed with the 'crash' utility.
+
+				The dump is a zlib compressed kdump, it's only uploaded if it's
+				smaller than 1 GiB. The guest must support the 'pvpanic' device,
+				which is only available with architecture 'x86_64'.
+			`),
+			MinimumLength: 1,
+		},
+		"resourceUsage": schematypes.String{
+			Title: "Resource Usage",
+			Description: util.Markdown(`
+				Artifact name for a timeline of resources used by the virtual
+				machine, for example 'public/resource-usage.json'. If specified the
+				resource usage is sampled every 5s and uploaded as a JSON array,
+				where each sample has 'time' and 'cpuTime' in seconds, resident
+				'memory' in bytes and the number of bytes read/written to disk and
+				received/sent over the network since the task was started.
+
+				A summary of the resource usage is always written to the task log.
+			`),
+			MinimumLength: 1,
+		},
+		"guaranteedMemory": schematypes.Integer{
+			Title: "Guaranteed Memory",
+			Description: util.Markdown(`
+				Memory in MiB that must not be reclaimed from the virtual machine,
+				when the worker reclaims memory from idle virtual machines using
+				the balloon device. Defaults to a percentage of the machine memory
+				configured by the worker, this cannot exceed the machine memory.
+			`),
+			Minimum: 0,
+			Maximum: 1024 * 1024,
+		},
+		"completeOnPoweroff": schematypes.Boolean{
+			Title: "Complete on Poweroff",
+			Description: util.Markdown(`
+				Resolve the task as successful when the guest powers itself off,
+				rather than treating it as a crash. This is useful for images where
+				a startup script is the whole task, the guest signals completion by
+				powering off. Resets and panics are still treated as failures.
+
+				Files cannot be extracted from the guest after it has powered off,
+				so artifacts must be uploaded before powering off.
+			`),
+		},
+		"imageArtifact": schematypes.String{
+			Title: "Image Artifact",
+			Description: util.Markdown(`
+				Artifact name for an image built from the disk of the virtual
+				machine, for example 'public/image.tar.zst'. If specified and the
+				task is successful, the guest is powered down and its disk is
+				packaged as a new image, instead of being discarded. This allows
+				images to be built by ordinary tasks.
+
+				The 'machine.json' of the new image is the machine definition from
+				the image, with options from 'task.payload.machine' applied. Any
+				snapshot is dropped, so the new image boots from scratch. Scratch
+				disks are not included in the image.
+
+				Files cannot be extracted from the guest after it has powered down,
+				so artifacts must be uploaded before the command exits.
+			`),
+			MinimumLength: 1,
+		},
+		"scratchDisks": schematypes.Array{
+			Title: "Scratch Disks",
+			Description: util.Markdown(`
+				Additional empty disks attached to the virtual machine as virtio-blk
+				devices, in the order given. Scratch disks are sparse files on the
+				host, and are deleted when the task is done. This is useful for tasks
+				with large amounts of temporary data, as the boot disk is limited by
+				the image.
+
+				Scratch disks cannot be used with images resuming from snapshot.
+			`),
+			Items: schematypes.Object{
+				Properties: schematypes.Properties{
+					"size": schematypes.Integer{
+						Title:       "Size",
+						Description: `Size of the disk in GiB.`,
+						Minimum:     1,
+						Maximum:     1024,
+					},
+				},
+				Required: []string{"size"},
+			},
+		},
+		"gpus": schematypes.Integer{
+			Title: "GPUs",
+			Description: util.Markdown(`
+				Number of host GPUs to pass through to the virtual machine, defaults
+				to 0. The task will fail with 'malformed-payload' if the worker
+				doesn't have this many GPUs. Memory is not reclaimed from virtual
+				machines with GPUs, as guest memory must be pinned for passthrough.
+
+				GPUs cannot be used with images resuming from snapshot.
+			`),
+			Minimum: 0,
+			Maximum: 4,
+		},
+		"usbDevices": schematypes.Array{
+			Title: "USB Devices",
+			Description: util.Markdown(`
+				Names of host USB devices to pass through to the virtual machine,
+				as configured by the worker. Devices are reserved for the duration
+				of the task, if a device is in use by another task, this task will
+				be resolved 'internal-error', so it can be retried.
+
+				USB devices cannot be used with images resuming from snapshot.
+			`),
+			Items: schematypes.String{
+				Pattern: `^[a-zA-Z0-9_-]{1,64}$`,
+			},
+			Unique: true,
+		},
+		"forwardPorts": schematypes.Array{
+			Title: "Forward Ports",
+			Description: util.Markdown(`
+				TCP ports in the guest to forward from ephemeral ports on the
+				loopback interface of the host, at most 16 ports. This allows
+				host-side tooling and interactive sessions to reach servers
+				running in the guest.
+
+				The host ports assigned are written to the task log, reported to
+				the guest as 'ports' by the meta-data service, and available from
+				the result set. Ports are forwarded until the virtual machine is
+				disposed.
+			`),
+			Items: schematypes.Integer{
+				Minimum: 1,
+				Maximum: 65535,
+			},
+			Unique: true,
+		},
+		"egressPolicy": egressPolicySchema,
+		"hostRecords":  hostRecordsSchema,
 	},
 	Required: []string{"command", "image"},
 }
@@ -130,6 +807,15 @@ func (e *engine) NewSandboxBuilder(options engines.SandboxOptions) (engines.Sand
 	var p payloadType
 	schematypes.MustValidateAndMap(payloadSchema, options.Payload, &p)
 
+	// Machine definitions in older formats are migrated to the current format
+	if p.Machine != nil {
+		if p.Machine = vm.MigrateMachineDefinition(p.Machine); p.Machine == nil {
+			return nil, runtime.NewMalformedPayloadError(
+				"task.payload.machine options 'display' and 'devices' require 'version: 2'",
+			)
+		}
+	}
+
 	// Get an idle network
 	net, err := e.networkPool.Network()
 	if err == network.ErrAllNetworksInUse {
@@ -140,11 +826,107 @@ func (e *engine) NewSandboxBuilder(options engines.SandboxOptions) (engines.Sand
 	}
 
 	// Create sandboxBuilder, it'll handle image downloading
-	return newSandboxBuilder(&p, net, options.TaskContext, e, options.Monitor), nil
+	storage := options.TemporaryStorage
+	if storage == nil {
+		storage = e.Environment.TemporaryStorage
+	}
+	sb := newSandboxBuilder(&p, net, options.TaskContext, storage, e, options.Monitor)
+	sb.migration = options.Migration
+	return sb, nil
+}
+
+func (e *engine) VolumeSchema() schematypes.Schema {
+	return volumeSchema
+}
+
+func (e *engine) NewVolumeBuilder(options interface{}) (engines.VolumeBuilder, error) {
+	var o volumeOptions
+	schematypes.MustValidateAndMap(volumeSchema, options, &o)
+	if o.Type == volumeTypeDisk {
+		return nil, runtime.NewMalformedPayloadError(
+			"Volumes of type 'disk' cannot be pre-loaded",
+		)
+	}
+	return newVolumeBuilder(e)
+}
+
+func (e *engine) NewVolume(options interface{}) (engines.Volume, error) {
+	var o volumeOptions
+	schematypes.MustValidateAndMap(volumeSchema, options, &o)
+	if o.Type == volumeTypeDisk {
+		size := o.Size
+		if size == 0 {
+			size = defaultDiskVolumeSize
+		}
+		v, err := newDiskVolume(e, size)
+		if err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+	vb, err := newVolumeBuilder(e)
+	if err != nil {
+		return nil, err
+	}
+	return vb.BuildVolume()
+}
+
+func (e *engine) HealthCheck() error {
+	// Check that we have KVM, as qemu would be very slow without it
+	if !e.engineConfig.AllowTCG {
+		f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+		if err != nil {
+			return errors.Wrap(err, "unable to open /dev/kvm, KVM is required")
+		}
+		f.Close()
+	}
+
+	// Check that nested virtualization is still enabled, if required
+	if e.engineConfig.Nested && !vm.NestedVirtualizationAvailable() {
+		return errors.New("nested virtualization is no longer enabled in the KVM module")
+	}
+
+	// Check that utilities we need are installed
+	qemuSystem := "qemu-system-" + vm.HostArchitecture()
+	utilities := []string{qemuSystem, "qemu-img", "dnsmasq", "ip"}
+	if e.vpns > 0 {
+		utilities = append(utilities, "openvpn")
+	}
+	if e.engineConfig.NetworkMode == networkModeUser {
+		utilities = []string{qemuSystem, "qemu-img", "netcat"}
+	}
+	for _, name := range utilities {
+		if _, err := exec.LookPath(name); err != nil {
+			return errors.Errorf("unable to find '%s' in PATH, error: %s", name, err)
+		}
+	}
+	return nil
 }
 
 func (e *engine) Dispose() error {
+	if e.balloon != nil {
+		e.balloon.Dispose()
+		e.balloon = nil
+	}
 	err := e.networkPool.Dispose()
 	e.networkPool = nil
+	if rerr := e.socketFolder.Remove(); err == nil {
+		err = rerr
+	}
+	if e.scratchFolder != nil {
+		if rerr := e.scratchFolder.Remove(); err == nil {
+			err = rerr
+		}
+	}
+	if e.guestTools != nil {
+		if rerr := e.guestTools.Remove(); err == nil {
+			err = rerr
+		}
+	}
+	if e.imagePeers != nil {
+		if rerr := e.imagePeers.Dispose(); err == nil {
+			err = rerr
+		}
+	}
 	return err
 }
@@ -0,0 +1,110 @@
+package qemuengine
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/taskcluster/taskcluster-worker/engines"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
+)
+
+// qmpEventKinds maps QMP events to kinds of engines.SandboxEvent, other QMP
+// events are ignored.
+var qmpEventKinds = map[string]string{
+	"RESET":          engines.SandboxEventReset,
+	"SHUTDOWN":       engines.SandboxEventShutdown,
+	"WATCHDOG":       engines.SandboxEventWatchdog,
+	"BLOCK_IO_ERROR": engines.SandboxEventIOError,
+	"GUEST_PANICKED": engines.SandboxEventGuestPanic,
+}
+
+// isGuestPoweroff returns true, if e is a SHUTDOWN event caused by the guest
+// powering off, rather than the host or a guest panic or reset. QEMU 2.10
+// added 'guest' and QEMU 3.0 added 'reason' to the SHUTDOWN event.
+func isGuestPoweroff(e vm.Event) bool {
+	if e.Name != "SHUTDOWN" {
+		return false
+	}
+	guest, _ := e.Data["guest"].(bool)
+	reason, ok := e.Data["reason"].(string)
+	return guest && (!ok || reason == "guest-shutdown")
+}
+
+// eventBufferSize is the number of events buffered for each subscriber, before
+// events are dropped.
+const eventBufferSize = 32
+
+// sandboxEvent returns the engines.SandboxEvent for a QMP event, and false if
+// the event should be ignored.
+func sandboxEvent(e vm.Event) (engines.SandboxEvent, bool) {
+	kind, ok := qmpEventKinds[e.Name]
+	if !ok {
+		return engines.SandboxEvent{}, false
+	}
+	message := fmt.Sprintf("QEMU event: %s", e.Name)
+	if len(e.Data) > 0 {
+		data, _ := json.Marshal(e.Data)
+		message += " " + string(data)
+	}
+	return engines.SandboxEvent{
+		Kind:    kind,
+		Message: message,
+		Details: e.Data,
+	}, true
+}
+
+// eventBroadcaster delivers events to all subscribers, dropping events for
+// subscribers that don't keep up.
+type eventBroadcaster struct {
+	m           sync.Mutex
+	closed      bool
+	subscribers []chan engines.SandboxEvent
+}
+
+// subscribe returns a new channel on which events are delivered, returns
+// engines.ErrSandboxTerminated if the broadcaster has been closed.
+func (b *eventBroadcaster) subscribe() (<-chan engines.SandboxEvent, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.closed {
+		return nil, engines.ErrSandboxTerminated
+	}
+	c := make(chan engines.SandboxEvent, eventBufferSize)
+	b.subscribers = append(b.subscribers, c)
+	return c, nil
+}
+
+// publish delivers e to all subscribers, returns the number of subscribers for
+// which the event was dropped.
+func (b *eventBroadcaster) publish(e engines.SandboxEvent) int {
+	b.m.Lock()
+	defer b.m.Unlock()
+	dropped := 0
+	if b.closed {
+		return dropped
+	}
+	for _, c := range b.subscribers {
+		select {
+		case c <- e:
+		default:
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// close closes all subscriber channels, events published after this are
+// ignored.
+func (b *eventBroadcaster) close() {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.closed {
+		return
+	}
+	b.closed = true
+	for _, c := range b.subscribers {
+		close(c)
+	}
+	b.subscribers = nil
+}
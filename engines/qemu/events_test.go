@@ -0,0 +1,69 @@
+package qemuengine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/engines"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
+)
+
+func TestSandboxEvent(t *testing.T) {
+	_, ok := sandboxEvent(vm.Event{Name: "RTC_CHANGE"})
+	require.False(t, ok, "expected RTC_CHANGE to be ignored")
+
+	e, ok := sandboxEvent(vm.Event{
+		Name: "GUEST_PANICKED",
+		Data: map[string]interface{}{"action": "pause"},
+	})
+	require.True(t, ok)
+	require.Equal(t, engines.SandboxEventGuestPanic, e.Kind)
+	require.Equal(t, `QEMU event: GUEST_PANICKED {"action":"pause"}`, e.Message)
+}
+
+func TestIsGuestPoweroff(t *testing.T) {
+	require.True(t, isGuestPoweroff(vm.Event{
+		Name: "SHUTDOWN",
+		Data: map[string]interface{}{"guest": true, "reason": "guest-shutdown"},
+	}))
+	require.True(t, isGuestPoweroff(vm.Event{
+		Name: "SHUTDOWN",
+		Data: map[string]interface{}{"guest": true},
+	}), "expected QEMU 2.10 events without reason to be accepted")
+	require.False(t, isGuestPoweroff(vm.Event{
+		Name: "SHUTDOWN",
+		Data: map[string]interface{}{"guest": false, "reason": "host-qmp-quit"},
+	}))
+	require.False(t, isGuestPoweroff(vm.Event{
+		Name: "SHUTDOWN",
+		Data: map[string]interface{}{"guest": true, "reason": "guest-panic"},
+	}))
+	require.False(t, isGuestPoweroff(vm.Event{Name: "SHUTDOWN"}))
+	require.False(t, isGuestPoweroff(vm.Event{Name: "RESET"}))
+}
+
+func TestEventBroadcaster(t *testing.T) {
+	var b eventBroadcaster
+	c1, err := b.subscribe()
+	require.NoError(t, err)
+	c2, err := b.subscribe()
+	require.NoError(t, err)
+
+	e := engines.SandboxEvent{Kind: engines.SandboxEventReset}
+	require.Equal(t, 0, b.publish(e))
+	require.Equal(t, e, <-c1)
+	require.Equal(t, e, <-c2)
+
+	// Events are dropped for subscribers that don't keep up
+	for i := 0; i < eventBufferSize; i++ {
+		b.publish(e)
+	}
+	require.Equal(t, 2, b.publish(e))
+
+	b.close()
+	for range c1 {
+	}
+	_, err = b.subscribe()
+	require.Equal(t, engines.ErrSandboxTerminated, err)
+	require.Equal(t, 0, b.publish(e))
+}
@@ -2,22 +2,136 @@ package qemuengine
 
 import (
 	"fmt"
+	"os"
+	"strings"
+	"time"
 
+	"github.com/pkg/errors"
+	schematypes "github.com/taskcluster/go-schematypes"
 	"github.com/taskcluster/taskcluster-worker/runtime"
 	"github.com/taskcluster/taskcluster-worker/runtime/fetcher"
+	"github.com/taskcluster/taskcluster-worker/runtime/util"
 )
 
 // A fetcher for downloading images.
-var imageFetcher = fetcher.Combine(
-	// Allow fetching images from URL
-	fetcher.URL,
-	// Allow fetching images from queue artifacts
-	fetcher.Artifact,
-	// Allow fetching images from queue referenced by index namespace
-	fetcher.Index,
-	// Allow fetching images from URL + hash
-	fetcher.URLHash,
-)
+var imageFetcher = fetcher.Default
+
+// downloadsConfig configures ranged image downloads, sizes are in MiB.
+type downloadsConfig struct {
+	Folder      string `json:"folder"`
+	Parallelism int    `json:"parallelism"`
+	PartSize    int    `json:"partSize"`
+}
+
+// Partial downloads not resumed within this time are removed on start-up
+const imageDownloadsMaxAge = 7 * 24 * time.Hour
+
+var imageDownloadsSchema = schematypes.Object{
+	Title: "Image Downloads",
+	Description: util.Markdown(`
+		Download images larger than 'partSize' in parts fetched concurrently
+		using range requests, if the server supports it. Failed parts are
+		retried individually, and partially downloaded images are kept in
+		'folder', so the download is resumed if the worker is restarted.
+		If not specified images are downloaded with a single request.
+
+		Partial downloads that haven't been resumed for 7 days are removed
+		when the worker starts.
+	`),
+	Properties: schematypes.Properties{
+		"folder": schematypes.String{
+			Title: "Folder",
+			Description: util.Markdown(`
+				Folder for partially downloaded images, this should be kept across
+				worker restarts, and have room for a few images. It is created if
+				it doesn't exist.
+			`),
+			MinimumLength: 1,
+		},
+		"parallelism": schematypes.Integer{
+			Title:       "Parallelism",
+			Description: `Number of parts to fetch concurrently, defaults to 4.`,
+			Minimum:     1,
+			Maximum:     64,
+		},
+		"partSize": schematypes.Integer{
+			Title:       "Part Size",
+			Description: `Size of each part in MiB, defaults to 64.`,
+			Minimum:     1,
+			Maximum:     4 * 1024,
+		},
+	},
+	Required: []string{"folder"},
+}
+
+// peersConfig configures sharing of images with peers.
+type peersConfig struct {
+	Interface        string `json:"interface"`
+	Port             int    `json:"port"`
+	BroadcastAddress string `json:"broadcastAddress"`
+}
+
+var imagePeersSchema = schematypes.Object{
+	Title: "Image Peers",
+	Description: util.Markdown(`
+		Share cached images with other workers on the local network. Workers
+		broadcast the digests of cached images over UDP and serve the images
+		over HTTP, both using 'port'. Before fetching an image from its origin,
+		workers fetch it from peers that have it, if any.
+
+		Only images referenced with 'sha256' or 'sha512' are shared, as images
+		from peers are verified against the digest. Cached images are kept in
+		compressed form too, when this is enabled, so they use more disk space.
+		Anyone on the local network can fetch cached images, if they know the
+		digest, so this shouldn't be enabled on untrusted networks, if images
+		are private. If not specified images are not shared.
+
+		Images are served on 'interface', and only to peers on the subnets of
+		'interface', virtual machines can't fetch images from the worker.
+	`),
+	Properties: schematypes.Properties{
+		"interface": schematypes.String{
+			Title: "Interface",
+			Description: util.Markdown(`
+				Host network interface connected to the local network shared with
+				peers, such as 'eth0'. Images are served on the IPv4 address of this
+				interface.
+			`),
+			Pattern: `^[^/\s]{1,15}$`,
+		},
+		"port": schematypes.Integer{
+			Title:       "Port",
+			Description: `UDP port for announcements and TCP port for serving images.`,
+			Minimum:     1,
+			Maximum:     65535,
+		},
+		"broadcastAddress": schematypes.String{
+			Title: "Broadcast Address",
+			Description: util.Markdown(`
+				IPv4 address to send announcements to, defaults to
+				'255.255.255.255'. This can be the broadcast address of a subnet.
+			`),
+			Pattern: `^[0-9]{1,3}(\.[0-9]{1,3}){3}$`,
+		},
+	},
+	Required: []string{"interface", "port"},
+}
+
+// newImageDownloads creates the folder for partial downloads and removes old
+// partial downloads, returning the options for fetcher.WithRangeDownloads().
+func newImageDownloads(c downloadsConfig) (*fetcher.RangeOptions, error) {
+	if err := os.MkdirAll(c.Folder, 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create imageDownloads.folder")
+	}
+	if err := fetcher.PruneRangeDownloads(c.Folder, imageDownloadsMaxAge); err != nil {
+		return nil, errors.Wrap(err, "failed to remove old partial downloads from imageDownloads.folder")
+	}
+	return &fetcher.RangeOptions{
+		Folder:      c.Folder,
+		Parallelism: c.Parallelism,
+		PartSize:    int64(c.PartSize) * 1024 * 1024,
+	}, nil
+}
 
 type fetchImageContext struct {
 	*runtime.TaskContext
@@ -26,3 +140,28 @@ type fetchImageContext struct {
 func (c fetchImageContext) Progress(description string, percent float64) {
 	c.Log(fmt.Sprintf("Fetching image: %s - %.0f %%", description, percent*100))
 }
+
+type fetchBootContext struct {
+	*runtime.TaskContext
+	name string
+}
+
+func (c fetchBootContext) Progress(description string, percent float64) {
+	c.Log(fmt.Sprintf("Fetching %s: %s - %.0f %%", c.name, description, percent*100))
+}
+
+// checkScopes returns a MalformedPayloadError, if task.scopes doesn't satisfy
+// one of the scope-sets required by ref.
+func checkScopes(c *runtime.TaskContext, ref fetcher.Reference) error {
+	scopeSets := ref.Scopes()
+	if c.HasScopes(scopeSets...) {
+		return nil
+	}
+	var options []string
+	for _, scopes := range scopeSets {
+		options = append(options, strings.Join(scopes, ", "))
+	}
+	return runtime.NewMalformedPayloadError(
+		`task.scopes must satisfy at-least one of the scope-sets: ` + strings.Join(options, " or "),
+	)
+}
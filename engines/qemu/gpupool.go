@@ -0,0 +1,105 @@
+package qemuengine
+
+import (
+	"errors"
+	"sync"
+
+	schematypes "github.com/taskcluster/go-schematypes"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/util"
+)
+
+// gpuConfig is a host GPU available for passthrough, given as the PCI
+// addresses of its functions.
+type gpuConfig struct {
+	Devices []string `json:"devices"`
+}
+
+var gpusSchema = schematypes.Array{
+	Title: "GPUs",
+	Description: util.Markdown(`
+		Host GPUs available for passthrough to virtual machines using vfio-pci,
+		tasks may request GPUs using 'gpus' in the task payload. If not
+		specified tasks cannot request GPUs.
+
+		Each GPU is given as the list of PCI addresses for its functions, for
+		example '["0000:01:00.0", "0000:01:00.1"]' for a GPU with an audio
+		function. The IOMMU must be enabled and all functions must be bound to
+		the vfio-pci driver, this is checked when the worker starts.
+	`),
+	Items: schematypes.Object{
+		Properties: schematypes.Properties{
+			"devices": schematypes.Array{
+				Title:       "PCI Devices",
+				Description: `PCI addresses of the GPU functions, as listed by 'lspci -D'.`,
+				Items: schematypes.String{
+					Pattern: vm.PCIAddressPattern,
+				},
+				Unique: true,
+			},
+		},
+		Required: []string{"devices"},
+	},
+}
+
+// errInsufficientGPUs is returned from gpuPool.reserve() if the GPUs required
+// are currently reserved by other virtual machines.
+var errInsufficientGPUs = errors.New("insufficient GPUs available for virtual machine")
+
+// gpuPool tracks GPUs reserved by running virtual machines.
+type gpuPool struct {
+	m     sync.Mutex
+	gpus  []gpuConfig
+	inUse []bool
+}
+
+func newGPUPool(gpus []gpuConfig) *gpuPool {
+	return &gpuPool{
+		gpus:  gpus,
+		inUse: make([]bool, len(gpus)),
+	}
+}
+
+// reserve count GPUs, returns the GPUs reserved and a function that must be
+// called to release the reservation.
+//
+// Returns MalformedPayloadError if the worker doesn't have count GPUs, and
+// errInsufficientGPUs if there isn't sufficient GPUs left right now.
+func (p *gpuPool) reserve(count int) ([]gpuConfig, func(), error) {
+	if count > len(p.gpus) {
+		return nil, nil, runtime.NewMalformedPayloadError(
+			"Task requires ", count, " GPUs, but only ", len(p.gpus),
+			" GPUs are available on this worker",
+		)
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	var indexes []int
+	for i, used := range p.inUse {
+		if !used && len(indexes) < count {
+			indexes = append(indexes, i)
+		}
+	}
+	if len(indexes) < count {
+		return nil, nil, errInsufficientGPUs
+	}
+	gpus := make([]gpuConfig, len(indexes))
+	for i, index := range indexes {
+		p.inUse[index] = true
+		gpus[i] = p.gpus[index]
+	}
+
+	var once sync.Once
+	return gpus, func() {
+		once.Do(func() {
+			p.m.Lock()
+			defer p.m.Unlock()
+			for _, index := range indexes {
+				p.inUse[index] = false
+			}
+		})
+	}, nil
+}
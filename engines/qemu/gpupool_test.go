@@ -0,0 +1,41 @@
+package qemuengine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+func TestGPUPoolReserve(t *testing.T) {
+	p := newGPUPool([]gpuConfig{
+		{Devices: []string{"0000:01:00.0", "0000:01:00.1"}},
+		{Devices: []string{"0000:02:00.0"}},
+	})
+
+	gpus1, release1, err := p.reserve(1)
+	require.NoError(t, err)
+	require.Equal(t, []string{"0000:01:00.0", "0000:01:00.1"}, gpus1[0].Devices)
+	gpus2, release2, err := p.reserve(1)
+	require.NoError(t, err)
+	require.Equal(t, []string{"0000:02:00.0"}, gpus2[0].Devices)
+
+	_, _, err = p.reserve(1)
+	require.Equal(t, errInsufficientGPUs, err)
+
+	// Releasing twice has no effect
+	release1()
+	release1()
+	_, _, err = p.reserve(2)
+	require.Equal(t, errInsufficientGPUs, err)
+	release2()
+	gpus, release, err := p.reserve(2)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(gpus))
+	release()
+
+	// Requesting more GPUs than the worker has is malformed-payload
+	_, _, err = p.reserve(3)
+	_, ok := runtime.IsMalformedPayloadError(err)
+	require.True(t, ok)
+}
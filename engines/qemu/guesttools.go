@@ -0,0 +1,73 @@
+package qemuengine
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	goruntime "runtime"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/commands/version"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/metaservice"
+)
+
+// guestToolsBinary is a copy of the running taskcluster-worker binary, which
+// includes qemu-guest-tools, offered to guests through the meta-data service.
+// A copy is used, so the binary can't change if the worker is upgraded while
+// running.
+type guestToolsBinary struct {
+	info metaservice.GuestTools
+	file string
+}
+
+// errNoRevision is returned from newGuestToolsBinary, if the binary wasn't
+// built with a git revision, as guests can't tell if they need to update.
+var errNoRevision = errors.New("taskcluster-worker wasn't built with a git revision")
+
+// newGuestToolsBinary copies the running binary to file. The binary is only
+// useful to guests with the same OS as the host, but guests check this.
+func newGuestToolsBinary(file string) (*guestToolsBinary, error) {
+	if version.Revision() == "" {
+		return nil, errNoRevision
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to find the taskcluster-worker binary")
+	}
+
+	src, err := os.Open(exe)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open the taskcluster-worker binary")
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create copy of the taskcluster-worker binary")
+	}
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(dst, h), src)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(file)
+		return nil, errors.Wrap(err, "failed to copy the taskcluster-worker binary")
+	}
+
+	return &guestToolsBinary{
+		info: metaservice.GuestTools{
+			Revision: version.Revision(),
+			OS:       goruntime.GOOS,
+			Arch:     goruntime.GOARCH,
+			SHA256:   hex.EncodeToString(h.Sum(nil)),
+			Size:     size,
+		},
+		file: file,
+	}, nil
+}
+
+// Remove deletes the copy of the binary
+func (b *guestToolsBinary) Remove() error {
+	return os.Remove(b.file)
+}
@@ -0,0 +1,51 @@
+package qemuengine
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/metaservice"
+)
+
+// defaultHeartbeatTimeout is the time without heartbeats from qemu-guest-tools
+// after which the task fails, unless heartbeatTimeout is configured.
+const defaultHeartbeatTimeout = 5 * time.Minute
+
+// watchHeartbeat fails the task with reason 'guest-tools-lost', if
+// qemu-guest-tools stops sending heartbeats for longer than timeout. Guests
+// that never send a heartbeat, such as images with older guest-tools, are
+// not monitored.
+func (s *sandbox) watchHeartbeat(timeout time.Duration) {
+	ticker := time.NewTicker(metaservice.HeartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.vm.Done:
+			return
+		case <-s.resolve.Done():
+			return
+		case <-ticker.C:
+			last, ok := s.metaService.LastHeartbeat()
+			if !ok || time.Since(last) < timeout {
+				continue
+			}
+			s.guestToolsLost(time.Since(last))
+			return
+		}
+	}
+}
+
+// guestToolsLost resolves the sandbox as failed with reason
+// 'guest-tools-lost', when qemu-guest-tools stopped sending heartbeats.
+func (s *sandbox) guestToolsLost(since time.Duration) {
+	s.resolve.Do(func() {
+		s.context.LogError(fmt.Sprintf(
+			"Task failed with reason 'guest-tools-lost', no heartbeat from qemu-guest-tools for %s",
+			since.Round(time.Second),
+		))
+		s.finalize(false)
+		s.sessions.KillSessions()
+		s.metaService.KillProcess()
+	})
+}
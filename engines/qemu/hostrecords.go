@@ -0,0 +1,83 @@
+package qemuengine
+
+import (
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+	schematypes "github.com/taskcluster/go-schematypes"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/network"
+	"github.com/taskcluster/taskcluster-worker/runtime/util"
+)
+
+// maxHostRecords is the maximum number of host records in the engine config
+// or the task payload.
+const maxHostRecords = 64
+
+type hostRecord struct {
+	Name string `json:"name"`
+	IP   string `json:"ip"`
+}
+
+var hostRecordsSchema = schematypes.Array{
+	Title: "Host Records",
+	Description: util.Markdown(`
+		Names that should resolve to the given addresses in the virtual machine,
+		at most 64 records. This is useful for pointing the guest at mock
+		services or proxies without modifying the image.
+
+		Records are served by the DNS resolver for the network of the virtual
+		machine, in addition to 'hostRecords' from the 'network' option, so this
+		requires 'tap' networking. Records from the task payload replace records
+		for the same name from the engine config.
+	`),
+	Items: schematypes.Object{
+		Properties: schematypes.Properties{
+			"name": schematypes.String{
+				Title:       "Name",
+				Description: `Hostname, for example 'queue.taskcluster.net'.`,
+				Pattern:     `^[a-zA-Z0-9_]([a-zA-Z0-9_.-]{0,252})$`,
+			},
+			"ip": schematypes.String{
+				Title:       "IP",
+				Description: `IPv4 or IPv6 address the name should resolve to.`,
+				Pattern:     `^[0-9a-fA-F.:]+$`,
+			},
+		},
+		Required: []string{"name", "ip"},
+	},
+}
+
+// validateHostRecords returns an error if there are too many records, or a
+// record doesn't have a valid IP address.
+func validateHostRecords(records []hostRecord) error {
+	if len(records) > maxHostRecords {
+		return errors.Errorf("cannot have more than %d host records", maxHostRecords)
+	}
+	for _, r := range records {
+		if net.ParseIP(r.IP) == nil {
+			return errors.Errorf("host record for '%s' has invalid IP address: '%s'", r.Name, r.IP)
+		}
+	}
+	return nil
+}
+
+// mergeHostRecords returns records from the engine config followed by records
+// from the task payload, records for names in the task payload are omitted
+// from the engine config. Names are compared case-insensitively.
+func mergeHostRecords(config, payload []hostRecord) []network.HostRecord {
+	overridden := make(map[string]bool, len(payload))
+	for _, r := range payload {
+		overridden[strings.ToLower(r.Name)] = true
+	}
+	var records []network.HostRecord
+	for _, r := range config {
+		if !overridden[strings.ToLower(r.Name)] {
+			records = append(records, network.HostRecord{Name: r.Name, IP: r.IP})
+		}
+	}
+	for _, r := range payload {
+		records = append(records, network.HostRecord{Name: r.Name, IP: r.IP})
+	}
+	return records
+}
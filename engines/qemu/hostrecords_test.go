@@ -0,0 +1,37 @@
+package qemuengine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/network"
+)
+
+func TestValidateHostRecords(t *testing.T) {
+	require.NoError(t, validateHostRecords(nil))
+	require.NoError(t, validateHostRecords([]hostRecord{
+		{Name: "example.com", IP: "203.0.113.7"},
+		{Name: "example.com", IP: "2001:db8::7"},
+	}))
+	require.Error(t, validateHostRecords([]hostRecord{{Name: "example.com", IP: "203.0.113"}}))
+
+	records := make([]hostRecord, maxHostRecords+1)
+	for i := range records {
+		records[i] = hostRecord{Name: "example.com", IP: "203.0.113.7"}
+	}
+	require.Error(t, validateHostRecords(records))
+}
+
+func TestMergeHostRecords(t *testing.T) {
+	records := mergeHostRecords([]hostRecord{
+		{Name: "proxy", IP: "10.0.0.1"},
+		{Name: "Queue.example.com", IP: "10.0.0.2"},
+	}, []hostRecord{
+		{Name: "queue.example.com", IP: "127.0.0.1"},
+	})
+	require.Equal(t, []network.HostRecord{
+		{Name: "proxy", IP: "10.0.0.1"},
+		{Name: "queue.example.com", IP: "127.0.0.1"},
+	}, records)
+	require.Nil(t, mergeHostRecords(nil, nil))
+}
@@ -0,0 +1,165 @@
+package image
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
+)
+
+// ArchiveInfo holds information about an image archive, see InspectArchive().
+type ArchiveInfo struct {
+	Size    int64               `json:"size"`
+	SHA256  string              `json:"sha256"`
+	SHA512  string              `json:"sha512"`
+	Machine vm.Machine          `json:"machine"`
+	Files   map[string]DiskInfo `json:"files"`
+}
+
+// DiskInfo holds information about a disk file from an image archive.
+type DiskInfo struct {
+	SHA256        string `json:"sha256"`
+	Format        string `json:"format"`
+	VirtualSize   int64  `json:"virtualSize"`
+	ActualSize    int64  `json:"actualSize"`
+	BackingFile   string `json:"backingFile,omitempty"`
+	BackingFormat string `json:"backingFormat,omitempty"`
+	DirtyFlag     bool   `json:"dirtyFlag"`
+	Snapshots     int    `json:"snapshots"`
+}
+
+// ConvertFormats is the list of formats supported by ConvertImage().
+var ConvertFormats = []string{"qcow2", "raw", "vmdk", "vdi"}
+
+// ExtractArchive extracts the image archive imageFile to imageFolder and
+// validates the files extracted, in the same way images are validated before
+// use by the QEMU engine.
+//
+// Returns a MalformedPayloadError if the image isn't valid.
+func ExtractArchive(imageFile, imageFolder string) (*vm.Machine, error) {
+	return extractImage(imageFile, imageFolder)
+}
+
+// InspectArchive extracts and validates the image archive imageFile in
+// imageFolder, and returns information about the archive and the files it
+// contains.
+//
+// Returns a MalformedPayloadError if the image isn't valid.
+func InspectArchive(imageFile, imageFolder string) (*ArchiveInfo, error) {
+	machine, err := extractImage(imageFile, imageFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	stat, err := os.Stat(imageFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to stat image file")
+	}
+	hash, hash512, err := hashArchive(imageFile)
+	if err != nil {
+		return nil, err
+	}
+	info := &ArchiveInfo{
+		Size:    stat.Size(),
+		SHA256:  hash,
+		SHA512:  hash512,
+		Machine: *machine,
+		Files:   make(map[string]DiskInfo),
+	}
+
+	// extractImage have validated the formats, so we can inspect with those
+	for name, format := range map[string]imageFormat{
+		"disk.img":    imageRawFormat,
+		"layer.qcow2": imageQCOW2Format,
+	} {
+		file := filepath.Join(imageFolder, name)
+		i, err := inspectImageFile(file, format)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to inspect '%s'", name)
+		}
+		hash, err = hashFile(file)
+		if err != nil {
+			return nil, err
+		}
+		info.Files[name] = DiskInfo{
+			SHA256:        hash,
+			Format:        i.Format,
+			VirtualSize:   i.VirtualSize,
+			ActualSize:    i.ActualSize,
+			BackingFile:   i.BackingFile,
+			BackingFormat: i.BackingFormat,
+			DirtyFlag:     i.DirtyFlag,
+			Snapshots:     len(i.Snapshots),
+		}
+	}
+	return info, nil
+}
+
+// ConvertImage converts an image extracted to imageFolder with
+// ExtractArchive() to a single disk file in the given format, flattening
+// 'layer.qcow2' onto 'disk.img'. This is useful for booting or inspecting the
+// image with other tools.
+func ConvertImage(imageFolder, format, targetFile string) error {
+	supported := false
+	for _, f := range ConvertFormats {
+		supported = supported || f == format
+	}
+	if !supported {
+		return fmt.Errorf("unsupported image format: '%s'", format)
+	}
+	target, err := filepath.Abs(targetFile)
+	if err != nil {
+		return errors.Wrap(err, "failed to resolve target file")
+	}
+
+	convert := exec.Command(
+		"qemu-img", "convert", "-f", "qcow2", "-O", format,
+		"--", "layer.qcow2", target,
+	)
+	convert.Dir = imageFolder
+	if _, err = convert.Output(); err != nil {
+		msg := err.Error()
+		if ee, ok := err.(*exec.ExitError); ok {
+			msg = string(ee.Stderr)
+		}
+		return fmt.Errorf("Failed to convert image, error: %s", msg)
+	}
+	return nil
+}
+
+// hashFile returns the hex encoded sha256 hash of file
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to open '%s'", filepath.Base(file))
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", errors.Wrapf(err, "failed to read '%s'", filepath.Base(file))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashArchive returns the hex encoded sha256 and sha512 hashes of file, these
+// are the digests image references may be given with.
+func hashArchive(file string) (string, string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", "", errors.Wrapf(err, "failed to open '%s'", filepath.Base(file))
+	}
+	defer f.Close()
+	h256 := sha256.New()
+	h512 := sha512.New()
+	if _, err = io.Copy(io.MultiWriter(h256, h512), f); err != nil {
+		return "", "", errors.Wrapf(err, "failed to read '%s'", filepath.Base(file))
+	}
+	return hex.EncodeToString(h256.Sum(nil)), hex.EncodeToString(h512.Sum(nil)), nil
+}
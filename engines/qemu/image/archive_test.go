@@ -0,0 +1,34 @@
+// +build qemu
+
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestInspectAndConvertArchive(t *testing.T) {
+	folder, err := ioutil.TempDir("", "image-archive-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+
+	info, err := InspectArchive(testImageFile, folder)
+	require.NoError(t, err)
+	require.Len(t, info.SHA256, 64)
+	require.Len(t, info.SHA512, 128)
+	require.Equal(t, "raw", info.Files["disk.img"].Format)
+	require.Equal(t, "qcow2", info.Files["layer.qcow2"].Format)
+	require.Equal(t, "disk.img", info.Files["layer.qcow2"].BackingFile)
+
+	target := filepath.Join(folder, "flat.qcow2")
+	require.NoError(t, ConvertImage(folder, "qcow2", target))
+	flat, err := inspectImageFile(target, imageQCOW2Format)
+	require.NoError(t, err)
+	require.Equal(t, "", flat.BackingFile, "expected a flattened image")
+
+	require.Error(t, ConvertImage(folder, "iso", target))
+}
@@ -0,0 +1,85 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+// Compression specifies how image archives are compressed by Package().
+type Compression struct {
+	Level   int // zstd compression level from 1 to 22, 0 for DefaultCompression
+	Threads int // number of compression threads, 0 for one per CPU core
+}
+
+// DefaultCompression is used by Package()
+var DefaultCompression = Compression{Level: 3, Threads: 0}
+
+// Validate returns an error if the compression level or threads are invalid
+func (c Compression) Validate() error {
+	if c.Level < 0 || c.Level > 22 {
+		return fmt.Errorf("compression level must be between 1 and 22, got: %d", c.Level)
+	}
+	if c.Threads < 0 {
+		return fmt.Errorf("compression threads can't be negative, got: %d", c.Threads)
+	}
+	return nil
+}
+
+// zstdArgs returns the arguments for zstd to compress with c
+func (c Compression) zstdArgs() []string {
+	level := c.Level
+	if level == 0 {
+		level = DefaultCompression.Level
+	}
+	args := []string{"-" + strconv.Itoa(level), "-T" + strconv.Itoa(c.Threads)}
+	if level > 19 {
+		args = append(args, "--ultra")
+	}
+	return args
+}
+
+// Magic numbers for the compression formats supported by extractImage(),
+// images were lz4 or gzip compressed before zstd was used.
+var (
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	lz4Magic  = []byte{0x04, 0x22, 0x4d, 0x18}
+	gzipMagic = []byte{0x1f, 0x8b}
+)
+
+// decompressCommand returns a shell command that writes the decompressed
+// contents of imageFile to stdout, or a MalformedPayloadError if imageFile
+// isn't compressed with a supported format.
+//
+// zstd decompression is single threaded, but the command runs concurrently
+// with tar when extracting.
+func decompressCommand(imageFile string) (string, error) {
+	f, err := os.Open(imageFile)
+	if err != nil {
+		return "", fmt.Errorf("Failed to open image file, error: %s", err)
+	}
+	defer f.Close()
+
+	magic := make([]byte, 4)
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", runtime.NewMalformedPayloadError("Image file is too small to be an image archive")
+	}
+	magic = magic[:n]
+
+	switch {
+	case bytes.HasPrefix(magic, zstdMagic):
+		return "zstd -dqc '" + imageFile + "'", nil
+	case bytes.HasPrefix(magic, lz4Magic):
+		return "lz4 -dqc '" + imageFile + "'", nil
+	case bytes.HasPrefix(magic, gzipMagic):
+		return "gzip -dqc '" + imageFile + "'", nil
+	}
+	return "", runtime.NewMalformedPayloadError(
+		"Image file isn't a zstd, lz4 or gzip compressed tar archive",
+	)
+}
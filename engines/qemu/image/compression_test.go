@@ -0,0 +1,50 @@
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+func TestCompressionZstdArgs(t *testing.T) {
+	require.Equal(t, []string{"-3", "-T0"}, Compression{}.zstdArgs())
+	require.Equal(t, []string{"-19", "-T4"}, Compression{Level: 19, Threads: 4}.zstdArgs())
+	require.Equal(t, []string{"-22", "-T0", "--ultra"}, Compression{Level: 22}.zstdArgs())
+
+	require.NoError(t, DefaultCompression.Validate())
+	require.Error(t, Compression{Level: 23}.Validate())
+	require.Error(t, Compression{Threads: -1}.Validate())
+}
+
+func TestDecompressCommand(t *testing.T) {
+	folder, err := ioutil.TempDir("", "image-compression-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+
+	for _, c := range []struct {
+		data    []byte
+		command string
+	}{
+		{append(zstdMagic, 0), "zstd -dqc"},
+		{append(lz4Magic, 0), "lz4 -dqc"},
+		{append(gzipMagic, 0), "gzip -dqc"},
+		{[]byte("disk.img"), ""},
+		{nil, ""},
+	} {
+		file := filepath.Join(folder, "image.tar")
+		require.NoError(t, ioutil.WriteFile(file, c.data, 0600))
+		command, err := decompressCommand(file)
+		if c.command == "" {
+			_, ok := runtime.IsMalformedPayloadError(err)
+			require.True(t, ok, "expected MalformedPayloadError for %v, got: %v", c.data, err)
+			continue
+		}
+		require.NoError(t, err)
+		require.True(t, strings.HasPrefix(command, c.command), "unexpected command: %s", command)
+	}
+}
@@ -0,0 +1,224 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/ioext"
+)
+
+// foreignDiskFiles are the disk files an image archive may contain instead
+// of 'disk.img' and 'layer.qcow2', these are converted when extracted.
+var foreignDiskFiles = []string{"disk.vmdk", "disk.vhdx"}
+
+// convertibleFormats are the qemu-img formats ConvertDisk() accepts, 'vpc' is
+// the VHD format used by older versions of Hyper-V.
+var convertibleFormats = map[string]bool{
+	"raw":   true,
+	"qcow2": true,
+	"vmdk":  true,
+	"vhdx":  true,
+	"vpc":   true,
+}
+
+// vmdkCreateTypes are the VMDK variants with a single file, other variants
+// may reference arbitrary files as extents.
+var vmdkCreateTypes = map[string]bool{
+	"monolithicSparse": true,
+	"streamOptimized":  true,
+}
+
+// diskFormatInformation is the meta-data from qemu-img info, that matters
+// when checking a disk file before conversion.
+type diskFormatInformation struct {
+	Format         string `json:"format"`
+	VirtualSize    int64  `json:"virtual-size"`
+	BackingFile    string `json:"backing-filename"`
+	FormatSpecific struct {
+		Type string `json:"type"`
+		Data struct {
+			CreateType string `json:"create-type"`
+			Extents    []struct {
+				Filename string `json:"filename"`
+			} `json:"extents"`
+		} `json:"data"`
+	} `json:"format-specific"`
+}
+
+// probeDiskFile returns the format of diskFile, or a MalformedPayloadError if
+// diskFile can't be safely converted.
+func probeDiskFile(diskFile string) (string, error) {
+	p := exec.Command("qemu-img", "info", "--output", "json", "--", filepath.Base(diskFile))
+	p.Dir = filepath.Dir(diskFile)
+	data, err := p.Output()
+	if err != nil {
+		debug("qemu-img info failed, error: %s, output: %s", err, string(data))
+		return "", runtime.NewMalformedPayloadError(
+			"'", filepath.Base(diskFile), "' is not a disk file supported by qemu-img",
+		)
+	}
+	var info diskFormatInformation
+	if err = json.Unmarshal(data, &info); err != nil {
+		return "", fmt.Errorf("Failed to parse output from qemu-img info, error: %s", err)
+	}
+
+	if !convertibleFormats[info.Format] {
+		return "", runtime.NewMalformedPayloadError(
+			"'", filepath.Base(diskFile), "' has unsupported disk format: ", info.Format,
+		)
+	}
+	if info.BackingFile != "" {
+		return "", runtime.NewMalformedPayloadError(
+			"'", filepath.Base(diskFile), "' has a backing file, this is not permitted",
+		)
+	}
+	if info.VirtualSize > maxImageSize {
+		return "", runtime.NewMalformedPayloadError(
+			"'", filepath.Base(diskFile), "' has virtual size larger than ", maxImageSize, " bytes",
+		)
+	}
+	if info.Format == "vmdk" {
+		if !vmdkCreateTypes[info.FormatSpecific.Data.CreateType] {
+			return "", runtime.NewMalformedPayloadError(
+				"'", filepath.Base(diskFile), "' is a VMDK of type '",
+				info.FormatSpecific.Data.CreateType, "', only single file VMDKs are supported",
+			)
+		}
+		for _, extent := range info.FormatSpecific.Data.Extents {
+			if extent.Filename != filepath.Base(diskFile) {
+				return "", runtime.NewMalformedPayloadError(
+					"'", filepath.Base(diskFile), "' references other files as extents",
+				)
+			}
+		}
+	}
+	return info.Format, nil
+}
+
+// progressPattern matches progress reports from 'qemu-img convert -p'
+var progressPattern = regexp.MustCompile(`\((\d+(?:\.\d+)?)/100%\)`)
+
+// ConvertDisk converts diskFile to a sparse raw disk file at targetFile. The
+// diskFile may be in raw, qcow2, vmdk, vhdx or vpc (VHD) format, but can't
+// reference other files. Progress is reported as a float between 0 and 1,
+// if progress is non-nil.
+//
+// Returns a MalformedPayloadError, if diskFile isn't a supported disk file.
+func ConvertDisk(diskFile, targetFile string, progress func(float64)) error {
+	if !ioext.IsPlainFile(diskFile) {
+		return runtime.NewMalformedPayloadError("'", filepath.Base(diskFile), "' is not a plain file")
+	}
+	format, err := probeDiskFile(diskFile)
+	if err != nil {
+		return err
+	}
+
+	convert := exec.Command(
+		"qemu-img", "convert", "-p", "-f", format, "-O", "raw", "--", diskFile, targetFile,
+	)
+	var stderr bytes.Buffer
+	convert.Stderr = &stderr
+	stdout, err := convert.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("Failed to create pipe for qemu-img, error: %s", err)
+	}
+	if err = convert.Start(); err != nil {
+		return fmt.Errorf("Failed to start qemu-img convert, error: %s", err)
+	}
+
+	// Progress is written as '    (12.34/100%)\r'
+	scanner := bufio.NewScanner(stdout)
+	scanner.Split(scanProgress)
+	for scanner.Scan() {
+		m := progressPattern.FindStringSubmatch(scanner.Text())
+		if m == nil || progress == nil {
+			continue
+		}
+		if percent, perr := strconv.ParseFloat(m[1], 64); perr == nil {
+			progress(percent / 100)
+		}
+	}
+
+	if err = convert.Wait(); err != nil {
+		os.Remove(targetFile)
+		return runtime.NewMalformedPayloadError(
+			"Failed to convert '", filepath.Base(diskFile), "', error: ", strings.TrimSpace(stderr.String()),
+		)
+	}
+	return nil
+}
+
+// scanProgress is a bufio.SplitFunc that splits on '\r' and '\n'
+func scanProgress(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// diskExtensions are file extensions for disks extracted from OVA bundles
+var diskExtensions = map[string]bool{
+	".vmdk":  true,
+	".vhdx":  true,
+	".vhd":   true,
+	".qcow2": true,
+	".img":   true,
+}
+
+// ExtractOVA extracts the disk file from an OVA bundle to folder, and returns
+// the path of the extracted disk file. OVA bundles with more than one disk are
+// not supported.
+func ExtractOVA(ovaFile, folder string) (string, error) {
+	list := exec.Command("tar", "-tf", ovaFile)
+	data, err := list.Output()
+	if err != nil {
+		msg := err.Error()
+		if ee, ok := err.(*exec.ExitError); ok {
+			msg = string(ee.Stderr)
+		}
+		return "", runtime.NewMalformedPayloadError("Failed to read OVA bundle, error: ", msg)
+	}
+
+	var disks []string
+	for _, name := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if diskExtensions[strings.ToLower(filepath.Ext(name))] {
+			disks = append(disks, name)
+		}
+	}
+	if len(disks) != 1 {
+		return "", runtime.NewMalformedPayloadError(
+			"OVA bundle must contain exactly one disk file, found: ", len(disks),
+		)
+	}
+	// Don't extract files outside folder
+	disk := disks[0]
+	if disk != filepath.Base(disk) || strings.HasPrefix(disk, ".") {
+		return "", runtime.NewMalformedPayloadError("OVA bundle has disk file with invalid name: ", disk)
+	}
+
+	extract := exec.Command("tar", "-xoC", folder, "--no-same-permissions", "-f", ovaFile, "--", disk)
+	if _, err = extract.Output(); err != nil {
+		msg := err.Error()
+		if ee, ok := err.(*exec.ExitError); ok {
+			msg = string(ee.Stderr)
+		}
+		return "", runtime.NewMalformedPayloadError("Failed to extract disk from OVA bundle, error: ", msg)
+	}
+	diskFile := filepath.Join(folder, disk)
+	if !ioext.IsPlainFile(diskFile) {
+		return "", runtime.NewMalformedPayloadError("OVA bundle has disk '", disk, "' which is not a plain file")
+	}
+	return diskFile, nil
+}
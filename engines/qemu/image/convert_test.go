@@ -0,0 +1,69 @@
+package image
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+func TestScanProgress(t *testing.T) {
+	scanner := bufio.NewScanner(strings.NewReader("    (0.00/100%)\r    (51.20/100%)\r    (100.00/100%)\n"))
+	scanner.Split(scanProgress)
+	var progress []string
+	for scanner.Scan() {
+		if m := progressPattern.FindStringSubmatch(scanner.Text()); m != nil {
+			progress = append(progress, m[1])
+		}
+	}
+	require.NoError(t, scanner.Err())
+	require.Equal(t, []string{"0.00", "51.20", "100.00"}, progress)
+}
+
+func TestExtractOVA(t *testing.T) {
+	folder, err := ioutil.TempDir("", "image-ova-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+
+	// Create OVA bundles with tar
+	makeOVA := func(name string, files ...string) string {
+		src := filepath.Join(folder, "src-"+name)
+		require.NoError(t, os.Mkdir(src, 0700))
+		for _, f := range files {
+			require.NoError(t, ioutil.WriteFile(filepath.Join(src, f), []byte(f), 0600))
+		}
+		ova := filepath.Join(folder, name+".ova")
+		tar := exec.Command("tar", append([]string{"-cf", ova, "-C", src, "--"}, files...)...)
+		_, err := tar.Output()
+		require.NoError(t, err)
+		return ova
+	}
+
+	target := filepath.Join(folder, "target")
+	require.NoError(t, os.Mkdir(target, 0700))
+
+	disk, err := ExtractOVA(makeOVA("ok", "vm.ovf", "vm.mf", "vm-disk1.vmdk"), target)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(target, "vm-disk1.vmdk"), disk)
+	data, err := ioutil.ReadFile(disk)
+	require.NoError(t, err)
+	require.Equal(t, "vm-disk1.vmdk", string(data))
+
+	_, err = ExtractOVA(makeOVA("nodisk", "vm.ovf"), target)
+	_, ok := runtime.IsMalformedPayloadError(err)
+	require.True(t, ok, "expected MalformedPayloadError, got: %v", err)
+
+	_, err = ExtractOVA(makeOVA("twodisks", "vm.ovf", "a.vmdk", "b.vmdk"), target)
+	_, ok = runtime.IsMalformedPayloadError(err)
+	require.True(t, ok, "expected MalformedPayloadError, got: %v", err)
+
+	_, err = ExtractOVA(filepath.Join(folder, "missing.ova"), target)
+	_, ok = runtime.IsMalformedPayloadError(err)
+	require.True(t, ok, "expected MalformedPayloadError, got: %v", err)
+}
@@ -0,0 +1,65 @@
+// +build qemu
+
+package image
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+func TestConvertDisk(t *testing.T) {
+	folder, err := ioutil.TempDir("", "image-convert-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+
+	for _, format := range []string{"vmdk", "vhdx", "vpc"} {
+		t.Run(format, func(t *testing.T) {
+			disk := filepath.Join(folder, "disk."+format)
+			create := exec.Command("qemu-img", "create", "-f", format, disk, "64M")
+			_, err := create.Output()
+			require.NoError(t, err)
+
+			target := filepath.Join(folder, format+".img")
+			var progress []float64
+			err = ConvertDisk(disk, target, func(p float64) {
+				progress = append(progress, p)
+			})
+			require.NoError(t, err)
+			info, err := inspectImageFile(target, imageRawFormat)
+			require.NoError(t, err)
+			require.Equal(t, formatRaw, info.Format)
+			require.True(t, info.VirtualSize >= 64*1024*1024, "unexpected virtual size")
+			require.NotEmpty(t, progress)
+			require.Equal(t, float64(1), progress[len(progress)-1])
+		})
+	}
+
+	t.Run("backing file", func(t *testing.T) {
+		base := filepath.Join(folder, "base.qcow2")
+		_, err := exec.Command("qemu-img", "create", "-f", "qcow2", base, "64M").Output()
+		require.NoError(t, err)
+		layer := filepath.Join(folder, "layer.qcow2")
+		_, err = exec.Command("qemu-img", "create", "-f", "qcow2", "-o",
+			"backing_file=base.qcow2,backing_fmt=qcow2", layer).Output()
+		require.NoError(t, err)
+		err = ConvertDisk(layer, filepath.Join(folder, "layer.img"), nil)
+		_, ok := runtime.IsMalformedPayloadError(err)
+		require.True(t, ok, "expected MalformedPayloadError, got: %v", err)
+	})
+
+	t.Run("multi-file vmdk", func(t *testing.T) {
+		disk := filepath.Join(folder, "split.vmdk")
+		_, err := exec.Command("qemu-img", "create", "-f", "vmdk", "-o",
+			"subformat=twoGbMaxExtentFlat", disk, "64M").Output()
+		require.NoError(t, err)
+		err = ConvertDisk(disk, filepath.Join(folder, "split.img"), nil)
+		_, ok := runtime.IsMalformedPayloadError(err)
+		require.True(t, ok, "expected MalformedPayloadError, got: %v", err)
+	})
+}
@@ -0,0 +1,142 @@
+package image
+
+import (
+	"crypto/sha256"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// dedupeChunkSize is the size of chunks deduplicated between disk files, this
+// must be a multiple of the file system block size.
+const dedupeChunkSize = 1024 * 1024
+
+type chunkDigest [sha256.Size]byte
+
+// dedupeIndex tracks chunks of the disk files for loaded images, such that
+// identical chunks in disk files for other images can share data blocks.
+// Nightly images often differ in a small fraction of their chunks, so this
+// avoids storing a full copy of each disk.
+type dedupeIndex struct {
+	m        sync.Mutex
+	files    map[string]map[chunkDigest]int64 // file to offset of chunks
+	disabled bool                             // set, if not supported
+}
+
+func newDedupeIndex() *dedupeIndex {
+	return &dedupeIndex{
+		files: make(map[string]map[chunkDigest]int64),
+	}
+}
+
+// add deduplicates chunks of file against chunks of files already added, and
+// adds file to the index. Returns the number of bytes now shared with other
+// files.
+//
+// If the file system doesn't support deduplication file is not added, and
+// later calls do nothing. Other errors deduplicating a chunk stops
+// deduplication of file, but file is still added and the error returned.
+func (d *dedupeIndex) add(file string) (int64, error) {
+	d.m.Lock()
+	if d.disabled {
+		d.m.Unlock()
+		return 0, nil
+	}
+	// Copy the index, so we don't hold the lock while reading file, the chunk
+	// maps are never modified once added.
+	others := make(map[string]map[chunkDigest]int64, len(d.files))
+	for f, chunks := range d.files {
+		others[f] = chunks
+	}
+	d.m.Unlock()
+
+	target, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to open file for deduplication")
+	}
+	defer target.Close()
+
+	// Open files shared with, files removed from the index remains readable
+	// while open, so we can still share their chunks.
+	sources := make(map[string]*os.File)
+	defer func() {
+		for _, f := range sources {
+			f.Close()
+		}
+	}()
+
+	var shared int64
+	var dedupeErr error // first error deduplicating a chunk of file
+	chunks := make(map[chunkDigest]int64)
+	buf := make([]byte, dedupeChunkSize)
+	for offset := int64(0); ; offset += dedupeChunkSize {
+		// Partial chunks at the end of file are not deduplicated
+		_, err = io.ReadFull(target, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return shared, errors.Wrap(err, "failed to read file for deduplication")
+		}
+		if isZero(buf) {
+			continue // holes are already free
+		}
+		digest := chunkDigest(sha256.Sum256(buf))
+		if _, ok := chunks[digest]; !ok {
+			chunks[digest] = offset
+		}
+		if dedupeErr != nil {
+			continue // keep indexing chunks, so other files can share them
+		}
+
+		for f, c := range others {
+			sourceOffset, ok := c[digest]
+			if !ok {
+				continue
+			}
+			source := sources[f]
+			if source == nil {
+				if source, err = os.Open(f); err != nil {
+					delete(others, f) // removed before we opened it
+					continue
+				}
+				sources[f] = source
+			}
+			var same bool
+			same, err = dedupeRange(target, offset, source, sourceOffset, dedupeChunkSize)
+			if err != nil && isDedupeNotSupported(err) {
+				debug("deduplication not supported, error: %s", err)
+				d.m.Lock()
+				d.disabled = true
+				d.files = nil
+				d.m.Unlock()
+				return shared, nil
+			}
+			if err != nil {
+				dedupeErr = errors.Wrapf(err, "failed to deduplicate chunk at offset %d", offset)
+				break
+			}
+			if same {
+				shared += dedupeChunkSize
+				break
+			}
+		}
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+	if !d.disabled {
+		d.files[file] = chunks
+	}
+	return shared, dedupeErr
+}
+
+// remove removes file from the index, this must be called before file is
+// deleted.
+func (d *dedupeIndex) remove(file string) {
+	d.m.Lock()
+	defer d.m.Unlock()
+	delete(d.files, file)
+}
@@ -4,8 +4,10 @@ import (
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
+	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 
 	"github.com/pkg/errors"
 	schematypes "github.com/taskcluster/go-schematypes"
@@ -22,6 +24,12 @@ const (
 
 const maxImageSize = int64(50 * 1024 * 1024 * 1024) // Use int64 for i386 builds
 
+// nvramFile is the name of the optional UEFI variables file in image archives
+const nvramFile = "uefi-vars.fd"
+
+// maxNVRAMSize is the maximum size of the UEFI variables file
+const maxNVRAMSize = int64(64 * 1024 * 1024)
+
 // RandomMAC generates a new random MAC with the local bit set.
 func RandomMAC() string {
 	// Credits: http://stackoverflow.com/a/21027407/68333
@@ -36,8 +44,14 @@ func RandomMAC() string {
 }
 
 // extractImage will extract the "disk.img", "layer.qcow2" and "machine.json"
-// files from a tar archive using GNU tar ensuring that sparse entries will be
-// extracted as sparse files.
+// files, and the optional "uefi-vars.fd" file from a tar archive using GNU tar
+// ensuring that sparse entries will be extracted as sparse files. If the
+// archive wasn't created with sparse entries, blocks of zeros in "disk.img"
+// are deallocated after extraction.
+//
+// Instead of "disk.img" and "layer.qcow2" the archive may contain a
+// "disk.vmdk" or "disk.vhdx" file, which is converted to "disk.img" and an
+// empty "layer.qcow2" is created.
 //
 // This also validates that files aren't symlinks and are in correct format,
 // with legal backing_file parameters.
@@ -53,12 +67,25 @@ func extractImage(imageFile, imageFolder string) (*vm.Machine, error) {
 		return nil, runtime.NewMalformedPayloadError("Image file is larger than ", maxImageSize, " bytes")
 	}
 
+	// Detect compression, so older lz4 and gzip compressed images still work
+	decompress, err := decompressCommand(imageFile)
+	if err != nil {
+		return nil, err
+	}
+
 	// Using zstd | tar so we get sparse files (sh to get OS pipes)
-	tar := exec.Command("sh", "-fec", "zstd -dqc '"+imageFile+"' | "+
+	tar := exec.Command("sh", "-fec", decompress+" | "+
 		"tar -xoC '"+imageFolder+"' --no-same-permissions -- "+
-		"disk.img layer.qcow2 machine.json",
+		"disk.img layer.qcow2 machine.json "+nvramFile+" "+strings.Join(foreignDiskFiles, " "),
 	)
-	_, err := tar.Output()
+	_, err = tar.Output()
+	missing := make(map[string]bool)
+	if ee, ok := err.(*exec.ExitError); ok {
+		if m, ok := missingArchiveFiles(string(ee.Stderr)); ok {
+			missing = m
+			err = nil
+		}
+	}
 	if err != nil {
 		if ee, ok := err.(*exec.ExitError); ok {
 			return nil, runtime.NewMalformedPayloadError(
@@ -70,6 +97,33 @@ func extractImage(imageFile, imageFolder string) (*vm.Machine, error) {
 		return nil, fmt.Errorf("Failed to extract image archive, error: %s", err)
 	}
 
+	// Convert disk in another format, if given instead of disk.img
+	for _, name := range foreignDiskFiles {
+		if missing[name] {
+			continue
+		}
+		if !missing["disk.img"] || !missing["layer.qcow2"] {
+			return nil, runtime.NewMalformedPayloadError("Image file contains '", name,
+				"' which is only allowed instead of 'disk.img' and 'layer.qcow2'")
+		}
+		debug("converting '%s' to 'disk.img'", name)
+		diskFile := filepath.Join(imageFolder, name)
+		err = ConvertDisk(diskFile, filepath.Join(imageFolder, "disk.img"), func(progress float64) {
+			debug("converting '%s' - %.0f %%", name, progress*100)
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err = os.Remove(diskFile); err != nil {
+			return nil, errors.Wrapf(err, "failed to remove '%s' after conversion", name)
+		}
+		if err = createLayer(imageFolder); err != nil {
+			return nil, err
+		}
+		missing["disk.img"] = false
+		missing["layer.qcow2"] = false
+	}
+
 	// Check files exist, are plain files and not larger than maxImageSize
 	for _, name := range []string{"disk.img", "layer.qcow2", "machine.json"} {
 		f := filepath.Join(imageFolder, name)
@@ -82,6 +136,23 @@ func extractImage(imageFile, imageFolder string) (*vm.Machine, error) {
 		}
 	}
 
+	// Make sure disk.img is sparse, as archives may be created without tar -S
+	if err = digHoles(filepath.Join(imageFolder, "disk.img")); err != nil {
+		debug("failed to make disk.img sparse, error: %s", err)
+	}
+
+	// Check the optional UEFI variables file, if present
+	if f := filepath.Join(imageFolder, nvramFile); fileExists(f) {
+		if !ioext.IsPlainFile(f) {
+			return nil, runtime.NewMalformedPayloadError("Image file contains '",
+				nvramFile, "' which is not a plain file")
+		}
+		if !ioext.IsFileLessThan(f, maxNVRAMSize) {
+			return nil, runtime.NewMalformedPayloadError("Image file contains '",
+				nvramFile, "' larger than ", maxNVRAMSize, " bytes")
+		}
+	}
+
 	// Load the machine configuration
 	machineFile := filepath.Join(imageFolder, "machine.json")
 	machine, err := newMachineFromFile(machineFile)
@@ -89,48 +160,29 @@ func extractImage(imageFile, imageFolder string) (*vm.Machine, error) {
 		return nil, err
 	}
 
-	// Inspect the raw disk file
-	diskFile := filepath.Join(imageFolder, "disk.img")
-	diskInfo := inspectImageFile(diskFile, imageRawFormat)
-	if diskInfo == nil || diskInfo.Format != formatRaw {
-		return nil, runtime.NewMalformedPayloadError("Image file contains ",
-			"'disk.img' which is not a RAW image file")
-	}
-	if diskInfo.VirtualSize > maxImageSize {
-		return nil, runtime.NewMalformedPayloadError("Image file contains ",
-			"'disk.img' has virtual size larger than ", maxImageSize, " bytes")
-	}
-	if diskInfo.DirtyFlag {
-		return nil, runtime.NewMalformedPayloadError("Image file contains ",
-			"'disk.img' which has the dirty-flag set")
+	// Inspect and validate the raw disk file
+	diskInfo, err := inspectImageFile(filepath.Join(imageFolder, "disk.img"), imageRawFormat)
+	if err != nil {
+		return nil, inspectionError(err)
 	}
-	if diskInfo.BackingFile != "" {
-		return nil, runtime.NewMalformedPayloadError("Image file contains ",
-			"'disk.img' which has a backing file, this is not permitted")
+	if err = validateImageFile("disk.img", diskInfo, imageFileRules{
+		Format: formatRaw,
+	}); err != nil {
+		return nil, err
 	}
 
-	// Inspect the QCOW2 layer file
-	layerFile := filepath.Join(imageFolder, "layer.qcow2")
-	layerInfo := inspectImageFile(layerFile, imageQCOW2Format)
-	if layerInfo == nil || layerInfo.Format != formatQCOW2 {
-		return nil, runtime.NewMalformedPayloadError("Image file contains ",
-			"'layer.qcow2' which is not a QCOW2 file")
-	}
-	if layerInfo.VirtualSize > maxImageSize {
-		return nil, runtime.NewMalformedPayloadError("Image file contains ",
-			"'layer.qcow2' has virtual size larger than ", maxImageSize, " bytes")
-	}
-	if layerInfo.DirtyFlag {
-		return nil, runtime.NewMalformedPayloadError("Image file contains ",
-			"'layer.qcow2' which has the dirty-flag set")
-	}
-	if layerInfo.BackingFile != "disk.img" {
-		return nil, runtime.NewMalformedPayloadError("Image file contains ",
-			"'layer.qcow2' which has a backing file that isn't: 'disk.img'")
+	// Inspect and validate the QCOW2 layer file
+	layerInfo, err := inspectImageFile(filepath.Join(imageFolder, "layer.qcow2"), imageQCOW2Format)
+	if err != nil {
+		return nil, inspectionError(err)
 	}
-	if layerInfo.BackingFormat != formatRaw {
-		return nil, runtime.NewMalformedPayloadError("Image file contains ",
-			"'layer.qcow2' which has a backing file format that isn't 'raw'")
+	if err = validateImageFile("layer.qcow2", layerInfo, imageFileRules{
+		Format:        formatQCOW2,
+		BackingFile:   "disk.img",
+		BackingFormat: formatRaw,
+		Snapshot:      machine.Snapshot(),
+	}); err != nil {
+		return nil, err
 	}
 
 	return machine, nil
@@ -156,7 +208,8 @@ func newMachineFromFile(machineFile string) (*vm.Machine, error) {
 	}
 
 	// Migrate if possible
-	if migrated := vm.MigrateMachineDefinition(data); migrated != nil {
+	migrated := vm.MigrateMachineDefinition(data)
+	if migrated != nil {
 		// If this fails we want to show schema error against
 		// most recent schema.
 		data = migrated
@@ -176,9 +229,49 @@ func newMachineFromFile(machineFile string) (*vm.Machine, error) {
 	} else if verr != nil {
 		return nil, runtime.NewMalformedPayloadError("task.payload schema violation: ", verr)
 	}
+	if migrated == nil {
+		return nil, runtime.NewMalformedPayloadError(
+			"Invalid machine definition in 'machine.json', options 'display' and ",
+			"'devices' require 'version: 2'",
+		)
+	}
 
 	// Create machine
 	m := vm.NewMachine(data)
 
 	return &m, nil
 }
+
+// inspectionError returns a MalformedPayloadError, if err is an inspectError,
+// as qemu-img failing to read a file means the image is malformed.
+func inspectionError(err error) error {
+	if ie, ok := err.(*inspectError); ok {
+		return runtime.NewMalformedPayloadError("Image file is malformed, ", ie.Error())
+	}
+	return err
+}
+
+// missingArchiveFiles returns the files GNU tar reports as not found in the
+// archive, returns false if stderr reports any other errors.
+func missingArchiveFiles(stderr string) (map[string]bool, bool) {
+	missing := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(stderr), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "tar: Exiting with failure status due to previous errors" {
+			continue
+		}
+		if !strings.HasPrefix(line, "tar: ") || !strings.HasSuffix(line, ": Not found in archive") {
+			return nil, false
+		}
+		name := strings.TrimSuffix(strings.TrimPrefix(line, "tar: "), ": Not found in archive")
+		missing[name] = true
+	}
+	return missing, true
+}
+
+// fileExists returns true, if something exists at the given path, this does
+// not follow symbolic links.
+func fileExists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
@@ -0,0 +1,32 @@
+package image
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMissingArchiveFiles(t *testing.T) {
+	missing, ok := missingArchiveFiles(
+		"tar: uefi-vars.fd: Not found in archive\n" +
+			"tar: Exiting with failure status due to previous errors\n",
+	)
+	require.True(t, ok)
+	require.Equal(t, map[string]bool{"uefi-vars.fd": true}, missing)
+
+	missing, ok = missingArchiveFiles(
+		"tar: disk.img: Not found in archive\n" +
+			"tar: uefi-vars.fd: Not found in archive\n" +
+			"tar: Exiting with failure status due to previous errors\n",
+	)
+	require.True(t, ok)
+	require.Equal(t, map[string]bool{"disk.img": true, "uefi-vars.fd": true}, missing)
+
+	_, ok = missingArchiveFiles("zstd: image.tar.zst: unsupported format\n")
+	require.False(t, ok)
+	_, ok = missingArchiveFiles(
+		"tar: disk.img: Cannot open: Permission denied\n" +
+			"tar: Exiting with failure status due to previous errors\n",
+	)
+	require.False(t, ok)
+}
@@ -2,8 +2,13 @@ package image
 
 import (
 	"encoding/json"
+	"fmt"
 	"os/exec"
 	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/runtime"
 )
 
 type imageFormat int
@@ -33,8 +38,22 @@ type information struct {
 	Snapshots     []snapshot `json:"snapshots"`
 }
 
-// inspectImageFile reads image meta-data for an image file of type
-func inspectImageFile(imageFile string, format imageFormat) *information {
+// An inspectError is returned from inspectImageFile, if qemu-img can't read
+// the image file, in which case the image file is probably malformed.
+type inspectError struct {
+	File   string // name of the image file
+	Format string // format the image file was inspected as
+	Output string // stderr from qemu-img
+}
+
+func (e *inspectError) Error() string {
+	return fmt.Sprintf("qemu-img can't read '%s' as %s, error: %s",
+		e.File, e.Format, strings.TrimSpace(e.Output))
+}
+
+// inspectImageFile reads image meta-data for an image file of type, returns
+// an *inspectError if qemu-img fails to read the image file.
+func inspectImageFile(imageFile string, format imageFormat) (*information, error) {
 	f := "raw"
 	if format == imageQCOW2Format {
 		f = "qcow2"
@@ -42,15 +61,93 @@ func inspectImageFile(imageFile string, format imageFormat) *information {
 	p := exec.Command("qemu-img", "info", "-f", f, "--output", "json", "--", filepath.Base(imageFile))
 	p.Dir = filepath.Dir(imageFile)
 	data, err := p.Output()
+	if ee, ok := err.(*exec.ExitError); ok {
+		return nil, &inspectError{
+			File:   filepath.Base(imageFile),
+			Format: f,
+			Output: string(ee.Stderr),
+		}
+	}
 	if err != nil {
-		debug("qemu-img failed, error: %s, output: %s", err, string(data))
-		return nil
+		return nil, errors.Wrap(err, "failed to run qemu-img info")
 	}
 	info := &information{}
 	err = json.Unmarshal(data, info)
 	if err != nil {
 		debug("inspectImageFile unmarshal json failed, error: %s, data: %s", err, string(data))
-		return nil
+		return nil, errors.Wrap(err, "failed to parse output from qemu-img info")
+	}
+	return info, nil
+}
+
+// imageFileRules are the requirements for a file in an image archive
+type imageFileRules struct {
+	Format        string // required format
+	BackingFile   string // required backing file, empty for none
+	BackingFormat string // required format of the backing file
+	Snapshot      string // snapshot allowed, empty for none
+}
+
+// validateImageFile checks that info for the file name from an image archive
+// satisfies rules, returning a MalformedPayloadError explaining how to fix the
+// image, if not.
+func validateImageFile(name string, info *information, rules imageFileRules) error {
+	if info.Format != rules.Format {
+		return runtime.NewMalformedPayloadError(fmt.Sprintf(
+			"Image file contains '%s' in %s format, it must be a %s file",
+			name, info.Format, rules.Format,
+		))
+	}
+	if info.VirtualSize > maxImageSize {
+		return runtime.NewMalformedPayloadError(fmt.Sprintf(
+			"Image file contains '%s' with virtual size %d bytes, the limit is %d bytes",
+			name, info.VirtualSize, maxImageSize,
+		))
+	}
+	if info.DirtyFlag {
+		return runtime.NewMalformedPayloadError(fmt.Sprintf(
+			"Image file contains '%s' which has the dirty-flag set, as it wasn't "+
+				"closed cleanly, repair it with 'qemu-img check -r all %s' and "+
+				"package the image again", name, name,
+		))
+	}
+	if info.BackingFile != rules.BackingFile {
+		if rules.BackingFile == "" {
+			return runtime.NewMalformedPayloadError(fmt.Sprintf(
+				"Image file contains '%s' which has backing file '%s', this is not "+
+					"permitted", name, info.BackingFile,
+			))
+		}
+		return runtime.NewMalformedPayloadError(fmt.Sprintf(
+			"Image file contains '%s' which has backing file '%s', the backing "+
+				"file must be '%s'", name, info.BackingFile, rules.BackingFile,
+		))
+	}
+	if rules.BackingFile != "" && info.BackingFormat != rules.BackingFormat {
+		return runtime.NewMalformedPayloadError(fmt.Sprintf(
+			"Image file contains '%s' which has backing file format '%s', the "+
+				"backing file format must be '%s', set it with 'qemu-img rebase -u "+
+				"-F %s -b %s %s'", name, info.BackingFormat, rules.BackingFormat,
+			rules.BackingFormat, rules.BackingFile, name,
+		))
+	}
+	found := false
+	for _, s := range info.Snapshots {
+		if s.Name == rules.Snapshot {
+			found = true
+			continue
+		}
+		return runtime.NewMalformedPayloadError(fmt.Sprintf(
+			"Image file contains '%s' which has snapshot '%s' that isn't the "+
+				"snapshot in 'machine.json', remove it with 'qemu-img snapshot -d %s %s'",
+			name, s.Name, s.Name, name,
+		))
+	}
+	if rules.Snapshot != "" && !found {
+		return runtime.NewMalformedPayloadError(fmt.Sprintf(
+			"Image file contains 'machine.json' with snapshot '%s', which isn't "+
+				"in '%s'", rules.Snapshot, name,
+		))
 	}
-	return info
+	return nil
 }
@@ -0,0 +1,89 @@
+package image
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+func TestValidateImageFile(t *testing.T) {
+	layerRules := imageFileRules{
+		Format:        formatQCOW2,
+		BackingFile:   "disk.img",
+		BackingFormat: formatRaw,
+		Snapshot:      "booted",
+	}
+	layer := func() *information {
+		return &information{
+			Format:        formatQCOW2,
+			VirtualSize:   1024 * 1024,
+			BackingFile:   "disk.img",
+			BackingFormat: formatRaw,
+			Snapshots:     []snapshot{{Name: "booted", ID: "1"}},
+		}
+	}
+	requireMalformed := func(err error, contains string) {
+		require.Error(t, err)
+		_, ok := runtime.IsMalformedPayloadError(err)
+		require.True(t, ok, "expected MalformedPayloadError, got: %s", err)
+		require.Contains(t, err.Error(), contains)
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		require.NoError(t, validateImageFile("layer.qcow2", layer(), layerRules))
+		require.NoError(t, validateImageFile("disk.img", &information{
+			Format: formatRaw,
+		}, imageFileRules{Format: formatRaw}))
+	})
+
+	t.Run("wrong format", func(t *testing.T) {
+		info := layer()
+		info.Format = formatRaw
+		requireMalformed(validateImageFile("layer.qcow2", info, layerRules), "must be a qcow2 file")
+	})
+
+	t.Run("virtual size", func(t *testing.T) {
+		info := layer()
+		info.VirtualSize = maxImageSize + 1
+		requireMalformed(validateImageFile("layer.qcow2", info, layerRules), "virtual size")
+	})
+
+	t.Run("dirty", func(t *testing.T) {
+		info := layer()
+		info.DirtyFlag = true
+		requireMalformed(validateImageFile("layer.qcow2", info, layerRules), "qemu-img check -r all layer.qcow2")
+	})
+
+	t.Run("backing file", func(t *testing.T) {
+		requireMalformed(validateImageFile("disk.img", &information{
+			Format:      formatRaw,
+			BackingFile: "/etc/passwd",
+		}, imageFileRules{Format: formatRaw}), "not permitted")
+
+		info := layer()
+		info.BackingFile = "other.img"
+		requireMalformed(validateImageFile("layer.qcow2", info, layerRules), "must be 'disk.img'")
+
+		info = layer()
+		info.BackingFormat = ""
+		requireMalformed(validateImageFile("layer.qcow2", info, layerRules), "qemu-img rebase")
+	})
+
+	t.Run("unknown snapshot", func(t *testing.T) {
+		info := layer()
+		info.Snapshots = append(info.Snapshots, snapshot{Name: "other", ID: "2"})
+		requireMalformed(validateImageFile("layer.qcow2", info, layerRules), "qemu-img snapshot -d other")
+
+		info = layer()
+		rules := layerRules
+		rules.Snapshot = ""
+		requireMalformed(validateImageFile("layer.qcow2", info, rules), "snapshot 'booted'")
+	})
+
+	t.Run("missing snapshot", func(t *testing.T) {
+		info := layer()
+		info.Snapshots = nil
+		requireMalformed(validateImageFile("layer.qcow2", info, layerRules), "isn't in 'layer.qcow2'")
+	})
+}
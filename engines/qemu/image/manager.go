@@ -3,6 +3,7 @@ package image
 import (
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"sync"
 
@@ -15,11 +16,13 @@ import (
 
 // Manager loads and tracks images.
 type Manager struct {
-	m           sync.Mutex
-	images      map[string]*image
-	imageFolder string
-	gc          gc.ResourceTracker
-	monitor     runtime.Monitor
+	m            sync.Mutex
+	images       map[string]*image
+	imageFolder  string
+	gc           gc.ResourceTracker
+	monitor      runtime.Monitor
+	keepArchives bool
+	dedupe       *dedupeIndex // nil, unless DeduplicateDisks() was called
 }
 
 // Downloader is a function capable of downloading an image to an *os.File.
@@ -32,6 +35,7 @@ type image struct {
 	gc.DisposableResource
 	imageID string
 	folder  string
+	archive string // image file, if kept for sharing
 	machine *vm.Machine
 	done    <-chan struct{}
 	manager *Manager
@@ -40,9 +44,10 @@ type image struct {
 
 // Instance represents an instance of an image.
 type Instance struct {
-	m        sync.Mutex
-	image    *image
-	diskFile string
+	m         sync.Mutex
+	image     *image
+	diskFile  string
+	nvramFile string
 }
 
 // NewManager creates a new image manager using the imageFolder for storing
@@ -106,9 +111,71 @@ func (m *Manager) Instance(imageID string, download Downloader) (*Instance, erro
 	return img.instance()
 }
 
+// KeepArchives makes the manager keep the downloaded image file for each
+// image, until the image is garbage collected, so that it can be shared with
+// other workers using Archive(). This must be called before Instance().
+func (m *Manager) KeepArchives() {
+	m.m.Lock()
+	defer m.m.Unlock()
+	m.keepArchives = true
+}
+
+// DeduplicateDisks makes the manager share identical chunks between the disk
+// files of loaded images, if the file system supports it (btrfs or xfs with
+// reflink=1). This makes it cheap to cache many versions of an image, at the
+// cost of reading each disk file once more when loaded. This must be called
+// before Instance().
+func (m *Manager) DeduplicateDisks() {
+	m.m.Lock()
+	defer m.m.Unlock()
+	if m.dedupe == nil {
+		m.dedupe = newDedupeIndex()
+	}
+}
+
+// ArchiveIDs returns the imageIDs of images for which the downloaded image
+// file is kept, see KeepArchives().
+func (m *Manager) ArchiveIDs() []string {
+	m.m.Lock()
+	defer m.m.Unlock()
+	var ids []string
+	for id, img := range m.images {
+		select {
+		case <-img.done:
+			if img.err == nil && img.archive != "" {
+				ids = append(ids, id)
+			}
+		default:
+		}
+	}
+	return ids
+}
+
+// Archive opens the downloaded image file for imageID, returns nil if the
+// image file isn't kept. The caller must close the file, it remains readable
+// even if the image is garbage collected.
+func (m *Manager) Archive(imageID string) (*os.File, error) {
+	m.m.Lock()
+	defer m.m.Unlock()
+	img := m.images[imageID]
+	if img == nil {
+		return nil, nil
+	}
+	select {
+	case <-img.done:
+	default:
+		return nil, nil
+	}
+	if img.err != nil || img.archive == "" {
+		return nil, nil
+	}
+	return os.Open(img.archive)
+}
+
 func (img *image) loadImage(download Downloader, done chan<- struct{}) {
 	imageFilePath := filepath.Join(img.manager.imageFolder, slugid.Nice()+".tar.zst")
 	var imageFile *os.File
+	var dedupe *dedupeIndex
 
 	// Create image folder
 	err := os.Mkdir(img.folder, 0777)
@@ -144,6 +211,18 @@ func (img *image) loadImage(download Downloader, done chan<- struct{}) {
 		goto cleanup
 	}
 
+	// Share chunks of disk.img with other images, if enabled
+	img.manager.m.Lock()
+	dedupe = img.manager.dedupe
+	img.manager.m.Unlock()
+	if dedupe != nil {
+		shared, derr := dedupe.add(filepath.Join(img.folder, "disk.img"))
+		if derr != nil {
+			img.manager.monitor.ReportWarning(derr, "Failed to deduplicate disk.img")
+		}
+		debug("deduplicated %d bytes of disk.img for %s", shared, img.imageID)
+	}
+
 	// Clean up if there is any error
 cleanup:
 	// Close image file, if still open
@@ -151,10 +230,18 @@ cleanup:
 		imageFile.Close()
 	}
 
-	// Delete the image file
-	e := os.RemoveAll(imageFilePath)
-	if e != nil {
-		img.manager.monitor.ReportWarning(e, "Failed to delete image file")
+	// Keep the image file for sharing, if requested and loaded successfully
+	img.manager.m.Lock()
+	keep := img.manager.keepArchives && err == nil
+	img.manager.m.Unlock()
+	if keep {
+		img.archive = imageFilePath
+	} else {
+		// Delete the image file
+		e := os.RemoveAll(imageFilePath)
+		if e != nil {
+			img.manager.monitor.ReportWarning(e, "Failed to delete image file")
+		}
 	}
 
 	// If there was an err, set img.err and remove it from cache
@@ -193,14 +280,50 @@ func (img *image) Dispose() error {
 	// Remove image entry
 	delete(img.manager.images, img.imageID)
 
+	// Stop sharing chunks with disk.img, before it's deleted
+	if img.manager.dedupe != nil {
+		img.manager.dedupe.remove(filepath.Join(img.folder, "disk.img"))
+	}
+
 	// Delete the image folder
 	if err := os.RemoveAll(img.folder); err != nil {
 		return fmt.Errorf("Failed to delete image folder '%s', error: %s", img.folder, err)
 	}
 
+	// Delete the image file, if kept
+	if img.archive != "" {
+		if err := os.Remove(img.archive); err != nil {
+			return fmt.Errorf("Failed to delete image file '%s', error: %s", img.archive, err)
+		}
+	}
+
 	return nil
 }
 
+// DiskSize returns the disk space used by the image folder, this includes
+// instances of the image currently in use.
+func (img *image) DiskSize() (uint64, error) {
+	size, err := gc.DiskUsage(img.folder)
+	if err != nil || img.archive == "" {
+		return size, err
+	}
+	info, err := os.Stat(img.archive)
+	if err != nil {
+		return 0, err
+	}
+	return size + uint64(info.Size()), nil
+}
+
+// Describe returns a description of the image for reporting.
+func (img *image) Describe() string {
+	return "qemu image: " + img.imageID
+}
+
+// Priority returns gc.PriorityHigh as images are expensive to download.
+func (img *image) Priority() gc.Priority {
+	return gc.PriorityHigh
+}
+
 // instance returns a new instance of the image for use in a virtual machine.
 // You must have called image.Acquire() first to prevent garbage collection.
 func (img *image) instance() (*Instance, error) {
@@ -211,9 +334,20 @@ func (img *image) instance() (*Instance, error) {
 		return nil, fmt.Errorf("Failed to make copy of layer.qcow2, error: %s", err)
 	}
 
+	// Create a copy of uefi-vars.fd, if present
+	nvram := filepath.Join(img.folder, slugid.Nice()+".fd")
+	if fileExists(filepath.Join(img.folder, nvramFile)) {
+		err = copyFile(filepath.Join(img.folder, nvramFile), nvram)
+		if err != nil {
+			os.Remove(diskFile)
+			return nil, fmt.Errorf("Failed to make copy of %s, error: %s", nvramFile, err)
+		}
+	}
+
 	return &Instance{
-		image:    img,
-		diskFile: diskFile,
+		image:     img,
+		diskFile:  diskFile,
+		nvramFile: nvram,
 	}, nil
 }
 
@@ -237,11 +371,65 @@ func (i *Instance) DiskFile() string {
 	return i.diskFile
 }
 
+// NVRAMFile returns the UEFI variables file for this image instance, this is
+// a copy of 'uefi-vars.fd' from the image, if present.
+func (i *Instance) NVRAMFile() string {
+	i.m.Lock()
+	defer i.m.Unlock()
+	if i.image == nil {
+		panic("Instance of image is already disposed")
+	}
+	return i.nvramFile
+}
+
 // Format returns the image format: 'qcow2'
 func (i *Instance) Format() string {
 	return formatQCOW2
 }
 
+// Package flattens the disk of this instance into a new image, and writes it
+// as a zstd compressed tar archive to targetFile, with the machine definition
+// given. This cannot be called while the instance is used by a virtual machine.
+func (i *Instance) Package(targetFile string, machine vm.Machine) error {
+	i.m.Lock()
+	defer i.m.Unlock()
+	if i.image == nil {
+		panic("Instance of image is already disposed")
+	}
+
+	// Create a temporary folder for the new image
+	folder := filepath.Join(i.image.manager.imageFolder, slugid.Nice())
+	if err := os.Mkdir(folder, 0777); err != nil {
+		return errors.Wrap(err, "failed to create folder for packaging image")
+	}
+	defer os.RemoveAll(folder)
+
+	// Convert the layer and its backing disk.img into a new disk.img
+	convert := exec.Command(
+		"qemu-img", "convert", "-f", "qcow2", "-O", "raw",
+		"--", i.diskFile, filepath.Join(folder, "disk.img"),
+	)
+	if _, err := convert.Output(); err != nil {
+		msg := err.Error()
+		if ee, ok := err.(*exec.ExitError); ok {
+			msg = string(ee.Stderr)
+		}
+		return fmt.Errorf("Failed to convert disk image, error: %s", msg)
+	}
+
+	// Carry the UEFI variables forward, if present
+	if fileExists(i.nvramFile) {
+		if err := copyFile(i.nvramFile, filepath.Join(folder, nvramFile)); err != nil {
+			return fmt.Errorf("Failed to copy %s, error: %s", nvramFile, err)
+		}
+	}
+
+	if err := createLayer(folder); err != nil {
+		return err
+	}
+	return writeImageArchive(folder, targetFile, machine, DefaultCompression)
+}
+
 // Release frees the resources held by an instance.
 func (i *Instance) Release() {
 	i.m.Lock()
@@ -255,6 +443,11 @@ func (i *Instance) Release() {
 		i.image.manager.monitor.ReportError(err, "Failed to delete layer.qcow2 copy")
 	}
 
+	// Delete the uefi-vars.fd copy, which is only created for UEFI machines
+	if err := os.Remove(i.nvramFile); err != nil && !os.IsNotExist(err) {
+		i.image.manager.monitor.ReportError(err, "Failed to delete uefi-vars.fd copy")
+	}
+
 	// Release the image
 	i.image.Release()
 	i.image = nil // ensure that we never do this twice
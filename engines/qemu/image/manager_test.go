@@ -70,8 +70,8 @@ func TestImageManager(t *testing.T) {
 	diskImage := instance.DiskFile()
 
 	debug(" - Inspect file for sanity check: ", diskImage)
-	info := inspectImageFile(diskImage, imageQCOW2Format)
-	require.True(t, info != nil, "Expected a qcow2 file")
+	info, err := inspectImageFile(diskImage, imageQCOW2Format)
+	require.NoError(t, err, "Expected a qcow2 file")
 	require.True(t, info.Format == formatQCOW2)
 	require.True(t, !info.DirtyFlag)
 	require.True(t, info.BackingFile != "", "Missing backing file in qcow2")
@@ -85,8 +85,8 @@ func TestImageManager(t *testing.T) {
 	require.NoError(t, gc.CollectAll(), "gc.CollectAll() failed")
 	_, err = os.Lstat(backingFile)
 	require.NoError(t, err, "backingFile missing after GC")
-	info = inspectImageFile(diskImage, imageQCOW2Format)
-	require.True(t, info != nil, "diskImage for instance deleted after GC")
+	_, err = inspectImageFile(diskImage, imageQCOW2Format)
+	require.NoError(t, err, "diskImage for instance deleted after GC")
 
 	debug(" - Make a new instance")
 	instance2, err := manager.Instance("url:test-image-1", func(target *os.File) error {
@@ -95,15 +95,15 @@ func TestImageManager(t *testing.T) {
 	require.NoError(t, err, "Failed to create new instance")
 	diskImage2 := instance2.DiskFile()
 	require.True(t, diskImage2 != diskImage, "Expected a new disk image")
-	info = inspectImageFile(diskImage2, imageQCOW2Format)
-	require.True(t, info != nil, "diskImage2 missing initially")
+	_, err = inspectImageFile(diskImage2, imageQCOW2Format)
+	require.NoError(t, err, "diskImage2 missing initially")
 
 	debug(" - Release the first instance")
 	instance.Release()
 	_, err = os.Lstat(diskImage)
 	require.True(t, os.IsNotExist(err), "first instance diskImage shouldn't exist!")
-	info = inspectImageFile(diskImage2, imageQCOW2Format)
-	require.True(t, info != nil, "diskImage2 missing after first instance release")
+	_, err = inspectImageFile(diskImage2, imageQCOW2Format)
+	require.NoError(t, err, "diskImage2 missing after first instance release")
 
 	debug(" - Garbage collect and test that image is still there")
 	require.NoError(t, gc.CollectAll(), "gc.CollectAll() failed")
@@ -111,8 +111,8 @@ func TestImageManager(t *testing.T) {
 	require.NoError(t, err, "backingFile missing after second GC")
 	_, err = os.Lstat(diskImage)
 	require.True(t, os.IsNotExist(err), "first instance diskImage shouldn't exist!")
-	info = inspectImageFile(diskImage2, imageQCOW2Format)
-	require.True(t, info != nil, "diskImage2 missing after first instance release")
+	_, err = inspectImageFile(diskImage2, imageQCOW2Format)
+	require.NoError(t, err, "diskImage2 missing after first instance release")
 
 	debug(" - Release the second instance")
 	instance2.Release()
@@ -132,3 +132,50 @@ func TestImageManager(t *testing.T) {
 	})
 	require.True(t, err == downloadError, "Expected a downloadError", err)
 }
+
+func TestImageManagerKeepArchives(t *testing.T) {
+	gc := &gc.GarbageCollector{}
+	monitor := mocks.NewMockMonitor(true)
+	imageFolder := filepath.Join("/tmp", slugid.Nice())
+	defer os.RemoveAll(imageFolder)
+
+	manager, err := NewManager(imageFolder, gc, monitor)
+	require.NoError(t, err, "Failed to create image manager")
+	manager.KeepArchives()
+
+	debug(" - Load image with archive")
+	instance, err := manager.Instance("sha256=test-image", func(target *os.File) error {
+		f, ferr := os.Open(testImageFile)
+		if ferr != nil {
+			return ferr
+		}
+		defer f.Close()
+		_, ferr = io.Copy(target, f)
+		return ferr
+	})
+	require.NoError(t, err, "Failed to loadImage")
+	require.Equal(t, []string{"sha256=test-image"}, manager.ArchiveIDs())
+
+	debug(" - Check that archive is the image file")
+	archive, err := manager.Archive("sha256=test-image")
+	require.NoError(t, err)
+	require.NotNil(t, archive)
+	archivePath := archive.Name()
+	archiveInfo, err := archive.Stat()
+	require.NoError(t, err)
+	archive.Close()
+	imageInfo, err := os.Stat(testImageFile)
+	require.NoError(t, err)
+	require.Equal(t, imageInfo.Size(), archiveInfo.Size())
+
+	archive, err = manager.Archive("sha256=missing-image")
+	require.NoError(t, err)
+	require.Nil(t, archive)
+
+	debug(" - Garbage collect and check that archive is removed")
+	instance.Release()
+	require.NoError(t, gc.CollectAll(), "gc.CollectAll() failed")
+	require.Empty(t, manager.ArchiveIDs())
+	_, err = os.Lstat(archivePath)
+	require.True(t, os.IsNotExist(err), "Expected archive to be deleted after GC")
+}
@@ -1,13 +1,13 @@
 package image
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
 
 	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
@@ -76,6 +76,51 @@ func NewMutableImageFromFile(imageFile, imageFolder string) (*MutableImage, erro
 	}, nil
 }
 
+// NewMutableImageFromDisk creates a mutable image from a disk file in another
+// format, such as vmdk, vhdx or vhd, or an OVA bundle, using the given machine
+// configuration. The disk is converted to 'disk.img' in imageFolder, reporting
+// progress as a float between 0 and 1, if progress is non-nil.
+func NewMutableImageFromDisk(diskFile, imageFolder string, machine *vm.Machine, progress func(float64)) (*MutableImage, error) {
+	// Extract disk from OVA bundles
+	if strings.ToLower(filepath.Ext(diskFile)) == ".ova" {
+		disk, err := ExtractOVA(diskFile, imageFolder)
+		if err != nil {
+			return nil, err
+		}
+		defer os.Remove(disk)
+		diskFile = disk
+	}
+
+	if err := ConvertDisk(diskFile, filepath.Join(imageFolder, "disk.img"), progress); err != nil {
+		return nil, err
+	}
+
+	return &MutableImage{
+		folder:  imageFolder,
+		machine: machine,
+	}, nil
+}
+
+// createLayer creates an empty 'layer.qcow2' backed by 'disk.img' in folder
+func createLayer(folder string) error {
+	layer := exec.Command(
+		"qemu-img", "create",
+		"-f", "qcow2",
+		"-o", "backing_file=disk.img,backing_fmt=raw,lazy_refcounts=on",
+		"layer.qcow2",
+	)
+	layer.Dir = folder
+	_, err := layer.Output()
+	if err != nil {
+		msg := err.Error()
+		if ee, ok := err.(*exec.ExitError); ok {
+			msg = string(ee.Stderr)
+		}
+		return fmt.Errorf("Failed to create layer.qcow2 file, error: %s", msg)
+	}
+	return nil
+}
+
 // DiskFile returns path to disk file to use in QEMU.
 // This also marks the image as being in-use.
 func (img *MutableImage) DiskFile() string {
@@ -94,20 +139,45 @@ func (img *MutableImage) Format() string {
 	return "raw"
 }
 
-// Machine returns the vm.Machine definition of the virtual machine.
-func (img *MutableImage) Machine() vm.Machine {
+// DiskUsage returns the number of bytes allocated for the disk file, and the
+// virtual size of the disk. This can be called while the image is in-use, to
+// monitor how much of the disk the guest has filled.
+func (img *MutableImage) DiskUsage() (allocated, size int64, err error) {
 	img.m.Lock()
 	defer img.m.Unlock()
 	if img.folder == "" {
 		panic("MutableImage have been disposed")
 	}
 
-	return *img.machine
+	diskFile := filepath.Join(img.folder, "disk.img")
+	info, err := os.Stat(diskFile)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Failed to stat disk.img, error: %s", err)
+	}
+	allocated, err = allocatedSize(diskFile)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Failed to stat disk.img, error: %s", err)
+	}
+	return allocated, info.Size(), nil
 }
 
-// Package will write an zstd compressed tar archive of the image to targetFile.
-// This method cannot be called the image is in-use.
-func (img *MutableImage) Package(targetFile string) error {
+// NVRAMFile returns path to the UEFI variables file, this is included in the
+// image when packaged.
+func (img *MutableImage) NVRAMFile() string {
+	img.m.Lock()
+	defer img.m.Unlock()
+	if img.folder == "" {
+		panic("MutableImage have been disposed")
+	}
+
+	return filepath.Join(img.folder, nvramFile)
+}
+
+// Compact deallocates blocks of zeros in the disk file, so the image stays
+// small when packaged. Guests should zero or trim free space before shutting
+// down, for instance with 'qemu-guest-tools compact'. Returns the number of
+// bytes reclaimed. This method cannot be called while the image is in-use.
+func (img *MutableImage) Compact() (int64, error) {
 	img.m.Lock()
 	defer img.m.Unlock()
 	if img.folder == "" {
@@ -117,74 +187,66 @@ func (img *MutableImage) Package(targetFile string) error {
 		panic("MutableImage is currently in-use, Release() must be called first")
 	}
 
-	// Create layer.qcow2 file
-	layer := exec.Command(
-		"qemu-img", "create",
-		"-f", "qcow2",
-		"-o", "backing_file=disk.img,backing_fmt=raw,lazy_refcounts=on",
-		"layer.qcow2",
-	)
-	layer.Dir = img.folder
-	_, err := layer.Output()
+	diskFile := filepath.Join(img.folder, "disk.img")
+	before, err := allocatedSize(diskFile)
 	if err != nil {
-		msg := err.Error()
-		if ee, ok := err.(*exec.ExitError); ok {
-			msg = string(ee.Stderr)
-		}
-		return fmt.Errorf("Failed to create layer.qcow2 file, error: %s", msg)
+		return 0, fmt.Errorf("Failed to stat disk.img, error: %s", err)
 	}
-
-	// Create machine.json file
-	data, err := json.Marshal(img.machine)
-	if err != nil {
-		panic(fmt.Sprintf("Failed to json.Marshal machine.json, err: %s", err))
+	if err = deallocateZeros(diskFile); err != nil {
+		return 0, err
 	}
-	file, err := os.Create(filepath.Join(img.folder, "machine.json"))
+	after, err := allocatedSize(diskFile)
 	if err != nil {
-		return fmt.Errorf("Failed to create machine.json, err: %s", err)
+		return 0, fmt.Errorf("Failed to stat disk.img, error: %s", err)
 	}
-	if _, err := file.Write(data); err != nil {
-		file.Close()
-		return fmt.Errorf("Failed to write machine.json, err: %s", err)
+	return before - after, nil
+}
+
+// Machine returns the vm.Machine definition of the virtual machine.
+func (img *MutableImage) Machine() vm.Machine {
+	img.m.Lock()
+	defer img.m.Unlock()
+	if img.folder == "" {
+		panic("MutableImage have been disposed")
 	}
-	file.Close()
 
-	// Create tarball of everything
-	tar := exec.Command(
-		"tar", "-Scf", "image.tar", "disk.img", "layer.qcow2", "machine.json",
-	)
-	tar.Dir = img.folder
-	if _, err := tar.Output(); err != nil {
-		msg := err.Error()
-		if ee, ok := err.(*exec.ExitError); ok {
-			msg = string(ee.Stderr)
-		}
-		return fmt.Errorf("Failed to create image.tar file, error: %s", msg)
+	return *img.machine
+}
+
+// Package will write an zstd compressed tar archive of the image to targetFile.
+// This method cannot be called the image is in-use.
+func (img *MutableImage) Package(targetFile string) error {
+	return img.PackageWithCompression(targetFile, DefaultCompression)
+}
+
+// PackageWithCompression is like Package(), but compresses the archive with
+// the given compression level and number of threads.
+func (img *MutableImage) PackageWithCompression(targetFile string, compression Compression) error {
+	if err := compression.Validate(); err != nil {
+		return err
 	}
 
-	// zstd compress everything and write to targetFile
-	zstd := exec.Command(
-		"zstd", "-3", "image.tar", "-fo", targetFile,
-	)
-	zstd.Dir = img.folder
-	if _, err := zstd.Output(); err != nil {
-		msg := err.Error()
-		if ee, ok := err.(*exec.ExitError); ok {
-			msg = string(ee.Stderr)
-		}
-		return fmt.Errorf("Failed to zstd compress image file, error: %s", msg)
+	img.m.Lock()
+	defer img.m.Unlock()
+	if img.folder == "" {
+		panic("MutableImage have been disposed")
+	}
+	if img.inUse {
+		panic("MutableImage is currently in-use, Release() must be called first")
 	}
 
-	// Remove layer.qcow2
-	if err := os.Remove(filepath.Join(img.folder, "layer.qcow2")); err != nil {
-		return fmt.Errorf("Failed to clean up after packaging, err: %s", err)
+	// Create layer.qcow2 file
+	if err := createLayer(img.folder); err != nil {
+		return err
 	}
-	// Remove machine.json
-	if err := os.Remove(filepath.Join(img.folder, "machine.json")); err != nil {
-		return fmt.Errorf("Failed to clean up after packaging, err: %s", err)
+
+	// Write machine.json and create the compressed tar archive
+	if err := writeImageArchive(img.folder, targetFile, *img.machine, compression); err != nil {
+		return err
 	}
-	// Remove image.tar
-	if err := os.Remove(filepath.Join(img.folder, "image.tar")); err != nil {
+
+	// Remove layer.qcow2
+	if err := os.Remove(filepath.Join(img.folder, "layer.qcow2")); err != nil {
 		return fmt.Errorf("Failed to clean up after packaging, err: %s", err)
 	}
 
@@ -0,0 +1,257 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
+)
+
+// SnapshotImage is a vm.MutableImage implementation that runs an existing
+// image from its layer.qcow2 file, such that a running-state snapshot can be
+// saved in layer.qcow2 and packaged with the image.
+//
+// When packaged the machine definition will be fully resolved and have the
+// snapshot property set, so the qemu engine resumes from the snapshot.
+type SnapshotImage struct {
+	m        sync.Mutex
+	inUse    bool
+	folder   string
+	machine  vm.Machine
+	snapshot string
+}
+
+// NewSnapshotImage creates a SnapshotImage from an existing compressed image
+// tar archive. The snapshot must be saved under the name given, before the
+// image is packaged.
+//
+// The machine definition is resolved using limits derived from the machine, as
+// the virtual hardware must not change when resuming from the snapshot.
+func NewSnapshotImage(imageFile, imageFolder, snapshot string) (*SnapshotImage, error) {
+	// Extract image normally
+	machine, err := extractImage(imageFile, imageFolder)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolve the machine, and clear any existing snapshot as we want to boot
+	m := machine.WithSnapshot("")
+	resolved, err := m.Resolve(m.DeriveLimits())
+	if err != nil {
+		// Delete image folder, ignoring errors
+		os.RemoveAll(imageFolder)
+		return nil, err
+	}
+
+	// Delete the existing snapshot from layer.qcow2, as packaged images may
+	// only contain the snapshot referenced in machine.json
+	if s := machine.Snapshot(); s != "" {
+		del := exec.Command("qemu-img", "snapshot", "-d", s, "layer.qcow2")
+		del.Dir = imageFolder
+		if _, err = del.Output(); err != nil {
+			msg := err.Error()
+			if ee, ok := err.(*exec.ExitError); ok {
+				msg = string(ee.Stderr)
+			}
+			os.RemoveAll(imageFolder)
+			return nil, fmt.Errorf("Failed to delete snapshot '%s' from layer.qcow2, error: %s", s, msg)
+		}
+	}
+
+	return &SnapshotImage{
+		folder:   imageFolder,
+		machine:  resolved,
+		snapshot: snapshot,
+	}, nil
+}
+
+// DiskFile returns path to disk file to use in QEMU.
+// This also marks the image as being in-use.
+func (img *SnapshotImage) DiskFile() string {
+	img.m.Lock()
+	defer img.m.Unlock()
+	if img.folder == "" {
+		panic("SnapshotImage have been disposed")
+	}
+	img.inUse = true
+
+	return filepath.Join(img.folder, "layer.qcow2")
+}
+
+// Format returns the image format: 'qcow2', required for internal snapshots.
+func (img *SnapshotImage) Format() string {
+	return formatQCOW2
+}
+
+// NVRAMFile returns path to the UEFI variables file, this is included in the
+// image when packaged.
+func (img *SnapshotImage) NVRAMFile() string {
+	img.m.Lock()
+	defer img.m.Unlock()
+	if img.folder == "" {
+		panic("SnapshotImage have been disposed")
+	}
+
+	return filepath.Join(img.folder, nvramFile)
+}
+
+// Machine returns the vm.Machine definition of the virtual machine.
+func (img *SnapshotImage) Machine() vm.Machine {
+	img.m.Lock()
+	defer img.m.Unlock()
+	if img.folder == "" {
+		panic("SnapshotImage have been disposed")
+	}
+
+	return img.machine
+}
+
+// Package will write an zstd compressed tar archive of the image to targetFile.
+// This method cannot be called the image is in-use.
+func (img *SnapshotImage) Package(targetFile string) error {
+	return img.PackageWithCompression(targetFile, DefaultCompression)
+}
+
+// PackageWithCompression is like Package(), but compresses the archive with
+// the given compression level and number of threads.
+func (img *SnapshotImage) PackageWithCompression(targetFile string, compression Compression) error {
+	if err := compression.Validate(); err != nil {
+		return err
+	}
+
+	img.m.Lock()
+	defer img.m.Unlock()
+	if img.folder == "" {
+		panic("SnapshotImage have been disposed")
+	}
+	if img.inUse {
+		panic("SnapshotImage is currently in-use, Release() must be called first")
+	}
+
+	// Check that the snapshot was saved in layer.qcow2
+	check := exec.Command("qemu-img", "snapshot", "-l", "layer.qcow2")
+	check.Dir = img.folder
+	output, err := check.Output()
+	if err != nil {
+		msg := err.Error()
+		if ee, ok := err.(*exec.ExitError); ok {
+			msg = string(ee.Stderr)
+		}
+		return fmt.Errorf("Failed to list snapshots in layer.qcow2, error: %s", msg)
+	}
+	if !hasSnapshot(string(output), img.snapshot) {
+		return fmt.Errorf("Snapshot '%s' wasn't found in layer.qcow2", img.snapshot)
+	}
+
+	return writeImageArchive(img.folder, targetFile, img.machine.WithSnapshot(img.snapshot), compression)
+}
+
+// Release marks the SnapshotImage as no longer in use. This allows Package()
+// or Dispose() to be called.
+func (img *SnapshotImage) Release() {
+	img.m.Lock()
+	defer img.m.Unlock()
+	if img.folder == "" {
+		panic("SnapshotImage have been disposed")
+	}
+
+	// Mark the image no-longer in use
+	img.inUse = false
+}
+
+// Dispose will delete all resources hold by the SnapshotImage
+func (img *SnapshotImage) Dispose() {
+	img.m.Lock()
+	defer img.m.Unlock()
+	if img.folder == "" {
+		panic("SnapshotImage have already been released")
+	}
+	if img.inUse {
+		panic("SnapshotImage is currently in-use, Release() must be called first")
+	}
+
+	// Delete image folder, ignoring errors
+	os.RemoveAll(img.folder)
+
+	// Clear image folder, to prevent reuse.
+	img.folder = ""
+}
+
+// hasSnapshot returns true, if the output from 'qemu-img snapshot -l' lists
+// a snapshot with the given name.
+func hasSnapshot(output, name string) bool {
+	// Output is a table on the form:
+	//   Snapshot list:
+	//   ID        TAG                 VM SIZE                DATE       VM CLOCK
+	//   1         booted                 1.2G 2017-08-01 10:00:00   00:01:23.456
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[1] == name {
+			return true
+		}
+	}
+	return false
+}
+
+// writeImageArchive writes machine.json to folder and creates a zstd compressed
+// tar archive of disk.img, layer.qcow2, machine.json and uefi-vars.fd (if
+// present) at targetFile.
+func writeImageArchive(folder, targetFile string, machine vm.Machine, compression Compression) error {
+	// Create machine.json file
+	data, err := json.Marshal(machine)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to json.Marshal machine.json, err: %s", err))
+	}
+	file, err := os.Create(filepath.Join(folder, "machine.json"))
+	if err != nil {
+		return fmt.Errorf("Failed to create machine.json, err: %s", err)
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("Failed to write machine.json, err: %s", err)
+	}
+	file.Close()
+
+	// Create tarball of everything
+	files := []string{"disk.img", "layer.qcow2", "machine.json"}
+	if fileExists(filepath.Join(folder, nvramFile)) {
+		files = append(files, nvramFile)
+	}
+	tar := exec.Command("tar", append([]string{"-Scf", "image.tar"}, files...)...)
+	tar.Dir = folder
+	if _, err := tar.Output(); err != nil {
+		msg := err.Error()
+		if ee, ok := err.(*exec.ExitError); ok {
+			msg = string(ee.Stderr)
+		}
+		return fmt.Errorf("Failed to create image.tar file, error: %s", msg)
+	}
+
+	// zstd compress everything and write to targetFile
+	args := append(compression.zstdArgs(), "-q", "image.tar", "-fo", targetFile)
+	zstd := exec.Command("zstd", args...)
+	zstd.Dir = folder
+	if _, err := zstd.Output(); err != nil {
+		msg := err.Error()
+		if ee, ok := err.(*exec.ExitError); ok {
+			msg = string(ee.Stderr)
+		}
+		return fmt.Errorf("Failed to zstd compress image file, error: %s", msg)
+	}
+
+	// Remove machine.json
+	if err := os.Remove(filepath.Join(folder, "machine.json")); err != nil {
+		return fmt.Errorf("Failed to clean up after packaging, err: %s", err)
+	}
+	// Remove image.tar
+	if err := os.Remove(filepath.Join(folder, "image.tar")); err != nil {
+		return fmt.Errorf("Failed to clean up after packaging, err: %s", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,16 @@
+package image
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHasSnapshot(t *testing.T) {
+	output := "Snapshot list:\n" +
+		"ID        TAG                 VM SIZE                DATE       VM CLOCK\n" +
+		"1         booted                 1.2G 2017-08-01 10:00:00   00:01:23.456\n"
+	require.True(t, hasSnapshot(output, "booted"))
+	require.False(t, hasSnapshot(output, "other"))
+	require.False(t, hasSnapshot("", "booted"))
+}
@@ -0,0 +1,105 @@
+package image
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"unsafe"
+)
+
+// ioctls from linux/fs.h
+const (
+	ficlone       = 0x40049409
+	fidedupeRange = 0xc0189436
+)
+
+// reflink makes target share the data blocks of source, without copying the
+// data. This is supported by btrfs and xfs (if created with reflink=1), other
+// file systems return an error.
+func reflink(target, source *os.File) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, target.Fd(), ficlone, source.Fd())
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// fileDedupeRange is struct file_dedupe_range from linux/fs.h with a single
+// struct file_dedupe_range_info
+type fileDedupeRange struct {
+	SrcOffset    uint64
+	SrcLength    uint64
+	DestCount    uint16
+	Reserved1    uint16
+	Reserved2    uint32
+	DestFd       int64
+	DestOffset   uint64
+	BytesDeduped uint64
+	Status       int32
+	Reserved     uint32
+}
+
+// dedupeRange makes length bytes at targetOffset in target share the data
+// blocks at sourceOffset in source, if the contents are identical. Returns
+// false, if the contents differ. The kernel compares the contents, so this
+// never changes the contents of target. This is supported by btrfs and xfs
+// (if created with reflink=1), other file systems return an error.
+func dedupeRange(target *os.File, targetOffset int64, source *os.File, sourceOffset, length int64) (bool, error) {
+	arg := fileDedupeRange{
+		SrcOffset:  uint64(sourceOffset),
+		SrcLength:  uint64(length),
+		DestCount:  1,
+		DestFd:     int64(target.Fd()),
+		DestOffset: uint64(targetOffset),
+	}
+	_, _, errno := syscall.Syscall(
+		syscall.SYS_IOCTL, source.Fd(), fidedupeRange, uintptr(unsafe.Pointer(&arg)),
+	)
+	if errno != 0 {
+		return false, errno
+	}
+	if arg.Status < 0 {
+		return false, syscall.Errno(-arg.Status)
+	}
+	// Status is 1 (FILE_DEDUPE_RANGE_DIFFERS), if contents differ
+	return arg.Status == 0 && arg.BytesDeduped == uint64(length), nil
+}
+
+// isDedupeNotSupported returns true, if err from dedupeRange() implies that
+// the file system doesn't support deduplication.
+func isDedupeNotSupported(err error) bool {
+	return err == syscall.EOPNOTSUPP || err == syscall.EXDEV
+}
+
+// allocatedSize returns the number of bytes allocated for file, this is less
+// than the size of file, if file is sparse.
+func allocatedSize(file string) (int64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(file, &st); err != nil {
+		return 0, err
+	}
+	return st.Blocks * 512, nil
+}
+
+// digHoles deallocates blocks of zeros in file, if file isn't sparse already.
+// Image archives created without GNU tar -S have disk files without holes.
+func digHoles(file string) error {
+	var st syscall.Stat_t
+	if err := syscall.Stat(file, &st); err != nil {
+		return err
+	}
+	if st.Blocks*512 < st.Size {
+		return nil // already sparse
+	}
+	return deallocateZeros(file)
+}
+
+// deallocateZeros deallocates all blocks of zeros in file
+func deallocateZeros(file string) error {
+	_, err := exec.Command("fallocate", "--dig-holes", file).Output()
+	if ee, ok := err.(*exec.ExitError); ok {
+		return fmt.Errorf("fallocate --dig-holes failed, error: %s", string(ee.Stderr))
+	}
+	return err
+}
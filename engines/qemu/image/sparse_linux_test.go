@@ -0,0 +1,155 @@
+package image
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// allocated returns the number of bytes allocated for file
+func allocated(t *testing.T, file string) int64 {
+	var st syscall.Stat_t
+	require.NoError(t, syscall.Stat(file, &st))
+	return st.Blocks * 512
+}
+
+func TestCopyFileSparse(t *testing.T) {
+	folder, err := ioutil.TempDir("", "image-sparse-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+
+	// Create a 16 MiB file with data at 0 and 8 MiB, ending with a hole
+	source := filepath.Join(folder, "source")
+	f, err := os.Create(source)
+	require.NoError(t, err)
+	_, err = f.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("world"), 8*1024*1024)
+	require.NoError(t, err)
+	require.NoError(t, f.Truncate(16*1024*1024))
+	require.NoError(t, f.Close())
+
+	target := filepath.Join(folder, "target")
+	require.NoError(t, copyFile(source, target))
+
+	a, err := ioutil.ReadFile(source)
+	require.NoError(t, err)
+	b, err := ioutil.ReadFile(target)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(a, b), "expected target to be a copy of source")
+	require.True(t, allocated(t, target) < 1024*1024, "expected target to be sparse")
+}
+
+func TestDigHoles(t *testing.T) {
+	if _, err := exec.LookPath("fallocate"); err != nil {
+		t.Skip("fallocate is not available")
+	}
+	folder, err := ioutil.TempDir("", "image-sparse-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+
+	// Write 8 MiB of zeros and some data, so the file isn't sparse
+	file := filepath.Join(folder, "disk.img")
+	data := make([]byte, 8*1024*1024)
+	copy(data, []byte("hello"))
+	require.NoError(t, ioutil.WriteFile(file, data, 0600))
+	if allocated(t, file) < int64(len(data)) {
+		t.Skip("file system doesn't allocate blocks of zeros")
+	}
+
+	require.NoError(t, digHoles(file))
+	result, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data, result), "expected contents to be unchanged")
+	if allocated(t, file) >= int64(len(data)) {
+		t.Skip("file system doesn't support punching holes")
+	}
+	require.True(t, allocated(t, file) < 1024*1024, "expected file to be sparse")
+}
+
+func TestDedupeIndex(t *testing.T) {
+	folder, err := ioutil.TempDir("", "image-dedupe-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+
+	// Create two 4 MiB disks sharing the chunks at 1 and 3 MiB, chunk 2 is a
+	// hole and the first chunk differs.
+	chunk := func(c byte) []byte {
+		return bytes.Repeat([]byte{c}, dedupeChunkSize)
+	}
+	zero := make([]byte, dedupeChunkSize)
+	disk1 := filepath.Join(folder, "disk1.img")
+	data1 := bytes.Join([][]byte{chunk(1), chunk(2), zero, chunk(3)}, nil)
+	require.NoError(t, ioutil.WriteFile(disk1, data1, 0600))
+	disk2 := filepath.Join(folder, "disk2.img")
+	data2 := bytes.Join([][]byte{chunk(4), chunk(2), zero, chunk(3)}, nil)
+	require.NoError(t, ioutil.WriteFile(disk2, data2, 0600))
+
+	d := newDedupeIndex()
+	shared, err := d.add(disk1)
+	require.NoError(t, err)
+	require.Equal(t, int64(0), shared)
+	shared, err = d.add(disk2)
+	require.NoError(t, err)
+
+	// Contents must never change
+	result, err := ioutil.ReadFile(disk2)
+	require.NoError(t, err)
+	require.True(t, bytes.Equal(data2, result), "expected contents to be unchanged")
+
+	if d.disabled {
+		require.Equal(t, int64(0), shared)
+		t.Skip("file system doesn't support deduplication")
+	}
+	require.Equal(t, int64(2*dedupeChunkSize), shared)
+	require.Len(t, d.files, 2)
+	d.remove(disk1)
+	require.Len(t, d.files, 1)
+}
+
+func TestIsDedupeNotSupported(t *testing.T) {
+	require.True(t, isDedupeNotSupported(syscall.EOPNOTSUPP))
+	require.True(t, isDedupeNotSupported(syscall.EXDEV))
+	require.False(t, isDedupeNotSupported(syscall.EIO))
+	require.False(t, isDedupeNotSupported(syscall.EINVAL))
+}
+
+func TestMutableImageCompact(t *testing.T) {
+	if _, err := exec.LookPath("fallocate"); err != nil {
+		t.Skip("fallocate is not available")
+	}
+	folder, err := ioutil.TempDir("", "image-compact-test-")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+
+	img, err := NewMutableImage(folder, 1, nil)
+	require.NoError(t, err)
+	defer img.Dispose()
+
+	// Write 8 MiB of zeros, as a guest zero filling free space would
+	f, err := os.OpenFile(filepath.Join(folder, "disk.img"), os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.WriteAt(make([]byte, 8*1024*1024), 1024*1024)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+	if allocated(t, filepath.Join(folder, "disk.img")) < 8*1024*1024 {
+		t.Skip("file system doesn't allocate blocks of zeros")
+	}
+
+	reclaimed, err := img.Compact()
+	require.NoError(t, err)
+	if reclaimed == 0 {
+		t.Skip("file system doesn't support punching holes")
+	}
+	require.True(t, reclaimed >= 8*1024*1024, "expected blocks of zeros to be reclaimed")
+	used, size, err := img.DiskUsage()
+	require.NoError(t, err)
+	require.True(t, used < 1024*1024, "expected disk.img to be sparse")
+	require.Equal(t, int64(1024*1024*1024), size)
+}
@@ -0,0 +1,44 @@
+// +build !linux
+
+package image
+
+import (
+	"errors"
+	"os"
+)
+
+// reflink returns an error, as reflinks are only supported on linux
+func reflink(target, source *os.File) error {
+	return errors.New("reflinks are only supported on linux")
+}
+
+// dedupeRange returns an error, as deduplication is only supported on linux
+func dedupeRange(target *os.File, targetOffset int64, source *os.File, sourceOffset, length int64) (bool, error) {
+	return false, errors.New("deduplication is only supported on linux")
+}
+
+// isDedupeNotSupported returns true, as deduplication is only supported on
+// linux
+func isDedupeNotSupported(err error) bool {
+	return true
+}
+
+// digHoles does nothing, as files are only made sparse on linux
+func digHoles(file string) error {
+	return nil
+}
+
+// deallocateZeros does nothing, as files are only made sparse on linux
+func deallocateZeros(file string) error {
+	return nil
+}
+
+// allocatedSize returns the size of file, as the number of bytes allocated is
+// only available on linux
+func allocatedSize(file string) (int64, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
@@ -10,9 +10,15 @@ import (
 	"github.com/taskcluster/taskcluster-worker/runtime"
 )
 
+// Block size used when copying files, blocks of zeros become holes in target
+const copyBlockSize = 64 * 1024
+
 // copyFile copies source to destination, and returns an error if one occurs
 // during opening input or output file, copying data from input to output, or
-// closing input or output file
+// closing input or output file.
+//
+// If the file system supports it the copy is a reflink sharing data blocks
+// with source, otherwise blocks of zeros are skipped, so the copy is sparse.
 func copyFile(source, target string) (err error) {
 	var input *os.File
 	var output *os.File
@@ -37,11 +43,54 @@ func copyFile(source, target string) (err error) {
 	}
 	defer closeFile(output)
 
-	// Copy data
-	_, err = io.Copy(output, input)
+	// Clone data, falling back to a sparse copy
+	rerr := reflink(output, input)
+	if rerr == nil {
+		return
+	}
+	debug("reflink of %s failed, copying instead, error: %s", source, rerr)
+	err = copySparse(output, input)
 	return
 }
 
+// copySparse copies input to output, seeking over blocks of zeros instead of
+// writing them, so they become holes in output.
+func copySparse(output, input *os.File) error {
+	block := make([]byte, copyBlockSize)
+	var size int64
+	for {
+		n, err := io.ReadFull(input, block)
+		if n > 0 {
+			size += int64(n)
+			if isZero(block[:n]) {
+				if _, serr := output.Seek(int64(n), io.SeekCurrent); serr != nil {
+					return serr
+				}
+			} else if _, werr := output.Write(block[:n]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	// Extend output, in case it ends with a hole
+	return output.Truncate(size)
+}
+
+// isZero returns true, if all bytes in p are zero
+func isZero(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
 const maxRetries = 7
 
 // DownloadImage returns a Downloader that will download the image from the
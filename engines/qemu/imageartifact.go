@@ -0,0 +1,107 @@
+package qemuengine
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/atomics"
+)
+
+// imageShutdownGracePeriod is the time the guest is given to power down, before
+// its disk is packaged as an image artifact.
+const imageShutdownGracePeriod = 5 * time.Minute
+
+// errImageNotPackaged is sent on packagedImage.result, if the virtual machine
+// released the image without the guest powering down first.
+var errImageNotPackaged = errors.New("the guest didn't power down, the image was not packaged")
+
+// imagePackager is an image instance that can package its disk as a new image,
+// see image.Instance.Package().
+type imagePackager interface {
+	vm.Image
+	Package(targetFile string, machine vm.Machine) error
+}
+
+// packagedImage wraps the image instance given to the virtual machine, such
+// that the disk can be packaged after the guest has powered down, but before
+// the virtual machine releases the instance.
+type packagedImage struct {
+	imagePackager
+	machine vm.Machine   // Machine definition for the new image
+	target  string       // File to package the image to
+	request atomics.Bool // True, if the image should be packaged on release
+	result  chan error   // Result of packaging, sent when released
+}
+
+func newPackagedImage(image imagePackager, machine vm.Machine, target string) *packagedImage {
+	return &packagedImage{
+		imagePackager: image,
+		machine:       machine,
+		target:        target,
+		result:        make(chan error, 1),
+	}
+}
+
+// Release packages the image, if requested, and releases the image instance.
+func (p *packagedImage) Release() {
+	err := errImageNotPackaged
+	if p.request.Get() {
+		err = p.imagePackager.Package(p.target, p.machine)
+	}
+	p.result <- err
+	p.imagePackager.Release()
+}
+
+// uploadImage powers down the guest, and uploads the disk packaged as an image
+// as the artifact named by task.payload.imageArtifact. Returns false, if the
+// image couldn't be uploaded, in which case the task must fail.
+func (s *sandbox) uploadImage() bool {
+	defer os.Remove(s.packaged.target)
+
+	// Package the disk when the guest powers down
+	s.packaging.Set(true)
+	if !s.poweredOff.Get() {
+		s.context.Log("Powering down the guest to package the image")
+	}
+	s.vm.Shutdown(imageShutdownGracePeriod)
+
+	// The image is released, and thus packaged, before the VM is done
+	err := <-s.packaged.result
+	if err == errImageNotPackaged {
+		s.context.LogError(fmt.Sprintf(
+			"Guest didn't power down within %s, the image was not packaged",
+			imageShutdownGracePeriod,
+		))
+		return false
+	}
+	if err != nil {
+		incidentID := s.monitor.ReportError(err, "failed to package image")
+		s.context.LogError("Failed to package the image, incidentId: ", incidentID)
+		return false
+	}
+
+	f, err := os.Open(s.packaged.target)
+	if err != nil {
+		s.monitor.ReportError(err, "failed to open packaged image")
+		return false
+	}
+	defer f.Close()
+
+	err = s.context.UploadS3Artifact(runtime.S3Artifact{
+		Name:     s.imageName,
+		Mimetype: "application/octet-stream",
+		Expires:  s.context.TaskInfo.Expires,
+		Stream:   f,
+	})
+	if err != nil {
+		s.monitor.Warn("failed to upload image, error: ", err)
+		s.context.LogError(fmt.Sprintf("Failed to upload image as artifact: %s", s.imageName))
+		return false
+	}
+	s.context.Log(fmt.Sprintf("Uploaded image as artifact: %s", s.imageName))
+	return true
+}
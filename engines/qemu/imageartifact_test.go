@@ -0,0 +1,44 @@
+package qemuengine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
+)
+
+type fakePackager struct {
+	vm.Image
+	packaged []string
+	released bool
+}
+
+func (f *fakePackager) Package(targetFile string, machine vm.Machine) error {
+	f.packaged = append(f.packaged, targetFile)
+	return nil
+}
+
+func (f *fakePackager) Release() {
+	f.released = true
+}
+
+func TestPackagedImage(t *testing.T) {
+	t.Run("not-requested", func(t *testing.T) {
+		f := &fakePackager{}
+		p := newPackagedImage(f, vm.Machine{}, "/tmp/image.tar.zst")
+		p.Release()
+		require.Equal(t, errImageNotPackaged, <-p.result)
+		require.Empty(t, f.packaged)
+		require.True(t, f.released)
+	})
+
+	t.Run("requested", func(t *testing.T) {
+		f := &fakePackager{}
+		p := newPackagedImage(f, vm.Machine{}, "/tmp/image.tar.zst")
+		p.request.Set(true)
+		p.Release()
+		require.NoError(t, <-p.result)
+		require.Equal(t, []string{"/tmp/image.tar.zst"}, f.packaged)
+		require.True(t, f.released)
+	})
+}
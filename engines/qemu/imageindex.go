@@ -0,0 +1,48 @@
+package qemuengine
+
+import (
+	schematypes "github.com/taskcluster/go-schematypes"
+	"github.com/taskcluster/taskcluster-worker/runtime/util"
+)
+
+var indexImageSchema = schematypes.Object{
+	Title: "Fetch Image from Index",
+	Description: util.Markdown(`
+		Fetch image from an artifact of the task indexed under the 'index'
+		namespace. The namespace is resolved when the task is claimed, so tasks
+		can use the latest image without hardcoding a 'taskId'.
+	`),
+	Properties: schematypes.Properties{
+		"index": schematypes.String{
+			Title:         "Index Namespace",
+			Description:   "Index namespace of the task, such as `project.foo.latest`.",
+			Pattern:       `^[a-zA-Z0-9_!~*'().%-]+$`,
+			MaximumLength: 1024,
+		},
+		"artifact": schematypes.String{
+			Title:         "Artifact",
+			Description:   "Name of the image artifact, such as `public/image.tar.zst`.",
+			MaximumLength: 1024,
+		},
+	},
+	Required: []string{"index", "artifact"},
+}
+
+type indexImage struct {
+	Index    string `json:"index"`
+	Artifact string `json:"artifact"`
+}
+
+// resolveIndexImage returns the reference to be given to imageFetcher, if
+// image is a reference matching indexImageSchema, otherwise image is returned.
+func resolveIndexImage(image interface{}) interface{} {
+	if indexImageSchema.Validate(image) != nil {
+		return image
+	}
+	var i indexImage
+	schematypes.MustValidateAndMap(indexImageSchema, image, &i)
+	return map[string]interface{}{
+		"namespace": i.Index,
+		"artifact":  i.Artifact,
+	}
+}
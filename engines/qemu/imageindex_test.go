@@ -0,0 +1,31 @@
+package qemuengine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveIndexImage(t *testing.T) {
+	image := map[string]interface{}{
+		"index":    "project.foo.latest",
+		"artifact": "public/image.tar.zst",
+	}
+	require.NoError(t, imageSchema.Validate(image))
+	ref := resolveIndexImage(image)
+	require.Equal(t, map[string]interface{}{
+		"namespace": "project.foo.latest",
+		"artifact":  "public/image.tar.zst",
+	}, ref)
+	require.NoError(t, imageFetcher.Schema().Validate(ref))
+
+	// Other references are returned as is
+	url := "https://example.com/image.tar.zst"
+	require.Equal(t, url, resolveIndexImage(url))
+
+	// Index references can't satisfy requireImageDigest
+	v, err := newImageVerifier(nil, true)
+	require.NoError(t, err)
+	_, err = v.Resolve(image)
+	require.Error(t, err)
+}
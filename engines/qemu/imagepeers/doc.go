@@ -0,0 +1,18 @@
+// Package imagepeers implements sharing of cached images between workers on
+// the same network.
+//
+// Workers periodically broadcast the imageIDs of the images they have cached
+// over UDP, and serve the image files over HTTP on the same port number.
+// Before an image is fetched from its origin, it is fetched from peers that
+// have announced it, verifying the image file against the digest from the
+// imageID. Hence, only images identified by 'sha256=<hex>' or 'sha512=<hex>'
+// are shared, and peers can't serve other images than those requested.
+//
+// Images are served on the configured host interface, and requests and
+// announcements are only accepted from the subnets of that interface, never
+// from the subnets of virtual machines.
+package imagepeers
+
+import "github.com/taskcluster/taskcluster-worker/runtime/util"
+
+var debug = util.Debug("imagepeers")
@@ -0,0 +1,436 @@
+package imagepeers
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/slugid-go/slugid"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/fetcher"
+)
+
+// Defaults for Options
+const (
+	defaultBroadcastAddress = "255.255.255.255"
+	defaultInterval         = 30 * time.Second
+)
+
+// Peers are forgotten, if they haven't announced an image for this many
+// announcement intervals.
+const peerExpiration = 3
+
+// Maximum number of imageIDs in a single announcement, this keeps
+// announcements well below the maximum size of a UDP datagram.
+const maxImagesPerAnnouncement = 100
+
+// Maximum size of an announcement we'll read
+const maxAnnouncementSize = 64 * 1024
+
+// Timeout for checking that a peer still has an image before fetching it
+const peerCheckTimeout = 5 * time.Second
+
+// shareablePattern matches imageIDs that can be verified when fetched from
+// a peer, these are the HashKey() of fetcher.URLHash references with digest.
+var shareablePattern = regexp.MustCompile(`^(sha256=[0-9a-fA-F]{64}|sha512=[0-9a-fA-F]{128})$`)
+
+// ErrNoPeers is returned from FetchImage, if no peer could provide the image.
+var ErrNoPeers = errors.New("image isn't available from any peers")
+
+// An ImageSource provides image files to be shared with peers, this is
+// implemented by image.Manager.
+type ImageSource interface {
+	// ArchiveIDs returns imageIDs of images that can be opened with Archive()
+	ArchiveIDs() []string
+	// Archive opens the image file for imageID, returns nil if not present
+	Archive(imageID string) (*os.File, error)
+}
+
+// Options for New()
+type Options struct {
+	Interface        string          // Host network interface on which images are served
+	Port             int             // UDP port for announcements and TCP port for serving images
+	BroadcastAddress string          // Address announcements are sent to, defaults to 255.255.255.255
+	Interval         time.Duration   // Time between announcements, defaults to 30s
+	Images           ImageSource     // Images to share with peers
+	Monitor          runtime.Monitor // Monitor for reporting issues
+	Reject           []*net.IPNet    // Subnets of virtual machines, which must not access images
+}
+
+// announcement is the message broadcast to peers
+type announcement struct {
+	ID     string   `json:"id"`
+	Port   int      `json:"port"`
+	Images []string `json:"images"`
+}
+
+// peer is a worker that announced images
+type peer struct {
+	baseURL string
+	images  map[string]time.Time // imageID to time it was last announced
+}
+
+// Peers announces cached images to peers on the local network, serves the
+// images to peers and tracks images announced by peers.
+type Peers struct {
+	options   Options
+	id        string
+	port      int
+	conn      *net.UDPConn
+	broadcast *net.UDPAddr
+	subnets   []*net.IPNet // subnets of Interface, peers must be on one of these
+	server    *http.Server
+	m         sync.Mutex
+	peers     map[string]*peer
+	done      chan struct{}
+	wg        sync.WaitGroup
+}
+
+// New starts announcing and serving images from options.Images, and tracking
+// images announced by peers. If options.Port is zero a random port is used.
+//
+// Images are served on the IPv4 address of options.Interface, and only to
+// peers on the subnets of options.Interface, excluding options.Reject.
+func New(options Options) (*Peers, error) {
+	if options.BroadcastAddress == "" {
+		options.BroadcastAddress = defaultBroadcastAddress
+	}
+	if options.Interval == 0 {
+		options.Interval = defaultInterval
+	}
+	ip, subnets, err := interfaceAddress(options.Interface)
+	if err != nil {
+		return nil, err
+	}
+	for _, subnet := range options.Reject {
+		if subnet.Contains(ip) {
+			return nil, errors.Errorf("interface '%s' is on the virtual machine subnet %s", options.Interface, subnet)
+		}
+	}
+
+	// Listen for HTTP first, so the UDP port is the same, if Port is zero
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: ip, Port: options.Port})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to listen for image requests from peers")
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	// Broadcasts aren't delivered to sockets bound to a unicast address, so we
+	// listen on all interfaces and ignore announcements from other subnets.
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{Port: port})
+	if err != nil {
+		listener.Close()
+		return nil, errors.Wrap(err, "failed to listen for announcements from peers")
+	}
+	broadcast, err := net.ResolveUDPAddr("udp4", net.JoinHostPort(options.BroadcastAddress, strconv.Itoa(port)))
+	if err != nil {
+		listener.Close()
+		conn.Close()
+		return nil, errors.Wrap(err, "invalid broadcast address")
+	}
+
+	p := &Peers{
+		options:   options,
+		id:        slugid.Nice(),
+		port:      port,
+		conn:      conn,
+		broadcast: broadcast,
+		subnets:   subnets,
+		peers:     make(map[string]*peer),
+		done:      make(chan struct{}),
+	}
+	p.server = &http.Server{Handler: http.HandlerFunc(p.serveImage)}
+
+	p.wg.Add(3)
+	go func() {
+		defer p.wg.Done()
+		if serr := p.server.Serve(listener); serr != http.ErrServerClosed {
+			p.options.Monitor.ReportError(serr, "image server for peers stopped")
+		}
+	}()
+	go p.receiveAnnouncements()
+	go p.sendAnnouncements()
+
+	return p, nil
+}
+
+// interfaceAddress returns the first IPv4 address of the network interface
+// given by name, and the IPv4 subnets of the interface.
+func interfaceAddress(name string) (net.IP, []*net.IPNet, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to find interface '%s'", name)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed to list addresses of interface '%s'", name)
+	}
+	var ip net.IP
+	var subnets []*net.IPNet
+	for _, addr := range addrs {
+		if subnet, ok := addr.(*net.IPNet); ok && subnet.IP.To4() != nil {
+			if ip == nil {
+				ip = subnet.IP
+			}
+			subnets = append(subnets, subnet)
+		}
+	}
+	if ip == nil {
+		return nil, nil, errors.Errorf("interface '%s' doesn't have an IPv4 address", name)
+	}
+	return ip, subnets, nil
+}
+
+// isPeer returns true, if ip is on a subnet of the interface and not on a
+// subnet of virtual machines
+func (p *Peers) isPeer(ip net.IP) bool {
+	for _, subnet := range p.options.Reject {
+		if subnet.Contains(ip) {
+			return false
+		}
+	}
+	for _, subnet := range p.subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Port returns the port used for announcements and serving images
+func (p *Peers) Port() int {
+	return p.port
+}
+
+// Dispose stops announcing and serving images
+func (p *Peers) Dispose() error {
+	close(p.done)
+	err := p.server.Close()
+	if cerr := p.conn.Close(); err == nil {
+		err = cerr
+	}
+	p.wg.Wait()
+	return err
+}
+
+// FetchImage fetches the image file for imageID from peers to target. The
+// image file is verified against the digest from imageID, if no peer
+// provides a valid image file, this returns ErrNoPeers.
+func (p *Peers) FetchImage(ctx fetcher.Context, imageID string, target fetcher.WriteReseter) error {
+	if !shareablePattern.MatchString(imageID) {
+		return ErrNoPeers
+	}
+	digest := strings.SplitN(imageID, "=", 2)
+
+	for _, u := range p.find(imageID) {
+		// Check that the peer still has the image, as the request for the image
+		// is retried if the peer doesn't respond.
+		if !checkPeer(ctx, u) {
+			debug("peer %s no longer has image", u)
+			continue
+		}
+		ref, err := fetcher.URLHash.NewReference(ctx, map[string]interface{}{
+			"url":     u,
+			digest[0]: digest[1],
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to create reference for image from peer")
+		}
+		err = ref.Fetch(ctx, target)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		p.options.Monitor.Warnf("failed to fetch image from peer %s, error: %s", u, err)
+		if err = target.Reset(); err != nil {
+			return errors.Wrap(err, "failed to reset target")
+		}
+	}
+	return ErrNoPeers
+}
+
+// find returns URLs for imageID from peers that announced it, in random order
+func (p *Peers) find(imageID string) []string {
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	var urls []string
+	expired := time.Now().Add(-peerExpiration * p.options.Interval)
+	for id, pr := range p.peers {
+		for image, seen := range pr.images {
+			if seen.Before(expired) {
+				delete(pr.images, image)
+			}
+		}
+		if len(pr.images) == 0 {
+			delete(p.peers, id)
+			continue
+		}
+		if _, ok := pr.images[imageID]; ok {
+			urls = append(urls, pr.baseURL+"/images/"+imageID)
+		}
+	}
+	// Spread load between peers
+	rand.Shuffle(len(urls), func(i, j int) { urls[i], urls[j] = urls[j], urls[i] })
+	return urls
+}
+
+// checkPeer returns true, if u responds to a HEAD request with 200 OK
+func checkPeer(ctx fetcher.Context, u string) bool {
+	req, err := http.NewRequest(http.MethodHead, u, nil)
+	if err != nil {
+		return false
+	}
+	client := http.Client{Timeout: peerCheckTimeout}
+	res, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+	res.Body.Close()
+	return res.StatusCode == http.StatusOK
+}
+
+// serveImage serves image files as '/images/<imageID>'
+func (p *Peers) serveImage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil || !p.isPeer(net.ParseIP(host)) {
+		debug("request from forbidden remote address: %s", r.RemoteAddr)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	imageID := strings.TrimPrefix(r.URL.Path, "/images/")
+	if imageID == r.URL.Path || !shareablePattern.MatchString(imageID) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	f, err := p.options.Images.Archive(imageID)
+	if err != nil {
+		p.options.Monitor.ReportError(err, "failed to open image file for peer")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if f == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		p.options.Monitor.ReportError(err, "failed to stat image file for peer")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	debug("serving %s to %s", imageID, r.RemoteAddr)
+	// The ETag allows peers to resume ranged downloads
+	w.Header().Set("ETag", strconv.Quote(imageID))
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
+
+// sendAnnouncements announces images every interval, until disposed
+func (p *Peers) sendAnnouncements() {
+	defer p.wg.Done()
+	for {
+		if err := p.announce(); err != nil {
+			p.options.Monitor.Warn("failed to announce images to peers, error: ", err)
+		}
+		select {
+		case <-p.done:
+			return
+		case <-time.After(p.options.Interval):
+		}
+	}
+}
+
+// announce broadcasts the shareable images, in chunks if necessary
+func (p *Peers) announce() error {
+	var images []string
+	for _, imageID := range p.options.Images.ArchiveIDs() {
+		if shareablePattern.MatchString(imageID) {
+			images = append(images, imageID)
+		}
+	}
+	for len(images) > 0 {
+		n := len(images)
+		if n > maxImagesPerAnnouncement {
+			n = maxImagesPerAnnouncement
+		}
+		data, err := json.Marshal(announcement{
+			ID:     p.id,
+			Port:   p.port,
+			Images: images[:n],
+		})
+		if err != nil {
+			panic(errors.Wrap(err, "failed to marshal announcement"))
+		}
+		if _, err = p.conn.WriteToUDP(data, p.broadcast); err != nil {
+			return err
+		}
+		images = images[n:]
+	}
+	return nil
+}
+
+// receiveAnnouncements reads announcements, until disposed
+func (p *Peers) receiveAnnouncements() {
+	defer p.wg.Done()
+	buf := make([]byte, maxAnnouncementSize)
+	for {
+		n, addr, err := p.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-p.done:
+			default:
+				p.options.Monitor.ReportError(err, "failed to read announcements from peers")
+			}
+			return
+		}
+		if !p.isPeer(addr.IP) {
+			debug("ignoring announcement from %s, not on the interface subnets", addr)
+			continue
+		}
+		var a announcement
+		if err = json.Unmarshal(buf[:n], &a); err != nil {
+			debug("ignoring invalid announcement from %s, error: %s", addr, err)
+			continue
+		}
+		p.handleAnnouncement(a, addr.IP)
+	}
+}
+
+// handleAnnouncement records the images announced by the peer at ip
+func (p *Peers) handleAnnouncement(a announcement, ip net.IP) {
+	if a.ID == p.id || a.ID == "" || a.Port <= 0 || a.Port > 65535 {
+		return
+	}
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	baseURL := fmt.Sprintf("http://%s", net.JoinHostPort(ip.String(), strconv.Itoa(a.Port)))
+	pr := p.peers[a.ID]
+	if pr == nil || pr.baseURL != baseURL {
+		pr = &peer{baseURL: baseURL, images: make(map[string]time.Time)}
+		p.peers[a.ID] = pr
+	}
+	now := time.Now()
+	for _, imageID := range a.Images {
+		if shareablePattern.MatchString(imageID) {
+			pr.images[imageID] = now
+		}
+	}
+}
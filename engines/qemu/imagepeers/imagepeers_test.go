@@ -0,0 +1,191 @@
+package imagepeers
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/runtime/client"
+	"github.com/taskcluster/taskcluster-worker/runtime/mocks"
+)
+
+type fakeImages struct {
+	files map[string]string // imageID to file path
+}
+
+func (f *fakeImages) ArchiveIDs() []string {
+	var ids []string
+	for id := range f.files {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (f *fakeImages) Archive(imageID string) (*os.File, error) {
+	file, ok := f.files[imageID]
+	if !ok {
+		return nil, nil
+	}
+	return os.Open(file)
+}
+
+type fakeContext struct {
+	context.Context
+}
+
+func (c *fakeContext) Queue() client.Queue {
+	return nil
+}
+
+func (c *fakeContext) Progress(description string, percent float64) {}
+
+type bufferReseter struct {
+	bytes.Buffer
+}
+
+func (b *bufferReseter) Reset() error {
+	b.Buffer.Reset()
+	return nil
+}
+
+func TestPeers(t *testing.T) {
+	folder, err := ioutil.TempDir("", "imagepeers-")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+
+	// Create an image file and an image with the wrong contents
+	data := make([]byte, 256*1024)
+	_, err = rand.Read(data)
+	require.NoError(t, err)
+	h := sha256.Sum256(data)
+	imageID := "sha256=" + hex.EncodeToString(h[:])
+	wrongID := "sha256=" + hex.EncodeToString(make([]byte, 32))
+	imageFile := filepath.Join(folder, "image.tar.zst")
+	require.NoError(t, ioutil.WriteFile(imageFile, data, 0600))
+
+	monitor := mocks.NewMockMonitor(true)
+	a, err := New(Options{
+		Interface: "lo",
+		Images: &fakeImages{files: map[string]string{
+			imageID:    imageFile,
+			wrongID:    imageFile,
+			"url:test": imageFile,
+		}},
+		Monitor: monitor,
+	})
+	require.NoError(t, err)
+	defer a.Dispose()
+	b, err := New(Options{
+		Interface: "lo",
+		Images:    &fakeImages{},
+		Monitor:   monitor,
+	})
+	require.NoError(t, err)
+	defer b.Dispose()
+
+	// Send announcement from a to b
+	a.broadcast = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: b.Port()}
+	require.NoError(t, a.announce())
+	for i := 0; len(b.find(imageID)) == 0; i++ {
+		require.True(t, i < 100, "expected announcement from a")
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.Len(t, b.find(wrongID), 1)
+	require.Len(t, b.find("url:test"), 0, "only images with digest are shared")
+
+	ctx := &fakeContext{Context: context.Background()}
+
+	t.Run("fetch image", func(t *testing.T) {
+		var target bufferReseter
+		require.NoError(t, b.FetchImage(ctx, imageID, &target))
+		require.True(t, bytes.Equal(data, target.Bytes()), "wrong image data")
+	})
+
+	t.Run("invalid image from peer", func(t *testing.T) {
+		var target bufferReseter
+		require.Equal(t, ErrNoPeers, b.FetchImage(ctx, wrongID, &target))
+		require.Equal(t, 0, target.Len())
+	})
+
+	t.Run("image not announced", func(t *testing.T) {
+		var target bufferReseter
+		require.Equal(t, ErrNoPeers, a.FetchImage(ctx, imageID, &target))
+	})
+
+	t.Run("ignore own announcements", func(t *testing.T) {
+		a.handleAnnouncement(announcement{ID: a.id, Port: a.Port(), Images: []string{imageID}}, net.IPv4(127, 0, 0, 1))
+		require.Len(t, a.find(imageID), 0)
+	})
+
+	t.Run("reject requests from other subnets", func(t *testing.T) {
+		for _, remoteAddr := range []string{"192.168.150.2:4242", "10.0.0.1:4242"} {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "/images/"+imageID, nil)
+			r.RemoteAddr = remoteAddr
+			a.serveImage(w, r)
+			require.Equal(t, http.StatusForbidden, w.Code, "expected request from %s to be rejected", remoteAddr)
+		}
+	})
+
+	t.Run("announcements expire", func(t *testing.T) {
+		b.m.Lock()
+		for _, pr := range b.peers {
+			for id := range pr.images {
+				pr.images[id] = time.Now().Add(-peerExpiration * b.options.Interval)
+			}
+		}
+		b.m.Unlock()
+		require.Len(t, b.find(imageID), 0)
+		b.m.Lock()
+		require.Len(t, b.peers, 0)
+		b.m.Unlock()
+	})
+}
+
+func TestPeersReject(t *testing.T) {
+	monitor := mocks.NewMockMonitor(true)
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	_, err = New(Options{
+		Interface: "lo",
+		Images:    &fakeImages{},
+		Monitor:   monitor,
+		Reject:    []*net.IPNet{loopback},
+	})
+	require.Error(t, err, "expected interface on a rejected subnet to fail")
+
+	_, guest, err := net.ParseCIDR("127.0.150.0/24")
+	require.NoError(t, err)
+	p, err := New(Options{
+		Interface: "lo",
+		Images:    &fakeImages{},
+		Monitor:   monitor,
+		Reject:    []*net.IPNet{guest},
+	})
+	require.NoError(t, err)
+	defer p.Dispose()
+	require.True(t, p.isPeer(net.IPv4(127, 0, 0, 1)))
+	require.False(t, p.isPeer(net.IPv4(127, 0, 150, 2)), "expected rejected subnet to be ignored")
+	require.False(t, p.isPeer(net.IPv4(192, 168, 150, 2)), "expected other subnets to be ignored")
+
+	// Announcements from rejected subnets are ignored
+	conn, err := net.DialUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 150, 2)}, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: p.Port()})
+	require.NoError(t, err)
+	defer conn.Close()
+	imageID := "sha256=" + hex.EncodeToString(make([]byte, 32))
+	_, err = conn.Write([]byte(`{"id":"guest","port":4242,"images":["` + imageID + `"]}`))
+	require.NoError(t, err)
+	time.Sleep(50 * time.Millisecond)
+	require.Len(t, p.find(imageID), 0)
+}
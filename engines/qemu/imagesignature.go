@@ -0,0 +1,161 @@
+package qemuengine
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+	schematypes "github.com/taskcluster/go-schematypes"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/util"
+	"golang.org/x/crypto/ed25519"
+)
+
+var signedImageSchema = schematypes.Object{
+	Title: "Fetch Signed Image from URL",
+	Description: util.Markdown(`
+		Fetch image from a URL, validate it against the given digest and check
+		that the digest is signed with one of the 'imageSigningKeys' configured
+		for the worker.
+
+		The 'signature' is a base64 encoded ed25519 signature of the string
+		'sha512:<hex>', if 'sha512' is given, otherwise 'sha256:<hex>', where
+		'<hex>' is the digest in lower case hexadecimal notation.
+	`),
+	Properties: schematypes.Properties{
+		"url": schematypes.URI{
+			Title:       "URL",
+			Description: "URL to fetch image from, this must be `http://` or `https://`.",
+		},
+		"sha256": schematypes.String{
+			Title:   "SHA256 as hex",
+			Pattern: `^[0-9a-fA-F]{64}$`,
+		},
+		"sha512": schematypes.String{
+			Title:   "SHA512 as hex",
+			Pattern: `^[0-9a-fA-F]{128}$`,
+		},
+		"signature": schematypes.String{
+			Title:   "Ed25519 Signature as base64",
+			Pattern: `^[A-Za-z0-9+/]{86}==$`,
+		},
+	},
+	Required: []string{"url", "signature"},
+}
+
+// imageSchema is the schema for the image property in the payload
+var imageSchema = schematypes.OneOf{
+	imageFetcher.Schema(),
+	signedImageSchema,
+	indexImageSchema,
+}
+
+type signedImage struct {
+	URL       string `json:"url"`
+	SHA256    string `json:"sha256"`
+	SHA512    string `json:"sha512"`
+	Signature string `json:"signature"`
+}
+
+// message returns the message signed by the signature
+func (s *signedImage) message() (string, error) {
+	if s.SHA512 != "" {
+		return "sha512:" + strings.ToLower(s.SHA512), nil
+	}
+	if s.SHA256 != "" {
+		return "sha256:" + strings.ToLower(s.SHA256), nil
+	}
+	return "", errors.New("signed images must specify 'sha256' or 'sha512'")
+}
+
+// imageVerifier checks that image references in task payloads satisfy the
+// 'requireImageDigest' and 'imageSigningKeys' options, before images are
+// fetched.
+type imageVerifier struct {
+	keys          []ed25519.PublicKey
+	requireDigest bool
+}
+
+// newImageVerifier returns an imageVerifier for base64 encoded ed25519 keys
+func newImageVerifier(keys []string, requireDigest bool) (*imageVerifier, error) {
+	v := &imageVerifier{requireDigest: requireDigest}
+	for i, k := range keys {
+		key, err := base64.StdEncoding.DecodeString(k)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.Errorf("imageSigningKeys[%d] isn't a base64 encoded ed25519 public key", i)
+		}
+		v.keys = append(v.keys, ed25519.PublicKey(key))
+	}
+	return v, nil
+}
+
+// Resolve returns the reference to be given to imageFetcher, or a
+// MalformedPayloadError if image doesn't satisfy the requirements. Digests are
+// verified by imageFetcher when the image is downloaded, and images are
+// cached by digest, so a signed digest covers cached images too.
+func (v *imageVerifier) Resolve(image interface{}) (interface{}, error) {
+	if signedImageSchema.Validate(image) != nil {
+		if len(v.keys) > 0 {
+			return nil, runtime.NewMalformedPayloadError(
+				"this worker requires images to be signed, 'image' must specify 'signature'",
+			)
+		}
+		if v.requireDigest && !hasImageDigest(image) {
+			return nil, runtime.NewMalformedPayloadError(
+				"this worker requires 'image' to be given as 'url' with 'sha256' or 'sha512'",
+			)
+		}
+		return resolveIndexImage(image), nil
+	}
+
+	var s signedImage
+	schematypes.MustValidateAndMap(signedImageSchema, image, &s)
+	if len(v.keys) == 0 {
+		return nil, runtime.NewMalformedPayloadError(
+			"'image.signature' can't be checked, as this worker has no 'imageSigningKeys'",
+		)
+	}
+	message, err := s.message()
+	if err != nil {
+		return nil, runtime.NewMalformedPayloadError(err.Error())
+	}
+	signature, _ := base64.StdEncoding.DecodeString(s.Signature) // validated by schema
+	if !v.verify([]byte(message), signature) {
+		return nil, runtime.NewMalformedPayloadError(fmt.Sprintf(
+			"'image.signature' isn't a valid signature of '%s' for any of the imageSigningKeys", message,
+		))
+	}
+
+	// Return reference without signature, so it's fetched and cached like any
+	// other image with the same digest
+	ref := map[string]interface{}{"url": s.URL}
+	if s.SHA256 != "" {
+		ref["sha256"] = s.SHA256
+	}
+	if s.SHA512 != "" {
+		ref["sha512"] = s.SHA512
+	}
+	return ref, nil
+}
+
+func (v *imageVerifier) verify(message, signature []byte) bool {
+	for _, key := range v.keys {
+		if ed25519.Verify(key, message, signature) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasImageDigest returns true, if image is a reference with sha256 or sha512
+func hasImageDigest(image interface{}) bool {
+	m, ok := image.(map[string]interface{})
+	if !ok {
+		return false
+	}
+	_, hasURL := m["url"]
+	sha256, _ := m["sha256"].(string)
+	sha512, _ := m["sha512"].(string)
+	return hasURL && (sha256 != "" || sha512 != "")
+}
@@ -0,0 +1,99 @@
+package qemuengine
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestImageVerifier(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	sha256 := strings.Repeat("ab", 32)
+	sha512 := strings.Repeat("CD", 64)
+	sign := func(message string) string {
+		return base64.StdEncoding.EncodeToString(ed25519.Sign(private, []byte(message)))
+	}
+	requireMalformed := func(image interface{}, v *imageVerifier) {
+		_, err := v.Resolve(image)
+		_, ok := runtime.IsMalformedPayloadError(err)
+		require.True(t, ok, "expected MalformedPayloadError, got: %v", err)
+	}
+
+	t.Run("invalid keys", func(t *testing.T) {
+		_, err := newImageVerifier([]string{"not-a-key"}, false)
+		require.Error(t, err)
+	})
+
+	t.Run("no requirements", func(t *testing.T) {
+		v, err := newImageVerifier(nil, false)
+		require.NoError(t, err)
+		image := "https://example.com/image.tar.zst"
+		ref, err := v.Resolve(image)
+		require.NoError(t, err)
+		require.Equal(t, image, ref)
+		requireMalformed(map[string]interface{}{
+			"url":       "https://example.com/image.tar.zst",
+			"sha256":    sha256,
+			"signature": sign("sha256:" + sha256),
+		}, v)
+	})
+
+	t.Run("require digest", func(t *testing.T) {
+		v, err := newImageVerifier(nil, true)
+		require.NoError(t, err)
+		requireMalformed("https://example.com/image.tar.zst", v)
+		requireMalformed(map[string]interface{}{
+			"taskId":   "Q5DRgeHmTXqSWnt1hJIWRw",
+			"artifact": "public/image.tar.zst",
+		}, v)
+		image := map[string]interface{}{
+			"url":    "https://example.com/image.tar.zst",
+			"sha512": sha512,
+		}
+		ref, err := v.Resolve(image)
+		require.NoError(t, err)
+		require.Equal(t, image, ref)
+	})
+
+	t.Run("require signature", func(t *testing.T) {
+		key := base64.StdEncoding.EncodeToString(public)
+		v, err := newImageVerifier([]string{key}, false)
+		require.NoError(t, err)
+
+		ref, err := v.Resolve(map[string]interface{}{
+			"url":       "https://example.com/image.tar.zst",
+			"sha256":    sha256,
+			"sha512":    sha512,
+			"signature": sign("sha512:" + strings.ToLower(sha512)),
+		})
+		require.NoError(t, err)
+		require.Equal(t, map[string]interface{}{
+			"url":    "https://example.com/image.tar.zst",
+			"sha256": sha256,
+			"sha512": sha512,
+		}, ref)
+
+		// The signature must cover sha512, if given
+		requireMalformed(map[string]interface{}{
+			"url":       "https://example.com/image.tar.zst",
+			"sha256":    sha256,
+			"sha512":    sha512,
+			"signature": sign("sha256:" + sha256),
+		}, v)
+		// Signature without digest
+		requireMalformed(map[string]interface{}{
+			"url":       "https://example.com/image.tar.zst",
+			"signature": sign(""),
+		}, v)
+		// Unsigned images
+		requireMalformed(map[string]interface{}{
+			"url":    "https://example.com/image.tar.zst",
+			"sha256": sha256,
+		}, v)
+	})
+}
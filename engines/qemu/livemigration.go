@@ -0,0 +1,142 @@
+package qemuengine
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/engines"
+)
+
+// migrationState is the engine specific state given to the target host, when
+// migrating a sandbox to another host.
+type migrationState struct {
+	// Token for the meta-data service, this must be the same on the target host
+	// as the guest has already read it.
+	Token string `json:"token,omitempty"`
+}
+
+// Migrate moves the running virtual machine to another host, see
+// engines.Sandbox.Migrate().
+func (s *sandbox) Migrate(target engines.MigrationTarget) error {
+	if s.resolve.IsDone() {
+		return engines.ErrSandboxTerminated
+	}
+	if s.pending.Get() {
+		return errors.New("the sandbox is being migrated from another host")
+	}
+	// Recordings and images built from the disk are uploaded when the task is
+	// done, so they can't be continued on another host
+	if s.recorder != nil || s.audio != "" || s.capture != nil {
+		return errors.New("tasks recording the screen, audio or network traffic can't be migrated")
+	}
+	if s.packaged != nil {
+		return errors.New("tasks building an image can't be migrated")
+	}
+	if err := s.vm.CanMigrate(); err != nil {
+		return err
+	}
+	if s.migrating.Swap(true) {
+		return errors.New("the sandbox is already being migrated")
+	}
+	defer s.migrating.Set(false)
+
+	state, _ := json.Marshal(migrationState{Token: s.token})
+	if err := target.Prepare(state); err != nil {
+		return errors.Wrap(err, "target host failed to prepare for migration")
+	}
+
+	s.context.Log("Migrating virtual machine to another host")
+	if err := s.transfer(target); err != nil {
+		target.Abort()
+		s.context.LogError("Migration of virtual machine failed, the task continues on this host")
+		return err
+	}
+
+	// The guest may have reported the result, before it was paused
+	if s.metaService.Resolved() || s.resolve.IsDone() {
+		target.Abort()
+		s.resume()
+		return errors.New("the task was resolved while migrating")
+	}
+
+	if err := target.Commit(); err != nil {
+		s.resume()
+		s.context.LogError("Migration of virtual machine failed, the task continues on this host")
+		return errors.Wrap(err, "target host failed to resume the virtual machine")
+	}
+
+	// Execution continues on the target host, so we stop the virtual machine
+	// without uploading anything
+	if !s.resolve.Do(func() {
+		s.sessions.AbortSessions()
+		s.resultError = engines.ErrSandboxMigrated
+		s.resultAbort = engines.ErrSandboxTerminated
+	}) {
+		s.monitor.Warn("sandbox was resolved while committing migration to another host")
+	}
+	s.context.Log("Virtual machine was migrated, the task continues on another host")
+	s.vm.Quit()
+	return nil
+}
+
+// transfer writes the virtual machine to the stream from target. If this
+// returns nil, the virtual machine is paused, and must be resumed or stopped.
+func (s *sandbox) transfer(target engines.MigrationTarget) error {
+	stream, err := target.Transfer()
+	if err != nil {
+		return errors.Wrap(err, "failed to open migration stream to target host")
+	}
+	err = s.vm.Migrate(stream)
+	cerr := stream.Close()
+	if err != nil {
+		return errors.Wrap(err, "failed to migrate virtual machine")
+	}
+	if cerr != nil {
+		s.resume()
+		return errors.Wrap(cerr, "target host failed to load the virtual machine")
+	}
+	return nil
+}
+
+// resume execution after a migration that completed, but wasn't committed. If
+// this fails the virtual machine is killed, as the task can't continue.
+func (s *sandbox) resume() {
+	if err := s.vm.Resume(); err != nil {
+		s.monitor.ReportError(err, "failed to resume virtual machine after migration failed")
+		s.vm.Kill()
+	}
+}
+
+// receiveMigration loads the virtual machine from the source host, and starts
+// execution when the task has been handed over. If the migration fails, the
+// sandbox is discarded without uploading anything, as the task remains on the
+// source host.
+func (s *sandbox) receiveMigration(m engines.IncomingMigration) {
+	stream, done, err := m.Receive()
+	if err == nil {
+		err = s.vm.ReceiveMigration(stream)
+		done(err)
+	}
+	if err == nil {
+		err = m.Committed()
+	}
+	if err == nil {
+		s.pending.Set(false)
+		err = s.vm.ResumeMigration()
+		if err == nil {
+			s.context.Log("Virtual machine was migrated from another host, the task continues on this host")
+			return
+		}
+		// The task was handed over, so the sandbox is resolved as if QEMU crashed
+		s.monitor.ReportError(err, "failed to resume virtual machine migrated from another host")
+		s.vm.Kill()
+		return
+	}
+
+	s.monitor.Info("migration from another host failed, error: ", err)
+	s.resolve.Do(func() {
+		s.sessions.AbortSessions()
+		s.resultError = engines.ErrSandboxAborted
+	})
+	s.vm.Kill()
+}
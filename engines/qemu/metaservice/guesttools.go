@@ -0,0 +1,77 @@
+package metaservice
+
+import (
+	"net/http"
+	"os"
+)
+
+// SetGuestTools offers the guest-tools binary in file to the guest, such that
+// guest-tools with another revision can replace themselves at boot. The file
+// must not be modified while the MetaService is in use.
+func (s *MetaService) SetGuestTools(info GuestTools, file string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.guestTools = &info
+	s.guestToolsFile = file
+}
+
+// handleGuestTools handles GET /engine/v1/guest-tools
+func (s *MetaService) handleGuestTools(w http.ResponseWriter, r *http.Request) {
+	if !forceMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	debug("GET /engine/v1/guest-tools")
+	s.m.Lock()
+	info := s.guestTools
+	s.m.Unlock()
+	if info == nil {
+		reply(w, http.StatusNotFound, Error{
+			Code:    ErrorCodeNotFound,
+			Message: "The host doesn't offer guest-tools",
+		})
+		return
+	}
+	reply(w, http.StatusOK, info)
+}
+
+// handleGuestToolsBinary handles GET /engine/v1/guest-tools/binary
+func (s *MetaService) handleGuestToolsBinary(w http.ResponseWriter, r *http.Request) {
+	if !forceMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	debug("GET /engine/v1/guest-tools/binary")
+	s.m.Lock()
+	file := s.guestToolsFile
+	s.m.Unlock()
+	if file == "" {
+		reply(w, http.StatusNotFound, Error{
+			Code:    ErrorCodeNotFound,
+			Message: "The host doesn't offer guest-tools",
+		})
+		return
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		debug("Failed to open guest-tools binary: %s, error: %s", file, err)
+		reply(w, http.StatusInternalServerError, Error{
+			Code:    ErrorCodeInternalError,
+			Message: "Failed to read guest-tools binary",
+		})
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		reply(w, http.StatusInternalServerError, Error{
+			Code:    ErrorCodeInternalError,
+			Message: "Failed to read guest-tools binary",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", info.ModTime(), f)
+}
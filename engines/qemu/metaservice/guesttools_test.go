@@ -0,0 +1,53 @@
+package metaservice
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+func TestMetaServiceGuestTools(t *testing.T) {
+	storage, err := runtime.NewTemporaryStorage(os.TempDir())
+	nilOrFatal(t, err)
+	s := New([]string{"true"}, make(map[string]string), ioutil.Discard, func(bool) {}, &runtime.Environment{
+		TemporaryStorage: storage,
+	})
+
+	// Without guest-tools nothing is offered
+	w := doRequest(t, s, "GET", "/engine/v1/guest-tools", nil)
+	assert(t, w.Code == http.StatusNotFound)
+	w = doRequest(t, s, "GET", "/engine/v1/guest-tools/binary", nil)
+	assert(t, w.Code == http.StatusNotFound)
+
+	folder, err := storage.NewFolder()
+	nilOrFatal(t, err)
+	defer folder.Remove()
+	file := filepath.Join(folder.Path(), "taskcluster-worker")
+	nilOrFatal(t, ioutil.WriteFile(file, []byte("binary"), 0755))
+
+	s.SetGuestTools(GuestTools{
+		Revision: "2b9e2f8fbe2a6a35a5c4e7b8a5d9c3e1f0a1b2c3",
+		OS:       "linux",
+		Arch:     "amd64",
+		Size:     6,
+	}, file)
+
+	w = doRequest(t, s, "GET", "/engine/v1/guest-tools", nil)
+	assert(t, w.Code == http.StatusOK)
+	var info GuestTools
+	nilOrFatal(t, json.Unmarshal(w.Body.Bytes(), &info), "Failed to decode JSON")
+	assert(t, info.Revision == "2b9e2f8fbe2a6a35a5c4e7b8a5d9c3e1f0a1b2c3")
+	assert(t, info.OS == "linux" && info.Arch == "amd64")
+
+	w = doRequest(t, s, "GET", "/engine/v1/guest-tools/binary", nil)
+	assert(t, w.Code == http.StatusOK)
+	assert(t, w.Body.String() == "binary", "unexpected binary: ", w.Body.String())
+
+	w = doRequest(t, s, "PUT", "/engine/v1/guest-tools", nil)
+	assert(t, w.Code == http.StatusMethodNotAllowed)
+}
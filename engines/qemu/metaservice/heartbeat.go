@@ -0,0 +1,36 @@
+package metaservice
+
+import (
+	"net/http"
+	"time"
+)
+
+// HeartbeatInterval is the interval at which the guest sends heartbeats, while
+// the command is running.
+const HeartbeatInterval = 15 * time.Second
+
+// LastHeartbeat returns the time of the last heartbeat from the guest, and
+// false if the guest hasn't sent a heartbeat or has reported the result, as
+// the guest isn't expected to send heartbeats in either case.
+func (s *MetaService) LastHeartbeat() (time.Time, bool) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.lastHeartbeat.IsZero() || s.resolved {
+		return time.Time{}, false
+	}
+	return s.lastHeartbeat, true
+}
+
+// handleHeartbeat handles PUT /engine/v1/heartbeat
+func (s *MetaService) handleHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if !forceMethod(w, r, http.MethodPut) {
+		return
+	}
+
+	debug("PUT /engine/v1/heartbeat")
+	s.m.Lock()
+	s.lastHeartbeat = time.Now()
+	s.m.Unlock()
+
+	reply(w, http.StatusOK, nil)
+}
@@ -0,0 +1,32 @@
+package metaservice
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+func TestMetaServiceHeartbeat(t *testing.T) {
+	storage, err := runtime.NewTemporaryStorage(os.TempDir())
+	nilOrFatal(t, err)
+	s := New([]string{"true"}, make(map[string]string), ioutil.Discard, func(bool) {}, &runtime.Environment{
+		TemporaryStorage: storage,
+	})
+
+	_, ok := s.LastHeartbeat()
+	assert(t, !ok, "Expected no heartbeat")
+
+	w := doRequest(t, s, "PUT", "/engine/v1/heartbeat", nil)
+	assert(t, w.Code == http.StatusOK)
+	last, ok := s.LastHeartbeat()
+	assert(t, ok && !last.IsZero(), "Expected a heartbeat")
+
+	// Heartbeats aren't expected after the result is reported
+	w = doRequest(t, s, "PUT", "/engine/v1/failed", nil)
+	assert(t, w.Code == http.StatusOK)
+	_, ok = s.LastHeartbeat()
+	assert(t, !ok, "Expected no heartbeat after result")
+}
@@ -1,11 +1,13 @@
 package metaservice
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -45,6 +47,18 @@ type MetaService struct {
 	pendingRecords  map[string]*asyncRecord
 	mPendingRecords sync.Mutex
 	haltPolling     chan struct{} // Closed when polling should stop (for tests)
+	uploadArtifact  func(runtime.S3Artifact) error
+	mounts          []Mount
+	ports           []engines.PortForward
+	token           string // Bearer token required by end-points, if not empty
+	uploads         map[string]*upload
+	disposed        bool // true, if uploads may no longer be created
+	fetchSecret     func(name string) ([]byte, error)
+	reportProgress  func(Progress)
+	summary         json.RawMessage
+	lastHeartbeat   time.Time
+	guestTools      *GuestTools
+	guestToolsFile  string
 }
 
 // New returns a new MetaService that will tell the virtual machine to
@@ -67,6 +81,7 @@ func New(
 		actionOut:      make(chan Action),
 		pendingRecords: make(map[string]*asyncRecord),
 		haltPolling:    make(chan struct{}),
+		uploads:        make(map[string]*upload),
 	}
 
 	s.mux.HandleFunc("/engine/v1/execute", s.handleExecute)
@@ -76,6 +91,15 @@ func New(
 	s.mux.HandleFunc("/engine/v1/poll", s.handlePoll)
 	s.mux.HandleFunc("/engine/v1/reply", s.handleReply)
 	s.mux.HandleFunc("/engine/v1/ping", s.handlePing)
+	s.mux.HandleFunc("/engine/v1/artifact", s.handleArtifact)
+	s.mux.HandleFunc("/engine/v1/upload", s.handleCreateUpload)
+	s.mux.HandleFunc("/engine/v1/upload/", s.handleUpload)
+	s.mux.HandleFunc("/engine/v1/secret", s.handleSecret)
+	s.mux.HandleFunc("/engine/v1/progress", s.handleProgress)
+	s.mux.HandleFunc("/engine/v1/summary", s.handleSummary)
+	s.mux.HandleFunc("/engine/v1/heartbeat", s.handleHeartbeat)
+	s.mux.HandleFunc("/engine/v1/guest-tools", s.handleGuestTools)
+	s.mux.HandleFunc("/engine/v1/guest-tools/binary", s.handleGuestToolsBinary)
 	s.mux.HandleFunc("/", s.handleUnknown)
 
 	return s
@@ -83,9 +107,42 @@ func New(
 
 // ServeHTTP handles request to the meta-data service.
 func (s *MetaService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		debug("Unauthorized request: %s %s", r.Method, r.URL.Path)
+		reply(w, http.StatusUnauthorized, Error{
+			Code:    ErrorCodeUnauthorized,
+			Message: "This meta-data API end-point requires 'Authorization: Bearer <token>'",
+		})
+		return
+	}
 	s.mux.ServeHTTP(w, r)
 }
 
+// SetToken requires requests to carry the header 'Authorization: Bearer <token>'
+// for all end-points, except /engine/v1/ping. This must be called before the
+// guest is started, an empty token disables the requirement.
+func (s *MetaService) SetToken(token string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.token = token
+}
+
+// authorized returns true, if r carries the token set with SetToken()
+func (s *MetaService) authorized(r *http.Request) bool {
+	s.m.Lock()
+	token := s.token
+	s.m.Unlock()
+
+	if token == "" || r.URL.Path == "/engine/v1/ping" {
+		return true
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(token)) == 1
+}
+
 // reply will write status and response to ResponseWriter.
 func reply(w http.ResponseWriter, status int, response interface{}) error {
 	var data []byte
@@ -121,9 +178,15 @@ func (s *MetaService) handleExecute(w http.ResponseWriter, r *http.Request) {
 	}
 
 	debug("GET /engine/v1/execute")
+	s.m.Lock()
+	mounts := s.mounts
+	ports := s.ports
+	s.m.Unlock()
 	reply(w, http.StatusOK, Execute{
 		Command: s.command,
 		Env:     s.env,
+		Mounts:  mounts,
+		Ports:   ports,
 	})
 }
 
@@ -204,6 +267,114 @@ func (s *MetaService) handleFailed(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Resolved returns true, if the guest has reported the result of the command.
+func (s *MetaService) Resolved() bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.resolved
+}
+
+// SetArtifactUploader sets the function used to upload artifacts pushed by
+// the guest, if not set the guest cannot upload artifacts.
+func (s *MetaService) SetArtifactUploader(upload func(runtime.S3Artifact) error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.uploadArtifact = upload
+}
+
+// SetMounts sets the shared folders and disk volumes the guest should mount
+// before executing the command.
+func (s *MetaService) SetMounts(mounts []Mount) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.mounts = mounts
+}
+
+// SetPortForwards sets the ports forwarded from the host to the guest, these
+// are reported to the guest with the command.
+func (s *MetaService) SetPortForwards(ports []engines.PortForward) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.ports = ports
+}
+
+// handleArtifact handles PUT /engine/v1/artifact?name=<name>
+func (s *MetaService) handleArtifact(w http.ResponseWriter, r *http.Request) {
+	if !forceMethod(w, r, http.MethodPut) {
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	debug("PUT /engine/v1/artifact?name=%s", name)
+	if name == "" || strings.HasPrefix(name, "/") {
+		reply(w, http.StatusBadRequest, Error{
+			Code:    ErrorCodeInvalidPayload,
+			Message: "The querystring parameter 'name' must be a valid artifact name",
+		})
+		return
+	}
+
+	s.m.Lock()
+	upload := s.uploadArtifact
+	s.m.Unlock()
+	if upload == nil {
+		reply(w, http.StatusNotFound, Error{
+			Code:    ErrorCodeNoSuchEndPoint,
+			Message: "Uploading artifacts from the guest isn't supported",
+		})
+		return
+	}
+
+	if replyTooLarge(w, r.ContentLength, nil) {
+		return
+	}
+
+	// Buffer the artifact to a temporary file, as we need to know the size
+	// before uploading, and may have to retry the upload
+	f, err := s.environment.TemporaryStorage.NewFile()
+	if err != nil {
+		reply(w, http.StatusInternalServerError, Error{
+			Code:    ErrorCodeInternalError,
+			Message: fmt.Sprintf("Failed to create temporary file, error: %s", err),
+		})
+		return
+	}
+	defer f.Close()
+	size, err := io.Copy(f, io.LimitReader(r.Body, MaxArtifactSize+1))
+	if replyTooLarge(w, size, err) {
+		return
+	}
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		reply(w, http.StatusInternalServerError, Error{
+			Code:    ErrorCodeInternalError,
+			Message: fmt.Sprintf("Failed to receive artifact, error: %s", err),
+		})
+		return
+	}
+
+	mimetype := r.Header.Get("Content-Type")
+	if mimetype == "" {
+		mimetype = "application/octet-stream"
+	}
+	err = upload(runtime.S3Artifact{
+		Name:     name,
+		Mimetype: mimetype,
+		Stream:   f,
+	})
+	if err != nil {
+		reply(w, http.StatusInternalServerError, Error{
+			Code:    ErrorCodeInternalError,
+			Message: fmt.Sprintf("Failed to upload artifact '%s', error: %s", name, err),
+		})
+		return
+	}
+
+	reply(w, http.StatusOK, nil)
+}
+
 // handlePing handles ping requests
 func (s *MetaService) handlePing(w http.ResponseWriter, r *http.Request) {
 	if !forceMethod(w, r, http.MethodGet) {
@@ -549,6 +720,12 @@ func (s *MetaService) killProcessWithoutRetries() error {
 	return Err
 }
 
+// Dispose discards unfinished uploads, releasing their temporary files. This
+// should be called when the virtual machine is done.
+func (s *MetaService) Dispose() {
+	s.removeUploads()
+}
+
 // KillProcess will send an action to guest-tools to kill the process executing
 // the main command.
 //
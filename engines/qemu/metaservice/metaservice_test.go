@@ -49,11 +49,13 @@ func TestMetaService(t *testing.T) {
 	}
 
 	// Check that we can report success
+	assert(t, !s.Resolved(), "Expected not to be resolved before reporting success")
 	req, err = http.NewRequest("PUT", "http://169.254.169.254/engine/v1/success", nil)
 	nilOrFatal(t, err)
 	w = httptest.NewRecorder()
 	s.ServeHTTP(w, req)
 	assert(t, w.Code == http.StatusOK)
+	assert(t, s.Resolved(), "Expected to be resolved after reporting success")
 
 	// Check result
 	resolved.Wait()
@@ -348,3 +350,88 @@ func TestMetaServiceShell(t *testing.T) {
 	nilOrFatal(t, err, "Failed to readAll from stderr")
 	assert(t, string(b) == "", "Failed to read ''")
 }
+
+func TestMetaServiceUploadArtifact(t *testing.T) {
+	storage, err := runtime.NewTemporaryStorage(os.TempDir())
+	nilOrFatal(t, err)
+
+	log := bytes.NewBuffer(nil)
+	s := New([]string{"bash", "-c", "whoami"}, make(map[string]string), log, func(bool) {}, &runtime.Environment{
+		TemporaryStorage: storage,
+	})
+
+	// Without an uploader the end-point isn't supported
+	req, err := http.NewRequest("PUT", "http://169.254.169.254/engine/v1/artifact?name=public/hello.txt", bytes.NewBufferString("hello"))
+	nilOrFatal(t, err)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert(t, w.Code == http.StatusNotFound)
+
+	var uploaded runtime.S3Artifact
+	var data []byte
+	s.SetArtifactUploader(func(artifact runtime.S3Artifact) error {
+		uploaded = artifact
+		data, err = ioutil.ReadAll(artifact.Stream)
+		return err
+	})
+
+	// Upload an artifact
+	req, err = http.NewRequest("PUT", "http://169.254.169.254/engine/v1/artifact?name=public/hello.txt", bytes.NewBufferString("hello"))
+	nilOrFatal(t, err)
+	req.Header.Set("Content-Type", "text/plain")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert(t, w.Code == http.StatusOK)
+	assert(t, uploaded.Name == "public/hello.txt")
+	assert(t, uploaded.Mimetype == "text/plain")
+	assert(t, string(data) == "hello")
+
+	// Artifact name is required
+	req, err = http.NewRequest("PUT", "http://169.254.169.254/engine/v1/artifact", bytes.NewBufferString("hello"))
+	nilOrFatal(t, err)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert(t, w.Code == http.StatusBadRequest)
+}
+
+func TestMetaServiceToken(t *testing.T) {
+	storage, err := runtime.NewTemporaryStorage(os.TempDir())
+	nilOrFatal(t, err)
+	s := New([]string{"true"}, make(map[string]string), ioutil.Discard, func(r bool) {}, &runtime.Environment{
+		TemporaryStorage: storage,
+	})
+	s.SetToken("secret-token")
+
+	// Ping doesn't require the token
+	req, err := http.NewRequest("GET", "http://169.254.169.254/engine/v1/ping", nil)
+	nilOrFatal(t, err)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert(t, w.Code == http.StatusOK)
+
+	// Requests without the token are rejected
+	req, err = http.NewRequest("POST", "http://169.254.169.254/engine/v1/log", bytes.NewBufferString("Hello"))
+	nilOrFatal(t, err)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert(t, w.Code == http.StatusUnauthorized)
+	e := Error{}
+	nilOrFatal(t, json.Unmarshal(w.Body.Bytes(), &e), "Failed to decode JSON")
+	assert(t, e.Code == ErrorCodeUnauthorized, "Expected Unauthorized error")
+
+	// Requests with the wrong token are rejected
+	req, err = http.NewRequest("GET", "http://169.254.169.254/engine/v1/execute", nil)
+	nilOrFatal(t, err)
+	req.Header.Set("Authorization", "Bearer wrong-token")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert(t, w.Code == http.StatusUnauthorized)
+
+	// Requests with the token are accepted
+	req, err = http.NewRequest("GET", "http://169.254.169.254/engine/v1/execute", nil)
+	nilOrFatal(t, err)
+	req.Header.Set("Authorization", "Bearer secret-token")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert(t, w.Code == http.StatusOK)
+}
@@ -1,11 +1,36 @@
 package metaservice
 
+import "github.com/taskcluster/taskcluster-worker/engines"
+
 // Execute is the response payload for the /engine/v1/execute end-point.
 type Execute struct {
 	Env     map[string]string `json:"env"`
 	Command []string          `json:"command"`
+	Mounts  []Mount           `json:"mounts,omitempty"`
+	// Ports forwarded from the host to the guest, such that the guest knows
+	// which services are reachable from the host.
+	Ports []engines.PortForward `json:"ports,omitempty"`
+}
+
+// Mount is a volume the guest should mount before executing the command, the
+// volume is exposed to the guest under the given Tag.
+//
+// If Type is MountTypeSharedFolder the Tag is the virtio-9p mount tag, if Type
+// is MountTypeDisk the Tag is the serial number of a virtio-blk or virtio-scsi
+// disk.
+type Mount struct {
+	Tag        string `json:"tag"`
+	MountPoint string `json:"mountPoint"`
+	ReadOnly   bool   `json:"readOnly"`
+	Type       string `json:"type,omitempty"`
 }
 
+// Types of mounts, an empty Type is a shared folder for compatibility.
+const (
+	MountTypeSharedFolder = "9p"
+	MountTypeDisk         = "disk"
+)
+
 // List of API error codes for using the Error struct.
 const (
 	ErrorCodeMethodNotAllowed = "MethodNotAllowed"
@@ -14,6 +39,9 @@ const (
 	ErrorCodeResourceConflict = "ResourceConflict"
 	ErrorCodeUnknownActionID  = "UnknownActionId"
 	ErrorCodeInvalidPayload   = "InvalidPayload"
+	ErrorCodeUnauthorized     = "Unauthorized"
+	ErrorCodeForbidden        = "Forbidden"
+	ErrorCodeNotFound         = "NotFound"
 )
 
 // Error is the response payload for any error senario.
@@ -22,6 +50,30 @@ type Error struct {
 	Message string `json:"message"`
 }
 
+// Upload is the response payload for the /engine/v1/upload end-points, Offset
+// is the number of bytes received, which is where the next chunk must start.
+type Upload struct {
+	ID     string `json:"id"`
+	Offset int64  `json:"offset"`
+}
+
+// Progress is the request payload for the /engine/v1/progress end-point, at
+// least one of the properties must be given.
+type Progress struct {
+	Percent *int   `json:"percent,omitempty"` // 0 to 100
+	Step    string `json:"step,omitempty"`    // Description of the current step
+}
+
+// GuestTools is the response payload for the /engine/v1/guest-tools end-point,
+// it describes the binary served by /engine/v1/guest-tools/binary.
+type GuestTools struct {
+	Revision string `json:"revision"` // git revision the binary was built from
+	OS       string `json:"os"`       // GOOS of the binary
+	Arch     string `json:"arch"`     // GOARCH of the binary
+	SHA256   string `json:"sha256"`   // hex encoded SHA-256 of the binary
+	Size     int64  `json:"size"`     // size of the binary in bytes
+}
+
 // Action is the response payload for the /engine/v1/poll end-point.
 type Action struct {
 	ID      string   `json:"id"`      // id, to be used when replying
@@ -0,0 +1,111 @@
+package metaservice
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/taskcluster/taskcluster-worker/runtime/ioext"
+)
+
+// MaxProgressStepLength is the maximum length of Progress.Step
+const MaxProgressStepLength = 256
+
+// MaxSummarySize is the maximum size of the result summary reported by the
+// guest.
+const MaxSummarySize = 64 * 1024
+
+// SetProgressHandler sets the function called when the guest reports progress,
+// if not set progress reports are accepted and ignored.
+func (s *MetaService) SetProgressHandler(report func(Progress)) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.reportProgress = report
+}
+
+// Summary returns the result summary reported by the guest as a JSON object,
+// or nil if the guest didn't report a summary.
+func (s *MetaService) Summary() json.RawMessage {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.summary
+}
+
+// handleProgress handles PUT /engine/v1/progress
+func (s *MetaService) handleProgress(w http.ResponseWriter, r *http.Request) {
+	if !forceMethod(w, r, http.MethodPut) {
+		return
+	}
+
+	debug("PUT /engine/v1/progress")
+	var p Progress
+	data, err := ioext.ReadAtMost(r.Body, 64*1024)
+	if err == nil {
+		err = json.Unmarshal(data, &p)
+	}
+	if err == nil && p.Percent == nil && p.Step == "" {
+		err = fmt.Errorf("one of the properties 'percent' or 'step' must be given")
+	}
+	if err == nil && p.Percent != nil && (*p.Percent < 0 || *p.Percent > 100) {
+		err = fmt.Errorf("the property 'percent' must be between 0 and 100")
+	}
+	if err == nil && len(p.Step) > MaxProgressStepLength {
+		err = fmt.Errorf("the property 'step' cannot be longer than %d", MaxProgressStepLength)
+	}
+	if err != nil {
+		reply(w, http.StatusBadRequest, Error{
+			Code:    ErrorCodeInvalidPayload,
+			Message: fmt.Sprintf("Invalid progress report, error: %s", err),
+		})
+		return
+	}
+
+	s.m.Lock()
+	report := s.reportProgress
+	s.m.Unlock()
+	if report != nil {
+		report(p)
+	}
+
+	reply(w, http.StatusOK, nil)
+}
+
+// handleSummary handles PUT /engine/v1/summary, the summary must be a JSON
+// object, reporting a summary again replaces the previous summary.
+func (s *MetaService) handleSummary(w http.ResponseWriter, r *http.Request) {
+	if !forceMethod(w, r, http.MethodPut) {
+		return
+	}
+
+	debug("PUT /engine/v1/summary")
+	data, err := ioext.ReadAtMost(r.Body, MaxSummarySize)
+	if err != nil {
+		reply(w, http.StatusBadRequest, Error{
+			Code:    ErrorCodeInvalidPayload,
+			Message: fmt.Sprintf("The summary cannot be larger than %d bytes", MaxSummarySize),
+		})
+		return
+	}
+	var summary map[string]json.RawMessage
+	if json.Unmarshal(data, &summary) != nil || summary == nil {
+		reply(w, http.StatusBadRequest, Error{
+			Code:    ErrorCodeInvalidPayload,
+			Message: "The summary must be a JSON object",
+		})
+		return
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.resolved {
+		reply(w, http.StatusConflict, Error{
+			Code:    ErrorCodeResourceConflict,
+			Message: "The summary must be reported before the task is resolved",
+		})
+		return
+	}
+	s.summary = json.RawMessage(bytes.TrimSpace(data))
+
+	reply(w, http.StatusOK, nil)
+}
@@ -0,0 +1,63 @@
+package metaservice
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+func TestMetaServiceProgress(t *testing.T) {
+	storage, err := runtime.NewTemporaryStorage(os.TempDir())
+	nilOrFatal(t, err)
+	s := New([]string{"true"}, make(map[string]string), ioutil.Discard, func(bool) {}, &runtime.Environment{
+		TemporaryStorage: storage,
+	})
+
+	var reports []Progress
+	s.SetProgressHandler(func(p Progress) {
+		reports = append(reports, p)
+	})
+
+	w := doRequest(t, s, "PUT", "/engine/v1/progress", bytes.NewBufferString(`{"percent": 42, "step": "Running tests"}`))
+	assert(t, w.Code == http.StatusOK)
+	w = doRequest(t, s, "PUT", "/engine/v1/progress", bytes.NewBufferString(`{"step": "Uploading"}`))
+	assert(t, w.Code == http.StatusOK)
+	assert(t, len(reports) == 2, "Expected 2 reports, got: ", len(reports))
+	assert(t, *reports[0].Percent == 42 && reports[0].Step == "Running tests")
+	assert(t, reports[1].Percent == nil && reports[1].Step == "Uploading")
+
+	// Invalid reports are rejected
+	for _, payload := range []string{`{}`, `{"percent": 101}`, `{"percent": -1}`, `not json`} {
+		w = doRequest(t, s, "PUT", "/engine/v1/progress", bytes.NewBufferString(payload))
+		assert(t, w.Code == http.StatusBadRequest, "Expected 400 for: ", payload)
+	}
+	assert(t, len(reports) == 2)
+}
+
+func TestMetaServiceSummary(t *testing.T) {
+	storage, err := runtime.NewTemporaryStorage(os.TempDir())
+	nilOrFatal(t, err)
+	s := New([]string{"true"}, make(map[string]string), ioutil.Discard, func(bool) {}, &runtime.Environment{
+		TemporaryStorage: storage,
+	})
+	assert(t, s.Summary() == nil)
+
+	// Summary must be an object
+	w := doRequest(t, s, "PUT", "/engine/v1/summary", bytes.NewBufferString(`[1, 2]`))
+	assert(t, w.Code == http.StatusBadRequest)
+
+	w = doRequest(t, s, "PUT", "/engine/v1/summary", bytes.NewBufferString(`{"passed": 10, "failed": 1}`))
+	assert(t, w.Code == http.StatusOK)
+	assert(t, string(s.Summary()) == `{"passed": 10, "failed": 1}`)
+
+	// Summary can't be reported after the task is resolved
+	w = doRequest(t, s, "PUT", "/engine/v1/success", nil)
+	assert(t, w.Code == http.StatusOK)
+	w = doRequest(t, s, "PUT", "/engine/v1/summary", bytes.NewBufferString(`{"passed": 11}`))
+	assert(t, w.Code == http.StatusConflict)
+	assert(t, string(s.Summary()) == `{"passed": 10, "failed": 1}`)
+}
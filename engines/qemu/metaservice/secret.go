@@ -0,0 +1,75 @@
+package metaservice
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Errors returned by the function given to SetSecretFetcher.
+var (
+	ErrSecretForbidden = errors.New("the task doesn't have scopes to read the secret")
+	ErrSecretNotFound  = errors.New("the secret doesn't exist")
+)
+
+// SetSecretFetcher sets the function used to fetch secrets requested by the
+// guest, if not set the guest cannot fetch secrets.
+//
+// The fetch function must return the secret as JSON, ErrSecretForbidden if the
+// task isn't allowed to read the secret, or ErrSecretNotFound if it doesn't
+// exist.
+func (s *MetaService) SetSecretFetcher(fetch func(name string) ([]byte, error)) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.fetchSecret = fetch
+}
+
+// handleSecret handles GET /engine/v1/secret?name=<name>
+func (s *MetaService) handleSecret(w http.ResponseWriter, r *http.Request) {
+	if !forceMethod(w, r, http.MethodGet) {
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	debug("GET /engine/v1/secret?name=%s", name)
+	if name == "" {
+		reply(w, http.StatusBadRequest, Error{
+			Code:    ErrorCodeInvalidPayload,
+			Message: "The querystring parameter 'name' must be given",
+		})
+		return
+	}
+
+	s.m.Lock()
+	fetch := s.fetchSecret
+	s.m.Unlock()
+	if fetch == nil {
+		reply(w, http.StatusNotFound, Error{
+			Code:    ErrorCodeNoSuchEndPoint,
+			Message: "Fetching secrets from the guest isn't supported",
+		})
+		return
+	}
+
+	secret, err := fetch(name)
+	switch err {
+	case nil:
+		reply(w, http.StatusOK, json.RawMessage(secret))
+	case ErrSecretForbidden:
+		reply(w, http.StatusForbidden, Error{
+			Code:    ErrorCodeForbidden,
+			Message: fmt.Sprintf("The task needs the scope 'secrets:get:%s' to read the secret", name),
+		})
+	case ErrSecretNotFound:
+		reply(w, http.StatusNotFound, Error{
+			Code:    ErrorCodeNotFound,
+			Message: fmt.Sprintf("The secret '%s' doesn't exist", name),
+		})
+	default:
+		reply(w, http.StatusInternalServerError, Error{
+			Code:    ErrorCodeInternalError,
+			Message: fmt.Sprintf("Failed to fetch secret '%s', error: %s", name, err),
+		})
+	}
+}
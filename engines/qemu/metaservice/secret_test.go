@@ -0,0 +1,51 @@
+package metaservice
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+func TestMetaServiceSecret(t *testing.T) {
+	storage, err := runtime.NewTemporaryStorage(os.TempDir())
+	nilOrFatal(t, err)
+	s := New([]string{"true"}, make(map[string]string), ioutil.Discard, func(bool) {}, &runtime.Environment{
+		TemporaryStorage: storage,
+	})
+
+	// Without a fetcher the end-point isn't supported
+	w := doRequest(t, s, "GET", "/engine/v1/secret?name=project/test", nil)
+	assert(t, w.Code == http.StatusNotFound)
+
+	s.SetSecretFetcher(func(name string) ([]byte, error) {
+		switch name {
+		case "project/test":
+			return []byte(`{"secret": {"password": "hunter2"}}`), nil
+		case "project/other":
+			return nil, ErrSecretForbidden
+		default:
+			return nil, ErrSecretNotFound
+		}
+	})
+
+	w = doRequest(t, s, "GET", "/engine/v1/secret?name=project/test", nil)
+	assert(t, w.Code == http.StatusOK)
+	var secret struct {
+		Secret map[string]string `json:"secret"`
+	}
+	nilOrFatal(t, json.Unmarshal(w.Body.Bytes(), &secret), "Failed to decode JSON")
+	assert(t, secret.Secret["password"] == "hunter2")
+
+	w = doRequest(t, s, "GET", "/engine/v1/secret?name=project/other", nil)
+	assert(t, w.Code == http.StatusForbidden)
+
+	w = doRequest(t, s, "GET", "/engine/v1/secret?name=project/missing", nil)
+	assert(t, w.Code == http.StatusNotFound)
+
+	w = doRequest(t, s, "GET", "/engine/v1/secret", nil)
+	assert(t, w.Code == http.StatusBadRequest)
+}
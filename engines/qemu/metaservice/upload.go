@@ -0,0 +1,352 @@
+package metaservice
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/taskcluster/slugid-go/slugid"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/ioext"
+)
+
+// UploadIdleTimeout is the time after which an upload that hasn't received
+// any requests is discarded, releasing the temporary file.
+const UploadIdleTimeout = 10 * time.Minute
+
+// MaxUploads is the maximum number of unfinished uploads at any time.
+const MaxUploads = 16
+
+// MaxArtifactSize is the maximum size of an artifact uploaded by the guest,
+// this is the largest object that can be uploaded to S3 with a single PUT.
+const MaxArtifactSize = 5 * 1024 * 1024 * 1024
+
+// replyTooLarge replies 413, if err is runtime.ErrQuotaExceeded or size
+// exceeds MaxArtifactSize, and returns true if it did. Artifacts are buffered
+// in the temporary storage for the task, which may be limited by a quota.
+func replyTooLarge(w http.ResponseWriter, size int64, err error) bool {
+	if err == runtime.ErrQuotaExceeded {
+		reply(w, http.StatusRequestEntityTooLarge, Error{
+			Code:    ErrorCodeInvalidPayload,
+			Message: "Artifact exceeds the temporary storage quota for the task",
+		})
+		return true
+	}
+	if size > MaxArtifactSize {
+		reply(w, http.StatusRequestEntityTooLarge, Error{
+			Code:    ErrorCodeInvalidPayload,
+			Message: fmt.Sprintf("Artifact exceeds the maximum size of %d bytes", int64(MaxArtifactSize)),
+		})
+		return true
+	}
+	return false
+}
+
+// upload is an artifact being uploaded in chunks by the guest
+type upload struct {
+	name     string
+	mimetype string
+	file     runtime.TemporaryFile
+	hash     hash.Hash // SHA-256 of bytes received so far
+	offset   int64     // Bytes received so far
+	busy     bool      // True, while a request is using the upload
+	timer    *time.Timer
+}
+
+// handleCreateUpload handles POST /engine/v1/upload?name=<name>, creating an
+// upload that chunks can be written to with handleUpload.
+//
+// Uploads are finished with POST /engine/v1/upload/<id>?sha256=<hash>, which
+// checks the hash of the content before uploading the artifact.
+func (s *MetaService) handleCreateUpload(w http.ResponseWriter, r *http.Request) {
+	if !forceMethod(w, r, http.MethodPost) {
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	debug("POST /engine/v1/upload?name=%s", name)
+	if name == "" || strings.HasPrefix(name, "/") {
+		reply(w, http.StatusBadRequest, Error{
+			Code:    ErrorCodeInvalidPayload,
+			Message: "The querystring parameter 'name' must be a valid artifact name",
+		})
+		return
+	}
+	mimetype := r.Header.Get("Content-Type")
+	if mimetype == "" {
+		mimetype = "application/octet-stream"
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.uploadArtifact == nil {
+		reply(w, http.StatusNotFound, Error{
+			Code:    ErrorCodeNoSuchEndPoint,
+			Message: "Uploading artifacts from the guest isn't supported",
+		})
+		return
+	}
+	if s.disposed {
+		reply(w, http.StatusConflict, Error{
+			Code:    ErrorCodeResourceConflict,
+			Message: "Cannot create uploads after the task is resolved",
+		})
+		return
+	}
+	if len(s.uploads) >= MaxUploads {
+		reply(w, http.StatusConflict, Error{
+			Code:    ErrorCodeResourceConflict,
+			Message: fmt.Sprintf("Cannot have more than %d unfinished uploads", MaxUploads),
+		})
+		return
+	}
+
+	f, err := s.environment.TemporaryStorage.NewFile()
+	if err != nil {
+		reply(w, http.StatusInternalServerError, Error{
+			Code:    ErrorCodeInternalError,
+			Message: fmt.Sprintf("Failed to create temporary file, error: %s", err),
+		})
+		return
+	}
+	ID := slugid.Nice()
+	u := &upload{
+		name:     name,
+		mimetype: mimetype,
+		file:     f,
+		hash:     sha256.New(),
+	}
+	u.timer = time.AfterFunc(UploadIdleTimeout, func() { s.expireUpload(ID, u) })
+	s.uploads[ID] = u
+
+	reply(w, http.StatusOK, Upload{ID: ID})
+}
+
+// handleUpload handles requests for /engine/v1/upload/<id>, GET returns the
+// offset at which the next chunk must start, PUT ?offset=<offset> appends the
+// request body at offset, POST ?sha256=<hash> finishes the upload and uploads
+// the artifact, and DELETE discards the upload.
+func (s *MetaService) handleUpload(w http.ResponseWriter, r *http.Request) {
+	ID := strings.TrimPrefix(r.URL.Path, "/engine/v1/upload/")
+	debug("%s /engine/v1/upload/%s", r.Method, ID)
+
+	switch r.Method {
+	case http.MethodGet, http.MethodPut, http.MethodPost, http.MethodDelete:
+	default:
+		reply(w, http.StatusMethodNotAllowed, Error{
+			Code:    ErrorCodeMethodNotAllowed,
+			Message: fmt.Sprintf("The end-point '%s' does not support %s", r.URL.Path, r.Method),
+		})
+		return
+	}
+
+	u := s.acquireUpload(w, ID)
+	if u == nil {
+		return
+	}
+	defer s.releaseUpload(ID, u)
+
+	switch r.Method {
+	case http.MethodGet:
+		reply(w, http.StatusOK, Upload{ID: ID, Offset: u.offset})
+	case http.MethodPut:
+		s.writeChunk(w, r, ID, u)
+	case http.MethodPost:
+		s.finishUpload(w, r, ID, u)
+	case http.MethodDelete:
+		s.removeUpload(ID)
+		reply(w, http.StatusOK, nil)
+	}
+}
+
+// acquireUpload returns the upload with given ID, marking it busy, or writes
+// an error to w and returns nil. The upload must be released with
+// releaseUpload.
+func (s *MetaService) acquireUpload(w http.ResponseWriter, ID string) *upload {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	u, ok := s.uploads[ID]
+	if !ok {
+		reply(w, http.StatusNotFound, Error{
+			Code:    ErrorCodeNoSuchEndPoint,
+			Message: fmt.Sprintf("No upload with id: '%s', it may have expired", ID),
+		})
+		return nil
+	}
+	if u.busy {
+		reply(w, http.StatusConflict, Error{
+			Code:    ErrorCodeResourceConflict,
+			Message: fmt.Sprintf("Upload '%s' is in use by another request", ID),
+		})
+		return nil
+	}
+	u.busy = true
+	u.timer.Stop()
+	return u
+}
+
+// releaseUpload marks u as no longer busy and restarts the idle timer
+func (s *MetaService) releaseUpload(ID string, u *upload) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	u.busy = false
+	if s.uploads[ID] == u {
+		u.timer.Reset(UploadIdleTimeout)
+	}
+}
+
+// expireUpload removes u, unless it is busy, in which case the timer will be
+// restarted when it is released.
+func (s *MetaService) expireUpload(ID string, u *upload) {
+	s.m.Lock()
+	if u.busy || s.uploads[ID] != u {
+		s.m.Unlock()
+		return
+	}
+	delete(s.uploads, ID)
+	s.m.Unlock()
+
+	debug("Upload expired: %s", ID)
+	u.file.Close()
+}
+
+// removeUpload discards the upload with given ID
+func (s *MetaService) removeUpload(ID string) {
+	s.m.Lock()
+	u, ok := s.uploads[ID]
+	delete(s.uploads, ID)
+	s.m.Unlock()
+
+	if ok {
+		u.timer.Stop()
+		u.file.Close()
+	}
+}
+
+// removeUploads discards all unfinished uploads and prevents new uploads from
+// being created, this is called when the MetaService is disposed.
+func (s *MetaService) removeUploads() {
+	s.m.Lock()
+	uploads := s.uploads
+	s.uploads = make(map[string]*upload)
+	s.disposed = true
+	s.m.Unlock()
+
+	for ID, u := range uploads {
+		debug("Discarding unfinished upload: %s", ID)
+		u.timer.Stop()
+		u.file.Close()
+	}
+}
+
+// writeChunk appends the request body to u, the chunk must start at the
+// offset given in the querystring. If the request is interrupted the bytes
+// received are kept, so the guest can resume from the new offset.
+func (s *MetaService) writeChunk(w http.ResponseWriter, r *http.Request, ID string, u *upload) {
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil {
+		reply(w, http.StatusBadRequest, Error{
+			Code:    ErrorCodeInvalidPayload,
+			Message: "The querystring parameter 'offset' must be an integer",
+		})
+		return
+	}
+	if offset != u.offset {
+		reply(w, http.StatusConflict, Error{
+			Code:    ErrorCodeResourceConflict,
+			Message: fmt.Sprintf("Chunk must start at offset %d, not %d", u.offset, offset),
+		})
+		return
+	}
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, rerr := r.Body.Read(buf)
+		if n > 0 {
+			if u.offset+int64(n) <= MaxArtifactSize {
+				_, err = u.file.Write(buf[:n])
+			}
+			if replyTooLarge(w, u.offset+int64(n), err) {
+				// Discard the partial write, so the file matches the hash
+				u.file.Truncate(u.offset)
+				u.file.Seek(u.offset, io.SeekStart)
+				return
+			}
+			if err != nil {
+				// Discard the partial write, so the file matches the hash
+				u.file.Truncate(u.offset)
+				u.file.Seek(u.offset, io.SeekStart)
+				reply(w, http.StatusInternalServerError, Error{
+					Code:    ErrorCodeInternalError,
+					Message: fmt.Sprintf("Failed to write chunk, error: %s", err),
+				})
+				return
+			}
+			u.hash.Write(buf[:n])
+			u.offset += int64(n)
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			reply(w, http.StatusBadRequest, Error{
+				Code:    ErrorCodeInvalidPayload,
+				Message: fmt.Sprintf("Failed to read chunk, error: %s", rerr),
+			})
+			return
+		}
+	}
+
+	reply(w, http.StatusOK, Upload{ID: ID, Offset: u.offset})
+}
+
+// finishUpload checks the SHA-256 given in the querystring and uploads the
+// artifact. If the hash doesn't match the upload is discarded, if uploading
+// the artifact fails the guest may try to finish the upload again.
+func (s *MetaService) finishUpload(w http.ResponseWriter, r *http.Request, ID string, u *upload) {
+	sum := hex.EncodeToString(u.hash.Sum(nil))
+	if !strings.EqualFold(r.URL.Query().Get("sha256"), sum) {
+		s.removeUpload(ID)
+		reply(w, http.StatusBadRequest, Error{
+			Code: ErrorCodeInvalidPayload,
+			Message: fmt.Sprintf(
+				"The querystring parameter 'sha256' doesn't match the %d bytes received, "+
+					"which have SHA-256: %s, the upload has been discarded", u.offset, sum,
+			),
+		})
+		return
+	}
+
+	s.m.Lock()
+	upload := s.uploadArtifact
+	s.m.Unlock()
+
+	_, err := u.file.Seek(0, io.SeekStart)
+	if err == nil {
+		err = upload(runtime.S3Artifact{
+			Name:     u.name,
+			Mimetype: u.mimetype,
+			Stream:   ioext.NopCloser(u.file), // keep the file, in case we retry
+		})
+	}
+	if err != nil {
+		// Move back to the end, so the guest can retry or keep writing
+		u.file.Seek(u.offset, io.SeekStart)
+		reply(w, http.StatusInternalServerError, Error{
+			Code:    ErrorCodeInternalError,
+			Message: fmt.Sprintf("Failed to upload artifact '%s', error: %s", u.name, err),
+		})
+		return
+	}
+
+	s.removeUpload(ID)
+	reply(w, http.StatusOK, nil)
+}
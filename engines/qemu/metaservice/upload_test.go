@@ -0,0 +1,171 @@
+package metaservice
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+// doRequest sends a request to s and returns the response recorded
+func doRequest(t *testing.T, s *MetaService, method, path string, body io.Reader) *httptest.ResponseRecorder {
+	req, err := http.NewRequest(method, "http://169.254.169.254"+path, body)
+	nilOrFatal(t, err)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	return w
+}
+
+func TestMetaServiceResumableUpload(t *testing.T) {
+	storage, err := runtime.NewTemporaryStorage(os.TempDir())
+	nilOrFatal(t, err)
+	s := New([]string{"true"}, make(map[string]string), ioutil.Discard, func(bool) {}, &runtime.Environment{
+		TemporaryStorage: storage,
+	})
+
+	var uploaded runtime.S3Artifact
+	var data []byte
+	s.SetArtifactUploader(func(artifact runtime.S3Artifact) error {
+		uploaded = artifact
+		data, err = ioutil.ReadAll(artifact.Stream)
+		return err
+	})
+
+	// Create upload
+	w := doRequest(t, s, "POST", "/engine/v1/upload?name=public/build.tar", nil)
+	assert(t, w.Code == http.StatusOK)
+	var u Upload
+	nilOrFatal(t, json.Unmarshal(w.Body.Bytes(), &u), "Failed to decode JSON")
+	assert(t, u.ID != "" && u.Offset == 0)
+
+	// Write first chunk
+	w = doRequest(t, s, "PUT", "/engine/v1/upload/"+u.ID+"?offset=0", bytes.NewBufferString("hello "))
+	assert(t, w.Code == http.StatusOK)
+	nilOrFatal(t, json.Unmarshal(w.Body.Bytes(), &u), "Failed to decode JSON")
+	assert(t, u.Offset == 6, "Expected offset 6, got: ", u.Offset)
+
+	// Chunks must start at the current offset
+	w = doRequest(t, s, "PUT", "/engine/v1/upload/"+u.ID+"?offset=0", bytes.NewBufferString("hello "))
+	assert(t, w.Code == http.StatusConflict)
+
+	// Resume from the offset reported
+	w = doRequest(t, s, "GET", "/engine/v1/upload/"+u.ID, nil)
+	assert(t, w.Code == http.StatusOK)
+	nilOrFatal(t, json.Unmarshal(w.Body.Bytes(), &u), "Failed to decode JSON")
+	assert(t, u.Offset == 6)
+	w = doRequest(t, s, "PUT", "/engine/v1/upload/"+u.ID+"?offset=6", bytes.NewBufferString("world"))
+	assert(t, w.Code == http.StatusOK)
+
+	// Finish the upload
+	sum := sha256.Sum256([]byte("hello world"))
+	w = doRequest(t, s, "POST", "/engine/v1/upload/"+u.ID+"?sha256="+hex.EncodeToString(sum[:]), nil)
+	assert(t, w.Code == http.StatusOK)
+	assert(t, uploaded.Name == "public/build.tar")
+	assert(t, uploaded.Mimetype == "application/octet-stream")
+	assert(t, string(data) == "hello world", "Unexpected artifact: ", string(data))
+
+	// Finished uploads are removed
+	w = doRequest(t, s, "GET", "/engine/v1/upload/"+u.ID, nil)
+	assert(t, w.Code == http.StatusNotFound)
+
+	// Uploads with the wrong hash are discarded
+	w = doRequest(t, s, "POST", "/engine/v1/upload?name=public/build.tar", nil)
+	assert(t, w.Code == http.StatusOK)
+	nilOrFatal(t, json.Unmarshal(w.Body.Bytes(), &u), "Failed to decode JSON")
+	w = doRequest(t, s, "PUT", "/engine/v1/upload/"+u.ID+"?offset=0", bytes.NewBufferString("corrupt"))
+	assert(t, w.Code == http.StatusOK)
+	w = doRequest(t, s, "POST", "/engine/v1/upload/"+u.ID+"?sha256="+hex.EncodeToString(sum[:]), nil)
+	assert(t, w.Code == http.StatusBadRequest)
+	w = doRequest(t, s, "GET", "/engine/v1/upload/"+u.ID, nil)
+	assert(t, w.Code == http.StatusNotFound)
+}
+
+func TestMetaServiceUploadDispose(t *testing.T) {
+	storage, err := runtime.NewTemporaryStorage(os.TempDir())
+	nilOrFatal(t, err)
+	folder, err := storage.NewFolder()
+	nilOrFatal(t, err)
+	defer folder.Remove()
+	s := New([]string{"true"}, make(map[string]string), ioutil.Discard, func(bool) {}, &runtime.Environment{
+		TemporaryStorage: folder,
+	})
+	s.SetArtifactUploader(func(artifact runtime.S3Artifact) error { return nil })
+
+	w := doRequest(t, s, "POST", "/engine/v1/upload?name=public/build.tar", nil)
+	assert(t, w.Code == http.StatusOK)
+	var u Upload
+	nilOrFatal(t, json.Unmarshal(w.Body.Bytes(), &u), "Failed to decode JSON")
+	w = doRequest(t, s, "PUT", "/engine/v1/upload/"+u.ID+"?offset=0", bytes.NewBufferString("hello"))
+	assert(t, w.Code == http.StatusOK)
+
+	// Unfinished uploads are removed when disposed
+	s.Dispose()
+	files, err := ioutil.ReadDir(folder.Path())
+	nilOrFatal(t, err)
+	assert(t, len(files) == 0, "Expected temporary files to be removed, found: ", len(files))
+	w = doRequest(t, s, "GET", "/engine/v1/upload/"+u.ID, nil)
+	assert(t, w.Code == http.StatusNotFound)
+	w = doRequest(t, s, "POST", "/engine/v1/upload?name=public/build.tar", nil)
+	assert(t, w.Code == http.StatusConflict)
+}
+
+func TestMetaServiceUploadTemporaryFileError(t *testing.T) {
+	storage, err := runtime.NewTemporaryStorage(os.TempDir())
+	nilOrFatal(t, err)
+	folder, err := storage.NewFolder()
+	nilOrFatal(t, err)
+	nilOrFatal(t, folder.Remove())
+	s := New([]string{"true"}, make(map[string]string), ioutil.Discard, func(bool) {}, &runtime.Environment{
+		TemporaryStorage: folder,
+	})
+	s.SetArtifactUploader(func(artifact runtime.S3Artifact) error { return nil })
+
+	// Failing to create a temporary file is reported to the guest
+	w := doRequest(t, s, "POST", "/engine/v1/upload?name=public/build.tar", nil)
+	assert(t, w.Code == http.StatusInternalServerError, "Expected 500, got: ", w.Code)
+	w = doRequest(t, s, "PUT", "/engine/v1/artifact?name=public/build.tar", bytes.NewBufferString("hello"))
+	assert(t, w.Code == http.StatusInternalServerError, "Expected 500, got: ", w.Code)
+}
+
+func TestMetaServiceUploadTooLarge(t *testing.T) {
+	storage, err := runtime.NewTemporaryStorage(os.TempDir())
+	nilOrFatal(t, err)
+	folder, err := storage.NewFolderWithQuota(10)
+	nilOrFatal(t, err)
+	defer folder.Remove()
+	s := New([]string{"true"}, make(map[string]string), ioutil.Discard, func(bool) {}, &runtime.Environment{
+		TemporaryStorage: folder,
+	})
+	s.SetArtifactUploader(func(artifact runtime.S3Artifact) error { return nil })
+
+	// Artifacts are limited by the quota for the task
+	w := doRequest(t, s, "PUT", "/engine/v1/artifact?name=public/log.txt", bytes.NewBufferString("hello world"))
+	assert(t, w.Code == http.StatusRequestEntityTooLarge, "Expected 413, got: ", w.Code)
+
+	w = doRequest(t, s, "POST", "/engine/v1/upload?name=public/build.tar", nil)
+	assert(t, w.Code == http.StatusOK)
+	var u Upload
+	nilOrFatal(t, json.Unmarshal(w.Body.Bytes(), &u), "Failed to decode JSON")
+	w = doRequest(t, s, "PUT", "/engine/v1/upload/"+u.ID+"?offset=0", bytes.NewBufferString("hello world"))
+	assert(t, w.Code == http.StatusRequestEntityTooLarge, "Expected 413, got: ", w.Code)
+	w = doRequest(t, s, "GET", "/engine/v1/upload/"+u.ID, nil)
+	assert(t, w.Code == http.StatusOK)
+	nilOrFatal(t, json.Unmarshal(w.Body.Bytes(), &u), "Failed to decode JSON")
+	assert(t, u.Offset == 0, "Expected the chunk to be discarded, offset: ", u.Offset)
+
+	// Artifacts larger than MaxArtifactSize are rejected before reading them
+	req, err := http.NewRequest("PUT", "http://169.254.169.254/engine/v1/artifact?name=public/log.txt", bytes.NewBufferString("hello"))
+	nilOrFatal(t, err)
+	req.ContentLength = MaxArtifactSize + 1
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	assert(t, w.Code == http.StatusRequestEntityTooLarge, "Expected 413, got: ", w.Code)
+}
@@ -0,0 +1,81 @@
+package network
+
+import (
+	"strconv"
+
+	schematypes "github.com/taskcluster/go-schematypes"
+	"github.com/taskcluster/taskcluster-worker/runtime/util"
+)
+
+// bandwidthConfig limits bandwidth for each virtual machine in kbit/s, zero
+// values means unlimited.
+type bandwidthConfig struct {
+	Egress  int `json:"egress"`
+	Ingress int `json:"ingress"`
+}
+
+var bandwidthSchema = schematypes.Object{
+	Title: "Bandwidth Limits",
+	Description: util.Markdown(`
+		Bandwidth limits for each virtual machine in kbit/s, omitted or zero
+		values are unlimited. This ensures that tasks downloading or uploading
+		large amounts of data don't saturate the host uplink, which is also used
+		for live logs and artifact uploads.
+
+		Limits are applied with 'tc' on the TAP device of each virtual machine.
+	`),
+	Properties: schematypes.Properties{
+		"egress": schematypes.Integer{
+			Title:       "Egress",
+			Description: "Maximum rate of traffic sent by the virtual machine in kbit/s.",
+			Minimum:     0,
+			Maximum:     100 * 1000 * 1000, // 100 Gbit/s
+		},
+		"ingress": schematypes.Integer{
+			Title:       "Ingress",
+			Description: "Maximum rate of traffic received by the virtual machine in kbit/s.",
+			Minimum:     0,
+			Maximum:     100 * 1000 * 1000, // 100 Gbit/s
+		},
+	},
+}
+
+// Minimum burst size in bytes for token bucket filters
+const minBurst = 32 * 1024
+
+// burst returns the burst size in bytes for a rate in kbit/s, we allow 100ms
+// worth of traffic, but never less than minBurst.
+func burst(rate int) string {
+	b := rate * 1000 / 8 / 10
+	if b < minBurst {
+		b = minBurst
+	}
+	return strconv.Itoa(b)
+}
+
+// tcRules returns a list of commands to apply bandwidth limits to tapDevice.
+// Note: ingress on the TAP device is egress from the virtual machine, and vice
+// versa. The queuing disciplines are removed along with the TAP device.
+func tcRules(tapDevice string, bandwidth bandwidthConfig) [][]string {
+	cmds := [][]string{}
+	if bandwidth.Ingress != 0 {
+		// Shape traffic sent to the virtual machine using a token bucket filter
+		rate := strconv.Itoa(bandwidth.Ingress) + "kbit"
+		cmds = append(cmds, []string{
+			"tc", "qdisc", "add", "dev", tapDevice, "root", "tbf",
+			"rate", rate, "burst", burst(bandwidth.Ingress), "latency", "50ms",
+		})
+	}
+	if bandwidth.Egress != 0 {
+		// Police traffic sent from the virtual machine, dropping excess packets
+		rate := strconv.Itoa(bandwidth.Egress) + "kbit"
+		cmds = append(cmds, []string{
+			"tc", "qdisc", "add", "dev", tapDevice, "handle", "ffff:", "ingress",
+		}, []string{
+			"tc", "filter", "add", "dev", tapDevice, "parent", "ffff:", "protocol", "all",
+			"u32", "match", "u32", "0", "0",
+			"police", "rate", rate, "burst", burst(bandwidth.Egress), "drop", "flowid", ":1",
+		})
+	}
+	return cmds
+}
@@ -0,0 +1,21 @@
+package network
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTCRules(t *testing.T) {
+	cmds := tcRules("tctap0", bandwidthConfig{})
+	assert(t, len(cmds) == 0, "Expected no commands without bandwidth limits")
+
+	cmds = tcRules("tctap0", bandwidthConfig{Ingress: 8000})
+	assert(t, len(cmds) == 1, "Expected a single command for ingress limit")
+	cmd := strings.Join(cmds[0], " ")
+	assert(t, strings.Contains(cmd, "root tbf rate 8000kbit burst 100000"), "Unexpected command: ", cmd)
+
+	cmds = tcRules("tctap0", bandwidthConfig{Egress: 80, Ingress: 80})
+	assert(t, len(cmds) == 3, "Expected three commands for ingress and egress limits")
+	cmd = strings.Join(cmds[2], " ")
+	assert(t, strings.Contains(cmd, "police rate 80kbit burst 32768 drop"), "Unexpected command: ", cmd)
+}
@@ -7,9 +7,15 @@
 // address. Request to the meta-data IP will be forwarded to the handler
 // registered for the network instance.
 //
+// If IPv6 is enabled in the pool configuration, networks are dual-stack, the
+// TAP device will also get an IPv6 address using DHCPv6 and router
+// advertisements. The meta-data service is reachable over IPv6 on the
+// link-local address fe80::a9fe:a9fe on each TAP device.
+//
 // This package uses iptables to lock down network and ensure that the virtual
 // machine attached to a TAP device can't contact the meta-data handler of
-// another virtual machine.
+// another virtual machine. Optionally, bandwidth for each virtual machine can be
+// limited using tc queuing disciplines on the TAP device.
 package network
 
 import "github.com/taskcluster/taskcluster-worker/runtime/util"
@@ -0,0 +1,101 @@
+package network
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// egressRules returns a list of commands to create a chain restricting traffic
+// forwarded from tapDevice to the allowed subnets, and jump to it from the top
+// of the fwd_input_<tapDevice> chains. If delete=true, this returns the
+// commands to delete the chains. If ipv6=false, IPv6 subnets are ignored and
+// no ip6tables chain is created.
+//
+// Traffic to allowed subnets returns to fwd_input_<tapDevice>, so the rules
+// from ipTableRules and ip6TableRules still apply, all other traffic is
+// rejected. As chains are named by index, each restriction applied to the same
+// network must have a distinct index.
+func egressRules(tapDevice string, index int, allowed []*net.IPNet, ipv6, delete bool) [][]string {
+	chain := fmt.Sprintf("egress%d_%s", index, tapDevice)
+
+	var v4, v6 [][]string
+	for _, subnet := range allowed {
+		rule := []string{"-d", subnet.String(), "-j", "RETURN"}
+		if subnet.IP.To4() != nil {
+			v4 = append(v4, rule)
+		} else {
+			v6 = append(v6, rule)
+		}
+	}
+	v4 = append(v4, []string{"-j", "REJECT", "--reject-with", "icmp-net-prohibited"})
+	v6 = append(v6, []string{"-j", "REJECT", "--reject-with", "icmp6-adm-prohibited"})
+
+	type table struct {
+		command string
+		rules   [][]string
+	}
+	tables := []table{{"iptables", v4}}
+	if ipv6 {
+		tables = append(tables, table{"ip6tables", v6})
+	}
+
+	cmds := [][]string{}
+	for _, t := range tables {
+		if !delete {
+			cmds = append(cmds, []string{t.command, "-w", xtableLockWait, "-N", chain})
+			cmds = append(cmds, prefixCommands([]string{t.command, "-w", xtableLockWait, "-A", chain}, t.rules)...)
+			cmds = append(cmds, []string{
+				t.command, "-w", xtableLockWait, "-I", "fwd_input_" + tapDevice, "1", "-j", chain,
+			})
+		} else {
+			cmds = append(cmds, [][]string{
+				{t.command, "-w", xtableLockWait, "-D", "fwd_input_" + tapDevice, "-j", chain},
+				{t.command, "-w", xtableLockWait, "-F", chain},
+				{t.command, "-w", xtableLockWait, "-X", chain},
+			}...)
+		}
+	}
+	return cmds
+}
+
+// RestrictEgress rejects traffic from the guest to destinations outside the
+// allowed subnets, an empty list rejects all traffic leaving the host, while
+// the meta-data service and DNS remain reachable. Private subnets are rejected
+// regardless of the allowed subnets.
+//
+// This may be called more than once, in which case traffic must satisfy all
+// restrictions. Restrictions are removed when the network is released.
+func (n *Network) RestrictEgress(allowed []*net.IPNet) error {
+	n.m.Lock()
+	defer n.m.Unlock()
+	if n.entry == nil {
+		panic("Network.RestrictEgress() called after Network.Release()")
+	}
+
+	index := len(n.egress)
+	ipv6 := n.entry.ipv6Prefix != ""
+	err := script(egressRules(n.entry.tapDevice, index, allowed, ipv6, false), false)
+	if err != nil {
+		// Remove whatever was created, ignoring errors for what wasn't
+		for _, cmd := range egressRules(n.entry.tapDevice, index, allowed, ipv6, true) {
+			script([][]string{cmd}, false)
+		}
+		return errors.Wrap(err, "failed to setup ip-tables for restricting egress")
+	}
+	n.egress = append(n.egress, allowed)
+	return nil
+}
+
+// removeEgressRestrictions removes the chains created by RestrictEgress, n.m
+// must be held.
+func (n *Network) removeEgressRestrictions() {
+	for index, allowed := range n.egress {
+		err := script(egressRules(n.entry.tapDevice, index, allowed, n.entry.ipv6Prefix != "", true), false)
+		if err != nil {
+			debug("failed to remove egress restriction on %s, error: %s", n.entry.tapDevice, err)
+		}
+	}
+	n.egress = nil
+}
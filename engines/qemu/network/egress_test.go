@@ -0,0 +1,41 @@
+package network
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestEgressRules(t *testing.T) {
+	_, v4, _ := net.ParseCIDR("203.0.113.0/24")
+	_, v6, _ := net.ParseCIDR("2001:db8::/32")
+	cmds := egressRules("tctap0", 1, []*net.IPNet{v4, v6}, true, false)
+	assert(t, len(cmds) == 8, "Expected 8 commands for restricting egress, got: ", len(cmds))
+	cmd := strings.Join(cmds[1], " ")
+	assert(t, cmd == "iptables -w 3 -A egress1_tctap0 -d 203.0.113.0/24 -j RETURN", "Unexpected command: ", cmd)
+	cmd = strings.Join(cmds[3], " ")
+	assert(t, cmd == "iptables -w 3 -I fwd_input_tctap0 1 -j egress1_tctap0", "Unexpected command: ", cmd)
+	cmd = strings.Join(cmds[5], " ")
+	assert(t, cmd == "ip6tables -w 3 -A egress1_tctap0 -d 2001:db8::/32 -j RETURN", "Unexpected command: ", cmd)
+
+	// Without allowed subnets everything is rejected
+	cmds = egressRules("tctap0", 0, nil, true, false)
+	assert(t, len(cmds) == 6, "Expected 6 commands for denying egress, got: ", len(cmds))
+	cmd = strings.Join(cmds[1], " ")
+	assert(t, strings.Contains(cmd, "-A egress0_tctap0 -j REJECT"), "Unexpected command: ", cmd)
+
+	// The chain must be unreferenced before it's deleted
+	cmds = egressRules("tctap0", 0, nil, true, true)
+	assert(t, len(cmds) == 6, "Expected 6 commands for removing restrictions, got: ", len(cmds))
+	cmd = strings.Join(cmds[0], " ")
+	assert(t, cmd == "iptables -w 3 -D fwd_input_tctap0 -j egress0_tctap0", "Unexpected command: ", cmd)
+	cmd = strings.Join(cmds[2], " ")
+	assert(t, cmd == "iptables -w 3 -X egress0_tctap0", "Unexpected command: ", cmd)
+
+	// Without IPv6 no ip6tables chain is created
+	cmds = egressRules("tctap0", 1, []*net.IPNet{v4, v6}, false, false)
+	assert(t, len(cmds) == 4, "Expected 4 commands for restricting egress, got: ", len(cmds))
+	for _, c := range cmds {
+		assert(t, c[0] == "iptables", "Unexpected command: ", strings.Join(c, " "))
+	}
+}
@@ -1,10 +1,23 @@
 package network
 
-import "github.com/taskcluster/taskcluster-worker/engines/qemu/network/openvpn"
+import (
+	"strconv"
+
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/network/openvpn"
+)
 
 // Maximum time to wait for the xtables lock when using iptables
 const xtableLockWait = "3"
 
+// prefixCommands returns rules with prefix prepended to each rule.
+func prefixCommands(prefix []string, rules [][]string) [][]string {
+	cmds := [][]string{}
+	for _, rule := range rules {
+		cmds = append(cmds, append(prefix, rule...))
+	}
+	return cmds
+}
+
 // ipTableRules returns a list of commands to append rules for tapDevice.
 // If delete=false, this returns the commands to delete the rules.
 //
@@ -21,13 +34,6 @@ const xtableLockWait = "3"
 func ipTableRules(tapDevice string, ipPrefix string, vpns []*openvpn.VPN, delete bool) [][]string {
 	subnet := ipPrefix + ".0/24"
 	gateway := ipPrefix + ".1"
-	prefixCommands := func(prefix []string, rules [][]string) [][]string {
-		cmds := [][]string{}
-		for _, rule := range rules {
-			cmds = append(cmds, append(prefix, rule...))
-		}
-		return cmds
-	}
 
 	ruleAction := "-A"
 	chainAction := "-N"
@@ -169,3 +175,153 @@ func ipTableRules(tapDevice string, ipPrefix string, vpns []*openvpn.VPN, delete
 
 	return cmds
 }
+
+// portForwardRules returns a list of commands to insert rules allowing the
+// host to connect to port on the VM exposed on tapDevice. If delete=true, this
+// returns the commands to delete the rules.
+//
+// Rules are inserted at the top of the chains created by ipTableRules, such
+// that they take precedence over the rules rejecting all other traffic.
+func portForwardRules(tapDevice string, ipPrefix string, port int, delete bool) [][]string {
+	subnet := ipPrefix + ".0/24"
+	gateway := ipPrefix + ".1"
+
+	output := []string{"-I", "output_" + tapDevice, "1"}
+	input := []string{"-I", "input_" + tapDevice, "1"}
+	if delete {
+		output = []string{"-D", "output_" + tapDevice}
+		input = []string{"-D", "input_" + tapDevice}
+	}
+
+	return prefixCommands([]string{"iptables", "-w", xtableLockWait}, [][]string{
+		// Allow connections from the host to the port in the VM
+		append(output, "-p", "tcp", "-s", gateway, "-d", subnet, "-m", "tcp", "--dport", strconv.Itoa(port), "-m", "state", "--state", "NEW,ESTABLISHED", "-j", "ACCEPT"),
+		// Allow replies from the port in the VM (if already established)
+		append(input, "-p", "tcp", "-s", subnet, "-d", gateway, "-m", "tcp", "--sport", strconv.Itoa(port), "-m", "state", "--state", "ESTABLISHED", "-j", "ACCEPT"),
+	})
+}
+
+// ip6TableRules returns a list of commands to append rules for tapDevice.
+// If delete=true, this returns the commands to delete the rules.
+//
+// This is the IPv6 equivalent of ipTableRules, a VM exposed on tapDevice is
+// restricted to IPs from the subnet <ipv6Prefix>::/64 and link-local addresses
+// and can access:
+// * Metadata service at fe80::a9fe:a9fe on port 80
+// * DNS server (dnsmasq)
+// * DHCPv6 server and router advertisements (dnsmasq)
+// * The public IPv6 internet
+func ip6TableRules(tapDevice string, ipv6Prefix string, delete bool) [][]string {
+	subnet := ipv6Prefix + "::/64"
+	linkLocal := "fe80::/64"
+
+	ruleAction := "-A"
+	chainAction := "-N"
+	if delete {
+		ruleAction = "-D"
+		chainAction = "-X"
+	}
+
+	// Create/delete custom chains for this tap device
+	chains := prefixCommands([]string{"ip6tables", "-w", xtableLockWait, chainAction}, [][]string{
+		{"input_" + tapDevice},
+		{"output_" + tapDevice},
+		{"fwd_input_" + tapDevice},
+		{"fwd_output_" + tapDevice},
+	})
+
+	// Rules for jumping to custom chains for this tap device
+	rules := prefixCommands([]string{"ip6tables", "-w", xtableLockWait, ruleAction}, [][]string{
+		{"INPUT", "-i", tapDevice, "-j", "input_" + tapDevice},
+		{"OUTPUT", "-o", tapDevice, "-j", "output_" + tapDevice},
+		{"FORWARD", "-i", tapDevice, "-j", "fwd_input_" + tapDevice},
+		{"FORWARD", "-o", tapDevice, "-j", "fwd_output_" + tapDevice},
+	})
+
+	// Rules for nat from this subnet
+	nat := prefixCommands([]string{"ip6tables", "-w", xtableLockWait, "-t", "nat", ruleAction}, [][]string{
+		{"POSTROUTING", "-o", "eth0", "-s", subnet, "-j", "MASQUERADE"},
+	})
+
+	// Rules for filtering INPUT from this tap device
+	inputRules := prefixCommands([]string{"ip6tables", "-w", xtableLockWait, ruleAction, "input_" + tapDevice}, [][]string{
+		// Allow neighbor discovery and router solicitation
+		{"-p", "ipv6-icmp", "-m", "icmp6", "--icmpv6-type", "router-solicitation", "-j", "ACCEPT"},
+		{"-p", "ipv6-icmp", "-m", "icmp6", "--icmpv6-type", "neighbour-solicitation", "-j", "ACCEPT"},
+		{"-p", "ipv6-icmp", "-m", "icmp6", "--icmpv6-type", "neighbour-advertisement", "-j", "ACCEPT"},
+		// Allow requests to meta-data service (from link-local only)
+		{"-p", "tcp", "-s", linkLocal, "-d", metaDataIPv6, "-m", "tcp", "--dport", "80", "-m", "state", "--state", "NEW,ESTABLISHED", "-j", "ACCEPT"},
+		// Allow DNS requests
+		{"-p", "tcp", "-s", subnet, "-m", "tcp", "--dport", "53", "-m", "state", "--state", "NEW,ESTABLISHED", "-j", "ACCEPT"},
+		{"-p", "udp", "-s", subnet, "-m", "udp", "--dport", "53", "-m", "state", "--state", "NEW,ESTABLISHED", "-j", "ACCEPT"},
+		{"-p", "tcp", "-s", linkLocal, "-m", "tcp", "--dport", "53", "-m", "state", "--state", "NEW,ESTABLISHED", "-j", "ACCEPT"},
+		{"-p", "udp", "-s", linkLocal, "-m", "udp", "--dport", "53", "-m", "state", "--state", "NEW,ESTABLISHED", "-j", "ACCEPT"},
+		// Allow DHCPv6 requests
+		{"-s", linkLocal, "-d", "ff02::1:2", "-p", "udp", "-m", "udp", "--sport", "546", "--dport", "547", "-j", "ACCEPT"},
+		// Reject all other input (with special case for wrong port on meta-data service)
+		{"-s", linkLocal, "-d", metaDataIPv6, "-j", "REJECT", "--reject-with", "icmp6-port-unreachable"},
+		{"-j", "REJECT", "--reject-with", "icmp6-addr-unreachable"},
+	})
+
+	// Rules for filtering OUTPUT to this tap device
+	outputRules := prefixCommands([]string{"ip6tables", "-w", xtableLockWait, ruleAction, "output_" + tapDevice}, [][]string{
+		// Allow neighbor discovery and router advertisements
+		{"-p", "ipv6-icmp", "-m", "icmp6", "--icmpv6-type", "router-advertisement", "-j", "ACCEPT"},
+		{"-p", "ipv6-icmp", "-m", "icmp6", "--icmpv6-type", "neighbour-solicitation", "-j", "ACCEPT"},
+		{"-p", "ipv6-icmp", "-m", "icmp6", "--icmpv6-type", "neighbour-advertisement", "-j", "ACCEPT"},
+		// Allow meta-data replies (to link-local only)
+		{"-p", "tcp", "-s", metaDataIPv6, "-d", linkLocal, "-m", "tcp", "--sport", "80", "-m", "state", "--state", "ESTABLISHED", "-j", "ACCEPT"},
+		// Allow DNS replies from dnsmasq
+		{"-p", "udp", "-m", "udp", "--sport", "53", "-m", "state", "--state", "ESTABLISHED", "-j", "ACCEPT"},
+		{"-p", "tcp", "-m", "tcp", "--sport", "53", "-m", "state", "--state", "ESTABLISHED", "-j", "ACCEPT"},
+		// Allow DHCPv6 replies
+		{"-p", "udp", "-m", "udp", "--sport", "547", "--dport", "546", "-j", "ACCEPT"},
+		// Reject all other output
+		{"-j", "REJECT", "--reject-with", "icmp6-adm-prohibited"},
+	})
+
+	// Rules for filtering FORWARD from this tap device
+	forwardInputRules := prefixCommands([]string{"ip6tables", "-w", xtableLockWait, ruleAction, "fwd_input_" + tapDevice}, [][]string{
+		// Reject out-going from this tap device to unique-local and link-local
+		{"-d", "fc00::/7", "-j", "REJECT", "--reject-with", "icmp6-adm-prohibited"},
+		{"-d", "fe80::/10", "-j", "REJECT", "--reject-with", "icmp6-adm-prohibited"},
+		// Allow out-going from this tap device with correct source subnet
+		{"-o", "eth0", "-s", subnet, "-j", "ACCEPT"},
+		// Reject all other input for forwarding from tap-device
+		{"-j", "REJECT", "--reject-with", "icmp6-adm-prohibited"},
+	})
+
+	// Rules for filtering FORWARD to this tap device
+	forwardOutputRules := prefixCommands([]string{"ip6tables", "-w", xtableLockWait, ruleAction, "fwd_output_" + tapDevice}, [][]string{
+		// Reject incoming from unique-local and link-local to this tap device
+		{"-s", "fc00::/7", "-j", "DROP"},
+		{"-s", "fe80::/10", "-j", "DROP"},
+		// Allow incoming from this tap device with correct destination (if already established)
+		{"-i", "eth0", "-d", subnet, "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT"},
+		// Reject all other output from forwarding to tap-device
+		{"-j", "DROP"},
+	})
+
+	cmds := [][]string{}
+	if !delete {
+		cmds = append(cmds, nat...)
+		cmds = append(cmds, chains...)
+		cmds = append(cmds, rules...)
+		cmds = append(cmds, inputRules...)
+		cmds = append(cmds, outputRules...)
+		cmds = append(cmds, forwardOutputRules...)
+		cmds = append(cmds, forwardInputRules...)
+	} else {
+		// Reverse order when deleting, because we can't delete chains that are
+		// referenced by a rule
+		cmds = append(cmds, forwardInputRules...)
+		cmds = append(cmds, forwardOutputRules...)
+		cmds = append(cmds, outputRules...)
+		cmds = append(cmds, inputRules...)
+		cmds = append(cmds, rules...)
+		cmds = append(cmds, chains...)
+		cmds = append(cmds, nat...)
+	}
+
+	return cmds
+}
@@ -0,0 +1,94 @@
+package network
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+// errListenerClosed is returned from Accept() when the multiListener is closed
+var errListenerClosed = errors.New("listener closed")
+
+// multiListener is a net.Listener that accepts connections from a set of
+// listeners. This allows a single http.Server to serve the meta-data service
+// on both the IPv4 address and the IPv6 link-local address of each TAP device.
+type multiListener struct {
+	listeners []net.Listener
+	conns     chan net.Conn
+	errs      chan error
+	done      chan struct{}
+	closing   sync.Once
+}
+
+// newMultiListener returns a net.Listener accepting connections from all the
+// listeners given, which must be non-empty.
+func newMultiListener(listeners ...net.Listener) net.Listener {
+	if len(listeners) == 0 {
+		panic("newMultiListener requires at least one listener")
+	}
+	l := &multiListener{
+		listeners: listeners,
+		conns:     make(chan net.Conn),
+		errs:      make(chan error),
+		done:      make(chan struct{}),
+	}
+	for _, listener := range listeners {
+		go l.accept(listener)
+	}
+	return l
+}
+
+func (l *multiListener) accept(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.done:
+				return
+			}
+			// Stop accepting, if this isn't a temporary error
+			if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
+				return
+			}
+			continue
+		}
+		select {
+		case l.conns <- conn:
+		case <-l.done:
+			conn.Close()
+			return
+		}
+	}
+}
+
+// Accept waits for and returns the next connection from any of the listeners.
+func (l *multiListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case err := <-l.errs:
+		return nil, err
+	case <-l.done:
+		return nil, errListenerClosed
+	}
+}
+
+// Close closes all the underlying listeners.
+func (l *multiListener) Close() error {
+	var err error
+	l.closing.Do(func() {
+		close(l.done)
+		for _, listener := range l.listeners {
+			if cerr := listener.Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+	})
+	return err
+}
+
+// Addr returns the address of the first listener.
+func (l *multiListener) Addr() net.Addr {
+	return l.listeners[0].Addr()
+}
@@ -0,0 +1,33 @@
+package network
+
+import (
+	"net"
+	"testing"
+)
+
+func TestMultiListener(t *testing.T) {
+	l1, err := net.Listen("tcp", "127.0.0.1:0")
+	nilOrFatal(t, err, "Failed to listen")
+	l2, err := net.Listen("tcp", "127.0.0.1:0")
+	nilOrFatal(t, err, "Failed to listen")
+
+	l := newMultiListener(l1, l2)
+	assert(t, l.Addr().String() == l1.Addr().String(), "Expected address of first listener")
+
+	// Connect to both listeners and accept from the multiListener
+	for _, addr := range []net.Addr{l1.Addr(), l2.Addr()} {
+		c, err := net.Dial("tcp", addr.String())
+		nilOrFatal(t, err, "Failed to dial: ", addr)
+		conn, err := l.Accept()
+		nilOrFatal(t, err, "Failed to accept from: ", addr)
+		assert(t, conn.LocalAddr().String() == addr.String(), "Wrong local address: ", conn.LocalAddr())
+		conn.Close()
+		c.Close()
+	}
+
+	nilOrFatal(t, l.Close(), "Failed to close")
+	_, err = l.Accept()
+	assert(t, err != nil, "Expected Accept() to fail after Close()")
+	_, err = net.Dial("tcp", l2.Addr().String())
+	assert(t, err != nil, "Expected underlying listeners to be closed")
+}
@@ -3,6 +3,7 @@ package network
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os/exec"
@@ -23,8 +24,16 @@ import (
 
 const metaDataIP = "169.254.169.254"
 
+// metaDataIPv6 is the link-local address of the meta-data service on each TAP
+// device, the guest must specify the interface, ie. http://[fe80::a9fe:a9fe%eth0]
+const metaDataIPv6 = "fe80::a9fe:a9fe"
+
 var remoteAddrPattern = regexp.MustCompile(`^(192\.168\.\d{1,3})\.\d{1,3}:\d{1,5}$`)
 
+// remoteAddrIPv6Pattern matches link-local remote addresses, the zone is the
+// interface the request was received on.
+var remoteAddrIPv6Pattern = regexp.MustCompile(`^\[fe80::[0-9a-fA-F:]+%(tctap\d+)\]:\d{1,5}$`)
+
 // Pool manages a static set of networks (TAP devices).
 type Pool struct {
 	m          sync.Mutex
@@ -32,6 +41,8 @@ type Pool struct {
 	server     *graceful.Server
 	serverDone <-chan struct{} // closed when server is stopped
 	vpns       []*openvpn.VPN
+	bandwidth  bandwidthConfig
+	ipv6       bool // true, if networks are dual-stack
 	dnsmasq    *exec.Cmd
 	disposing  atomics.Bool   // Set when we're disposing, before killing dnsmasq
 	disposed   sync.WaitGroup // Counts subprocesses, dnsmasq and vpns
@@ -39,12 +50,16 @@ type Pool struct {
 
 // entry is a strictly internal presentation of a TAP device network.
 type entry struct {
-	tapDevice string
-	ipPrefix  string // 192.168.xxx (subnet without the last ".0")
-	m         sync.RWMutex
-	handler   http.Handler
-	pool      *Pool
-	inUse     bool
+	tapDevice  string
+	ipPrefix   string // 192.168.xxx (subnet without the last ".0")
+	ipv6Prefix string // fd00:7463:xx (subnet without the last "::/64"), empty if IPv6 is disabled
+	resolver   *exec.Cmd
+	hostsFile  string // additional hosts file for the resolver
+	m          sync.RWMutex
+	handler    http.Handler
+	guestIP    string // IPv4 address of the guest, learned from meta-data requests
+	pool       *Pool
+	inUse      bool
 }
 
 // PoolOptions specifies options required by NewPool
@@ -63,7 +78,9 @@ func NewPool(options PoolOptions) (*Pool, error) {
 	schematypes.MustValidateAndMap(PoolConfigSchema, options.Config, &C)
 
 	p := &Pool{
-		networks: make(map[string]*entry),
+		networks:  make(map[string]*entry),
+		bandwidth: C.Bandwidth,
+		ipv6:      C.IPv6 != nil,
 	}
 
 	// Start VPN connections
@@ -110,26 +127,36 @@ func NewPool(options PoolOptions) (*Pool, error) {
 		return nil, fmt.Errorf("Failed to enable ipv4 forwarding: %s", err)
 	}
 
-	// Create dnsmasq configuration
-	dnsmasqConfig := []string{
+	// Enable IPv6 forwarding, this disables router advertisements on the uplink
+	// interface unless we explicitly accept them, which we need if the host uses
+	// SLAAC.
+	if C.IPv6 != nil {
+		var cmds [][]string
+		if C.IPv6.UplinkInterface != "" {
+			cmds = append(cmds, []string{
+				"sysctl", "-w", "net.ipv6.conf." + C.IPv6.UplinkInterface + ".accept_ra=2",
+			})
+		}
+		cmds = append(cmds, []string{"sysctl", "-w", "net.ipv6.conf.all.forwarding=1"})
+		if err = script(cmds, true); err != nil {
+			return nil, fmt.Errorf("Failed to enable ipv6 forwarding: %s", err)
+		}
+	}
+
+	// Create DNS configuration shared by the resolvers for all networks
+	dnsConfig := []string{
 		"strict-order",
-		"bind-interfaces",
-		"except-interface=lo",
-		"conf-file=\"\"",
-		"dhcp-no-override",
 		"host-record=taskcluster," + metaDataIP,
-		"keep-in-foreground",
 		"bogus-priv",
 		"domain-needed",
-		// Consider adding "no-ping"
 	}
 	for _, rec := range C.HostRecords {
-		dnsmasqConfig = append(dnsmasqConfig,
+		dnsConfig = append(dnsConfig,
 			"host-record="+strings.Join(append(rec.Names, rec.IPv4, rec.IPv6), ","),
 		)
 	}
 	for _, srv := range C.SRVRecords {
-		dnsmasqConfig = append(dnsmasqConfig,
+		dnsConfig = append(dnsConfig,
 			"srv-host="+strings.Join([]string{
 				strings.Join([]string{srv.Service, srv.Protocol, srv.Domain}, "."),
 				srv.Target,
@@ -139,6 +166,21 @@ func NewPool(options PoolOptions) (*Pool, error) {
 			}, ","),
 		)
 	}
+
+	// Create dnsmasq configuration, DNS is disabled as each network has its own
+	// resolver, so we can serve host records for each virtual machine.
+	dnsmasqConfig := []string{
+		"port=0",
+		"bind-interfaces",
+		"except-interface=lo",
+		"conf-file=\"\"",
+		"dhcp-no-override",
+		"keep-in-foreground",
+		// Consider adding "no-ping"
+	}
+	if p.ipv6 {
+		dnsmasqConfig = append(dnsmasqConfig, "enable-ra")
+	}
 	for _, n := range p.networks {
 		dnsmasqConfig = append(dnsmasqConfig,
 			"interface="+n.tapDevice,
@@ -154,6 +196,30 @@ func NewPool(options PoolOptions) (*Pool, error) {
 				"option:router",
 				n.ipPrefix + ".1",
 			}, ","),
+			"dhcp-option="+strings.Join([]string{
+				"tag:" + n.tapDevice,
+				"option:dns-server",
+				n.ipPrefix + ".1",
+			}, ","),
+		)
+		if !p.ipv6 {
+			continue
+		}
+		dnsmasqConfig = append(dnsmasqConfig,
+			// IPv6 addresses are assigned with DHCPv6, router advertisements tells
+			// the guest to use DHCPv6 and provides the default route.
+			"dhcp-range="+strings.Join([]string{
+				"tag:" + n.tapDevice,
+				n.ipv6Prefix + "::2",
+				n.ipv6Prefix + "::ffff",
+				"64",
+				"20m",
+			}, ","),
+			"dhcp-option="+strings.Join([]string{
+				"tag:" + n.tapDevice,
+				"option6:dns-server",
+				"[" + n.ipv6Prefix + "::1]",
+			}, ","),
 		)
 	}
 
@@ -166,21 +232,14 @@ func NewPool(options PoolOptions) (*Pool, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "Failed to start dnsmasq")
 	}
-	// Monitor dnsmasq and panic if it crashes unexpectedly
-	p.disposed.Add(1)
-	go (func(p *Pool) {
-		werr := p.dnsmasq.Wait()
-		p.disposed.Done()
-		// Ignore errors if disposing is true, otherwise this is a fatal issue
-		if werr != nil && !p.disposing.Get() {
-			// We could probably restart the dnsmasq, as long as we avoid an infinite
-			// loop that should be fine. But dnsmasq probably won't crash without a
-			// good reason
-			m := options.Monitor.WithPrefix("dnsmasq")
-			incidentID := m.ReportError(werr, "dnsmasq died unexpectedly")
-			m.Panic("dnsmasq crashed, incidentID:", incidentID)
+	p.watchDNSMasq(p.dnsmasq, options.Monitor.WithPrefix("dnsmasq"))
+
+	// Start a resolver for each network
+	for _, n := range p.networks {
+		if err = p.startResolver(n, dnsConfig, options); err != nil {
+			return nil, err
 		}
-	})(p)
+	}
 
 	// Add meta-data IP to loopback device
 	err = script([][]string{
@@ -203,12 +262,31 @@ func NewPool(options PoolOptions) (*Pool, error) {
 	}
 
 	// Start listening (we handle listener error as a special thing)
+	listeners := []net.Listener{}
 	listener, err := net.Listen("tcp", p.server.Addr)
 	if err != nil {
 		// If this happens ensure that we have configured the loopback device with:
 		// sudo ip addr add 169.254.169.254/24 scope link dev lo
 		return nil, errors.Wrapf(err, "Failed to listen on %s", p.server.Addr)
 	}
+	listeners = append(listeners, listener)
+
+	// Listen on the IPv6 link-local meta-data address for each TAP device
+	for _, n := range p.networks {
+		if !p.ipv6 {
+			break
+		}
+		addr := "[" + metaDataIPv6 + "%" + n.tapDevice + "]:80"
+		listener, err = net.Listen("tcp6", addr)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, errors.Wrapf(err, "Failed to listen on %s", addr)
+		}
+		listeners = append(listeners, listener)
+	}
+	listener = newMultiListener(listeners...)
 
 	// Start the server
 	go (func(p *Pool, done chan<- struct{}) {
@@ -229,30 +307,71 @@ func (p *Pool) Size() int {
 	return len(p.networks)
 }
 
-func (p *Pool) dispatchRequest(w http.ResponseWriter, r *http.Request) {
+// VPNs returns the number of VPN connections, each of which is an openvpn
+// process running on the host.
+func (p *Pool) VPNs() int {
+	return len(p.vpns)
+}
+
+// Subnets returns the subnets of the networks in the Pool, services on the
+// host that guests shouldn't access can use this to reject requests.
+func (p *Pool) Subnets() []*net.IPNet {
+	var subnets []*net.IPNet
+	for _, n := range p.networks {
+		_, subnet, err := net.ParseCIDR(n.ipPrefix + ".0/24")
+		if err != nil {
+			panic(errors.Wrap(err, "invalid ipPrefix for network"))
+		}
+		subnets = append(subnets, subnet)
+		if n.ipv6Prefix != "" {
+			_, subnet, err = net.ParseCIDR(n.ipv6Prefix + "::/64")
+			if err != nil {
+				panic(errors.Wrap(err, "invalid ipv6Prefix for network"))
+			}
+			subnets = append(subnets, subnet)
+		}
+	}
+	return subnets
+}
+
+// lookupNetwork finds the network a request from remoteAddr was received on.
+// Returns nil, if remoteAddr doesn't match any network.
+func (p *Pool) lookupNetwork(remoteAddr string) *entry {
 	// Match remote address to find ipPrefix
-	match := remoteAddrPattern.FindStringSubmatch(r.RemoteAddr)
-	if len(match) != 2 {
-		debug("request from forbidden remote address: %s - %s %s",
-			r.RemoteAddr, r.Method, r.URL.String())
-		w.WriteHeader(http.StatusForbidden)
-		return
+	if match := remoteAddrPattern.FindStringSubmatch(remoteAddr); len(match) == 2 {
+		return p.networks[match[1]]
 	}
-	ipPrefix := match[1]
 
-	// Find network from the ipPrefix
-	n := p.networks[ipPrefix]
+	// Match IPv6 link-local remote address to find tapDevice
+	if match := remoteAddrIPv6Pattern.FindStringSubmatch(remoteAddr); len(match) == 2 {
+		for _, n := range p.networks {
+			if n.tapDevice == match[1] {
+				return n
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p *Pool) dispatchRequest(w http.ResponseWriter, r *http.Request) {
+	// Find network from the remote address
+	n := p.lookupNetwork(r.RemoteAddr)
 	if n == nil {
-		debug("Request from ipPrefix: %s, not matching any network - %s %s",
-			ipPrefix, r.Method, r.URL.String())
+		debug("request from forbidden remote address: %s - %s %s",
+			r.RemoteAddr, r.Method, r.URL.String())
 		w.WriteHeader(http.StatusForbidden)
 		return
 	}
 
-	// Read lock the network, so the handler can't be cleared while we do this
-	n.m.RLock()
+	// Lock the network, so the handler can't be cleared while we do this, and
+	// record the guest address, which we need to forward ports to the guest
+	n.m.Lock()
 	handler := n.handler
-	n.m.RUnlock()
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil && strings.HasPrefix(host, n.ipPrefix+".") {
+		n.guestIP = host
+	}
+	n.m.Unlock()
 
 	// Call handler
 	if handler != nil {
@@ -266,8 +385,11 @@ func (p *Pool) dispatchRequest(w http.ResponseWriter, r *http.Request) {
 
 // Network is provides the interface for using a TAP device, and releasing it.
 type Network struct {
-	m     sync.Mutex
-	entry *entry
+	m        sync.Mutex
+	entry    *entry
+	forwards []*portForward // ports forwarded to the guest
+	egress   [][]*net.IPNet // subnets allowed by each egress restriction
+	hosts    bool           // true, if host records have been set
 }
 
 // SetHandler sets the http.handler for meta-data service for this tap-device.
@@ -293,6 +415,37 @@ func (n *Network) NetDev(ID string) string {
 	return "tap,id=" + ID + ",ifname=" + n.entry.tapDevice + ",script=no,downscript=no"
 }
 
+// Traffic returns the number of bytes received and sent by the virtual machine
+// since the TAP device was created. TAP devices are reused, so callers should
+// compute the difference from when the network was acquired.
+func (n *Network) Traffic() (received, sent int64, err error) {
+	n.m.Lock()
+	if n.entry == nil {
+		n.m.Unlock()
+		return 0, 0, errors.New("Network.Traffic() called after Network.Release()")
+	}
+	statistics := "/sys/class/net/" + n.entry.tapDevice + "/statistics/"
+	n.m.Unlock()
+
+	// What the TAP device transmits is received by the virtual machine
+	if received, err = readCounter(statistics + "tx_bytes"); err != nil {
+		return 0, 0, err
+	}
+	if sent, err = readCounter(statistics + "rx_bytes"); err != nil {
+		return 0, 0, err
+	}
+	return received, sent, nil
+}
+
+// readCounter reads an integer counter from a sysfs file
+func readCounter(file string) (int64, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read network statistics")
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
+
 // Release returns this network to the Pool
 func (n *Network) Release() {
 	// Lock the wrapper
@@ -304,9 +457,16 @@ func (n *Network) Release() {
 		return
 	}
 
-	// Lock entry and clear the handler
+	// Stop forwarding ports to the guest, remove egress restrictions and host
+	// records
+	n.stopForwarding()
+	n.removeEgressRestrictions()
+	n.removeHostRecords()
+
+	// Lock entry and clear the handler and guest address
 	n.entry.m.Lock()
 	n.entry.handler = nil
+	n.entry.guestIP = ""
 	n.entry.m.Unlock()
 
 	// Set entry as idle
@@ -356,8 +516,11 @@ func (p *Pool) Dispose() error {
 	// Indicate that error exit is expected, from dnsmasq
 	p.disposing.Set(true)
 
-	// Kill dnsmasq
+	// Kill dnsmasq and the resolvers
 	go p.dnsmasq.Process.Kill()
+	for _, n := range p.networks {
+		go n.resolver.Process.Kill()
+	}
 
 	// Stop all VPNs
 	for _, vpn := range p.vpns {
@@ -392,9 +555,14 @@ func (p *Pool) Dispose() error {
 // networks with dnsmasq running.
 func createNetwork(index int, parent *Pool) (*entry, error) {
 	// Each network has a name and an ip-prefix, we use the 192.168.0.0/16
-	// subnet starting from 192.168.150.0
+	// subnet starting from 192.168.150.0, and if IPv6 is enabled the unique-local
+	// fd00:7463::/32 subnet starting from fd00:7463:96::/64 (150 in hex)
 	tapDevice := "tctap" + strconv.Itoa(index)
 	ipPrefix := "192.168." + strconv.Itoa(index+150)
+	ipv6Prefix := ""
+	if parent.ipv6 {
+		ipv6Prefix = "fd00:7463:" + strconv.FormatInt(int64(index+150), 16)
+	}
 
 	//err := createTAPDevice(tapDevice)
 	//if err != nil {
@@ -414,19 +582,44 @@ func createNetwork(index int, parent *Pool) (*entry, error) {
 	if err != nil {
 		return nil, fmt.Errorf("Failed to setup tap device: %s, error: %s", tapDevice, err)
 	}
+	if ipv6Prefix != "" {
+		err = script([][]string{
+			// Assign IPv6 address and meta-data link-local address to tap device, we
+			// skip duplicate address detection as the tap device has no carrier yet.
+			// Note: this adds a route for the /64 subnets to the tap device.
+			{"ip", "-6", "addr", "add", ipv6Prefix + "::1/64", "dev", tapDevice, "nodad"},
+			{"ip", "-6", "addr", "add", metaDataIPv6 + "/64", "dev", tapDevice, "nodad"},
+		}, true)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to setup IPv6 for tap device: %s, error: %s", tapDevice, err)
+		}
+	}
 
 	// Create iptables rules and chains
 	err = script(ipTableRules(tapDevice, ipPrefix, parent.vpns, false), false)
 	if err != nil {
 		return nil, fmt.Errorf("Failed to setup ip-tables for tap device: %s error: %s", tapDevice, err)
 	}
+	if ipv6Prefix != "" {
+		err = script(ip6TableRules(tapDevice, ipv6Prefix, false), false)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to setup ip6-tables for tap device: %s error: %s", tapDevice, err)
+		}
+	}
+
+	// Apply bandwidth limits
+	err = script(tcRules(tapDevice, parent.bandwidth), false)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to setup bandwidth limits for tap device: %s error: %s", tapDevice, err)
+	}
 
 	// Construct the network object
 	return &entry{
-		tapDevice: tapDevice,
-		ipPrefix:  ipPrefix,
-		handler:   nil,
-		pool:      parent,
+		tapDevice:  tapDevice,
+		ipPrefix:   ipPrefix,
+		ipv6Prefix: ipv6Prefix,
+		handler:    nil,
+		pool:       parent,
 	}, nil
 }
 
@@ -443,6 +636,20 @@ func destroyNetwork(n *entry) error {
 	if err != nil {
 		return fmt.Errorf("Failed to remove ip-tables for tap device: %s, error: %s", n.tapDevice, err)
 	}
+	if n.ipv6Prefix != "" {
+		err = script(ip6TableRules(n.tapDevice, n.ipv6Prefix, true), false)
+		if err != nil {
+			return fmt.Errorf("Failed to remove ip6-tables for tap device: %s, error: %s", n.tapDevice, err)
+		}
+		err = script([][]string{
+			// Unassign IPv6 addresses from tap device
+			{"ip", "-6", "addr", "del", n.ipv6Prefix + "::1/64", "dev", n.tapDevice},
+			{"ip", "-6", "addr", "del", metaDataIPv6 + "/64", "dev", n.tapDevice},
+		}, true)
+		if err != nil {
+			return fmt.Errorf("Failed to remove IPv6 addresses from tap device: %s, error: %s", n.tapDevice, err)
+		}
+	}
 
 	err = script([][]string{
 		// Remove route for the network subnet
@@ -7,10 +7,16 @@ import (
 )
 
 type poolConfig struct {
-	Subnets     int           `json:"subnets"`
-	VPNs        []interface{} `json:"vpnConnections,omitempty"`
-	SRVRecords  []srvRecord   `json:"srvRecords,omitempty"`
-	HostRecords []hostRecord  `json:"hostRecords,omitempty"`
+	Subnets     int             `json:"subnets"`
+	VPNs        []interface{}   `json:"vpnConnections,omitempty"`
+	SRVRecords  []srvRecord     `json:"srvRecords,omitempty"`
+	HostRecords []hostRecord    `json:"hostRecords,omitempty"`
+	Bandwidth   bandwidthConfig `json:"bandwidth"`
+	IPv6        *ipv6Config     `json:"ipv6,omitempty"`
+}
+
+type ipv6Config struct {
+	UplinkInterface string `json:"uplinkInterface,omitempty"`
 }
 
 type srvRecord struct {
@@ -99,6 +105,33 @@ var PoolConfigSchema schematypes.Schema = schematypes.Object{
 				Required: []string{"names"},
 			},
 		},
+		"bandwidth": bandwidthSchema,
+		"ipv6": schematypes.Object{
+			Title: "IPv6",
+			Description: util.Markdown(`
+				If given, networks are dual-stack, virtual machines get an IPv6
+				address using DHCPv6 and router advertisements, and the meta-data
+				service is reachable on the link-local address 'fe80::a9fe:a9fe'.
+				This requires IPv6 and 'ip6tables' on the host, and enables IPv6
+				forwarding.
+
+				If not given, virtual machines only have IPv4 connectivity.
+			`),
+			Properties: schematypes.Properties{
+				"uplinkInterface": schematypes.String{
+					Title: "Uplink Interface",
+					Description: util.Markdown(`
+						Interface through which the host gets its IPv6 address using
+						SLAAC, such as 'eth0'. Enabling IPv6 forwarding stops the kernel
+						from accepting router advertisements, so 'accept_ra' is set to 2
+						for this interface.
+
+						If not given, 'accept_ra' isn't changed for any interface.
+					`),
+					Pattern: `^[a-zA-Z0-9_.-]{1,15}$`,
+				},
+			},
+		},
 	},
 	Required: []string{"subnets"},
 }
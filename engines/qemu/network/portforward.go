@@ -0,0 +1,167 @@
+package network
+
+import (
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/engines"
+)
+
+// portForwardDialTimeout is the time allowed for connecting to the guest when
+// forwarding a connection from the host.
+const portForwardDialTimeout = 30 * time.Second
+
+// listenLoopback listens on an ephemeral port on the loopback interface and
+// returns the listener and the port.
+func listenLoopback() (net.Listener, int, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "failed to listen on an ephemeral port for port forwarding")
+	}
+	return listener, listener.Addr().(*net.TCPAddr).Port, nil
+}
+
+// portForward accepts connections on the host and forwards them to a port in
+// the guest.
+type portForward struct {
+	listener  net.Listener
+	guestPort int
+	dial      func(port int) (net.Conn, error)
+	conns     sync.WaitGroup
+	closed    chan struct{} // closed when forwarding is stopped
+}
+
+// serve accepts connections until the listener is closed
+func (f *portForward) serve() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			return
+		}
+		f.conns.Add(1)
+		go func() {
+			defer f.conns.Done()
+			defer conn.Close()
+			guest, err := f.dial(f.guestPort)
+			if err != nil {
+				debug("failed to forward connection to guest port %d, error: %s", f.guestPort, err)
+				return
+			}
+			defer guest.Close()
+
+			// Forward data until either side is closed
+			done := make(chan struct{}, 2)
+			go func() {
+				io.Copy(guest, conn)
+				done <- struct{}{}
+			}()
+			go func() {
+				io.Copy(conn, guest)
+				done <- struct{}{}
+			}()
+			select {
+			case <-done:
+			case <-f.closed:
+			}
+		}()
+	}
+}
+
+// stop closes the listener and all forwarded connections
+func (f *portForward) stop() {
+	close(f.closed)
+	f.listener.Close()
+	f.conns.Wait()
+}
+
+// ForwardPorts forwards ephemeral ports on 127.0.0.1 of the host to the given
+// ports in the guest. The guest address is learned from requests to the
+// meta-data service, connections made before the guest has contacted the
+// meta-data service are closed immediately. Ports are forwarded until the
+// network is released.
+func (n *Network) ForwardPorts(guestPorts []int) ([]engines.PortForward, error) {
+	n.m.Lock()
+	defer n.m.Unlock()
+	if n.entry == nil {
+		panic("Network.ForwardPorts() called after Network.Release()")
+	}
+
+	var result []engines.PortForward
+	for _, port := range guestPorts {
+		listener, hostPort, err := listenLoopback()
+		if err != nil {
+			n.stopForwarding()
+			return nil, err
+		}
+		// Allow connections from the host to the guest port through the firewall
+		err = script(portForwardRules(n.entry.tapDevice, n.entry.ipPrefix, port, false), false)
+		if err != nil {
+			listener.Close()
+			n.stopForwarding()
+			return nil, errors.Wrapf(err, "failed to setup ip-tables for forwarding port %d", port)
+		}
+		f := &portForward{
+			listener:  listener,
+			guestPort: port,
+			dial:      n.entry.dialGuest,
+			closed:    make(chan struct{}),
+		}
+		n.forwards = append(n.forwards, f)
+		go f.serve()
+		result = append(result, engines.PortForward{GuestPort: port, HostPort: hostPort})
+	}
+	return result, nil
+}
+
+// stopForwarding closes all port forwards and removes the ip-tables rules
+// allowing them, n.m must be held.
+func (n *Network) stopForwarding() {
+	for _, f := range n.forwards {
+		f.stop()
+		err := script(portForwardRules(n.entry.tapDevice, n.entry.ipPrefix, f.guestPort, true), false)
+		if err != nil {
+			debug("failed to remove ip-tables for port %d on %s, error: %s", f.guestPort, n.entry.tapDevice, err)
+		}
+	}
+	n.forwards = nil
+}
+
+// dialGuest connects to port on the guest address, as learned from requests
+// to the meta-data service.
+func (e *entry) dialGuest(port int) (net.Conn, error) {
+	e.m.RLock()
+	guestIP := e.guestIP
+	e.m.RUnlock()
+	if guestIP == "" {
+		return nil, errors.New("guest address is unknown, the guest hasn't contacted the meta-data service")
+	}
+	return net.DialTimeout("tcp", net.JoinHostPort(guestIP, strconv.Itoa(port)), portForwardDialTimeout)
+}
+
+// ForwardPorts forwards ephemeral ports on 127.0.0.1 of the host to the given
+// ports in the guest using 'hostfwd' in the QEMU user-space network stack.
+// This must be called before NetDev().
+//
+// The ports are reserved by listening on them and closing the listener, so
+// another process could take a port before QEMU listens on it, in which case
+// QEMU fails to start.
+func (n *UserNetwork) ForwardPorts(guestPorts []int) ([]engines.PortForward, error) {
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	var result []engines.PortForward
+	for _, port := range guestPorts {
+		listener, hostPort, err := listenLoopback()
+		if err != nil {
+			return nil, err
+		}
+		listener.Close()
+		result = append(result, engines.PortForward{GuestPort: port, HostPort: hostPort})
+	}
+	n.forwards = append(n.forwards, result...)
+	return result, nil
+}
@@ -0,0 +1,71 @@
+package network
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestPortForwardRules(t *testing.T) {
+	cmds := portForwardRules("tctap0", "192.168.150", 8080, false)
+	assert(t, len(cmds) == 2, "Expected two commands for port forwarding")
+	cmd := strings.Join(cmds[0], " ")
+	assert(t, strings.HasPrefix(cmd, "iptables -w 3 -I output_tctap0 1 "), "Unexpected command: ", cmd)
+	assert(t, strings.Contains(cmd, "-s 192.168.150.1 -d 192.168.150.0/24"), "Unexpected command: ", cmd)
+	assert(t, strings.Contains(cmd, "--dport 8080"), "Unexpected command: ", cmd)
+	cmd = strings.Join(cmds[1], " ")
+	assert(t, strings.HasPrefix(cmd, "iptables -w 3 -I input_tctap0 1 "), "Unexpected command: ", cmd)
+	assert(t, strings.Contains(cmd, "--sport 8080"), "Unexpected command: ", cmd)
+
+	cmds = portForwardRules("tctap0", "192.168.150", 8080, true)
+	assert(t, len(cmds) == 2, "Expected two commands for removing port forwarding")
+	cmd = strings.Join(cmds[0], " ")
+	assert(t, strings.HasPrefix(cmd, "iptables -w 3 -D output_tctap0 -p tcp"), "Unexpected command: ", cmd)
+}
+
+func TestPortForwardProxy(t *testing.T) {
+	// Echo server playing the part of the guest
+	guest, err := net.Listen("tcp", "127.0.0.1:0")
+	nilOrFatal(t, err, "Failed to listen")
+	defer guest.Close()
+	go func() {
+		for {
+			conn, err := guest.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	listener, hostPort, err := listenLoopback()
+	nilOrFatal(t, err, "Failed to listen on loopback")
+	f := &portForward{
+		listener:  listener,
+		guestPort: 80,
+		dial: func(port int) (net.Conn, error) {
+			return net.Dial("tcp", guest.Addr().String())
+		},
+		closed: make(chan struct{}),
+	}
+	go f.serve()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	nilOrFatal(t, err, "Failed to connect to port ", hostPort)
+	_, err = conn.Write([]byte("hello"))
+	nilOrFatal(t, err, "Failed to write")
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	nilOrFatal(t, err, "Failed to read")
+	assert(t, string(buf) == "hello", "Unexpected reply: ", string(buf))
+
+	// Stopping must close forwarded connections
+	f.stop()
+	_, err = conn.Read(buf)
+	assert(t, err != nil, "Expected connection to be closed")
+	conn.Close()
+}
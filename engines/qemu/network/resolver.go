@@ -0,0 +1,124 @@
+package network
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+// HostRecord maps Name to an IPv4 or IPv6 address, there may be multiple
+// records for the same name.
+type HostRecord struct {
+	Name string
+	IP   string
+}
+
+// hostsFileContent returns records in the hosts file format read by dnsmasq.
+func hostsFileContent(records []HostRecord) ([]byte, error) {
+	b := bytes.NewBuffer(nil)
+	for _, r := range records {
+		if net.ParseIP(r.IP) == nil {
+			return nil, errors.Errorf("host record for '%s' has invalid IP address: '%s'", r.Name, r.IP)
+		}
+		if r.Name == "" || strings.ContainsAny(r.Name, " \t\r\n#") {
+			return nil, errors.Errorf("host record has invalid name: '%s'", r.Name)
+		}
+		fmt.Fprintf(b, "%s\t%s\n", r.IP, r.Name)
+	}
+	return b.Bytes(), nil
+}
+
+// startResolver starts a dnsmasq instance serving DNS on the tap device of n,
+// the configuration is dnsConfig and an additional hosts file for records set
+// with Network.SetHostRecords().
+func (p *Pool) startResolver(n *entry, dnsConfig []string, options PoolOptions) error {
+	n.hostsFile = options.TemporaryStorage.NewFilePath()
+	if err := ioutil.WriteFile(n.hostsFile, nil, 0644); err != nil {
+		return errors.Wrapf(err, "Failed to create hosts file for %s", n.tapDevice)
+	}
+
+	config := append([]string{
+		"bind-interfaces",
+		"interface=" + n.tapDevice,
+		"conf-file=\"\"",
+		"pid-file=",
+		"keep-in-foreground",
+		"addn-hosts=" + n.hostsFile,
+	}, dnsConfig...)
+
+	n.resolver = exec.Command("dnsmasq", "--conf-file=-")
+	n.resolver.Stdin = bytes.NewBufferString(strings.Join(config, "\n") + "\n")
+	n.resolver.Stderr = nil
+	n.resolver.Stdout = nil
+	if err := n.resolver.Start(); err != nil {
+		return errors.Wrapf(err, "Failed to start dnsmasq resolver for %s", n.tapDevice)
+	}
+	p.watchDNSMasq(n.resolver, options.Monitor.WithPrefix("dnsmasq").WithTag("network", n.tapDevice))
+	return nil
+}
+
+// watchDNSMasq monitors a dnsmasq process and panics if it crashes
+// unexpectedly.
+func (p *Pool) watchDNSMasq(cmd *exec.Cmd, m runtime.Monitor) {
+	p.disposed.Add(1)
+	go func() {
+		werr := cmd.Wait()
+		p.disposed.Done()
+		// Ignore errors if disposing is true, otherwise this is a fatal issue
+		if werr != nil && !p.disposing.Get() {
+			// We could probably restart the dnsmasq, as long as we avoid an infinite
+			// loop that should be fine. But dnsmasq probably won't crash without a
+			// good reason
+			incidentID := m.ReportError(werr, "dnsmasq died unexpectedly")
+			m.Panic("dnsmasq crashed, incidentID:", incidentID)
+		}
+	}()
+}
+
+// setHostRecords writes the hosts file for the resolver and tells dnsmasq to
+// reload it, dnsmasq also clears its cache when reloading.
+func (e *entry) setHostRecords(records []HostRecord) error {
+	data, err := hostsFileContent(records)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(e.hostsFile, data, 0644); err != nil {
+		return errors.Wrap(err, "failed to write hosts file for resolver")
+	}
+	if err = e.resolver.Process.Signal(syscall.SIGHUP); err != nil {
+		return errors.Wrap(err, "failed to reload resolver")
+	}
+	return nil
+}
+
+// SetHostRecords sets records served by the resolver for this network, in
+// addition to host records from the pool configuration. Calling this again
+// replaces the records, and records are removed when the network is released.
+func (n *Network) SetHostRecords(records []HostRecord) error {
+	n.m.Lock()
+	defer n.m.Unlock()
+	if n.entry == nil {
+		panic("Network.SetHostRecords() called after Network.Release()")
+	}
+
+	n.hosts = true
+	return n.entry.setHostRecords(records)
+}
+
+// removeHostRecords removes records set by SetHostRecords, n.m must be held.
+func (n *Network) removeHostRecords() {
+	if !n.hosts {
+		return
+	}
+	if err := n.entry.setHostRecords(nil); err != nil {
+		debug("failed to remove host records on %s, error: %s", n.entry.tapDevice, err)
+	}
+	n.hosts = false
+}
@@ -0,0 +1,21 @@
+package network
+
+import "testing"
+
+func TestHostsFileContent(t *testing.T) {
+	data, err := hostsFileContent(nil)
+	assert(t, err == nil && len(data) == 0, "Expected empty hosts file, got: ", string(data), err)
+
+	data, err = hostsFileContent([]HostRecord{
+		{Name: "queue.example.com", IP: "10.0.0.2"},
+		{Name: "queue.example.com", IP: "fd00::2"},
+	})
+	assert(t, err == nil, "Unexpected error: ", err)
+	assert(t, string(data) == "10.0.0.2\tqueue.example.com\nfd00::2\tqueue.example.com\n",
+		"Unexpected hosts file: ", string(data))
+
+	_, err = hostsFileContent([]HostRecord{{Name: "example.com", IP: "10.0.0"}})
+	assert(t, err != nil, "Expected error for invalid IP address")
+	_, err = hostsFileContent([]HostRecord{{Name: "example.com\n10.0.0.3 other", IP: "10.0.0.2"}})
+	assert(t, err != nil, "Expected error for name with newline")
+}
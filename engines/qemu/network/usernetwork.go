@@ -10,9 +10,14 @@ import (
 	"time"
 
 	"github.com/taskcluster/slugid-go/slugid"
+	"github.com/taskcluster/taskcluster-worker/engines"
 	"gopkg.in/tylerb/graceful.v1"
 )
 
+// userNetworkIPv6 is the IPv6 subnet for user-space networks, guests will get
+// an address using SLAAC from router advertisements sent by QEMU.
+const userNetworkIPv6 = "fd00:7463::/64"
+
 // UserNetwork provides an unsafe network implementation for use when building
 // and testing images locally (without root access).
 type UserNetwork struct {
@@ -21,6 +26,7 @@ type UserNetwork struct {
 	handler    http.Handler
 	server     *graceful.Server
 	serverDone <-chan struct{}
+	forwards   []engines.PortForward // ports forwarded with hostfwd
 }
 
 // NewUserNetwork returns a Network implementation using the QEMU user-space
@@ -75,8 +81,19 @@ func (n *UserNetwork) dispatchRequest(w http.ResponseWriter, r *http.Request) {
 }
 
 // NetDev returns the argument for the QEMU option -netdev
+//
+// The network is dual-stack, but QEMU only supports forwarding IPv4 connections
+// to the meta-data service, so the guest must use 169.254.169.254.
 func (n *UserNetwork) NetDev(ID string) string {
-	return "user,id=" + ID + ",net=169.254.0.0/16,guestfwd=tcp:" + metaDataIP + ":80-cmd:netcat -U " + n.socketFile
+	n.m.Lock()
+	defer n.m.Unlock()
+
+	netdev := "user,id=" + ID + ",net=169.254.0.0/16,ipv6=on,ipv6-net=" + userNetworkIPv6 +
+		",guestfwd=tcp:" + metaDataIP + ":80-cmd:netcat -U " + n.socketFile
+	for _, f := range n.forwards {
+		netdev += fmt.Sprintf(",hostfwd=tcp:127.0.0.1:%d-:%d", f.HostPort, f.GuestPort)
+	}
+	return netdev
 }
 
 // SetHandler takes an http.Handler to be used for meta-data requests.
@@ -0,0 +1,185 @@
+package qemuengine
+
+import (
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/taskcluster/taskcluster-worker/engines"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/network"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
+)
+
+// portForwarder is implemented by networks that can forward ports on the host
+// to ports in the guest.
+type portForwarder interface {
+	ForwardPorts(guestPorts []int) ([]engines.PortForward, error)
+}
+
+// egressRestricter is implemented by networks that can restrict the
+// destinations reachable from the guest.
+type egressRestricter interface {
+	RestrictEgress(allowed []*net.IPNet) error
+}
+
+// hostResolver is implemented by networks that can serve host records to the
+// guest.
+type hostResolver interface {
+	SetHostRecords(records []network.HostRecord) error
+}
+
+// Network modes supported by the engine
+const (
+	networkModeTAP  = "tap"
+	networkModeUser = "user"
+)
+
+// networkPool is a pool of networks for virtual machines, Network() returns
+// network.ErrAllNetworksInUse when all networks are in use.
+type networkPool interface {
+	Network() (vm.Network, error)
+	Size() int
+	Dispose() error
+}
+
+// tapNetworkPool wraps network.Pool to implement networkPool.
+type tapNetworkPool struct {
+	*network.Pool
+}
+
+func (p tapNetworkPool) Network() (vm.Network, error) {
+	n, err := p.Pool.Network()
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// userNetworkPool implements networkPool using network.UserNetwork, this
+// doesn't require root privileges and is useful on hosts where TAP devices
+// cannot be created. It offers less isolation and performance than TAP
+// devices, as the guest traffic goes through the QEMU user-space network stack.
+type userNetworkPool struct {
+	m            sync.Mutex
+	size         int
+	inUse        int
+	socketFolder string
+}
+
+func (p *userNetworkPool) Network() (vm.Network, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.inUse >= p.size {
+		return nil, network.ErrAllNetworksInUse
+	}
+
+	n, err := network.NewUserNetwork(p.socketFolder)
+	if err != nil {
+		return nil, err
+	}
+	p.inUse++
+	return &userNetwork{UserNetwork: n, pool: p}, nil
+}
+
+func (p *userNetworkPool) Size() int {
+	return p.size
+}
+
+func (p *userNetworkPool) Dispose() error {
+	return nil // user-space networks are released individually
+}
+
+// userNetwork wraps network.UserNetwork to return it to the pool when released.
+type userNetwork struct {
+	*network.UserNetwork
+	pool    *userNetworkPool
+	release sync.Once
+}
+
+func (n *userNetwork) Release() {
+	n.release.Do(func() {
+		n.UserNetwork.Release()
+		n.pool.m.Lock()
+		n.pool.inUse--
+		n.pool.m.Unlock()
+	})
+}
+
+// limitedNetworkPool wraps a networkPool to limit the number of networks in
+// use, this limits the number of concurrent virtual machines below the size of
+// the underlying pool.
+type limitedNetworkPool struct {
+	networkPool
+	m     sync.Mutex
+	size  int
+	inUse int
+}
+
+func (p *limitedNetworkPool) Network() (vm.Network, error) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.inUse >= p.size {
+		return nil, network.ErrAllNetworksInUse
+	}
+
+	n, err := p.networkPool.Network()
+	if err != nil {
+		return nil, err
+	}
+	p.inUse++
+	return &limitedNetwork{Network: n, pool: p}, nil
+}
+
+func (p *limitedNetworkPool) Size() int {
+	return p.size
+}
+
+// limitedNetwork wraps a vm.Network to return it to limitedNetworkPool when
+// released.
+type limitedNetwork struct {
+	vm.Network
+	pool    *limitedNetworkPool
+	release sync.Once
+}
+
+func (n *limitedNetwork) Release() {
+	n.release.Do(func() {
+		n.Network.Release()
+		n.pool.m.Lock()
+		n.pool.inUse--
+		n.pool.m.Unlock()
+	})
+}
+
+// Traffic forwards to the underlying network, if it can report traffic.
+func (n *limitedNetwork) Traffic() (received, sent int64, err error) {
+	if t, ok := n.Network.(trafficCounter); ok {
+		return t.Traffic()
+	}
+	return 0, 0, errors.New("network traffic isn't available")
+}
+
+// ForwardPorts forwards to the underlying network, if it can forward ports.
+func (n *limitedNetwork) ForwardPorts(guestPorts []int) ([]engines.PortForward, error) {
+	if f, ok := n.Network.(portForwarder); ok {
+		return f.ForwardPorts(guestPorts)
+	}
+	return nil, errors.New("port forwarding isn't supported by the network")
+}
+
+// RestrictEgress forwards to the underlying network, if it can restrict egress.
+func (n *limitedNetwork) RestrictEgress(allowed []*net.IPNet) error {
+	if r, ok := n.Network.(egressRestricter); ok {
+		return r.RestrictEgress(allowed)
+	}
+	return errors.New("egress restrictions aren't supported by the network")
+}
+
+// SetHostRecords forwards to the underlying network, if it can serve host
+// records.
+func (n *limitedNetwork) SetHostRecords(records []network.HostRecord) error {
+	if r, ok := n.Network.(hostResolver); ok {
+		return r.SetHostRecords(records)
+	}
+	return errors.New("host records aren't supported by the network")
+}
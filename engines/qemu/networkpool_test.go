@@ -0,0 +1,59 @@
+package qemuengine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/network"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+func TestUserNetworkPool(t *testing.T) {
+	folder := runtime.NewTemporaryTestFolderOrPanic()
+	defer folder.Remove()
+
+	p := &userNetworkPool{size: 1, socketFolder: folder.Path()}
+	require.Equal(t, 1, p.Size())
+
+	n, err := p.Network()
+	require.NoError(t, err)
+	_, err = p.Network()
+	require.Equal(t, network.ErrAllNetworksInUse, err)
+
+	// Releasing twice is harmless
+	n.Release()
+	n.Release()
+
+	n, err = p.Network()
+	require.NoError(t, err)
+	n.Release()
+	require.NoError(t, p.Dispose())
+}
+
+func TestLimitedNetworkPool(t *testing.T) {
+	folder := runtime.NewTemporaryTestFolderOrPanic()
+	defer folder.Remove()
+
+	p := &limitedNetworkPool{
+		networkPool: &userNetworkPool{size: 3, socketFolder: folder.Path()},
+		size:        2,
+	}
+	require.Equal(t, 2, p.Size())
+
+	n1, err := p.Network()
+	require.NoError(t, err)
+	n2, err := p.Network()
+	require.NoError(t, err)
+	_, err = p.Network()
+	require.Equal(t, network.ErrAllNetworksInUse, err)
+
+	// Releasing twice is harmless
+	n1.Release()
+	n1.Release()
+	n1, err = p.Network()
+	require.NoError(t, err)
+	n1.Release()
+	n2.Release()
+	require.Equal(t, 0, p.inUse)
+	require.NoError(t, p.Dispose())
+}
@@ -0,0 +1,312 @@
+package qemuengine
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	schematypes "github.com/taskcluster/go-schematypes"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/atomics"
+	"github.com/taskcluster/taskcluster-worker/runtime/ioext"
+	"github.com/taskcluster/taskcluster-worker/runtime/util"
+)
+
+// maxPacketCaptureSize is the maximum size of a packet capture, the capture is
+// stopped when this size is exceeded.
+const maxPacketCaptureSize = 256 * 1024 * 1024
+
+// packetCaptureSnapLen is the number of bytes captured from each packet
+const packetCaptureSnapLen = 65535
+
+// packetCaptureInterval is the interval at which the size of the capture is
+// checked, so the capture may exceed the maximum size by what the guest can
+// send and receive in this interval.
+const packetCaptureInterval = 1 * time.Second
+
+// Sizes of the global header and the packet record headers in pcap files
+const (
+	pcapHeaderSize       = 24
+	pcapRecordHeaderSize = 16
+)
+
+type packetCaptureType struct {
+	Artifact string `json:"artifact"`
+	Filter   string `json:"filter,omitempty"`
+}
+
+var packetCaptureSchema = schematypes.Object{
+	Title: "Packet Capture",
+	Description: util.Markdown(`
+		Capture packets sent and received by the virtual machine, and upload the
+		capture in pcap format as artifact when the task is resolved. This is
+		useful for debugging flaky network tests, the capture can be opened with
+		'wireshark' or 'tcpdump -r'.
+
+		The capture is stopped when it exceeds 256 MiB.
+	`),
+	Properties: schematypes.Properties{
+		"artifact": schematypes.String{
+			Title: "Artifact",
+			Description: util.Markdown(`
+				Artifact name for the packet capture, for example
+				'public/network.pcap'.
+			`),
+			MinimumLength: 1,
+		},
+		"filter": schematypes.String{
+			Title: "Filter",
+			Description: util.Markdown(`
+				Filter in 'pcap-filter' syntax, for example 'tcp port 80', if
+				specified only matching packets are uploaded. The filter is applied
+				after capturing, so packets that don't match still count against
+				the maximum size of the capture.
+			`),
+			MaximumLength: 1024,
+		},
+	},
+	Required: []string{"artifact"},
+}
+
+// checkPacketFilter returns a MalformedPayloadError if filter can't be
+// compiled by tcpdump, tempFile is used for an empty capture to test against.
+func checkPacketFilter(filter, tempFile string) error {
+	if _, err := exec.LookPath("tcpdump"); err != nil {
+		return runtime.NewMalformedPayloadError(
+			"task.payload.packetCapture.filter requires 'tcpdump', which isn't available on this worker",
+		)
+	}
+
+	// Write an empty capture of ethernet frames, as written by QEMU
+	header := make([]byte, pcapHeaderSize)
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], packetCaptureSnapLen)
+	binary.LittleEndian.PutUint32(header[20:24], 1) // LINKTYPE_ETHERNET
+	if err := ioutil.WriteFile(tempFile, header, 0600); err != nil {
+		return errors.Wrap(err, "failed to write empty packet capture")
+	}
+	defer os.Remove(tempFile)
+
+	if err := filterPacketCapture(tempFile, os.DevNull, filter); err != nil {
+		return runtime.NewMalformedPayloadError(
+			"task.payload.packetCapture.filter is invalid: ", err,
+		)
+	}
+	return nil
+}
+
+// filterPacketCapture writes packets from the capture in input matching filter
+// to output using tcpdump.
+func filterPacketCapture(input, output, filter string) error {
+	stderr := bytes.NewBuffer(nil)
+	cmd := exec.Command("tcpdump", "-r", input, "-w", output, "--", filter)
+	cmd.Stderr = stderr
+	if err := cmd.Run(); err != nil {
+		return errors.Errorf("tcpdump failed: %s, stderr: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
+
+// trimPacketCapture returns the size of the capture in f rounded down to whole
+// packets, such that it doesn't exceed maxSize, and the number of packets.
+// This is necessary as QEMU may stop writing in the middle of a packet.
+func trimPacketCapture(f *os.File, maxSize int64) (int64, int, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	end := info.Size()
+	if end > maxSize {
+		end = maxSize
+	}
+
+	header := make([]byte, pcapHeaderSize)
+	if _, err = f.ReadAt(header, 0); err != nil {
+		return 0, 0, errors.New("packet capture is missing the pcap header")
+	}
+	var order binary.ByteOrder
+	switch binary.LittleEndian.Uint32(header[0:4]) {
+	case 0xa1b2c3d4, 0xa1b23c4d: // microsecond and nanosecond timestamps
+		order = binary.LittleEndian
+	case 0xd4c3b2a1, 0x4d3cb2a1:
+		order = binary.BigEndian
+	default:
+		return 0, 0, errors.New("packet capture doesn't have a pcap header")
+	}
+
+	size := int64(pcapHeaderSize)
+	packets := 0
+	record := make([]byte, pcapRecordHeaderSize)
+	for size+pcapRecordHeaderSize <= end {
+		if _, err = f.ReadAt(record, size); err != nil {
+			return 0, 0, err
+		}
+		next := size + pcapRecordHeaderSize + int64(order.Uint32(record[8:12]))
+		if next > end {
+			break
+		}
+		size = next
+		packets++
+	}
+	return size, packets, nil
+}
+
+// packetCapture monitors the size of a packet capture written by QEMU, and
+// stops the capture when it exceeds maxPacketCaptureSize.
+type packetCapture struct {
+	vm        *vm.VirtualMachine
+	file      string
+	filter    string
+	monitor   runtime.Monitor
+	truncated atomics.Bool
+	stopping  sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// newPacketCapture monitors the capture QEMU writes to file, the virtual
+// machine must have been started with vm.CaptureNetwork(file).
+func newPacketCapture(machine *vm.VirtualMachine, file, filter string, monitor runtime.Monitor) *packetCapture {
+	c := &packetCapture{
+		vm:      machine,
+		file:    file,
+		filter:  filter,
+		monitor: monitor,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go c.watch()
+	return c
+}
+
+func (c *packetCapture) watch() {
+	defer close(c.done)
+
+	ticker := time.NewTicker(packetCaptureInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-c.vm.Done:
+			return
+		case <-ticker.C:
+			info, err := os.Stat(c.file)
+			if err != nil || info.Size() < maxPacketCaptureSize {
+				continue
+			}
+			c.truncated.Set(true)
+			if err = c.vm.StopNetworkCapture(); err != nil {
+				c.monitor.Warn("failed to stop packet capture, error: ", err)
+			}
+			return
+		}
+	}
+}
+
+// Stop ends the capture and returns whether it was truncated, because it
+// exceeded the maximum size. After Stop() QEMU no longer writes to the file.
+func (c *packetCapture) Stop() (truncated bool, err error) {
+	c.stopping.Do(func() {
+		close(c.stop)
+	})
+	<-c.done
+
+	if c.truncated.Get() {
+		return true, nil
+	}
+	return false, c.vm.StopNetworkCapture()
+}
+
+// uploadPacketCapture uploads the packets captured as the artifact named by
+// task.payload.packetCapture.artifact, after applying the filter, if any.
+// Errors are only logged, as this is purely a debugging aid.
+func (s *sandbox) uploadPacketCapture() {
+	if s.capture == nil {
+		return
+	}
+	defer os.Remove(s.capture.file)
+
+	truncated, err := s.capture.Stop()
+	if err != nil {
+		s.monitor.Warn("failed to stop packet capture, error: ", err)
+		s.context.LogError("Failed to stop packet capture")
+		return
+	}
+	if truncated {
+		s.context.LogWarning(fmt.Sprintf(
+			"Packet capture exceeded %d MiB, later packets were not captured",
+			maxPacketCaptureSize/(1024*1024),
+		))
+	}
+
+	file := s.capture.file
+	if s.capture.filter != "" {
+		// tcpdump fails on a partial packet at the end of the capture
+		if err = truncatePacketCapture(file); err == nil {
+			filtered := s.engine.Environment.TemporaryStorage.NewFilePath()
+			defer os.Remove(filtered)
+			err = filterPacketCapture(file, filtered, s.capture.filter)
+			file = filtered
+		}
+		if err != nil {
+			s.monitor.Warn("failed to filter packet capture, error: ", err)
+			s.context.LogError("Failed to filter packet capture")
+			return
+		}
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		s.monitor.Warn("failed to open packet capture, error: ", err)
+		s.context.LogError("Failed to open packet capture")
+		return
+	}
+	defer f.Close()
+
+	size, packets, err := trimPacketCapture(f, maxPacketCaptureSize)
+	if err != nil {
+		s.monitor.ReportError(err, "failed to read packet capture")
+		s.context.LogError("Failed to read packet capture")
+		return
+	}
+
+	name := s.captureName
+	err = s.context.UploadS3Artifact(runtime.S3Artifact{
+		Name:     name,
+		Mimetype: "application/vnd.tcpdump.pcap",
+		Expires:  s.context.TaskInfo.Expires,
+		Stream:   ioext.NopCloser(io.NewSectionReader(f, 0, size)),
+	})
+	if err != nil {
+		s.monitor.Warn("failed to upload packet capture, error: ", err)
+		s.context.LogError(fmt.Sprintf("Failed to upload packet capture as artifact: %s", name))
+		return
+	}
+	s.context.Log(fmt.Sprintf("Uploaded packet capture with %d packets as artifact: %s", packets, name))
+}
+
+// truncatePacketCapture truncates the capture in file to whole packets
+func truncatePacketCapture(file string) error {
+	f, err := os.OpenFile(file, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	size, _, err := trimPacketCapture(f, maxPacketCaptureSize)
+	if err != nil {
+		return err
+	}
+	return f.Truncate(size)
+}
@@ -0,0 +1,76 @@
+package qemuengine
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+func TestTrimPacketCapture(t *testing.T) {
+	f, err := ioutil.TempFile("", "packet-capture-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	// Big-endian header, as written by QEMU on a big-endian host
+	header := make([]byte, pcapHeaderSize)
+	binary.BigEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.BigEndian.PutUint32(header[20:], 1)
+	_, err = f.Write(header)
+	require.NoError(t, err)
+
+	// Write two packets of 60 bytes, and part of a third
+	record := make([]byte, pcapRecordHeaderSize+60)
+	binary.BigEndian.PutUint32(record[8:], 60)
+	binary.BigEndian.PutUint32(record[12:], 60)
+	for i := 0; i < 2; i++ {
+		_, err = f.Write(record)
+		require.NoError(t, err)
+	}
+	_, err = f.Write(record[:30])
+	require.NoError(t, err)
+
+	size, packets, err := trimPacketCapture(f, maxPacketCaptureSize)
+	require.NoError(t, err)
+	require.Equal(t, int64(pcapHeaderSize+2*len(record)), size)
+	require.Equal(t, 2, packets)
+
+	// Only whole packets within the maximum size are kept
+	size, packets, err = trimPacketCapture(f, pcapHeaderSize+int64(len(record))+10)
+	require.NoError(t, err)
+	require.Equal(t, int64(pcapHeaderSize+len(record)), size)
+	require.Equal(t, 1, packets)
+}
+
+func TestTrimPacketCaptureInvalid(t *testing.T) {
+	f, err := ioutil.TempFile("", "packet-capture-test")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	_, _, err = trimPacketCapture(f, maxPacketCaptureSize)
+	require.Error(t, err, "expected empty file to fail")
+
+	_, err = f.Write(make([]byte, 2*pcapHeaderSize))
+	require.NoError(t, err)
+	_, _, err = trimPacketCapture(f, maxPacketCaptureSize)
+	require.Error(t, err, "expected file without pcap header to fail")
+}
+
+func TestCheckPacketFilter(t *testing.T) {
+	if _, err := exec.LookPath("tcpdump"); err != nil {
+		t.Skip("tcpdump isn't available")
+	}
+	folder := runtime.NewTemporaryTestFolderOrPanic()
+	defer folder.Remove()
+
+	require.NoError(t, checkPacketFilter("tcp port 80", folder.NewFilePath()))
+	err := checkPacketFilter("tcp port eighty", folder.NewFilePath())
+	_, ok := runtime.IsMalformedPayloadError(err)
+	require.True(t, ok, "expected malformed-payload error, got: %s", err)
+}
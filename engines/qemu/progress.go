@@ -0,0 +1,48 @@
+package qemuengine
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/metaservice"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/ioext"
+)
+
+// resultSummaryArtifact is the artifact name for the result summary reported
+// by the guest, this is well-known so tools can find it without the payload.
+const resultSummaryArtifact = "public/result-summary.json"
+
+// reportProgress writes progress reported by the guest to the task log
+func (s *sandbox) reportProgress(p metaservice.Progress) {
+	switch {
+	case p.Percent != nil && p.Step != "":
+		s.context.Log(fmt.Sprintf("Progress: %d%% - %s", *p.Percent, p.Step))
+	case p.Percent != nil:
+		s.context.Log(fmt.Sprintf("Progress: %d%%", *p.Percent))
+	default:
+		s.context.Log(fmt.Sprintf("Progress: %s", p.Step))
+	}
+}
+
+// uploadResultSummary uploads the result summary reported by the guest as the
+// artifact named by resultSummaryArtifact, if the guest reported a summary.
+func (s *sandbox) uploadResultSummary() {
+	summary := s.metaService.Summary()
+	if summary == nil {
+		return
+	}
+
+	err := s.context.UploadS3Artifact(runtime.S3Artifact{
+		Name:     resultSummaryArtifact,
+		Mimetype: "application/json",
+		Expires:  s.context.TaskInfo.Expires,
+		Stream:   ioext.NopCloser(bytes.NewReader(summary)),
+	})
+	if err != nil {
+		s.monitor.Warn("failed to upload result summary, error: ", err)
+		s.context.LogError(fmt.Sprintf("Failed to upload result summary as artifact: %s", resultSummaryArtifact))
+		return
+	}
+	s.context.Log(fmt.Sprintf("Uploaded result summary as artifact: %s", resultSummaryArtifact))
+}
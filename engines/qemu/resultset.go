@@ -1,11 +1,14 @@
 package qemuengine
 
 import (
+	"fmt"
 	"strings"
+	"time"
 
 	"github.com/taskcluster/taskcluster-worker/engines"
 	"github.com/taskcluster/taskcluster-worker/engines/qemu/metaservice"
 	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
+	"github.com/taskcluster/taskcluster-worker/runtime"
 	"github.com/taskcluster/taskcluster-worker/runtime/ioext"
 )
 
@@ -14,15 +17,24 @@ type resultSet struct {
 	success     bool
 	vm          *vm.VirtualMachine
 	metaService *metaservice.MetaService
+	gracePeriod time.Duration
+	usage       engines.ResourceUsage
+	ports       []engines.PortForward
 }
 
-func newResultSet(success bool, vm *vm.VirtualMachine, m *metaservice.MetaService) *resultSet {
+func newResultSet(
+	success bool, vm *vm.VirtualMachine, m *metaservice.MetaService,
+	gracePeriod time.Duration, usage engines.ResourceUsage, ports []engines.PortForward,
+) *resultSet {
 	// Set metaService as handler (this will make proxies unreachable)
 	vm.SetHTTPHandler(m)
 	return &resultSet{
 		success:     success,
 		vm:          vm,
 		metaService: m,
+		gracePeriod: gracePeriod,
+		usage:       usage,
+		ports:       ports,
 	}
 }
 
@@ -31,6 +43,12 @@ func (r *resultSet) Success() bool {
 }
 
 func (r *resultSet) ExtractFile(path string) (ioext.ReadSeekCloser, error) {
+	// Paths ending with a separator are paths to folders, as in other engines
+	if strings.HasSuffix(path, "/") || strings.HasSuffix(path, "\\") {
+		return nil, runtime.NewMalformedPayloadError(fmt.Sprintf(
+			"file path: '%s' ends with slash, paths to files cannot end with slash", path,
+		))
+	}
 	return r.metaService.GetArtifact(path)
 }
 
@@ -41,18 +59,20 @@ func (r *resultSet) ExtractFolder(path string, handler engines.FileHandler) erro
 	}
 
 	// TODO: Consider some level of parallelism, but not too many files in parallel
+	folder := strings.TrimRight(path, "/\\")
 	for _, p := range files {
+		name, ok := relativeName(folder, p)
+		if !ok {
+			continue // guest-tools should only list files inside path
+		}
 		f, err := r.metaService.GetArtifact(p)
+		if err == engines.ErrResourceNotFound {
+			continue // file was removed after the folder was listed
+		}
 		if err != nil {
 			return err
 		}
-		// If guest uses backslashes our input paths should have that, but the ones
-		// we return should be intepreted as names.
-		p = strings.Replace(p[len(path):], "\\", "/", -1)
-		if len(p) > 0 && p[0] == '\\' {
-			p = p[1:]
-		}
-		if handler(p, f) != nil {
+		if handler(name, f) != nil {
 			return engines.ErrHandlerInterrupt
 		}
 	}
@@ -60,7 +80,32 @@ func (r *resultSet) ExtractFolder(path string, handler engines.FileHandler) erro
 	return nil
 }
 
+// relativeName returns the name of file relative to folder using forward
+// slashes, as engines.FileHandler expects, and false if file isn't inside
+// folder. If the guest uses backslashes the paths from guest-tools will too,
+// folder must not end with a separator.
+func relativeName(folder, file string) (string, bool) {
+	if !strings.HasPrefix(file, folder) {
+		return "", false
+	}
+	name := strings.Replace(file[len(folder):], "\\", "/", -1)
+	if !strings.HasPrefix(name, "/") || len(name) == 1 {
+		return "", false
+	}
+	return name[1:], true
+}
+
+func (r *resultSet) ResourceUsage() (engines.ResourceUsage, error) {
+	return r.usage, nil
+}
+
+// PortForwards returns the ports forwarded from the host to the guest, these
+// remain reachable until the result set is disposed.
+func (r *resultSet) PortForwards() ([]engines.PortForward, error) {
+	return r.ports, nil
+}
+
 func (r *resultSet) Dispose() error {
-	r.vm.Kill()
+	r.vm.Shutdown(r.gracePeriod)
 	return nil
 }
@@ -0,0 +1,27 @@
+package qemuengine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelativeName(t *testing.T) {
+	cases := []struct {
+		folder, file, name string
+		ok                 bool
+	}{
+		{"/home/tc/folder", "/home/tc/folder/hello.txt", "hello.txt", true},
+		{"/home/tc/folder", "/home/tc/folder/sub/hello.txt", "sub/hello.txt", true},
+		{`C:\Users\tc\folder`, `C:\Users\tc\folder\sub\hello.txt`, "sub/hello.txt", true},
+		{"", "/hello.txt", "hello.txt", true},
+		{"/home/tc/folder", "/home/tc/folder2/hello.txt", "", false},
+		{"/home/tc/folder", "/home/tc/other/hello.txt", "", false},
+		{"/home/tc/folder", "/home/tc/folder/", "", false},
+	}
+	for _, c := range cases {
+		name, ok := relativeName(c.folder, c.file)
+		require.Equal(t, c.ok, ok, "relativeName(%q, %q)", c.folder, c.file)
+		require.Equal(t, c.name, name, "relativeName(%q, %q)", c.folder, c.file)
+	}
+}
@@ -1,17 +1,25 @@
 package qemuengine
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image/png"
 	"io"
 	"net/http"
 	"net/url"
+	"os"
 	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
+	"github.com/taskcluster/slugid-go/slugid"
 	"github.com/taskcluster/taskcluster-worker/engines"
 	"github.com/taskcluster/taskcluster-worker/engines/qemu/metaservice"
 	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
 	"github.com/taskcluster/taskcluster-worker/runtime"
 	"github.com/taskcluster/taskcluster-worker/runtime/atomics"
+	"github.com/taskcluster/taskcluster-worker/runtime/ioext"
 )
 
 type sandbox struct {
@@ -27,46 +35,417 @@ type sandbox struct {
 	resultAbort error             // Error for Abort
 	monitor     runtime.Monitor   // System log / metrics / error reporting
 	sessions    *sessionManager
+	recording   string          // Artifact name for screen recording, if any
+	recorder    *screenRecorder // Screen recorder, nil if not recording
+	audio       string          // Artifact name for audio recording, if any
+	audioFile   string          // WAV file written by QEMU, if recording audio
+	captureName string          // Artifact name for packet capture, if any
+	capture     *packetCapture  // Packet capture, nil if not capturing
+	events      eventBroadcaster
+	crashDump   string         // Artifact name for crash dump, if any
+	dumpOnce    sync.Once      // Ensures we only dump guest memory once
+	dumping     sync.WaitGroup // Wait for crash dump before resolving
+	usage       *usageSampler
+	usageName   string                // Artifact name for resource usage, if any
+	usageTotal  engines.ResourceUsage // Summary of resource usage for the result set
+	poweroff    bool                  // Resolve as success when the guest powers off
+	poweredOff  atomics.Bool          // True, if the guest powered off
+	ports       []engines.PortForward // Ports forwarded from the host to the guest
+	imageName   string                // Artifact name for image built from the disk, if any
+	packaged    *packagedImage        // Image given to the VM, nil if not building an image
+	packaging   atomics.Bool          // Package the disk, when the guest powers off
+	token       string                // Token for the meta-data service, if any
+	pending     atomics.Bool          // True, while waiting for migration from another host
+	migrating   atomics.Bool          // True, while migrating to another host
 }
 
-// newSandbox will create a new sandbox and start it.
-func newSandbox(
-	command []string,
-	env map[string]string,
-	proxies map[string]http.Handler,
-	machine vm.Machine,
-	image vm.Image,
-	network vm.Network,
-	c *runtime.TaskContext,
-	e *engine,
-	monitor runtime.Monitor,
-) (*sandbox, error) {
+// maxPortForwards is the maximum number of ports a task can forward
+const maxPortForwards = 16
+
+// newSandbox will create a new sandbox from sb and start it, sb.m must be held.
+func newSandbox(sb *sandboxBuilder) (*sandbox, error) {
+	// The builder releases image, boot and network after this, as they are owned
+	// by the sandbox. Image and machine are replaced below, if packaging the
+	// image and when merging machine definitions.
+	var image vm.Image = sb.image
+	machine, boot, network := sb.machine, sb.boot, sb.network
+	c, e, monitor := sb.context, sb.engine, sb.monitor
+
+	// Migration state from the source host, if migrating from another host
+	var incoming migrationState
+	if sb.migration != nil {
+		if image.Machine().Snapshot() != "" {
+			return nil, errors.New("virtual machines resuming from snapshot can't be migrated")
+		}
+		if err := json.Unmarshal(sb.migration.State(), &incoming); err != nil {
+			return nil, errors.Wrap(err, "failed to parse migration state from source host")
+		}
+	}
+
+	// Resuming from a snapshot requires the exact machine it was taken from
+	if machine.Snapshot() != "" {
+		return nil, runtime.NewMalformedPayloadError(
+			"task.payload.machine cannot specify 'snapshot', snapshots must be ",
+			"declared in 'machine.json' of the image",
+		)
+	}
+	if image.Machine().Snapshot() != "" && boot != nil {
+		return nil, runtime.NewMalformedPayloadError(
+			"task.payload.boot cannot be specified for images resuming from ",
+			"snapshot: '", image.Machine().Snapshot(), "'",
+		)
+	}
+	if image.Machine().Snapshot() != "" && !machine.IsEmpty() {
+		return nil, runtime.NewMalformedPayloadError(
+			"task.payload.machine cannot be specified for images resuming from ",
+			"snapshot: '", image.Machine().Snapshot(), "'",
+		)
+	}
+
+	// Package the disk as an image, if requested, carrying the machine definition
+	// forward, except for the snapshot as the new image won't contain it
+	var packaged *packagedImage
+	if sb.imageName != "" {
+		p, ok := image.(imagePackager)
+		if !ok {
+			return nil, errors.New("image instance doesn't support packaging")
+		}
+		packaged = newPackagedImage(
+			p, machine.WithDefaults(image.Machine()).WithSnapshot(""),
+			e.Environment.TemporaryStorage.NewFilePath(),
+		)
+		image = packaged
+	}
+
+	// Merge machine definitions in order of preference:
+	//  - task.payload.machine
+	//  - machine.json from iamge
+	//  - machine from engine config
+	//  - default machine (hardcoded into vm.NewVirtualMachine)
+	machine = machine.WithDefaults(image.Machine()).WithDefaults(e.defaultMachine)
+
+	// Let the guest run virtual machines, unless resuming from snapshot where
+	// the CPU must match the snapshot
+	if e.engineConfig.Nested && image.Machine().Snapshot() == "" {
+		machine = machine.WithNestedVirtualization()
+	}
+
+	// Reserve memory, CPUs and scratch disk space for the machine, after limits
+	// have been applied
+	resolved, err := machine.ApplyLimits(e.engineConfig.MachineLimits)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check host records, as the schema doesn't validate IP addresses
+	if err = validateHostRecords(sb.hosts); err != nil {
+		return nil, runtime.NewMalformedPayloadError("task.payload.hostRecords is invalid: ", err)
+	}
+
+	// Restrict egress as required by the engine config and the task payload,
+	// before the virtual machine is created. Restrictions are removed when the
+	// network is released.
+	if e.engineConfig.EgressPolicy.restricted() || sb.egress.restricted() {
+		restricter, ok := network.(egressRestricter)
+		if !ok {
+			return nil, runtime.NewMalformedPayloadError(
+				"task.payload.egressPolicy is only supported by workers using 'tap' networking",
+			)
+		}
+		if e.engineConfig.EgressPolicy.restricted() {
+			allowed, err2 := e.engineConfig.EgressPolicy.resolve()
+			if err2 == nil {
+				err2 = restricter.RestrictEgress(allowed)
+			}
+			if err2 != nil {
+				return nil, errors.Wrap(err2, "failed to apply egress policy from engine config")
+			}
+		}
+		if sb.egress.restricted() {
+			allowed, err2 := sb.egress.resolve()
+			if err2 != nil {
+				return nil, runtime.NewMalformedPayloadError("task.payload.egressPolicy is invalid: ", err2)
+			}
+			if err2 = restricter.RestrictEgress(allowed); err2 != nil {
+				return nil, err2
+			}
+		}
+		c.Log("Network access from the virtual machine is restricted by egress policy")
+	}
+
+	// Serve host records from the resolver for the network, before the virtual
+	// machine is created. Records are removed when the network is released.
+	if records := mergeHostRecords(e.engineConfig.HostRecords, sb.hosts); len(records) > 0 {
+		resolver, ok := network.(hostResolver)
+		if !ok {
+			return nil, runtime.NewMalformedPayloadError(
+				"task.payload.hostRecords is only supported by workers using 'tap' networking",
+			)
+		}
+		if err = resolver.SetHostRecords(records); err != nil {
+			return nil, errors.Wrap(err, "failed to set host records")
+		}
+	}
+
+	// Forward ports before the virtual machine is created, as user-space
+	// networks forward ports using options for QEMU. Forwarding is stopped when
+	// the network is released.
+	if len(sb.ports) > maxPortForwards {
+		return nil, runtime.NewMalformedPayloadError(fmt.Sprintf(
+			"task.payload.forwardPorts cannot forward more than %d ports", maxPortForwards,
+		))
+	}
+	var ports []engines.PortForward
+	if len(sb.ports) > 0 {
+		forwarder, ok := network.(portForwarder)
+		if !ok {
+			return nil, runtime.NewMalformedPayloadError(
+				"task.payload.forwardPorts isn't supported by the network on this worker",
+			)
+		}
+		if ports, err = forwarder.ForwardPorts(sb.ports); err != nil {
+			return nil, err
+		}
+		for _, p := range ports {
+			c.Log(fmt.Sprintf("Forwarding guest port %d from 127.0.0.1:%d", p.GuestPort, p.HostPort))
+		}
+	}
+	scratchSize := 0
+	for _, d := range sb.scratch {
+		scratchSize += d.Size * 1024
+	}
+	release, err := e.capacity.reserve(monitor.WithPrefix("capacity"), resolved, scratchSize)
+	if err == errInsufficientCapacity {
+		incidentID := monitor.ReportWarning(err, "unable to start virtual machine")
+		c.LogError("Insufficient capacity to start virtual machine, incidentId: ", incidentID)
+		return nil, runtime.ErrNonFatalInternalError
+	}
+	if err != nil {
+		return nil, err
+	}
+
 	instance, err := vm.NewVirtualMachine(
-		e.engineConfig.MachineLimits,
-		// Merge machine definitions in order of preference:
-		//  - task.payload.machine
-		//  - machine.json from iamge
-		//  - machine from engine config
-		//  - default machine (hardcoded into vm.NewVirtualMachine)
-		vm.OverwriteMachine(image, machine.WithDefaults(image.Machine()).WithDefaults(e.defaultMachine)),
-		network, e.socketFolder.Path(), "", "", vm.LinuxBootOptions{},
+		e.engineConfig.MachineLimits, vm.OverwriteMachine(image, machine),
+		network, e.socketFolder.Path(), "", "", boot.options(),
 		monitor.WithTag("component", "vm"),
 	)
 	if err != nil {
+		release()
 		return nil, err
 	}
+	if e.scratchFolder != nil {
+		instance.SetScratchFolder(e.scratchFolder.Path())
+	}
+	if e.engineConfig.SocketTimeout != 0 {
+		instance.SetSocketTimeout(e.engineConfig.SocketTimeout)
+	}
+
+	// Report the accelerator used, and warn if we're not using KVM
+	monitor = monitor.WithTag("accelerator", instance.Accelerator())
+	if instance.Accelerator() != vm.AccelKVM {
+		if !e.engineConfig.AllowTCG {
+			release()
+			incidentID := monitor.ReportError(errors.New("KVM is no longer available"))
+			c.LogError("Unable to start virtual machine without KVM, incidentId: ", incidentID)
+			return nil, runtime.ErrFatalInternalError
+		}
+		c.LogWarning(fmt.Sprintf(
+			"KVM isn't available, virtual machine is running with software "+
+				"emulation (accel=%s), this is considerably slower", instance.Accelerator(),
+		))
+	}
+	c.Log(fmt.Sprintf("Starting virtual machine with accel=%s", instance.Accelerator()))
+
+	// Expose volumes as shared folders or disks, disk volumes are locked until
+	// the virtual machine is done, as they can't be attached read-write twice
+	var volumes []metaservice.Mount
+	for i, m := range sb.mounts {
+		tag := fmt.Sprintf("volume%d", i)
+		mountType := metaservice.MountTypeSharedFolder
+		if m.volume.disk != "" {
+			mountType = metaservice.MountTypeDisk
+			if !m.volume.lock(m.readOnly) {
+				release()
+				incidentID := monitor.ReportError(errors.New("disk volume is already in use"))
+				c.LogError(fmt.Sprintf(
+					"Disk volume for '%s' is already in use, incidentId: %s", m.mountPoint, incidentID,
+				))
+				return nil, runtime.ErrNonFatalInternalError
+			}
+			v, readOnly, releaseOthers := m.volume, m.readOnly, release
+			release = func() {
+				v.unlock(readOnly)
+				releaseOthers()
+			}
+			err = instance.AddDiskVolume(tag, m.volume.disk, m.readOnly)
+		} else {
+			err = instance.AddSharedFolder(tag, m.volume.Path(), m.readOnly)
+		}
+		if err != nil {
+			release()
+			return nil, err
+		}
+		volumes = append(volumes, metaservice.Mount{
+			Tag:        tag,
+			MountPoint: m.mountPoint,
+			ReadOnly:   m.readOnly,
+			Type:       mountType,
+		})
+	}
+
+	// Attach scratch disks
+	for _, disk := range sb.scratch {
+		if err = instance.AddScratchDisk(disk.Size * 1024); err != nil {
+			release()
+			return nil, err
+		}
+	}
+
+	// Record audio output, if requested
+	audioFile := ""
+	if sb.audio != "" {
+		audioFile = e.Environment.TemporaryStorage.NewFilePath()
+		if err = instance.RecordAudio(audioFile); err != nil {
+			release()
+			return nil, err
+		}
+	}
+
+	// Capture packets, if requested, the filter is checked first so invalid
+	// filters are reported as malformed payload
+	captureFile := ""
+	if sb.capture != nil {
+		if sb.capture.Filter != "" {
+			err = checkPacketFilter(sb.capture.Filter, e.Environment.TemporaryStorage.NewFilePath())
+			if err != nil {
+				release()
+				return nil, err
+			}
+		}
+		captureFile = e.Environment.TemporaryStorage.NewFilePath()
+		instance.CaptureNetwork(captureFile, packetCaptureSnapLen)
+	}
+
+	// Generate a token the guest must present to the meta-data service, this
+	// can't be injected into images resuming from snapshot as fw_cfg items are
+	// read when the guest boots
+	token := ""
+	if e.engineConfig.MetaDataToken && image.Machine().Snapshot() == "" {
+		token = slugid.Nice()
+	}
+	// The guest has already read the token, when migrating from another host
+	if sb.migration != nil {
+		token = incoming.Token
+	}
+	if token != "" {
+		instance.SetMetaDataToken(token)
+	}
+
+	// Wait for the virtual machine to be received, instead of booting the guest
+	if sb.migration != nil {
+		instance.EnableIncomingMigration()
+	}
+
+	// Only the engine may connect to the VNC socket, as displays, screenshots and
+	// screen recordings are exposed through the engine
+	instance.EnableVNCPassword()
+
+	// Serve the meta-data service over virtio-serial, this changes the virtual
+	// hardware so it can't be added for images resuming from snapshot
+	if e.engineConfig.SerialChannel && image.Machine().Snapshot() == "" {
+		instance.EnableSerialChannel()
+	}
+
+	// Reserve and attach GPUs
+	if sb.gpus > 0 {
+		devices, releaseGPUs, err2 := e.gpus.reserve(sb.gpus)
+		if err2 == errInsufficientGPUs {
+			release()
+			incidentID := monitor.ReportWarning(err2, "unable to start virtual machine")
+			c.LogError("Insufficient GPUs to start virtual machine, incidentId: ", incidentID)
+			return nil, runtime.ErrNonFatalInternalError
+		}
+		if err2 != nil {
+			release()
+			return nil, err2
+		}
+		releaseOthers := release
+		release = func() {
+			releaseGPUs()
+			releaseOthers()
+		}
+		for _, gpu := range devices {
+			if err = instance.AddPassthroughDevice(gpu.Devices); err != nil {
+				release()
+				return nil, err
+			}
+		}
+	}
+
+	// Reserve and attach USB devices
+	if len(sb.usb) > 0 {
+		devices, releaseUSB, err2 := e.usbDevices.reserve(sb.usb)
+		if err2 == errUSBDeviceInUse {
+			release()
+			incidentID := monitor.ReportWarning(err2, "unable to start virtual machine")
+			c.LogError("USB device requested is in use by another task, incidentId: ", incidentID)
+			return nil, runtime.ErrNonFatalInternalError
+		}
+		if err2 != nil {
+			release()
+			return nil, err2
+		}
+		releaseOthers := release
+		release = func() {
+			releaseUSB()
+			releaseOthers()
+		}
+		for _, d := range devices {
+			if err = instance.AddUSBHostDevice(d.device()); err != nil {
+				release()
+				return nil, err
+			}
+		}
+	}
 
 	// Create sandbox
 	s := &sandbox{
-		vm:      instance,
-		context: c,
-		engine:  e,
-		proxies: proxies,
-		monitor: monitor,
+		vm:        instance,
+		context:   c,
+		engine:    e,
+		proxies:   sb.proxies,
+		monitor:   monitor,
+		recording: sb.recording,
+		audio:     sb.audio,
+		audioFile: audioFile,
+		crashDump: sb.crashDump,
+		usageName: sb.usage,
+		poweroff:  sb.poweroff,
+		ports:     ports,
+		imageName: sb.imageName,
+		packaged:  packaged,
+		token:     token,
 	}
+	s.pending.Set(sb.migration != nil)
 
 	// Setup meta-data service
-	s.metaService = metaservice.New(command, env, c.LogDrain(), s.result, e.Environment)
+	// Files uploaded by the guest are buffered in the storage for the task, so
+	// they count towards its quota
+	environment := *e.Environment
+	environment.TemporaryStorage = sb.storage
+	s.metaService = metaservice.New(sb.command, sb.env, c.LogDrain(), s.result, &environment)
+	s.metaService.SetArtifactUploader(func(artifact runtime.S3Artifact) error {
+		artifact.Expires = c.TaskInfo.Expires
+		return c.UploadS3Artifact(artifact)
+	})
+	s.metaService.SetMounts(volumes)
+	s.metaService.SetPortForwards(ports)
+	s.metaService.SetToken(token)
+	s.metaService.SetSecretFetcher(s.fetchSecret)
+	s.metaService.SetProgressHandler(s.reportProgress)
+	if e.guestTools != nil {
+		s.metaService.SetGuestTools(e.guestTools.info, e.guestTools.file)
+	}
 
 	// Create session manager
 	s.sessions = newSessionManager(s.metaService, s.vm)
@@ -74,13 +453,68 @@ func newSandbox(
 	// Setup network handler
 	s.vm.SetHTTPHandler(http.HandlerFunc(s.handleRequest))
 
+	// Log QMP events and deliver them to plugins
+	s.vm.SetEventHandler(s.handleEvent)
+
 	// Start the VM
 	debug("Starting virtual machine")
 	s.vm.Start()
 
+	// Sample resource usage
+	s.usage = newUsageSampler(s.vm, network)
+
+	// Start recording the screen, if requested
+	if s.recording != "" {
+		f, err := e.Environment.TemporaryStorage.NewFile()
+		if err != nil {
+			monitor.ReportError(err, "failed to create temporary file for screen recording")
+			c.LogError("Failed to start screen recording")
+		} else {
+			s.recorder = newScreenRecorder(s.vm, f, monitor.WithTag("component", "screen-recorder"))
+		}
+	}
+
+	// Monitor the size of the packet capture, if capturing
+	if captureFile != "" {
+		s.captureName = sb.capture.Artifact
+		s.capture = newPacketCapture(
+			s.vm, captureFile, sb.capture.Filter, monitor.WithTag("component", "packet-capture"),
+		)
+	}
+
+	// Receive the virtual machine, if migrating from another host
+	if sb.migration != nil {
+		go s.receiveMigration(sb.migration)
+	}
+
 	// Resolve when VM is closed
 	go s.waitForCrash()
 
+	// Fail the task if qemu-guest-tools stops sending heartbeats
+	heartbeatTimeout := e.engineConfig.HeartbeatTimeout
+	if heartbeatTimeout == 0 {
+		heartbeatTimeout = defaultHeartbeatTimeout
+	}
+	go s.watchHeartbeat(heartbeatTimeout)
+
+	// Let the balloon controller reclaim memory, if enabled, unless we have GPUs
+	// passed through, as guest memory is then pinned and can't be reclaimed
+	removeBalloon := func() {}
+	if e.balloon != nil && sb.gpus == 0 {
+		memory := resolved.Memory()
+		removeBalloon = e.balloon.add(s.vm, memory, e.balloon.guarantee(memory, sb.guaranteed))
+	}
+
+	// Release reserved capacity when VM is done
+	go func() {
+		<-s.vm.Done
+		s.events.close()
+		s.metaService.Dispose()
+		removeBalloon()
+		release()
+		boot.Close()
+	}()
+
 	return s, nil
 }
 
@@ -129,28 +563,117 @@ func (s *sandbox) handleRequest(w http.ResponseWriter, r *http.Request) {
 	h.ServeHTTP(w, r)
 }
 
+// handleEvent writes QMP events to the task log and delivers them to plugins
+// subscribed using Events()
+func (s *sandbox) handleEvent(e vm.Event) {
+	event, ok := sandboxEvent(e)
+	if !ok {
+		return
+	}
+	switch event.Kind {
+	case engines.SandboxEventReset, engines.SandboxEventShutdown:
+		s.context.Log(event.Message)
+	default:
+		s.context.LogWarning(event.Message)
+	}
+	// Record guest poweroff before publishing, as watchEvents() won't quit QEMU
+	// until this returns, so waitForCrash() always sees it
+	if isGuestPoweroff(e) {
+		s.poweredOff.Set(true)
+		// Package the disk, if requested or powering off completes the task
+		if s.packaged != nil && (s.packaging.Get() || s.poweroff && !s.resolve.IsDone()) {
+			s.packaged.request.Set(true)
+		}
+	}
+	if dropped := s.events.publish(event); dropped > 0 {
+		s.monitor.Warnf("dropped QMP event %s for %d subscribers", e.Name, dropped)
+	}
+
+	// Dump guest memory in a separate go-routine, as QMP commands can't complete
+	// while we're blocking the event stream
+	if event.Kind == engines.SandboxEventGuestPanic && s.crashDump != "" {
+		s.dumpOnce.Do(func() {
+			s.dumping.Add(1)
+			go func() {
+				defer s.dumping.Done()
+				s.uploadCrashDump()
+			}()
+		})
+	}
+
+	// Fail the task if the guest stopped resetting the watchdog, this must also
+	// happen in a separate go-routine as we capture a screenshot using QMP
+	if event.Kind == engines.SandboxEventWatchdog {
+		go s.guestHung()
+	}
+}
+
+func (s *sandbox) Events() (<-chan engines.SandboxEvent, error) {
+	return s.events.subscribe()
+}
+
 func (s *sandbox) result(success bool) {
 	// Wait for all sessions to be finished and stop issuing new sessions
 	debug("ready to resolve success=%v - waiting for shells/displays to finish", success)
 	s.sessions.WaitAndTerminate()
 
 	s.resolve.Do(func() {
-		s.resultSet = newResultSet(success, s.vm, s.metaService)
-		s.resultAbort = engines.ErrSandboxTerminated
+		s.finalize(success)
 	})
 }
 
+// finalize uploads artifacts and resolves the sandbox with a resultSet. If
+// success is false, a screenshot and the QEMU log are uploaded first, if true
+// the packaged image is uploaded, if any. Must be called from s.resolve.Do().
+func (s *sandbox) finalize(success bool) {
+	if !success {
+		s.captureScreenshot()
+		s.uploadQEMULog()
+	}
+	if success && s.packaged != nil {
+		success = s.uploadImage()
+	}
+	s.uploadArtifacts()
+	s.resultSet = newResultSet(
+		success, s.vm, s.metaService, s.engine.engineConfig.ShutdownGracePeriod, s.usageTotal, s.ports,
+	)
+	s.resultAbort = engines.ErrSandboxTerminated
+}
+
+// uploadArtifacts waits for crash dumps and uploads recordings, resource usage
+// and the result summary.
+func (s *sandbox) uploadArtifacts() {
+	s.dumping.Wait()
+	s.uploadScreenRecording()
+	s.uploadAudioRecording()
+	s.uploadPacketCapture()
+	s.uploadResourceUsage()
+	s.uploadResultSummary()
+}
+
 func (s *sandbox) Kill() error {
 	s.resolve.Do(func() {
+		s.finalize(false)
 		s.sessions.KillSessions()
 		s.metaService.KillProcess()
-		s.resultSet = newResultSet(false, s.vm, s.metaService)
-		s.resultAbort = engines.ErrSandboxTerminated
 	})
 	s.resolve.Wait()
 	return s.resultError
 }
 
+// guestHung resolves the sandbox as failed with reason 'guest-hung', when the
+// watchdog expires because the guest stopped making progress.
+func (s *sandbox) guestHung() {
+	s.resolve.Do(func() {
+		s.context.LogError(
+			"Task failed with reason 'guest-hung', the watchdog expired as the guest stopped responding",
+		)
+		s.finalize(false)
+		s.sessions.KillSessions()
+		s.metaService.KillProcess()
+	})
+}
+
 // waitForCrash will wait for a VM crash and resolve
 func (s *sandbox) waitForCrash() {
 	// Wait for the VM to finish
@@ -160,12 +683,214 @@ func (s *sandbox) waitForCrash() {
 		// Kill all sessions
 		s.sessions.AbortSessions()
 
+		// Resolve as success, if the task is completed by powering off the guest
+		if s.poweroff && s.poweredOff.Get() {
+			s.context.Log("Guest powered off, task completed")
+			s.finalize(true)
+			return
+		}
+		if s.poweredOff.Get() {
+			s.context.LogError("Guest powered off before the task was completed")
+		}
+
+		// Upload whatever was recorded before the crash
+		s.uploadQEMULog()
+		s.uploadArtifacts()
+
 		// TODO: Read s.vm.Error and handle the error
 		s.resultError = errors.New("QEMU crashed unexpected")
 		s.resultAbort = engines.ErrSandboxTerminated
 	})
 }
 
+// captureScreenshot uploads a PNG screenshot of the virtual machine screen as
+// the artifact named by screenshotOnFailure, if configured. Errors are only
+// logged, as this is purely a debugging aid.
+func (s *sandbox) captureScreenshot() {
+	name := s.engine.engineConfig.ScreenshotOnFailure
+	if name == "" {
+		return
+	}
+
+	img, err := s.vm.Screenshot()
+	if err != nil {
+		s.monitor.Warn("failed to capture screenshot, error: ", err)
+		s.context.LogError("Failed to capture screenshot of the virtual machine")
+		return
+	}
+	buf := bytes.NewBuffer(nil)
+	if err = png.Encode(buf, img); err != nil {
+		s.monitor.ReportError(err, "failed to encode screenshot as PNG")
+		return
+	}
+
+	err = s.context.UploadS3Artifact(runtime.S3Artifact{
+		Name:     name,
+		Mimetype: "image/png",
+		Expires:  s.context.TaskInfo.Expires,
+		Stream:   ioext.NopCloser(bytes.NewReader(buf.Bytes())),
+	})
+	if err != nil {
+		s.monitor.Warn("failed to upload screenshot, error: ", err)
+		s.context.LogError(fmt.Sprintf("Failed to upload screenshot as artifact: %s", name))
+		return
+	}
+	s.context.Log(fmt.Sprintf("Uploaded screenshot of the virtual machine as artifact: %s", name))
+}
+
+// qemuLogArtifact is the artifact name for the output of QEMU, uploaded when
+// a task fails, so device errors can be seen without access to the host
+const qemuLogArtifact = "public/logs/qemu-log.txt"
+
+// uploadQEMULog uploads the last lines written by QEMU to stdout and stderr as
+// qemuLogArtifact, if QEMU wrote anything. Errors are only logged, as this is
+// purely a debugging aid.
+func (s *sandbox) uploadQEMULog() {
+	output := s.vm.Output()
+	if output == "" {
+		return
+	}
+
+	err := s.context.UploadS3Artifact(runtime.S3Artifact{
+		Name:     qemuLogArtifact,
+		Mimetype: "text/plain; charset=utf-8",
+		Expires:  s.context.TaskInfo.Expires,
+		Stream:   ioext.NopCloser(strings.NewReader(output)),
+	})
+	if err != nil {
+		s.monitor.Warn("failed to upload QEMU log, error: ", err)
+		s.context.LogError(fmt.Sprintf("Failed to upload QEMU log as artifact: %s", qemuLogArtifact))
+		return
+	}
+	s.context.Log(fmt.Sprintf("Uploaded QEMU log as artifact: %s", qemuLogArtifact))
+}
+
+// uploadScreenRecording stops the screen recorder and uploads the recording as
+// the artifact named by task.payload.screenRecording. Errors are only logged,
+// as this is purely a debugging aid.
+func (s *sandbox) uploadScreenRecording() {
+	if s.recorder == nil {
+		return
+	}
+	defer s.recorder.file.Close()
+
+	frames, truncated, err := s.recorder.Stop()
+	if err != nil {
+		s.monitor.ReportError(err, "failed to finish screen recording")
+		s.context.LogError("Failed to finish screen recording")
+		return
+	}
+	if truncated {
+		s.context.LogWarning(fmt.Sprintf(
+			"Screen recording exceeded %d MiB, later frames were not recorded",
+			maxScreenRecordingSize/(1024*1024),
+		))
+	}
+
+	err = s.context.UploadS3Artifact(runtime.S3Artifact{
+		Name:     s.recording,
+		Mimetype: "application/x-tar",
+		Expires:  s.context.TaskInfo.Expires,
+		Stream:   s.recorder.file,
+	})
+	if err != nil {
+		s.monitor.Warn("failed to upload screen recording, error: ", err)
+		s.context.LogError(fmt.Sprintf("Failed to upload screen recording as artifact: %s", s.recording))
+		return
+	}
+	s.context.Log(fmt.Sprintf(
+		"Uploaded screen recording with %d frames as artifact: %s", frames, s.recording,
+	))
+}
+
+// maxCrashDumpSize is the maximum size of crash dumps uploaded as artifacts
+const maxCrashDumpSize = 1024 * 1024 * 1024
+
+// uploadCrashDump dumps the guest memory and uploads it as the artifact named
+// by task.payload.crashDump. Errors are only logged, as this is purely a
+// debugging aid.
+func (s *sandbox) uploadCrashDump() {
+	s.context.LogError("Guest panicked, dumping guest memory")
+	file := s.engine.Environment.TemporaryStorage.NewFilePath()
+	defer os.Remove(file)
+
+	if err := s.vm.DumpGuestMemory(file); err != nil {
+		s.monitor.Warn("failed to dump guest memory, error: ", err)
+		s.context.LogError("Failed to dump guest memory")
+		return
+	}
+	f, err := os.Open(file)
+	if err != nil {
+		s.monitor.ReportError(err, "failed to open crash dump")
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		s.monitor.ReportError(err, "failed to stat crash dump")
+		return
+	}
+	if info.Size() > maxCrashDumpSize {
+		s.context.LogError(fmt.Sprintf(
+			"Crash dump is %d MiB which exceeds %d MiB, it will not be uploaded",
+			info.Size()/(1024*1024), maxCrashDumpSize/(1024*1024),
+		))
+		return
+	}
+
+	err = s.context.UploadS3Artifact(runtime.S3Artifact{
+		Name:     s.crashDump,
+		Mimetype: "application/octet-stream",
+		Expires:  s.context.TaskInfo.Expires,
+		Stream:   f,
+	})
+	if err != nil {
+		s.monitor.Warn("failed to upload crash dump, error: ", err)
+		s.context.LogError(fmt.Sprintf("Failed to upload crash dump as artifact: %s", s.crashDump))
+		return
+	}
+	s.context.Log(fmt.Sprintf("Uploaded crash dump as artifact: %s", s.crashDump))
+}
+
+// uploadResourceUsage stops sampling resource usage, writes a summary to the
+// task log and uploads the timeline as the artifact named by
+// task.payload.resourceUsage, if specified.
+func (s *sandbox) uploadResourceUsage() {
+	samples, usage := s.usage.Stop()
+	s.usageTotal = usage
+	s.context.Log(fmt.Sprintf(
+		"Resource usage: CPU time %s, peak memory %d MiB, disk read %d MiB, "+
+			"disk written %d MiB, network received %d MiB, network sent %d MiB",
+		usage.CPUTime, usage.PeakMemory/(1024*1024),
+		usage.DiskRead/(1024*1024), usage.DiskWritten/(1024*1024),
+		usage.NetReceived/(1024*1024), usage.NetSent/(1024*1024),
+	))
+	if s.usageName == "" {
+		return
+	}
+
+	if samples == nil {
+		samples = []usageSample{} // Upload an empty array rather than null
+	}
+	data, err := json.Marshal(samples)
+	if err != nil {
+		s.monitor.ReportError(err, "failed to serialize resource usage")
+		return
+	}
+	err = s.context.UploadS3Artifact(runtime.S3Artifact{
+		Name:     s.usageName,
+		Mimetype: "application/json",
+		Expires:  s.context.TaskInfo.Expires,
+		Stream:   ioext.NopCloser(bytes.NewReader(data)),
+	})
+	if err != nil {
+		s.monitor.Warn("failed to upload resource usage, error: ", err)
+		s.context.LogError(fmt.Sprintf("Failed to upload resource usage as artifact: %s", s.usageName))
+		return
+	}
+	s.context.Log(fmt.Sprintf("Uploaded resource usage as artifact: %s", s.usageName))
+}
+
 func (s *sandbox) WaitForResult() (engines.ResultSet, error) {
 	s.resolve.Wait()
 	return s.resultSet, s.resultError
@@ -176,8 +901,20 @@ func (s *sandbox) Abort() error {
 		// Kill all shells
 		s.sessions.AbortSessions()
 
+		// Nothing is uploaded while waiting for migration, as the task is still
+		// running on the source host
+		if s.pending.Get() {
+			s.vm.Kill()
+			s.resultError = engines.ErrSandboxAborted
+			return
+		}
+
+		// Capture the screen before we abort the VM
+		s.captureScreenshot()
+		s.uploadArtifacts()
+
 		// Abort the VM
-		s.vm.Kill()
+		s.vm.Shutdown(s.engine.engineConfig.ShutdownGracePeriod)
 		s.resultError = engines.ErrSandboxAborted
 	})
 
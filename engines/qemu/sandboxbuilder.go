@@ -1,6 +1,7 @@
 package qemuengine
 
 import (
+	"fmt"
 	"net/http"
 	"os"
 	"regexp"
@@ -9,7 +10,6 @@ import (
 
 	"github.com/taskcluster/taskcluster-worker/engines"
 	"github.com/taskcluster/taskcluster-worker/engines/qemu/image"
-	"github.com/taskcluster/taskcluster-worker/engines/qemu/network"
 	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
 	"github.com/taskcluster/taskcluster-worker/runtime"
 	"github.com/taskcluster/taskcluster-worker/runtime/fetcher"
@@ -19,35 +19,68 @@ type sandboxBuilder struct {
 	engines.SandboxBuilderBase
 	m          sync.Mutex
 	discarded  bool
-	network    *network.Network
+	network    vm.Network
 	command    []string
+	recording  string
+	audio      string
+	capture    *packetCaptureType
+	crashDump  string
+	usage      string
+	guaranteed int
+	poweroff   bool
+	imageName  string
+	scratch    []scratchDiskType
+	gpus       int
+	usb        []string
+	ports      []int
+	egress     *egressPolicy
+	hosts      []hostRecord
 	machine    vm.Machine
 	image      *image.Instance
+	boot       *bootFiles
 	imageError error
 	imageDone  <-chan struct{}
 	proxies    map[string]http.Handler
 	env        map[string]string
+	mounts     []mount
 	context    *runtime.TaskContext
+	storage    runtime.TemporaryStorage
 	engine     *engine
 	monitor    runtime.Monitor
+	migration  engines.IncomingMigration // Migration from another host, if any
 }
 
 // newSandboxBuilder creates a new sandboxBuilder, the network and command
 // properties must be set manually after calling this method.
 func newSandboxBuilder(
-	payload *payloadType, network *network.Network,
-	c *runtime.TaskContext, e *engine, monitor runtime.Monitor,
+	payload *payloadType, network vm.Network,
+	c *runtime.TaskContext, storage runtime.TemporaryStorage, e *engine, monitor runtime.Monitor,
 ) *sandboxBuilder {
 	imageDone := make(chan struct{})
 	sb := &sandboxBuilder{
-		network:   network,
-		command:   payload.Command,
-		imageDone: imageDone,
-		proxies:   make(map[string]http.Handler),
-		env:       make(map[string]string),
-		context:   c,
-		engine:    e,
-		monitor:   monitor,
+		network:    network,
+		command:    payload.Command,
+		recording:  payload.ScreenRecording,
+		audio:      payload.AudioRecording,
+		capture:    payload.PacketCapture,
+		crashDump:  payload.CrashDump,
+		usage:      payload.ResourceUsage,
+		guaranteed: payload.GuaranteedMemory,
+		poweroff:   payload.Poweroff,
+		imageName:  payload.ImageArtifact,
+		scratch:    payload.ScratchDisks,
+		gpus:       payload.GPUs,
+		usb:        payload.USBDevices,
+		ports:      payload.ForwardPorts,
+		egress:     payload.EgressPolicy,
+		hosts:      payload.HostRecords,
+		imageDone:  imageDone,
+		proxies:    make(map[string]http.Handler),
+		env:        make(map[string]string),
+		context:    c,
+		storage:    storage,
+		engine:     e,
+		monitor:    monitor,
 	}
 	if payload.Machine != nil {
 		sb.machine = vm.NewMachine(payload.Machine)
@@ -55,34 +88,52 @@ func newSandboxBuilder(
 
 	// Start downloading and extracting the image
 	go func() {
-		var scopeSets [][]string
 		var inst *image.Instance
+		var boot *bootFiles
 
+		var ref fetcher.Reference
 		ctx := &fetchImageContext{c}
-		ref, err := imageFetcher.NewReference(ctx, payload.Image)
+		imageRef, err := e.imageVerifier.Resolve(payload.Image)
+		if err != nil {
+			goto handleErr
+		}
+		ref, err = imageFetcher.NewReference(ctx, imageRef)
 		if err != nil {
 			goto handleErr
 		}
 
 		// Check that task.scopes satisfies one of required scope-sets
-		scopeSets = ref.Scopes()
-		if !c.HasScopes(scopeSets...) {
-			var options []string
-			for _, scopes := range scopeSets {
-				options = append(options, strings.Join(scopes, ", "))
-			}
-			err = runtime.NewMalformedPayloadError(
-				`task.scopes must satisfy at-least one of the scope-sets: ` + strings.Join(options, " or "),
-			)
+		if err = checkScopes(c, ref); err != nil {
 			goto handleErr
 		}
 
 		debug("fetching image: %#v (if not already present)", payload.Image)
 		inst, err = e.imageManager.Instance(ref.HashKey(), func(imageFile *os.File) error {
-			return ref.Fetch(ctx, &fetcher.FileReseter{File: imageFile})
+			var fctx fetcher.Context = ctx
+			if e.imageDownloads != nil {
+				fctx = fetcher.WithRangeDownloads(ctx, *e.imageDownloads)
+			}
+			target := &fetcher.FileReseter{File: imageFile}
+			// Fetch from peers first, if enabled, falling back to the origin
+			if e.imagePeers != nil {
+				perr := e.imagePeers.FetchImage(fctx, ref.HashKey(), target)
+				if perr == nil || ctx.Err() != nil {
+					return perr
+				}
+				debug("fetching image from origin, peers failed with: %s", perr)
+				if perr = target.Reset(); perr != nil {
+					return perr
+				}
+			}
+			return ref.Fetch(fctx, target)
 		})
 		debug("fetched image: %#v", payload.Image)
 
+		// Fetch kernel and initrd for direct kernel boot, if requested
+		if err == nil && payload.Boot != nil {
+			boot, err = fetchBootFiles(c, payload.Boot, e.Environment.TemporaryStorage)
+		}
+
 	handleErr:
 		// Transform broken reference to malformed payload
 		if fetcher.IsBrokenReferenceError(err) {
@@ -97,8 +148,10 @@ func newSandboxBuilder(
 			if inst != nil {
 				inst.Release()
 			}
+			boot.Close()
 		} else {
 			sb.image = inst
+			sb.boot = boot
 			sb.imageError = err
 		}
 		sb.m.Unlock()
@@ -136,6 +189,53 @@ func (sb *sandboxBuilder) AttachProxy(hostname string, handler http.Handler) err
 	return nil
 }
 
+// mount is a volume attached to the sandbox as shared folder
+type mount struct {
+	volume     *volume
+	mountPoint string
+	readOnly   bool
+}
+
+// mountPointPattern defines allowed mount-points, these must be absolute and
+// end with slash to indicate a folder.
+var mountPointPattern = regexp.MustCompile(`^(?:/[^/\0\\:*"<>|,]+)+/$`)
+
+func (sb *sandboxBuilder) AttachVolume(mountPoint string, vol engines.Volume, readOnly bool) error {
+	// We may assert that vol is a result from engine.NewVolume()
+	v, ok := vol.(*volume)
+	if !ok {
+		sb.monitor.Panicf("AttachVolume() was passed volume of type: %T", vol)
+	}
+
+	// Validate mount-point
+	if !mountPointPattern.MatchString(mountPoint) {
+		return runtime.NewMalformedPayloadError(fmt.Sprintf(
+			"mount-point: '%s' is not allowed for QEMU engine, mount-points must "+
+				"be absolute, end with slash and match: %s",
+			mountPoint, mountPointPattern.String(),
+		))
+	}
+
+	// Acquire the lock
+	sb.m.Lock()
+	defer sb.m.Unlock()
+
+	// Check for naming conflicts, notably we don't allow nested mount-points as
+	// the guest would have to mount them in order.
+	for _, m := range sb.mounts {
+		if strings.HasPrefix(m.mountPoint, mountPoint) || strings.HasPrefix(mountPoint, m.mountPoint) {
+			return engines.ErrNamingConflict
+		}
+	}
+
+	sb.mounts = append(sb.mounts, mount{
+		volume:     v,
+		mountPoint: mountPoint,
+		readOnly:   readOnly,
+	})
+	return nil
+}
+
 // envVarPattern defines allowed environment variable names
 var envVarPattern = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
 
@@ -184,10 +284,7 @@ func (sb *sandboxBuilder) StartSandbox() (engines.Sandbox, error) {
 	}
 
 	// Create a sandbox
-	s, err := newSandbox(
-		sb.command, sb.env, sb.proxies, sb.machine, sb.image, sb.network,
-		sb.context, sb.engine, sb.monitor,
-	)
+	s, err := newSandbox(sb)
 	if err != nil {
 		sb.m.Unlock()
 		// Free all resources
@@ -198,6 +295,7 @@ func (sb *sandboxBuilder) StartSandbox() (engines.Sandbox, error) {
 	// Resources are now owned by the sandbox
 	sb.network = nil
 	sb.image = nil
+	sb.boot = nil
 	sb.m.Unlock()
 
 	return s, nil
@@ -219,5 +317,9 @@ func (sb *sandboxBuilder) Discard() error {
 		sb.network.Release()
 		sb.network = nil
 	}
+	if sb.boot != nil {
+		sb.boot.Close()
+		sb.boot = nil
+	}
 	return nil
 }
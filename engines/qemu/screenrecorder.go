@@ -0,0 +1,245 @@
+package qemuengine
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"net"
+	"sync"
+	"time"
+
+	vnc "github.com/mitchellh/go-vnc"
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+// screenRecordingInterval is the interval at which frames are captured
+const screenRecordingInterval = 1 * time.Second
+
+// maxScreenRecordingSize is the maximum size of a screen recording, frames are
+// no longer captured when this size is exceeded.
+const maxScreenRecordingSize = 256 * 1024 * 1024
+
+// screenRecorder records the screen of a virtual machine as a tar-archive of
+// PNG frames, by connecting as VNC client to the VNC socket of the virtual
+// machine. Frames are only captured when the screen has changed, and each
+// frame is named by the number of milliseconds since the recording started,
+// e.g. '00012000.png' is the screen 12 seconds into the recording.
+type screenRecorder struct {
+	vm        *vm.VirtualMachine
+	file      runtime.TemporaryFile
+	archive   *tar.Writer
+	monitor   runtime.Monitor
+	started   time.Time
+	size      int64
+	frames    int
+	truncated bool
+	stopping  sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// newScreenRecorder starts recording the screen of the given virtual machine
+// to file, the recording continues until Stop() is called.
+func newScreenRecorder(machine *vm.VirtualMachine, file runtime.TemporaryFile, monitor runtime.Monitor) *screenRecorder {
+	r := &screenRecorder{
+		vm:      machine,
+		file:    file,
+		archive: tar.NewWriter(file),
+		monitor: monitor,
+		started: time.Now(),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go r.record()
+	return r
+}
+
+// connect dials the VNC socket of the virtual machine, retrying until the
+// socket is available, as QEMU may not have created it yet.
+func (r *screenRecorder) connect() (net.Conn, error) {
+	for {
+		socket := r.vm.VNCSocket()
+		if socket == "" {
+			return nil, errors.New("virtual machine was terminated before recording started")
+		}
+		conn, err := net.DialTimeout("unix", socket, 15*time.Second)
+		if err == nil {
+			return conn, nil
+		}
+		debug("screen recorder failed to connect to display socket: %s, error: %s", socket, err)
+		select {
+		case <-r.stop:
+			return nil, errors.New("recording was stopped before it started")
+		case <-r.vm.Done:
+			return nil, errors.New("virtual machine was terminated before recording started")
+		case <-time.After(screenRecordingInterval):
+		}
+	}
+}
+
+func (r *screenRecorder) record() {
+	defer close(r.done)
+
+	conn, err := r.connect()
+	if err != nil {
+		debug("screen recorder didn't start, error: %s", err)
+		return
+	}
+
+	password := r.vm.VNCPassword()
+	if password == "" {
+		conn.Close()
+		debug("screen recorder didn't start, virtual machine was terminated")
+		return
+	}
+
+	// Buffer server messages, so the client isn't blocked on a pending update
+	// when we stop reading from the channel
+	messages := make(chan vnc.ServerMessage, 16)
+	client, err := vnc.Client(conn, &vnc.ClientConfig{
+		Auth:            []vnc.ClientAuth{&vnc.PasswordAuth{Password: password}},
+		ServerMessageCh: messages,
+	})
+	if err != nil {
+		conn.Close()
+		r.monitor.Warn("screen recorder failed to connect as VNC client, error: ", err)
+		return
+	}
+	defer client.Close()
+
+	if err = client.SetEncodings([]vnc.Encoding{&vnc.RawEncoding{}}); err != nil {
+		r.monitor.Warn("screen recorder failed to set VNC encodings, error: ", err)
+		return
+	}
+
+	w, h := client.FrameBufferWidth, client.FrameBufferHeight
+	screen := image.NewRGBA(image.Rect(0, 0, int(w), int(h)))
+	dirty := false
+	if err = client.FramebufferUpdateRequest(false, 0, 0, w, h); err != nil {
+		r.monitor.Warn("screen recorder failed to request framebuffer update, error: ", err)
+		return
+	}
+
+	ticker := time.NewTicker(screenRecordingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.stop:
+			// Capture the last frame, if the screen changed since the last tick
+			if dirty && !r.truncated {
+				r.writeFrame(screen)
+			}
+			return
+		case <-r.vm.Done:
+			return
+		case msg := <-messages:
+			if update, ok := msg.(*vnc.FramebufferUpdateMessage); ok {
+				if drawRectangles(screen, update.Rectangles, client.PixelFormat) {
+					dirty = true
+				}
+			}
+		case <-ticker.C:
+			if dirty && !r.truncated {
+				r.writeFrame(screen)
+				dirty = false
+			}
+			if err = client.FramebufferUpdateRequest(true, 0, 0, w, h); err != nil {
+				debug("screen recorder failed to request framebuffer update, error: %s", err)
+				return
+			}
+		}
+	}
+}
+
+// writeFrame adds screen as a PNG frame to the recording
+func (r *screenRecorder) writeFrame(screen image.Image) {
+	buf := bytes.NewBuffer(nil)
+	if err := png.Encode(buf, screen); err != nil {
+		r.monitor.ReportError(err, "screen recorder failed to encode frame as PNG")
+		return
+	}
+	if r.size+int64(buf.Len()) > maxScreenRecordingSize {
+		r.truncated = true
+		return
+	}
+
+	elapsed := time.Since(r.started)
+	err := r.archive.WriteHeader(&tar.Header{
+		Name:    fmt.Sprintf("%08d.png", int64(elapsed/time.Millisecond)),
+		Mode:    0644,
+		Size:    int64(buf.Len()),
+		ModTime: r.started.Add(elapsed),
+	})
+	if err == nil {
+		_, err = r.archive.Write(buf.Bytes())
+	}
+	if err != nil {
+		r.monitor.ReportError(err, "screen recorder failed to write frame")
+		r.truncated = true
+		return
+	}
+	r.size += int64(buf.Len())
+	r.frames++
+}
+
+// drawRectangles draws rectangles from a framebuffer update on screen, returns
+// true if anything was drawn.
+func drawRectangles(screen *image.RGBA, rects []vnc.Rectangle, pf vnc.PixelFormat) bool {
+	drawn := false
+	for _, rect := range rects {
+		raw, ok := rect.Enc.(*vnc.RawEncoding)
+		if !ok {
+			continue
+		}
+		for i, c := range raw.Colors {
+			x := int(rect.X) + i%int(rect.Width)
+			y := int(rect.Y) + i/int(rect.Width)
+			screen.Set(x, y, toRGBA(c, pf)) // Set ignores pixels out of bounds
+			drawn = true
+		}
+	}
+	return drawn
+}
+
+// toRGBA converts a VNC color to color.RGBA, true-color values are scaled by
+// the maximum values from the pixel format, while color-map entries are 16 bit.
+func toRGBA(c vnc.Color, pf vnc.PixelFormat) color.RGBA {
+	scale := func(v, max uint16) uint8 {
+		if max == 0 {
+			return 0
+		}
+		return uint8(uint32(v) * 255 / uint32(max))
+	}
+	if !pf.TrueColor {
+		return color.RGBA{R: uint8(c.R >> 8), G: uint8(c.G >> 8), B: uint8(c.B >> 8), A: 255}
+	}
+	return color.RGBA{
+		R: scale(c.R, pf.RedMax),
+		G: scale(c.G, pf.GreenMax),
+		B: scale(c.B, pf.BlueMax),
+		A: 255,
+	}
+}
+
+// Stop ends the recording and returns the number of frames recorded, and
+// whether the recording was truncated because it exceeded the maximum size.
+// After Stop() the recording can be read from the file.
+func (r *screenRecorder) Stop() (frames int, truncated bool, err error) {
+	r.stopping.Do(func() {
+		close(r.stop)
+	})
+	<-r.done
+
+	if err = r.archive.Close(); err != nil {
+		return 0, false, errors.Wrap(err, "failed to close tar-archive")
+	}
+	if _, err = r.file.Seek(0, 0); err != nil {
+		return 0, false, errors.Wrap(err, "failed to seek to start of recording")
+	}
+	return r.frames, r.truncated, nil
+}
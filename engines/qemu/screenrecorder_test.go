@@ -0,0 +1,35 @@
+package qemuengine
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	vnc "github.com/mitchellh/go-vnc"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDrawRectangles(t *testing.T) {
+	pf := vnc.PixelFormat{TrueColor: true, RedMax: 255, GreenMax: 63, BlueMax: 31}
+	screen := image.NewRGBA(image.Rect(0, 0, 4, 4))
+
+	drawn := drawRectangles(screen, nil, pf)
+	require.False(t, drawn, "expected nothing to be drawn")
+
+	drawn = drawRectangles(screen, []vnc.Rectangle{{
+		X: 1, Y: 2, Width: 2, Height: 1,
+		Enc: &vnc.RawEncoding{Colors: []vnc.Color{
+			{R: 255, G: 0, B: 0},
+			{R: 0, G: 63, B: 31},
+		}},
+	}}, pf)
+	require.True(t, drawn, "expected rectangle to be drawn")
+	require.Equal(t, color.RGBA{R: 255, A: 255}, screen.RGBAAt(1, 2))
+	require.Equal(t, color.RGBA{G: 255, B: 255, A: 255}, screen.RGBAAt(2, 2))
+	require.Equal(t, color.RGBA{}, screen.RGBAAt(0, 0))
+}
+
+func TestToRGBAColorMap(t *testing.T) {
+	c := toRGBA(vnc.Color{R: 0xffff, G: 0x8000, B: 0}, vnc.PixelFormat{TrueColor: false})
+	require.Equal(t, color.RGBA{R: 0xff, G: 0x80, B: 0, A: 255}, c)
+}
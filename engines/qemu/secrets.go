@@ -0,0 +1,86 @@
+package qemuengine
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/metaservice"
+	"github.com/taskcluster/taskcluster-worker/runtime/ioext"
+)
+
+// defaultSecretsBaseURL is the baseUrl for taskcluster-secrets, unless
+// secretsBaseUrl is given in the engine config.
+const defaultSecretsBaseURL = "https://secrets.taskcluster.net/v1"
+
+// maxSecretSize is the maximum size of a secret returned to the guest
+const maxSecretSize = 1024 * 1024
+
+// secretFetchTimeout is the maximum time to wait for taskcluster-secrets
+const secretFetchTimeout = 30 * time.Second
+
+// fetchSecret fetches the secret named name from taskcluster-secrets with the
+// temporary credentials for the task, if task.scopes satisfies
+// 'secrets:get:<name>'. Secrets fetched are recorded in the task log, without
+// their values.
+func (s *sandbox) fetchSecret(name string) ([]byte, error) {
+	scope := "secrets:get:" + name
+	if !s.context.HasScopes([]string{scope}) {
+		s.context.LogWarning(fmt.Sprintf(
+			"Guest was denied the secret '%s', as task.scopes doesn't satisfy '%s'", name, scope,
+		))
+		return nil, metaservice.ErrSecretForbidden
+	}
+
+	baseURL := s.engine.engineConfig.SecretsBaseURL
+	if baseURL == "" {
+		baseURL = defaultSecretsBaseURL
+	}
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/") + "/secret/" + url.PathEscape(name))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to construct secret URL")
+	}
+
+	// Sign with task credentials, restricted to the scope for this secret
+	signature, err := s.context.Authorizer().WithAuthorizedScopes(scope).SignHeader(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to sign request")
+	}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create request")
+	}
+	req.Header.Set("Authorization", signature)
+
+	// Abort the request if the task is resolved
+	ctx, cancel := context.WithTimeout(s.context, secretFetchTimeout)
+	defer cancel()
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, errors.Wrap(err, "request to taskcluster-secrets failed")
+	}
+	defer res.Body.Close()
+	body, err := ioext.ReadAtMost(res.Body, maxSecretSize)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read secret")
+	}
+
+	switch res.StatusCode {
+	case http.StatusOK:
+		s.context.Log(fmt.Sprintf("Guest fetched the secret '%s'", name))
+		return body, nil
+	case http.StatusNotFound:
+		return nil, metaservice.ErrSecretNotFound
+	case http.StatusUnauthorized, http.StatusForbidden:
+		s.context.LogWarning(fmt.Sprintf(
+			"Guest was denied the secret '%s' by taskcluster-secrets", name,
+		))
+		return nil, metaservice.ErrSecretForbidden
+	default:
+		return nil, errors.Errorf("taskcluster-secrets returned status: %d", res.StatusCode)
+	}
+}
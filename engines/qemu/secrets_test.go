@@ -0,0 +1,55 @@
+package qemuengine
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/metaservice"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+func TestFetchSecret(t *testing.T) {
+	var path, auth string
+	secrets := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.EscapedPath()
+		auth = r.Header.Get("Authorization")
+		if strings.HasSuffix(path, "missing") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"secret": {"password": "hunter2"}}`))
+	}))
+	defer secrets.Close()
+
+	folder := runtime.NewTemporaryTestFolderOrPanic()
+	defer folder.Remove()
+	ctx, controller, err := runtime.NewTaskContext(folder.NewFilePath(), runtime.TaskInfo{
+		Scopes: []string{"secrets:get:project/test/*"},
+	})
+	require.NoError(t, err)
+	defer controller.Dispose()
+	controller.SetCredentials("test-client", "test-token", "")
+
+	s := &sandbox{
+		context: ctx,
+		engine:  &engine{engineConfig: configType{SecretsBaseURL: secrets.URL + "/v1"}},
+	}
+
+	secret, err := s.fetchSecret("project/test/password")
+	require.NoError(t, err)
+	require.JSONEq(t, `{"secret": {"password": "hunter2"}}`, string(secret))
+	require.Equal(t, "/v1/secret/project%2Ftest%2Fpassword", path)
+	require.True(t, strings.HasPrefix(auth, "Hawk "), "expected hawk signature")
+
+	_, err = s.fetchSecret("project/test/missing")
+	require.Equal(t, metaservice.ErrSecretNotFound, err)
+
+	// Secrets not covered by task.scopes are denied without a request
+	path = ""
+	_, err = s.fetchSecret("project/other/password")
+	require.Equal(t, metaservice.ErrSecretForbidden, err)
+	require.Equal(t, "", path)
+}
@@ -163,6 +163,22 @@ func (s *sessionManager) OpenDisplay() (io.ReadWriteCloser, error) {
 		return nil, engines.ErrSandboxTerminated
 	}
 
+	// Authenticate with the VNC password, display clients are offered no
+	// authentication as access is guarded by the interactive URL
+	password := s.vm.VNCPassword()
+	if password == "" {
+		conn.Close()
+		return nil, engines.ErrSandboxTerminated
+	}
+	conn.SetDeadline(time.Now().Add(vncAuthTimeout))
+	err = vncAuthenticate(conn, password)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		debug("failed to authenticate with display socket: %s, error: %s", socket, err)
+		return nil, engines.ErrSandboxTerminated
+	}
+
 	// Lock we so we can insert in the list of displays
 	s.m.Lock()
 	defer s.m.Unlock()
@@ -170,7 +186,7 @@ func (s *sessionManager) OpenDisplay() (io.ReadWriteCloser, error) {
 	// Create a WatchPipe around conn, so that we can remove it from displays
 	// when it is closed
 	var display io.ReadWriteCloser
-	display = ioext.WatchPipe(conn, func(_ error) {
+	display = ioext.WatchPipe(newVNCProxy(conn), func(_ error) {
 		// Lock so we can move display from displays
 		s.m.Lock()
 		defer s.m.Unlock()
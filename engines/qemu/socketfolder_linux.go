@@ -0,0 +1,141 @@
+// +build linux
+
+package qemuengine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/slugid-go/slugid"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+// tmpfsMagic is the filesystem type of tmpfs reported by statfs(2)
+const tmpfsMagic = 0x01021994
+
+// tmpfsOptions are the mount options for the socket folder tmpfs, sockets take
+// no space, but screenshots are briefly written to the socket folder.
+const tmpfsOptions = "size=256m,mode=0700"
+
+// lockSuffix is the suffix of lock files for socket folders
+const lockSuffix = ".lock"
+
+// lockedFolder is a folder with a lock file held with flock(2) while the
+// folder is in use, such that stale folders can be detected.
+type lockedFolder struct {
+	path string
+	lock *os.File
+}
+
+// newTmpfsSocketFolder mounts a tmpfs at mountPoint, unless already mounted by
+// another worker, removes stale socket folders left by crashed workers, and
+// creates a locked socket folder for this engine.
+func newTmpfsSocketFolder(mountPoint string, monitor runtime.Monitor) (folder, error) {
+	if err := os.MkdirAll(mountPoint, 0700); err != nil {
+		return nil, errors.Wrap(err, "failed to create socket folder")
+	}
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(mountPoint, &stat); err != nil {
+		return nil, errors.Wrap(err, "failed to stat socket folder")
+	}
+	if stat.Type != tmpfsMagic {
+		flags := uintptr(syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC)
+		if err := syscall.Mount("tmpfs", mountPoint, "tmpfs", flags, tmpfsOptions); err != nil {
+			return nil, errors.Wrapf(err, "failed to mount tmpfs at %s", mountPoint)
+		}
+		monitor.Info("mounted tmpfs for sockets at ", mountPoint)
+	}
+
+	removeStaleFolders(mountPoint, monitor)
+	return newLockedFolder(mountPoint)
+}
+
+// newLockedFolder creates a folder with a random name in parent, and a lock
+// file that is held until the folder is removed.
+func newLockedFolder(parent string) (*lockedFolder, error) {
+	for {
+		path := filepath.Join(parent, slugid.Nice())
+		lock, err := os.OpenFile(path+lockSuffix, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0600)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create lock file")
+		}
+		// Block, as removeStaleFolders() in another worker may hold the lock
+		if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+			lock.Close()
+			os.Remove(lock.Name())
+			return nil, errors.Wrap(err, "failed to lock socket folder")
+		}
+		// If another worker removed the lock file, before we locked it, try again
+		if !isLinked(lock) {
+			lock.Close()
+			continue
+		}
+		if err = os.Mkdir(path, 0700); err != nil {
+			os.Remove(lock.Name())
+			lock.Close()
+			return nil, errors.Wrap(err, "failed to create socket folder")
+		}
+		return &lockedFolder{path: path, lock: lock}, nil
+	}
+}
+
+// isLinked returns true, if the path of the open file f still refers to f
+func isLinked(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	linked, err := os.Stat(f.Name())
+	return err == nil && os.SameFile(info, linked)
+}
+
+// removeStaleFolders removes folders in parent whose lock file isn't held,
+// because the worker that created them crashed.
+func removeStaleFolders(parent string, monitor runtime.Monitor) {
+	entries, err := ioutil.ReadDir(parent)
+	if err != nil {
+		monitor.ReportWarning(err, "failed to list socket folders")
+		return
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), lockSuffix) {
+			continue
+		}
+		path := filepath.Join(parent, strings.TrimSuffix(entry.Name(), lockSuffix))
+		lock, err := os.OpenFile(path+lockSuffix, os.O_RDWR, 0)
+		if err != nil {
+			continue // removed by another worker
+		}
+		if syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB) != nil || !isLinked(lock) {
+			lock.Close()
+			continue // in use or removed by another worker
+		}
+		monitor.Info("removing stale socket folder: ", path)
+		// Remove folder before the lock file, so folders never exist unlocked
+		if err = os.RemoveAll(path); err == nil {
+			err = os.Remove(lock.Name())
+		}
+		if err != nil {
+			monitor.ReportWarning(err, "failed to remove stale socket folder")
+		}
+		lock.Close()
+	}
+}
+
+func (f *lockedFolder) Path() string {
+	return f.path
+}
+
+// Remove the folder and release the lock, if the folder can't be removed the
+// lock file is left, so it'll be removed as a stale folder later.
+func (f *lockedFolder) Remove() error {
+	defer f.lock.Close()
+	if err := os.RemoveAll(f.path); err != nil {
+		return err
+	}
+	return os.Remove(f.lock.Name())
+}
@@ -0,0 +1,42 @@
+// +build linux
+
+package qemuengine
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/mocks"
+)
+
+func TestRemoveStaleFolders(t *testing.T) {
+	parent := runtime.NewTemporaryTestFolderOrPanic()
+	defer parent.Remove()
+
+	// Folder in use by a running worker
+	active, err := newLockedFolder(parent.Path())
+	require.NoError(t, err)
+	defer active.Remove()
+
+	// Folder left by a crashed worker, the lock was released when it died
+	stale, err := newLockedFolder(parent.Path())
+	require.NoError(t, err)
+	require.NoError(t, stale.lock.Close())
+
+	removeStaleFolders(parent.Path(), mocks.NewMockMonitor(true))
+
+	_, err = os.Stat(active.Path())
+	require.NoError(t, err, "expected active folder to be kept")
+	_, err = os.Stat(stale.Path())
+	require.True(t, os.IsNotExist(err), "expected stale folder to be removed")
+	_, err = os.Stat(stale.Path() + lockSuffix)
+	require.True(t, os.IsNotExist(err), "expected stale lock file to be removed")
+
+	require.NoError(t, active.Remove())
+	matches, err := filepath.Glob(filepath.Join(parent.Path(), "*"))
+	require.NoError(t, err)
+	require.Empty(t, matches)
+}
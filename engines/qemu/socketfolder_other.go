@@ -0,0 +1,14 @@
+// +build !linux
+
+package qemuengine
+
+import (
+	"errors"
+
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+// newTmpfsSocketFolder returns an error, as tmpfs is only supported on linux
+func newTmpfsSocketFolder(mountPoint string, monitor runtime.Monitor) (folder, error) {
+	return nil, errors.New("'socketFolder' is only supported on linux")
+}
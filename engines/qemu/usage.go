@@ -0,0 +1,151 @@
+package qemuengine
+
+import (
+	"sync"
+	"time"
+
+	"github.com/taskcluster/taskcluster-worker/engines"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
+)
+
+// usageInterval is the interval at which resource usage is sampled
+const usageInterval = 5 * time.Second
+
+// usageSample is the resource usage of a virtual machine at a point in time,
+// counters are totals since the sampler was started.
+type usageSample struct {
+	Time        float64 `json:"time"`    // seconds since sampling started
+	CPUTime     float64 `json:"cpuTime"` // seconds
+	Memory      int64   `json:"memory"`  // resident memory in bytes
+	DiskRead    int64   `json:"diskRead"`
+	DiskWritten int64   `json:"diskWritten"`
+	NetReceived int64   `json:"netReceived"`
+	NetSent     int64   `json:"netSent"`
+}
+
+// trafficCounter is implemented by networks that can report traffic, such as
+// TAP networks from network.Pool.
+type trafficCounter interface {
+	Traffic() (received, sent int64, err error)
+}
+
+// usageSampler periodically samples resource usage of a virtual machine from
+// the QEMU process and QMP query-blockstats.
+type usageSampler struct {
+	m        sync.Mutex
+	vm       *vm.VirtualMachine
+	network  trafficCounter // nil, if network traffic isn't available
+	started  time.Time
+	received int64 // network counters when the sampler was started
+	sent     int64
+	samples  []usageSample
+	usage    engines.ResourceUsage
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// newUsageSampler starts sampling resource usage, network may be nil. Stop()
+// must be called to stop sampling.
+func newUsageSampler(machine *vm.VirtualMachine, network vm.Network) *usageSampler {
+	s := &usageSampler{
+		vm:      machine,
+		started: time.Now(),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	if t, ok := network.(trafficCounter); ok {
+		if received, sent, err := t.Traffic(); err == nil {
+			s.network, s.received, s.sent = t, received, sent
+		} else {
+			debug("network traffic not available, error: %s", err)
+		}
+	}
+	go s.run()
+	return s
+}
+
+func (s *usageSampler) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(usageInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-s.vm.Done:
+			return
+		case <-ticker.C:
+			s.sample()
+		}
+	}
+}
+
+// sample records the current resource usage, metrics that can't be read are
+// left as zero, as the virtual machine may be stopping.
+func (s *usageSampler) sample() {
+	sample := usageSample{
+		Time: time.Since(s.started).Seconds(),
+	}
+	stats, err := s.vm.ProcessStats()
+	if err != nil {
+		debug("failed to read QEMU process stats, error: %s", err)
+		return
+	}
+	sample.CPUTime = stats.CPUTime.Seconds()
+	sample.Memory = stats.Memory
+	if read, written, err := s.vm.BlockStats(); err == nil {
+		sample.DiskRead, sample.DiskWritten = read, written
+	}
+	if s.network != nil {
+		if received, sent, err := s.network.Traffic(); err == nil {
+			sample.NetReceived, sample.NetSent = received-s.received, sent-s.sent
+		}
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.samples = append(s.samples, sample)
+	s.usage = summarizeUsage(s.usage, sample, stats.PeakMemory)
+}
+
+// summarizeUsage returns usage updated with a new sample, counters only ever
+// increase, so we keep the largest values seen.
+func summarizeUsage(usage engines.ResourceUsage, sample usageSample, peakMemory int64) engines.ResourceUsage {
+	max := func(a, b int64) int64 {
+		if a > b {
+			return a
+		}
+		return b
+	}
+	cpuTime := time.Duration(sample.CPUTime * float64(time.Second))
+	if cpuTime > usage.CPUTime {
+		usage.CPUTime = cpuTime
+	}
+	usage.PeakMemory = max(usage.PeakMemory, max(peakMemory, sample.Memory))
+	usage.DiskRead = max(usage.DiskRead, sample.DiskRead)
+	usage.DiskWritten = max(usage.DiskWritten, sample.DiskWritten)
+	usage.NetReceived = max(usage.NetReceived, sample.NetReceived)
+	usage.NetSent = max(usage.NetSent, sample.NetSent)
+	return usage
+}
+
+// Stop sampling, takes a final sample if the virtual machine is still running,
+// and returns the timeline of samples and a summary of resource usage.
+func (s *usageSampler) Stop() ([]usageSample, engines.ResourceUsage) {
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+		<-s.done
+		select {
+		case <-s.vm.Done:
+		default:
+			s.sample()
+		}
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.samples, s.usage
+}
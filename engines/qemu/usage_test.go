@@ -0,0 +1,36 @@
+package qemuengine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/engines"
+)
+
+func TestSummarizeUsage(t *testing.T) {
+	var usage engines.ResourceUsage
+	usage = summarizeUsage(usage, usageSample{
+		CPUTime:     1.5,
+		Memory:      512,
+		DiskRead:    100,
+		DiskWritten: 200,
+		NetReceived: 300,
+	}, 1024)
+	usage = summarizeUsage(usage, usageSample{
+		CPUTime:     3,
+		Memory:      256,
+		DiskRead:    150,
+		DiskWritten: 200,
+		NetReceived: 300,
+		NetSent:     50,
+	}, 0)
+	require.Equal(t, engines.ResourceUsage{
+		CPUTime:     3 * time.Second,
+		PeakMemory:  1024,
+		DiskRead:    150,
+		DiskWritten: 200,
+		NetReceived: 300,
+		NetSent:     50,
+	}, usage)
+}
@@ -0,0 +1,138 @@
+package qemuengine
+
+import (
+	"errors"
+	"sync"
+
+	schematypes "github.com/taskcluster/go-schematypes"
+	"github.com/taskcluster/taskcluster-worker/engines/qemu/vm"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/util"
+)
+
+// usbDeviceConfig is a named host USB device available for passthrough.
+type usbDeviceConfig struct {
+	Name      string `json:"name"`
+	VendorID  string `json:"vendorId"`
+	ProductID string `json:"productId"`
+	HostBus   int    `json:"hostBus"`
+	HostPort  string `json:"hostPort"`
+}
+
+// device returns the vm.USBHostDevice for the configured device
+func (c usbDeviceConfig) device() vm.USBHostDevice {
+	return vm.USBHostDevice{
+		VendorID:  c.VendorID,
+		ProductID: c.ProductID,
+		HostBus:   c.HostBus,
+		HostPort:  c.HostPort,
+	}
+}
+
+var usbDevicesSchema = schematypes.Array{
+	Title: "USB Devices",
+	Description: util.Markdown(`
+		Host USB devices available for passthrough to virtual machines, tasks
+		may request devices by name using 'usbDevices' in the task payload.
+		Each device is reserved by a single virtual machine at the time, so
+		concurrent tasks can't claim the same phone or board under test.
+
+		Devices are identified by 'vendorId' and 'productId' as listed by
+		'lsusb', or by 'hostBus' and 'hostPort' when multiple devices of the
+		same kind are connected.
+	`),
+	Items: schematypes.Object{
+		Properties: schematypes.Properties{
+			"name": schematypes.String{
+				Title:       "Name",
+				Description: `Name used to request the device in the task payload.`,
+				Pattern:     `^[a-zA-Z0-9_-]{1,64}$`,
+			},
+			"vendorId": schematypes.String{
+				Title:       "Vendor ID",
+				Description: `USB vendor id as 4 hex digits, for example '18d1'.`,
+				Pattern:     vm.USBIDPattern,
+			},
+			"productId": schematypes.String{
+				Title:       "Product ID",
+				Description: `USB product id as 4 hex digits, for example '4ee7'.`,
+				Pattern:     vm.USBIDPattern,
+			},
+			"hostBus": schematypes.Integer{
+				Title:       "Host Bus",
+				Description: `USB bus number the device is connected to.`,
+				Minimum:     1,
+				Maximum:     255,
+			},
+			"hostPort": schematypes.String{
+				Title:       "Host Port",
+				Description: `USB port path the device is connected to, for example '1.2'.`,
+				Pattern:     vm.USBPortPattern,
+			},
+		},
+		Required: []string{"name"},
+	},
+}
+
+// errUSBDeviceInUse is returned from usbPool.reserve() if a device requested is
+// currently reserved by another virtual machine.
+var errUSBDeviceInUse = errors.New("USB device is in use by another virtual machine")
+
+// usbPool tracks USB devices reserved by running virtual machines.
+type usbPool struct {
+	m       sync.Mutex
+	devices map[string]usbDeviceConfig
+	inUse   map[string]bool
+}
+
+func newUSBPool(devices []usbDeviceConfig) *usbPool {
+	p := &usbPool{
+		devices: make(map[string]usbDeviceConfig),
+		inUse:   make(map[string]bool),
+	}
+	for _, d := range devices {
+		p.devices[d.Name] = d
+	}
+	return p
+}
+
+// reserve the USB devices with given names, returns the devices reserved and a
+// function that must be called to release the reservation.
+//
+// Returns MalformedPayloadError if the worker doesn't have a device requested,
+// and errUSBDeviceInUse if a device is reserved by another virtual machine.
+func (p *usbPool) reserve(names []string) ([]usbDeviceConfig, func(), error) {
+	var devices []usbDeviceConfig
+	for _, name := range names {
+		d, ok := p.devices[name]
+		if !ok {
+			return nil, nil, runtime.NewMalformedPayloadError(
+				"USB device '", name, "' is not available on this worker",
+			)
+		}
+		devices = append(devices, d)
+	}
+
+	p.m.Lock()
+	defer p.m.Unlock()
+
+	for _, name := range names {
+		if p.inUse[name] {
+			return nil, nil, errUSBDeviceInUse
+		}
+	}
+	for _, name := range names {
+		p.inUse[name] = true
+	}
+
+	var once sync.Once
+	return devices, func() {
+		once.Do(func() {
+			p.m.Lock()
+			defer p.m.Unlock()
+			for _, name := range names {
+				delete(p.inUse, name)
+			}
+		})
+	}, nil
+}
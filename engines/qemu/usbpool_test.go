@@ -0,0 +1,39 @@
+package qemuengine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+func TestUSBPoolReserve(t *testing.T) {
+	p := newUSBPool([]usbDeviceConfig{
+		{Name: "phone", VendorID: "18d1", ProductID: "4ee7"},
+		{Name: "board", HostBus: 1, HostPort: "2"},
+	})
+
+	devices, release1, err := p.reserve([]string{"phone"})
+	require.NoError(t, err)
+	require.Equal(t, "18d1", devices[0].device().VendorID)
+
+	// Devices can't be claimed twice
+	_, _, err = p.reserve([]string{"board", "phone"})
+	require.Equal(t, errUSBDeviceInUse, err)
+	_, release2, err := p.reserve([]string{"board"})
+	require.NoError(t, err)
+
+	// Releasing twice has no effect
+	release1()
+	release1()
+	_, release3, err := p.reserve([]string{"phone"})
+	require.NoError(t, err)
+	release2()
+	release3()
+	require.Equal(t, 0, len(p.inUse))
+
+	// Requesting a device the worker doesn't have is malformed-payload
+	_, _, err = p.reserve([]string{"printer"})
+	_, ok := runtime.IsMalformedPayloadError(err)
+	require.True(t, ok)
+}
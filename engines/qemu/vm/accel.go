@@ -0,0 +1,56 @@
+package vm
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// Accelerators used by QEMU for virtual machines
+const (
+	AccelKVM = "kvm" // Hardware virtualization, requires /dev/kvm
+	AccelTCG = "tcg" // Software emulation, considerably slower
+)
+
+// KVMAvailable returns true, if /dev/kvm can be opened for use by QEMU.
+func KVMAvailable() bool {
+	f, err := os.OpenFile("/dev/kvm", os.O_RDWR, 0)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
+
+// detectAccelerator returns AccelKVM if KVM is available, and AccelTCG otherwise.
+func detectAccelerator() string {
+	if KVMAvailable() {
+		return AccelKVM
+	}
+	return AccelTCG
+}
+
+// kvmNestedParameters are the module parameters that enable nested
+// virtualization for Intel and AMD hosts, this is a variable so it can be
+// overwritten in tests.
+var kvmNestedParameters = []string{
+	"/sys/module/kvm_intel/parameters/nested",
+	"/sys/module/kvm_amd/parameters/nested",
+}
+
+// NestedVirtualizationAvailable returns true, if the KVM module on the host has
+// nested virtualization enabled, this is done by loading 'kvm_intel' or
+// 'kvm_amd' with 'nested=1'.
+func NestedVirtualizationAvailable() bool {
+	for _, file := range kvmNestedParameters {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		value := strings.TrimSpace(string(data))
+		if value == "Y" || value == "1" {
+			return true
+		}
+	}
+	return false
+}
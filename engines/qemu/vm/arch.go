@@ -0,0 +1,58 @@
+package vm
+
+import (
+	rt "runtime"
+	"strings"
+)
+
+// Architectures supported for virtual machines, the QEMU binary used is
+// 'qemu-system-<architecture>'.
+const (
+	archX86_64  = "x86_64"
+	archAArch64 = "aarch64"
+)
+
+// HostArchitecture returns the architecture of the host, as named by QEMU.
+func HostArchitecture() string {
+	switch rt.GOARCH {
+	case "amd64":
+		return archX86_64
+	case "arm64":
+		return archAArch64
+	default:
+		return rt.GOARCH
+	}
+}
+
+// PCI slots are assigned statically, such that devices keep their address when
+// resuming from snapshot:
+//
+//   0x2        graphics
+//   0x3        USB controller
+//   0x4        balloon
+//   0x5        network
+//   0x6        sound
+//   0x7        SCSI controller for CD drives on aarch64
+//   0x8        boot disk, or virtio-scsi controller for all disks
+//   0x9 - 0xe  scratch disks
+//   0xf        RNG
+//   0x10-0x1a  shared folders and disk volumes
+//   0x1b       watchdog
+//   0x1c-0x1f  passthrough devices, or root ports for passthrough devices in
+//              functions of 0x1c on q35 and virt
+//
+// On q35 0x1f is the LPC, AHCI and SMBus controllers built into the chipset,
+// and CD drives are attached to the AHCI controller.
+
+// pciBus returns the name of the root PCI bus for the given chipset.
+func pciBus(chipset string) string {
+	if strings.HasPrefix(chipset, "pc-i440fx") {
+		return "pci.0"
+	}
+	return "pcie.0" // q35 and virt are PCI express only
+}
+
+// isPCIExpress returns true, if the chipset has a PCI express root complex.
+func isPCIExpress(chipset string) bool {
+	return pciBus(chipset) == "pcie.0"
+}
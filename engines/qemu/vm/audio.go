@@ -0,0 +1,63 @@
+package vm
+
+import (
+	"os"
+	"strings"
+
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+// audioBackendID is the id of the audio backend used for audio recordings
+const audioBackendID = "audio-0"
+
+// RecordAudio writes the output of the sound device to file as WAV, using the
+// 'wav' audio backend of QEMU. QEMU only writes the sizes in the WAV header
+// when it terminates, until then the sizes in the header are zero.
+//
+// Returns a MalformedPayloadError if the machine doesn't have a sound device.
+// This must be called before Start().
+func (vm *VirtualMachine) RecordAudio(file string) error {
+	vm.m.Lock()
+	defer vm.m.Unlock()
+	if vm.started {
+		panic("RecordAudio() cannot be called after Start()")
+	}
+
+	o := vm.machine.options
+	if o.Sound == "none" {
+		return runtime.NewMalformedPayloadError(
+			"Audio cannot be recorded from a machine without a sound device, ",
+			"the machine must specify 'sound'",
+		)
+	}
+
+	// Before QEMU 4.2 the audio backend is configured by environment variables
+	if !vm.qemuInfo.Supports(FeatureAudiodev) {
+		vm.qemu.Env = append(os.Environ(), "QEMU_AUDIO_DRV=wav", "QEMU_WAV_PATH="+file)
+		return nil
+	}
+
+	// The backend is set on the device producing audio, for 'intel-hda' and
+	// 'ich9-intel-hda' that's the codec rather than the controller
+	id := "sound-0"
+	if strings.Contains(o.Sound, "/") {
+		id = "sound-0-device-0"
+	}
+	for i := 1; i < len(vm.qemu.Args); i++ {
+		if vm.qemu.Args[i-1] == "-device" && hasDeviceID(vm.qemu.Args[i], id) {
+			vm.qemu.Args[i] += ",audiodev=" + audioBackendID
+		}
+	}
+	vm.qemu.Args = append(vm.qemu.Args, "-audiodev", "wav,id="+audioBackendID+",path="+file)
+	return nil
+}
+
+// hasDeviceID returns true, if the value of a -device option has the given id
+func hasDeviceID(device, id string) bool {
+	for _, arg := range strings.Split(device, ",") {
+		if arg == "id="+id {
+			return true
+		}
+	}
+	return false
+}
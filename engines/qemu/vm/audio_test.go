@@ -0,0 +1,48 @@
+package vm
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecordAudio(t *testing.T) {
+	m := defaultMachine
+	m.options.Sound = "hda-output/intel-hda"
+	vm := &VirtualMachine{
+		machine:  m,
+		qemuInfo: &QEMUInfo{version: qemuVersion{5, 2}},
+		qemu: exec.Command("qemu-system-x86_64",
+			"-device", "hda-output,bus=sound-0.0,cad=0,id=sound-0-device-0",
+			"-device", "intel-hda,addr=0x6,bus=pci.0,id=sound-0",
+		),
+	}
+	require.NoError(t, vm.RecordAudio("/tmp/audio.wav"))
+	assert.Contains(t, vm.qemu.Args, "hda-output,bus=sound-0.0,cad=0,id=sound-0-device-0,audiodev=audio-0")
+	assert.Contains(t, vm.qemu.Args, "intel-hda,addr=0x6,bus=pci.0,id=sound-0")
+	assert.Contains(t, vm.qemu.Args, "wav,id=audio-0,path=/tmp/audio.wav")
+}
+
+func TestRecordAudioLegacy(t *testing.T) {
+	m := defaultMachine
+	m.options.Sound = "AC97"
+	vm := &VirtualMachine{
+		machine:  m,
+		qemuInfo: &QEMUInfo{version: qemuVersion{2, 11}},
+		qemu:     exec.Command("qemu-system-x86_64"),
+	}
+	require.NoError(t, vm.RecordAudio("/tmp/audio.wav"))
+	assert.Contains(t, vm.qemu.Env, "QEMU_AUDIO_DRV=wav")
+	assert.Contains(t, vm.qemu.Env, "QEMU_WAV_PATH=/tmp/audio.wav")
+}
+
+func TestRecordAudioWithoutSound(t *testing.T) {
+	vm := &VirtualMachine{
+		machine:  defaultMachine,
+		qemuInfo: &QEMUInfo{version: qemuVersion{5, 2}},
+		qemu:     exec.Command("qemu-system-x86_64"),
+	}
+	assert.Error(t, vm.RecordAudio("/tmp/audio.wav"))
+}
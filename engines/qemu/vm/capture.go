@@ -0,0 +1,35 @@
+package vm
+
+import "strconv"
+
+// captureFilterID is the id of the network filter capturing packets
+const captureFilterID = "capture-0"
+
+// CaptureNetwork writes the packets sent and received by the virtual machine
+// to file in pcap format, using the 'filter-dump' network filter of QEMU.
+// Packets are truncated to snapLen bytes. The capture continues until
+// StopNetworkCapture() is called or QEMU terminates.
+//
+// This must be called before Start().
+func (vm *VirtualMachine) CaptureNetwork(file string, snapLen int) {
+	vm.m.Lock()
+	defer vm.m.Unlock()
+	if vm.started {
+		panic("CaptureNetwork() cannot be called after Start()")
+	}
+
+	vm.qemu.Args = append(vm.qemu.Args, "-object", "filter-dump,id="+captureFilterID+
+		",netdev=netdev-0,file="+file+",maxlen="+strconv.Itoa(snapLen))
+}
+
+// StopNetworkCapture stops the capture started by CaptureNetwork(), such that
+// QEMU closes the file. This has no effect if QEMU has terminated.
+func (vm *VirtualMachine) StopNetworkCapture() error {
+	_, err := vm.runQMP("object-del", map[string]interface{}{
+		"id": captureFilterID,
+	})
+	if err == errQMPNotConnected {
+		return nil
+	}
+	return err
+}
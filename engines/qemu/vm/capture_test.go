@@ -0,0 +1,20 @@
+package vm
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCaptureNetwork(t *testing.T) {
+	vm := &VirtualMachine{
+		machine: defaultMachine,
+		qemu:    exec.Command("qemu-system-x86_64"),
+	}
+	vm.CaptureNetwork("/tmp/capture.pcap", 1500)
+	assert.Equal(t, []string{
+		"qemu-system-x86_64",
+		"-object", "filter-dump,id=capture-0,netdev=netdev-0,file=/tmp/capture.pcap,maxlen=1500",
+	}, vm.qemu.Args)
+}
@@ -0,0 +1,115 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"strings"
+
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+// cpuInfoFile is read to find CPU flags supported by the host, this is a
+// variable so it can be overwritten in tests.
+var cpuInfoFile = "/proc/cpuinfo"
+
+// cpuFlagAliases maps QEMU CPU flag names to the names used in /proc/cpuinfo,
+// where these differ beyond '-' vs '_'.
+var cpuFlagAliases = map[string]string{
+	"sse3":     "pni",
+	"pclmuldq": "pclmulqdq",
+	"sse4.1":   "sse4_1",
+	"sse4.2":   "sse4_2",
+}
+
+// parseCPUInfoFlags returns the set of CPU flags from /proc/cpuinfo, the flags
+// of the first processor are used as all processors are expected to match.
+func parseCPUInfoFlags(data []byte) map[string]bool {
+	flags := make(map[string]bool)
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		parts := strings.SplitN(s.Text(), ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) != "flags" {
+			continue
+		}
+		for _, flag := range strings.Fields(parts[1]) {
+			flags[flag] = true
+		}
+		break
+	}
+	return flags
+}
+
+// cpuOption returns the value for the -cpu option. Named CPU models are given
+// 'enforce', such that QEMU fails rather than silently dropping features the
+// host doesn't support, as the point of pinning a model is a deterministic
+// instruction set.
+func cpuOption(model string, flags []string) string {
+	options := append([]string{model}, flags...)
+	if model != "host" && model != "max" {
+		options = append(options, "enforce")
+	}
+	return strings.Join(options, ",")
+}
+
+// validateCPU returns a MalformedPayloadError if the CPU model isn't supported
+// by QEMU, or if a flag is enabled that the host CPU doesn't support.
+func validateCPU(model string, flags []string, info *QEMUInfo, accelerator string) error {
+	if !info.SupportsCPU(model) {
+		return runtime.NewMalformedPayloadError(
+			"Machine CPU '", model, "' isn't supported by QEMU ", info.Version,
+		)
+	}
+
+	// We can only check host flags for x86_64 with KVM, TCG emulates the flags
+	// it supports regardless of the host.
+	if accelerator != AccelKVM || HostArchitecture() != archX86_64 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(cpuInfoFile)
+	if err != nil {
+		return nil // QEMU will fail, if the flags aren't supported
+	}
+	host := parseCPUInfoFlags(data)
+	for _, flag := range flags {
+		if !strings.HasPrefix(flag, "+") {
+			continue
+		}
+		name := strings.TrimPrefix(flag, "+")
+		if alias, ok := cpuFlagAliases[name]; ok {
+			name = alias
+		}
+		if !host[name] && !host[strings.Replace(name, "-", "_", -1)] {
+			return runtime.NewMalformedPayloadError(
+				"Machine CPU flag '", flag, "' isn't supported by the host CPU",
+			)
+		}
+	}
+	return nil
+}
+
+// WithNestedVirtualization returns a copy of the machine with the CPU flag for
+// hardware virtualization of the host CPU enabled, '+vmx' on Intel and '+svm'
+// on AMD, such that the guest can run virtual machines with KVM. Flags that
+// explicitly disable virtualization in the machine are respected.
+func (m Machine) WithNestedVirtualization() Machine {
+	data, err := ioutil.ReadFile(cpuInfoFile)
+	if err != nil {
+		return m
+	}
+	host := parseCPUInfoFlags(data)
+	for _, flag := range []string{"vmx", "svm"} {
+		if !host[flag] {
+			continue
+		}
+		for _, f := range m.options.Flags {
+			if f == "+"+flag || f == "-"+flag {
+				return m
+			}
+		}
+		o := m.options
+		o.Flags = append(append([]string{}, o.Flags...), "+"+flag)
+		return Machine{options: o}
+	}
+	return m
+}
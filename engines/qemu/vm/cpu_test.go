@@ -0,0 +1,42 @@
+package vm
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCPUOption(t *testing.T) {
+	assert.Equal(t, "host,+vmx", cpuOption("host", []string{"+vmx"}))
+	assert.Equal(t, "Haswell-noTSX,-avx2,enforce", cpuOption("Haswell-noTSX", []string{"-avx2"}))
+
+	flags := parseCPUInfoFlags([]byte("processor\t: 0\nflags\t\t: fpu pni avx2 sse4_1\n\nprocessor\t: 1\n"))
+	assert.Equal(t, map[string]bool{"fpu": true, "pni": true, "avx2": true, "sse4_1": true}, flags)
+}
+
+func TestWithNestedVirtualization(t *testing.T) {
+	f, err := ioutil.TempFile("", "cpuinfo")
+	require.NoError(t, err)
+	defer os.Remove(f.Name())
+	_, err = f.WriteString("processor\t: 0\nflags\t\t: fpu svm avx2\n")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	defer func(file string) { cpuInfoFile = file }(cpuInfoFile)
+	cpuInfoFile = f.Name()
+
+	m := NewMachine(map[string]interface{}{
+		"version": float64(1),
+		"flags":   []interface{}{"+avx2"},
+	}).WithNestedVirtualization()
+	assert.Equal(t, []string{"+avx2", "+svm"}, m.options.Flags)
+
+	m = NewMachine(map[string]interface{}{
+		"version": float64(1),
+		"flags":   []interface{}{"-svm"},
+	}).WithNestedVirtualization()
+	assert.Equal(t, []string{"-svm"}, m.options.Flags)
+}
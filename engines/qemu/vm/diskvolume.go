@@ -0,0 +1,81 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+// AddDiskVolume attaches a qcow2 disk file to the virtual machine as a
+// virtio-blk or virtio-scsi disk with the given tag as serial number. The guest
+// can find the disk using the tag, on Linux the device is:
+//
+//   /dev/disk/by-id/virtio-<tag>
+//   /dev/disk/by-id/scsi-0QEMU_QEMU_HARDDISK_<tag>
+//
+// Disk volumes share PCI slots with shared folders, so the combined number of
+// volumes is limited. For machines resuming from snapshot the disk is attached
+// with QMP before execution is started, on PCI express chipsets this requires
+// storage 'virtio-scsi-pci', as the root complex doesn't support hot-plug.
+// This must be called before Start().
+func (vm *VirtualMachine) AddDiskVolume(tag, file string, readOnly bool) error {
+	vm.m.Lock()
+	defer vm.m.Unlock()
+	if vm.started {
+		panic("AddDiskVolume() cannot be called after Start()")
+	}
+	// virtio-blk serial numbers are limited to 20 characters
+	if !sharedFolderTagPattern.MatchString(tag) || len(tag) > 20 {
+		panic(fmt.Sprintf("disk volume tag '%s' is not valid", tag))
+	}
+
+	o := vm.machine.options
+	if vm.volumes >= maxVolumes {
+		return runtime.NewMalformedPayloadError(
+			"Virtual machines cannot have more than ", maxVolumes, " volumes",
+		)
+	}
+
+	id := fmt.Sprintf("disk-volume-%d", vm.volumes)
+
+	// Machines resuming from snapshot must start with the hardware the snapshot
+	// was taken with, so we hot-plug the disk before execution is started
+	if o.Snapshot != "" {
+		if isPCIExpress(o.Chipset) && o.Storage != storageSCSI {
+			return runtime.NewMalformedPayloadError(
+				"Disk volumes can only be used with machines resuming from snapshot on chipset ",
+				"'", o.Chipset, "', if storage is '", storageSCSI, "'",
+			)
+		}
+		device := hotplugDiskDevice(o.Storage, o.Chipset, id, 0x10+vm.volumes) // volumes on PCI 0x10 and up
+		device["serial"] = tag
+		vm.hotplug = append(vm.hotplug, hotplugDisk{
+			id:       id,
+			file:     file,
+			format:   "qcow2",
+			readOnly: readOnly,
+			device:   device,
+		})
+		vm.volumes++
+		return nil
+	}
+
+	drive := fmt.Sprintf(
+		"file=%s,if=none,id=%s,cache=writeback,aio=threads,format=qcow2,werror=report,rerror=report",
+		strings.Replace(file, ",", ",,", -1), id, // QEMU escapes commas as ',,'
+	)
+	if readOnly {
+		drive += ",readonly=on"
+	}
+	drive += driveDiscard(o.Storage) + vm.throttling.optionSuffix()
+	vm.qemu.Args = append(vm.qemu.Args,
+		"-drive", drive,
+		"-device", fmt.Sprintf(
+			"%s,serial=%s",
+			diskDevice(o.Storage, o.Chipset, id, 0x10+vm.volumes), tag, // volumes on PCI 0x10 and up
+		),
+	)
+	vm.volumes++
+	return nil
+}
@@ -0,0 +1,67 @@
+package vm
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/digitalocean/go-qemu"
+)
+
+// Event is an event emitted by QEMU on the QMP monitor, such as RESET or
+// GUEST_PANICKED, see QMP documentation for event names and data.
+type Event struct {
+	Name      string
+	Data      map[string]interface{}
+	Timestamp time.Time
+}
+
+// SetEventHandler sets a function to be called for each QMP event emitted by
+// QEMU. Events are delivered in order from a single go-routine, so handler
+// shouldn't block. A SHUTDOWN event is always delivered before the virtual
+// machine is done. This must be called before Start().
+func (vm *VirtualMachine) SetEventHandler(handler func(Event)) {
+	vm.m.Lock()
+	defer vm.m.Unlock()
+	if vm.started {
+		panic("SetEventHandler() cannot be called after Start()")
+	}
+	vm.eventHandler = handler
+}
+
+// watchEvents forwards QMP events from domain to the event handler, if any,
+// until QEMU terminates.
+//
+// QEMU runs with -no-shutdown, such that it stops rather than exits when the
+// guest shuts down. This way the SHUTDOWN event is always delivered before
+// QEMU terminates, and we quit QEMU once the event has been handled.
+func (vm *VirtualMachine) watchEvents(domain *qemu.Domain) {
+	// We don't signal the done channel, the event broadcast stops when the
+	// domain is closed, which happens when QEMU terminates.
+	events, _, err := domain.Events()
+	if err != nil {
+		// Without events QEMU wouldn't terminate when the guest shuts down
+		vm.monitor.ReportError(err, "failed to subscribe to QMP events")
+		vm.abort(fmt.Errorf("Failed to subscribe to QMP events, error: %s", err))
+		return
+	}
+
+	for {
+		select {
+		case e := <-events:
+			debug("QMP event: %s", e.Event)
+			if vm.eventHandler != nil {
+				vm.eventHandler(Event{
+					Name:      e.Event,
+					Data:      e.Data,
+					Timestamp: time.Unix(e.Timestamp.Seconds, e.Timestamp.Microseconds*1000),
+				})
+			}
+			// QMP commands can't complete while we're blocking the event stream
+			if e.Event == "SHUTDOWN" {
+				go vm.Quit()
+			}
+		case <-vm.Done:
+			return
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package vm
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Firmware types for virtual machines
+const (
+	firmwareBIOS           = "bios"
+	firmwareUEFI           = "uefi"
+	firmwareUEFISecureBoot = "uefi-secure-boot"
+)
+
+// firmwareFiles is a pair of UEFI firmware code and variable template files.
+type firmwareFiles struct {
+	Code string // Read-only firmware code
+	Vars string // Template for the UEFI variables (NVRAM)
+}
+
+// firmwareCandidates lists the UEFI firmware files installed by common
+// distributions for each architecture and firmware type, in order of
+// preference.
+var firmwareCandidates = map[string][]firmwareFiles{
+	archX86_64 + "/" + firmwareUEFI: {
+		{"/usr/share/OVMF/OVMF_CODE.fd", "/usr/share/OVMF/OVMF_VARS.fd"},
+		{"/usr/share/edk2/ovmf/OVMF_CODE.fd", "/usr/share/edk2/ovmf/OVMF_VARS.fd"},
+	},
+	archX86_64 + "/" + firmwareUEFISecureBoot: {
+		{"/usr/share/OVMF/OVMF_CODE.secboot.fd", "/usr/share/OVMF/OVMF_VARS.ms.fd"},
+		{"/usr/share/edk2/ovmf/OVMF_CODE.secboot.fd", "/usr/share/edk2/ovmf/OVMF_VARS.secboot.fd"},
+	},
+	archAArch64 + "/" + firmwareUEFI: {
+		{"/usr/share/AAVMF/AAVMF_CODE.fd", "/usr/share/AAVMF/AAVMF_VARS.fd"},
+		{"/usr/share/edk2/aarch64/QEMU_EFI-pflash.raw", "/usr/share/edk2/aarch64/vars-template-pflash.raw"},
+	},
+}
+
+// locateFirmware returns the UEFI firmware files for the given architecture
+// and firmware type, or an error if they are not installed.
+func locateFirmware(architecture, firmware string) (firmwareFiles, error) {
+	candidates := firmwareCandidates[architecture+"/"+firmware]
+	for _, c := range candidates {
+		if isFile(c.Code) && isFile(c.Vars) {
+			return c, nil
+		}
+	}
+	paths := []string{}
+	for _, c := range candidates {
+		paths = append(paths, c.Code)
+	}
+	return firmwareFiles{}, fmt.Errorf(
+		"unable to find firmware '%s' for architecture '%s', looked for: %s",
+		firmware, architecture, strings.Join(paths, ", "),
+	)
+}
+
+// initializeNVRAM copies the variable template to nvramFile, unless nvramFile
+// already exists.
+func initializeNVRAM(nvramFile, template string) error {
+	if _, err := os.Stat(nvramFile); err == nil {
+		return nil
+	}
+
+	src, err := os.Open(template)
+	if err != nil {
+		return fmt.Errorf("failed to open UEFI variables template, error: %s", err)
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(nvramFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create UEFI variables file, error: %s", err)
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		os.Remove(nvramFile)
+		return fmt.Errorf("failed to copy UEFI variables template, error: %s", err)
+	}
+	if err = dst.Close(); err != nil {
+		os.Remove(nvramFile)
+		return fmt.Errorf("failed to write UEFI variables file, error: %s", err)
+	}
+	return nil
+}
+
+func isFile(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && info.Mode().IsRegular()
+}
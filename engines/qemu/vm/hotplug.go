@@ -0,0 +1,85 @@
+package vm
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// hotplugDisk is a disk attached with QMP after QEMU has started, but before
+// execution is started, as machines resuming from snapshot must be started
+// with the exact hardware the snapshot was taken with.
+type hotplugDisk struct {
+	id       string // node-name of the block device
+	file     string
+	format   string
+	readOnly bool
+	device   map[string]interface{} // arguments for device_add
+}
+
+// blockdevAdd adds a block device backed by file with QMP blockdev-add.
+func (vm *VirtualMachine) blockdevAdd(id, file, format string, readOnly bool) error {
+	args := map[string]interface{}{
+		"driver":    format,
+		"node-name": id,
+		"read-only": readOnly,
+		"file": map[string]interface{}{
+			"driver":   "file",
+			"filename": file,
+		},
+	}
+	if driveDiscard(vm.machine.options.Storage) != "" {
+		args["discard"] = "unmap"
+	}
+	_, err := vm.runQMP("blockdev-add", args)
+	return err
+}
+
+// deviceAdd adds a device with QMP device_add, args must contain 'driver'.
+func (vm *VirtualMachine) deviceAdd(args map[string]interface{}) error {
+	_, err := vm.runQMP("device_add", args)
+	return err
+}
+
+// hotplugDiskDevice returns the arguments for device_add attaching the block
+// device id with the given storage device, see diskDevice().
+func hotplugDiskDevice(storage, chipset, id string, slot int) map[string]interface{} {
+	if storage == storageSCSI {
+		return map[string]interface{}{
+			"driver":  "scsi-hd",
+			"bus":     scsiDiskController + ".0",
+			"scsi-id": strconv.Itoa(slot - 0x8),
+			"lun":     "0",
+			"drive":   id,
+			"id":      id + "-device",
+		}
+	}
+	return map[string]interface{}{
+		"driver": "virtio-blk-pci",
+		"bus":    pciBus(chipset),
+		"addr":   fmt.Sprintf("0x%x", slot),
+		"drive":  id,
+		"id":     id + "-device",
+	}
+}
+
+// hotplugDisks attaches the disks added while resuming from snapshot, this
+// must be called after the QMP monitor is connected, before execution starts.
+func (vm *VirtualMachine) hotplugDisks() error {
+	for _, disk := range vm.hotplug {
+		debug("hot-plugging disk: %s", disk.id)
+		if err := vm.blockdevAdd(disk.id, disk.file, disk.format, disk.readOnly); err != nil {
+			return errors.Wrapf(err, "failed to add block device for %s", disk.id)
+		}
+		if err := vm.deviceAdd(disk.device); err != nil {
+			return errors.Wrapf(err, "failed to add device for %s", disk.id)
+		}
+		if args := vm.throttling.qmpArgs(disk.device["id"].(string)); args != nil {
+			if _, err := vm.runQMP("block_set_io_throttle", args); err != nil {
+				return errors.Wrapf(err, "failed to set I/O limits for %s", disk.id)
+			}
+		}
+	}
+	return nil
+}
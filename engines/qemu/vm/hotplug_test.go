@@ -0,0 +1,41 @@
+package vm
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHotplugDiskVolume(t *testing.T) {
+	vm := &VirtualMachine{
+		machine: defaultMachine.WithSnapshot("booted"),
+		qemu:    exec.Command("qemu-system-x86_64"),
+	}
+	require.NoError(t, vm.AddDiskVolume("cache0", "/tmp/cache0.qcow2", false))
+	assert.Equal(t, []string{"qemu-system-x86_64"}, vm.qemu.Args, "expected disk to be hot-plugged")
+	require.Len(t, vm.hotplug, 1)
+	assert.Equal(t, map[string]interface{}{
+		"driver": "virtio-blk-pci",
+		"bus":    "pci.0",
+		"addr":   "0x10",
+		"drive":  "disk-volume-0",
+		"id":     "disk-volume-0-device",
+		"serial": "cache0",
+	}, vm.hotplug[0].device)
+
+	// PCI express root complex doesn't support hot-plug
+	q35 := defaultMachine.WithSnapshot("booted")
+	q35.options.Chipset = "pc-q35-2.8"
+	vm = &VirtualMachine{
+		machine: q35,
+		qemu:    exec.Command("qemu-system-x86_64"),
+	}
+	assert.Error(t, vm.AddDiskVolume("cache0", "/tmp/cache0.qcow2", false))
+	q35.options.Storage = storageSCSI
+	vm.machine = q35
+	require.NoError(t, vm.AddDiskVolume("cache0", "/tmp/cache0.qcow2", false))
+	assert.Equal(t, "scsi-hd", vm.hotplug[0].device["driver"])
+	assert.Equal(t, "8", vm.hotplug[0].device["scsi-id"])
+}
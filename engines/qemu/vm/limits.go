@@ -7,9 +7,10 @@ import (
 
 // MachineLimits imposes limits on a virtual machine definition.
 type MachineLimits struct {
-	MaxMemory      int `json:"maxMemory"`
-	MaxCPUs        int `json:"maxCPUs"`
-	DefaultThreads int `json:"defaultThreads"`
+	MaxMemory      int            `json:"maxMemory"`
+	MaxCPUs        int            `json:"maxCPUs"`
+	DefaultThreads int            `json:"defaultThreads"`
+	DiskThrottling DiskThrottling `json:"diskThrottling"`
 }
 
 // MachineLimitsSchema is the schema for MachineOptions.
@@ -57,6 +58,7 @@ var MachineLimitsSchema = schematypes.Object{
 			Minimum: 1,
 			Maximum: 255,
 		},
+		"diskThrottling": DiskThrottlingSchema,
 	},
 	Required: []string{
 		"maxMemory",
@@ -0,0 +1,273 @@
+package vm
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/runtime/util"
+)
+
+// migrationSocketFile is the socket through which QEMU sends or receives the
+// state of the virtual machine, when live migrating to or from another host.
+const migrationSocketFile = "migration.sock"
+
+// migrationPollInterval is the interval at which the status of a live
+// migration is polled with QMP.
+const migrationPollInterval = 500 * time.Millisecond
+
+// migrationAcceptTimeout is the time to wait for QEMU to connect to the
+// migration socket, after the QMP migrate command was issued.
+const migrationAcceptTimeout = 30 * time.Second
+
+// linkDownDuration is the time the network link is taken down, when resuming
+// a virtual machine migrated from another host.
+const linkDownDuration = 2 * time.Second
+
+// CanMigrate returns an error explaining why the virtual machine can't be
+// migrated to another host, or nil if it can be migrated.
+func (vm *VirtualMachine) CanMigrate() error {
+	vm.m.Lock()
+	defer vm.m.Unlock()
+
+	o := vm.machine.options
+	switch {
+	case vm.passthrough > 0:
+		return errors.New("virtual machines with host devices passed through can't be migrated")
+	case vm.usbDevices > 0:
+		return errors.New("virtual machines with host USB devices can't be migrated")
+	case vm.volumes > 0:
+		return errors.New("virtual machines with volumes attached can't be migrated")
+	case o.TPM != "none":
+		return errors.New("virtual machines with a TPM can't be migrated")
+	case o.Snapshot != "":
+		return errors.New("virtual machines resuming from snapshot can't be migrated")
+	}
+	return nil
+}
+
+// EnableIncomingMigration makes QEMU wait for the state of the virtual machine
+// to be received from another host, instead of booting the guest, see
+// ReceiveMigration(). The virtual machine must be created with the exact same
+// machine definition, image and disks as on the source host.
+//
+// This must be called before Start().
+func (vm *VirtualMachine) EnableIncomingMigration() {
+	vm.m.Lock()
+	defer vm.m.Unlock()
+	if vm.started {
+		panic("EnableIncomingMigration() cannot be called after Start()")
+	}
+	vm.incoming = true
+
+	vm.qemu.Args = append(vm.qemu.Args, "-incoming", "defer")
+}
+
+// Migrate sends the state of the running virtual machine, including memory and
+// disks, to stream. This blocks until the migration has completed, after which
+// the virtual machine is paused, and must either be resumed with Resume(), if
+// the target host failed to load the stream, or stopped with Quit().
+//
+// If an error is returned, execution continues on this host.
+func (vm *VirtualMachine) Migrate(stream io.Writer) error {
+	if err := vm.CanMigrate(); err != nil {
+		return err
+	}
+
+	vm.m.Lock()
+	socketFolder := vm.socketFolder
+	vm.m.Unlock()
+	if socketFolder == "" {
+		return errQMPNotConnected
+	}
+
+	// Let QEMU throttle the guest CPUs, if memory is dirtied faster than it can
+	// be sent, otherwise busy guests may never finish migrating
+	_, err := vm.runQMP("migrate-set-capabilities", map[string]interface{}{
+		"capabilities": []interface{}{
+			map[string]interface{}{"capability": "auto-converge", "state": true},
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// QEMU connects to a socket we listen on, so we can forward the stream
+	socket := filepath.Join(socketFolder, migrationSocketFile)
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		return errors.Wrap(err, "failed to listen on migration socket")
+	}
+	defer os.Remove(socket)
+	defer listener.Close()
+	_ = listener.(*net.UnixListener).SetDeadline(time.Now().Add(migrationAcceptTimeout))
+
+	// Migrate disks too, as they aren't on shared storage. With 'inc' only
+	// blocks not in the backing image are sent, as the target has the image.
+	_, err = vm.runQMP("migrate", map[string]interface{}{
+		"uri": "unix:" + socket,
+		"blk": true,
+		"inc": true,
+	})
+	if err != nil {
+		return err
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		_, _ = vm.runQMP("migrate_cancel", nil)
+		return errors.Wrap(err, "QEMU didn't connect to migration socket")
+	}
+
+	// Copy the stream, closing the connection fails the migration if we can't
+	// write to the stream
+	copied := make(chan error, 1)
+	go func() {
+		_, cerr := io.Copy(stream, conn)
+		conn.Close()
+		copied <- cerr
+	}()
+
+	status, err := vm.waitForMigration("query-migrate", "setup", "active", "pre-switchover", "device")
+	if cerr := <-copied; err == nil && cerr != nil {
+		err = errors.Wrap(cerr, "failed to write migration stream")
+	}
+	if err == nil && status != "completed" {
+		err = fmt.Errorf("migration ended with status '%s'", status)
+	}
+	if err != nil {
+		_, _ = vm.runQMP("migrate_cancel", nil)
+		return err
+	}
+	return nil
+}
+
+// ReceiveMigration loads the state of the virtual machine from stream, as
+// written by Migrate() on the source host. This requires that
+// EnableIncomingMigration() was called before Start().
+//
+// The virtual machine remains paused until ResumeMigration() is called. If
+// loading fails QEMU terminates and an error is returned.
+func (vm *VirtualMachine) ReceiveMigration(stream io.Reader) error {
+	vm.m.Lock()
+	socketFolder := vm.socketFolder
+	incoming := vm.incoming
+	vm.m.Unlock()
+	if !incoming {
+		panic("ReceiveMigration() requires EnableIncomingMigration() to be called before Start()")
+	}
+	if socketFolder == "" {
+		return errQMPNotConnected
+	}
+
+	// QEMU listens on the socket, when migrate-incoming returns
+	socket := filepath.Join(socketFolder, migrationSocketFile)
+	_, err := vm.runQMP("migrate-incoming", map[string]interface{}{
+		"uri": "unix:" + socket,
+	})
+	if err != nil {
+		return err
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return errors.Wrap(err, "failed to connect to migration socket")
+	}
+	_, err = io.Copy(conn, stream)
+	if err == nil {
+		err = conn.(*net.UnixConn).CloseWrite()
+	}
+	if err != nil {
+		conn.Close()
+		return errors.Wrap(err, "failed to read migration stream")
+	}
+	defer conn.Close()
+
+	// QEMU terminates, if loading fails, otherwise it leaves the 'inmigrate'
+	// state, and stays paused as it was started with -S
+	status, err := vm.waitForMigration("query-status", "inmigrate")
+	if err != nil {
+		return err
+	}
+	if status != "paused" && status != "prelaunch" {
+		return fmt.Errorf("virtual machine has status '%s' after receiving migration", status)
+	}
+	return nil
+}
+
+// ResumeMigration starts execution of a virtual machine received with
+// ReceiveMigration(). The network link is taken down and up, such that the
+// guest renews its network configuration, as the network on this host may use
+// another subnet than on the source host.
+func (vm *VirtualMachine) ResumeMigration() error {
+	if _, err := vm.runQMP("cont", nil); err != nil {
+		return err
+	}
+	if _, err := vm.runQMP("set_link", map[string]interface{}{"name": "nic0", "up": false}); err != nil {
+		return err
+	}
+	select {
+	case <-time.After(linkDownDuration):
+	case <-vm.Done:
+		return errQMPNotConnected
+	}
+	_, err := vm.runQMP("set_link", map[string]interface{}{"name": "nic0", "up": true})
+	return err
+}
+
+// Resume execution of the virtual machine, after Migrate() completed, but the
+// target host failed to resume it.
+func (vm *VirtualMachine) Resume() error {
+	_, err := vm.runQMP("cont", nil)
+	return err
+}
+
+// waitForMigration polls the QMP command until the status isn't one of the
+// pending statuses, and returns the status. If QEMU terminates an error is
+// returned, this is how QEMU reports that an incoming migration failed.
+func (vm *VirtualMachine) waitForMigration(command string, pending ...string) (string, error) {
+	statuses := util.StringList(pending)
+	for {
+		result, err := vm.runQMP(command, nil)
+		if err != nil {
+			return "", err
+		}
+		status, err := parseMigrationStatus(result)
+		if err != nil {
+			return "", err
+		}
+		if !statuses.Contains(status) {
+			return status, nil
+		}
+		select {
+		case <-time.After(migrationPollInterval):
+		case <-vm.Done:
+			return "", errors.New("QEMU terminated while migrating the virtual machine")
+		}
+	}
+}
+
+// parseMigrationStatus parses the status from the response to query-migrate or
+// query-status, if the status is 'failed' the error description is returned.
+func parseMigrationStatus(result []byte) (string, error) {
+	var response struct {
+		Return struct {
+			Status    string `json:"status"`
+			ErrorDesc string `json:"error-desc"`
+		} `json:"return"`
+	}
+	if err := json.Unmarshal(result, &response); err != nil {
+		return "", fmt.Errorf("failed to parse migration status, error: %s", err)
+	}
+	if response.Return.Status == "failed" {
+		desc := response.Return.ErrorDesc
+		if desc == "" {
+			desc = "unknown error"
+		}
+		return "", fmt.Errorf("migration failed, error: %s", desc)
+	}
+	return response.Return.Status, nil
+}
@@ -0,0 +1,29 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseMigrationStatus(t *testing.T) {
+	status, err := parseMigrationStatus([]byte(`{"return": {"status": "active", "total-time": 1200}}`))
+	require.NoError(t, err)
+	assert.Equal(t, "active", status)
+
+	// query-status has the same format
+	status, err = parseMigrationStatus([]byte(`{"return": {"status": "paused", "running": false}}`))
+	require.NoError(t, err)
+	assert.Equal(t, "paused", status)
+
+	_, err = parseMigrationStatus([]byte(`{"return": {"status": "failed", "error-desc": "Connection reset"}}`))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Connection reset")
+
+	_, err = parseMigrationStatus([]byte(`{"return": {"status": "failed"}}`))
+	assert.Error(t, err)
+
+	_, err = parseMigrationStatus([]byte(`{"return":`))
+	assert.Error(t, err)
+}
@@ -5,14 +5,16 @@ import (
 	"fmt"
 	"reflect"
 	rt "runtime"
+	"strings"
+	"time"
 
 	schematypes "github.com/taskcluster/go-schematypes"
 	"github.com/taskcluster/taskcluster-worker/runtime"
 	"github.com/taskcluster/taskcluster-worker/runtime/util"
 )
 
-// version number of the machine.json format
-const machineFormatVersion = 1
+// version number of the machine.json format, see MigrateMachineDefinition()
+const machineFormatVersion = 2
 
 // Machine specifies arguments for various QEMU options.
 //
@@ -24,8 +26,10 @@ const machineFormatVersion = 1
 type Machine struct {
 	options struct {
 		Version        int      `json:"version"` // see machineFormatVersion
+		Architecture   string   `json:"architecture"`
 		UUID           string   `json:"uuid"`
 		Chipset        string   `json:"chipset"`
+		Firmware       string   `json:"firmware"`
 		CPU            string   `json:"cpu"`
 		Flags          []string `json:"flags"`
 		Threads        int      `json:"threads"`
@@ -37,41 +41,98 @@ type Machine struct {
 		MAC            string   `json:"mac"`
 		Storage        string   `json:"storage"`
 		Graphics       string   `json:"graphics"`
+		GraphicsMemory int      `json:"graphicsMemory"`
+		Display        string   `json:"display"`
 		Sound          string   `json:"sound"`
 		Keyboard       string   `json:"keyboard"`
 		KeyboardLayout string   `json:"keyboardLayout"`
 		Mouse          string   `json:"mouse"`
 		Tablet         string   `json:"tablet"`
+		Snapshot       string   `json:"snapshot"`
+		SharedFolders  string   `json:"sharedFolders"`
+		RNG            string   `json:"rng"`
+		Watchdog       string   `json:"watchdog"`
+		TPM            string   `json:"tpm"`
+		Devices        []string `json:"devices"`
+		RTCBase        string   `json:"rtcBase"`
+		RTCClock       string   `json:"rtcClock"`
+		RTCDriftFix    string   `json:"rtcDriftFix"`
 	}
 }
 
-var defaultMachine = (func() Machine {
+var defaultMachine = mustParseMachine(`{
+	"version":         2,
+	"architecture":    "x86_64",
+	"uuid":            "52bab607-10f1-4049-a0f8-ee4725cb715b",
+	"chipset":         "pc-i440fx",
+	"firmware":        "bios",
+	"cpu":             "host",
+	"flags":           [],
+	"usb":             "nec-usb-xhci",
+	"network":         "e1000",
+	"mac":             "aa:54:1a:30:5c:de",
+	"storage":         "virtio-blk-pci",
+	"graphics":        "qxl-vga",
+	"sound":           "none",
+	"keyboard":        "usb-kbd",
+	"keyboardLayout":  "en-us",
+	"mouse":           "usb-mouse",
+	"tablet":          "usb-tablet",
+	"sharedFolders":   "none",
+	"rng":             "virtio-rng-pci",
+	"watchdog":        "i6300esb",
+	"tpm":             "none",
+	"devices":         [],
+	"rtcBase":         "utc",
+	"rtcClock":        "host",
+	"rtcDriftFix":     "none"
+}`)
+
+// defaultAArch64Machine is the default machine for architecture 'aarch64'
+var defaultAArch64Machine = mustParseMachine(`{
+	"version":         2,
+	"architecture":    "aarch64",
+	"uuid":            "52bab607-10f1-4049-a0f8-ee4725cb715b",
+	"chipset":         "virt",
+	"firmware":        "uefi",
+	"cpu":             "host",
+	"flags":           [],
+	"usb":             "nec-usb-xhci",
+	"network":         "virtio-net-pci",
+	"mac":             "aa:54:1a:30:5c:de",
+	"storage":         "virtio-blk-pci",
+	"graphics":        "virtio-gpu-pci",
+	"sound":           "none",
+	"keyboard":        "usb-kbd",
+	"keyboardLayout":  "en-us",
+	"mouse":           "usb-mouse",
+	"tablet":          "usb-tablet",
+	"sharedFolders":   "none",
+	"rng":             "virtio-rng-pci",
+	"watchdog":        "i6300esb",
+	"tpm":             "none",
+	"devices":         [],
+	"rtcBase":         "utc",
+	"rtcClock":        "host",
+	"rtcDriftFix":     "none"
+}`)
+
+// mustParseMachine parses a static machine definition, panics on error.
+func mustParseMachine(data string) Machine {
 	var m Machine
-	err := json.Unmarshal([]byte(`{
-		"version":         1,
-		"uuid":            "52bab607-10f1-4049-a0f8-ee4725cb715b",
-		"chipset":         "pc-i440fx-2.8",
-		"cpu":             "host",
-		"flags":           [],
-		"usb":             "nec-usb-xhci",
-		"network":         "e1000",
-		"mac":             "aa:54:1a:30:5c:de",
-		"storage":         "virtio-blk-pci",
-		"graphics":        "qxl-vga",
-		"sound":           "none",
-		"keyboard":        "usb-kbd",
-		"keyboardLayout":  "en-us",
-		"mouse":           "usb-mouse",
-		"tablet":          "usb-tablet"
-	}`), &m.options)
+	err := json.Unmarshal([]byte(data), &m.options)
 	if err != nil {
 		panic("failed to parse static JSON config")
 	}
 	return m
-})()
+}
 
-// NewMachine returns a new machine from definition matching MachineSchema
+// NewMachine returns a new machine from definition matching MachineSchema,
+// definitions in older formats are migrated to the current format.
 func NewMachine(definition interface{}) Machine {
+	if migrated := MigrateMachineDefinition(definition); migrated != nil {
+		definition = migrated
+	}
 	var m Machine
 	schematypes.MustValidateAndMap(MachineSchema, definition, &m.options)
 	return m
@@ -182,6 +243,226 @@ func (m Machine) ApplyLimits(limits MachineLimits) (Machine, error) {
 	return Machine{o}, nil
 }
 
+// Memory returns the memory in MiB specified by the machine definition, this
+// is zero if not specified. Use ApplyLimits() to obtain defaults.
+func (m Machine) Memory() int {
+	return m.options.Memory
+}
+
+// CPUs returns the number of virtual CPUs ('threads * cores * sockets'), this
+// is zero if any of these are not specified. Use ApplyLimits() to obtain
+// defaults.
+func (m Machine) CPUs() int {
+	return m.options.Threads * m.options.Cores * m.options.Sockets
+}
+
+// IsEmpty returns true, if the Machine doesn't specify any properties other
+// than the format version.
+func (m Machine) IsEmpty() bool {
+	o := m.options
+	o.Version = 0
+	return reflect.DeepEqual(o, Machine{}.options)
+}
+
+// Architecture returns the guest architecture, empty-string if not specified.
+// Use Resolve() to obtain defaults.
+func (m Machine) Architecture() string {
+	return m.options.Architecture
+}
+
+// Snapshot returns the name of the internal qcow2 snapshot the virtual machine
+// should be resumed from, empty-string if the machine should be booted.
+func (m Machine) Snapshot() string {
+	return m.options.Snapshot
+}
+
+// WithSnapshot returns a copy of the Machine with snapshot set to the given
+// name, empty-string to clear the snapshot.
+func (m Machine) WithSnapshot(name string) Machine {
+	o := m.options
+	o.Snapshot = name
+	return Machine{options: o}
+}
+
+// Resolve returns a fully specified Machine with built-in defaults and defaults
+// extracted from limits, or a MalformedPayloadError if limits were violated.
+//
+// Built-in defaults depend on the architecture, which defaults to 'x86_64'.
+//
+// When resuming from a snapshot the virtual hardware must match exactly, hence,
+// machine definitions with a snapshot should always be resolved before they
+// are packaged into an image.
+func (m Machine) Resolve(limits MachineLimits) (Machine, error) {
+	defaults := defaultMachine
+	if m.options.Architecture == archAArch64 {
+		defaults = defaultAArch64Machine
+	}
+	// Snapshots packaged before the chipset defaulted to the newest version
+	// were taken with 'pc-i440fx-2.8'
+	if m.options.Snapshot != "" && m.options.Chipset == "" && m.options.Architecture != archAArch64 {
+		m.options.Chipset = "pc-i440fx-2.8"
+	}
+	// Snapshots packaged before the RNG and watchdog devices were added don't
+	// have them
+	if m.options.Snapshot != "" && m.options.RNG == "" {
+		m.options.RNG = "none"
+	}
+	if m.options.Snapshot != "" && m.options.Watchdog == "" {
+		m.options.Watchdog = "none"
+	}
+	m = m.WithDefaults(defaults)
+	if err := m.validateArchitecture(); err != nil {
+		return m, err
+	}
+	if err := m.validateGraphics(); err != nil {
+		return m, err
+	}
+	if err := m.validateRTC(); err != nil {
+		return m, err
+	}
+	if _, ok := unversionedChipsets[m.options.Chipset]; ok && m.options.Snapshot != "" {
+		return m, runtime.NewMalformedPayloadError(
+			"Machine chipset '", m.options.Chipset, "' must specify a version, such as ",
+			"'", m.options.Chipset, "-2.8', when resuming from snapshot",
+		)
+	}
+	return m.ApplyLimits(limits)
+}
+
+// graphicsMemoryDevices is the set of graphics devices supporting the
+// 'vgamem_mb' property.
+var graphicsMemoryDevices = map[string]bool{
+	"VGA":         true,
+	"vmware-svga": true,
+	"qxl-vga":     true,
+}
+
+// displayDevices is the set of graphics devices supporting the 'xres' and
+// 'yres' properties.
+var displayDevices = map[string]bool{
+	"VGA":            true,
+	"qxl-vga":        true,
+	"virtio-vga":     true,
+	"virtio-gpu-pci": true,
+}
+
+// validateGraphics returns a MalformedPayloadError if graphicsMemory or
+// display is specified for a graphics device that doesn't support it.
+func (m Machine) validateGraphics() error {
+	o := m.options
+	if o.GraphicsMemory != 0 && !graphicsMemoryDevices[o.Graphics] {
+		return runtime.NewMalformedPayloadError(
+			"Machine graphics '", o.Graphics, "' doesn't support 'graphicsMemory'",
+		)
+	}
+	if o.Display != "" && !displayDevices[o.Graphics] {
+		return runtime.NewMalformedPayloadError(
+			"Machine graphics '", o.Graphics, "' doesn't support 'display'",
+		)
+	}
+	return nil
+}
+
+// displayResolution returns the width and height for 'xres' and 'yres' of the
+// graphics device, empty-strings if display isn't specified.
+func (m Machine) displayResolution() (string, string) {
+	if m.options.Display == "" {
+		return "", ""
+	}
+	parts := strings.SplitN(m.options.Display, "x", 2)
+	return parts[0], parts[1]
+}
+
+// rtcDateTimeFormats are the formats for 'rtcBase' accepted by QEMU, other
+// than 'utc' and 'localtime'
+var rtcDateTimeFormats = []string{"2006-01-02T15:04:05", "2006-01-02"}
+
+// validateRTC returns a MalformedPayloadError if rtcBase isn't a valid date.
+func (m Machine) validateRTC() error {
+	base := m.options.RTCBase
+	if base == "utc" || base == "localtime" {
+		return nil
+	}
+	for _, format := range rtcDateTimeFormats {
+		if _, err := time.Parse(format, base); err == nil {
+			return nil
+		}
+	}
+	return runtime.NewMalformedPayloadError(
+		"Machine rtcBase '", base, "' is not a valid date, expected 'YYYY-MM-DD' or 'YYYY-MM-DDThh:mm:ss'",
+	)
+}
+
+// validateArchitecture returns a MalformedPayloadError if the machine specifies
+// hardware that isn't supported by the architecture.
+func (m Machine) validateArchitecture() error {
+	o := m.options
+	if o.Architecture == archAArch64 {
+		if o.Chipset != "virt" {
+			return runtime.NewMalformedPayloadError(
+				"Machine with architecture 'aarch64' must use chipset 'virt', not '", o.Chipset, "'",
+			)
+		}
+		if o.Graphics != "virtio-gpu-pci" && o.Graphics != "none" {
+			return runtime.NewMalformedPayloadError(
+				"Machine with architecture 'aarch64' must use graphics 'virtio-gpu-pci' or 'none', not '", o.Graphics, "'",
+			)
+		}
+		if o.Keyboard == "PS/2" || o.Mouse == "PS/2" {
+			return runtime.NewMalformedPayloadError(
+				"Machine with architecture 'aarch64' doesn't support 'PS/2' keyboard or mouse",
+			)
+		}
+		if o.Firmware != firmwareUEFI {
+			return runtime.NewMalformedPayloadError(
+				"Machine with architecture 'aarch64' must use firmware 'uefi', not '", o.Firmware, "'",
+			)
+		}
+		if o.TPM != "none" {
+			return runtime.NewMalformedPayloadError(
+				"Machine with architecture 'aarch64' doesn't support TPM '", o.TPM, "'",
+			)
+		}
+		if o.RTCDriftFix != "none" {
+			return runtime.NewMalformedPayloadError(
+				"Machine with architecture 'aarch64' doesn't support rtcDriftFix '", o.RTCDriftFix, "'",
+			)
+		}
+		if m.hasDevice("sga") {
+			return runtime.NewMalformedPayloadError(
+				"Machine with architecture 'aarch64' doesn't support device 'sga'",
+			)
+		}
+		return nil
+	}
+	if o.Chipset == "virt" {
+		return runtime.NewMalformedPayloadError(
+			"Machine chipset 'virt' is only supported with architecture 'aarch64'",
+		)
+	}
+	if o.Firmware == firmwareUEFISecureBoot && !strings.HasPrefix(o.Chipset, "pc-q35") {
+		return runtime.NewMalformedPayloadError(
+			"Machine firmware 'uefi-secure-boot' requires chipset 'pc-q35'",
+		)
+	}
+	if m.hasDevice("sga") && o.Firmware != firmwareBIOS {
+		return runtime.NewMalformedPayloadError(
+			"Machine device 'sga' requires firmware 'bios'",
+		)
+	}
+	return nil
+}
+
+// hasDevice returns true, if device is in the extra devices for the machine.
+func (m Machine) hasDevice(device string) bool {
+	for _, d := range m.options.Devices {
+		if d == device {
+			return true
+		}
+	}
+	return false
+}
+
 // DeriveLimits constructs sane MachineLimits that permits the machine.
 func (m Machine) DeriveLimits() MachineLimits {
 	// Default 1 for threads, cores and sockets
@@ -225,30 +506,81 @@ var MachineSchema schematypes.Schema = schematypes.Object{
 	Description: `Hardware definition for a virtual machine`,
 	Properties: schematypes.Properties{
 		"version": schematypes.IntegerEnum{
-			Title:   "Format Version",
-			Options: []int{machineFormatVersion},
+			Title: "Format Version",
+			Description: util.Markdown(`
+				Format version of the machine definition, definitions with version 1
+				are migrated to version 2, but cannot use 'display' or 'devices'.
+			`),
+			Options: []int{1, machineFormatVersion},
+		},
+		"architecture": schematypes.StringEnum{
+			Title: "Architecture",
+			Description: util.Markdown(`
+				Guest architecture, defaults to 'x86_64'. The virtual machine is run
+				with 'qemu-system-<architecture>' and must match the host
+				architecture, as virtual machines are accelerated using KVM.
+
+				Machines with architecture 'aarch64' use the 'virt' chipset, boot
+				using 'uefi' firmware and must use 'virtio-gpu-pci' or 'none' graphics.
+			`),
+			Options: []string{archX86_64, archAArch64},
 		},
 		"uuid": schematypes.String{
 			Title:       "System UUID",
 			Description: `System UUID for the virtual machine`,
 			Pattern:     `^[0-9a-f]{8}-[0-9a-f]{4}-[1-5][0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`,
 		},
-		"chipset": schematypes.StringEnum{
-			Title:   "Chipset",
-			Options: []string{"pc-i440fx-2.8"},
+		"chipset": schematypes.String{
+			Title: "Chipset",
+			Description: util.Markdown(`
+				Machine type for the virtual machine, either 'pc-i440fx' or 'pc-q35'
+				for 'x86_64', optionally with a version such as 'pc-q35-2.8', and
+				'virt' for 'aarch64'. Without a version the newest version supported
+				by the QEMU installed on the worker is used, defaults to 'pc-i440fx'.
+
+				Machines resuming from snapshot must specify a version, as the
+				virtual hardware must match the snapshot.
+			`),
+			Pattern: `^(?:pc-i440fx(?:-[0-9]+\.[0-9]+)?|pc-q35(?:-[0-9]+\.[0-9]+)?|virt)$`,
+		},
+		"firmware": schematypes.StringEnum{
+			Title: "Firmware",
+			Description: util.Markdown(`
+				Firmware used to boot the virtual machine, defaults to 'bios' for
+				'x86_64' and 'uefi' for 'aarch64'.
+
+				UEFI firmware (OVMF/AAVMF) must be installed on the host. The UEFI
+				variables are stored in 'uefi-vars.fd' in the image, such that boot
+				entries and secure-boot keys are preserved when the image is
+				rebuilt. Firmware 'uefi-secure-boot' requires chipset 'pc-q35',
+				and snapshots are only supported with firmware 'bios'.
+			`),
+			Options: []string{firmwareBIOS, firmwareUEFI, firmwareUEFISecureBoot},
 		},
-		"cpu": schematypes.StringEnum{
+		"cpu": schematypes.String{
 			Title: "CPU",
 			Description: util.Markdown(`
-				CPU to be exposed to the virtual machine.
+				CPU model to be exposed to the virtual machine, defaults to 'host'
+				which passes through the host CPU. Named models from
+				'qemu-system-<architecture> -cpu help', such as 'Haswell-noTSX',
+				give a deterministic instruction set, the task fails if the host
+				doesn't support all features of the model.
 
 				The number of virtual CPUs inside the virtual machine will be
 				'threads * cores * sockets' as configured below.
 			`),
-			Options: []string{"host"},
+			Pattern: `^[a-zA-Z0-9_.-]+$`,
 		},
 		"flags": schematypes.Array{
-			Items: schematypes.StringEnum{},
+			Title: "CPU Flags",
+			Description: util.Markdown(`
+				CPU feature flags to enable or disable, such as '+avx2' or '-vmx'.
+				Enabling a flag the host CPU doesn't support is not allowed.
+			`),
+			Items: schematypes.String{
+				Pattern: `^[+-][a-z0-9_.-]+$`,
+			},
+			Unique: true,
 		},
 		"threads": schematypes.Integer{
 			Description: "Threads per CPU core, leave undefined to get maximum available",
@@ -277,7 +609,7 @@ var MachineSchema schematypes.Schema = schematypes.Object{
 		},
 		"network": schematypes.StringEnum{
 			Title:   "Network Interface Controller",
-			Options: []string{"rtl8139", "e1000"},
+			Options: []string{"rtl8139", "e1000", "virtio-net-pci"},
 		},
 		"mac": schematypes.String{
 			Title:       "MAC Address",
@@ -285,12 +617,41 @@ var MachineSchema schematypes.Schema = schematypes.Object{
 			Pattern:     `^[0-9a-f][26ae](:[0-9a-f]{2}){5}$`,
 		},
 		"storage": schematypes.StringEnum{
-			Title:       "Storage Device",
-			Description: `Block device to use for attaching storage`,
-			Options:     []string{"virtio-blk-pci"},
+			Title: "Storage Device",
+			Description: util.Markdown(`
+				Block device to use for attaching storage, defaults to
+				'virtio-blk-pci'. With 'virtio-scsi-pci' disks are attached to a
+				virtio-scsi controller with 'discard=unmap', such that TRIM in the
+				guest frees space on the host.
+			`),
+			Options: []string{"virtio-blk-pci", "virtio-scsi-pci"},
 		},
 		"graphics": schematypes.StringEnum{
-			Options: []string{"VGA", "vmware-svga", "qxl-vga", "virtio-vga"},
+			Title: "Graphics Device",
+			Description: util.Markdown(`
+				Display device for the virtual machine, 'none' for headless machines.
+				Without a display device screenshots and VNC will not show anything.
+			`),
+			Options: []string{"VGA", "vmware-svga", "qxl-vga", "virtio-vga", "virtio-gpu-pci", "none"},
+		},
+		"graphicsMemory": schematypes.IntegerEnum{
+			Title: "Graphics Memory",
+			Description: util.Markdown(`
+				Video memory in MiB for graphics devices 'VGA', 'vmware-svga' and
+				'qxl-vga', defaults to the QEMU default for the device (16 MiB).
+				Larger screen resolutions may require more video memory.
+			`),
+			Options: []int{8, 16, 32, 64, 128, 256},
+		},
+		"display": schematypes.String{
+			Title: "Display Resolution",
+			Description: util.Markdown(`
+				Preferred display resolution reported to the guest, such as
+				'1920x1080', for graphics devices 'VGA', 'qxl-vga', 'virtio-vga' and
+				'virtio-gpu-pci'. The guest driver picks the resolution when it
+				loads, defaults to the QEMU default for the device (1024x768).
+			`),
+			Pattern: `^[1-9][0-9]{2,3}x[1-9][0-9]{2,3}$`,
 		},
 		"sound": schematypes.StringEnum{
 			Options: []string{
@@ -317,6 +678,119 @@ var MachineSchema schematypes.Schema = schematypes.Object{
 		"tablet": schematypes.StringEnum{
 			Options: []string{"usb-tablet", "none"},
 		},
+		"sharedFolders": schematypes.StringEnum{
+			Title: "Shared Folders",
+			Description: util.Markdown(`
+				Device used to expose host folders to the guest, this is used to
+				mount volumes such as persistent caches. The guest must mount shared
+				folders, 'qemu-guest-tools' will do this when supported.
+
+				Defaults to 'none', in which case tasks cannot mount volumes.
+			`),
+			Options: []string{"virtio-9p-pci", "none"},
+		},
+		"rng": schematypes.StringEnum{
+			Title: "Random Number Generator",
+			Description: util.Markdown(`
+				Device used to provide entropy from the host '/dev/urandom' to the
+				guest, this avoids stalls when the guest is low on entropy, such as
+				during TLS handshakes in headless guests.
+
+				Defaults to 'virtio-rng-pci'.
+			`),
+			Options: []string{"virtio-rng-pci", "none"},
+		},
+		"watchdog": schematypes.StringEnum{
+			Title: "Watchdog",
+			Description: util.Markdown(`
+				Watchdog device the guest can use to signal that it's making
+				progress. If the guest arms the watchdog and stops resetting it, the
+				task is failed as 'guest-hung', instead of running until
+				'maxRunTime' expires. The guest must load a driver and run a
+				watchdog daemon, otherwise the watchdog is never armed.
+
+				Defaults to 'i6300esb'.
+			`),
+			Options: []string{"i6300esb", "none"},
+		},
+		"tpm": schematypes.StringEnum{
+			Title: "Trusted Platform Module",
+			Description: util.Markdown(`
+				TPM 2.0 device emulated by 'swtpm', which must be installed on the
+				host. This is required by Windows 11 and measured boot. The TPM
+				state is created when the virtual machine is started and discarded
+				when it's stopped.
+
+				Defaults to 'none', a TPM is not supported with snapshots or
+				architecture 'aarch64'.
+			`),
+			Options: []string{"tpm-tis", "tpm-crb", "none"},
+		},
+		"devices": schematypes.Array{
+			Title: "Extra Devices",
+			Description: util.Markdown(`
+				Additional devices for the virtual machine:
+
+				 * 'vmcoreinfo', lets the guest kernel report where its crash
+				   information is, such that crash dumps can be analyzed.
+				 * 'sga', serial graphics adapter, which prints BIOS output on the
+				   serial console of headless machines, this requires architecture
+				   'x86_64' and firmware 'bios'.
+				 * 'usb-wacom-tablet', a pen tablet for testing drawing input.
+
+				Defaults to no additional devices.
+			`),
+			Items: schematypes.StringEnum{
+				Options: []string{"vmcoreinfo", "sga", "usb-wacom-tablet"},
+			},
+			Unique: true,
+		},
+		"rtcBase": schematypes.String{
+			Title: "RTC Base",
+			Description: util.Markdown(`
+				Initial time of the real-time clock, either 'utc', 'localtime' or a
+				fixed date such as '2017-06-01' or '2017-06-01T12:00:00' in UTC.
+				Windows guests expect the RTC in 'localtime', defaults to 'utc'.
+			`),
+			Pattern: `^(?:utc|localtime|[0-9]{4}-[0-9]{2}-[0-9]{2}(?:T[0-9]{2}:[0-9]{2}:[0-9]{2})?)$`,
+		},
+		"rtcClock": schematypes.StringEnum{
+			Title: "RTC Clock",
+			Description: util.Markdown(`
+				Clock driving the real-time clock, 'host' follows the host system
+				time, 'rt' follows the host monotonic clock and isn't affected by
+				changes to the host time, and 'vm' only advances while the virtual
+				machine is running. Defaults to 'host'.
+
+				With 'vm' and a fixed 'rtcBase' the guest always starts at the same
+				time, which is useful for tests that need a frozen clock, and when
+				resuming from snapshot the guest time continues from the snapshot.
+			`),
+			Options: []string{"host", "rt", "vm"},
+		},
+		"rtcDriftFix": schematypes.StringEnum{
+			Title: "RTC Drift Fix",
+			Description: util.Markdown(`
+				With 'slew' lost RTC interrupts are re-injected, such that guests
+				counting timer ticks, such as Windows, don't drift when the virtual
+				machine isn't scheduled. Defaults to 'none', 'slew' is only
+				supported on 'x86_64'.
+			`),
+			Options: []string{"none", "slew"},
+		},
+		"snapshot": schematypes.String{
+			Title: "Snapshot",
+			Description: util.Markdown(`
+				Name of an internal snapshot in 'layer.qcow2' to resume the virtual
+				machine from, instead of booting it. This is used to package images
+				with a running-state snapshot to speed up task startup.
+
+				The virtual hardware must match the machine the snapshot was taken
+				from, hence, the machine definition cannot be overwritten when using
+				a snapshot.
+			`),
+			Pattern: `^[a-zA-Z0-9_-]{1,64}$`,
+		},
 	},
 	Required: []string{"version"},
 }
@@ -179,3 +179,270 @@ func TestValidateMACWithInvalidMACs(t *testing.T) {
 		}
 	}
 }
+
+func TestMachineSnapshot(t *testing.T) {
+	m := NewMachine(map[string]interface{}{
+		"version":  float64(1),
+		"snapshot": "booted",
+	})
+	assert.Equal(t, "booted", m.Snapshot())
+	assert.False(t, m.IsEmpty())
+	assert.True(t, m.WithSnapshot("").IsEmpty())
+	assert.True(t, NewMachine(map[string]interface{}{"version": float64(1)}).IsEmpty())
+
+	// Resolved machines must retain the snapshot
+	r, err := m.Resolve(m.DeriveLimits())
+	assert.NoError(t, err)
+	assert.Equal(t, "booted", r.Snapshot())
+	assert.Equal(t, "nec-usb-xhci", r.options.USB)
+}
+
+func TestMachineArchitecture(t *testing.T) {
+	m := NewMachine(map[string]interface{}{
+		"version":      float64(1),
+		"architecture": "aarch64",
+	})
+	r, err := m.Resolve(m.DeriveLimits())
+	assert.NoError(t, err)
+	assert.Equal(t, "aarch64", r.Architecture())
+	assert.Equal(t, "virt", r.options.Chipset)
+	assert.Equal(t, "virtio-gpu-pci", r.options.Graphics)
+
+	// Machines default to x86_64
+	m = NewMachine(map[string]interface{}{"version": float64(1)})
+	r, err = m.Resolve(m.DeriveLimits())
+	assert.NoError(t, err)
+	assert.Equal(t, "x86_64", r.Architecture())
+	assert.Equal(t, "pc-i440fx", r.options.Chipset)
+
+	// Hardware not supported by the architecture is rejected
+	m = NewMachine(map[string]interface{}{
+		"version":      float64(1),
+		"architecture": "aarch64",
+		"chipset":      "pc-i440fx-2.8",
+	})
+	_, err = m.Resolve(m.DeriveLimits())
+	assert.Error(t, err)
+	m = NewMachine(map[string]interface{}{
+		"version": float64(1),
+		"chipset": "virt",
+	})
+	_, err = m.Resolve(m.DeriveLimits())
+	assert.Error(t, err)
+}
+
+func TestMachineFirmware(t *testing.T) {
+	m := NewMachine(map[string]interface{}{"version": float64(1)})
+	r, err := m.Resolve(m.DeriveLimits())
+	assert.NoError(t, err)
+	assert.Equal(t, "bios", r.options.Firmware)
+
+	m = NewMachine(map[string]interface{}{
+		"version":      float64(1),
+		"architecture": "aarch64",
+	})
+	r, err = m.Resolve(m.DeriveLimits())
+	assert.NoError(t, err)
+	assert.Equal(t, "uefi", r.options.Firmware)
+
+	// Secure boot requires q35 chipset
+	m = NewMachine(map[string]interface{}{
+		"version":  float64(1),
+		"firmware": "uefi-secure-boot",
+	})
+	_, err = m.Resolve(m.DeriveLimits())
+	assert.Error(t, err)
+	m = NewMachine(map[string]interface{}{
+		"version":  float64(1),
+		"firmware": "uefi-secure-boot",
+		"chipset":  "pc-q35-2.8",
+	})
+	_, err = m.Resolve(m.DeriveLimits())
+	assert.NoError(t, err)
+}
+
+func TestMachineRNG(t *testing.T) {
+	limits := MachineLimits{MaxMemory: 1024, MaxCPUs: 1, DefaultThreads: 1}
+
+	m, err := Machine{}.Resolve(limits)
+	assert.NoError(t, err)
+	assert.Equal(t, "virtio-rng-pci", m.options.RNG)
+
+	// Snapshots without rng were taken without the device
+	m, err = Machine{}.WithSnapshot("booted").Resolve(limits)
+	assert.NoError(t, err)
+	assert.Equal(t, "none", m.options.RNG)
+
+	m, err = NewMachine(map[string]interface{}{
+		"version": float64(1),
+		"rng":     "none",
+	}).Resolve(limits)
+	assert.NoError(t, err)
+	assert.Equal(t, "none", m.options.RNG)
+}
+
+func TestMachineWatchdog(t *testing.T) {
+	limits := MachineLimits{MaxMemory: 1024, MaxCPUs: 1, DefaultThreads: 1}
+
+	m, err := Machine{}.Resolve(limits)
+	assert.NoError(t, err)
+	assert.Equal(t, "i6300esb", m.options.Watchdog)
+
+	// Snapshots without watchdog were taken without the device
+	m, err = Machine{}.WithSnapshot("booted").Resolve(limits)
+	assert.NoError(t, err)
+	assert.Equal(t, "none", m.options.Watchdog)
+
+	m, err = NewMachine(map[string]interface{}{
+		"version":  float64(1),
+		"watchdog": "none",
+	}).Resolve(limits)
+	assert.NoError(t, err)
+	assert.Equal(t, "none", m.options.Watchdog)
+}
+
+func TestMachineGraphics(t *testing.T) {
+	limits := MachineLimits{MaxMemory: 1024, MaxCPUs: 1, DefaultThreads: 1}
+
+	m, err := NewMachine(map[string]interface{}{
+		"version":        float64(1),
+		"graphics":       "vmware-svga",
+		"graphicsMemory": float64(64),
+	}).Resolve(limits)
+	assert.NoError(t, err)
+	assert.Equal(t, 64, m.options.GraphicsMemory)
+
+	// graphicsMemory is not supported by virtio graphics devices
+	_, err = NewMachine(map[string]interface{}{
+		"version":        float64(1),
+		"graphics":       "virtio-vga",
+		"graphicsMemory": float64(64),
+	}).Resolve(limits)
+	assert.Error(t, err)
+
+	// Headless machines are allowed for all architectures
+	m, err = NewMachine(map[string]interface{}{
+		"version":      float64(1),
+		"architecture": "aarch64",
+		"graphics":     "none",
+	}).Resolve(limits)
+	assert.NoError(t, err)
+	assert.Equal(t, "none", m.options.Graphics)
+
+	m, err = NewMachine(map[string]interface{}{
+		"version":  float64(2),
+		"graphics": "virtio-vga",
+		"display":  "1920x1080",
+	}).Resolve(limits)
+	assert.NoError(t, err)
+	xres, yres := m.displayResolution()
+	assert.Equal(t, "1920", xres)
+	assert.Equal(t, "1080", yres)
+
+	// display is not supported by vmware-svga
+	_, err = NewMachine(map[string]interface{}{
+		"version":  float64(2),
+		"graphics": "vmware-svga",
+		"display":  "1920x1080",
+	}).Resolve(limits)
+	assert.Error(t, err)
+}
+
+func TestMachineDevices(t *testing.T) {
+	limits := MachineLimits{MaxMemory: 1024, MaxCPUs: 1, DefaultThreads: 1}
+
+	m, err := Machine{}.Resolve(limits)
+	assert.NoError(t, err)
+	assert.Empty(t, m.options.Devices)
+
+	m, err = NewMachine(map[string]interface{}{
+		"version": float64(2),
+		"devices": []interface{}{"vmcoreinfo", "sga"},
+	}).Resolve(limits)
+	assert.NoError(t, err)
+	assert.True(t, m.hasDevice("sga"))
+
+	_, err = NewMachine(map[string]interface{}{
+		"version":  float64(2),
+		"firmware": "uefi",
+		"devices":  []interface{}{"sga"},
+	}).Resolve(limits)
+	assert.Error(t, err)
+
+	_, err = NewMachine(map[string]interface{}{
+		"version":      float64(2),
+		"architecture": "aarch64",
+		"devices":      []interface{}{"sga"},
+	}).Resolve(limits)
+	assert.Error(t, err)
+}
+
+func TestMachineTPM(t *testing.T) {
+	limits := MachineLimits{MaxMemory: 1024, MaxCPUs: 1, DefaultThreads: 1}
+
+	m, err := Machine{}.Resolve(limits)
+	assert.NoError(t, err)
+	assert.Equal(t, "none", m.options.TPM)
+
+	m, err = NewMachine(map[string]interface{}{
+		"version": float64(1),
+		"tpm":     "tpm-tis",
+	}).Resolve(limits)
+	assert.NoError(t, err)
+	assert.Equal(t, "tpm-tis", m.options.TPM)
+
+	_, err = NewMachine(map[string]interface{}{
+		"version":      float64(1),
+		"architecture": "aarch64",
+		"tpm":          "tpm-tis",
+	}).Resolve(limits)
+	assert.Error(t, err)
+}
+
+func TestMachineRTC(t *testing.T) {
+	limits := MachineLimits{MaxMemory: 1024, MaxCPUs: 1, DefaultThreads: 1}
+
+	// Machines that don't specify the RTC get the previously hardcoded 'utc'
+	m, err := Machine{}.WithSnapshot("booted").Resolve(limits)
+	assert.NoError(t, err)
+	assert.Equal(t, "utc", m.options.RTCBase)
+	assert.Equal(t, "host", m.options.RTCClock)
+	assert.Equal(t, "none", m.options.RTCDriftFix)
+
+	m, err = NewMachine(map[string]interface{}{
+		"version":     float64(1),
+		"rtcBase":     "localtime",
+		"rtcDriftFix": "slew",
+	}).Resolve(limits)
+	assert.NoError(t, err)
+	assert.Equal(t, "localtime", m.options.RTCBase)
+	assert.Equal(t, "slew", m.options.RTCDriftFix)
+
+	m, err = NewMachine(map[string]interface{}{
+		"version":  float64(1),
+		"rtcBase":  "2017-06-01T12:00:00",
+		"rtcClock": "vm",
+	}).Resolve(limits)
+	assert.NoError(t, err)
+	assert.Equal(t, "2017-06-01T12:00:00", m.options.RTCBase)
+	assert.Equal(t, "vm", m.options.RTCClock)
+
+	// Dates matching the pattern must also be valid
+	_, err = NewMachine(map[string]interface{}{
+		"version": float64(1),
+		"rtcBase": "2017-13-01",
+	}).Resolve(limits)
+	assert.Error(t, err)
+
+	assert.Error(t, MachineSchema.Validate(map[string]interface{}{
+		"version": float64(1),
+		"rtcBase": "yesterday",
+	}))
+
+	_, err = NewMachine(map[string]interface{}{
+		"version":      float64(1),
+		"architecture": "aarch64",
+		"rtcDriftFix":  "slew",
+	}).Resolve(limits)
+	assert.Error(t, err)
+}
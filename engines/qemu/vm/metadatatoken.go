@@ -0,0 +1,26 @@
+package vm
+
+import "strings"
+
+// MetaDataTokenName is the fw_cfg item from which the guest can read the
+// token set with SetMetaDataToken().
+const MetaDataTokenName = "opt/org.taskcluster/meta-data-token"
+
+// SetMetaDataToken exposes token to the guest as the fw_cfg item named
+// MetaDataTokenName. On Linux guests this can be read as root from
+// /sys/firmware/qemu_fw_cfg/by_name/opt/org.taskcluster/meta-data-token/raw
+// when the qemu_fw_cfg module is loaded. The token must not contain commas.
+//
+// This must be called before Start().
+func (vm *VirtualMachine) SetMetaDataToken(token string) {
+	vm.m.Lock()
+	defer vm.m.Unlock()
+	if vm.started {
+		panic("SetMetaDataToken() cannot be called after Start()")
+	}
+	if strings.Contains(token, ",") {
+		panic("SetMetaDataToken() token cannot contain commas")
+	}
+
+	vm.qemu.Args = append(vm.qemu.Args, "-fw_cfg", "name="+MetaDataTokenName+",string="+token)
+}
@@ -0,0 +1,21 @@
+package vm
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetMetaDataToken(t *testing.T) {
+	vm := &VirtualMachine{
+		machine: defaultMachine,
+		qemu:    exec.Command("qemu-system-x86_64"),
+	}
+	vm.SetMetaDataToken("my-secret-token")
+	assert.Equal(t, []string{
+		"qemu-system-x86_64",
+		"-fw_cfg", "name=opt/org.taskcluster/meta-data-token,string=my-secret-token",
+	}, vm.qemu.Args)
+	assert.Panics(t, func() { vm.SetMetaDataToken("a,b") })
+}
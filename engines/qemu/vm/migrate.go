@@ -11,6 +11,7 @@ var migrations = []func(map[string]interface{}) map[string]interface{}{
 	//       All migrations must migrate to the next version, this way we only
 	//       have to write one migration when we change the format.
 	migrate0to1,
+	migrate1to2,
 
 	// As a final step after migrations we validate against current schema and
 	// return nil, if it's not valid.
@@ -24,9 +25,16 @@ var migrations = []func(map[string]interface{}) map[string]interface{}{
 
 // MigrateMachineDefinition takes a machine definition and migrates it to the
 // latest format version, and returns nil, if format is not supported.
+//
+// When new options are introduced the format version must be bumped and a
+// migration added, such that images packaged with an older machine.json keep
+// the virtual hardware they were built with, and older workers refuse
+// definitions using options they don't know about.
 func MigrateMachineDefinition(definition interface{}) interface{} {
-	def, ok := definition.(map[string]interface{})
-	if !ok {
+	// Normalizing JSON, definitions from config may not use float64 for numbers
+	var def map[string]interface{}
+	raw, err := json.Marshal(definition)
+	if err != nil || json.Unmarshal(raw, &def) != nil || def == nil {
 		return nil
 	}
 	version := 0 // default version from before we specified version numbers
@@ -37,6 +45,9 @@ func MigrateMachineDefinition(definition interface{}) interface{} {
 			return nil
 		}
 	}
+	if version < 0 || version > machineFormatVersion {
+		return nil // newer format than this worker supports
+	}
 	for i := version; i < len(migrations) && def != nil; i++ {
 		// Normalizing JSON
 		raw, _ := json.Marshal(def)
@@ -128,3 +139,17 @@ func migrate0to1(def map[string]interface{}) map[string]interface{} {
 
 	return result
 }
+
+// Migrate version 1 -> version 2
+func migrate1to2(def map[string]interface{}) map[string]interface{} {
+	// Version 2 added 'display' and 'devices', options from version 1 have the
+	// same meaning in version 2, and the defaults for new options give the
+	// same virtual hardware as version 1.
+	for _, option := range []string{"display", "devices"} {
+		if _, ok := def[option]; ok {
+			return nil // not allowed in version 1
+		}
+	}
+	def["version"] = 2
+	return def
+}
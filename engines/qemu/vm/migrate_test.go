@@ -57,4 +57,32 @@ func TestMigrateFromV1(t *testing.T) {
 	}`), &def))
 	def = MigrateMachineDefinition(def)
 	assert.NotNil(t, def, "Expected some machine definition")
+	assert.Equal(t, float64(2), def.(map[string]interface{})["version"])
+	assert.Equal(t, "qxl-vga", def.(map[string]interface{})["graphics"])
+}
+
+func TestMigrateFromV1WithV2Options(t *testing.T) {
+	def := MigrateMachineDefinition(map[string]interface{}{
+		"version": 1,
+		"devices": []interface{}{"vmcoreinfo"},
+	})
+	assert.Nil(t, def, "Expected no machine definition")
+}
+
+func TestMigrateFromV2(t *testing.T) {
+	def := MigrateMachineDefinition(map[string]interface{}{
+		"version":  2,
+		"graphics": "VGA",
+		"display":  "1920x1080",
+		"devices":  []interface{}{"vmcoreinfo"},
+	})
+	assert.NotNil(t, def, "Expected some machine definition")
+	assert.Equal(t, "1920x1080", def.(map[string]interface{})["display"])
+}
+
+func TestMigrateFromNewer(t *testing.T) {
+	def := MigrateMachineDefinition(map[string]interface{}{
+		"version": machineFormatVersion + 1,
+	})
+	assert.Nil(t, def, "Expected no machine definition")
 }
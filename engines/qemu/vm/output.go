@@ -0,0 +1,65 @@
+package vm
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// maxOutputLines is the number of lines of QEMU output kept by outputLog
+const maxOutputLines = 1000
+
+// maxOutputLineLength is the length at which lines in outputLog are truncated
+const maxOutputLineLength = 1024
+
+// outputLog is a ring buffer holding the last maxOutputLines lines written by
+// QEMU to stdout and stderr.
+type outputLog struct {
+	m       sync.Mutex
+	lines   []string
+	next    int // index of the oldest line, once the buffer is full
+	dropped int // number of lines overwritten
+}
+
+// add appends a line to the buffer, overwriting the oldest line if full
+func (l *outputLog) add(line string) {
+	if len(line) > maxOutputLineLength {
+		line = line[:maxOutputLineLength] + "..."
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+	if len(l.lines) < maxOutputLines {
+		l.lines = append(l.lines, line)
+		return
+	}
+	l.lines[l.next] = line
+	l.next = (l.next + 1) % maxOutputLines
+	l.dropped++
+}
+
+// String returns the lines in the buffer, oldest first
+func (l *outputLog) String() string {
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	if len(l.lines) == 0 {
+		return ""
+	}
+	b := bytes.NewBuffer(nil)
+	if l.dropped > 0 {
+		fmt.Fprintf(b, "[%d earlier lines were dropped]\n", l.dropped)
+	}
+	for i := range l.lines {
+		b.WriteString(l.lines[(l.next+i)%len(l.lines)])
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// Output returns the last lines written by QEMU to stdout and stderr, this is
+// empty-string if QEMU didn't write anything. Output is complete once the
+// virtual machine is done.
+func (vm *VirtualMachine) Output() string {
+	return vm.output.String()
+}
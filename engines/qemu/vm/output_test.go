@@ -0,0 +1,35 @@
+package vm
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutputLog(t *testing.T) {
+	var l outputLog
+	assert.Equal(t, "", l.String())
+
+	l.add("hello")
+	l.add("world")
+	assert.Equal(t, "hello\nworld\n", l.String())
+
+	// Long lines are truncated
+	l.add(strings.Repeat("x", maxOutputLineLength+10))
+	lines := strings.Split(l.String(), "\n")
+	assert.Equal(t, maxOutputLineLength+3, len(lines[2]))
+}
+
+func TestOutputLogOverflow(t *testing.T) {
+	var l outputLog
+	for i := 0; i < maxOutputLines+5; i++ {
+		l.add(fmt.Sprintf("line %d", i))
+	}
+	lines := strings.Split(strings.TrimSuffix(l.String(), "\n"), "\n")
+	assert.Equal(t, maxOutputLines+1, len(lines))
+	assert.Equal(t, "[5 earlier lines were dropped]", lines[0])
+	assert.Equal(t, "line 5", lines[1])
+	assert.Equal(t, fmt.Sprintf("line %d", maxOutputLines+4), lines[maxOutputLines])
+}
@@ -0,0 +1,129 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+// maxPassthroughDevices is the maximum number of host devices passed through
+// to a virtual machine, we put these on PCI 0x1c and up, so this must keep us
+// within 0x1f. With PCI express chipsets the devices are put behind root ports
+// in functions of PCI 0x1c, as 0x1f is taken by the LPC controller on q35.
+const maxPassthroughDevices = 4
+
+// PCIAddressPattern matches a fully qualified PCI address, such as the
+// '0000:01:00.0' reported by 'lspci -D'.
+const PCIAddressPattern = `^[0-9a-f]{4}:[0-9a-f]{2}:[0-9a-f]{2}\.[0-7]$`
+
+var pciAddressPattern = regexp.MustCompile(PCIAddressPattern)
+
+// Locations of sysfs PCI devices and VFIO group devices, variables such that
+// tests can substitute them.
+var (
+	sysfsPCIDevices = "/sys/bus/pci/devices"
+	devVFIO         = "/dev/vfio"
+)
+
+// CheckPassthroughDevice returns an error if the host PCI device at address
+// cannot be passed through to a virtual machine using vfio-pci.
+//
+// This requires an IOMMU enabled with 'intel_iommu=on' or 'amd_iommu=on' on
+// the kernel command line, and the device to be bound to the vfio-pci driver.
+// Note that all devices in the same IOMMU group must be bound to vfio-pci, or
+// QEMU will fail to open the group.
+func CheckPassthroughDevice(address string) error {
+	if !pciAddressPattern.MatchString(address) {
+		return errors.Errorf("'%s' is not a valid PCI address", address)
+	}
+	device := filepath.Join(sysfsPCIDevices, address)
+	if _, err := os.Stat(device); err != nil {
+		return errors.Errorf("PCI device %s doesn't exist", address)
+	}
+	group, err := os.Readlink(filepath.Join(device, "iommu_group"))
+	if err != nil {
+		return errors.Errorf(
+			"PCI device %s has no IOMMU group, the IOMMU must be enabled with "+
+				"'intel_iommu=on' or 'amd_iommu=on'", address,
+		)
+	}
+	driver, err := os.Readlink(filepath.Join(device, "driver"))
+	if err != nil || filepath.Base(driver) != "vfio-pci" {
+		return errors.Errorf("PCI device %s must be bound to the vfio-pci driver", address)
+	}
+	if _, err := os.Stat(filepath.Join(devVFIO, filepath.Base(group))); err != nil {
+		return errors.Wrapf(err, "VFIO group for PCI device %s isn't available", address)
+	}
+	return nil
+}
+
+// AddPassthroughDevice attaches the host PCI device with the given functions
+// to the virtual machine using vfio-pci, for a GPU this is typically the
+// graphics function and its audio function, for example:
+//
+//   vm.AddPassthroughDevice([]string{"0000:01:00.0", "0000:01:00.1"})
+//
+// Functions are attached as a single multi-function device in the given order.
+// Devices should be checked with CheckPassthroughDevice() first. Returns a
+// MalformedPayloadError if the device can't be added to the machine.
+// This must be called before Start().
+func (vm *VirtualMachine) AddPassthroughDevice(functions []string) error {
+	vm.m.Lock()
+	defer vm.m.Unlock()
+	if vm.started {
+		panic("AddPassthroughDevice() cannot be called after Start()")
+	}
+	if len(functions) == 0 || len(functions) > 8 {
+		panic(fmt.Sprintf("passthrough device cannot have %d functions", len(functions)))
+	}
+	for _, address := range functions {
+		if !pciAddressPattern.MatchString(address) {
+			panic(fmt.Sprintf("PCI address '%s' is not valid", address))
+		}
+	}
+
+	o := vm.machine.options
+	if o.Snapshot != "" {
+		return runtime.NewMalformedPayloadError(
+			"Passthrough devices cannot be used with machines resuming from snapshot: '",
+			o.Snapshot, "'",
+		)
+	}
+	if vm.passthrough >= maxPassthroughDevices {
+		return runtime.NewMalformedPayloadError(
+			"Virtual machines cannot have more than ", maxPassthroughDevices, " passthrough devices",
+		)
+	}
+
+	bus, slot := pciBus(o.Chipset), 0x1c+vm.passthrough // passthrough devices on PCI 0x1c and up
+	if isPCIExpress(o.Chipset) {
+		// Put the device behind a root port, so the guest sees a PCI express
+		// device, which GPU drivers often require. Root ports are functions of
+		// PCI 0x1c, like on real ICH9 chipsets.
+		port := fmt.Sprintf(
+			"pcie-root-port,id=hostport%d,bus=%s,addr=0x1c.0x%x,chassis=%d",
+			vm.passthrough, bus, vm.passthrough, vm.passthrough+1,
+		)
+		if vm.passthrough == 0 {
+			port += ",multifunction=on"
+		}
+		vm.qemu.Args = append(vm.qemu.Args, "-device", port)
+		bus, slot = fmt.Sprintf("hostport%d", vm.passthrough), 0x0
+	}
+	for i, address := range functions {
+		device := fmt.Sprintf(
+			"vfio-pci,host=%s,bus=%s,addr=0x%x.0x%x,id=hostdev%d-%d",
+			address, bus, slot, i, vm.passthrough, i,
+		)
+		if i == 0 && len(functions) > 1 {
+			device += ",multifunction=on"
+		}
+		vm.qemu.Args = append(vm.qemu.Args, "-device", device)
+	}
+	vm.passthrough++
+	return nil
+}
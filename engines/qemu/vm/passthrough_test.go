@@ -0,0 +1,77 @@
+package vm
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAddPassthroughDevice(t *testing.T) {
+	vm := &VirtualMachine{
+		machine: defaultMachine,
+		qemu:    exec.Command("qemu-system-x86_64"),
+	}
+	require.NoError(t, vm.AddPassthroughDevice([]string{"0000:01:00.0", "0000:01:00.1"}))
+	assert.Contains(t, vm.qemu.Args, "vfio-pci,host=0000:01:00.0,bus=pci.0,addr=0x1c.0x0,id=hostdev0-0,multifunction=on")
+	assert.Contains(t, vm.qemu.Args, "vfio-pci,host=0000:01:00.1,bus=pci.0,addr=0x1c.0x1,id=hostdev0-1")
+
+	for i := 1; i < maxPassthroughDevices; i++ {
+		require.NoError(t, vm.AddPassthroughDevice([]string{"0000:02:00.0"}))
+	}
+	assert.Error(t, vm.AddPassthroughDevice([]string{"0000:02:00.0"}), "expected too many devices to fail")
+
+	q35 := defaultMachine
+	q35.options.Chipset = "pc-q35-2.8"
+	vm = &VirtualMachine{
+		machine: q35,
+		qemu:    exec.Command("qemu-system-x86_64"),
+	}
+	require.NoError(t, vm.AddPassthroughDevice([]string{"0000:01:00.0"}))
+	require.NoError(t, vm.AddPassthroughDevice([]string{"0000:02:00.0"}))
+	assert.Contains(t, vm.qemu.Args, "pcie-root-port,id=hostport0,bus=pcie.0,addr=0x1c.0x0,chassis=1,multifunction=on")
+	assert.Contains(t, vm.qemu.Args, "vfio-pci,host=0000:01:00.0,bus=hostport0,addr=0x0.0x0,id=hostdev0-0")
+	assert.Contains(t, vm.qemu.Args, "pcie-root-port,id=hostport1,bus=pcie.0,addr=0x1c.0x1,chassis=2")
+	assert.Contains(t, vm.qemu.Args, "vfio-pci,host=0000:02:00.0,bus=hostport1,addr=0x0.0x0,id=hostdev1-0")
+
+	vm = &VirtualMachine{
+		machine: defaultMachine.WithSnapshot("booted"),
+		qemu:    exec.Command("qemu-system-x86_64"),
+	}
+	assert.Error(t, vm.AddPassthroughDevice([]string{"0000:01:00.0"}), "expected snapshots to be rejected")
+}
+
+func TestCheckPassthroughDevice(t *testing.T) {
+	folder, err := ioutil.TempDir("", "passthrough-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+
+	defer func(sysfs, dev string) {
+		sysfsPCIDevices, devVFIO = sysfs, dev
+	}(sysfsPCIDevices, devVFIO)
+	sysfsPCIDevices = filepath.Join(folder, "devices")
+	devVFIO = filepath.Join(folder, "vfio")
+
+	device := filepath.Join(sysfsPCIDevices, "0000:01:00.0")
+	require.NoError(t, os.MkdirAll(device, 0700))
+	require.NoError(t, os.MkdirAll(devVFIO, 0700))
+
+	assert.Error(t, CheckPassthroughDevice("01:00.0"), "expected invalid address to fail")
+	assert.Error(t, CheckPassthroughDevice("0000:02:00.0"), "expected missing device to fail")
+	assert.Error(t, CheckPassthroughDevice("0000:01:00.0"), "expected missing IOMMU group to fail")
+
+	require.NoError(t, os.Symlink("../../../kernel/iommu_groups/7", filepath.Join(device, "iommu_group")))
+	require.NoError(t, os.Symlink("../../../bus/pci/drivers/nouveau", filepath.Join(device, "driver")))
+	assert.Error(t, CheckPassthroughDevice("0000:01:00.0"), "expected wrong driver to fail")
+
+	require.NoError(t, os.Remove(filepath.Join(device, "driver")))
+	require.NoError(t, os.Symlink("../../../bus/pci/drivers/vfio-pci", filepath.Join(device, "driver")))
+	assert.Error(t, CheckPassthroughDevice("0000:01:00.0"), "expected missing VFIO group to fail")
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(devVFIO, "7"), nil, 0600))
+	assert.NoError(t, CheckPassthroughDevice("0000:01:00.0"))
+}
@@ -0,0 +1,216 @@
+package vm
+
+import (
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+// Optional features that depend on the QEMU version, see QEMUInfo.Supports().
+const (
+	FeatureVirtioFS  = "virtio-fs"  // vhost-user-fs-pci device for virtiofsd
+	FeatureQcow2Zstd = "qcow2-zstd" // qcow2 images with compression_type=zstd
+	FeatureAudiodev  = "audiodev"   // -audiodev with audiodev= on sound devices
+)
+
+// featureVersions is the minimum QEMU version for each feature
+var featureVersions = map[string]qemuVersion{
+	FeatureVirtioFS:  {5, 0},
+	FeatureQcow2Zstd: {5, 1},
+	FeatureAudiodev:  {4, 2},
+}
+
+// unversionedChipsets maps chipsets without version to the prefix of the
+// versioned machine types, of which the newest supported is selected.
+var unversionedChipsets = map[string]string{
+	"pc-i440fx": "pc-i440fx-",
+	"pc-q35":    "pc-q35-",
+}
+
+type qemuVersion struct {
+	Major, Minor int
+}
+
+func (v qemuVersion) atLeast(other qemuVersion) bool {
+	return v.Major > other.Major || (v.Major == other.Major && v.Minor >= other.Minor)
+}
+
+// QEMUInfo is the version, machine types and CPU models of the QEMU binary for
+// an architecture, as detected by ProbeQEMU().
+type QEMUInfo struct {
+	Version  string   // version string, such as '2.11.1'
+	Machines []string // machine types listed by '-machine help'
+	CPUs     []string // CPU models listed by '-cpu help'
+	version  qemuVersion
+}
+
+var qemuVersionPattern = regexp.MustCompile(`QEMU emulator version ((\d+)\.(\d+)(?:\.\d+)?)`)
+
+// parseQEMUVersion parses the output of 'qemu-system-<arch> -version'
+func parseQEMUVersion(output string) (string, qemuVersion, error) {
+	match := qemuVersionPattern.FindStringSubmatch(output)
+	if match == nil {
+		return "", qemuVersion{}, errors.New("unable to parse QEMU version")
+	}
+	major, _ := strconv.Atoi(match[2])
+	minor, _ := strconv.Atoi(match[3])
+	return match[1], qemuVersion{major, minor}, nil
+}
+
+// parseMachineHelp parses the output of 'qemu-system-<arch> -machine help'
+func parseMachineHelp(output string) []string {
+	var machines []string
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		// Skip the 'Supported machines are:' header
+		if len(fields) == 0 || strings.HasSuffix(line, ":") {
+			continue
+		}
+		machines = append(machines, fields[0])
+	}
+	return machines
+}
+
+// parseCPUHelp parses the CPU models from 'qemu-system-<arch> -cpu help'
+func parseCPUHelp(output string) []string {
+	var models []string
+	listing := false
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "Available CPUs:") {
+			listing = true
+			continue
+		}
+		fields := strings.Fields(line)
+		if !listing || len(fields) == 0 {
+			listing = false // CPU models end with an empty line
+			continue
+		}
+		// On x86 models are prefixed 'x86'
+		if fields[0] == "x86" && len(fields) > 1 {
+			fields = fields[1:]
+		}
+		models = append(models, fields[0])
+	}
+	return models
+}
+
+var qemuProbes = struct {
+	sync.Mutex
+	info map[string]*QEMUInfo
+}{info: make(map[string]*QEMUInfo)}
+
+// ProbeQEMU returns the version, machine types and CPU models of
+// 'qemu-system-<arch>', results are cached as the QEMU binary isn't expected to
+// change while we're running.
+func ProbeQEMU(architecture string) (*QEMUInfo, error) {
+	qemuProbes.Lock()
+	defer qemuProbes.Unlock()
+	if info, ok := qemuProbes.info[architecture]; ok {
+		return info, nil
+	}
+
+	binary := "qemu-system-" + architecture
+	output, err := exec.Command(binary, "-version").Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to run '%s -version'", binary)
+	}
+	info := &QEMUInfo{}
+	info.Version, info.version, err = parseQEMUVersion(string(output))
+	if err != nil {
+		return nil, err
+	}
+	output, err = exec.Command(binary, "-machine", "help").Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to run '%s -machine help'", binary)
+	}
+	info.Machines = parseMachineHelp(string(output))
+	output, err = exec.Command(binary, "-cpu", "help").Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to run '%s -cpu help'", binary)
+	}
+	info.CPUs = parseCPUHelp(string(output))
+
+	qemuProbes.info[architecture] = info
+	return info, nil
+}
+
+// Supports returns true, if the QEMU version supports the given feature.
+func (i *QEMUInfo) Supports(feature string) bool {
+	version, ok := featureVersions[feature]
+	if !ok {
+		panic("unknown QEMU feature: " + feature)
+	}
+	return i.version.atLeast(version)
+}
+
+// SupportsMachine returns true, if machine is a supported machine type.
+func (i *QEMUInfo) SupportsMachine(machine string) bool {
+	for _, m := range i.Machines {
+		if m == machine {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsCPU returns true, if model is a supported CPU model.
+func (i *QEMUInfo) SupportsCPU(model string) bool {
+	for _, m := range i.CPUs {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// NewestMachine returns the newest machine type with prefix followed by a
+// version, such as 'pc-q35-', or empty string if there is no such machine.
+func (i *QEMUInfo) NewestMachine(prefix string) string {
+	newest := ""
+	var newestVersion qemuVersion
+	for _, m := range i.Machines {
+		if !strings.HasPrefix(m, prefix) {
+			continue
+		}
+		parts := strings.Split(strings.TrimPrefix(m, prefix), ".")
+		if len(parts) != 2 {
+			continue
+		}
+		major, err1 := strconv.Atoi(parts[0])
+		minor, err2 := strconv.Atoi(parts[1])
+		if err1 != nil || err2 != nil {
+			continue // skip distribution specific machines, like 'pc-q35-rhel7.6.0'
+		}
+		version := qemuVersion{major, minor}
+		if newest == "" || !newestVersion.atLeast(version) {
+			newest, newestVersion = m, version
+		}
+	}
+	return newest
+}
+
+// resolveChipset returns the machine type for chipset, selecting the newest
+// supported version for unversioned chipsets. Returns a MalformedPayloadError
+// if the chipset isn't supported.
+func (i *QEMUInfo) resolveChipset(chipset string) (string, error) {
+	if prefix, ok := unversionedChipsets[chipset]; ok {
+		machine := i.NewestMachine(prefix)
+		if machine == "" {
+			return "", runtime.NewMalformedPayloadError(
+				"Machine chipset '", chipset, "' isn't supported by QEMU ", i.Version,
+			)
+		}
+		return machine, nil
+	}
+	if !i.SupportsMachine(chipset) {
+		return "", runtime.NewMalformedPayloadError(
+			"Machine chipset '", chipset, "' isn't supported by QEMU ", i.Version,
+		)
+	}
+	return chipset, nil
+}
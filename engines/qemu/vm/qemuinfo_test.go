@@ -0,0 +1,62 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const machineHelp = `Supported machines are:
+pc                   Standard PC (i440FX + PIIX, 1996) (alias of pc-i440fx-2.11)
+pc-i440fx-2.11       Standard PC (i440FX + PIIX, 1996) (default)
+pc-i440fx-2.8        Standard PC (i440FX + PIIX, 1996)
+pc-i440fx-2.10       Standard PC (i440FX + PIIX, 1996)
+q35                  Standard PC (Q35 + ICH9, 2009) (alias of pc-q35-2.11)
+pc-q35-2.11          Standard PC (Q35 + ICH9, 2009)
+pc-q35-rhel7.6.0     RHEL 7.6.0 PC (Q35 + ICH9, 2009)
+none                 empty machine
+`
+
+const cpuHelp = `Available CPUs:
+x86              486
+x86   Haswell-noTSX  Intel Core Processor (Haswell, no TSX)
+x86             host  KVM processor with all supported host features
+x86              max  Enables all features supported by the accelerator in the current host
+
+Recognized CPUID flags:
+  fpu vme de pse tsc msr pae mce cx8 apic sep mtrr pge mca cmov
+`
+
+func TestQEMUInfo(t *testing.T) {
+	version, v, err := parseQEMUVersion(
+		"QEMU emulator version 2.11.1(Debian 1:2.11+dfsg-1ubuntu7.41)\nCopyright (c) 2003-2017",
+	)
+	require.NoError(t, err)
+	assert.Equal(t, "2.11.1", version)
+	_, _, err = parseQEMUVersion("qemu-img version 2.11.1")
+	assert.Error(t, err)
+
+	info := &QEMUInfo{
+		Version:  version,
+		Machines: parseMachineHelp(machineHelp),
+		version:  v,
+	}
+	assert.True(t, info.SupportsMachine("pc-i440fx-2.8"))
+	assert.False(t, info.SupportsMachine("pc-q35-2.8"))
+	assert.Equal(t, "pc-i440fx-2.11", info.NewestMachine("pc-i440fx-"))
+	assert.Equal(t, "pc-q35-2.11", info.NewestMachine("pc-q35-"))
+	assert.False(t, info.Supports(FeatureVirtioFS))
+
+	assert.Equal(t, []string{"486", "Haswell-noTSX", "host", "max"}, parseCPUHelp(cpuHelp))
+
+	chipset, err := info.resolveChipset("pc-q35")
+	require.NoError(t, err)
+	assert.Equal(t, "pc-q35-2.11", chipset)
+	_, err = info.resolveChipset("pc-q35-2.8")
+	assert.Error(t, err)
+
+	info.version = qemuVersion{5, 0}
+	assert.True(t, info.Supports(FeatureVirtioFS))
+	assert.False(t, info.Supports(FeatureQcow2Zstd))
+}
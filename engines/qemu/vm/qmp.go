@@ -0,0 +1,220 @@
+package vm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-qemu/qmp"
+)
+
+// errQMPNotConnected is returned from runQMP if the QMP monitor isn't
+// connected, either because the VM is still starting or it has stopped.
+var errQMPNotConnected = errors.New("QMP monitor is not connected")
+
+// runQMP executes a QMP command against the QMP monitor on qmp.sock, returning
+// the raw JSON response.
+func (vm *VirtualMachine) runQMP(command string, args map[string]interface{}) ([]byte, error) {
+	vm.m.Lock()
+	domain := vm.domain
+	vm.m.Unlock()
+
+	// domain is only set after the QMP monitor have been connected, and it is
+	// closed when QEMU terminates
+	if domain == nil {
+		return nil, errQMPNotConnected
+	}
+	select {
+	case <-vm.Done:
+		return nil, errQMPNotConnected
+	default:
+	}
+
+	debug("executing QMP command: %s", command)
+	cmd := qmp.Command{Execute: command}
+	if args != nil {
+		cmd.Args = args // Don't send "arguments": null
+	}
+	result, err := domain.Run(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("QMP command '%s' failed, error: %s", command, err)
+	}
+	return result, nil
+}
+
+// DumpGuestMemory writes the guest memory to file as a zlib compressed kdump,
+// which can be analyzed with the 'crash' utility. The file must be writable by
+// QEMU, this blocks until the dump is complete.
+func (vm *VirtualMachine) DumpGuestMemory(file string) error {
+	_, err := vm.runQMP("dump-guest-memory", map[string]interface{}{
+		"paging":   false,
+		"protocol": "file:" + file,
+		"format":   "kdump-zlib",
+	})
+	return err
+}
+
+// Shutdown the virtual machine gracefully by sending an ACPI power button
+// event, if QEMU hasn't terminated within gracePeriod it'll be killed.
+//
+// If gracePeriod is zero, this is equivalent to Kill(). This method can only
+// be called after Start(), and will return when the VM is stopped.
+func (vm *VirtualMachine) Shutdown(gracePeriod time.Duration) {
+	select {
+	case <-vm.Done:
+		return // Already stopped
+	default:
+	}
+	if gracePeriod <= 0 {
+		vm.Kill()
+		return
+	}
+
+	// Request ACPI powerdown, if this fails we kill QEMU right away
+	if _, err := vm.runQMP("system_powerdown", nil); err != nil {
+		debug("failed to request ACPI powerdown, error: %s", err)
+		vm.Kill()
+		return
+	}
+
+	debug("waiting up to %s for guest to power down", gracePeriod)
+	timer := time.NewTimer(gracePeriod)
+	defer timer.Stop()
+	select {
+	case <-vm.Done:
+		debug("guest powered down gracefully")
+	case <-timer.C:
+		vm.monitor.Warnf("guest didn't power down within %s, killing QEMU", gracePeriod)
+		vm.Kill()
+	}
+}
+
+// Quit terminates QEMU through the QMP monitor, unlike Kill() this allows QEMU
+// to flush and close disk files cleanly, but gives the guest no chance to shut
+// down. If the quit command fails QEMU will be killed.
+//
+// This method can only be called after Start(), and will return when the VM
+// is stopped.
+func (vm *VirtualMachine) Quit() {
+	select {
+	case <-vm.Done:
+		return // Already stopped
+	default:
+	}
+
+	if _, err := vm.runQMP("quit", nil); err != nil {
+		debug("failed to quit QEMU, error: %s", err)
+		vm.Kill()
+		return
+	}
+	<-vm.Done
+}
+
+// SaveSnapshot pauses the virtual machine and saves the running-state as an
+// internal snapshot with the given name in the qcow2 disk file.
+//
+// The virtual machine remains paused, callers will typically Quit() the
+// virtual machine and package the image afterwards.
+func (vm *VirtualMachine) SaveSnapshot(name string) error {
+	if _, err := vm.runQMP("stop", nil); err != nil {
+		return err
+	}
+
+	// QMP doesn't have a savevm command, so we use the human monitor, which
+	// reports errors as output rather than QMP errors.
+	result, err := vm.runQMP("human-monitor-command", map[string]interface{}{
+		"command-line": "savevm " + name,
+	})
+	if err != nil {
+		return err
+	}
+	var response struct {
+		Return string `json:"return"`
+	}
+	if err = json.Unmarshal(result, &response); err != nil {
+		return fmt.Errorf("failed to parse response from savevm, error: %s", err)
+	}
+	if output := strings.TrimSpace(response.Return); output != "" {
+		return fmt.Errorf("failed to save snapshot '%s', error: %s", name, output)
+	}
+	return nil
+}
+
+// ScreenDump writes the current content of the screen to file in PPM format.
+func (vm *VirtualMachine) ScreenDump(file string) error {
+	_, err := vm.runQMP("screendump", map[string]interface{}{
+		"filename": file,
+	})
+	return err
+}
+
+// balloonDevice is the QOM path of the virtio-balloon device
+const balloonDevice = "/machine/peripheral/balloon-0"
+
+// SetBalloon requests the guest to resize its memory to the given size in MiB
+// by inflating or deflating the balloon device. The guest adjusts the balloon
+// asynchronously, use QueryBalloon() to get the actual memory size.
+func (vm *VirtualMachine) SetBalloon(memory int) error {
+	_, err := vm.runQMP("balloon", map[string]interface{}{
+		"value": int64(memory) * 1024 * 1024,
+	})
+	return err
+}
+
+// QueryBalloon returns the memory currently available to the guest in MiB.
+func (vm *VirtualMachine) QueryBalloon() (int, error) {
+	result, err := vm.runQMP("query-balloon", nil)
+	if err != nil {
+		return 0, err
+	}
+	var response struct {
+		Return struct {
+			Actual int64 `json:"actual"`
+		} `json:"return"`
+	}
+	if err = json.Unmarshal(result, &response); err != nil {
+		return 0, fmt.Errorf("failed to parse response from query-balloon, error: %s", err)
+	}
+	return int(response.Return.Actual / (1024 * 1024)), nil
+}
+
+// EnableBalloonStats makes the guest report memory statistics through the
+// balloon device at the given interval, see BalloonFreeMemory().
+func (vm *VirtualMachine) EnableBalloonStats(interval time.Duration) error {
+	_, err := vm.runQMP("qom-set", map[string]interface{}{
+		"path":     balloonDevice,
+		"property": "guest-stats-polling-interval",
+		"value":    int64(interval / time.Second),
+	})
+	return err
+}
+
+// BalloonFreeMemory returns the memory not used by the guest in MiB, as last
+// reported through the balloon device. Returns -1 if the guest hasn't reported
+// memory statistics, which requires EnableBalloonStats() and a guest driver.
+func (vm *VirtualMachine) BalloonFreeMemory() (int, error) {
+	result, err := vm.runQMP("qom-get", map[string]interface{}{
+		"path":     balloonDevice,
+		"property": "guest-stats",
+	})
+	if err != nil {
+		return 0, err
+	}
+	var response struct {
+		Return struct {
+			Stats      map[string]int64 `json:"stats"`
+			LastUpdate int64            `json:"last-update"`
+		} `json:"return"`
+	}
+	if err = json.Unmarshal(result, &response); err != nil {
+		return 0, fmt.Errorf("failed to parse response from qom-get, error: %s", err)
+	}
+	// QEMU reports -1 for statistics the guest haven't provided
+	free, ok := response.Return.Stats["stat-free-memory"]
+	if response.Return.LastUpdate == 0 || !ok || free < 0 {
+		return -1, nil
+	}
+	return int(free / (1024 * 1024)), nil
+}
@@ -0,0 +1,117 @@
+package vm
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+// maxScratchDisks is the maximum number of scratch disks, we put scratch disks
+// on PCI 0x9 and up, so this must keep us below 0xf where the RNG device is.
+const maxScratchDisks = 6
+
+// scratchDisk is a sparse raw disk file created when the virtual machine is
+// started.
+type scratchDisk struct {
+	file string
+	size int64 // size in bytes
+}
+
+// AddScratchDisk attaches an empty disk with the given size in MiB to the
+// virtual machine as a virtio-blk or virtio-scsi disk, depending on storage. The disk is backed by a sparse raw
+// file, which is created by Start() and deleted when QEMU terminates.
+//
+// Returns a MalformedPayloadError if the disk can't be added to the machine.
+// This must be called before Start().
+func (vm *VirtualMachine) AddScratchDisk(size int) error {
+	vm.m.Lock()
+	defer vm.m.Unlock()
+	if vm.started {
+		panic("AddScratchDisk() cannot be called after Start()")
+	}
+	if size <= 0 {
+		panic(fmt.Sprintf("scratch disk size %d MiB is not valid", size))
+	}
+
+	o := vm.machine.options
+	if o.Snapshot != "" {
+		return runtime.NewMalformedPayloadError(
+			"Scratch disks cannot be used with machines resuming from snapshot: '",
+			o.Snapshot, "'",
+		)
+	}
+	if len(vm.scratchDisks) >= maxScratchDisks {
+		return runtime.NewMalformedPayloadError(
+			"Virtual machines cannot have more than ", maxScratchDisks, " scratch disks",
+		)
+	}
+
+	index := len(vm.scratchDisks) + 1 // virtio-disk0 is the boot disk
+	id := fmt.Sprintf("scratch-disk%d", index)
+	file := filepath.Join(vm.socketFolder, id+".img")
+	if vm.scratchDir != "" {
+		// Prefix with the name of the socket folder, as it's unique per machine
+		file = filepath.Join(vm.scratchDir, filepath.Base(vm.socketFolder)+"-"+id+".img")
+	}
+	disk := scratchDisk{
+		file: file,
+		size: int64(size) * 1024 * 1024,
+	}
+	drive := fmt.Sprintf(
+		"file=%s,if=none,id=%s,cache=unsafe,aio=threads,format=raw,werror=report,rerror=report",
+		disk.file, id,
+	) + driveDiscard(o.Storage) + vm.throttling.optionSuffix()
+	vm.qemu.Args = append(vm.qemu.Args,
+		"-drive", drive,
+		"-device", fmt.Sprintf(
+			"%s,id=virtio-disk%d",
+			diskDevice(o.Storage, o.Chipset, id, 0x8+index), index, // scratch disks on PCI 0x9 and up
+		),
+	)
+	vm.scratchDisks = append(vm.scratchDisks, disk)
+	return nil
+}
+
+// SetScratchFolder sets the folder in which files for scratch disks are
+// created, by default these are created in the socket folder. This is useful
+// if the socket folder is on a tmpfs. This must be called before
+// AddScratchDisk().
+func (vm *VirtualMachine) SetScratchFolder(folder string) {
+	vm.m.Lock()
+	defer vm.m.Unlock()
+	if len(vm.scratchDisks) > 0 {
+		panic("SetScratchFolder() cannot be called after AddScratchDisk()")
+	}
+	vm.scratchDir = folder
+}
+
+// createScratchDisks creates sparse files for scratch disks, these are
+// removed by removeScratchDisks() when QEMU terminates.
+func (vm *VirtualMachine) createScratchDisks() error {
+	for _, disk := range vm.scratchDisks {
+		f, err := os.OpenFile(disk.file, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+		if err != nil {
+			return errors.Wrap(err, "failed to create scratch disk")
+		}
+		err = f.Truncate(disk.size)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to allocate scratch disk")
+		}
+	}
+	return nil
+}
+
+// removeScratchDisks removes the files for scratch disks, if created
+func (vm *VirtualMachine) removeScratchDisks() {
+	for _, disk := range vm.scratchDisks {
+		if err := os.Remove(disk.file); err != nil && !os.IsNotExist(err) {
+			vm.monitor.ReportWarning(err, "failed to remove scratch disk")
+		}
+	}
+}
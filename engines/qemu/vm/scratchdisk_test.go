@@ -0,0 +1,77 @@
+package vm
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScratchDisks(t *testing.T) {
+	folder, err := ioutil.TempDir("", "scratch-disk-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+
+	vm := &VirtualMachine{
+		machine:      defaultMachine,
+		socketFolder: folder,
+		qemu:         exec.Command("qemu-system-x86_64"),
+	}
+	for i := 0; i < maxScratchDisks; i++ {
+		require.NoError(t, vm.AddScratchDisk(16))
+	}
+	assert.Error(t, vm.AddScratchDisk(16), "expected too many scratch disks to fail")
+	assert.Contains(t, vm.qemu.Args, "virtio-blk-pci,scsi=off,bus=pci.0,addr=0x9,drive=scratch-disk1,id=virtio-disk1")
+
+	require.NoError(t, vm.createScratchDisks())
+	info, err := os.Stat(filepath.Join(folder, "scratch-disk1.img"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(16*1024*1024), info.Size())
+}
+
+func TestScratchDisksWithSnapshot(t *testing.T) {
+	vm := &VirtualMachine{
+		machine: defaultMachine.WithSnapshot("booted"),
+		qemu:    exec.Command("qemu-system-x86_64"),
+	}
+	assert.Error(t, vm.AddScratchDisk(16), "expected scratch disks to be rejected with snapshots")
+}
+
+func TestScratchDisksWithSCSI(t *testing.T) {
+	m := defaultMachine
+	m.options.Storage = storageSCSI
+	vm := &VirtualMachine{
+		machine:      m,
+		socketFolder: "/tmp",
+		qemu:         exec.Command("qemu-system-x86_64"),
+	}
+	require.NoError(t, vm.AddScratchDisk(16))
+	assert.Contains(t, vm.qemu.Args, "scsi-hd,bus=scsi-disks.0,scsi-id=1,lun=0,drive=scratch-disk1,id=virtio-disk1")
+	assert.Contains(t, vm.qemu.Args[2], ",discard=unmap")
+}
+
+func TestScratchDisksInScratchFolder(t *testing.T) {
+	folder, err := ioutil.TempDir("", "scratch-disk-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+
+	vm := &VirtualMachine{
+		machine:      defaultMachine,
+		socketFolder: "/tmp/sockets/machine-slug",
+		qemu:         exec.Command("qemu-system-x86_64"),
+	}
+	vm.SetScratchFolder(folder)
+	require.NoError(t, vm.AddScratchDisk(16))
+	require.NoError(t, vm.createScratchDisks())
+	file := filepath.Join(folder, "machine-slug-scratch-disk1.img")
+	_, err = os.Stat(file)
+	require.NoError(t, err)
+
+	vm.removeScratchDisks()
+	_, err = os.Stat(file)
+	assert.True(t, os.IsNotExist(err))
+}
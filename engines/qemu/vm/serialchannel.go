@@ -0,0 +1,180 @@
+package vm
+
+import (
+	"net"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/taskcluster/webhooktunnel/wsmux"
+)
+
+// SerialPortName is the name of the virtio-serial port added by
+// EnableSerialChannel(). On Linux guests the port is available as
+// /dev/virtio-ports/org.taskcluster.guest-tools.0.
+const SerialPortName = "org.taskcluster.guest-tools.0"
+
+// SerialChannelPath is the path to which the guest must send a websocket
+// upgrade request over the serial port, before it can send HTTP requests.
+const SerialChannelPath = "/engine/v1/serial-channel"
+
+// serialStreamBufferSize is the buffer size for streams multiplexed over the
+// serial channel, this limits how much data can be in-flight on each stream.
+const serialStreamBufferSize = 64 * 1024
+
+// serialRetryDelay is the time to wait before connecting to the serial socket
+// again, if QEMU hasn't created it yet.
+const serialRetryDelay = 250 * time.Millisecond
+
+const serialSocketFile = "serial.sock"
+
+var errListenerClosed = errors.New("listener is closed")
+
+var serialUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4 * 1024,
+	WriteBufferSize: 4 * 1024,
+}
+
+// EnableSerialChannel adds a virtio-serial port named SerialPortName, over
+// which the HTTP handler given to SetHTTPHandler() is served. This allows
+// guest-tools to reach the meta-data service even if the task has broken
+// networking in the guest.
+//
+// The guest opens the channel by sending a websocket upgrade request for
+// SerialChannelPath over the port, and then opens a stream for each HTTP
+// connection using wsmux. If the websocket connection is lost the host waits
+// for a new upgrade request.
+//
+// This must be called before Start().
+func (vm *VirtualMachine) EnableSerialChannel() {
+	vm.m.Lock()
+	defer vm.m.Unlock()
+	if vm.started {
+		panic("EnableSerialChannel() cannot be called after Start()")
+	}
+	vm.serial = true
+
+	socket := filepath.Join(vm.socketFolder, serialSocketFile)
+	vm.qemu.Args = append(vm.qemu.Args,
+		"-device", "virtio-serial,id=virtio-serial-0",
+		"-chardev", "socket,id=serial-channel,path="+socket+",server,nowait",
+		"-device", "virtserialport,bus=virtio-serial-0.0,chardev=serial-channel,name="+SerialPortName,
+	)
+}
+
+// serialHandler returns the handler set with SetHTTPHandler()
+func (vm *VirtualMachine) serialHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vm.m.Lock()
+		handler := vm.handler
+		vm.m.Unlock()
+		if handler == nil {
+			http.Error(w, "meta-data service isn't available yet", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// serveSerialChannel connects to the serial socket created by QEMU and serves
+// the HTTP handler over it, until QEMU terminates.
+func (vm *VirtualMachine) serveSerialChannel(socket string) {
+	for {
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			select {
+			case <-vm.Done:
+				return
+			case <-time.After(serialRetryDelay):
+				continue
+			}
+		}
+		vm.serveSerialConn(conn)
+		conn.Close()
+	}
+}
+
+// serveSerialConn waits for a websocket upgrade request on conn, and serves
+// the HTTP handler over the wsmux session until it's closed.
+func (vm *VirtualMachine) serveSerialConn(conn net.Conn) {
+	c := &notifyConn{Conn: conn, closed: make(chan struct{})}
+	l := &connListener{conn: c, done: make(chan struct{})}
+	defer l.Close()
+
+	upgraded := make(chan *websocket.Conn, 1)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != SerialChannelPath {
+			http.NotFound(w, r)
+			return
+		}
+		ws, err := serialUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			debug("serial channel upgrade failed, error: %s", err)
+			return
+		}
+		upgraded <- ws
+	})}
+	go server.Serve(l)
+
+	var ws *websocket.Conn
+	select {
+	case ws = <-upgraded:
+	case <-c.closed:
+		return // connection was closed without an upgrade
+	}
+
+	debug("serial channel established")
+	session := wsmux.Server(ws, wsmux.Config{StreamBufferSize: serialStreamBufferSize})
+	http.Serve(session, vm.serialHandler())
+	session.Close()
+	debug("serial channel closed")
+}
+
+// notifyConn is a net.Conn that closes a channel when it's closed
+type notifyConn struct {
+	net.Conn
+	once   sync.Once
+	closed chan struct{}
+}
+
+func (c *notifyConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return c.Conn.Close()
+}
+
+// connListener is a net.Listener that accepts a single connection
+type connListener struct {
+	m    sync.Mutex
+	conn net.Conn
+	once sync.Once
+	done chan struct{}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	l.m.Lock()
+	conn := l.conn
+	l.conn = nil
+	l.m.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.done
+	return nil, errListenerClosed
+}
+
+func (l *connListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return serialAddr{}
+}
+
+type serialAddr struct{}
+
+func (serialAddr) Network() string { return "virtio-serial" }
+func (serialAddr) String() string  { return SerialPortName }
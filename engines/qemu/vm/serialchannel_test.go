@@ -0,0 +1,85 @@
+package vm
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/webhooktunnel/wsmux"
+)
+
+func TestEnableSerialChannel(t *testing.T) {
+	vm := &VirtualMachine{
+		machine:      defaultMachine,
+		socketFolder: "/tmp/sockets",
+		qemu:         exec.Command("qemu-system-x86_64"),
+	}
+	vm.EnableSerialChannel()
+	assert.Equal(t, []string{
+		"qemu-system-x86_64",
+		"-device", "virtio-serial,id=virtio-serial-0",
+		"-chardev", "socket,id=serial-channel,path=/tmp/sockets/serial.sock,server,nowait",
+		"-device", "virtserialport,bus=virtio-serial-0.0,chardev=serial-channel,name=org.taskcluster.guest-tools.0",
+	}, vm.qemu.Args)
+}
+
+func TestServeSerialConn(t *testing.T) {
+	folder, err := ioutil.TempDir("", "serial-channel-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+
+	vm := &VirtualMachine{}
+	vm.SetHTTPHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello " + r.URL.Path))
+	}))
+
+	// Use a unix socket, like the chardev socket created by QEMU
+	l, err := net.Listen("unix", filepath.Join(folder, "serial.sock"))
+	require.NoError(t, err)
+	defer l.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		host, err := l.Accept()
+		if !assert.NoError(t, err) {
+			return
+		}
+		vm.serveSerialConn(host)
+		host.Close()
+	}()
+	guest, err := net.Dial("unix", l.Addr().String())
+	require.NoError(t, err)
+	defer guest.Close()
+
+	// Open the serial channel like guest-tools does
+	u := &url.URL{Scheme: "ws", Host: "169.254.169.254", Path: SerialChannelPath}
+	ws, _, err := websocket.NewClient(guest, u, nil, 4*1024, 4*1024)
+	require.NoError(t, err)
+	session := wsmux.Client(ws, wsmux.Config{})
+
+	client := http.Client{Transport: &http.Transport{
+		Dial: func(network, addr string) (net.Conn, error) {
+			conn, _, err := session.Open()
+			return conn, err
+		},
+	}}
+	for i := 0; i < 3; i++ {
+		res, err := client.Get("http://169.254.169.254/engine/v1/ping")
+		require.NoError(t, err)
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		require.NoError(t, err)
+		assert.Equal(t, "hello /engine/v1/ping", string(data))
+	}
+
+	session.Close()
+	<-done
+}
@@ -0,0 +1,76 @@
+package vm
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+// maxVolumes is the maximum number of shared folders and disk volumes, we put
+// volumes on PCI 0x10 and up, so this must keep us below 0x1b where the
+// watchdog is.
+const maxVolumes = 11
+
+// sharedFolderTagPattern restricts mount tags for virtio-9p, which has a limit
+// of 31 characters and must be safe to pass as QEMU option.
+var sharedFolderTagPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,31}$`)
+
+// AddSharedFolder exposes a host folder to the guest using the sharedFolders
+// device specified in the machine definition. The guest can mount the folder
+// using the given tag, for virtio-9p-pci on Linux this is done with:
+//
+//   mount -t 9p -o trans=virtio,version=9p2000.L <tag> <mountpoint>
+//
+// Returns a MalformedPayloadError if the machine definition doesn't support
+// shared folders. This must be called before Start().
+func (vm *VirtualMachine) AddSharedFolder(tag, folder string, readOnly bool) error {
+	vm.m.Lock()
+	defer vm.m.Unlock()
+	if vm.started {
+		panic("AddSharedFolder() cannot be called after Start()")
+	}
+	if !sharedFolderTagPattern.MatchString(tag) {
+		panic(fmt.Sprintf("shared folder tag '%s' is not valid", tag))
+	}
+
+	o := vm.machine.options
+	if o.SharedFolders == "none" {
+		return runtime.NewMalformedPayloadError(
+			"The machine definition doesn't support shared folders, ",
+			"'sharedFolders' in 'machine.json' must be set to use volumes",
+		)
+	}
+	if o.Snapshot != "" {
+		return runtime.NewMalformedPayloadError(
+			"Shared folders cannot be used with machines resuming from snapshot: '",
+			o.Snapshot, "'",
+		)
+	}
+	if vm.volumes >= maxVolumes {
+		return runtime.NewMalformedPayloadError(
+			"Virtual machines cannot have more than ", maxVolumes, " volumes",
+		)
+	}
+
+	id := fmt.Sprintf("fsdev-%d", vm.volumes)
+	fsdev := fmt.Sprintf(
+		"local,id=%s,path=%s,security_model=mapped-xattr",
+		id, strings.Replace(folder, ",", ",,", -1), // QEMU escapes commas as ',,'
+	)
+	if readOnly {
+		fsdev += ",readonly"
+	}
+	fsdev += vm.throttling.optionSuffix()
+	vm.qemu.Args = append(vm.qemu.Args,
+		"-fsdev", fsdev,
+		"-device", fmt.Sprintf(
+			"%s,fsdev=%s,mount_tag=%s,bus=%s,addr=0x%x",
+			o.SharedFolders, id, tag, pciBus(o.Chipset),
+			0x10+vm.volumes, // volumes on PCI 0x10 and up
+		),
+	)
+	vm.volumes++
+	return nil
+}
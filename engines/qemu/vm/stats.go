@@ -0,0 +1,119 @@
+package vm
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// clockTicks is USER_HZ, the unit of CPU times in /proc/<pid>/stat, this is
+// 100 on all architectures we support.
+const clockTicks = 100
+
+// ProcessStats is the resource usage of the QEMU process.
+type ProcessStats struct {
+	CPUTime    time.Duration // user and system CPU time consumed
+	Memory     int64         // resident memory in bytes
+	PeakMemory int64         // peak resident memory in bytes
+}
+
+// ProcessStats returns the resource usage of the QEMU process, this can only
+// be called after Start().
+func (vm *VirtualMachine) ProcessStats() (ProcessStats, error) {
+	vm.m.Lock()
+	process := vm.qemu.Process
+	vm.m.Unlock()
+	if process == nil {
+		return ProcessStats{}, errors.New("QEMU process isn't running")
+	}
+
+	var stats ProcessStats
+	proc := fmt.Sprintf("/proc/%d/", process.Pid)
+	data, err := ioutil.ReadFile(proc + "stat")
+	if err != nil {
+		return stats, errors.Wrap(err, "failed to read process stat")
+	}
+	if stats.CPUTime, err = parseProcStat(data); err != nil {
+		return stats, err
+	}
+	data, err = ioutil.ReadFile(proc + "status")
+	if err != nil {
+		return stats, errors.Wrap(err, "failed to read process status")
+	}
+	stats.Memory, stats.PeakMemory, err = parseProcStatus(data)
+	return stats, err
+}
+
+// parseProcStat returns user and system CPU time from /proc/<pid>/stat
+func parseProcStat(data []byte) (time.Duration, error) {
+	// Skip the command name, which may contain spaces and parentheses
+	i := bytes.LastIndexByte(data, ')')
+	if i == -1 {
+		return 0, errors.New("unable to parse process stat")
+	}
+	// Fields after the command name starts with state, utime and stime are the
+	// 12th and 13th field
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 13 {
+		return 0, errors.New("unable to parse process stat")
+	}
+	utime, err1 := strconv.ParseInt(fields[11], 10, 64)
+	stime, err2 := strconv.ParseInt(fields[12], 10, 64)
+	if err1 != nil || err2 != nil {
+		return 0, errors.New("unable to parse CPU time in process stat")
+	}
+	return time.Duration(utime+stime) * time.Second / clockTicks, nil
+}
+
+// parseProcStatus returns VmRSS and VmHWM from /proc/<pid>/status in bytes
+func parseProcStatus(data []byte) (rss, hwm int64, err error) {
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 2 || (fields[0] != "VmRSS:" && fields[0] != "VmHWM:") {
+			continue
+		}
+		kb, perr := strconv.ParseInt(fields[1], 10, 64)
+		if perr != nil {
+			return 0, 0, errors.Errorf("unable to parse %s in process status", fields[0])
+		}
+		if fields[0] == "VmRSS:" {
+			rss = kb * 1024
+		} else {
+			hwm = kb * 1024
+		}
+	}
+	return rss, hwm, nil
+}
+
+// BlockStats returns the total number of bytes read and written by all block
+// devices attached to the virtual machine.
+func (vm *VirtualMachine) BlockStats() (read, written int64, err error) {
+	result, err := vm.runQMP("query-blockstats", nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	var response struct {
+		Return []struct {
+			Stats struct {
+				ReadBytes    int64 `json:"rd_bytes"`
+				WrittenBytes int64 `json:"wr_bytes"`
+			} `json:"stats"`
+		} `json:"return"`
+	}
+	if err = json.Unmarshal(result, &response); err != nil {
+		return 0, 0, fmt.Errorf("failed to parse response from query-blockstats, error: %s", err)
+	}
+	for _, device := range response.Return {
+		read += device.Stats.ReadBytes
+		written += device.Stats.WrittenBytes
+	}
+	return read, written, nil
+}
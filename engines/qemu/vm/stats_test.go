@@ -0,0 +1,27 @@
+package vm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProcStat(t *testing.T) {
+	stat := "4242 (qemu-system-x86) S 1 4242 4242 0 -1 4194624 1234 0 0 0 250 150 0 0 20 0 5 0 100 0"
+	d, err := parseProcStat([]byte(stat))
+	require.NoError(t, err)
+	assert.Equal(t, 4*time.Second, d)
+
+	_, err = parseProcStat([]byte("4242 (qemu"))
+	assert.Error(t, err)
+}
+
+func TestParseProcStatus(t *testing.T) {
+	status := "Name:\tqemu-system-x86\nVmHWM:\t  2048 kB\nVmRSS:\t  1024 kB\nThreads:\t5\n"
+	rss, hwm, err := parseProcStatus([]byte(status))
+	require.NoError(t, err)
+	assert.Equal(t, int64(1024*1024), rss)
+	assert.Equal(t, int64(2048*1024), hwm)
+}
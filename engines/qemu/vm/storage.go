@@ -0,0 +1,32 @@
+package vm
+
+import "fmt"
+
+// storageSCSI is the storage device that attaches disks as SCSI disks on a
+// single virtio-scsi controller, rather than as virtio-blk-pci devices. Unlike
+// virtio-blk this supports discard, so guest TRIM frees space on the host.
+const storageSCSI = "virtio-scsi-pci"
+
+// scsiDiskController is the id of the virtio-scsi controller for disks, which
+// takes PCI 0x8 where the boot disk is with virtio-blk.
+const scsiDiskController = "scsi-disks"
+
+// diskDevice returns the value for the -device option attaching drive with the
+// given storage device. With virtio-blk the disk is put on PCI slot, with
+// virtio-scsi the disk is SCSI target slot-0x8 on the disk controller, such
+// that the boot disk is target 0.
+func diskDevice(storage, chipset, drive string, slot int) string {
+	if storage == storageSCSI {
+		return fmt.Sprintf("scsi-hd,bus=%s.0,scsi-id=%d,lun=0,drive=%s", scsiDiskController, slot-0x8, drive)
+	}
+	return fmt.Sprintf("virtio-blk-pci,scsi=off,bus=%s,addr=0x%x,drive=%s", pciBus(chipset), slot, drive)
+}
+
+// driveDiscard returns the suffix for the -drive option enabling discard, if
+// supported by the storage device.
+func driveDiscard(storage string) string {
+	if storage == storageSCSI {
+		return ",discard=unmap"
+	}
+	return ""
+}
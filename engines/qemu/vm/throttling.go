@@ -0,0 +1,135 @@
+package vm
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+	schematypes "github.com/taskcluster/go-schematypes"
+	"github.com/taskcluster/taskcluster-worker/runtime/util"
+)
+
+// DiskThrottling limits disk I/O for the boot disk and shared folders of a
+// virtual machine, zero values means unlimited.
+type DiskThrottling struct {
+	IOPSTotal int `json:"iopsTotal"`
+	IOPSRead  int `json:"iopsRead"`
+	IOPSWrite int `json:"iopsWrite"`
+	BPSTotal  int `json:"bpsTotal"`
+	BPSRead   int `json:"bpsRead"`
+	BPSWrite  int `json:"bpsWrite"`
+}
+
+const (
+	maxIOPS = 10 * 1000 * 1000
+	maxBPS  = 1024 * 1024 * 1024 * 1024 // 1 TiB/s
+)
+
+// DiskThrottlingSchema is the schema for DiskThrottling.
+var DiskThrottlingSchema = schematypes.Object{
+	Title: "Disk Throttling",
+	Description: util.Markdown(`
+		Disk I/O limits for the boot disk and each shared folder of a virtual
+		machine. This ensures that a single task with heavy disk I/O cannot
+		starve other virtual machines sharing the same host disk.
+
+		Limits are given in operations per second (iops) and bytes per second
+		(bps), omitted or zero values are unlimited. Total limits cannot be
+		combined with read/write limits of the same kind.
+	`),
+	Properties: schematypes.Properties{
+		"iopsTotal": schematypes.Integer{
+			Title:   "Total IOPS",
+			Minimum: 0,
+			Maximum: maxIOPS,
+		},
+		"iopsRead": schematypes.Integer{
+			Title:   "Read IOPS",
+			Minimum: 0,
+			Maximum: maxIOPS,
+		},
+		"iopsWrite": schematypes.Integer{
+			Title:   "Write IOPS",
+			Minimum: 0,
+			Maximum: maxIOPS,
+		},
+		"bpsTotal": schematypes.Integer{
+			Title:   "Total Bytes per Second",
+			Minimum: 0,
+			Maximum: maxBPS,
+		},
+		"bpsRead": schematypes.Integer{
+			Title:   "Read Bytes per Second",
+			Minimum: 0,
+			Maximum: maxBPS,
+		},
+		"bpsWrite": schematypes.Integer{
+			Title:   "Write Bytes per Second",
+			Minimum: 0,
+			Maximum: maxBPS,
+		},
+	},
+}
+
+// Validate returns an error if total limits are combined with read/write
+// limits, as this is rejected by QEMU.
+func (t DiskThrottling) Validate() error {
+	if t.IOPSTotal != 0 && (t.IOPSRead != 0 || t.IOPSWrite != 0) {
+		return errors.New("diskThrottling: 'iopsTotal' cannot be combined with 'iopsRead' or 'iopsWrite'")
+	}
+	if t.BPSTotal != 0 && (t.BPSRead != 0 || t.BPSWrite != 0) {
+		return errors.New("diskThrottling: 'bpsTotal' cannot be combined with 'bpsRead' or 'bpsWrite'")
+	}
+	return nil
+}
+
+// options returns QEMU 'throttling.*' options for -drive and -fsdev
+func (t DiskThrottling) options() map[string]string {
+	options := make(map[string]string)
+	set := func(key string, value int) {
+		if value != 0 {
+			options["throttling."+key] = strconv.Itoa(value)
+		}
+	}
+	set("iops-total", t.IOPSTotal)
+	set("iops-read", t.IOPSRead)
+	set("iops-write", t.IOPSWrite)
+	set("bps-total", t.BPSTotal)
+	set("bps-read", t.BPSRead)
+	set("bps-write", t.BPSWrite)
+	return options
+}
+
+// qmpArgs returns arguments for the QMP command block_set_io_throttle for the
+// device with the given id, or nil if I/O is unlimited.
+func (t DiskThrottling) qmpArgs(id string) map[string]interface{} {
+	if t == (DiskThrottling{}) {
+		return nil
+	}
+	return map[string]interface{}{
+		"id":      id,
+		"iops":    t.IOPSTotal,
+		"iops_rd": t.IOPSRead,
+		"iops_wr": t.IOPSWrite,
+		"bps":     t.BPSTotal,
+		"bps_rd":  t.BPSRead,
+		"bps_wr":  t.BPSWrite,
+	}
+}
+
+// optionSuffix returns QEMU 'throttling.*' options as a string to be appended
+// to -drive or -fsdev options, sorted for consistency.
+func (t DiskThrottling) optionSuffix() string {
+	options := t.options()
+	keys := make([]string, 0, len(options))
+	for k := range options {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	suffix := ""
+	for _, k := range keys {
+		suffix += fmt.Sprintf(",%s=%s", k, options[k])
+	}
+	return suffix
+}
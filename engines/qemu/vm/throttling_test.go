@@ -0,0 +1,24 @@
+package vm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiskThrottling(t *testing.T) {
+	var throttling DiskThrottling
+	assert.NoError(t, throttling.Validate())
+	assert.Empty(t, throttling.options())
+
+	throttling = DiskThrottling{IOPSTotal: 500, BPSRead: 1024, BPSWrite: 2048}
+	assert.NoError(t, throttling.Validate())
+	assert.Equal(t, map[string]string{
+		"throttling.iops-total": "500",
+		"throttling.bps-read":   "1024",
+		"throttling.bps-write":  "2048",
+	}, throttling.options())
+
+	assert.Error(t, DiskThrottling{IOPSTotal: 500, IOPSWrite: 100}.Validate())
+	assert.Error(t, DiskThrottling{BPSTotal: 500, BPSRead: 100}.Validate())
+}
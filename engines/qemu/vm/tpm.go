@@ -0,0 +1,92 @@
+package vm
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	tpmSocketFile  = "swtpm.sock"
+	tpmStateFolder = "tpm-state"
+)
+
+// tpmStartTimeout is the time to wait for swtpm to create its socket
+const tpmStartTimeout = 10 * time.Second
+
+// newTPM returns a swtpm process emulating a TPM 2.0 with state stored in
+// socketFolder, and the QEMU options for attaching it as the given device.
+// The process must be started with startTPM() before QEMU is started.
+func newTPM(device, socketFolder string) (*exec.Cmd, []string, error) {
+	if _, err := exec.LookPath("swtpm"); err != nil {
+		return nil, nil, errors.Wrap(err, "unable to find 'swtpm' which is required for TPM emulation")
+	}
+	socket := filepath.Join(socketFolder, tpmSocketFile)
+	tpm := exec.Command("swtpm", "socket", "--tpm2",
+		"--tpmstate", "dir="+filepath.Join(socketFolder, tpmStateFolder),
+		"--ctrl", "type=unixio,path="+socket,
+		"--terminate", // exit when QEMU disconnects
+	)
+	options := []string{
+		"-chardev", "socket,id=chrtpm,path=" + socket,
+		"-tpmdev", "emulator,id=tpm-0,chardev=chrtpm",
+		"-device", device + ",tpmdev=tpm-0",
+	}
+	return tpm, options, nil
+}
+
+// startTPM starts the swtpm process, if the machine has a TPM, and waits for
+// its socket to be created. The socketFolder must exist.
+func (vm *VirtualMachine) startTPM() error {
+	if vm.tpm == nil {
+		return nil
+	}
+	if err := os.Mkdir(filepath.Join(vm.socketFolder, tpmStateFolder), 0700); err != nil {
+		return errors.Wrap(err, "failed to create TPM state folder")
+	}
+	if err := vm.tpm.Start(); err != nil {
+		return errors.Wrap(err, "failed to start swtpm")
+	}
+	exited := make(chan struct{})
+	go func() {
+		vm.tpm.Wait()
+		close(exited)
+	}()
+	vm.tpmDone = exited
+
+	socket := filepath.Join(vm.socketFolder, tpmSocketFile)
+	deadline := time.Now().Add(tpmStartTimeout)
+	for {
+		if _, err := os.Stat(socket); err == nil {
+			return nil
+		}
+		select {
+		case <-exited:
+			return errors.New("swtpm exited before creating its socket")
+		case <-time.After(10 * time.Millisecond):
+		}
+		if time.Now().After(deadline) {
+			vm.stopTPM()
+			return errors.Errorf("swtpm didn't create its socket in %s", tpmStartTimeout)
+		}
+	}
+}
+
+// stopTPM kills the swtpm process, if running, and waits for it to exit.
+// Usually swtpm exits when QEMU disconnects, this ensures it doesn't outlive
+// QEMU if QEMU never connected.
+func (vm *VirtualMachine) stopTPM() {
+	if vm.tpmDone == nil {
+		return
+	}
+	select {
+	case <-vm.tpmDone:
+	default:
+		debug("terminating swtpm with SIGKILL")
+		vm.tpm.Process.Kill()
+		<-vm.tpmDone
+	}
+}
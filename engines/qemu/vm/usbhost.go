@@ -0,0 +1,93 @@
+package vm
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+// maxUSBHostDevices is the maximum number of host USB devices passed through to
+// a virtual machine, USB controllers have few ports, and keyboard, mouse and
+// tablet use the first ports.
+const maxUSBHostDevices = 4
+
+// Patterns for properties of USBHostDevice
+const (
+	USBIDPattern   = `^[0-9a-f]{4}$`
+	USBPortPattern = `^[1-9][0-9]*(\.[1-9][0-9]*)*$`
+)
+
+var (
+	usbIDPattern   = regexp.MustCompile(USBIDPattern)
+	usbPortPattern = regexp.MustCompile(USBPortPattern)
+)
+
+// USBHostDevice identifies a host USB device, either by VendorID and ProductID,
+// or by HostBus and HostPort.
+type USBHostDevice struct {
+	VendorID  string // 4 hex digits, as listed by 'lsusb'
+	ProductID string // 4 hex digits, as listed by 'lsusb'
+	HostBus   int    // USB bus number
+	HostPort  string // USB port path, such as '1.2'
+}
+
+// Validate returns an error if the USBHostDevice doesn't identify a device by
+// either VendorID and ProductID, or HostBus and HostPort.
+func (d USBHostDevice) Validate() error {
+	byID := d.VendorID != "" || d.ProductID != ""
+	byPort := d.HostBus != 0 || d.HostPort != ""
+	if byID == byPort {
+		return errors.New("USB device must be given by either vendor and product id, or bus and port")
+	}
+	if byID && (!usbIDPattern.MatchString(d.VendorID) || !usbIDPattern.MatchString(d.ProductID)) {
+		return errors.Errorf("USB vendor id '%s' and product id '%s' must be 4 hex digits", d.VendorID, d.ProductID)
+	}
+	if byPort && (d.HostBus <= 0 || !usbPortPattern.MatchString(d.HostPort)) {
+		return errors.Errorf("USB bus %d and port '%s' are not valid", d.HostBus, d.HostPort)
+	}
+	return nil
+}
+
+// AddUSBHostDevice attaches a host USB device to the virtual machine using
+// usb-host. The device is attached when it's plugged in, so it's fine if the
+// device is briefly disconnected, as phones and boards often are on reboot.
+//
+// Returns a MalformedPayloadError if the device can't be added to the machine.
+// This must be called before Start().
+func (vm *VirtualMachine) AddUSBHostDevice(device USBHostDevice) error {
+	vm.m.Lock()
+	defer vm.m.Unlock()
+	if vm.started {
+		panic("AddUSBHostDevice() cannot be called after Start()")
+	}
+	if err := device.Validate(); err != nil {
+		panic(err.Error())
+	}
+
+	o := vm.machine.options
+	if o.Snapshot != "" {
+		return runtime.NewMalformedPayloadError(
+			"USB devices cannot be used with machines resuming from snapshot: '",
+			o.Snapshot, "'",
+		)
+	}
+	if vm.usbDevices >= maxUSBHostDevices {
+		return runtime.NewMalformedPayloadError(
+			"Virtual machines cannot have more than ", maxUSBHostDevices, " USB devices",
+		)
+	}
+
+	var arg string
+	if device.VendorID != "" {
+		arg = fmt.Sprintf("usb-host,vendorid=0x%s,productid=0x%s", device.VendorID, device.ProductID)
+	} else {
+		arg = fmt.Sprintf("usb-host,hostbus=%d,hostport=%s", device.HostBus, device.HostPort)
+	}
+	vm.qemu.Args = append(vm.qemu.Args,
+		"-device", fmt.Sprintf("%s,bus=usb.0,id=usbhost-%d", arg, vm.usbDevices),
+	)
+	vm.usbDevices++
+	return nil
+}
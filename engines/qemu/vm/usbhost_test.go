@@ -0,0 +1,35 @@
+package vm
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUSBHostDeviceValidate(t *testing.T) {
+	assert.NoError(t, USBHostDevice{VendorID: "18d1", ProductID: "4ee7"}.Validate())
+	assert.NoError(t, USBHostDevice{HostBus: 1, HostPort: "1.2"}.Validate())
+	assert.Error(t, USBHostDevice{}.Validate())
+	assert.Error(t, USBHostDevice{VendorID: "18d1"}.Validate())
+	assert.Error(t, USBHostDevice{VendorID: "18D1X", ProductID: "4ee7"}.Validate())
+	assert.Error(t, USBHostDevice{HostBus: 1, HostPort: "1.0"}.Validate())
+	assert.Error(t, USBHostDevice{VendorID: "18d1", ProductID: "4ee7", HostBus: 1, HostPort: "1"}.Validate())
+}
+
+func TestAddUSBHostDevice(t *testing.T) {
+	vm := &VirtualMachine{
+		machine: defaultMachine,
+		qemu:    exec.Command("qemu-system-x86_64"),
+	}
+	require.NoError(t, vm.AddUSBHostDevice(USBHostDevice{VendorID: "18d1", ProductID: "4ee7"}))
+	require.NoError(t, vm.AddUSBHostDevice(USBHostDevice{HostBus: 3, HostPort: "1.2"}))
+	assert.Contains(t, vm.qemu.Args, "usb-host,vendorid=0x18d1,productid=0x4ee7,bus=usb.0,id=usbhost-0")
+	assert.Contains(t, vm.qemu.Args, "usb-host,hostbus=3,hostport=1.2,bus=usb.0,id=usbhost-1")
+
+	for i := 2; i < maxUSBHostDevices; i++ {
+		require.NoError(t, vm.AddUSBHostDevice(USBHostDevice{HostBus: 3, HostPort: "2"}))
+	}
+	assert.Error(t, vm.AddUSBHostDevice(USBHostDevice{HostBus: 3, HostPort: "3"}), "expected too many devices to fail")
+}
@@ -21,6 +21,7 @@ import (
 	pnm "github.com/jbuchbinder/gopnm"
 	"github.com/taskcluster/slugid-go/slugid"
 	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/limits"
 )
 
 const (
@@ -28,6 +29,10 @@ const (
 	qmpSocketFile = "qmp.sock"
 )
 
+// DefaultSocketTimeout is the default time to wait for QEMU to create the VNC
+// and QMP sockets, see SetSocketTimeout().
+const DefaultSocketTimeout = 90 * time.Second
+
 // LinuxBootOptions holds optionals boot options for Linux.
 // These are exclusively useful for building images and should not be used in
 // production when running per-task VMs. But they can greatly simplify image
@@ -53,11 +58,34 @@ type VirtualMachine struct {
 	Error        error           // Error, to be read after Done is closed
 	monitor      runtime.Monitor
 	domain       *qemu.Domain
+	machine      Machine // resolved machine definition
+	volumes      int     // number of shared folders and disk volumes added
+	passthrough  int     // number of host devices passed through
+	usbDevices   int     // number of host USB devices passed through
+	accelerator  string  // AccelKVM or AccelTCG
+	throttling   DiskThrottling
+	scratchDisks []scratchDisk // scratch disks created by Start()
+	tpm          *exec.Cmd     // swtpm process, nil if the machine has no TPM
+	tpmDone      chan struct{} // closed when swtpm exits, nil if not started
+	eventHandler func(Event)   // called for QMP events, nil if not set
+	hotplug      []hotplugDisk // disks to attach with QMP before execution starts
+	qemuInfo     *QEMUInfo     // version and machine types of QEMU
+	vncPassword  string        // password for the VNC socket, empty if not enabled
+	vncReady     chan struct{} // closed when vncPassword has been set with QMP
+	output       outputLog     // last lines written by QEMU to stdout/stderr
+	scratchDir   string        // folder for scratch disks, socketFolder if empty
+	sockTimeout  time.Duration // time to wait for QEMU to create sockets
+	handler      http.Handler  // handler for the meta-data service
+	serial       bool          // true, if EnableSerialChannel() was called
+	incoming     bool          // true, if EnableIncomingMigration() was called
 }
 
 // NewVirtualMachine constructs a new virtual machine using the given
 // machineOptions, image, network and cdroms.
 //
+// The virtual machine will use KVM, if available, otherwise it falls back to
+// TCG software emulation, see Accelerator().
+//
 // Returns engines.MalformedPayloadError if machineOptions and image definition
 // are conflicting. If this returns an error, caller is responsible for
 // releasing all resources, otherwise, they will be held by the VirtualMachine
@@ -69,7 +97,7 @@ func NewVirtualMachine(
 	monitor runtime.Monitor,
 ) (*VirtualMachine, error) {
 	// Get machine definition and set defaults
-	m, err := image.Machine().WithDefaults(defaultMachine).ApplyLimits(limits)
+	m, err := image.Machine().Resolve(limits)
 	if err != nil {
 		return nil, err
 	}
@@ -84,8 +112,40 @@ func NewVirtualMachine(
 		network:      network,
 		image:        image,
 		monitor:      monitor,
+		machine:      m,
+		accelerator:  detectAccelerator(),
+		throttling:   limits.DiskThrottling,
+		vncReady:     make(chan struct{}),
+		sockTimeout:  DefaultSocketTimeout,
+	}
+	if vm.accelerator != AccelKVM {
+		monitor.Warn("KVM isn't available, falling back to accel=", vm.accelerator)
+	}
+
+	// Virtual machines are accelerated, so the guest must match the host
+	if o.Architecture != HostArchitecture() {
+		return nil, runtime.NewMalformedPayloadError(
+			"Machine architecture '", o.Architecture, "' doesn't match the host ",
+			"architecture '", HostArchitecture(), "'",
+		)
 	}
 
+	// Select the newest machine type for chipsets without version, and check
+	// that the chipset is supported by the installed QEMU
+	qemuInfo, err := ProbeQEMU(o.Architecture)
+	if err != nil {
+		return nil, err
+	}
+	if o.Chipset, err = qemuInfo.resolveChipset(o.Chipset); err != nil {
+		return nil, err
+	}
+	vm.machine.options.Chipset = o.Chipset
+	vm.qemuInfo = qemuInfo
+	if err = validateCPU(o.CPU, o.Flags, qemuInfo, vm.accelerator); err != nil {
+		return nil, err
+	}
+	bus := pciBus(o.Chipset)
+
 	vncSocket := filepath.Join(vm.socketFolder, vncSocketFile)
 	qmpSocket := filepath.Join(vm.socketFolder, qmpSocketFile)
 
@@ -118,15 +178,61 @@ func NewVirtualMachine(
 	// Set options always required
 	options = append(options,
 		"-S",              // Wait for QMP command "continue" before starting execution
+		"-no-shutdown",    // Stop on guest shutdown, watchEvents() quits QEMU
 		"-no-user-config", // Don't load user config
 		"-nodefaults",     // Don't apply any default values
 		"-name", "qemu-guest",
-		"-cpu", strings.Join(append([]string{o.CPU}, o.Flags...), ","),
+		"-cpu", cpuOption(o.CPU, o.Flags),
 		"-m", strconv.Itoa(o.Memory),
 		"-uuid", o.UUID,
 		"-k", o.KeyboardLayout,
 	)
 
+	// UEFI firmware with variables stored in the NVRAM file from the image
+	if o.Firmware != firmwareBIOS {
+		if o.Snapshot != "" {
+			return nil, runtime.NewMalformedPayloadError(
+				"Snapshots are not supported with firmware '", o.Firmware, "'",
+			)
+		}
+		firmware, err := locateFirmware(o.Architecture, o.Firmware)
+		if err != nil {
+			return nil, err
+		}
+		if err = initializeNVRAM(image.NVRAMFile(), firmware.Vars); err != nil {
+			return nil, err
+		}
+		drive("readonly", args{
+			"if":     "pflash",
+			"format": "raw",
+			"file":   firmware.Code,
+		})
+		drive("", args{
+			"if":     "pflash",
+			"format": "raw",
+			"file":   image.NVRAMFile(),
+		})
+	}
+	if o.Firmware == firmwareUEFISecureBoot {
+		// Only allow SMM code to write to the UEFI variables
+		options = append(options, "-global", "driver=cfi.pflash01,property=secure,value=on")
+	}
+
+	// Emulated TPM, the swtpm process is started by Start()
+	if o.TPM != "none" {
+		if o.Snapshot != "" {
+			return nil, runtime.NewMalformedPayloadError(
+				"Snapshots are not supported with TPM '", o.TPM, "'",
+			)
+		}
+		tpm, tpmOptions, err := newTPM(o.TPM, vm.socketFolder)
+		if err != nil {
+			return nil, err
+		}
+		vm.tpm = tpm
+		options = append(options, tpmOptions...)
+	}
+
 	if bootOptions.Kernel != "" {
 		option("kernel", bootOptions.Kernel, nil)
 	}
@@ -137,6 +243,17 @@ func NewVirtualMachine(
 		option("initrd", bootOptions.Initrd, nil)
 	}
 
+	// Resume from snapshot, if one is specified
+	if o.Snapshot != "" {
+		if image.Format() != "qcow2" {
+			return nil, fmt.Errorf(
+				"snapshot '%s' cannot be loaded from image with format '%s'",
+				o.Snapshot, image.Format(),
+			)
+		}
+		option("loadvm", o.Snapshot, nil)
+	}
+
 	option("boot", "", args{
 		"menu":   "off",
 		"strict": "on",
@@ -144,9 +261,14 @@ func NewVirtualMachine(
 	option("realtime", "", args{
 		"mlock": "off", // TODO: Enable for things like talos
 	})
-	option("rtc", "", args{
-		"base": "utc", // TODO: Allow clock=vm for loadvm with windows
-	})
+	rtc := args{
+		"base":  o.RTCBase,
+		"clock": o.RTCClock,
+	}
+	if o.RTCDriftFix != "none" {
+		rtc["driftfix"] = o.RTCDriftFix
+	}
+	option("rtc", "", rtc)
 	option("smp", "", args{
 		"cpus":    strconv.Itoa(o.Threads * o.Cores * o.Sockets),
 		"threads": strconv.Itoa(o.Threads), // threads per core
@@ -154,10 +276,17 @@ func NewVirtualMachine(
 		"sockets": strconv.Itoa(o.Sockets), // sockets in the machine
 		// TODO: fit to system HT, see: https://www.kernel.org/doc/Documentation/ABI/testing/sysfs-devices-system-cpu
 	})
-	option("machine", o.Chipset, args{
-		"accel": "kvm",
+	machineArgs := args{
+		"accel": vm.accelerator,
 		// TODO: Configure additional options
-	})
+	}
+	if o.Architecture == archAArch64 {
+		machineArgs["gic-version"] = "max" // Use the best interrupt controller available
+	}
+	if o.Firmware == firmwareUEFISecureBoot {
+		machineArgs["smm"] = "on" // Required for secure boot
+	}
+	option("machine", o.Chipset, machineArgs)
 	option("vnc", "unix:"+vncSocket, args{
 		"share": "force-shared",
 	})
@@ -173,33 +302,87 @@ func NewVirtualMachine(
 	})
 
 	// Graphics
-	device(o.Graphics, args{
-		"id":   "video-0",
-		"bus":  "pci.0",
-		"addr": "0x2", // QEMU uses PCI 0x2 for VGA by default
-	})
+	if o.Graphics != "none" {
+		graphicsArgs := args{
+			"id":   "video-0",
+			"bus":  bus,
+			"addr": "0x2", // QEMU uses PCI 0x2 for VGA by default
+		}
+		if o.GraphicsMemory != 0 {
+			graphicsArgs["vgamem_mb"] = strconv.Itoa(o.GraphicsMemory)
+		}
+		if xres, yres := m.displayResolution(); xres != "" {
+			graphicsArgs["xres"] = xres
+			graphicsArgs["yres"] = yres
+		}
+		device(o.Graphics, graphicsArgs)
+	}
 
 	// USB
 	device(o.USB, args{
 		"id":   "usb",
-		"bus":  "pci.0",
+		"bus":  bus,
 		"addr": "0x3", // Always put USB on PCI 0x3
 	})
 
 	// Virtio ballon device
 	device("virtio-balloon-pci", args{
 		"id":   "balloon-0",
-		"bus":  "pci.0",
+		"bus":  bus,
 		"addr": "0x4", // Always put balloon on PCI 0x4
 	})
 
+	// Random number generator backed by /dev/urandom on the host
+	if o.RNG != "none" {
+		option("object", "rng-random", args{
+			"id":       "rng-0",
+			"filename": "/dev/urandom",
+		})
+		device(o.RNG, args{
+			"id":   "rng-0-device",
+			"rng":  "rng-0",
+			"bus":  bus,
+			"addr": "0xf", // Always put RNG on PCI 0xf
+		})
+	}
+
+	// Watchdog, we don't let QEMU take action when it expires, instead the
+	// WATCHDOG event is emitted and we fail the task
+	if o.Watchdog != "none" {
+		device(o.Watchdog, args{
+			"id":   "watchdog-0",
+			"bus":  bus,
+			"addr": "0x1b", // Always put watchdog on PCI 0x1b
+		})
+		option("watchdog-action", "none", nil)
+	}
+
+	// Let the guest report panics, this is an ISA device only available on x86
+	if o.Architecture == archX86_64 {
+		device("pvpanic", args{
+			"id": "pvpanic-0",
+		})
+	}
+
+	// Extra devices, none of these are on PCI, as all slots are assigned
+	for i, d := range o.Devices {
+		extraArgs := args{
+			"id": fmt.Sprintf("extra-%d", i),
+		}
+		if strings.HasPrefix(d, "usb-") {
+			extraArgs["bus"] = "usb.0"
+			extraArgs["port"] = "4" // after keyboard, mouse and tablet
+		}
+		device(d, extraArgs)
+	}
+
 	// Network
 	option("netdev", vm.network.NetDev("netdev-0"), nil)
 	device(o.Network, args{
 		"netdev": "netdev-0",
 		"id":     "nic0",
 		"mac":    o.MAC,
-		"bus":    "pci.0",
+		"bus":    bus,
 		"addr":   "0x5", // Always put network on PCI 0x5
 	})
 
@@ -227,7 +410,7 @@ func NewVirtualMachine(
 	}
 
 	// Storage
-	drive("", args{
+	bootDisk := args{
 		"file":   vm.image.DiskFile(),
 		"if":     "none",
 		"id":     "boot-disk",
@@ -236,15 +419,38 @@ func NewVirtualMachine(
 		"format": vm.image.Format(),
 		"werror": "report",
 		"rerror": "report",
-	})
-	device(o.Storage, args{
-		"scsi":      "off",
-		"bus":       "pci.0",
-		"addr":      "0x8", // Start disks as 0x8, reserve 0x7 for future
-		"drive":     "boot-disk",
-		"id":        "virtio-disk0",
-		"bootindex": "1",
-	})
+	}
+	for k, v := range vm.throttling.options() {
+		bootDisk[k] = v
+	}
+	if o.Storage == storageSCSI {
+		bootDisk["discard"] = "unmap" // Let guest TRIM free space in the overlay
+	}
+	drive("", bootDisk)
+	if o.Storage == storageSCSI {
+		device(storageSCSI, args{
+			"id":   scsiDiskController,
+			"bus":  bus,
+			"addr": "0x8", // Start disks as 0x8, 0x7 is reserved for CD drives on aarch64
+		})
+		device("scsi-hd", args{
+			"bus":       scsiDiskController + ".0",
+			"scsi-id":   "0",
+			"lun":       "0",
+			"drive":     "boot-disk",
+			"id":        "virtio-disk0",
+			"bootindex": "1",
+		})
+	} else {
+		device(o.Storage, args{
+			"scsi":      "off",
+			"bus":       bus,
+			"addr":      "0x8", // Start disks as 0x8, 0x7 is reserved for CD drives on aarch64
+			"drive":     "boot-disk",
+			"id":        "virtio-disk0",
+			"bootindex": "1",
+		})
+	}
 
 	// Sound
 	if o.Sound != "none" {
@@ -259,58 +465,69 @@ func NewVirtualMachine(
 			// Sound controller
 			device(sound[1], args{
 				"id":   "sound-0",
-				"bus":  "pci.0",
+				"bus":  bus,
 				"addr": "0x6", // Always put sound on PCI 0x6
 			})
 		} else {
 			// PCI Sound device
 			device(o.Sound, args{
 				"id":   "sound-0",
-				"bus":  "pci.0",
+				"bus":  bus,
 				"addr": "0x6", // Always put sound on PCI 0x6
 			})
 		}
 	}
 
 	// CD drives for qemu-build
-	if cdrom1 != "" {
+	cdrom := func(index int, file string) {
+		id := "cdrom" + strconv.Itoa(index)
 		drive("readonly", args{
-			"file":   cdrom1,
+			"file":   file,
 			"if":     "none",
-			"id":     "cdrom1",
+			"id":     id,
 			"cache":  "unsafe",
 			"aio":    "threads", // TODO: Reconsider 'native' w. cache not 'unsafe'
 			"format": "raw",
 			"werror": "report",
 			"rerror": "report",
 		})
+		if o.Architecture == archAArch64 {
+			// virt machine type has no IDE controller, so we use SCSI
+			device("scsi-cd", args{
+				"bootindex": strconv.Itoa(index + 1),
+				"drive":     id,
+				"id":        "scsi-cd" + strconv.Itoa(index),
+				"bus":       "scsi-0.0",
+				"scsi-id":   strconv.Itoa(index - 1),
+			})
+			return
+		}
+		ideBus, ideUnit := "ide.0", strconv.Itoa(index-1)
+		if strings.HasPrefix(o.Chipset, "pc-q35-") {
+			// q35 has an AHCI controller with one unit per bus
+			ideBus, ideUnit = "ide."+strconv.Itoa(index-1), "0"
+		}
 		device("ide-cd", args{
-			"bootindex": "2",
-			"drive":     "cdrom1",
-			"id":        "ide-cd1",
-			"bus":       "ide.0",
-			"unit":      "0",
+			"bootindex": strconv.Itoa(index + 1),
+			"drive":     id,
+			"id":        "ide-cd" + strconv.Itoa(index),
+			"bus":       ideBus,
+			"unit":      ideUnit,
 		})
 	}
-	if cdrom2 != "" {
-		drive("readonly", args{
-			"file":   cdrom2,
-			"if":     "none",
-			"id":     "cdrom2",
-			"cache":  "unsafe",
-			"aio":    "threads", // TODO: Reconsider 'native' w. cache not 'unsafe'
-			"format": "raw",
-			"werror": "report",
-			"rerror": "report",
-		})
-		device("ide-cd", args{
-			"bootindex": "3",
-			"drive":     "cdrom2",
-			"id":        "ide-cd2",
-			"bus":       "ide.0",
-			"unit":      "1",
+	if o.Architecture == archAArch64 && (cdrom1 != "" || cdrom2 != "") {
+		device("virtio-scsi-pci", args{
+			"id":   "scsi-0",
+			"bus":  bus,
+			"addr": "0x7", // Put SCSI controller for CD drives on PCI 0x7
 		})
 	}
+	if cdrom1 != "" {
+		cdrom(1, cdrom1)
+	}
+	if cdrom2 != "" {
+		cdrom(2, cdrom2)
+	}
 
 	// Create done channel
 	qemuDone := make(chan struct{})
@@ -318,21 +535,47 @@ func NewVirtualMachine(
 	vm.Done = qemuDone
 
 	// Create QEMU process
-	vm.qemu = exec.Command("qemu-system-x86_64", options...)
+	vm.qemu = exec.Command("qemu-system-"+o.Architecture, options...)
 
 	return vm, nil
 }
 
-// SetHTTPHandler sets the HTTP handler for the meta-data service.
+// Accelerator returns the accelerator used by the virtual machine, this is
+// either AccelKVM or AccelTCG.
+func (vm *VirtualMachine) Accelerator() string {
+	return vm.accelerator
+}
+
+// QEMU returns the version and machine types of the QEMU binary used, this can
+// be used to check for optional features with QEMUInfo.Supports().
+func (vm *VirtualMachine) QEMU() *QEMUInfo {
+	return vm.qemuInfo
+}
+
+// SetHTTPHandler sets the HTTP handler for the meta-data service, this is
+// also served over the serial channel, see EnableSerialChannel().
 func (vm *VirtualMachine) SetHTTPHandler(handler http.Handler) {
 	vm.m.Lock()
 	defer vm.m.Unlock()
+	vm.handler = handler
 	if vm.network != nil {
 		// Ignore the case where network has been released
 		vm.network.SetHandler(handler)
 	}
 }
 
+// SetSocketTimeout sets the time to wait for QEMU to create the VNC and QMP
+// sockets, before the virtual machine is aborted. This defaults to
+// DefaultSocketTimeout.
+func (vm *VirtualMachine) SetSocketTimeout(timeout time.Duration) {
+	vm.m.Lock()
+	defer vm.m.Unlock()
+	if vm.started {
+		panic("SetSocketTimeout() cannot be called after Start()")
+	}
+	vm.sockTimeout = timeout
+}
+
 // Start the virtual machine.
 func (vm *VirtualMachine) Start() {
 	vm.m.Lock()
@@ -360,11 +603,33 @@ func (vm *VirtualMachine) Start() {
 		return
 	}
 
+	// Create scratch disks
+	if err = vm.createScratchDisks(); err != nil {
+		vm.monitor.ReportError(err, "failed to create scratch disks")
+		vm.Error = err
+		vm.removeScratchDisks()
+		os.RemoveAll(socketFolder)
+		close(vm.qemuDone)
+		return
+	}
+
+	// Start swtpm, if the machine has a TPM
+	if err = vm.startTPM(); err != nil {
+		vm.monitor.ReportError(err, "failed to start swtpm")
+		vm.Error = err
+		vm.removeScratchDisks()
+		os.RemoveAll(socketFolder)
+		close(vm.qemuDone)
+		return
+	}
+
 	// Start monitor socketFolder for vnc and qmp sockets
 	socketsReady, err := vm.waitForSockets()
 	if err != nil {
 		vm.monitor.Errorf("Error configuring socketFolder monitoring, error: %s", err)
 		vm.Error = err
+		vm.stopTPM()
+		vm.removeScratchDisks()
 		close(vm.qemuDone)
 		return
 	}
@@ -372,15 +637,31 @@ func (vm *VirtualMachine) Start() {
 	// Start QEMU
 	vm.Error = vm.qemu.Start()
 	if vm.Error != nil {
+		vm.stopTPM()
+		vm.removeScratchDisks()
 		close(vm.qemuDone)
 		return
 	}
 
+	// Make the OOM killer prefer QEMU over the worker, if configured
+	if err = limits.ApplyChildOOMScoreAdj(vm.qemu.Process.Pid); err != nil {
+		vm.monitor.ReportWarning(err, "failed to set oom_score_adj for QEMU")
+	}
+
 	// Forward stdout/err to log
 	// Normally QEMU won't write anything... So sending everything to log is
 	// probably a good thing. Usually, it's errors and deprecation notices.
-	go scanLog(stdout, vm.monitor.Info, vm.monitor.Error)
-	go scanLog(stderr, vm.monitor.Error, vm.monitor.Error)
+	// Output is also kept in vm.output, so it can be attached to failed tasks.
+	var scanning sync.WaitGroup
+	scanning.Add(2)
+	go func() {
+		defer scanning.Done()
+		scanLog(stdout, &vm.output, vm.monitor.Info, vm.monitor.Error)
+	}()
+	go func() {
+		defer scanning.Done()
+		scanLog(stderr, &vm.output, vm.monitor.Error, vm.monitor.Error)
+	}()
 
 	// Wait for QEMU to finish and cleanup
 	go func() {
@@ -392,9 +673,10 @@ func (vm *VirtualMachine) Start() {
 		vm.m.Lock()
 		defer vm.m.Unlock()
 
-		// Close output pipes
+		// Close output pipes, and wait for output to be read
 		stdoutWriter.Close()
 		stderrWriter.Close()
+		scanning.Wait()
 
 		// Set error, if any and not already set
 		if vm.Error == nil {
@@ -406,13 +688,17 @@ func (vm *VirtualMachine) Start() {
 			vm.domain.Close()
 		}
 
+		// Stop swtpm, if it didn't exit when QEMU disconnected
+		vm.stopTPM()
+
 		// Release network and image
 		vm.network.Release()
 		vm.network = nil
 		vm.image.Release()
 		vm.image = nil
 
-		// Remove socket folder
+		// Remove scratch disks and socket folder
+		vm.removeScratchDisks()
 		os.RemoveAll(vm.socketFolder)
 		vm.socketFolder = ""
 
@@ -474,6 +760,41 @@ func (vm *VirtualMachine) Start() {
 	}
 	vm.m.Unlock()
 
+	// Forward QMP events before execution starts, so we don't miss any
+	go vm.watchEvents(domain)
+
+	// Set the VNC password, this is the QMP equivalent of 'change vnc password'
+	if vm.vncPassword != "" {
+		_, err = vm.runQMP("set_password", map[string]interface{}{
+			"protocol": "vnc",
+			"password": vm.vncPassword,
+		})
+		if err != nil {
+			debug("Error setting VNC password, error: %s", err)
+			vm.abort(err)
+			return
+		}
+	}
+	close(vm.vncReady)
+
+	// Attach disks that couldn't be given on the command line
+	if err = vm.hotplugDisks(); err != nil {
+		debug("Error hot-plugging disks, error: %s", err)
+		vm.abort(err)
+		return
+	}
+
+	// Serve the meta-data service over the serial channel, if enabled
+	if vm.serial {
+		go vm.serveSerialChannel(filepath.Join(socketFolder, serialSocketFile))
+	}
+
+	// Execution is started by ResumeMigration(), when receiving the virtual
+	// machine from another host
+	if vm.incoming {
+		return
+	}
+
 	// Run QMP command continue to start execution
 	_, err = vm.domain.Run(qmp.Command{
 		Execute: "cont",
@@ -521,12 +842,52 @@ func (vm *VirtualMachine) VNCSocket() string {
 	return filepath.Join(vm.socketFolder, vncSocketFile)
 }
 
+// EnableVNCPassword makes the VNC socket refuse connections that doesn't
+// authenticate with the password returned by VNCPassword(). Without this any
+// process that can open the VNC socket can connect, which is what qemu-run and
+// qemu-build expects when exposing VNC for interactive use.
+//
+// This must be called before Start().
+func (vm *VirtualMachine) EnableVNCPassword() {
+	vm.m.Lock()
+	defer vm.m.Unlock()
+	if vm.started {
+		panic("EnableVNCPassword() cannot be called after Start()")
+	}
+	vm.vncPassword = slugid.Nice()[:8] // VNC passwords are limited to 8 characters
+
+	// Refuse connections until the password is set with QMP
+	for i := 1; i < len(vm.qemu.Args); i++ {
+		if vm.qemu.Args[i-1] == "-vnc" {
+			vm.qemu.Args[i] += ",password=on"
+		}
+	}
+}
+
+// VNCPassword returns the password for the VNC socket. This blocks until the
+// password has been set, and returns empty-string if the virtual machine
+// terminated before the password was set, or EnableVNCPassword() wasn't called.
+func (vm *VirtualMachine) VNCPassword() string {
+	select {
+	case <-vm.vncReady:
+		return vm.vncPassword
+	case <-vm.Done:
+		return ""
+	}
+}
+
 // Screenshot takes a screenshot of the virtual machine screen as is running.
 func (vm *VirtualMachine) Screenshot() (image.Image, error) {
-	r, err := vm.domain.ScreenDump()
-	if err != nil {
+	// Write screendump to the socket folder, as QEMU can write to it
+	file := filepath.Join(vm.socketFolder, "screendump-"+slugid.Nice()+".ppm")
+	defer os.Remove(file)
+	if err := vm.ScreenDump(file); err != nil {
 		return nil, fmt.Errorf("Error taking screendump, error: %s", err)
 	}
+	r, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading screendump, error: %s", err)
+	}
 	defer r.Close()
 	img, err := pnm.Decode(r)
 	if err != nil {
@@ -556,6 +917,8 @@ func (vm *VirtualMachine) waitForSockets() (<-chan error, error) {
 
 	// Handle events, and close the done channel when sockets are ready
 	go func() {
+		timeout := time.NewTimer(vm.sockTimeout)
+		defer timeout.Stop()
 		vncReady := false
 		qmpReady := false
 		for !vncReady || !qmpReady {
@@ -574,8 +937,8 @@ func (vm *VirtualMachine) waitForSockets() (<-chan error, error) {
 				// Stop monitoring if QEMU has crashed
 				w.Close()
 				return
-			case <-time.After(90 * time.Second):
-				done <- fmt.Errorf("vnc and qmp sockets didn't show up in 90s")
+			case <-timeout.C:
+				done <- fmt.Errorf("vnc and qmp sockets didn't show up in %s", vm.sockTimeout)
 				w.Close()
 				return
 			case err := <-w.Errors:
@@ -591,9 +954,10 @@ func (vm *VirtualMachine) waitForSockets() (<-chan error, error) {
 	return done, nil
 }
 
-func scanLog(log io.Reader, infoLog, errorLog func(...interface{})) {
+func scanLog(log io.Reader, output *outputLog, infoLog, errorLog func(...interface{})) {
 	scanner := bufio.NewScanner(log)
 	for scanner.Scan() {
+		output.add(scanner.Text())
 		infoLog("QEMU: ", scanner.Text())
 	}
 	if err := scanner.Err(); err != nil {
@@ -0,0 +1,25 @@
+package vm
+
+import (
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEnableVNCPassword(t *testing.T) {
+	vm := &VirtualMachine{
+		qemu: exec.Command("qemu-system-x86_64", "-vnc", "unix:/tmp/vnc.sock,share=force-shared"),
+	}
+	assert.Equal(t, "", vm.vncPassword)
+
+	vm.EnableVNCPassword()
+	assert.Len(t, vm.vncPassword, 8)
+	assert.Equal(t, []string{
+		"qemu-system-x86_64",
+		"-vnc", "unix:/tmp/vnc.sock,share=force-shared,password=on",
+	}, vm.qemu.Args)
+
+	vm.started = true
+	assert.Panics(t, func() { vm.EnableVNCPassword() })
+}
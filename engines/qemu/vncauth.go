@@ -0,0 +1,174 @@
+package qemuengine
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	vnc "github.com/mitchellh/go-vnc"
+	"github.com/pkg/errors"
+)
+
+// vncAuthTimeout is the time allowed for the RFB handshake with QEMU
+const vncAuthTimeout = 30 * time.Second
+
+// rfbVersion is the RFB protocol version we offer to QEMU and display clients
+const rfbVersion = "RFB 003.008\n"
+
+// RFB security types, see RFC 6143 section 7.1.2
+const (
+	rfbSecurityNone = 1
+	rfbSecurityVNC  = 2
+)
+
+// readRFBVersion reads a ProtocolVersion message and returns the minor version
+func readRFBVersion(r io.Reader) (int, error) {
+	var version [12]byte
+	if _, err := io.ReadFull(r, version[:]); err != nil {
+		return 0, err
+	}
+	v := string(version[:])
+	if !strings.HasPrefix(v, "RFB 003.") || !strings.HasSuffix(v, "\n") {
+		return 0, errors.Errorf("unsupported RFB protocol version: %q", v)
+	}
+	minor, err := strconv.Atoi(v[8:11])
+	if err != nil {
+		return 0, errors.Errorf("unsupported RFB protocol version: %q", v)
+	}
+	return minor, nil
+}
+
+// readRFBReason reads the reason string sent by the server on failure
+func readRFBReason(r io.Reader) string {
+	var length uint32
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil || length > 4096 {
+		return "unknown reason"
+	}
+	reason := make([]byte, length)
+	if _, err := io.ReadFull(r, reason); err != nil {
+		return "unknown reason"
+	}
+	return string(reason)
+}
+
+// vncAuthenticate performs the RFB handshake with the VNC server on conn using
+// VNC authentication with password. Afterwards conn is ready for the
+// ClientInit message.
+func vncAuthenticate(conn net.Conn, password string) error {
+	if _, err := readRFBVersion(conn); err != nil {
+		return err
+	}
+	if _, err := io.WriteString(conn, rfbVersion); err != nil {
+		return err
+	}
+
+	// Read list of security types, an empty list is followed by a reason
+	var count uint8
+	if err := binary.Read(conn, binary.BigEndian, &count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return errors.Errorf("VNC server refused connection: %s", readRFBReason(conn))
+	}
+	types := make([]byte, count)
+	if _, err := io.ReadFull(conn, types); err != nil {
+		return err
+	}
+	supported := false
+	for _, t := range types {
+		supported = supported || t == rfbSecurityVNC
+	}
+	if !supported {
+		return errors.New("VNC server doesn't offer VNC authentication")
+	}
+	if _, err := conn.Write([]byte{rfbSecurityVNC}); err != nil {
+		return err
+	}
+
+	// Respond to the challenge
+	auth := &vnc.PasswordAuth{Password: password}
+	if err := auth.Handshake(conn); err != nil {
+		return err
+	}
+
+	var result uint32
+	if err := binary.Read(conn, binary.BigEndian, &result); err != nil {
+		return err
+	}
+	if result != 0 {
+		return errors.Errorf("VNC authentication failed: %s", readRFBReason(conn))
+	}
+	return nil
+}
+
+// vncServeNoAuth performs the server side of the RFB handshake with a display
+// client offering no authentication. Afterwards the client will send the
+// ClientInit message.
+//
+// This supports RFB 3.3, 3.7 and 3.8, as the security handshake differs.
+func vncServeNoAuth(client io.ReadWriter) error {
+	if _, err := io.WriteString(client, rfbVersion); err != nil {
+		return err
+	}
+	minor, err := readRFBVersion(client)
+	if err != nil {
+		return err
+	}
+
+	// RFB 3.3 has the server decide the security type
+	if minor < 7 {
+		return binary.Write(client, binary.BigEndian, uint32(rfbSecurityNone))
+	}
+
+	if _, err = client.Write([]byte{1, rfbSecurityNone}); err != nil {
+		return err
+	}
+	var selected [1]byte
+	if _, err = io.ReadFull(client, selected[:]); err != nil {
+		return err
+	}
+	if selected[0] != rfbSecurityNone {
+		return errors.Errorf("display client selected unsupported security type: %d", selected[0])
+	}
+	// RFB 3.7 has no SecurityResult message when there is no authentication
+	if minor == 7 {
+		return nil
+	}
+	return binary.Write(client, binary.BigEndian, uint32(0))
+}
+
+// newVNCProxy returns a connection for a display client to the VNC server on
+// conn, which must have been authenticated with vncAuthenticate().
+//
+// Access to displays is guarded by the interactive URL, so the display client
+// is offered no authentication, this way the VNC password never leaves the
+// worker. Closing the returned connection closes conn, and after the handshake
+// with the display client closing conn closes the returned connection.
+func newVNCProxy(conn net.Conn) net.Conn {
+	client, proxy := net.Pipe()
+	go func() {
+		defer conn.Close()
+		defer proxy.Close()
+
+		if err := vncServeNoAuth(proxy); err != nil {
+			debug("RFB handshake with display client failed, error: %s", err)
+			return
+		}
+
+		// Forward data until either side is closed
+		done := make(chan struct{}, 2)
+		go func() {
+			io.Copy(conn, proxy)
+			done <- struct{}{}
+		}()
+		go func() {
+			io.Copy(proxy, conn)
+			done <- struct{}{}
+		}()
+		<-done
+	}()
+	return client
+}
@@ -0,0 +1,125 @@
+package qemuengine
+
+import (
+	"crypto/des"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// reverseBits reverses the bits in b, as VNC authentication uses the password
+// as DES key with the bits of each byte in reverse order.
+func reverseBits(b byte) byte {
+	var r byte
+	for i := uint(0); i < 8; i++ {
+		r |= ((b >> i) & 1) << (7 - i)
+	}
+	return r
+}
+
+// serveVNCAuth plays the VNC server side of the RFB 3.8 handshake on conn, and
+// returns true, if the client responded correctly to the challenge.
+func serveVNCAuth(t *testing.T, conn net.Conn, password string) bool {
+	defer conn.Close()
+
+	_, err := io.WriteString(conn, rfbVersion)
+	require.NoError(t, err)
+	minor, err := readRFBVersion(conn)
+	require.NoError(t, err)
+	require.Equal(t, 8, minor)
+
+	_, err = conn.Write([]byte{1, rfbSecurityVNC})
+	require.NoError(t, err)
+	var selected [1]byte
+	_, err = io.ReadFull(conn, selected[:])
+	require.NoError(t, err)
+	require.Equal(t, byte(rfbSecurityVNC), selected[0])
+
+	challenge := []byte("0123456789abcdef")
+	_, err = conn.Write(challenge)
+	require.NoError(t, err)
+	response := make([]byte, 16)
+	_, err = io.ReadFull(conn, response)
+	require.NoError(t, err)
+
+	key := make([]byte, 8)
+	copy(key, password)
+	for i := range key {
+		key[i] = reverseBits(key[i])
+	}
+	cipher, err := des.NewCipher(key)
+	require.NoError(t, err)
+	expected := make([]byte, 16)
+	cipher.Encrypt(expected[:8], challenge[:8])
+	cipher.Encrypt(expected[8:], challenge[8:])
+
+	ok := string(expected) == string(response)
+	if ok {
+		err = binary.Write(conn, binary.BigEndian, uint32(0))
+	} else {
+		err = binary.Write(conn, binary.BigEndian, uint32(1))
+		if err == nil {
+			reason := "Authentication failed"
+			binary.Write(conn, binary.BigEndian, uint32(len(reason)))
+			io.WriteString(conn, reason)
+		}
+	}
+	require.NoError(t, err)
+	return ok
+}
+
+func TestVNCAuthenticate(t *testing.T) {
+	t.Run("correct password", func(t *testing.T) {
+		client, server := net.Pipe()
+		result := make(chan bool, 1)
+		go func() { result <- serveVNCAuth(t, server, "secret") }()
+		require.NoError(t, vncAuthenticate(client, "secret"))
+		require.True(t, <-result)
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		client, server := net.Pipe()
+		result := make(chan bool, 1)
+		go func() { result <- serveVNCAuth(t, server, "secret") }()
+		require.Error(t, vncAuthenticate(client, "wrong"))
+		require.False(t, <-result)
+	})
+}
+
+func TestVNCServeNoAuth(t *testing.T) {
+	for _, version := range []string{"RFB 003.003\n", "RFB 003.007\n", "RFB 003.008\n"} {
+		t.Run(version[:11], func(t *testing.T) {
+			client, server := net.Pipe()
+			done := make(chan error, 1)
+			go func() { done <- vncServeNoAuth(server) }()
+
+			minor, err := readRFBVersion(client)
+			require.NoError(t, err)
+			require.Equal(t, 8, minor)
+			_, err = io.WriteString(client, version)
+			require.NoError(t, err)
+
+			if version == "RFB 003.003\n" {
+				var securityType uint32
+				require.NoError(t, binary.Read(client, binary.BigEndian, &securityType))
+				require.Equal(t, uint32(rfbSecurityNone), securityType)
+			} else {
+				types := make([]byte, 2)
+				_, err = io.ReadFull(client, types)
+				require.NoError(t, err)
+				require.Equal(t, []byte{1, rfbSecurityNone}, types)
+				_, err = client.Write([]byte{rfbSecurityNone})
+				require.NoError(t, err)
+			}
+			if version == "RFB 003.008\n" {
+				var result uint32
+				require.NoError(t, binary.Read(client, binary.BigEndian, &result))
+				require.Equal(t, uint32(0), result)
+			}
+			require.NoError(t, <-done)
+		})
+	}
+}
@@ -0,0 +1,299 @@
+package qemuengine
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	schematypes "github.com/taskcluster/go-schematypes"
+	"github.com/taskcluster/taskcluster-worker/engines"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/util"
+)
+
+// Types of volumes
+const (
+	volumeTypeFolder = "folder"
+	volumeTypeDisk   = "disk"
+)
+
+// Default size of disk volumes in GiB
+const defaultDiskVolumeSize = 10
+
+var volumeSchema = schematypes.Object{
+	Title: "QEMU Volume Options",
+	Description: util.Markdown(`
+		Options for volumes exposed to virtual machines. By default volumes are
+		host folders exposed to the guest as shared folders.
+
+		Volumes of type 'disk' are qcow2 disk files attached to the guest as
+		virtio-blk devices, the guest formats the disk when first mounted. Disk
+		volumes offer better performance than shared folders, but cannot be
+		pre-loaded and can only be attached read-write to one virtual machine at
+		the time.
+	`),
+	Properties: schematypes.Properties{
+		"type": schematypes.StringEnum{
+			Title:       "Volume Type",
+			Description: "Type of volume, defaults to 'folder'.",
+			Options:     []string{volumeTypeFolder, volumeTypeDisk},
+		},
+		"size": schematypes.Integer{
+			Title:       "Size",
+			Description: "Size of disk volumes in GiB, defaults to 10.",
+			Minimum:     1,
+			Maximum:     1024,
+		},
+	},
+	AdditionalProperties: false, // We require known properties to ensure forward-compatibility
+}
+
+type volumeOptions struct {
+	Type string `json:"type"`
+	Size int    `json:"size"`
+}
+
+type volumeBuilder struct {
+	engines.VolumeBuilderBase
+	m       sync.Mutex
+	v       *volume
+	invalid bool
+}
+
+// volume is a host folder that is exposed to the guest as a shared folder, or
+// a folder holding a qcow2 file that is exposed to the guest as a disk.
+type volume struct {
+	engines.VolumeBase
+	m        sync.Mutex
+	folder   runtime.TemporaryFolder
+	disk     string // qcow2 file for disk volumes, empty for shared folders
+	readers  int    // number of read-only attachments of a disk volume
+	writer   bool   // true, if disk volume is attached read-write
+	monitor  runtime.Monitor
+	disposed bool
+}
+
+func newVolumeBuilder(e *engine) (*volumeBuilder, error) {
+	folder, err := e.Environment.TemporaryStorage.NewFolder()
+	if err != nil {
+		e.monitor.ReportError(err, "failed to create folder for volume")
+		return nil, runtime.ErrFatalInternalError
+	}
+
+	// World writable as the guest user inside the VM owns the files
+	if err = os.Chmod(folder.Path(), 0777); err != nil {
+		folder.Remove()
+		e.monitor.ReportError(err, "failed to chmod folder for volume")
+		return nil, runtime.ErrFatalInternalError
+	}
+
+	return &volumeBuilder{
+		v: &volume{
+			folder:  folder,
+			monitor: e.monitor.WithTag("volume-path", folder.Path()),
+		},
+	}, nil
+}
+
+// newDiskVolume creates a volume with an empty qcow2 disk of the given size
+// in GiB.
+func newDiskVolume(e *engine, size int) (*volume, error) {
+	folder, err := e.Environment.TemporaryStorage.NewFolder()
+	if err != nil {
+		e.monitor.ReportError(err, "failed to create folder for disk volume")
+		return nil, runtime.ErrFatalInternalError
+	}
+
+	disk := filepath.Join(folder.Path(), "disk.qcow2")
+	output, err := exec.Command(
+		"qemu-img", "create", "-q", "-f", "qcow2", disk, strconv.Itoa(size)+"G",
+	).CombinedOutput()
+	if err != nil {
+		folder.Remove()
+		e.monitor.WithTag("output", string(output)).ReportError(err, "failed to create qcow2 file for disk volume")
+		return nil, runtime.ErrFatalInternalError
+	}
+
+	return &volume{
+		folder:  folder,
+		disk:    disk,
+		monitor: e.monitor.WithTag("volume-path", folder.Path()),
+	}, nil
+}
+
+// path returns the path for name inside the volume, or an error if name
+// reaches outside the volume.
+func (vb *volumeBuilder) path(name string) (string, error) {
+	root := filepath.Clean(vb.v.folder.Path())
+	p := filepath.Join(root, filepath.FromSlash(name))
+	if p != root && !strings.HasPrefix(p, root+string(filepath.Separator)) {
+		vb.v.monitor.WithTag("name", name).ReportError(errors.New(
+			"VolumeBuilder for qemu-engine attempted to write outside the volume",
+		))
+		return "", runtime.ErrFatalInternalError
+	}
+	return p, nil
+}
+
+func (vb *volumeBuilder) WriteFolder(name string) error {
+	vb.m.Lock()
+	defer vb.m.Unlock()
+
+	// Ensure that this VolumeBuilder instance is still valid
+	if vb.invalid {
+		vb.v.monitor.Panic("VolumeBuilder.WriteFolder() was called after BuildVolume()/Discard()")
+	}
+
+	p, err := vb.path(name)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(p, 0777); err != nil {
+		vb.v.monitor.WithTag("name", name).ReportError(
+			err, "VolumeBuilder.WriteFolder() for qemu-engine failed to create folder",
+		)
+		return runtime.ErrFatalInternalError
+	}
+	return nil
+}
+
+func (vb *volumeBuilder) WriteFile(name string) io.WriteCloser {
+	vb.m.Lock()
+	defer vb.m.Unlock()
+
+	// Ensure that this VolumeBuilder instance is still valid
+	if vb.invalid {
+		vb.v.monitor.Panic("VolumeBuilder.WriteFile() was called after BuildVolume()/Discard()")
+	}
+
+	p, err := vb.path(name)
+	if err != nil {
+		return &errWriteCloser{Err: err}
+	}
+	if err = os.MkdirAll(filepath.Dir(p), 0777); err != nil {
+		vb.v.monitor.WithTag("name", name).ReportError(
+			err, "VolumeBuilder.WriteFile() for qemu-engine failed to create folders for file",
+		)
+		return &errWriteCloser{Err: runtime.ErrFatalInternalError}
+	}
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0777)
+	if err != nil {
+		vb.v.monitor.WithTag("name", name).ReportError(
+			err, "VolumeBuilder.WriteFile() for qemu-engine failed to create file",
+		)
+		return &errWriteCloser{Err: runtime.ErrFatalInternalError}
+	}
+	return f // Note it is the callers responsibility to close the file
+}
+
+func (vb *volumeBuilder) BuildVolume() (engines.Volume, error) {
+	vb.m.Lock()
+	defer vb.m.Unlock()
+
+	// Ensure that this VolumeBuilder instance is still valid
+	if vb.invalid {
+		vb.v.monitor.Panic("VolumeBuilder.BuildVolume() was called after BuildVolume()/Discard()")
+	}
+
+	// Mark the VolumeBuilder as invalid
+	vb.invalid = true
+
+	return vb.v, nil
+}
+
+func (vb *volumeBuilder) Discard() error {
+	vb.m.Lock()
+	defer vb.m.Unlock()
+
+	// Ensure that this VolumeBuilder instance is still valid
+	if vb.invalid {
+		vb.v.monitor.Panic("VolumeBuilder.Discard() was called after BuildVolume()/Discard()")
+	}
+
+	// Mark the VolumeBuilder as invalid
+	vb.invalid = true
+
+	// Discard the underlying volume
+	return vb.v.Dispose()
+}
+
+// Path returns the host folder to be exposed as shared folder
+func (v *volume) Path() string {
+	v.m.Lock()
+	defer v.m.Unlock()
+
+	// Validate that this haven't been disposed yet
+	if v.disposed {
+		v.monitor.Panic("Volume cannot be used after Dispose()")
+	}
+
+	return v.folder.Path()
+}
+
+// lock a disk volume for use by a virtual machine, returns false if the disk
+// volume is already attached read-write, or attached read-only when a
+// read-write lock is requested.
+func (v *volume) lock(readOnly bool) bool {
+	v.m.Lock()
+	defer v.m.Unlock()
+
+	if v.writer || (!readOnly && v.readers > 0) {
+		return false
+	}
+	if readOnly {
+		v.readers++
+	} else {
+		v.writer = true
+	}
+	return true
+}
+
+// unlock a disk volume locked with lock(readOnly)
+func (v *volume) unlock(readOnly bool) {
+	v.m.Lock()
+	defer v.m.Unlock()
+
+	if readOnly {
+		v.readers--
+	} else {
+		v.writer = false
+	}
+}
+
+func (v *volume) Dispose() error {
+	v.m.Lock()
+	defer v.m.Unlock()
+
+	// Ignore double Dispose() there is no risk here
+	if v.disposed {
+		v.monitor.Warn("Volume.Dispose() was called twice!")
+		return nil
+	}
+	v.disposed = true
+
+	// Leaking a single volume isn't the end of the world, so this is non-fatal
+	if err := v.folder.Remove(); err != nil {
+		v.monitor.ReportError(err, "Volume.Dispose() failed to remove volume folder")
+		return runtime.ErrNonFatalInternalError
+	}
+	return nil
+}
+
+// errWriteCloser is a simple io.WriteCloser implementation that returns Err
+// for all operations.
+type errWriteCloser struct {
+	Err error
+}
+
+func (e *errWriteCloser) Write(p []byte) (int, error) {
+	return 0, e.Err
+}
+
+func (e *errWriteCloser) Close() error {
+	return e.Err
+}
@@ -0,0 +1,58 @@
+package qemuengine
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/mocks"
+)
+
+func TestVolumeBuilder(t *testing.T) {
+	storage := runtime.NewTemporaryTestFolderOrPanic()
+	defer storage.Remove()
+	e := &engine{
+		monitor:     mocks.NewMockMonitor(false),
+		Environment: &runtime.Environment{TemporaryStorage: storage},
+	}
+
+	vb, err := newVolumeBuilder(e)
+	require.NoError(t, err)
+	require.NoError(t, vb.WriteFolder("a/b"))
+	w := vb.WriteFile("a/b/hello.txt")
+	_, err = w.Write([]byte("hello"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+
+	// Writing outside the volume is not allowed
+	require.Error(t, vb.WriteFolder("../outside"))
+	_, err = vb.WriteFile("../../outside.txt").Write([]byte("x"))
+	require.Error(t, err)
+
+	vol, err := vb.BuildVolume()
+	require.NoError(t, err)
+	data, err := ioutil.ReadFile(filepath.Join(vol.(*volume).Path(), "a", "b", "hello.txt"))
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(data))
+	require.NoError(t, vol.Dispose())
+}
+
+func TestDiskVolumeLock(t *testing.T) {
+	v := &volume{disk: "disk.qcow2"}
+
+	// Read-only attachments can be shared
+	require.True(t, v.lock(true))
+	require.True(t, v.lock(true))
+	require.False(t, v.lock(false), "expected read-write lock to fail while attached read-only")
+	v.unlock(true)
+	v.unlock(true)
+
+	// Read-write attachments are exclusive
+	require.True(t, v.lock(false))
+	require.False(t, v.lock(false), "expected second read-write lock to fail")
+	require.False(t, v.lock(true), "expected read-only lock to fail while attached read-write")
+	v.unlock(false)
+	require.True(t, v.lock(true))
+}
@@ -1,6 +1,8 @@
 package engines
 
 import (
+	"time"
+
 	"github.com/taskcluster/taskcluster-worker/runtime/ioext"
 )
 
@@ -19,6 +21,24 @@ import (
 // file, or a copy of the file, or some seekable stream interface.
 type FileHandler func(path string, stream ioext.ReadSeekCloser) error
 
+// ResourceUsage summarizes the resources used by a sandbox, zero values means
+// unknown.
+type ResourceUsage struct {
+	CPUTime     time.Duration // CPU time consumed
+	PeakMemory  int64         // Peak resident memory in bytes
+	DiskRead    int64         // Bytes read from disk
+	DiskWritten int64         // Bytes written to disk
+	NetReceived int64         // Bytes received from the network
+	NetSent     int64         // Bytes sent to the network
+}
+
+// PortForward is a port in the sandbox forwarded to a port on the loopback
+// interface of the host.
+type PortForward struct {
+	GuestPort int `json:"guestPort"` // Port in the sandbox
+	HostPort  int `json:"hostPort"`  // Port on 127.0.0.1 of the host
+}
+
 // The ResultSet interface represents the results of a sandbox that has finished
 // execution, but is hanging around while results are being extracted.
 //
@@ -83,6 +103,20 @@ type ResultSet interface {
 	// as a tar-stream. Ideally this also includes cache folders.
 	ArchiveSandbox() (ioext.ReadSeekCloser, error)
 
+	// ResourceUsage returns a summary of the resources used by the sandbox while
+	// it was running, this is useful for capacity planning.
+	//
+	// Non-fatal errors: ErrFeatureNotSupported
+	ResourceUsage() (ResourceUsage, error)
+
+	// PortForwards returns the ports in the sandbox forwarded to ports on the
+	// host, as requested by the task. Ports remain forwarded until the ResultSet
+	// is disposed, so services in the sandbox can be reached while results are
+	// being extracted.
+	//
+	// Non-fatal errors: ErrFeatureNotSupported
+	PortForwards() ([]PortForward, error)
+
 	// Dispose shall release all resources.
 	//
 	// CacheFolders given to the sandbox shall not be disposed, instead they are
@@ -120,6 +154,18 @@ func (ResultSetBase) ArchiveSandbox() (ioext.ReadSeekCloser, error) {
 	return nil, ErrFeatureNotSupported
 }
 
+// ResourceUsage returns ErrFeatureNotSupported indicating that the feature
+// isn't supported.
+func (ResultSetBase) ResourceUsage() (ResourceUsage, error) {
+	return ResourceUsage{}, ErrFeatureNotSupported
+}
+
+// PortForwards returns ErrFeatureNotSupported indicating that the feature
+// isn't supported.
+func (ResultSetBase) PortForwards() ([]PortForward, error) {
+	return nil, ErrFeatureNotSupported
+}
+
 // Dispose returns nil indicating that resources have been released.
 func (ResultSetBase) Dispose() error {
 	return nil
@@ -36,6 +36,23 @@ type Display struct {
 	Height      int // 0 if unknown
 }
 
+// A SandboxEvent is an event reported by the environment a sandbox is running
+// in, such as a kernel panic in the guest of a virtual machine.
+type SandboxEvent struct {
+	Kind    string                 // One of the SandboxEventXXX constants
+	Message string                 // Human readable description of the event
+	Details map[string]interface{} // Engine specific details, may be nil
+}
+
+// Kinds of SandboxEvent
+const (
+	SandboxEventReset      = "reset"       // Sandbox environment was reset
+	SandboxEventShutdown   = "shutdown"    // Sandbox environment shut down
+	SandboxEventWatchdog   = "watchdog"    // Watchdog in the sandbox fired
+	SandboxEventIOError    = "io-error"    // I/O error on a disk
+	SandboxEventGuestPanic = "guest-panic" // Guest operating system panicked
+)
+
 // The Sandbox interface represents an active sandbox.
 //
 // All methods on this interface must be thread-safe.
@@ -118,6 +135,26 @@ type Sandbox interface {
 	// Non-fatal errors: ErrSandboxTerminated, ErrSandboxAborted,
 	// ErrFeatureNotSupported
 	Kill() error
+
+	// Events returns a channel on which events from the sandbox environment are
+	// delivered, such that plugins can react promptly to things like guest
+	// panics. Each call returns a new channel, which is closed when the sandbox
+	// has stopped. Events may be dropped if the receiver doesn't keep up.
+	//
+	// Non-fatal errors: ErrFeatureNotSupported, ErrSandboxTerminated
+	Events() (<-chan SandboxEvent, error)
+
+	// Migrate the running sandbox to the host given by target, such that
+	// execution continues on the target host. When this returns nil, all
+	// resources held by the Sandbox must have been released, and
+	// WaitForResult() must return ErrSandboxMigrated.
+	//
+	// If an error is returned execution continues on this host, as if Migrate()
+	// had not been called.
+	//
+	// Non-fatal errors: ErrFeatureNotSupported, ErrSandboxTerminated, any error
+	// explaining why the sandbox couldn't be migrated.
+	Migrate(target MigrationTarget) error
 }
 
 // SandboxBase is a base implemenation of Sandbox. It will implement all
@@ -158,3 +195,15 @@ func (SandboxBase) Kill() error {
 	// panic("Not implemented: Sandbox.Kill()")
 	return ErrFeatureNotSupported
 }
+
+// Events returns ErrFeatureNotSupported indicating that the feature isn't
+// supported.
+func (SandboxBase) Events() (<-chan SandboxEvent, error) {
+	return nil, ErrFeatureNotSupported
+}
+
+// Migrate returns ErrFeatureNotSupported indicating that the feature isn't
+// supported.
+func (SandboxBase) Migrate(MigrationTarget) error {
+	return ErrFeatureNotSupported
+}
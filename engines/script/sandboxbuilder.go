@@ -11,6 +11,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/taskcluster/taskcluster-worker/engines"
 	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/limits"
 )
 
 type sandboxBuilder struct {
@@ -52,6 +53,9 @@ func (b *sandboxBuilder) StartSandbox() (engines.Sandbox, error) {
 	if err := cmd.Start(); err != nil {
 		return nil, errors.Wrap(err, "Internal error invalid script")
 	}
+	if err := limits.ApplyChildOOMScoreAdj(cmd.Process.Pid); err != nil {
+		b.monitor.ReportWarning(err, "failed to set oom_score_adj for script")
+	}
 	s := &sandbox{
 		cmd:     cmd,
 		stderr:  stderr,
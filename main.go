@@ -25,14 +25,22 @@ import (
 	// Import all sub-packages from commands/, config/, engines/ and plugins/
 	// as they will register themselves using extension registries.
 
+	_ "github.com/taskcluster/taskcluster-worker/commands/completion"
+	_ "github.com/taskcluster/taskcluster-worker/commands/config-test"
 	_ "github.com/taskcluster/taskcluster-worker/commands/daemon"
+	_ "github.com/taskcluster/taskcluster-worker/commands/drain"
+	_ "github.com/taskcluster/taskcluster-worker/commands/gc"
 	_ "github.com/taskcluster/taskcluster-worker/commands/help"
+	_ "github.com/taskcluster/taskcluster-worker/commands/image"
 	_ "github.com/taskcluster/taskcluster-worker/commands/qemu-build"
 	_ "github.com/taskcluster/taskcluster-worker/commands/qemu-guest-tools"
 	_ "github.com/taskcluster/taskcluster-worker/commands/qemu-run"
 	_ "github.com/taskcluster/taskcluster-worker/commands/schema"
 	_ "github.com/taskcluster/taskcluster-worker/commands/shell"
 	_ "github.com/taskcluster/taskcluster-worker/commands/shell-server"
+	_ "github.com/taskcluster/taskcluster-worker/commands/status"
+	_ "github.com/taskcluster/taskcluster-worker/commands/test-engine"
+	_ "github.com/taskcluster/taskcluster-worker/commands/validate-payload"
 	_ "github.com/taskcluster/taskcluster-worker/commands/version"
 	_ "github.com/taskcluster/taskcluster-worker/commands/work"
 	_ "github.com/taskcluster/taskcluster-worker/config/abs"
@@ -3,6 +3,7 @@ package cache
 import (
 	"fmt"
 	"io"
+	"os"
 	"time"
 
 	"github.com/pkg/errors"
@@ -77,34 +78,12 @@ func constructor(ctx caching.Context, opts interface{}) (caching.Resource, error
 	}
 	// the rest of this function deals with creating a pre-loaded cache
 
-	// Fetch pre-load data to temporary file
-	file, err := options.Plugin.environment.TemporaryStorage.NewFile()
+	// Fetch pre-load data
+	file, release, err := fetchPreload(ctx, options)
 	if err != nil {
-		return nil, errors.Wrap(err, "unable to create temporary file to fetch cache pre-load")
-	}
-	defer file.Close() // remove the temporary file whatever happens
-	err = options.Reference.Fetch(&preloadFetchContext{
-		Context:            ctx,
-		InitialTaskContext: options.InitialTaskContext,
-	}, &fetcher.FileReseter{File: file})
-	if err != nil {
-		if fetcher.IsBrokenReferenceError(err) {
-			err = runtime.NewMalformedPayloadError(fmt.Sprintf(
-				"cache pre-loading error: %s", err.Error(),
-			))
-		} else {
-			err = errors.Wrap(err, "failed to fetch cache preload data")
-		}
 		return nil, err
 	}
-
-	// Seek to start of file (after download)
-	_, err = file.Seek(0, io.SeekStart)
-	if err != nil {
-		incidentID := options.Plugin.monitor.ReportError(err, "failed to seek to start of temporary file after download")
-		ctx.Progress(fmt.Sprintf("internal error downloading, incidentId: %s", incidentID), 1)
-		return nil, runtime.ErrFatalInternalError // if we can't seek start that's pretty critical
-	}
+	defer release() // release the file whatever happens
 
 	// Create a new volume builder
 	volumeBuilder, err := options.Plugin.engine.NewVolumeBuilder(options.Options)
@@ -137,3 +116,68 @@ func constructor(ctx caching.Context, opts interface{}) (caching.Resource, error
 		Created: created,
 	}, nil
 }
+
+// fetchPreload fetches pre-load data for a cache, through the shared fetcher
+// cache if available, otherwise to a temporary file. Returns a file positioned
+// at the start and a function to release the file when done.
+func fetchPreload(ctx caching.Context, options cacheOptions) (io.Reader, func(), error) {
+	fctx := &preloadFetchContext{
+		Context:            ctx,
+		InitialTaskContext: options.InitialTaskContext,
+	}
+	var file io.ReadSeeker
+	var release func()
+	var err error
+	if cache := options.Plugin.environment.FetchCache; cache != nil {
+		var cached *fetcher.CachedFile
+		cached, err = cache.Fetch(fctx, options.Reference)
+		if err == nil {
+			var f *os.File
+			f, err = cached.Open()
+			if err != nil {
+				cached.Release()
+				incidentID := options.Plugin.monitor.ReportError(err, "failed to open cached file after download")
+				ctx.Progress(fmt.Sprintf("internal error downloading, incidentId: %s", incidentID), 1)
+				return nil, nil, runtime.ErrFatalInternalError
+			}
+			file = f
+			release = func() {
+				f.Close()
+				cached.Release()
+			}
+		}
+	} else {
+		var f runtime.TemporaryFile
+		f, err = options.Plugin.environment.TemporaryStorage.NewFile()
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "unable to create temporary file to fetch cache pre-load")
+		}
+		err = options.Reference.Fetch(fctx, &fetcher.FileReseter{File: f})
+		file = f
+		release = func() { f.Close() } // remove the temporary file
+		if err != nil {
+			release()
+		}
+	}
+	if err != nil {
+		if fetcher.IsBrokenReferenceError(err) {
+			err = runtime.NewMalformedPayloadError(fmt.Sprintf(
+				"cache pre-loading error: %s", err.Error(),
+			))
+		} else {
+			err = errors.Wrap(err, "failed to fetch cache preload data")
+		}
+		return nil, nil, err
+	}
+
+	// Seek to start of file (after download)
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		release()
+		incidentID := options.Plugin.monitor.ReportError(err, "failed to seek to start of file after download")
+		ctx.Progress(fmt.Sprintf("internal error downloading, incidentId: %s", incidentID), 1)
+		return nil, nil, runtime.ErrFatalInternalError // if we can't seek start that's pretty critical
+	}
+
+	return file, release, nil
+}
@@ -10,13 +10,4 @@ type payloadEntry struct {
 }
 
 // A fetcher for pre-loading caches
-var preloadFetcher = fetcher.Combine(
-	// Allow fetching from URL
-	fetcher.URL,
-	// Allow fetching from queue artifacts
-	fetcher.Artifact,
-	// Allow fetching from queue referenced by index namespace
-	fetcher.Index,
-	// Allow fetching from URL + hash
-	fetcher.URLHash,
-)
+var preloadFetcher = fetcher.Default
@@ -15,6 +15,8 @@ type config struct {
 	DisableDisplay             bool   `json:"disableDisplay"`
 	ShellToolURL               string `json:"shellToolUrl"`
 	DisplayToolURL             string `json:"displayToolUrl"`
+	RequireScopes              bool   `json:"requireScopes"`
+	RecordSessions             bool   `json:"recordSessions"`
 }
 
 var configSchema = schematypes.Object{
@@ -27,8 +29,9 @@ var configSchema = schematypes.Object{
 		"artifactPrefix": schematypes.String{
 			Title: "Artifact Prefix",
 			Description: util.Markdown(`
-				Prefix that the 'sockets.json', 'display.html' and 'shell.html'
-				should be created under. Defaults to
+				Prefix that the 'sockets.json', 'display.html',
+				'display-viewer.html' and 'shell.html' should be created under.
+				Defaults to
 				` + fmt.Sprintf("'%s'", defaultArtifactPrefix) + `.
 			`),
 			Pattern:       `^[\x20-.0-\x7e][\x20-\x7e]*/$`,
@@ -45,6 +48,27 @@ var configSchema = schematypes.Object{
 			Title:       "Always Enabled",
 			Description: "If set the interactive plugin will be abled for all tasks.",
 		},
+		"requireScopes": schematypes.Boolean{
+			Title: "Require Scopes",
+			Description: util.Markdown(`
+				Require 'task.scopes' to cover
+				'worker:interactive-shell:<provisionerId>/<workerType>' for the
+				interactive shell, and
+				'worker:interactive-display:<provisionerId>/<workerType>' for the
+				interactive display. If a task doesn't have the scopes required for
+				a feature it requests, the task is resolved malformed-payload.
+			`),
+		},
+		"recordSessions": schematypes.Boolean{
+			Title: "Record Sessions",
+			Description: util.Markdown(`
+				Record interactive sessions and upload the recordings when the task
+				is done. Shell sessions are uploaded as asciicast v2 recordings,
+				including keystrokes, to '<prefix>recordings/shell-<N>.cast', and
+				metadata for display connections is uploaded to
+				'<prefix>recordings/displays.json'. Tasks can't disable this.
+			`),
+		},
 		"disableShell": schematypes.Boolean{
 			Title:       "Disable Shell",
 			Description: "If set the interactive shell will be disabled.",
@@ -67,7 +91,7 @@ var configSchema = schematypes.Object{
 				URL to a tool that can take display socket, list
 				displays and render noVNC session. The URL will be given the
 				querystring options: 'v=1', 'socketUrl', 'displaysUrl', 'taskId' and
-				'runId'.
+				'runId', and 'viewOnly=true' if the display tool shouldn't send input.
 			`),
 		},
 	},
@@ -12,4 +12,7 @@ const (
 	// ErrorCodeInvalidParameters indicates that the given display parameter isn't
 	// valid, likely it's missing.
 	ErrorCodeInvalidParameters = "InvalidParameters"
+	// ErrorCodeDisplayInUse indicates that the display already has a client in
+	// control of it, only one client can control a display at the time.
+	ErrorCodeDisplayInUse = "DisplayInUse"
 )
@@ -18,6 +18,8 @@ type DisplayHandler struct {
 	display io.ReadWriteCloser
 	monitor runtime.Monitor
 	in      io.ReadCloser
+	once    sync.Once
+	done    chan struct{}
 }
 
 // NewDisplayHandler creates a DisplayHandler that connects the websocket to the
@@ -28,6 +30,7 @@ func NewDisplayHandler(ws *websocket.Conn, display io.ReadWriteCloser, monitor r
 		display: display,
 		monitor: monitor,
 		in:      display,
+		done:    make(chan struct{}),
 	}
 	d.ws.SetReadLimit(displayconsts.DisplayMaxMessageSize)
 	d.ws.SetReadDeadline(time.Now().Add(displayconsts.DisplayPongTimeout))
@@ -44,6 +47,13 @@ func NewDisplayHandler(ws *websocket.Conn, display io.ReadWriteCloser, monitor r
 func (d *DisplayHandler) Abort() {
 	d.ws.Close()
 	d.display.Close()
+	d.once.Do(func() { close(d.done) })
+}
+
+// Done returns a channel that is closed when the display handler is aborted,
+// this happens when either the websocket or the display is closed.
+func (d *DisplayHandler) Done() <-chan struct{} {
+	return d.done
 }
 
 func (d *DisplayHandler) sendPings() {
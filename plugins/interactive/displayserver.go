@@ -30,6 +30,9 @@ type DisplayServer struct {
 	monitor  runtime.Monitor
 	done     chan struct{}
 	handlers []*DisplayHandler
+	readOnly bool           // wrap displays with newReadOnlyDisplay
+	maxConns int            // maximum connections per display, 0 for unlimited
+	conns    map[string]int // number of connections per display
 }
 
 // NewDisplayServer creates a DisplayServer for exposing the given provider
@@ -39,9 +42,28 @@ func NewDisplayServer(provider DisplayProvider, monitor runtime.Monitor) *Displa
 		monitor:  monitor,
 		provider: provider,
 		done:     make(chan struct{}),
+		conns:    make(map[string]int),
 	}
 }
 
+// NewControllerDisplayServer creates a DisplayServer that allows only one
+// connection to each display at the time. Additional connections are rejected
+// with ErrorCodeDisplayInUse, until the connection in control is closed.
+func NewControllerDisplayServer(provider DisplayProvider, monitor runtime.Monitor) *DisplayServer {
+	s := NewDisplayServer(provider, monitor)
+	s.maxConns = 1
+	return s
+}
+
+// NewViewerDisplayServer creates a DisplayServer that allows any number of
+// read-only connections to each display. Input events from viewers are
+// discarded, and viewers always share the display with other clients.
+func NewViewerDisplayServer(provider DisplayProvider, monitor runtime.Monitor) *DisplayServer {
+	s := NewDisplayServer(provider, monitor)
+	s.readOnly = true
+	return s
+}
+
 // Abort stops new display connections from opneing and aborts all existing
 // connections, cleaning up all resources held.
 func (s *DisplayServer) Abort() {
@@ -93,8 +115,21 @@ func (s *DisplayServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			Code:    displayconsts.ErrorCodeInvalidParameters,
 			Message: "Querystring parameter 'display' must be given!",
 		})
+		return
+	}
+
+	// Reserve a connection to the display, released when the handler is done
+	if !s.reserve(displayName) {
+		reply(w, http.StatusConflict, displayconsts.ErrorMessage{
+			Code:    displayconsts.ErrorCodeDisplayInUse,
+			Message: fmt.Sprintf("Display: '%s' is already in use by another client", displayName),
+		})
+		return
 	}
 	display, err := s.provider.OpenDisplay(displayName)
+	if err != nil {
+		s.release(displayName)
+	}
 	switch err {
 	case engines.ErrNoSuchDisplay:
 		reply(w, http.StatusNotFound, displayconsts.ErrorMessage{
@@ -119,6 +154,7 @@ func (s *DisplayServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ws, err := displayUpgrader.Upgrade(w, r, nil)
 	if err != nil {
 		display.Close()
+		s.release(displayName)
 		return
 	}
 
@@ -135,8 +171,47 @@ func (s *DisplayServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Create new handler and add it to the list
+	if s.readOnly {
+		display = newReadOnlyDisplay(display)
+	}
 	h := NewDisplayHandler(ws, display, s.monitor.WithTag("display", displayName))
 	s.handlers = append(s.handlers, h)
+
+	// Remove the handler and release the connection, when the handler is done
+	go func() {
+		<-h.Done()
+		s.m.Lock()
+		for i, handler := range s.handlers {
+			if handler == h {
+				s.handlers = append(s.handlers[:i], s.handlers[i+1:]...)
+				break
+			}
+		}
+		s.m.Unlock()
+		s.release(displayName)
+	}()
+}
+
+// reserve a connection to displayName, returns false if the display has the
+// maximum number of connections.
+func (s *DisplayServer) reserve(displayName string) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.maxConns > 0 && s.conns[displayName] >= s.maxConns {
+		return false
+	}
+	s.conns[displayName]++
+	return true
+}
+
+// release a connection to displayName reserved with reserve()
+func (s *DisplayServer) release(displayName string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.conns[displayName]--
+	if s.conns[displayName] <= 0 {
+		delete(s.conns, displayName)
+	}
 }
 
 func (s *DisplayServer) listDisplays(w http.ResponseWriter, r *http.Request) {
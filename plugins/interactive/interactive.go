@@ -60,6 +60,8 @@ func (provider) NewPlugin(options plugins.PluginOptions) (plugins.Plugin, error)
 		config:        c,
 		monitor:       options.Monitor,
 		webhookserver: options.Environment.WebHookServer,
+		scopeSuffix:   options.Environment.ProvisionerID + "/" + options.Environment.WorkerType,
+		storage:       options.Environment.TemporaryStorage,
 	}, nil
 }
 
@@ -68,6 +70,8 @@ type plugin struct {
 	config        config
 	monitor       runtime.Monitor
 	webhookserver webhookserver.WebHookServer
+	scopeSuffix   string // <provisionerId>/<workerType> for requireScopes
+	storage       runtime.TemporaryStorage
 }
 
 func (p *plugin) PayloadSchema() schematypes.Object {
@@ -100,8 +104,9 @@ func (p *plugin) PayloadSchema() schematypes.Object {
 			Title: "Artifact Prefix",
 			Description: util.Markdown(`
 				Prefix for the interactive artifacts will be used to create
-				'<prefix>/shell.html', '<prefix>/display.html' and
-				'<prefix>/sockets.json'. The prefix defaults to
+				'<prefix>/shell.html', '<prefix>/display.html',
+				'<prefix>/display-viewer.html' and '<prefix>/sockets.json'.
+				The prefix defaults to
 				'` + p.config.ArtifactPrefix + `'.
 			`),
 			Pattern:       `^[\x20-.0-\x7e][\x20-\x7e]*/$`,
@@ -135,12 +140,45 @@ func (p *plugin) NewTaskPlugin(options plugins.TaskPluginOptions) (
 		o.ArtifactPrefix = p.config.ArtifactPrefix
 	}
 
+	// Check that task.scopes covers the features enabled, if required
+	if p.config.RequireScopes {
+		ctx := options.TaskContext
+		shellScope := "worker:interactive-shell:" + p.scopeSuffix
+		displayScope := "worker:interactive-display:" + p.scopeSuffix
+		if P.Interactive == nil {
+			// If always enabled, we just disable the features the task can't use
+			o.DisableShell = !ctx.HasScopes([]string{shellScope})
+			o.DisableDisplay = !ctx.HasScopes([]string{displayScope})
+		} else {
+			if !o.DisableShell && !ctx.HasScopes([]string{shellScope}) {
+				return nil, runtime.NewMalformedPayloadError(fmt.Sprintf(
+					"task.scopes must cover '%s' in-order for the task to use the interactive shell, "+
+						"set 'interactive.disableShell' to run the task without it",
+					shellScope,
+				))
+			}
+			if !o.DisableDisplay && !ctx.HasScopes([]string{displayScope}) {
+				return nil, runtime.NewMalformedPayloadError(fmt.Sprintf(
+					"task.scopes must cover '%s' in-order for the task to use the interactive display, "+
+						"set 'interactive.disableDisplay' to run the task without it",
+					displayScope,
+				))
+			}
+		}
+	}
+
+	var recorder *SessionRecorder
+	if p.config.RecordSessions {
+		recorder = NewSessionRecorder(p.storage)
+	}
+
 	return &taskPlugin{
 		context:  options.TaskContext,
 		webhooks: webhookserver.NewWebHookSet(p.webhookserver),
 		opts:     o,
 		monitor:  options.Monitor,
 		parent:   p,
+		recorder: recorder,
 	}, nil
 }
 
@@ -157,6 +195,9 @@ type taskPlugin struct {
 	displaysURL      string
 	displaySocketURL string
 	displayServer    *DisplayServer
+	displayViewerURL string
+	viewerServer     *DisplayServer
+	recorder         *SessionRecorder
 }
 
 func (p *taskPlugin) Started(sandbox engines.Sandbox) error {
@@ -192,6 +233,16 @@ func (p *taskPlugin) Started(sandbox engines.Sandbox) error {
 }
 
 func (p *taskPlugin) Stopped(_ engines.ResultSet) (bool, error) {
+	// Abort sessions before uploading recordings, so the recordings are complete
+	p.abortSessions()
+	if p.recorder != nil {
+		err := p.recorder.Upload(p.context, p.opts.ArtifactPrefix+"recordings/")
+		if err != nil {
+			p.monitor.Error("Failed to upload interactive session recordings, error: ", err)
+			p.Dispose()
+			return false, runtime.ErrNonFatalInternalError
+		}
+	}
 	return true, p.Dispose()
 }
 
@@ -201,6 +252,20 @@ func (p *taskPlugin) Exception(_ runtime.ExceptionReason) error {
 
 func (p *taskPlugin) Dispose() error {
 	// NOTE: This is also called from Stopped() and Exception()
+	p.abortSessions()
+	if p.webhooks != nil {
+		p.webhooks.Dispose()
+	}
+	p.webhooks = nil
+	if p.recorder != nil {
+		p.recorder.Dispose()
+	}
+	p.recorder = nil
+	return nil
+}
+
+// abortSessions aborts all interactive sessions and stops new sessions
+func (p *taskPlugin) abortSessions() {
 	util.Parallel(func() {
 		if p.shellServer != nil {
 			p.shellServer.Abort()
@@ -213,12 +278,11 @@ func (p *taskPlugin) Dispose() error {
 		}
 		p.displayServer = nil
 	}, func() {
-		if p.webhooks != nil {
-			p.webhooks.Dispose()
+		if p.viewerServer != nil {
+			p.viewerServer.Abort()
 		}
-		p.webhooks = nil
+		p.viewerServer = nil
 	})
-	return nil
 }
 
 func (p *taskPlugin) setupShell() error {
@@ -229,8 +293,12 @@ func (p *taskPlugin) setupShell() error {
 	debug("Setting up interactive shell")
 
 	// Create shell server and get a URL to reach it
+	makeShell := ShellFactory(p.sandbox.NewShell)
+	if p.recorder != nil {
+		makeShell = p.recorder.RecordShells(makeShell)
+	}
 	p.shellServer = NewShellServer(
-		p.sandbox.NewShell, p.monitor.WithPrefix("shell-server"),
+		makeShell, p.monitor.WithPrefix("shell-server"),
 	)
 	u := p.webhooks.AttachHook(p.shellServer)
 	p.shellURL = urlProtocolToWebsocket(u)
@@ -256,27 +324,53 @@ func (p *taskPlugin) setupDisplay() error {
 	}
 	debug("Setting up interactive display")
 
-	// Create display server
-	p.displayServer = NewDisplayServer(
-		p.sandbox, p.monitor.WithPrefix("display-server"),
+	// Record display connections, if required
+	var controller, viewer DisplayProvider = p.sandbox, p.sandbox
+	if p.recorder != nil {
+		controller = p.recorder.RecordDisplays(p.sandbox, false)
+		viewer = p.recorder.RecordDisplays(p.sandbox, true)
+	}
+
+	// Create display server for the client in control of the display
+	p.displayServer = NewControllerDisplayServer(
+		controller, p.monitor.WithPrefix("display-server"),
 	)
 	u := p.webhooks.AttachHook(p.displayServer)
 	p.displaysURL = u
 	p.displaySocketURL = urlProtocolToWebsocket(u)
 
+	// Create display server for read-only viewers
+	p.viewerServer = NewViewerDisplayServer(
+		viewer, p.monitor.WithPrefix("display-viewer-server"),
+	)
+	p.displayViewerURL = urlProtocolToWebsocket(p.webhooks.AttachHook(p.viewerServer))
+
+	err := p.createDisplayArtifact("display.html", p.displaySocketURL, false)
+	if err != nil {
+		return err
+	}
+	return p.createDisplayArtifact("display-viewer.html", p.displayViewerURL, true)
+}
+
+// createDisplayArtifact creates a redirect artifact to the display tool, which
+// connects to socketURL. If viewOnly is true the display tool won't send input.
+func (p *taskPlugin) createDisplayArtifact(name, socketURL string, viewOnly bool) error {
 	query := url.Values{}
 	query.Set("v", "1")
 	query.Set("taskId", p.context.TaskID)
 	query.Set("runId", fmt.Sprintf("%d", p.context.RunID))
-	query.Set("socketUrl", p.displaySocketURL)
+	query.Set("socketUrl", socketURL)
 	query.Set("displaysUrl", p.displaysURL)
 	// TODO: Make this an option the engine can specify in ListDisplays
 	//       Probably requires changing display list result to contain websocket
 	//       URLs. Hence, introducing v=2, so leaving it for later.
 	query.Set("shared", "true")
+	if viewOnly {
+		query.Set("viewOnly", "true")
+	}
 
 	return p.context.CreateRedirectArtifact(runtime.RedirectArtifact{
-		Name:     p.opts.ArtifactPrefix + "display.html",
+		Name:     p.opts.ArtifactPrefix + name,
 		Mimetype: "text/html",
 		URL:      p.parent.config.DisplayToolURL + "?" + query.Encode(),
 		Expires:  p.context.TaskInfo.Deadline,
@@ -298,6 +392,9 @@ func (p *taskPlugin) createSocketsFile() error {
 	if p.displaySocketURL != "" {
 		sockets["displaySocketUrl"] = p.displaySocketURL
 	}
+	if p.displayViewerURL != "" {
+		sockets["displayViewerSocketUrl"] = p.displayViewerURL
+	}
 	data, _ := json.MarshalIndent(sockets, "", "  ")
 	return p.context.UploadS3Artifact(runtime.S3Artifact{
 		Name:     p.opts.ArtifactPrefix + "sockets.json",
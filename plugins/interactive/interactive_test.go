@@ -6,11 +6,13 @@ import (
 	"io"
 	"io/ioutil"
 	"net/url"
+	"strings"
 	"testing"
 
 	vnc "github.com/mitchellh/go-vnc"
 	"github.com/taskcluster/slugid-go/slugid"
 	"github.com/taskcluster/taskcluster-worker/plugins/interactive/displayclient"
+	"github.com/taskcluster/taskcluster-worker/plugins/interactive/displayconsts"
 	"github.com/taskcluster/taskcluster-worker/plugins/interactive/shellclient"
 	"github.com/taskcluster/taskcluster-worker/plugins/plugintest"
 	"github.com/taskcluster/taskcluster-worker/runtime/client"
@@ -117,6 +119,7 @@ func TestInteractivePluginDisplay(t *testing.T) {
 	taskID := slugid.V4()
 	q := &client.MockQueue{}
 	display := q.ExpectRedirectArtifact(taskID, 0, "private/interactive/display.html")
+	viewer := q.ExpectRedirectArtifact(taskID, 0, "private/interactive/display-viewer.html")
 	sockets := q.ExpectS3Artifact(taskID, 0, "private/interactive/sockets.json")
 	plugintest.Case{
 		Payload: `{
@@ -138,10 +141,19 @@ func TestInteractivePluginDisplay(t *testing.T) {
 			u, _ := url.Parse(displayToolURL)
 			displaysURL := u.Query().Get("displaysUrl")
 			socketURL := u.Query().Get("socketUrl")
+			displayViewerURL := <-viewer
+			u, _ = url.Parse(displayViewerURL)
+			viewerSocketURL := u.Query().Get("socketUrl")
+			if u.Query().Get("viewOnly") != "true" {
+				panic("Expected viewOnly=true for display-viewer.html")
+			}
 
 			// Check that socket.json contains the socket url too
 			var s map[string]string
 			json.Unmarshal(<-sockets, &s)
+			if viewerSocketURL != s["displayViewerSocketUrl"] {
+				panic("Expected displayViewerSocketUrl to match redirect artifact target")
+			}
 			if socketURL != s["displaySocketUrl"] {
 				panic("Expected displaySocketUrl to match redirect artifact target")
 			}
@@ -178,6 +190,114 @@ func TestInteractivePluginDisplay(t *testing.T) {
 			if res.width != displays[0].Width {
 				panic("width mismatch")
 			}
+
+			debug("OpenDisplay while display is in use")
+			_, err = displays[0].OpenDisplay()
+			if e, ok := err.(*displayconsts.ErrorMessage); !ok || e.Code != displayconsts.ErrorCodeDisplayInUse {
+				panic(fmt.Sprintf("Expected DisplayInUse error, got: %v", err))
+			}
+
+			debug("Open read-only display")
+			for i := 0; i < 2; i++ {
+				v, err := displayclient.Dial(viewerSocketURL, displays[0].Display)
+				if err != nil {
+					panic(fmt.Sprintf("Failed to open read-only display, error: %s", err))
+				}
+				res, err = getDisplayResolution(v)
+				if err != nil {
+					panic(fmt.Sprintf("Failed connect to read-only VNC display, error: %s", err))
+				}
+				if res.height != displays[0].Height || res.width != displays[0].Width {
+					panic("read-only display resolution mismatch")
+				}
+			}
+		},
+	}.Test()
+}
+
+func TestInteractivePluginRequireScopes(t *testing.T) {
+	taskID := slugid.V4()
+	q := &client.MockQueue{}
+	q.ExpectRedirectArtifact(taskID, 0, "private/interactive/shell.html")
+	sockets := q.ExpectS3Artifact(taskID, 0, "private/interactive/sockets.json")
+	plugintest.Case{
+		Payload: `{
+			"delay": 250,
+			"function": "true",
+			"argument": "whatever"
+		}`,
+		Plugin: "interactive",
+		PluginConfig: `{
+			"alwaysEnabled": true,
+			"requireScopes": true
+		}`,
+		Scopes:        []string{"worker:interactive-shell:dummy-provisioner/*"},
+		PluginSuccess: true,
+		EngineSuccess: true,
+		QueueMock:     q,
+		TaskID:        taskID,
+		AfterStarted: func(plugintest.Options) {
+			// Check that only the shell is enabled, as display scope is missing
+			var s map[string]interface{}
+			json.Unmarshal(<-sockets, &s)
+			if _, ok := s["shellSocketUrl"]; !ok {
+				panic("Expected shellSocketUrl in sockets.json")
+			}
+			if _, ok := s["displaySocketUrl"]; ok {
+				panic("Expected no displaySocketUrl in sockets.json without scopes")
+			}
+		},
+	}.Test()
+}
+
+func TestInteractivePluginRecordSessions(t *testing.T) {
+	taskID := slugid.V4()
+	q := &client.MockQueue{}
+	shell := q.ExpectRedirectArtifact(taskID, 0, "private/interactive/shell.html")
+	q.ExpectS3Artifact(taskID, 0, "private/interactive/sockets.json")
+	recording := q.ExpectS3Artifact(taskID, 0, "private/interactive/recordings/shell-1.cast")
+	plugintest.Case{
+		Payload: `{
+			"delay": 250,
+			"function": "true",
+			"argument": "whatever",
+			"interactive": {
+				"disableDisplay": true
+			}
+		}`,
+		Plugin:        "interactive",
+		PluginConfig:  `{"recordSessions": true}`,
+		PluginSuccess: true,
+		EngineSuccess: true,
+		QueueMock:     q,
+		TaskID:        taskID,
+		AfterStarted: func(plugintest.Options) {
+			u, _ := url.Parse(<-shell)
+			sh, err := shellclient.Dial(u.Query().Get("socketUrl"), nil, false)
+			if err != nil {
+				panic(fmt.Sprintf("Failed to open shell, error: %s", err))
+			}
+			go func() {
+				sh.StdinPipe().Write([]byte("print-hello"))
+				sh.StdinPipe().Close()
+			}()
+			ioutil.ReadAll(sh.StdoutPipe())
+			if _, err = sh.Wait(); err != nil {
+				panic(fmt.Sprintf("Error from shell, error: %s", err))
+			}
+		},
+		AfterStopped: func(plugintest.Options) {
+			// Check that input and output was recorded in asciicast format
+			cast := string(<-recording)
+			if !strings.HasPrefix(cast, `{`) || !strings.Contains(cast, `"version":2`) {
+				panic(fmt.Sprintf("Expected asciicast v2 header, got: %s", cast))
+			}
+			if !strings.Contains(cast, `"i","print-hello"`) {
+				panic(fmt.Sprintf("Expected input to be recorded, got: %s", cast))
+			}
+			if !strings.Contains(cast, `"o","Hello World"`) {
+				panic(fmt.Sprintf("Expected output to be recorded, got: %s", cast))
+			}
 		},
 	}.Test()
 }
@@ -0,0 +1,207 @@
+package interactive
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// RFB security types, see RFC 6143 section 7.1.2
+const (
+	rfbSecurityNone = 1
+	rfbSecurityVNC  = 2
+)
+
+// RFB client-to-server message types, see RFC 6143 section 7.5, and the
+// extensions used by noVNC.
+const (
+	rfbSetPixelFormat           = 0
+	rfbSetEncodings             = 2
+	rfbFramebufferUpdateRequest = 3
+	rfbKeyEvent                 = 4
+	rfbPointerEvent             = 5
+	rfbClientCutText            = 6
+	rfbEnableContinuousUpdates  = 150
+	rfbClientFence              = 248
+	rfbQEMUClientMessage        = 255
+)
+
+// rfbMaxCutText is the maximum length of ClientCutText we'll discard, before
+// giving up on the display client.
+const rfbMaxCutText = 1024 * 1024
+
+// readOnlyDisplay is a display connection that discards input events from the
+// display client, so the display client can only view the display.
+type readOnlyDisplay struct {
+	io.Reader
+	display io.ReadWriteCloser
+	input   *io.PipeWriter
+	once    sync.Once
+}
+
+// newReadOnlyDisplay returns a display connection for display, which discards
+// key events, pointer events and clipboard updates written by the display
+// client. The display client must use RFB 3.7 or later, and the display must
+// offer no authentication or VNC authentication. The connection is closed if
+// the display client sends a message that can't be parsed.
+func newReadOnlyDisplay(display io.ReadWriteCloser) io.ReadWriteCloser {
+	r, w := io.Pipe()
+	d := &readOnlyDisplay{
+		Reader:  display,
+		display: display,
+		input:   w,
+	}
+	go func() {
+		err := filterRFBInput(r, display)
+		debug("read-only display input stopped, error: %s", err)
+		r.CloseWithError(err)
+		d.Close()
+	}()
+	return d
+}
+
+func (d *readOnlyDisplay) Write(p []byte) (int, error) {
+	return d.input.Write(p)
+}
+
+func (d *readOnlyDisplay) Close() error {
+	var err error
+	d.once.Do(func() {
+		d.input.Close()
+		err = d.display.Close()
+	})
+	return err
+}
+
+// filterRFBInput copies the RFB messages sent by a display client from r to
+// w, except for messages that would interact with the display. The shared
+// flag is always set, so read-only clients can't disconnect other clients.
+func filterRFBInput(r io.Reader, w io.Writer) error {
+	// ProtocolVersion
+	var version [12]byte
+	if _, err := io.ReadFull(r, version[:]); err != nil {
+		return err
+	}
+	v := string(version[:])
+	if !strings.HasPrefix(v, "RFB 003.") {
+		return errors.Errorf("unsupported RFB protocol version: %q", v)
+	}
+	minor, err := strconv.Atoi(v[8:11])
+	if err != nil || minor < 7 {
+		return errors.Errorf("read-only displays require RFB 3.7 or later, got: %q", v)
+	}
+	if _, err = w.Write(version[:]); err != nil {
+		return err
+	}
+
+	// Security type selected, followed by a response to the challenge, if VNC
+	// authentication is selected
+	var security [1]byte
+	if _, err = io.ReadFull(r, security[:]); err != nil {
+		return err
+	}
+	if security[0] != rfbSecurityNone && security[0] != rfbSecurityVNC {
+		return errors.Errorf("read-only displays don't support RFB security type: %d", security[0])
+	}
+	if _, err = w.Write(security[:]); err != nil {
+		return err
+	}
+	if security[0] == rfbSecurityVNC {
+		if _, err = io.CopyN(w, r, 16); err != nil {
+			return err
+		}
+	}
+
+	// ClientInit, always request a shared session
+	var shared [1]byte
+	if _, err = io.ReadFull(r, shared[:]); err != nil {
+		return err
+	}
+	if _, err = w.Write([]byte{1}); err != nil {
+		return err
+	}
+
+	// Client-to-server messages
+	for {
+		var t [1]byte
+		if _, err = io.ReadFull(r, t[:]); err != nil {
+			return err
+		}
+		switch t[0] {
+		case rfbSetPixelFormat:
+			err = copyBytes(w, r, 19, t[:])
+		case rfbSetEncodings:
+			var header [3]byte
+			if _, err = io.ReadFull(r, header[:]); err != nil {
+				return err
+			}
+			count := int64(binary.BigEndian.Uint16(header[1:]))
+			if err = copyBytes(w, r, 0, append(t[:], header[:]...)); err == nil {
+				_, err = io.CopyN(w, r, 4*count)
+			}
+		case rfbFramebufferUpdateRequest:
+			err = copyBytes(w, r, 9, t[:])
+		case rfbEnableContinuousUpdates:
+			err = copyBytes(w, r, 9, t[:])
+		case rfbClientFence:
+			var header [8]byte
+			if _, err = io.ReadFull(r, header[:]); err != nil {
+				return err
+			}
+			if err = copyBytes(w, r, 0, append(t[:], header[:]...)); err == nil {
+				_, err = io.CopyN(w, r, int64(header[7]))
+			}
+		case rfbKeyEvent:
+			err = discardBytes(r, 7)
+		case rfbPointerEvent:
+			err = discardBytes(r, 5)
+		case rfbClientCutText:
+			var header [7]byte
+			if _, err = io.ReadFull(r, header[:]); err != nil {
+				return err
+			}
+			length := int64(binary.BigEndian.Uint32(header[3:]))
+			if length > rfbMaxCutText {
+				return errors.Errorf("ClientCutText of %d bytes exceeds the maximum", length)
+			}
+			err = discardBytes(r, length)
+		case rfbQEMUClientMessage:
+			// Only the extended key event is supported, as used by noVNC
+			var subtype [1]byte
+			if _, err = io.ReadFull(r, subtype[:]); err != nil {
+				return err
+			}
+			if subtype[0] != 0 {
+				return errors.Errorf("unsupported QEMU client message: %d", subtype[0])
+			}
+			err = discardBytes(r, 10)
+		default:
+			return errors.Errorf("unsupported RFB message type: %d", t[0])
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// copyBytes writes prefix followed by n bytes from r to w
+func copyBytes(w io.Writer, r io.Reader, n int64, prefix []byte) error {
+	data := make([]byte, int64(len(prefix))+n)
+	copy(data, prefix)
+	if _, err := io.ReadFull(r, data[len(prefix):]); err != nil {
+		return err
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// discardBytes reads n bytes from r
+func discardBytes(r io.Reader, n int64) error {
+	_, err := io.CopyN(ioutil.Discard, r, n)
+	return err
+}
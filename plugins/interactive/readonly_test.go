@@ -0,0 +1,66 @@
+package interactive
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestFilterRFBInput(t *testing.T) {
+	var in bytes.Buffer
+	in.WriteString("RFB 003.008\n")
+	in.Write([]byte{rfbSecurityNone})
+	in.Write([]byte{0}) // ClientInit, not shared
+	setEncodings := []byte{rfbSetEncodings, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0, 1}
+	in.Write(setEncodings)
+	in.Write([]byte{rfbKeyEvent, 1, 0, 0, 0, 0, 0, 0x61})
+	in.Write([]byte{rfbPointerEvent, 1, 0, 10, 0, 10})
+	in.Write([]byte{rfbClientCutText, 0, 0, 0, 0, 0, 0, 5})
+	in.WriteString("hello")
+	in.Write([]byte{rfbQEMUClientMessage, 0, 0, 1, 0, 0, 0, 0x61, 0, 0, 0, 0x1e})
+	update := []byte{rfbFramebufferUpdateRequest, 1, 0, 0, 0, 0, 0, 100, 0, 100}
+	in.Write(update)
+
+	var out bytes.Buffer
+	err := filterRFBInput(&in, &out)
+	if err != io.EOF {
+		t.Fatal("Expected io.EOF, got: ", err)
+	}
+
+	var expected bytes.Buffer
+	expected.WriteString("RFB 003.008\n")
+	expected.Write([]byte{rfbSecurityNone})
+	expected.Write([]byte{1}) // ClientInit, always shared
+	expected.Write(setEncodings)
+	expected.Write(update)
+	if !bytes.Equal(out.Bytes(), expected.Bytes()) {
+		t.Errorf("Expected: %v, got: %v", expected.Bytes(), out.Bytes())
+	}
+}
+
+func TestFilterRFBInputOldVersion(t *testing.T) {
+	in := bytes.NewBufferString("RFB 003.003\n")
+	var out bytes.Buffer
+	if err := filterRFBInput(in, &out); err == nil {
+		t.Fatal("Expected RFB 3.3 to be rejected")
+	}
+	if out.Len() != 0 {
+		t.Error("Expected nothing to be written")
+	}
+}
+
+func TestFilterRFBInputUnknownMessage(t *testing.T) {
+	var in bytes.Buffer
+	in.WriteString("RFB 003.008\n")
+	in.Write([]byte{rfbSecurityVNC})
+	in.Write(make([]byte, 16)) // challenge response
+	in.Write([]byte{1})
+	in.Write([]byte{42})
+	var out bytes.Buffer
+	if err := filterRFBInput(&in, &out); err == nil || err == io.EOF {
+		t.Fatal("Expected unknown message type to be rejected, got: ", err)
+	}
+	if out.Len() != 12+1+16+1 {
+		t.Errorf("Expected handshake to be forwarded, got %d bytes", out.Len())
+	}
+}
@@ -0,0 +1,346 @@
+package interactive
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/engines"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/ioext"
+)
+
+// Default TTY size for shell recordings, used until the client sets the size
+const (
+	recordingDefaultColumns = 80
+	recordingDefaultRows    = 24
+)
+
+// A SessionRecorder records interactive shell and display sessions, so they
+// can be uploaded as artifacts when the task is done. Shell sessions are
+// recorded in the asciicast v2 format, including input and resize events.
+// For display sessions only metadata is recorded, as recording the framebuffer
+// is better done by the engine.
+type SessionRecorder struct {
+	m        sync.Mutex
+	storage  runtime.TemporaryStorage
+	shells   []*shellRecording
+	displays []*displayRecording
+	closed   bool
+}
+
+// NewSessionRecorder creates a SessionRecorder that writes shell recordings
+// to files in storage.
+func NewSessionRecorder(storage runtime.TemporaryStorage) *SessionRecorder {
+	return &SessionRecorder{storage: storage}
+}
+
+// RecordShells returns a ShellFactory that records all shells created with
+// makeShell. If a recording can't be created the shell isn't created.
+func (r *SessionRecorder) RecordShells(makeShell ShellFactory) ShellFactory {
+	return func(command []string, tty bool) (engines.Shell, error) {
+		r.m.Lock()
+		defer r.m.Unlock()
+		if r.closed {
+			return nil, engines.ErrSandboxTerminated
+		}
+
+		file, err := r.storage.NewFile()
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create file for shell recording")
+		}
+		rec := &shellRecording{file: file, start: time.Now()}
+		if err = rec.writeHeader(command, tty); err != nil {
+			file.Close()
+			return nil, errors.Wrap(err, "failed to write shell recording header")
+		}
+
+		shell, err := makeShell(command, tty)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		r.shells = append(r.shells, rec)
+		return &recordedShell{
+			Shell:  shell,
+			rec:    rec,
+			stdin:  &recordingWriter{WriteCloser: shell.StdinPipe(), rec: rec, event: "i"},
+			stdout: &recordingReader{ReadCloser: shell.StdoutPipe(), rec: rec},
+			stderr: &recordingReader{ReadCloser: shell.StderrPipe(), rec: rec},
+		}, nil
+	}
+}
+
+// RecordDisplays returns a DisplayProvider that records metadata for all
+// display connections opened with provider. If readOnly is true connections
+// are recorded as read-only viewers.
+func (r *SessionRecorder) RecordDisplays(provider DisplayProvider, readOnly bool) DisplayProvider {
+	return &recordingDisplayProvider{
+		DisplayProvider: provider,
+		recorder:        r,
+		readOnly:        readOnly,
+	}
+}
+
+// Upload closes all recordings and uploads them as artifacts under prefix,
+// shell recordings are uploaded as '<prefix>shell-<N>.cast' and display
+// metadata as '<prefix>displays.json'. Sessions should be aborted before
+// calling this, as events after Upload() is called are not recorded.
+func (r *SessionRecorder) Upload(context *runtime.TaskContext, prefix string) error {
+	r.m.Lock()
+	r.closed = true
+	shells := r.shells
+	displays := r.displays
+	r.m.Unlock()
+
+	for i, rec := range shells {
+		file := rec.close()
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return errors.Wrap(err, "failed to seek to start of shell recording")
+		}
+		name := fmt.Sprintf("%sshell-%d.cast", prefix, i+1)
+		debug("Uploading %s", name)
+		err := context.UploadS3Artifact(runtime.S3Artifact{
+			Name:     name,
+			Mimetype: "application/x-asciicast",
+			Expires:  context.TaskInfo.Expires,
+			Stream:   ioext.NopCloser(file),
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed to upload %s", name)
+		}
+	}
+
+	if len(displays) == 0 {
+		return nil
+	}
+	entries := make([]displayRecordingEntry, len(displays))
+	for i, rec := range displays {
+		entries[i] = rec.entry()
+	}
+	data, _ := json.MarshalIndent(entries, "", "  ")
+	debug("Uploading %sdisplays.json", prefix)
+	err := context.UploadS3Artifact(runtime.S3Artifact{
+		Name:     prefix + "displays.json",
+		Mimetype: "application/json",
+		Expires:  context.TaskInfo.Expires,
+		Stream:   ioext.NopCloser(bytes.NewReader(data)),
+	})
+	return errors.Wrapf(err, "failed to upload %sdisplays.json", prefix)
+}
+
+// Dispose removes all recordings, this must be called after Upload()
+func (r *SessionRecorder) Dispose() {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.closed = true
+	for _, rec := range r.shells {
+		rec.close().Close()
+	}
+	r.shells = nil
+	r.displays = nil
+}
+
+// shellRecording is an asciicast v2 recording of a shell session
+type shellRecording struct {
+	m      sync.Mutex
+	file   runtime.TemporaryFile
+	start  time.Time
+	closed bool
+}
+
+func (rec *shellRecording) writeHeader(command []string, tty bool) error {
+	header := map[string]interface{}{
+		"version":   2,
+		"width":     recordingDefaultColumns,
+		"height":    recordingDefaultRows,
+		"timestamp": rec.start.Unix(),
+		"env":       map[string]string{"TTY": fmt.Sprintf("%t", tty)},
+	}
+	if len(command) > 0 {
+		header["command"] = strings.Join(command, " ")
+	}
+	data, err := json.Marshal(header)
+	if err != nil {
+		panic(errors.Wrap(err, "failed to marshal asciicast header"))
+	}
+	_, err = rec.file.Write(append(data, '\n'))
+	return err
+}
+
+// record writes an event to the recording, event is 'o' for output, 'i' for
+// input and 'r' for resize. Errors are ignored, as they shouldn't interrupt
+// the shell, the recording will be truncated instead.
+func (rec *shellRecording) record(event string, data string) {
+	rec.m.Lock()
+	defer rec.m.Unlock()
+	if rec.closed {
+		return
+	}
+	elapsed := time.Since(rec.start).Seconds()
+	line, err := json.Marshal([]interface{}{elapsed, event, data})
+	if err != nil {
+		panic(errors.Wrap(err, "failed to marshal asciicast event"))
+	}
+	if _, err = rec.file.Write(append(line, '\n')); err != nil {
+		debug("Failed to write shell recording, error: %s", err)
+		rec.closed = true
+	}
+}
+
+// close stops recording and returns the file
+func (rec *shellRecording) close() runtime.TemporaryFile {
+	rec.m.Lock()
+	defer rec.m.Unlock()
+	rec.closed = true
+	return rec.file
+}
+
+// recordedShell wraps an engines.Shell and records input, output and resizes
+type recordedShell struct {
+	engines.Shell
+	rec    *shellRecording
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr io.ReadCloser
+}
+
+func (s *recordedShell) StdinPipe() io.WriteCloser {
+	return s.stdin
+}
+
+func (s *recordedShell) StdoutPipe() io.ReadCloser {
+	return s.stdout
+}
+
+func (s *recordedShell) StderrPipe() io.ReadCloser {
+	return s.stderr
+}
+
+func (s *recordedShell) SetSize(columns, rows uint16) error {
+	s.rec.record("r", fmt.Sprintf("%dx%d", columns, rows))
+	return s.Shell.SetSize(columns, rows)
+}
+
+type recordingReader struct {
+	io.ReadCloser
+	rec *shellRecording
+}
+
+func (r *recordingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.rec.record("o", string(p[:n]))
+	}
+	return n, err
+}
+
+type recordingWriter struct {
+	io.WriteCloser
+	rec   *shellRecording
+	event string
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.rec.record(w.event, string(p))
+	return w.WriteCloser.Write(p)
+}
+
+// displayRecordingEntry is the metadata recorded for a display connection
+type displayRecordingEntry struct {
+	Display       string     `json:"display"`
+	ReadOnly      bool       `json:"readOnly"`
+	Opened        time.Time  `json:"opened"`
+	Closed        *time.Time `json:"closed,omitempty"`
+	BytesSent     int64      `json:"bytesSent"`
+	BytesReceived int64      `json:"bytesReceived"`
+}
+
+// displayRecording records metadata for a display connection, bytes sent are
+// bytes written to the display client, bytes received are bytes written by the
+// display client.
+type displayRecording struct {
+	sent     int64 // accessed atomically, must be 64-bit aligned
+	received int64 // accessed atomically, must be 64-bit aligned
+	m        sync.Mutex
+	display  string
+	readOnly bool
+	opened   time.Time
+	closed   time.Time
+}
+
+func (rec *displayRecording) entry() displayRecordingEntry {
+	rec.m.Lock()
+	defer rec.m.Unlock()
+	e := displayRecordingEntry{
+		Display:       rec.display,
+		ReadOnly:      rec.readOnly,
+		Opened:        rec.opened,
+		BytesSent:     atomic.LoadInt64(&rec.sent),
+		BytesReceived: atomic.LoadInt64(&rec.received),
+	}
+	if !rec.closed.IsZero() {
+		closed := rec.closed
+		e.Closed = &closed
+	}
+	return e
+}
+
+type recordingDisplayProvider struct {
+	DisplayProvider
+	recorder *SessionRecorder
+	readOnly bool
+}
+
+func (p *recordingDisplayProvider) OpenDisplay(name string) (io.ReadWriteCloser, error) {
+	p.recorder.m.Lock()
+	defer p.recorder.m.Unlock()
+	if p.recorder.closed {
+		return nil, engines.ErrSandboxTerminated
+	}
+
+	display, err := p.DisplayProvider.OpenDisplay(name)
+	if err != nil {
+		return nil, err
+	}
+	rec := &displayRecording{
+		display:  name,
+		readOnly: p.readOnly,
+		opened:   time.Now(),
+	}
+	p.recorder.displays = append(p.recorder.displays, rec)
+	return &recordedDisplay{ReadWriteCloser: display, rec: rec}, nil
+}
+
+// recordedDisplay wraps a display connection and records metadata
+type recordedDisplay struct {
+	io.ReadWriteCloser
+	rec *displayRecording
+}
+
+func (d *recordedDisplay) Read(p []byte) (int, error) {
+	n, err := d.ReadWriteCloser.Read(p)
+	atomic.AddInt64(&d.rec.sent, int64(n))
+	return n, err
+}
+
+func (d *recordedDisplay) Write(p []byte) (int, error) {
+	n, err := d.ReadWriteCloser.Write(p)
+	atomic.AddInt64(&d.rec.received, int64(n))
+	return n, err
+}
+
+func (d *recordedDisplay) Close() error {
+	d.rec.m.Lock()
+	if d.rec.closed.IsZero() {
+		d.rec.closed = time.Now()
+	}
+	d.rec.m.Unlock()
+	return d.ReadWriteCloser.Close()
+}
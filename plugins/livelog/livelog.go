@@ -10,11 +10,13 @@ import (
 
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
+	"github.com/taskcluster/slugid-go/slugid"
 	tcclient "github.com/taskcluster/taskcluster-client-go"
 	"github.com/taskcluster/taskcluster-worker/plugins"
 	"github.com/taskcluster/taskcluster-worker/runtime"
 	"github.com/taskcluster/taskcluster-worker/runtime/atomics"
 	"github.com/taskcluster/taskcluster-worker/runtime/ioext"
+	"github.com/taskcluster/taskcluster-worker/runtime/webhookserver"
 )
 
 type pluginProvider struct {
@@ -64,18 +66,16 @@ func (p plugin) NewTaskPlugin(options plugins.TaskPluginOptions) (plugins.TaskPl
 func (tp *taskPlugin) setup() {
 	defer tp.setupDone.Done()
 
-	if tp.environment.WebHookServer == nil {
+	if tp.environment.Endpoints == nil && tp.environment.WebHookServer == nil {
 		tp.monitor.Info("livelog disabled when WebHookServer isn't provided")
 		return
 	}
 
-	tp.url, tp.detach = tp.environment.WebHookServer.AttachHook(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet && r.Method != http.MethodHead {
 			w.WriteHeader(http.StatusMethodNotAllowed)
 			return
 		}
-		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD")
-		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Expose-Headers", "X-Streaming")
 		if r.Method == http.MethodHead {
 			w.WriteHeader(http.StatusOK)
@@ -103,9 +103,29 @@ func (tp *taskPlugin) setup() {
 
 		w.WriteHeader(http.StatusOK)
 		ioext.CopyAndFlush(wf, logReader, 100*time.Millisecond)
-	}))
+	})
+
+	// Register under a random name, as the URL is public through the redirect
+	// artifact, the name is what keeps other tasks from guessing it. Without an
+	// endpoint set, attach a hook directly to the WebHookServer, which also
+	// generates a random URL.
+	var err error
+	cors := webhookserver.WithCORS(handler, http.MethodGet, http.MethodHead)
+	if tp.environment.Endpoints != nil {
+		name := slugid.Nice()
+		tp.url, err = tp.environment.Endpoints.Register(name, cors)
+		if err != nil {
+			incidentID := tp.monitor.ReportError(err, "Failed to register livelog endpoint")
+			tp.context.LogError("Failed to setup livelogging: ", incidentID)
+			tp.setupErr = runtime.ErrNonFatalInternalError
+			return
+		}
+		tp.detach = func() { tp.environment.Endpoints.Unregister(name) }
+	} else {
+		tp.url, tp.detach = tp.environment.WebHookServer.AttachHook(cors)
+	}
 
-	err := tp.context.CreateRedirectArtifact(runtime.RedirectArtifact{
+	err = tp.context.CreateRedirectArtifact(runtime.RedirectArtifact{
 		Name:     "public/logs/live.log",
 		Mimetype: "text/plain; charset=utf-8",
 		URL:      tp.url,
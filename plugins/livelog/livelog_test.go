@@ -13,6 +13,14 @@ import (
 )
 
 func TestLiveLogStreaming(t *testing.T) {
+	testLiveLogStreaming(t, false)
+}
+
+func TestLiveLogStreamingWithoutEndpoints(t *testing.T) {
+	testLiveLogStreaming(t, true)
+}
+
+func testLiveLogStreaming(t *testing.T, noEndpoints bool) {
 	taskID := slugid.V4()
 
 	// Create a mock queue
@@ -91,6 +99,7 @@ func TestLiveLogStreaming(t *testing.T) {
 		MatchLog:      "[hello-world-yt5aqnur3]",
 		TaskID:        taskID,
 		QueueMock:     q,
+		NoEndpoints:   noEndpoints,
 		AfterFinished: func(plugintest.Options) {
 			assert.Contains(t, <-livelog, taskID, "Expected an artifact URL containing the taskId")
 			assert.Contains(t, string(<-backing), "[hello-world-yt5aqnur3]")
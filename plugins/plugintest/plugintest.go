@@ -74,6 +74,9 @@ type Case struct {
 	StoppedNow bool
 	// If true, requires that the plugin called StopGracefully
 	StoppedGracefully bool
+	// If true, runtime.Environment.Endpoints is nil, as if the worker didn't
+	// provide an EndpointSet
+	NoEndpoints bool
 
 	// ClientID to be passed to TaskContext
 	ClientID string
@@ -81,6 +84,8 @@ type Case struct {
 	AccessToken string
 	// Certificate to be passed to TaskContext
 	Certificate string
+	// Scopes to be passed to TaskContext as task.scopes
+	Scopes []string
 
 	// Each of these functions is called at the time specified in the name
 	BeforeBuildSandbox func(Options)
@@ -103,6 +108,10 @@ func (c Case) Test() {
 	nilOrPanic(err)
 	defer testServer.Stop()
 	runtimeEnvironment.WebHookServer = testServer
+	if !c.NoEndpoints {
+		runtimeEnvironment.Endpoints = webhookserver.NewEndpointSet(testServer)
+		defer runtimeEnvironment.Endpoints.Dispose()
+	}
 
 	engineProvider := engines.Engines()["mock"]
 	engine, err := engineProvider.NewEngine(engines.EngineOptions{
@@ -120,6 +129,7 @@ func (c Case) Test() {
 	context, controller, err := runtime.NewTaskContext(runtimeEnvironment.TemporaryStorage.NewFilePath(), runtime.TaskInfo{
 		TaskID: taskID,
 		RunID:  c.RunID,
+		Scopes: c.Scopes,
 	})
 	nilOrPanic(err)
 
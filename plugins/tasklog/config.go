@@ -0,0 +1,37 @@
+package tasklog
+
+import (
+	"time"
+
+	schematypes "github.com/taskcluster/go-schematypes"
+	"github.com/taskcluster/taskcluster-worker/runtime/util"
+)
+
+type config struct {
+	UploadInterval time.Duration `json:"uploadInterval"`
+}
+
+var configSchema = schematypes.Object{
+	Title: "`tasklog` Plugin",
+	Description: util.Markdown(`
+		The task log plugin uploads the task log as 'public/logs/task.log' when
+		the task is resolved. The log is gzip compressed while it is written, such
+		that large logs don't have to be compressed in one go at the end.
+	`),
+	Properties: schematypes.Properties{
+		"uploadInterval": schematypes.Duration{
+			Title: "Incremental Upload Interval",
+			Description: util.Markdown(`
+				If given, the compressed log written since the previous upload is
+				uploaded at this interval while the task is running, as
+				'public/logs/task.log.part0000', 'public/logs/task.log.part0001', etc.
+				This way a worker crash near the end of a long running task won't
+				lose the entire log. Each part is a gzip stream, and the parts
+				concatenated in order are the log written so far.
+
+				The entire log is always uploaded as 'public/logs/task.log' when the
+				task is resolved.
+			`),
+		},
+	},
+}
@@ -6,6 +6,10 @@
 // strict subset of features offered by the 'livelog' plugin, however, this
 // plugin will not offer any interactive aspects, hence, some might consider it
 // more secure.
+//
+// The log is gzip compressed as it is written, and what was written since the
+// previous upload may optionally be uploaded as a part at a configured interval
+// while the task is running.
 package tasklog
 
 import "github.com/taskcluster/taskcluster-worker/runtime/util"
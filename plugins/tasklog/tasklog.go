@@ -1,10 +1,8 @@
 package tasklog
 
 import (
-	"compress/gzip"
-	"io"
-
 	"github.com/pkg/errors"
+	schematypes "github.com/taskcluster/go-schematypes"
 	"github.com/taskcluster/taskcluster-worker/plugins"
 	"github.com/taskcluster/taskcluster-worker/runtime"
 	"github.com/taskcluster/taskcluster-worker/runtime/atomics"
@@ -16,6 +14,7 @@ type pluginProvider struct {
 
 type plugin struct {
 	plugins.PluginBase
+	config
 	monitor     runtime.Monitor
 	environment *runtime.Environment
 }
@@ -25,6 +24,7 @@ type taskPlugin struct {
 	parent   *plugin
 	context  *runtime.TaskContext
 	monitor  runtime.Monitor
+	uploader *logUploader
 	uploaded atomics.Once // ensure we only upload once
 }
 
@@ -32,9 +32,17 @@ func init() {
 	plugins.Register("tasklog", &pluginProvider{})
 }
 
+func (pluginProvider) ConfigSchema() schematypes.Schema {
+	return configSchema
+}
+
 func (pluginProvider) NewPlugin(options plugins.PluginOptions) (plugins.Plugin, error) {
+	var c config
+	schematypes.MustValidateAndMap(configSchema, options.Config, &c)
+
 	debug("Created tasklog plugin")
 	return &plugin{
+		config:      c,
 		monitor:     options.Monitor,
 		environment: options.Environment,
 	}, nil
@@ -42,10 +50,18 @@ func (pluginProvider) NewPlugin(options plugins.PluginOptions) (plugins.Plugin,
 
 func (p *plugin) NewTaskPlugin(options plugins.TaskPluginOptions) (plugins.TaskPlugin, error) {
 	debug("Created tasklog taskPlugin")
+	uploader, err := newLogUploader(options.TaskContext, p.environment.TemporaryStorage)
+	if err != nil {
+		return nil, errors.Wrap(err, "tasklog: failed to setup log compression")
+	}
+	if p.UploadInterval > 0 {
+		go uploader.uploadPeriodically(p.UploadInterval, options.Monitor)
+	}
 	return &taskPlugin{
-		parent:  p,
-		context: options.TaskContext,
-		monitor: options.Monitor,
+		parent:   p,
+		context:  options.TaskContext,
+		monitor:  options.Monitor,
+		uploader: uploader,
 	}, nil
 }
 
@@ -65,46 +81,15 @@ func (tp *taskPlugin) Exception(runtime.ExceptionReason) error {
 	return err
 }
 
-func (tp *taskPlugin) uploadLog() error {
-	// Get the log
-	logFile, err := tp.context.ExtractLog()
-	if err != nil {
-		return errors.Wrap(err, "tasklog: TaskContext.extractLog() failed")
-	}
-	defer logFile.Close()
-
-	// Create temporary file for gzipping
-	tempFile, err := tp.parent.environment.TemporaryStorage.NewFile()
-	if err != nil {
-		return errors.Wrap(err, "tasklog: failed to create temporary file")
-	}
-	defer tempFile.Close()
-
-	// gzip the log
-	zip := gzip.NewWriter(tempFile)
-	if _, err = io.Copy(zip, logFile); err != nil {
-		return errors.Wrap(err, "tasklog: failed to read log-file")
-	}
-	if err = zip.Close(); err != nil {
-		return errors.Wrap(err, "tasklog: failed to gzip log-file")
-	}
-	if _, err = tempFile.Seek(0, io.SeekStart); err != nil {
-		return errors.Wrap(err, "tasklog: failed to seek start of temp file")
-	}
+func (tp *taskPlugin) Dispose() error {
+	return tp.uploader.Dispose()
+}
 
-	// Upload gzipped task.log
+func (tp *taskPlugin) uploadLog() error {
+	// Wait for the log to be compressed and upload it
 	debug("uploading 'public/logs/task.log'")
-	err = tp.context.UploadS3Artifact(runtime.S3Artifact{
-		Name:     "public/logs/task.log",
-		Mimetype: "text/plain; charset=utf-8",
-		Expires:  tp.context.TaskInfo.Expires,
-		Stream:   tempFile,
-		AdditionalHeaders: map[string]string{
-			"Content-Encoding": "gzip",
-		},
-	})
-	if err != nil {
-		tp.monitor.Error(errors.Wrap(err, "failed to update task.log"))
+	if err := tp.uploader.finish(); err != nil {
+		tp.monitor.Error(errors.Wrap(err, "failed to upload task.log"))
 		// Upload error isn't fatal, could just be bad network
 		return runtime.ErrNonFatalInternalError
 	}
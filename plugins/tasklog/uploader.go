@@ -0,0 +1,206 @@
+package tasklog
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+// logUploader compresses the task log to a temporary file as it is written,
+// uploads the compressed log written since the last part, when uploadPart() is
+// called, and uploads the entire compressed log when finish() is called.
+//
+// The log is compressed as a series of gzip members, each upload completes the
+// current member, such that each part and the concatenation of parts is always
+// a valid gzip stream.
+type logUploader struct {
+	m              sync.Mutex
+	context        *runtime.TaskContext
+	uploadArtifact func(runtime.S3Artifact) error
+	file           runtime.TemporaryFile
+	zip            *gzip.Writer
+	size           int64 // size of complete gzip members in file
+	dirty          bool  // true, if zip has data not in a complete member
+	uploaded       int64 // size of compressed log uploaded as parts
+	parts          int   // number of parts uploaded
+	reader         io.ReadCloser
+	copyDone       chan struct{}
+	copyErr        error
+	stopped        chan struct{}
+	stopOnce       sync.Once
+}
+
+func newLogUploader(context *runtime.TaskContext, storage runtime.TemporaryStorage) (*logUploader, error) {
+	reader, err := context.NewLogReader()
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to open log reader")
+	}
+	file, err := storage.NewFile()
+	if err != nil {
+		reader.Close()
+		return nil, errors.Wrap(err, "failed to create temporary file")
+	}
+	u := &logUploader{
+		context:        context,
+		uploadArtifact: context.UploadS3Artifact,
+		file:           file,
+		zip:            gzip.NewWriter(file),
+		reader:         reader,
+		copyDone:       make(chan struct{}),
+		stopped:        make(chan struct{}),
+	}
+	go u.copyLog()
+	return u, nil
+}
+
+// copyLog compresses the log to file until EOF, when the log is closed
+func (u *logUploader) copyLog() {
+	defer close(u.copyDone)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := u.reader.Read(buf)
+		if n > 0 {
+			u.m.Lock()
+			_, werr := u.zip.Write(buf[:n])
+			u.dirty = true
+			u.m.Unlock()
+			if werr != nil {
+				u.copyErr = errors.Wrap(werr, "failed to compress log")
+				return
+			}
+		}
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			u.copyErr = errors.Wrap(err, "failed to read log")
+			return
+		}
+	}
+}
+
+// uploadPeriodically uploads a part every interval until stop() is called
+func (u *logUploader) uploadPeriodically(interval time.Duration, monitor runtime.Monitor) {
+	for {
+		select {
+		case <-u.stopped:
+			return
+		case <-u.copyDone:
+			return
+		case <-time.After(interval):
+		}
+		if err := u.uploadPart(); err != nil {
+			// Not critical, the next part will include what wasn't uploaded
+			monitor.Warn("failed to upload incremental task.log, error: ", err)
+		}
+	}
+}
+
+// finish waits for the log to be read until EOF and uploads the entire log
+func (u *logUploader) finish() error {
+	u.stop()
+	<-u.copyDone
+	if u.copyErr != nil {
+		return u.copyErr
+	}
+	size, err := u.completeMember()
+	if err != nil {
+		return err
+	}
+	return u.uploadRange("public/logs/task.log", 0, size)
+}
+
+func (u *logUploader) stop() {
+	u.stopOnce.Do(func() {
+		close(u.stopped)
+	})
+}
+
+// completeMember completes the current gzip member, if it has data, and
+// returns the size of the complete gzip members in file.
+func (u *logUploader) completeMember() (int64, error) {
+	u.m.Lock()
+	defer u.m.Unlock()
+
+	// Always complete a member if there is none, so the log is valid gzip
+	if u.dirty || u.size == 0 {
+		if err := u.zip.Close(); err != nil {
+			return 0, errors.Wrap(err, "failed to complete gzip member")
+		}
+		size, err := u.file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, errors.Wrap(err, "failed to get size of compressed log")
+		}
+		u.size = size
+		u.dirty = false
+		u.zip.Reset(u.file)
+	}
+	return u.size, nil
+}
+
+// uploadPart uploads the compressed log written since the previous part as
+// 'public/logs/task.log.partNNNN', this must not be called concurrently.
+func (u *logUploader) uploadPart() error {
+	u.m.Lock()
+	idle := !u.dirty && u.size == u.uploaded
+	u.m.Unlock()
+	if idle {
+		return nil // nothing was written since the previous part
+	}
+
+	size, err := u.completeMember()
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("public/logs/task.log.part%04d", u.parts)
+	if err = u.uploadRange(name, u.uploaded, size); err != nil {
+		return err
+	}
+	u.uploaded = size
+	u.parts++
+	return nil
+}
+
+// uploadRange uploads the compressed log from offset to size as artifact name
+func (u *logUploader) uploadRange(name string, offset, size int64) error {
+	// Open the file again, so we can read while compression continues
+	f, err := os.Open(u.file.Path())
+	if err != nil {
+		return errors.Wrap(err, "failed to open compressed log")
+	}
+	defer f.Close()
+
+	debug("uploading '%s' with %d bytes", name, size-offset)
+	return u.uploadArtifact(runtime.S3Artifact{
+		Name:     name,
+		Mimetype: "text/plain; charset=utf-8",
+		Expires:  u.context.TaskInfo.Expires,
+		Stream: &sectionReadCloser{
+			SectionReader: io.NewSectionReader(f, offset, size-offset),
+			Closer:        f,
+		},
+		AdditionalHeaders: map[string]string{
+			"Content-Encoding": "gzip",
+		},
+	})
+}
+
+// Dispose releases the log reader and temporary file
+func (u *logUploader) Dispose() error {
+	u.stop()
+	u.reader.Close()
+	<-u.copyDone
+	return u.file.Close()
+}
+
+// sectionReadCloser wraps io.SectionReader as ioext.ReadSeekCloser
+type sectionReadCloser struct {
+	*io.SectionReader
+	io.Closer
+}
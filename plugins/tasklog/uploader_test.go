@@ -0,0 +1,127 @@
+package tasklog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+// waitForData waits for the log uploader to compress data written to the log
+func waitForData(t *testing.T, u *logUploader, text string) {
+	_, err := u.context.LogDrain().Write([]byte(text))
+	require.NoError(t, err)
+	for i := 0; i < 500; i++ {
+		u.m.Lock()
+		dirty := u.dirty
+		u.m.Unlock()
+		if dirty {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("log uploader didn't read data written to the log")
+}
+
+func gunzip(t *testing.T, data []byte) string {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	require.NoError(t, err)
+	text, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return string(text)
+}
+
+func TestLogUploaderParts(t *testing.T) {
+	folder := runtime.NewTemporaryTestFolderOrPanic()
+	defer folder.Remove()
+	ctx, controller, err := runtime.NewTaskContext(folder.NewFilePath(), runtime.TaskInfo{})
+	require.NoError(t, err)
+	defer controller.Dispose()
+
+	u, err := newLogUploader(ctx, folder)
+	require.NoError(t, err)
+	defer u.Dispose()
+
+	// Capture uploaded artifacts
+	var names []string
+	uploads := make(map[string][]byte)
+	u.uploadArtifact = func(artifact runtime.S3Artifact) error {
+		defer artifact.Stream.Close()
+		data, rerr := ioutil.ReadAll(artifact.Stream)
+		require.NoError(t, rerr)
+		require.Equal(t, "gzip", artifact.AdditionalHeaders["Content-Encoding"])
+		names = append(names, artifact.Name)
+		uploads[artifact.Name] = data
+		return nil
+	}
+
+	debug("### Test that each part only contains data written since the last")
+	waitForData(t, u, "hello\n")
+	require.NoError(t, u.uploadPart())
+	waitForData(t, u, "world\n")
+	require.NoError(t, u.uploadPart())
+	require.Equal(t, []string{"public/logs/task.log.part0000", "public/logs/task.log.part0001"}, names)
+	require.Equal(t, "hello\n", gunzip(t, uploads["public/logs/task.log.part0000"]))
+	require.Equal(t, "world\n", gunzip(t, uploads["public/logs/task.log.part0001"]))
+
+	debug("### Test that nothing is uploaded, if nothing was written")
+	require.NoError(t, u.uploadPart())
+	require.Len(t, names, 2)
+
+	debug("### Test that a failed part is included in the next part")
+	waitForData(t, u, "failed\n")
+	upload := u.uploadArtifact
+	u.uploadArtifact = func(runtime.S3Artifact) error { return errors.New("upload failed") }
+	require.Error(t, u.uploadPart())
+	u.uploadArtifact = upload
+	waitForData(t, u, "retried\n")
+	require.NoError(t, u.uploadPart())
+	require.Equal(t, "failed\nretried\n", gunzip(t, uploads["public/logs/task.log.part0002"]))
+
+	debug("### Test that finish uploads the entire log as multiple gzip members")
+	waitForData(t, u, "done\n")
+	require.NoError(t, controller.CloseLog())
+	require.NoError(t, u.finish())
+	log := uploads["public/logs/task.log"]
+	require.Equal(t, "hello\nworld\nfailed\nretried\ndone\n", gunzip(t, log))
+
+	// Parts concatenated are a prefix of the entire log
+	var parts []byte
+	for _, name := range names[:3] {
+		parts = append(parts, uploads[name]...)
+	}
+	require.True(t, bytes.HasPrefix(log, parts), "expected parts to be a prefix of task.log")
+	require.Equal(t, "hello\nworld\nfailed\nretried\n", gunzip(t, parts))
+}
+
+func TestLogUploaderEmptyLog(t *testing.T) {
+	folder := runtime.NewTemporaryTestFolderOrPanic()
+	defer folder.Remove()
+	ctx, controller, err := runtime.NewTaskContext(folder.NewFilePath(), runtime.TaskInfo{})
+	require.NoError(t, err)
+	defer controller.Dispose()
+
+	u, err := newLogUploader(ctx, folder)
+	require.NoError(t, err)
+	defer u.Dispose()
+
+	var log []byte
+	u.uploadArtifact = func(artifact runtime.S3Artifact) error {
+		defer artifact.Stream.Close()
+		require.Equal(t, "public/logs/task.log", artifact.Name)
+		data, rerr := ioutil.ReadAll(artifact.Stream)
+		log = data
+		return rerr
+	}
+
+	// An empty log is uploaded as a valid gzip stream
+	require.NoError(t, u.uploadPart())
+	require.NoError(t, controller.CloseLog())
+	require.NoError(t, u.finish())
+	require.Equal(t, "", gunzip(t, log))
+}
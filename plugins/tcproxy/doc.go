@@ -5,6 +5,12 @@
 // this proxy the request will be signed with task.scopes, enabling
 // task-specific code to make authenticated requests without obtaining
 // credentials that could be leaked.
+//
+// Requests are only forwarded to taskcluster services, and the signature is
+// restricted to task.scopes using authorizedScopes, as the task credentials
+// may carry additional scopes for the worker. Taskcluster services are
+// identified from the baseUrls of the queue and auth services used by the
+// worker.
 package tcproxy
 
 import "github.com/taskcluster/taskcluster-worker/runtime/util"
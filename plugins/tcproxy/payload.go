@@ -17,7 +17,15 @@ var payloadSchema = schematypes.Object{
 				Please refer to engine specific documentation for how to access the
 				proxy, often it is something like: 'http://<hostname>/<proxy>/<...>',
 				hence, forwarding to the queue would be
-				'http://<hostname>/tcproxy/queue.taskcluster.net/...'.
+				'http://<hostname>/tcproxy/queue.taskcluster.net/...', or just
+				'http://<hostname>/tcproxy/queue/...' like the docker-worker
+				taskcluster-proxy. Requests are only forwarded to the queue and
+				auth services configured for the worker, and other services on the
+				same domain, if the queue is 'queue.<domain>'.
+
+				A 'POST' request to 'http://<hostname>/tcproxy/bewit' with a URL as
+				body, responds with a redirect to the URL signed with 'task.scopes',
+				valid for one hour.
 			`),
 		},
 	},
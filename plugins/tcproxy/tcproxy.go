@@ -6,13 +6,17 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"regexp"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	schematypes "github.com/taskcluster/go-schematypes"
 	"github.com/taskcluster/taskcluster-worker/engines"
 	"github.com/taskcluster/taskcluster-worker/plugins"
 	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/client"
+	"github.com/taskcluster/taskcluster-worker/runtime/ioext"
 )
 
 type provider struct {
@@ -21,12 +25,14 @@ type provider struct {
 
 type plugin struct {
 	plugins.PluginBase
+	services *services
 }
 
 type taskPlugin struct {
 	plugins.TaskPluginBase
-	monitor runtime.Monitor
-	context *runtime.TaskContext
+	monitor  runtime.Monitor
+	context  *runtime.TaskContext
+	services *services
 }
 
 func init() {
@@ -34,7 +40,19 @@ func init() {
 }
 
 func (provider) NewPlugin(options plugins.PluginOptions) (plugins.Plugin, error) {
-	return &plugin{}, nil
+	queueBaseURL := options.Environment.QueueBaseURL
+	if queueBaseURL == "" {
+		queueBaseURL = defaultQueueBaseURL
+	}
+	authBaseURL := options.Environment.AuthBaseURL
+	if authBaseURL == "" {
+		authBaseURL = defaultAuthBaseURL
+	}
+	s, err := newServices(queueBaseURL, authBaseURL)
+	if err != nil {
+		return nil, err
+	}
+	return &plugin{services: s}, nil
 }
 
 func (p *plugin) PayloadSchema() schematypes.Object {
@@ -51,8 +69,9 @@ func (p *plugin) NewTaskPlugin(options plugins.TaskPluginOptions) (plugins.TaskP
 	}
 
 	return &taskPlugin{
-		monitor: options.Monitor,
-		context: options.TaskContext,
+		monitor:  options.Monitor,
+		context:  options.TaskContext,
+		services: p.services,
 	}, nil
 }
 
@@ -74,22 +93,147 @@ func (p *taskPlugin) BuildSandbox(sandboxBuilder engines.SandboxBuilder) error {
 	return nil
 }
 
+// bewitExpiration is the expiration of signed URLs created with /bewit
+const bewitExpiration = 1 * time.Hour
+
+// BaseUrls of the queue and auth services, if the worker doesn't configure them
+const (
+	defaultQueueBaseURL = "https://queue.taskcluster.net/v1"
+	defaultAuthBaseURL  = "https://auth.taskcluster.net/v1"
+)
+
+// services identifies hosts of taskcluster services, requests are only signed
+// for these hosts, so credentials aren't leaked to other hosts.
+type services struct {
+	hosts   map[string]string // mapping from host to scheme for the baseUrls
+	pattern *regexp.Regexp    // matches '<service>.<domain>', nil if unknown
+	domain  string            // domain of services, empty if unknown
+	scheme  string            // scheme for hosts matching pattern
+}
+
+// newServices returns the services given the baseUrls of the queue and auth
+// services used by the worker. If the queue host is 'queue.<domain>', all
+// hosts on the form '<service>.<domain>' are taskcluster services.
+func newServices(queueBaseURL, authBaseURL string) (*services, error) {
+	s := &services{hosts: make(map[string]string)}
+	for i, baseURL := range []string{queueBaseURL, authBaseURL} {
+		u, err := url.Parse(baseURL)
+		if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") {
+			return nil, errors.Errorf("tcproxy requires an absolute http(s) baseUrl, received: '%s'", baseURL)
+		}
+		s.hosts[u.Host] = u.Scheme
+		if i == 0 && strings.HasPrefix(u.Host, "queue.") {
+			s.domain = strings.TrimPrefix(u.Host, "queue.")
+			s.pattern = regexp.MustCompile(`^[a-z0-9-]+\.` + regexp.QuoteMeta(s.domain) + `$`)
+			s.scheme = u.Scheme
+		}
+	}
+	return s, nil
+}
+
+// schemeFor returns the scheme for host, or empty string if host isn't a
+// taskcluster service.
+func (s *services) schemeFor(host string) string {
+	if scheme, ok := s.hosts[host]; ok {
+		return scheme
+	}
+	if s.pattern != nil && s.pattern.MatchString(host) {
+		return s.scheme
+	}
+	return ""
+}
+
+// reply writes a JSON error payload with code and message to w
+func reply(w http.ResponseWriter, status int, code, message string) {
+	w.WriteHeader(status)
+	data, _ := json.MarshalIndent(struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}{
+		Code:    code,
+		Message: message,
+	}, "", "  ")
+	w.Write(data)
+}
+
+// targetURL returns the URL to forward requests for path to, path is on the
+// form '/<hostname>/<resource>'. Like the docker-worker taskcluster-proxy, a
+// service name without a dot, such as 'queue', is short for
+// '<service>.<domain>', if the queue is on the form 'queue.<domain>'.
+func (s *services) targetURL(path string) (*url.URL, error) {
+	raw := strings.TrimPrefix(path, "/")
+	u, err := url.Parse("https://" + raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Host != "" && !strings.ContainsAny(u.Host, ".:") && s.domain != "" {
+		u.Host += "." + s.domain
+	}
+	scheme := s.schemeFor(u.Host)
+	if scheme == "" {
+		return nil, errors.Errorf("hostname '%s' is not a taskcluster service", u.Host)
+	}
+	u.Scheme = scheme
+	return u, nil
+}
+
+// authorizer returns an Authorizer for the task restricted to task.scopes, as
+// the task credentials may carry scopes for the worker, such as resolving the
+// task.
+func (p *taskPlugin) authorizer() client.Authorizer {
+	return p.context.Authorizer().WithAuthorizedScopes(p.context.Scopes...)
+}
+
+// serveBewit handles POST /bewit, where the request body is a URL, responding
+// with a redirect to the URL signed with task.scopes. This is useful for
+// giving URLs to tools that can't route requests through the proxy.
+func (p *taskPlugin) serveBewit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		reply(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "/bewit only supports POST")
+		return
+	}
+	data, err := ioext.ReadAtMost(r.Body, 8*1024)
+	if err != nil {
+		reply(w, http.StatusBadRequest, "InvalidRequest", "request body must be a URL")
+		return
+	}
+	u, err := url.Parse(strings.TrimSpace(string(data)))
+	if err == nil && (u.Scheme == "" || u.Scheme != p.services.schemeFor(u.Host)) {
+		err = errors.New("URL must be for a taskcluster service")
+	}
+	if err != nil {
+		reply(w, http.StatusBadRequest, "InvalidRequestUrl", fmt.Sprintf("tcproxy can't sign URL, error: %s", err))
+		return
+	}
+
+	signed, err := p.authorizer().SignURL(u, bewitExpiration)
+	if err != nil {
+		incidentID := p.monitor.ReportError(errors.Wrap(err, "SignURL failed"), "SignURL failed for URL: ", u.String())
+		reply(w, http.StatusInternalServerError, "InternalServerError",
+			"internal error in taskcluster-worker proxy, incidentId: "+incidentID)
+		return
+	}
+	w.Header().Set("Location", signed.String())
+	w.WriteHeader(http.StatusSeeOther)
+}
+
 func (p *taskPlugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/bewit" {
+		p.serveBewit(w, r)
+		return
+	}
+
 	// Parse request URL
 	raw := strings.TrimPrefix(r.URL.Path, "/")
-	u, err := url.Parse("https://" + raw)
+	u, err := p.services.targetURL(r.URL.Path)
 	if err != nil {
 		debug("bad URL: '%s'", r.URL.Path)
-		p.context.LogError(fmt.Sprintf("tcproxy received path: '%s' which it failed to parse as a URL", raw))
-		w.WriteHeader(http.StatusBadRequest)
-		data, _ := json.MarshalIndent(struct {
-			Code    string `json:"code"`
-			Message string `json:"message"`
-		}{
-			Code:    "InvalidRequestUrl",
-			Message: "tcproxy assumes <path> is on the form <hostname>/<resource>[?<query>], instead received: '" + raw + "'",
-		}, "", "  ")
-		w.Write(data)
+		p.context.LogError(fmt.Sprintf(
+			"tcproxy received path: '%s' which isn't a URL for a taskcluster service, error: %s", raw, err,
+		))
+		reply(w, http.StatusBadRequest, "InvalidRequestUrl",
+			"tcproxy assumes <path> is on the form <hostname>/<resource>[?<query>] for a taskcluster service, "+
+				"instead received: '"+raw+"'")
 		return
 	}
 
@@ -105,7 +249,7 @@ func (p *taskPlugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Add signature
-	signature, err := p.context.Authorizer().SignHeader(r.Method, u, nil)
+	signature, err := p.authorizer().SignHeader(r.Method, u, nil)
 	if err != nil {
 		incidentID := p.monitor.ReportError(
 			errors.Wrap(err, "SignHeader failed"),
@@ -150,15 +294,8 @@ func (p *taskPlugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			"tcproxy was unable to forward request to %s, error: %s",
 			u.String(), err,
 		))
-		w.WriteHeader(http.StatusInternalServerError)
-		data, _ := json.MarshalIndent(struct {
-			Code    string `json:"code"`
-			Message string `json:"message"`
-		}{
-			Code:    "ProxyRequestFailed",
-			Message: "tcproxy failed forwarding request to '" + u.String() + "'",
-		}, "", "  ")
-		w.Write(data)
+		reply(w, http.StatusInternalServerError, "ProxyRequestFailed",
+			"tcproxy failed forwarding request to '"+u.String()+"'")
 		return
 	}
 
@@ -1,9 +1,16 @@
 package tcproxy
 
 import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 
+	"github.com/stretchr/testify/require"
 	"github.com/taskcluster/taskcluster-worker/plugins/plugintest"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/mocks"
 )
 
 func TestTCProxySuccess(t *testing.T) {
@@ -16,6 +23,7 @@ func TestTCProxySuccess(t *testing.T) {
 		Plugin:        "tcproxy",
 		ClientID:      "tester",
 		AccessToken:   "no-secret",
+		Scopes:        []string{"test:authenticate-get"},
 		PluginSuccess: true,
 		EngineSuccess: true,
 	}.Test()
@@ -31,7 +39,91 @@ func TestTCProxyFail(t *testing.T) {
 		Plugin:        "tcproxy",
 		ClientID:      "tester",
 		AccessToken:   "wrong-secret",
+		Scopes:        []string{"test:authenticate-get"},
 		PluginSuccess: true,
 		EngineSuccess: false,
 	}.Test()
 }
+
+func TestTCProxyTargetURL(t *testing.T) {
+	s, err := newServices(defaultQueueBaseURL, defaultAuthBaseURL)
+	require.NoError(t, err)
+	u, err := s.targetURL("/queue.taskcluster.net/v1/ping")
+	require.NoError(t, err)
+	require.Equal(t, "https://queue.taskcluster.net/v1/ping", u.String())
+
+	// Service names are short for <service>.taskcluster.net
+	u, err = s.targetURL("/queue/v1/task/abc?q=1")
+	require.NoError(t, err)
+	require.Equal(t, "https://queue.taskcluster.net/v1/task/abc?q=1", u.String())
+
+	// Other hosts must not receive signed requests
+	_, err = s.targetURL("/example.com/v1/ping")
+	require.Error(t, err)
+	_, err = s.targetURL("/queue.taskcluster.net.example.com/v1/ping")
+	require.Error(t, err)
+}
+
+func TestTCProxyTargetURLBaseURLs(t *testing.T) {
+	s, err := newServices("https://queue.tc.example.com/v1", "http://localhost:8080/v1")
+	require.NoError(t, err)
+
+	// Services are on the domain of the queue
+	u, err := s.targetURL("/secrets/v1/ping")
+	require.NoError(t, err)
+	require.Equal(t, "https://secrets.tc.example.com/v1/ping", u.String())
+
+	// The scheme of the baseUrl is used
+	u, err = s.targetURL("/localhost:8080/v1/ping")
+	require.NoError(t, err)
+	require.Equal(t, "http://localhost:8080/v1/ping", u.String())
+
+	// Production services aren't allowed, unless configured
+	_, err = s.targetURL("/queue.taskcluster.net/v1/ping")
+	require.Error(t, err)
+	_, err = s.targetURL("/localhost:8081/v1/ping")
+	require.Error(t, err)
+
+	// Without 'queue.<domain>' only the baseUrl hosts are allowed
+	s, err = newServices("https://tc.example.com/api/queue/v1", "https://tc.example.com/api/auth/v1")
+	require.NoError(t, err)
+	_, err = s.targetURL("/tc.example.com/api/queue/v1/ping")
+	require.NoError(t, err)
+	_, err = s.targetURL("/queue/v1/ping")
+	require.Error(t, err)
+	_, err = s.targetURL("/other.example.com/v1/ping")
+	require.Error(t, err)
+
+	_, err = newServices("queue.taskcluster.net", defaultAuthBaseURL)
+	require.Error(t, err, "expected baseUrl without scheme to be rejected")
+}
+
+func TestTCProxyBewit(t *testing.T) {
+	folder := runtime.NewTemporaryTestFolderOrPanic()
+	defer folder.Remove()
+	ctx, controller, err := runtime.NewTaskContext(folder.NewFilePath(), runtime.TaskInfo{
+		Scopes: []string{"queue:get-artifact:private/*"},
+	})
+	require.NoError(t, err)
+	defer controller.Dispose()
+	controller.SetCredentials("tester", "no-secret", "")
+	s, err := newServices(defaultQueueBaseURL, defaultAuthBaseURL)
+	require.NoError(t, err)
+	p := &taskPlugin{monitor: mocks.NewMockMonitor(true), context: ctx, services: s}
+
+	target := "https://queue.taskcluster.net/v1/task/abc/artifacts/private/log.txt"
+	req := httptest.NewRequest(http.MethodPost, "/bewit", bytes.NewBufferString(target))
+	w := httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	require.Equal(t, http.StatusSeeOther, w.Code)
+	u, err := url.Parse(w.Header().Get("Location"))
+	require.NoError(t, err)
+	require.Equal(t, "queue.taskcluster.net", u.Host)
+	require.NotEmpty(t, u.Query().Get("bewit"))
+
+	// URLs for other hosts are not signed
+	req = httptest.NewRequest(http.MethodPost, "/bewit", bytes.NewBufferString("https://example.com/"))
+	w = httptest.NewRecorder()
+	p.ServeHTTP(w, req)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
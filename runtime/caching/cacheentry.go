@@ -31,6 +31,20 @@ func (e *cacheEntry) DiskSize() (uint64, error) {
 	return e.resource.DiskSize()
 }
 
+func (e *cacheEntry) Priority() gc.Priority {
+	if p, ok := e.resource.(gc.Prioritized); ok {
+		return p.Priority()
+	}
+	return gc.PriorityNormal
+}
+
+func (e *cacheEntry) Describe() string {
+	if d, ok := e.resource.(gc.Described); ok {
+		return d.Describe()
+	}
+	return fmt.Sprintf("cached resource: %T", e.resource)
+}
+
 func (e *cacheEntry) LastUsed() time.Time {
 	return e.lastUsed
 }
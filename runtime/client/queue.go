@@ -28,6 +28,7 @@ type Queue interface {
 	ReportFailed(string, string) (*tcqueue.TaskStatusResponse, error)
 	ClaimTask(string, string, *tcqueue.TaskClaimRequest) (*tcqueue.TaskClaimResponse, error)
 	ClaimWork(provisionerID, workerType string, payload *tcqueue.ClaimWorkRequest) (*tcqueue.ClaimWorkResponse, error)
+	PendingTasks(provisionerID, workerType string) (*tcqueue.CountPendingTasksResponse, error)
 	ReclaimTask(string, string) (*tcqueue.TaskReclaimResponse, error)
 	PollTaskUrls(string, string) (*tcqueue.PollTaskUrlsResponse, error)
 	CancelTask(string) (*tcqueue.TaskStatusResponse, error)
@@ -87,6 +88,12 @@ func (m *MockQueue) ClaimWork(provisionerID, workerType string, payload *tcqueue
 	return args.Get(0).(*tcqueue.ClaimWorkResponse), args.Error(1)
 }
 
+// PendingTasks is a mock implementation of github.com/taskcluster/taskcluster-client-go/tcqueue.PendingTasks
+func (m *MockQueue) PendingTasks(provisionerID, workerType string) (*tcqueue.CountPendingTasksResponse, error) {
+	args := m.Called(provisionerID, workerType)
+	return args.Get(0).(*tcqueue.CountPendingTasksResponse), args.Error(1)
+}
+
 // ReportFailed is a mock implementation of github.com/taskcluster/taskcluster-client-go/tcqueue.ReportFailed
 func (m *MockQueue) ReportFailed(taskID, runID string) (*tcqueue.TaskStatusResponse, error) {
 	args := m.Called(taskID, runID)
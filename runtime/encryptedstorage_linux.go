@@ -0,0 +1,146 @@
+// +build linux
+
+package runtime
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/slugid-go/slugid"
+)
+
+// runCommand runs a command with given stdin, wrapping output in the error
+func runCommand(stdin []byte, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", errors.Wrapf(err, "'%s %s' failed, output: %s", name, strings.Join(args, " "), string(out))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// randomKey returns a random key with given number of bytes
+func randomKey(size int) ([]byte, error) {
+	key := make([]byte, size)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Wrap(err, "failed to generate random key")
+	}
+	return key, nil
+}
+
+// setupDMCryptStorage creates a sparse backing file of the given size, attaches
+// it to a loopback device, opens a dm-crypt mapping with a random key, formats
+// it as ext4 and mounts it at path. Returns a function that tears it down.
+func setupDMCryptStorage(path string, size int64) (func() error, error) {
+	backingFile := strings.TrimRight(path, string(filepath.Separator)) + ".crypt"
+	mapping := "tc-worker-" + strings.ToLower(slugid.Nice())
+	mapper := filepath.Join("/dev/mapper", mapping)
+
+	// Create sparse backing file
+	f, err := os.Create(backingFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create backing file for encrypted storage")
+	}
+	err = f.Truncate(size)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(backingFile)
+		return nil, errors.Wrap(err, "failed to allocate backing file for encrypted storage")
+	}
+
+	// Keep track of what needs to be cleaned up, in reverse order
+	var cleanups []func() error
+	teardown := func() error {
+		var err error
+		for i := len(cleanups) - 1; i >= 0; i-- {
+			if cerr := cleanups[i](); cerr != nil && err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}
+	cleanups = append(cleanups, func() error {
+		return os.Remove(backingFile)
+	})
+
+	// Attach to loopback device
+	device, err := runCommand(nil, "losetup", "--find", "--show", backingFile)
+	if err != nil {
+		teardown()
+		return nil, err
+	}
+	cleanups = append(cleanups, func() error {
+		_, err := runCommand(nil, "losetup", "--detach", device)
+		return err
+	})
+
+	// Open dm-crypt mapping with ephemeral key, never written to disk
+	key, err := randomKey(64)
+	if err != nil {
+		teardown()
+		return nil, err
+	}
+	_, err = runCommand(key, "cryptsetup", "open", "--type", "plain",
+		"--cipher", "aes-xts-plain64", "--key-size", "512",
+		"--key-file", "-", device, mapping,
+	)
+	if err != nil {
+		teardown()
+		return nil, err
+	}
+	cleanups = append(cleanups, func() error {
+		_, err := runCommand(nil, "cryptsetup", "close", mapping)
+		return err
+	})
+
+	// Format and mount
+	if _, err = runCommand(nil, "mkfs.ext4", "-q", "-m", "0", mapper); err != nil {
+		teardown()
+		return nil, err
+	}
+	if _, err = runCommand(nil, "mount", mapper, path); err != nil {
+		teardown()
+		return nil, err
+	}
+	cleanups = append(cleanups, func() error {
+		_, err := runCommand(nil, "umount", path)
+		return err
+	})
+	if err = os.Chmod(path, 0777); err != nil {
+		teardown()
+		return nil, errors.Wrap(err, "failed to set permissions on encrypted storage")
+	}
+
+	return teardown, nil
+}
+
+// setupFSCryptStorage encrypts the empty folder at path using the fscrypt
+// utility with a random raw key. Returns a function that locks the folder.
+func setupFSCryptStorage(path string) (func() error, error) {
+	key, err := randomKey(32)
+	if err != nil {
+		return nil, err
+	}
+	name := "tc-worker-" + slugid.Nice()
+	_, err = runCommand(key, "fscrypt", "encrypt", path, "--quiet",
+		"--source=raw_key", "--name="+name, "--key=/dev/stdin",
+	)
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		// Purge the key from the kernel keyring, data is unrecoverable after this
+		_, err := runCommand(nil, "fscrypt", "lock", path, "--quiet")
+		return err
+	}, nil
+}
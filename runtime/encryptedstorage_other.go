@@ -0,0 +1,17 @@
+// +build !linux
+
+package runtime
+
+import "errors"
+
+var errEncryptionNotSupported = errors.New(
+	"encrypted temporary storage is only supported on linux",
+)
+
+func setupDMCryptStorage(path string, size int64) (func() error, error) {
+	return nil, errEncryptionNotSupported
+}
+
+func setupFSCryptStorage(path string) (func() error, error) {
+	return nil, errEncryptionNotSupported
+}
@@ -1,6 +1,7 @@
 package runtime
 
 import (
+	"github.com/taskcluster/taskcluster-worker/runtime/fetcher"
 	"github.com/taskcluster/taskcluster-worker/runtime/gc"
 	"github.com/taskcluster/taskcluster-worker/runtime/webhookserver"
 )
@@ -11,6 +12,8 @@ import (
 // and interfaces for that reason.
 type Environment struct {
 	GarbageCollector gc.ResourceTracker
+	FetchCache       *fetcher.Cache             // Optional, may be nil if not available
+	Endpoints        *webhookserver.EndpointSet // Optional, nil if WebHookServer isn't available
 	TemporaryStorage
 	webhookserver.WebHookServer // Optional, may be nil if not available
 	Monitor
@@ -19,4 +22,6 @@ type Environment struct {
 	WorkerType    string
 	WorkerGroup   string
 	WorkerID      string
+	QueueBaseURL  string // BaseUrl for the queue used by the worker, empty for the default
+	AuthBaseURL   string // BaseUrl for the auth service used by the worker, empty for the default
 }
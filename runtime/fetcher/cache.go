@@ -0,0 +1,256 @@
+package fetcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-worker/runtime/gc"
+)
+
+// Cache is a shared content-addressed cache for fetched resources.
+//
+// Resources are stored by the SHA256 hash of their contents, such that two
+// references resolving to the same content are only stored once. Resources
+// are registered with a gc.ResourceTracker and disposed when not in use, if
+// the garbage collector needs to reclaim disk space.
+type Cache struct {
+	m       sync.Mutex
+	folder  string
+	tracker gc.ResourceTracker
+	entries map[string]*cacheEntry // map from Reference.HashKey() to entry
+	blobs   map[string]*cacheBlob  // map from SHA256 to blob
+}
+
+// cacheEntry represents a Reference.HashKey() being fetched, or fetched.
+type cacheEntry struct {
+	done chan struct{}
+	blob *cacheBlob
+	err  error
+}
+
+// cacheBlob is a file in the cache, which may have multiple entries
+type cacheBlob struct {
+	gc.DisposableResource
+	cache  *Cache
+	sha256 string
+	path   string
+	size   int64
+	keys   []string
+}
+
+// CachedFile is a handle to a file in the Cache. The file must not be modified
+// and Release() must be called when the file is no longer needed.
+type CachedFile struct {
+	blob     *cacheBlob
+	released sync.Once
+}
+
+// NewCache creates a Cache storing files in folder, registering files with the
+// given gc.ResourceTracker.
+func NewCache(folder string, tracker gc.ResourceTracker) (*Cache, error) {
+	if err := os.MkdirAll(folder, 0777); err != nil {
+		return nil, errors.Wrap(err, "failed to create folder for fetcher cache")
+	}
+	return &Cache{
+		folder:  folder,
+		tracker: tracker,
+		entries: make(map[string]*cacheEntry),
+		blobs:   make(map[string]*cacheBlob),
+	}, nil
+}
+
+// Fetch returns a CachedFile with the contents of reference, fetching the
+// reference if it isn't present in the cache. Concurrent calls for references
+// with the same HashKey() will only fetch the reference once.
+//
+// Progress is reported to ctx, and errors are returned as from
+// Reference.Fetch(), including BrokenReferenceError.
+func (c *Cache) Fetch(ctx Context, reference Reference) (*CachedFile, error) {
+	key := reference.HashKey()
+	for {
+		// Find entry or create one, if we create it we must also fetch it
+		c.m.Lock()
+		e := c.entries[key]
+		if e == nil {
+			e = &cacheEntry{done: make(chan struct{})}
+			c.entries[key] = e
+			c.m.Unlock()
+			c.load(ctx, key, reference, e)
+		} else {
+			c.m.Unlock()
+		}
+
+		// Wait for entry to be fetched
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		// If fetching was aborted by someone else, we try again
+		if e.err == context.Canceled || e.err == context.DeadlineExceeded {
+			if ctx.Err() == nil {
+				continue
+			}
+		}
+		if e.err != nil {
+			return nil, e.err
+		}
+
+		// Acquire the blob, while holding the lock so it can't be disposed
+		c.m.Lock()
+		if c.entries[key] != e {
+			c.m.Unlock()
+			continue // entry was disposed while we waited, try again
+		}
+		e.blob.Acquire()
+		c.m.Unlock()
+
+		return &CachedFile{blob: e.blob}, nil
+	}
+}
+
+// load fetches reference into the cache and closes e.done when finished
+func (c *Cache) load(ctx Context, key string, reference Reference, e *cacheEntry) {
+	defer close(e.done)
+
+	var b *cacheBlob
+	register := false
+	h := sha256.New()
+	file, err := ioutil.TempFile(c.folder, "fetching-")
+	if err != nil {
+		err = errors.Wrap(err, "failed to create temporary file in fetcher cache")
+		goto cleanup
+	}
+
+	// Fetch reference while computing the hash
+	err = reference.Fetch(ctx, &hashWriteReseter{
+		Target:  &FileReseter{File: file},
+		hashers: []hash.Hash{h},
+	})
+	if cerr := file.Close(); err == nil && cerr != nil {
+		err = errors.Wrap(cerr, "failed to close file in fetcher cache")
+	}
+	if err != nil {
+		goto cleanup
+	}
+
+	// Insert the blob, unless we already have a blob with the same hash
+	c.m.Lock()
+	b, err = c.insert(hex.EncodeToString(h.Sum(nil)), file.Name())
+	if err == nil {
+		b.keys = append(b.keys, key)
+		register = len(b.keys) == 1
+		e.blob = b
+	}
+	c.m.Unlock()
+
+	// Register new blobs with the tracker, after we've released the lock
+	if register {
+		c.tracker.Register(b)
+	}
+
+cleanup:
+	if err != nil {
+		e.err = err
+		c.m.Lock()
+		delete(c.entries, key)
+		c.m.Unlock()
+	}
+	if file != nil {
+		os.Remove(file.Name()) // ignore error, file is renamed if successful
+	}
+}
+
+// insert a blob with given sha256 from file, assumes lock is held
+func (c *Cache) insert(sha256, file string) (*cacheBlob, error) {
+	if b, ok := c.blobs[sha256]; ok {
+		return b, nil
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to stat file in fetcher cache")
+	}
+	target := filepath.Join(c.folder, sha256)
+	if err = os.Rename(file, target); err != nil {
+		return nil, errors.Wrap(err, "failed to rename file in fetcher cache")
+	}
+	b := &cacheBlob{
+		cache:  c,
+		sha256: sha256,
+		path:   target,
+		size:   info.Size(),
+	}
+	c.blobs[sha256] = b
+	return b, nil
+}
+
+func (b *cacheBlob) MemorySize() (uint64, error) {
+	return 0, nil
+}
+
+func (b *cacheBlob) DiskSize() (uint64, error) {
+	return uint64(b.size), nil
+}
+
+func (b *cacheBlob) Describe() string {
+	b.cache.m.Lock()
+	defer b.cache.m.Unlock()
+	return "fetched resource: " + strings.Join(b.keys, ", ")
+}
+
+func (b *cacheBlob) Priority() gc.Priority {
+	return gc.PriorityLow
+}
+
+func (b *cacheBlob) Dispose() error {
+	// Lock cache, so nobody can acquire the blob while we dispose it
+	b.cache.m.Lock()
+	defer b.cache.m.Unlock()
+
+	if err := b.CanDispose(); err != nil {
+		return err
+	}
+	for _, key := range b.keys {
+		delete(b.cache.entries, key)
+	}
+	delete(b.cache.blobs, b.sha256)
+
+	if err := os.Remove(b.path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "failed to remove file '%s' from fetcher cache", b.path)
+	}
+	return nil
+}
+
+// Path returns the path to the cached file, this file must not be modified.
+func (f *CachedFile) Path() string {
+	return f.blob.path
+}
+
+// SHA256 returns the hex encoded SHA256 hash of the cached file.
+func (f *CachedFile) SHA256() string {
+	return f.blob.sha256
+}
+
+// Size returns the size of the cached file in bytes.
+func (f *CachedFile) Size() int64 {
+	return f.blob.size
+}
+
+// Open returns the cached file opened for reading.
+func (f *CachedFile) Open() (*os.File, error) {
+	return os.Open(f.blob.path)
+}
+
+// Release the CachedFile, allowing the garbage collector to dispose it.
+func (f *CachedFile) Release() {
+	f.released.Do(f.blob.Release)
+}
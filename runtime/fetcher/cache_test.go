@@ -0,0 +1,75 @@
+package fetcher
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/slugid-go/slugid"
+	"github.com/taskcluster/taskcluster-worker/runtime/gc"
+)
+
+func TestCache(t *testing.T) {
+	folder := filepath.Join(os.TempDir(), slugid.Nice())
+	defer os.RemoveAll(folder)
+
+	tracker := &gc.GarbageCollector{}
+	cache, err := NewCache(folder, tracker)
+	require.NoError(t, err)
+	ctx := &fakeContext{Context: context.Background()}
+
+	r1 := &fakeReference{HashKeyValue: "r1", Data: []byte("hello-world")}
+	r2 := &fakeReference{HashKeyValue: "r2", Data: []byte("hello-world"), Reset: true}
+
+	f1, err := cache.Fetch(ctx, r1)
+	require.NoError(t, err)
+	data, err := ioutil.ReadFile(f1.Path())
+	require.NoError(t, err)
+	assert.Equal(t, "hello-world", string(data))
+
+	t.Run("same content is stored once", func(t *testing.T) {
+		f2, err := cache.Fetch(ctx, r2)
+		require.NoError(t, err)
+		assert.Equal(t, f1.Path(), f2.Path())
+		assert.Equal(t, f1.SHA256(), f2.SHA256())
+		f2.Release()
+		usage, err := tracker.DiskUsage()
+		require.NoError(t, err)
+		assert.EqualValues(t, len("hello-world"), usage)
+	})
+
+	t.Run("cached references are not fetched again", func(t *testing.T) {
+		r1.Err = ErrStreamReset // would fail if fetched
+		f3, err := cache.Fetch(ctx, r1)
+		require.NoError(t, err)
+		f3.Release()
+		r1.Err = nil
+	})
+
+	t.Run("files in use are not disposed", func(t *testing.T) {
+		require.NoError(t, tracker.CollectAll())
+		_, err := os.Stat(f1.Path())
+		require.NoError(t, err)
+	})
+
+	t.Run("released files are disposed", func(t *testing.T) {
+		f1.Release()
+		require.NoError(t, tracker.CollectAll())
+		_, err := os.Stat(f1.Path())
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("errors are not cached", func(t *testing.T) {
+		r3 := &fakeReference{HashKeyValue: "r3", Err: ErrStreamReset}
+		_, err := cache.Fetch(ctx, r3)
+		assert.Equal(t, ErrStreamReset, err)
+		r3.Err = nil
+		f4, err := cache.Fetch(ctx, r3)
+		require.NoError(t, err)
+		f4.Release()
+	})
+}
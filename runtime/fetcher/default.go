@@ -0,0 +1,15 @@
+package fetcher
+
+// Default is a Fetcher that can fetch from all the reference types supported
+// by this package. Engines and plugins should prefer this, such that the
+// reference format is consistent across the worker.
+var Default = Combine(
+	// Allow fetching from URL
+	URL,
+	// Allow fetching from queue artifacts
+	Artifact,
+	// Allow fetching from queue referenced by index namespace
+	Index,
+	// Allow fetching from URL + hash
+	URLHash,
+)
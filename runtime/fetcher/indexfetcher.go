@@ -26,7 +26,7 @@ var indexSchema = schematypes.Object{
 		"namespace": schematypes.String{
 			Title:         "Namespace",
 			Description:   util.Markdown(`Index namespace under which to find the 'taskId' to fetch the artifact from`),
-			Pattern:       `^[a-zA-Z0-9_!~*'()%-]+$`,
+			Pattern:       `^[a-zA-Z0-9_!~*'().%-]+$`,
 			MaximumLength: 1024,
 		},
 		"artifact": schematypes.String{
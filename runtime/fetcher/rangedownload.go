@@ -0,0 +1,436 @@
+package fetcher
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/taskcluster/taskcluster-worker/runtime/ioext"
+)
+
+// Defaults for RangeOptions
+const (
+	defaultRangePartSize    = 64 * 1024 * 1024
+	defaultRangeParallelism = 4
+)
+
+// RangeOptions configures parallel ranged downloads, see WithRangeDownloads().
+type RangeOptions struct {
+	Folder      string // Folder for partial downloads, must exist
+	PartSize    int64  // Size of each ranged part, defaults to 64 MiB
+	Parallelism int    // Number of parts fetched concurrently, defaults to 4
+}
+
+type rangeOptionsKey struct{}
+
+// WithRangeDownloads returns a Context in which URLs larger than one part are
+// downloaded in ranged parts fetched concurrently, if the server supports
+// range requests. Failed parts are retried individually.
+//
+// Parts are written to a file in options.Folder, and the parts completed are
+// recorded next to it. If a download is interrupted, it'll be resumed by the
+// next fetch of the same resource, as long as the server reports the same
+// ETag or Last-Modified header. Hence, options.Folder should be kept across
+// worker restarts. When all parts are downloaded the file is copied to the
+// target and removed.
+func WithRangeDownloads(ctx Context, options RangeOptions) Context {
+	if options.PartSize <= 0 {
+		options.PartSize = defaultRangePartSize
+	}
+	if options.Parallelism <= 0 {
+		options.Parallelism = defaultRangeParallelism
+	}
+	return &contextWithCancel{context.WithValue(ctx, rangeOptionsKey{}, options), ctx}
+}
+
+// PruneRangeDownloads removes partial downloads from folder that haven't been
+// written to for maxAge, these are unlikely to ever be resumed.
+func PruneRangeDownloads(folder string, maxAge time.Duration) error {
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		ext := filepath.Ext(f.Name())
+		if f.IsDir() || (ext != ".part" && ext != ".json") {
+			continue
+		}
+		if time.Since(f.ModTime()) > maxAge {
+			if err = os.Remove(filepath.Join(folder, f.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// errResourceChanged is returned when a resource changes during a ranged
+// download, in which case the partial download is discarded.
+var errResourceChanged = fmt.Errorf("resource changed during ranged download")
+
+// rangeState is the state of a partial download, saved as JSON next to it
+type rangeState struct {
+	Subject      string `json:"subject"`
+	Size         int64  `json:"size"`
+	ETag         string `json:"etag"`
+	LastModified string `json:"lastModified"`
+	PartSize     int64  `json:"partSize"`
+	Done         []bool `json:"done"`
+}
+
+// rangeDownload is a ranged download of a URL to a file in a folder
+type rangeDownload struct {
+	written   int64 // accessed atomically, must be 64-bit aligned
+	ctx       Context
+	options   RangeOptions
+	subject   string
+	url       string
+	file      *os.File
+	statePath string
+	m         sync.Mutex
+	state     rangeState
+}
+
+// fetchURLInRanges will download u to target in ranged parts, if ctx was
+// created with WithRangeDownloads() and the server supports range requests
+// for u. If the download isn't attempted, this returns ok = false, so that
+// the URL can be fetched with a single request instead.
+func fetchURLInRanges(ctx Context, subject, u string, target WriteReseter) (ok bool, err error) {
+	options, enabled := ctx.Value(rangeOptionsKey{}).(RangeOptions)
+	if !enabled {
+		return false, nil
+	}
+	state, supported := probeRanges(ctx, subject, u)
+	if !supported || state.Size <= options.PartSize {
+		return false, nil
+	}
+	state.PartSize = options.PartSize
+	state.Done = make([]bool, (state.Size+options.PartSize-1)/options.PartSize)
+
+	// Partial downloads are identified by subject, size and validators, as the
+	// URL may contain signatures that change between fetches
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%d\n%s\n%s", subject, state.Size, state.ETag, state.LastModified)
+	key := filepath.Join(options.Folder, hex.EncodeToString(h.Sum(nil)))
+
+	d := &rangeDownload{
+		ctx:       ctx,
+		options:   options,
+		subject:   subject,
+		url:       u,
+		statePath: key + ".json",
+		state:     state,
+	}
+	d.resume()
+	d.file, err = os.OpenFile(key+".part", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		debug("failed to open partial download, error: %s", err)
+		return false, nil
+	}
+	if err = d.file.Truncate(state.Size); err != nil {
+		d.file.Close()
+		debug("failed to allocate partial download, error: %s", err)
+		return false, nil
+	}
+
+	err = d.run(target)
+	d.file.Close()
+	if err == errResourceChanged {
+		debug("%s changed during ranged download, falling back to a single request", subject)
+		d.remove(key)
+		return false, nil
+	}
+	if err == nil || IsBrokenReferenceError(err) {
+		d.remove(key)
+	}
+	return true, err
+}
+
+// probeRanges requests the first byte of u to check if ranges are supported,
+// returning the state for a new download if so.
+func probeRanges(ctx Context, subject, u string) (rangeState, bool) {
+	state := rangeState{Subject: subject}
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return state, false
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return state, false
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent {
+		return state, false
+	}
+	_, size, ok := parseContentRange(res.Header.Get("Content-Range"))
+	if !ok {
+		return state, false
+	}
+	state.Size = size
+	state.ETag = res.Header.Get("ETag")
+	state.LastModified = res.Header.Get("Last-Modified")
+	// Without a validator we can't tell if parts are from the same resource
+	return state, state.ETag != "" || state.LastModified != ""
+}
+
+// parseContentRange returns start and size from 'bytes <start>-<end>/<size>'
+func parseContentRange(header string) (start, size int64, ok bool) {
+	if !strings.HasPrefix(header, "bytes ") {
+		return 0, 0, false
+	}
+	parts := strings.Split(strings.TrimPrefix(header, "bytes "), "/")
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+	bounds := strings.Split(parts[0], "-")
+	if len(bounds) != 2 {
+		return 0, 0, false
+	}
+	start, err := strconv.ParseInt(bounds[0], 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	size, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || size <= 0 {
+		return 0, 0, false
+	}
+	return start, size, true
+}
+
+// resume loads parts completed by a previous attempt, if any
+func (d *rangeDownload) resume() {
+	data, err := ioutil.ReadFile(d.statePath)
+	if err != nil {
+		return
+	}
+	var s rangeState
+	if json.Unmarshal(data, &s) != nil || s.Subject != d.state.Subject || s.Size != d.state.Size ||
+		s.ETag != d.state.ETag || s.LastModified != d.state.LastModified ||
+		s.PartSize != d.state.PartSize || len(s.Done) != len(d.state.Done) {
+		return
+	}
+	d.state.Done = s.Done
+	for i, done := range s.Done {
+		if done {
+			d.written += d.partLength(i)
+		}
+	}
+	debug("resuming download of %s with %d of %d bytes", d.subject, d.written, d.state.Size)
+}
+
+// remove deletes the partial download and its state
+func (d *rangeDownload) remove(key string) {
+	os.Remove(key + ".part")
+	os.Remove(d.statePath)
+}
+
+func (d *rangeDownload) partLength(i int) int64 {
+	start := int64(i) * d.state.PartSize
+	if start+d.state.PartSize > d.state.Size {
+		return d.state.Size - start
+	}
+	return d.state.PartSize
+}
+
+// run downloads remaining parts and copies the file to target
+func (d *rangeDownload) run(target WriteReseter) error {
+	ctx, cancel := context.WithCancel(d.ctx)
+	defer cancel()
+
+	// Report download progress
+	d.ctx.Progress(d.subject, float64(atomic.LoadInt64(&d.written))/float64(d.state.Size))
+	done := make(chan struct{})
+	finishedReporting := make(chan struct{})
+	go func() {
+		defer close(finishedReporting)
+		for {
+			select {
+			case <-time.After(progressReportInterval):
+				d.ctx.Progress(d.subject, float64(atomic.LoadInt64(&d.written))/float64(d.state.Size))
+			case <-ctx.Done():
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// Fetch remaining parts with options.Parallelism workers
+	parts := make(chan int, len(d.state.Done))
+	for i, finished := range d.state.Done {
+		if !finished {
+			parts <- i
+		}
+	}
+	close(parts)
+
+	var m sync.Mutex
+	var err error
+	wg := sync.WaitGroup{}
+	wg.Add(d.options.Parallelism)
+	for w := 0; w < d.options.Parallelism; w++ {
+		go func() {
+			defer wg.Done()
+			for i := range parts {
+				if perr := d.fetchPartWithRetries(ctx, i); perr != nil {
+					m.Lock()
+					if err == nil {
+						err = perr
+					}
+					m.Unlock()
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	close(done)         // Stop progress reporting
+	<-finishedReporting // wait for reporting to be finished
+
+	if err != nil {
+		if d.ctx.Err() != nil {
+			return d.ctx.Err()
+		}
+		return err
+	}
+
+	// Copy the completed download to target
+	if _, err = d.file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("failed to seek to start of partial download, error: %s", err)
+	}
+	_, ew, er := ioext.Copy(target, d.file)
+	if ew != nil {
+		return ew
+	}
+	if er != nil {
+		return fmt.Errorf("failed to read partial download, error: %s", er)
+	}
+
+	// Report download completed
+	d.ctx.Progress(d.subject, 1)
+
+	return nil
+}
+
+// fetchPartWithRetries fetches part i with retries and records it as done
+func (d *rangeDownload) fetchPartWithRetries(ctx context.Context, i int) error {
+	retry := 0
+	for {
+		written, err := d.fetchPart(ctx, i)
+		if err == nil {
+			break
+		}
+		// Don't count what we wrote towards progress, it'll be written again
+		atomic.AddInt64(&d.written, -written)
+
+		retry++
+		if err == errResourceChanged || IsBrokenReferenceError(err) {
+			return err
+		}
+		if retry > maxRetries {
+			return newBrokenReferenceError(d.subject, fmt.Sprintf("exhausted retries with last error: %s", err))
+		}
+
+		// Sleep before we retry
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backOff.Delay(retry)):
+		}
+	}
+
+	d.m.Lock()
+	defer d.m.Unlock()
+	d.state.Done[i] = true
+	data, err := json.Marshal(d.state)
+	if err != nil {
+		panic(fmt.Sprintf("failed to marshal rangeState, error: %s", err))
+	}
+	// Saving the state is best-effort, if it fails we just can't resume
+	if err = ioutil.WriteFile(d.statePath+".tmp", data, 0600); err == nil {
+		err = os.Rename(d.statePath+".tmp", d.statePath)
+	}
+	if err != nil {
+		debug("failed to save state of ranged download, error: %s", err)
+	}
+	return nil
+}
+
+// fetchPart fetches part i to the file, returning the number of bytes written
+func (d *rangeDownload) fetchPart(ctx context.Context, i int) (int64, error) {
+	start := int64(i) * d.state.PartSize
+	length := d.partLength(i)
+
+	req, err := http.NewRequest(http.MethodGet, d.url, nil)
+	if err != nil {
+		return 0, newBrokenReferenceError(d.subject, "invalid URL")
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+length-1))
+	if d.state.ETag != "" {
+		req.Header.Set("If-Match", d.state.ETag)
+	} else {
+		req.Header.Set("If-Unmodified-Since", d.state.LastModified)
+	}
+	res, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, fmt.Errorf("request failed: %s", err)
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusPreconditionFailed:
+		return 0, errResourceChanged
+	case res.StatusCode == http.StatusPartialContent:
+		if s, size, ok := parseContentRange(res.Header.Get("Content-Range")); !ok || s != start || size != d.state.Size {
+			return 0, errResourceChanged
+		}
+	default:
+		p, _ := ioext.ReadAtMost(res.Body, 8*1024) // limit to 8 kb
+		if 400 <= res.StatusCode && res.StatusCode < 500 {
+			return 0, newBrokenReferenceError(d.subject, fmt.Sprintf("statusCode: %d, body: %s", res.StatusCode, p))
+		}
+		return 0, fmt.Errorf("statusCode: %d, body: %s", res.StatusCode, p)
+	}
+
+	w := &offsetWriter{file: d.file, offset: start, written: &d.written}
+	n, ew, er := ioext.Copy(w, io.LimitReader(res.Body, length))
+	if ew != nil {
+		return n, fmt.Errorf("failed to write partial download, error: %s", ew)
+	}
+	if er != nil {
+		return n, fmt.Errorf("connection broken: %s", er)
+	}
+	if n != length {
+		return n, fmt.Errorf("connection broken after %d of %d bytes", n, length)
+	}
+	return n, nil
+}
+
+// offsetWriter writes sequentially to file from offset, counting bytes written
+type offsetWriter struct {
+	file    *os.File
+	offset  int64
+	written *int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.file.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	atomic.AddInt64(w.written, int64(n))
+	return n, err
+}
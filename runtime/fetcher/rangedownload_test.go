@@ -0,0 +1,207 @@
+package fetcher
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRangeDownloads(t *testing.T) {
+	// HACK: Reduce backOff.MaxDelay for the duration of this test
+	maxDelay := backOff.MaxDelay
+	backOff.MaxDelay = 100 * time.Millisecond
+	defer func() { backOff.MaxDelay = maxDelay }()
+
+	const partSize = 64 * 1024
+	blob := make([]byte, 10*partSize+123)
+	_, err := rand.Read(blob)
+	require.NoError(t, err)
+	modified := time.Now()
+
+	// Record ranges requested and setup a test server
+	var m sync.Mutex
+	var ranges []string
+	etag := `"v1"`
+	failures := 0
+	changeAfterProbe := false
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		fail := failures > 0 && r.Header.Get("Range") != "bytes=0-0"
+		if fail {
+			failures--
+		}
+		tag := etag
+		if changeAfterProbe && r.Header.Get("Range") == "bytes=0-0" {
+			etag = `"v2"`
+		}
+		m.Unlock()
+		switch r.URL.Path {
+		case "/blob":
+			if fail {
+				w.WriteHeader(500)
+				return
+			}
+			w.Header().Set("ETag", tag)
+			http.ServeContent(w, r, "blob", modified, bytes.NewReader(blob))
+		case "/no-ranges":
+			w.WriteHeader(200)
+			w.Write(blob)
+		default:
+			panic("Unhandled path: " + r.URL.Path)
+		}
+	}))
+	defer s.Close()
+
+	reset := func() {
+		m.Lock()
+		defer m.Unlock()
+		ranges = nil
+		failures = 0
+		etag = `"v1"`
+		changeAfterProbe = false
+	}
+	requested := func() []string {
+		m.Lock()
+		defer m.Unlock()
+		return append([]string{}, ranges...)
+	}
+
+	folder, err := ioutil.TempDir("", "fetcher-ranges-")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+	requireEmptyFolder := func() {
+		files, err := ioutil.ReadDir(folder)
+		require.NoError(t, err)
+		require.Empty(t, files, "expected partial downloads to be removed")
+	}
+
+	ctx := WithRangeDownloads(&fakeContext{Context: context.Background()}, RangeOptions{
+		Folder:      folder,
+		PartSize:    partSize,
+		Parallelism: 3,
+	})
+
+	t.Run("parallel parts", func(t *testing.T) {
+		reset()
+		w := &fakeWriteReseter{}
+		ref, err := URL.NewReference(ctx, s.URL+"/blob")
+		require.NoError(t, err)
+		err = ref.Fetch(ctx, w)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(blob, w.buffer), "wrong content")
+		require.Len(t, requested(), 1+11) // probe + parts
+		requireEmptyFolder()
+	})
+
+	t.Run("retry failed parts", func(t *testing.T) {
+		reset()
+		m.Lock()
+		failures = 2
+		m.Unlock()
+		w := &fakeWriteReseter{}
+		err := fetchURLWithRetries(ctx, "blob", s.URL+"/blob", w)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(blob, w.buffer), "wrong content")
+		require.Len(t, requested(), 1+11+2)
+		requireEmptyFolder()
+	})
+
+	t.Run("resume partial download", func(t *testing.T) {
+		reset()
+		// Create a partial download with the first 4 parts done
+		h := sha256.New()
+		fmt.Fprintf(h, "%s\n%d\n%s\n%s", "blob", len(blob), `"v1"`, modified.UTC().Format(http.TimeFormat))
+		key := filepath.Join(folder, hex.EncodeToString(h.Sum(nil)))
+		partial := make([]byte, len(blob))
+		copy(partial, blob[:4*partSize])
+		require.NoError(t, ioutil.WriteFile(key+".part", partial, 0600))
+		state := rangeState{
+			Subject:      "blob",
+			Size:         int64(len(blob)),
+			ETag:         `"v1"`,
+			LastModified: modified.UTC().Format(http.TimeFormat),
+			PartSize:     partSize,
+			Done:         make([]bool, 11),
+		}
+		for i := 0; i < 4; i++ {
+			state.Done[i] = true
+		}
+		data, err := json.Marshal(state)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(key+".json", data, 0600))
+
+		w := &fakeWriteReseter{}
+		err = fetchURLWithRetries(ctx, "blob", s.URL+"/blob", w)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(blob, w.buffer), "wrong content")
+		for _, r := range requested()[1:] {
+			require.False(t, strings.HasPrefix(r, "bytes=0-"), "first part was fetched again")
+		}
+		require.Len(t, requested(), 1+7)
+		requireEmptyFolder()
+	})
+
+	t.Run("resource changed", func(t *testing.T) {
+		reset()
+		// Change the ETag after the probe, so parts fail with 412
+		ctx2 := &fakeContext{Context: context.Background()}
+		rctx := WithRangeDownloads(ctx2, RangeOptions{Folder: folder, PartSize: partSize})
+		m.Lock()
+		changeAfterProbe = true
+		m.Unlock()
+		w := &fakeWriteReseter{}
+		err := fetchURLWithRetries(rctx, "blob", s.URL+"/blob", w)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(blob, w.buffer), "wrong content")
+		require.Contains(t, requested(), "", "expected fallback to a single request")
+		requireEmptyFolder()
+	})
+
+	t.Run("ranges not supported", func(t *testing.T) {
+		reset()
+		w := &fakeWriteReseter{}
+		err := fetchURLWithRetries(ctx, "blob", s.URL+"/no-ranges", w)
+		require.NoError(t, err)
+		require.True(t, bytes.Equal(blob, w.buffer), "wrong content")
+		require.Len(t, requested(), 2) // probe + single request
+		requireEmptyFolder()
+	})
+}
+
+func TestPruneRangeDownloads(t *testing.T) {
+	folder, err := ioutil.TempDir("", "fetcher-prune-")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"old.part", "old.json", "other.txt"} {
+		require.NoError(t, ioutil.WriteFile(filepath.Join(folder, name), nil, 0600))
+		require.NoError(t, os.Chtimes(filepath.Join(folder, name), old, old))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(folder, "new.part"), nil, 0600))
+
+	require.NoError(t, PruneRangeDownloads(folder, 24*time.Hour))
+	files, err := ioutil.ReadDir(folder)
+	require.NoError(t, err)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	require.Equal(t, []string{"new.part", "other.txt"}, names)
+}
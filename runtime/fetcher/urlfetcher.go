@@ -60,6 +60,11 @@ func (u *urlReference) Fetch(ctx Context, target WriteReseter) error {
 // fetchURLWithRetries will download URL u to target with retries, using subject
 // in error messages and progress updates
 func fetchURLWithRetries(ctx Context, subject, u string, target WriteReseter) error {
+	// Fetch in ranged parts, if enabled and supported by the server
+	if ok, err := fetchURLInRanges(ctx, subject, u, target); ok {
+		return err
+	}
+
 	retry := 0
 	for {
 		// Fetch URL, if no error then we're done
@@ -0,0 +1,18 @@
+package gc
+
+import "fmt"
+
+// Described is an optional interface that Disposable resources can implement
+// to give a human readable description of the resource, this is used when
+// reporting which resources have been disposed.
+type Described interface {
+	Describe() string
+}
+
+// descriptionOf returns a human readable description of resource
+func descriptionOf(resource Disposable) string {
+	if d, ok := resource.(Described); ok {
+		return d.Describe()
+	}
+	return fmt.Sprintf("%T", resource)
+}
@@ -0,0 +1,100 @@
+package gc
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// DisposableFolder is a Disposable resource that removes a folder from disk
+// when disposed. This is useful for tracking temporary folders and downloads
+// that can be recreated if needed.
+//
+// Users should call Acquire() and Release() while using the folder, to
+// prevent it from being disposed.
+type DisposableFolder struct {
+	DisposableResource
+	path     string
+	priority Priority
+	m        sync.Mutex
+	disposed bool
+}
+
+// NewDisposableFolder returns a DisposableFolder for path with given Priority.
+func NewDisposableFolder(path string, priority Priority) *DisposableFolder {
+	return &DisposableFolder{
+		path:     path,
+		priority: priority,
+	}
+}
+
+// Path returns the path of the folder.
+func (f *DisposableFolder) Path() string {
+	return f.path
+}
+
+// Priority returns the disposal priority given when created.
+func (f *DisposableFolder) Priority() Priority {
+	return f.priority
+}
+
+// Describe returns a description of the folder for reporting.
+func (f *DisposableFolder) Describe() string {
+	return "folder: " + f.path
+}
+
+// DiskSize returns the number of bytes used by files in the folder.
+func (f *DisposableFolder) DiskSize() (uint64, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	if f.disposed {
+		return 0, nil
+	}
+	return DiskUsage(f.path)
+}
+
+// MemorySize returns 0 as a folder only uses disk space.
+func (f *DisposableFolder) MemorySize() (uint64, error) {
+	return 0, nil
+}
+
+// Dispose removes the folder, unless it's in use.
+func (f *DisposableFolder) Dispose() error {
+	if err := f.CanDispose(); err != nil {
+		return err
+	}
+	f.m.Lock()
+	defer f.m.Unlock()
+	if f.disposed {
+		return nil
+	}
+	if err := os.RemoveAll(f.path); err != nil {
+		return errors.Wrapf(err, "failed to remove folder: %s", f.path)
+	}
+	f.disposed = true
+	return nil
+}
+
+// DiskUsage returns the number of bytes used by files in the given path,
+// returns zero if path doesn't exist.
+func DiskUsage(path string) (uint64, error) {
+	var size uint64
+	err := filepath.Walk(path, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += uint64(info.Size())
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrapf(err, "failed to compute disk usage of: %s", path)
+	}
+	return size, nil
+}
@@ -3,6 +3,7 @@ package gc
 import (
 	"sort"
 	"sync"
+	"time"
 
 	"github.com/shirou/gopsutil/disk"
 	"github.com/shirou/gopsutil/mem"
@@ -28,6 +29,10 @@ func (d disposableSorter) Swap(i, j int) {
 }
 
 func (d disposableSorter) Less(i, j int) bool {
+	pi, pj := priorityOf(d[i]), priorityOf(d[j])
+	if pi != pj {
+		return pi < pj
+	}
 	return d[i].LastUsed().Before(d[j].LastUsed())
 }
 
@@ -42,13 +47,14 @@ type ResourceTracker interface {
 
 // GarbageCollector can be used register Disposable resources which will then
 // be diposed when not in use and the system is low on available disk space
-// or memory.
+// or memory, or when the resources tracked exceeds the disk budget.
 type GarbageCollector struct {
 	resources        []Disposable
 	m                sync.Mutex
 	storageFolder    string
 	minimumDiskSpace int64
 	minimumMemory    int64
+	maximumDiskUsage int64
 }
 
 // New creates a GarbageCollector which uses storageFolder to test for available
@@ -62,6 +68,44 @@ func New(storageFolder string, minimumDiskSpace, minimumMemory int64) *GarbageCo
 	}
 }
 
+// SetDiskBudget sets the maximum number of bytes of disk space that resources
+// tracked by the GarbageCollector may use, before Collect() starts disposing
+// resources regardless of available disk space. Zero implies no budget.
+//
+// This allows image caches, docker images, downloads and temporary folders for
+// tasks to share a global budget, rather than each growing until the disk is
+// full. Resources that doesn't support DiskSize(), such as named caches, are
+// not counted, and are only disposed when the system is low on disk space.
+func (gc *GarbageCollector) SetDiskBudget(maximumDiskUsage int64) {
+	gc.m.Lock()
+	defer gc.m.Unlock()
+	gc.maximumDiskUsage = maximumDiskUsage
+}
+
+// DiskUsage returns the number of bytes used by the resources tracked,
+// resources that doesn't support DiskSize() are not counted.
+func (gc *GarbageCollector) DiskUsage() (uint64, error) {
+	gc.m.Lock()
+	defer gc.m.Unlock()
+	return gc.diskUsage()
+}
+
+// diskUsage returns disk space used by resources, assumes lock is held
+func (gc *GarbageCollector) diskUsage() (uint64, error) {
+	var usage uint64
+	for _, r := range gc.resources {
+		size, err := r.DiskSize()
+		if err == ErrDisposableSizeNotSupported {
+			continue
+		}
+		if err != nil {
+			return 0, err
+		}
+		usage += size
+	}
+	return usage, nil
+}
+
 // Register takes a Disposable resource for the GarbageCollector to manage.
 //
 // GarbageCollector will attempt to to call resource.Dispose() at any time,
@@ -94,14 +138,27 @@ func (gc *GarbageCollector) Unregister(resource Disposable) bool {
 }
 
 // Collect runs garbage collection and reclaims resources, attempting to
-// satisfy minimumMemory and minimumDiskSpace, if possible.
+// satisfy minimumMemory, minimumDiskSpace and the disk budget, if possible.
+//
+// Resources are disposed in order of priority, least-recently-used first
+// among resources with the same priority.
 func (gc *GarbageCollector) Collect() error {
 	gc.m.Lock()
 	defer gc.m.Unlock()
 
-	// Sort to get least-recently-used first
+	// Sort to get lowest priority and least-recently-used first
 	sort.Sort(disposableSorter(gc.resources))
 
+	// Find disk usage if we have a budget to enforce
+	var usage uint64
+	if gc.maximumDiskUsage > 0 {
+		var err error
+		usage, err = gc.diskUsage()
+		if err != nil {
+			return err
+		}
+	}
+
 	var resources []Disposable
 	for i, r := range gc.resources {
 		var err error
@@ -109,12 +166,17 @@ func (gc *GarbageCollector) Collect() error {
 
 		abort := false
 		dispose := false
-		if gc.needDiskSpace() {
+		needDiskSpace := gc.needDiskSpace()
+		if needDiskSpace || gc.exceedsDiskBudget(usage) {
 			size, err = r.DiskSize()
 			if err != nil && err != ErrDisposableSizeNotSupported {
 				abort = true
-			} else if size > 0 || err == ErrDisposableSizeNotSupported {
+			} else if size > 0 {
 				dispose = true
+			} else if err == ErrDisposableSizeNotSupported {
+				// Resources without a size don't count towards the budget, so
+				// disposing them won't help unless we're low on disk space.
+				dispose = needDiskSpace
 			}
 		}
 
@@ -125,10 +187,11 @@ func (gc *GarbageCollector) Collect() error {
 			} else if size > 0 || err == ErrDisposableSizeNotSupported {
 				dispose = true
 			}
+			size = 0 // size is memory size, don't subtract from disk usage
 		}
 
 		if abort {
-			gc.resources = append(resources, gc.resources[i-1:]...)
+			gc.resources = append(resources, gc.resources[i:]...)
 			return err
 		}
 
@@ -136,10 +199,14 @@ func (gc *GarbageCollector) Collect() error {
 			err = r.Dispose()
 			if err != nil {
 				if err != ErrDisposableInUse {
-					gc.resources = append(resources, gc.resources[i-1:]...)
+					gc.resources = append(resources, gc.resources[i:]...)
 					return err
 				}
 				resources = append(resources, r)
+			} else if size <= usage {
+				usage -= size
+			} else {
+				usage = 0
 			}
 			continue
 		}
@@ -163,7 +230,7 @@ func (gc *GarbageCollector) CollectAll() error {
 		err := resource.Dispose()
 		if err != nil {
 			if err != ErrDisposableInUse {
-				gc.resources = append(resources, gc.resources[i-1:]...)
+				gc.resources = append(resources, gc.resources[i:]...)
 				return err
 			}
 			resources = append(resources, resource)
@@ -173,10 +240,78 @@ func (gc *GarbageCollector) CollectAll() error {
 	return nil
 }
 
+// Evicted describes a resource disposed by CollectFreeSpace()
+type Evicted struct {
+	Description string
+	Priority    Priority
+	DiskSize    uint64 // zero, if the resource doesn't support DiskSize()
+	LastUsed    time.Time
+}
+
+// CollectFreeSpace disposes resources until freeSpace bytes of disk space is
+// available in the storage folder, or all resources not in use have been
+// disposed. If freeSpace is zero all resources not in use are disposed.
+//
+// Unlike Collect() this ignores minimumDiskSpace and the disk budget, it is
+// intended for operators recovering from a full disk. Returns the resources
+// disposed, in the order they were disposed.
+func (gc *GarbageCollector) CollectFreeSpace(freeSpace int64) ([]Evicted, error) {
+	gc.m.Lock()
+	defer gc.m.Unlock()
+
+	// Sort to get lowest priority and least-recently-used first
+	sort.Sort(disposableSorter(gc.resources))
+
+	var evicted []Evicted
+	var resources []Disposable
+	for i, r := range gc.resources {
+		if !gc.diskSpaceBelow(freeSpace) {
+			resources = append(resources, r)
+			continue
+		}
+
+		size, err := r.DiskSize()
+		if err == ErrDisposableSizeNotSupported {
+			size, err = 0, nil
+		}
+		if err != nil {
+			gc.resources = append(resources, gc.resources[i:]...)
+			return evicted, err
+		}
+
+		// Describe the resource before disposing it
+		e := Evicted{
+			Description: descriptionOf(r),
+			Priority:    priorityOf(r),
+			DiskSize:    size,
+			LastUsed:    r.LastUsed(),
+		}
+
+		err = r.Dispose()
+		if err == ErrDisposableInUse {
+			resources = append(resources, r)
+			continue
+		}
+		if err != nil {
+			gc.resources = append(resources, gc.resources[i:]...)
+			return evicted, err
+		}
+		evicted = append(evicted, e)
+	}
+
+	gc.resources = resources
+	return evicted, nil
+}
+
 // needDiskSpace returns true if we need to free diskspace
 func (gc *GarbageCollector) needDiskSpace() bool {
-	// If we have no metrics or minimum diskspace we remove everything
-	if gc.minimumDiskSpace == 0 || gc.storageFolder == "" {
+	return gc.diskSpaceBelow(gc.minimumDiskSpace)
+}
+
+// diskSpaceBelow returns true if available diskspace is below target
+func (gc *GarbageCollector) diskSpaceBelow(target int64) bool {
+	// If we have no metrics or target diskspace we remove everything
+	if target == 0 || gc.storageFolder == "" {
 		return true
 	}
 	stat, err := disk.Usage(gc.storageFolder)
@@ -185,7 +320,12 @@ func (gc *GarbageCollector) needDiskSpace() bool {
 		return true
 	}
 
-	return int64(stat.Free) < gc.minimumDiskSpace
+	return int64(stat.Free) < target
+}
+
+// exceedsDiskBudget returns true if usage exceeds the disk budget
+func (gc *GarbageCollector) exceedsDiskBudget(usage uint64) bool {
+	return gc.maximumDiskUsage > 0 && usage > uint64(gc.maximumDiskUsage)
 }
 
 // needMemory returns true if we need to free memory
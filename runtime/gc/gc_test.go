@@ -2,8 +2,10 @@ package gc
 
 import (
 	"fmt"
+	"io/ioutil"
 	"math"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 )
@@ -192,3 +194,128 @@ func TestCollectMemoryOnly(t *testing.T) {
 	assert(r1.disposed, "Expected r1 to be disposed")
 	assert(!r2.disposed, "Didn't expect r2 to be disposed")
 }
+
+type prioritizedResource struct {
+	testResource
+	priority Priority
+}
+
+func (p *prioritizedResource) Priority() Priority {
+	return p.priority
+}
+
+func TestCollectDiskBudget(t *testing.T) {
+	gc := New(os.TempDir(), 1, 1)
+	gc.SetDiskBudget(15)
+
+	// Add three resources, r1 is least-recently-used, but has high priority
+	r1 := &prioritizedResource{
+		testResource: testResource{
+			disk:     10,
+			lastUsed: time.Now().Add(-2 * time.Hour),
+		},
+		priority: PriorityHigh,
+	}
+	gc.Register(r1)
+	r2 := &testResource{
+		disk:     10,
+		lastUsed: time.Now().Add(-1 * time.Hour),
+	}
+	gc.Register(r2)
+	r3 := &testResource{
+		disk:     5,
+		lastUsed: time.Now(),
+	}
+	gc.Register(r3)
+	// r4 is least-recently-used, but doesn't count towards the budget
+	r4 := &testResource{
+		diskError: ErrDisposableSizeNotSupported,
+		lastUsed:  time.Now().Add(-3 * time.Hour),
+	}
+	gc.Register(r4)
+
+	usage, err := gc.DiskUsage()
+	assert(err == nil, "Didn't expect error: ", err)
+	assert(usage == 25, "Expected usage to be 25, got: ", usage)
+
+	err = gc.Collect()
+	assert(err == nil, "Didn't expect error: ", err)
+	assert(!r1.disposed, "Didn't expect r1 to be disposed")
+	assert(r2.disposed, "Expected r2 to be disposed")
+	assert(!r3.disposed, "Didn't expect r3 to be disposed")
+	assert(!r4.disposed, "Didn't expect r4 to be disposed")
+
+	usage, err = gc.DiskUsage()
+	assert(err == nil, "Didn't expect error: ", err)
+	assert(usage == 15, "Expected usage to be 15, got: ", usage)
+}
+
+func TestDisposableFolder(t *testing.T) {
+	folder := filepath.Join(os.TempDir(), "gc-disposable-folder-test")
+	err := os.MkdirAll(folder, 0777)
+	assert(err == nil, "Didn't expect error: ", err)
+	defer os.RemoveAll(folder)
+	err = ioutil.WriteFile(filepath.Join(folder, "data.txt"), []byte("hello world"), 0666)
+	assert(err == nil, "Didn't expect error: ", err)
+
+	gc := &GarbageCollector{}
+	f := NewDisposableFolder(folder, PriorityLow)
+	gc.Register(f)
+
+	size, err := f.DiskSize()
+	assert(err == nil, "Didn't expect error: ", err)
+	assert(size == 11, "Expected size 11, got: ", size)
+
+	t.Log(" - CollectAll() while in use")
+	f.Acquire()
+	err = gc.CollectAll()
+	assert(err == nil, "Didn't expect error: ", err)
+	_, err = os.Stat(folder)
+	assert(err == nil, "Expected folder to exist")
+
+	t.Log(" - CollectAll() after release")
+	f.Release()
+	err = gc.CollectAll()
+	assert(err == nil, "Didn't expect error: ", err)
+	_, err = os.Stat(folder)
+	assert(os.IsNotExist(err), "Expected folder to be removed")
+}
+
+func TestCollectFreeSpace(t *testing.T) {
+	gc := New(os.TempDir(), 1, 1)
+
+	folder := filepath.Join(os.TempDir(), "gc-collect-free-space-test")
+	err := os.MkdirAll(folder, 0777)
+	assert(err == nil, "Didn't expect error: ", err)
+	defer os.RemoveAll(folder)
+
+	f := NewDisposableFolder(folder, PriorityLow)
+	gc.Register(f)
+	r1 := &testResource{
+		disk:     10,
+		lastUsed: time.Now(),
+	}
+	gc.Register(r1)
+	r2 := &testResource{
+		disk:         10,
+		lastUsed:     time.Now(),
+		disposeError: ErrDisposableInUse,
+	}
+	gc.Register(r2)
+
+	t.Log(" - CollectFreeSpace() with available space")
+	evicted, err := gc.CollectFreeSpace(1)
+	assert(err == nil, "Didn't expect error: ", err)
+	assert(len(evicted) == 0, "Didn't expect anything to be evicted")
+	assert(!r1.disposed, "Didn't expect r1 to be disposed")
+
+	t.Log(" - CollectFreeSpace() disposing everything not in use")
+	evicted, err = gc.CollectFreeSpace(math.MaxInt64)
+	assert(err == nil, "Didn't expect error: ", err)
+	assert(len(evicted) == 2, "Expected 2 resources to be evicted, got: ", len(evicted))
+	assert(evicted[0].Description == "folder: "+folder, "Unexpected description: ", evicted[0].Description)
+	assert(evicted[0].Priority == PriorityLow, "Expected folder to be evicted first")
+	assert(evicted[1].DiskSize == 10, "Expected r1 to be evicted with size 10")
+	assert(r1.disposed, "Expected r1 to be disposed")
+	assert(!r2.disposed, "Didn't expect r2 to be disposed")
+}
@@ -0,0 +1,33 @@
+package gc
+
+// Priority determines the order in which resources are disposed, resources
+// with low priority are disposed before resources with high priority.
+// Resources with equal priority are disposed least-recently-used first.
+type Priority int
+
+// Priorities for common kinds of resources, resources that doesn't implement
+// Prioritized will be assigned PriorityNormal.
+const (
+	// PriorityLow is intended for resources that are cheap to recreate, such
+	// as temporary folders and downloaded files.
+	PriorityLow Priority = -10
+	// PriorityNormal is the default priority for resources.
+	PriorityNormal Priority = 0
+	// PriorityHigh is intended for resources that are expensive to recreate,
+	// such as images for virtual machines and docker images.
+	PriorityHigh Priority = 10
+)
+
+// Prioritized is an optional interface that Disposable resources can implement
+// to specify a disposal Priority other than PriorityNormal.
+type Prioritized interface {
+	Priority() Priority
+}
+
+// priorityOf returns the Priority of a resource
+func priorityOf(resource Disposable) Priority {
+	if p, ok := resource.(Prioritized); ok {
+		return p.Priority()
+	}
+	return PriorityNormal
+}
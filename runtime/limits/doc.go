@@ -0,0 +1,14 @@
+// Package limits provides process tuning for the worker process, such as
+// oom_score_adj, umask and resource limits, applied by the daemon before
+// engines are created and inherited by processes spawned by engines.
+//
+// On linux the OOM killer can be made to prefer killing QEMU, docker
+// containers and task processes rather than the worker process, by setting
+// a low oom_score_adj for the worker and a high oom_score_adj for child
+// processes. Engines should call ApplyChildOOMScoreAdj(pid) after spawning
+// processes.
+package limits
+
+import "github.com/taskcluster/taskcluster-worker/runtime/util"
+
+var debug = util.Debug("limits")
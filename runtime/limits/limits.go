@@ -0,0 +1,160 @@
+package limits
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/pkg/errors"
+	schematypes "github.com/taskcluster/go-schematypes"
+	"github.com/taskcluster/taskcluster-worker/runtime/util"
+)
+
+type config struct {
+	OOMScoreAdj      *int             `json:"oomScoreAdj"`
+	ChildOOMScoreAdj *int             `json:"childOomScoreAdj"`
+	Umask            string           `json:"umask"`
+	Ulimits          map[string]int64 `json:"ulimits"`
+}
+
+// Unlimited is the value used in 'ulimits' to remove a limit.
+const Unlimited = -1
+
+// ConfigSchema is the schema for the config accepted by Apply().
+var ConfigSchema = schematypes.Object{
+	Title: "Process Tuning",
+	Description: util.Markdown(`
+		Process tuning applied to the worker process before engines are created,
+		these settings are inherited by processes spawned by engines. This is
+		only supported on linux.
+	`),
+	Properties: schematypes.Properties{
+		"oomScoreAdj": schematypes.Integer{
+			Title: "Worker OOM Score Adjustment",
+			Description: util.Markdown(`
+				The 'oom_score_adj' for the worker process, see proc(5). A low value
+				makes it less likely that the kernel OOM killer kills the worker.
+				Values lower than the current value requires 'CAP_SYS_RESOURCE'.
+			`),
+			Minimum: -1000,
+			Maximum: 1000,
+		},
+		"childOomScoreAdj": schematypes.Integer{
+			Title: "Child OOM Score Adjustment",
+			Description: util.Markdown(`
+				The 'oom_score_adj' for QEMU, docker containers and task processes
+				spawned by engines. A high value makes the kernel OOM killer prefer
+				killing a task over the worker. Must not be lower than 'oomScoreAdj',
+				unless the worker has 'CAP_SYS_RESOURCE'.
+			`),
+			Minimum: -1000,
+			Maximum: 1000,
+		},
+		"umask": schematypes.String{
+			Title: "Umask",
+			Description: util.Markdown(`
+				File mode creation mask for the worker process as octal string,
+				such as '0022'. This ensures files created by the worker and tasks
+				have the same permissions regardless of the init system used.
+			`),
+			Pattern: `^0?[0-7]{3}$`,
+		},
+		"ulimits": schematypes.Object{
+			Title: "Resource Limits",
+			Description: util.Markdown(`
+				Resource limits for the worker process, see setrlimit(2). Both soft
+				and hard limits are set to the value given, use '-1' for unlimited.
+				Raising the hard limit requires 'CAP_SYS_RESOURCE'.
+			`),
+			Properties: schematypes.Properties{
+				"nofile":  rlimitSchema("Maximum number of open file descriptors."),
+				"nproc":   rlimitSchema("Maximum number of processes for the user."),
+				"core":    rlimitSchema("Maximum size of core dumps in bytes."),
+				"memlock": rlimitSchema("Maximum bytes of memory that may be locked."),
+				"stack":   rlimitSchema("Maximum size of the process stack in bytes."),
+			},
+		},
+	},
+}
+
+func rlimitSchema(description string) schematypes.Schema {
+	return schematypes.Integer{
+		Description: description,
+		Minimum:     Unlimited,
+		Maximum:     1 << 53, // JSON numbers are float64
+	}
+}
+
+var (
+	m                sync.Mutex
+	childOOMScoreAdj *int
+)
+
+// Apply applies options given as JSON compatible value matching ConfigSchema
+// to the current process. Returns an error if options doesn't match
+// ConfigSchema, as options are applied before the worker config is validated.
+func Apply(options interface{}) error {
+	var c config
+	if err := ConfigSchema.Map(options, &c); err != nil {
+		return errors.Wrap(err, "invalid process tuning options")
+	}
+
+	if c.Umask != "" {
+		mask, err := strconv.ParseUint(c.Umask, 8, 32)
+		if err != nil {
+			panic(errors.Wrap(err, "umask should have been validated by the schema"))
+		}
+		debug("setting umask: %03o", mask)
+		if err = setUmask(int(mask)); err != nil {
+			return errors.Wrap(err, "failed to set umask")
+		}
+	}
+
+	for name, value := range c.Ulimits {
+		debug("setting ulimit %s: %d", name, value)
+		if err := setRlimit(name, value); err != nil {
+			return errors.Wrapf(err, "failed to set ulimit '%s'", name)
+		}
+	}
+
+	if c.OOMScoreAdj != nil {
+		debug("setting oom_score_adj: %d", *c.OOMScoreAdj)
+		if err := setOOMScoreAdj(0, *c.OOMScoreAdj); err != nil {
+			return errors.Wrap(err, "failed to set oom_score_adj")
+		}
+	}
+
+	if c.ChildOOMScoreAdj != nil {
+		if err := checkOOMScoreAdjSupported(); err != nil {
+			return err
+		}
+		m.Lock()
+		defer m.Unlock()
+		score := *c.ChildOOMScoreAdj
+		childOOMScoreAdj = &score
+	}
+	return nil
+}
+
+// ChildOOMScoreAdj returns the oom_score_adj to be applied to child processes
+// spawned by engines, and true if one has been configured.
+func ChildOOMScoreAdj() (int, bool) {
+	m.Lock()
+	defer m.Unlock()
+	if childOOMScoreAdj == nil {
+		return 0, false
+	}
+	return *childOOMScoreAdj, true
+}
+
+// ApplyChildOOMScoreAdj sets the configured oom_score_adj for child processes
+// on the process given by pid, does nothing if none is configured.
+//
+// Processes forked by the child before this call will not be affected, so this
+// is best-effort, but it is the best we can do without wrapping all commands.
+func ApplyChildOOMScoreAdj(pid int) error {
+	score, ok := ChildOOMScoreAdj()
+	if !ok {
+		return nil
+	}
+	return setOOMScoreAdj(pid, score)
+}
@@ -0,0 +1,47 @@
+package limits
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+var rlimits = map[string]int{
+	"nofile":  unix.RLIMIT_NOFILE,
+	"nproc":   unix.RLIMIT_NPROC,
+	"core":    unix.RLIMIT_CORE,
+	"memlock": unix.RLIMIT_MEMLOCK,
+	"stack":   unix.RLIMIT_STACK,
+}
+
+func setUmask(mask int) error {
+	unix.Umask(mask)
+	return nil
+}
+
+func setRlimit(name string, value int64) error {
+	resource, ok := rlimits[name]
+	if !ok {
+		panic(fmt.Sprintf("unknown ulimit '%s' should have been rejected by the schema", name))
+	}
+	limit := ^uint64(0) // RLIM_INFINITY
+	if value != Unlimited {
+		limit = uint64(value)
+	}
+	return unix.Setrlimit(resource, &unix.Rlimit{Cur: limit, Max: limit})
+}
+
+// setOOMScoreAdj sets oom_score_adj for pid, 0 is the current process
+func setOOMScoreAdj(pid, score int) error {
+	file := "/proc/self/oom_score_adj"
+	if pid != 0 {
+		file = fmt.Sprintf("/proc/%d/oom_score_adj", pid)
+	}
+	return ioutil.WriteFile(file, []byte(strconv.Itoa(score)), 0644)
+}
+
+func checkOOMScoreAdjSupported() error {
+	return nil
+}
@@ -0,0 +1,79 @@
+package limits
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readOOMScoreAdj(t *testing.T, pid string) int {
+	data, err := ioutil.ReadFile("/proc/" + pid + "/oom_score_adj")
+	require.NoError(t, err)
+	score, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	require.NoError(t, err)
+	return score
+}
+
+func TestApplyChildOOMScoreAdj(t *testing.T) {
+	current := readOOMScoreAdj(t, "self")
+	target := current + 100
+	if target > 1000 {
+		t.Skip("oom_score_adj is already too high to test raising it")
+	}
+
+	// Raising oom_score_adj doesn't require privileges
+	require.NoError(t, Apply(map[string]interface{}{
+		"childOomScoreAdj": float64(target),
+	}))
+	defer func() {
+		m.Lock()
+		childOOMScoreAdj = nil
+		m.Unlock()
+	}()
+	score, ok := ChildOOMScoreAdj()
+	require.True(t, ok)
+	require.Equal(t, target, score)
+
+	cmd := exec.Command("sleep", "10")
+	require.NoError(t, cmd.Start())
+	defer cmd.Process.Kill()
+	require.NoError(t, ApplyChildOOMScoreAdj(cmd.Process.Pid))
+	require.Equal(t, target, readOOMScoreAdj(t, strconv.Itoa(cmd.Process.Pid)))
+	require.Equal(t, current, readOOMScoreAdj(t, "self"))
+}
+
+func TestApplyUlimits(t *testing.T) {
+	// Lowering the hard limit can't be undone without privileges, so we apply it
+	// in a subprocess running this test
+	if os.Getenv("LIMITS_TEST_SUBPROCESS") == "1" {
+		// Lowering the soft and hard limit for core dumps doesn't require privileges
+		require.NoError(t, Apply(map[string]interface{}{
+			"ulimits": map[string]interface{}{"core": float64(0)},
+		}))
+		var limit syscall.Rlimit
+		require.NoError(t, syscall.Getrlimit(syscall.RLIMIT_CORE, &limit))
+		require.Equal(t, uint64(0), limit.Cur)
+		require.Equal(t, uint64(0), limit.Max)
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestApplyUlimits$")
+	cmd.Env = append(os.Environ(), "LIMITS_TEST_SUBPROCESS=1")
+	output, err := cmd.CombinedOutput()
+	require.NoError(t, err, "subprocess failed, output: %s", string(output))
+}
+
+func TestApplyInvalidOptions(t *testing.T) {
+	require.Error(t, Apply(map[string]interface{}{
+		"umask": "999",
+	}))
+	require.Error(t, Apply(map[string]interface{}{
+		"ulimits": map[string]interface{}{"core": "unlimited"},
+	}))
+}
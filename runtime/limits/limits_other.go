@@ -0,0 +1,23 @@
+// +build !linux
+
+package limits
+
+import "errors"
+
+var errNotSupported = errors.New("process tuning is only supported on linux")
+
+func setUmask(mask int) error {
+	return errNotSupported
+}
+
+func setRlimit(name string, value int64) error {
+	return errNotSupported
+}
+
+func setOOMScoreAdj(pid, score int) error {
+	return errNotSupported
+}
+
+func checkOOMScoreAdjSupported() error {
+	return errNotSupported
+}
@@ -3,6 +3,7 @@ package monitoring
 import (
 	"encoding/hex"
 	"fmt"
+	godebug "runtime/debug"
 	"strings"
 	"sync"
 	"time"
@@ -133,8 +134,11 @@ func (m *monitor) CapturePanic(fn func()) (incidentID string) {
 			message := fmt.Sprint(crash)
 			id := uuid.NewRandom()
 			incidentID = id.String()
-			m.Entry.WithField("incidentId", incidentID).WithField("panic", crash).Error("Recovered from panic:\n " + message)
-			m.submitError(fmt.Errorf("PANIC: %s", message), fmt.Sprint("Recovered from panic", message), raven.ERROR, id, 1)
+			trace := godebug.Stack()
+			m.Entry.WithField("incidentId", incidentID).WithField("panic", crash).Error(
+				"Recovered from panic: ", message, "\nAt:\n", string(trace),
+			)
+			m.submitError(fmt.Errorf("PANIC: %s", message), fmt.Sprint("Recovered from panic: ", message), raven.FATAL, id, 1)
 		}
 	}()
 	fn()
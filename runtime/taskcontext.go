@@ -258,6 +258,15 @@ func (c *TaskContext) LogError(a ...interface{}) {
 	c.log("[taskcluster:error] ", a...)
 }
 
+// LogWarning writes a log warning message from the worker
+//
+// These log messages will be prefixed "[taskcluster:warning]" so it's easy to
+// see that they are worker logs, and warnings that may explain unexpected
+// behavior.
+func (c *TaskContext) LogWarning(a ...interface{}) {
+	c.log("[taskcluster:warning] ", a...)
+}
+
 func (c *TaskContext) log(prefix string, a ...interface{}) {
 	a = append([]interface{}{prefix}, a...)
 	_, err := fmt.Fprintln(c.logStream, a...)
@@ -20,6 +20,7 @@ func TestTaskContextLogging(t *testing.T) {
 	require.NoError(t, err, "Failed to create context")
 
 	context.Log("Hello World")
+	context.LogWarning("Hello Warning")
 	err = control.CloseLog()
 	require.NoError(t, err, "Failed to close log file")
 
@@ -31,6 +32,7 @@ func TestTaskContextLogging(t *testing.T) {
 	if !strings.Contains(string(data), "Hello World") {
 		panic("Couldn't find 'Hello World' in the log")
 	}
+	require.Contains(t, string(data), "[taskcluster:warning] Hello Warning")
 	require.NoError(t, reader.Close(), "Failed to close log file")
 	err = context.logStream.Remove()
 	require.NoError(t, err, "Failed to remove logStream")
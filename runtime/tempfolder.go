@@ -1,17 +1,30 @@
 package runtime
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/taskcluster/slugid-go/slugid"
 )
 
+// ErrQuotaExceeded is returned from TemporaryFile.Write and
+// TemporaryFile.Truncate, if the operation would cause a TemporaryFolder to
+// exceed its quota.
+var ErrQuotaExceeded = errors.New("temporary storage quota exceeded")
+
 // TemporaryStorage can create temporary folders and files.
 type TemporaryStorage interface {
 	NewFolder() (TemporaryFolder, error)
+	// NewFolderWithQuota creates a folder, such that files created using
+	// NewFile() inside the folder can at most contain quota bytes combined.
+	//
+	// Quotas are nested, hence, writes must satisfy the quota of the folder
+	// and the quotas of any parent folders.
+	NewFolderWithQuota(quota int64) (TemporaryFolder, error)
 	NewFile() (TemporaryFile, error)
 	NewFilePath() string
 }
@@ -21,6 +34,10 @@ type TemporaryStorage interface {
 //
 // We don't really mock the file system interface as we need to integrate with
 // other applications like docker, so we have to expose real file paths.
+//
+// Notice that quotas can only be enforced for writes through TemporaryFile,
+// files written directly to Path() are not accounted for, unless the storage
+// is backed by an encrypted volume of fixed size.
 type TemporaryFolder interface {
 	TemporaryStorage
 	Path() string
@@ -35,13 +52,89 @@ type TemporaryFile interface {
 	Path() string
 }
 
+// EncryptionMode specifies how a TemporaryStorage is encrypted at rest.
+type EncryptionMode string
+
+// Encryption modes supported by NewTemporaryStorageWithOptions.
+const (
+	// EncryptionNone disables encryption.
+	EncryptionNone EncryptionMode = ""
+	// EncryptionDMCrypt backs the storage by a dm-crypt loopback device with
+	// an ephemeral key, this requires TemporaryStorageOptions.Quota to be set,
+	// as it determines the size of the loopback device.
+	EncryptionDMCrypt EncryptionMode = "dm-crypt"
+	// EncryptionFSCrypt encrypts the storage folder using ext4 fscrypt with an
+	// ephemeral key, this requires that the underlying file system supports
+	// encryption.
+	EncryptionFSCrypt EncryptionMode = "fscrypt"
+)
+
+// TemporaryStorageOptions are optional settings for creation of the root
+// TemporaryFolder with NewTemporaryStorageWithOptions.
+type TemporaryStorageOptions struct {
+	// Maximum number of bytes that can be written to TemporaryFile objects,
+	// zero implies no limit.
+	Quota int64
+	// Encryption mode for the storage, keys are generated at random and never
+	// written to disk, hence, data is lost when the worker stops.
+	Encryption EncryptionMode
+}
+
+// storageQuota tracks number of bytes used in a folder and its parents
+type storageQuota struct {
+	m      sync.Mutex
+	limit  int64
+	used   int64
+	parent *storageQuota
+}
+
+// reserve n bytes from q and all parents, returns ErrQuotaExceeded if this
+// would exceed a quota. If q is nil this is always successful.
+func (q *storageQuota) reserve(n int64) error {
+	if q == nil || n == 0 {
+		return nil
+	}
+	q.m.Lock()
+	if q.limit > 0 && q.used+n > q.limit {
+		q.m.Unlock()
+		return ErrQuotaExceeded
+	}
+	q.used += n
+	q.m.Unlock()
+
+	// Reserve from parent, rollback if this fails
+	if err := q.parent.reserve(n); err != nil {
+		q.m.Lock()
+		q.used -= n
+		q.m.Unlock()
+		return err
+	}
+	return nil
+}
+
+// release n bytes reserved from q
+func (q *storageQuota) release(n int64) {
+	for ; q != nil; q = q.parent {
+		q.m.Lock()
+		q.used -= n
+		q.m.Unlock()
+	}
+}
+
 type temporaryFolder struct {
-	path string
+	path     string
+	quota    *storageQuota
+	teardown func() error // optional function to call after removal
 }
 
+// temporaryFile wraps an *os.File without embedding it, as methods like
+// ReadFrom and WriteAt would otherwise be promoted and bypass the quota.
 type temporaryFile struct {
-	*os.File
-	path string
+	file  *os.File
+	path  string
+	m     sync.Mutex
+	size  int64
+	quota *storageQuota
 }
 
 // NewTemporaryTestFolderOrPanic creates a TemporaryFolder as in a subfolder
@@ -64,11 +157,36 @@ func NewTemporaryTestFolderOrPanic() TemporaryFolder {
 
 // NewTemporaryStorage return a TemporaryFolder rooted in the given path.
 func NewTemporaryStorage(path string) (TemporaryFolder, error) {
+	return NewTemporaryStorageWithOptions(path, TemporaryStorageOptions{})
+}
+
+// NewTemporaryStorageWithOptions return a TemporaryFolder rooted in the given
+// path, with the given quota and encryption mode.
+func NewTemporaryStorageWithOptions(path string, options TemporaryStorageOptions) (TemporaryFolder, error) {
 	err := os.MkdirAll(path, 0777)
 	if err != nil {
 		return nil, err
 	}
-	return &temporaryFolder{path: path}, nil
+	s := &temporaryFolder{path: path}
+	if options.Quota > 0 {
+		s.quota = &storageQuota{limit: options.Quota}
+	}
+	switch options.Encryption {
+	case EncryptionNone:
+	case EncryptionDMCrypt:
+		if options.Quota <= 0 {
+			return nil, errors.New("dm-crypt encryption of temporary storage requires a quota")
+		}
+		s.teardown, err = setupDMCryptStorage(path, options.Quota)
+	case EncryptionFSCrypt:
+		s.teardown, err = setupFSCryptStorage(path)
+	default:
+		return nil, fmt.Errorf("unsupported temporary storage encryption mode: '%s'", options.Encryption)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
 func (s *temporaryFolder) Path() string {
@@ -81,7 +199,19 @@ func (s *temporaryFolder) NewFolder() (TemporaryFolder, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &temporaryFolder{path: path}, nil
+	return &temporaryFolder{path: path, quota: s.quota}, nil
+}
+
+func (s *temporaryFolder) NewFolderWithQuota(quota int64) (TemporaryFolder, error) {
+	path := s.NewFilePath()
+	err := os.Mkdir(path, 0777)
+	if err != nil {
+		return nil, err
+	}
+	return &temporaryFolder{path: path, quota: &storageQuota{
+		limit:  quota,
+		parent: s.quota,
+	}}, nil
 }
 
 func (s *temporaryFolder) NewFilePath() string {
@@ -94,10 +224,16 @@ func (s temporaryFolder) NewFile() (TemporaryFile, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &temporaryFile{file, path}, nil
+	return &temporaryFile{file: file, path: path, quota: s.quota}, nil
 }
 
 func (s *temporaryFolder) Remove() error {
+	if s.teardown != nil {
+		if err := s.teardown(); err != nil {
+			return err
+		}
+		s.teardown = nil
+	}
 	return os.RemoveAll(s.path)
 }
 
@@ -105,7 +241,76 @@ func (f *temporaryFile) Path() string {
 	return f.path
 }
 
+func (f *temporaryFile) Read(p []byte) (int, error) {
+	return f.file.Read(p)
+}
+
+func (f *temporaryFile) Seek(offset int64, whence int) (int64, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.file.Seek(offset, whence)
+}
+
+func (f *temporaryFile) Write(p []byte) (int, error) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	// Find offset, so we can compute how much the file grows
+	offset, err := f.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	size := f.size
+	growth := offset + int64(len(p)) - size
+	if growth < 0 {
+		growth = 0
+	}
+	if err = f.quota.reserve(growth); err != nil {
+		return 0, err
+	}
+	f.size += growth
+
+	// Release quota reserved for bytes that weren't written, if the write failed
+	// or was short
+	n, err := f.file.Write(p)
+	if end := offset + int64(n); end < f.size {
+		if end < size {
+			end = size
+		}
+		f.quota.release(f.size - end)
+		f.size = end
+	}
+	return n, err
+}
+
+func (f *temporaryFile) Truncate(size int64) error {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	if size > f.size {
+		if err := f.quota.reserve(size - f.size); err != nil {
+			return err
+		}
+		if err := f.file.Truncate(size); err != nil {
+			f.quota.release(size - f.size)
+			return err
+		}
+	} else {
+		if err := f.file.Truncate(size); err != nil {
+			return err
+		}
+		f.quota.release(f.size - size)
+	}
+	f.size = size
+	return nil
+}
+
 func (f *temporaryFile) Close() error {
-	f.File.Close()
+	f.m.Lock()
+	f.quota.release(f.size)
+	f.size = 0
+	f.m.Unlock()
+
+	f.file.Close()
 	return os.Remove(f.path)
 }
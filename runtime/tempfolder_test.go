@@ -0,0 +1,92 @@
+package runtime
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTemporaryFolderQuota(t *testing.T) {
+	storage := NewTemporaryTestFolderOrPanic()
+	defer storage.Remove()
+
+	folder, err := storage.NewFolderWithQuota(10)
+	require.NoError(t, err)
+
+	f1, err := folder.NewFile()
+	require.NoError(t, err)
+	_, err = f1.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	t.Run("overwrite within quota", func(t *testing.T) {
+		_, err = f1.Seek(0, io.SeekStart)
+		require.NoError(t, err)
+		_, err = f1.Write([]byte("HELLO"))
+		require.NoError(t, err)
+	})
+
+	f2, err := folder.NewFile()
+	require.NoError(t, err)
+	_, err = f2.Write([]byte("world"))
+	require.NoError(t, err)
+
+	t.Run("write exceeding quota", func(t *testing.T) {
+		_, err = f2.Write([]byte("!"))
+		assert.Equal(t, ErrQuotaExceeded, err)
+		assert.Equal(t, ErrQuotaExceeded, f1.Truncate(6))
+	})
+
+	t.Run("nested quota", func(t *testing.T) {
+		sub, err := folder.NewFolderWithQuota(100)
+		require.NoError(t, err)
+		f3, err := sub.NewFile()
+		require.NoError(t, err)
+		assert.Equal(t, ErrQuotaExceeded, f3.Truncate(1))
+		require.NoError(t, f3.Close())
+	})
+
+	t.Run("io.Copy exceeding quota", func(t *testing.T) {
+		f3, err := folder.NewFile()
+		require.NoError(t, err)
+		defer f3.Close()
+		_, err = io.Copy(f3, strings.NewReader("too much data"))
+		assert.Equal(t, ErrQuotaExceeded, err)
+		_, err = io.WriteString(f3, "too much data")
+		assert.Equal(t, ErrQuotaExceeded, err)
+	})
+
+	t.Run("close releases quota", func(t *testing.T) {
+		require.NoError(t, f1.Close())
+		_, err = f2.Write([]byte("!"))
+		require.NoError(t, err)
+		require.NoError(t, f2.Close())
+	})
+}
+
+func TestTemporaryFileFailedWrite(t *testing.T) {
+	storage := NewTemporaryTestFolderOrPanic()
+	defer storage.Remove()
+
+	folder, err := storage.NewFolderWithQuota(10)
+	require.NoError(t, err)
+	quota := folder.(*temporaryFolder).quota
+
+	f, err := folder.NewFile()
+	require.NoError(t, err)
+	_, err = f.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	// Close the underlying file, so writes fail
+	require.NoError(t, f.(*temporaryFile).file.Close())
+	_, err = f.Write([]byte("world"))
+	require.Error(t, err)
+	require.Equal(t, int64(5), quota.used, "quota for a failed write should be released")
+	require.Error(t, f.Truncate(8))
+	require.Equal(t, int64(5), quota.used, "quota for a failed truncate should be released")
+
+	f.Close()
+	require.Equal(t, int64(0), quota.used)
+}
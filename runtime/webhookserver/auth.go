@@ -0,0 +1,55 @@
+package webhookserver
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/taskcluster/slugid-go/slugid"
+)
+
+// NewAccessToken returns a random token, suitable for use with WithAccessToken.
+func NewAccessToken() string {
+	return slugid.V4() + slugid.V4()
+}
+
+// WithAccessToken wraps handler such that requests must present the given
+// token, either as 'Authorization: Bearer <token>' header or as 'accessToken'
+// query-string parameter, which is useful for websockets and links.
+//
+// Requests without a token are rejected with 401, and requests with an
+// invalid token are rejected with 403.
+func WithAccessToken(token string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given := r.URL.Query().Get("accessToken")
+		if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+			given = strings.TrimPrefix(auth, "Bearer ")
+		}
+		if given == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "access token required", http.StatusUnauthorized)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			http.Error(w, "invalid access token", http.StatusForbidden)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// WithCORS wraps handler such that the endpoint can be accessed from any
+// origin using the given methods, responding to preflight requests directly.
+func WithCORS(handler http.Handler, methods ...string) http.Handler {
+	allowed := strings.Join(append([]string{http.MethodOptions}, methods...), ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Access-Control-Allow-Methods", allowed)
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
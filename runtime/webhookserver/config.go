@@ -31,6 +31,36 @@ var webhooktunnelConfigSchema = schematypes.Object{
 	Required: []string{"provider"},
 }
 
+var websocktunnelConfigSchema = schematypes.Object{
+	Properties: schematypes.Properties{
+		"provider": schematypes.StringEnum{Options: []string{"websocktunnel"}},
+		"tunnelUrl": schematypes.URI{
+			Title:       "Tunnel URL",
+			Description: "URL for the websocktunnel server the worker should connect to.",
+		},
+		"tunnelSecret": schematypes.String{
+			Title: "Tunnel Secret",
+			Description: util.Markdown(`
+				Secret shared with the websocktunnel server, used to sign the JWT
+				token the worker authenticates with.
+			`),
+		},
+		"tunnelId": schematypes.String{
+			Title: "Tunnel Identifier",
+			Description: util.Markdown(`
+				Identifier for the tunnel, this must be unique for each worker. If not
+				given a random slugid will be used.
+			`),
+			Pattern: "^[a-zA-Z0-9_-]{1,128}$",
+		},
+		"audience": schematypes.String{
+			Title:       "Token Audience",
+			Description: "Audience claim to include in the JWT token, if required by the server.",
+		},
+	},
+	Required: []string{"provider", "tunnelUrl", "tunnelSecret"},
+}
+
 var statelessDNSConfigSchema = schematypes.Object{
 	Properties: schematypes.Properties{
 		"provider": schematypes.StringEnum{Options: []string{"stateless-dns"}},
@@ -77,12 +107,66 @@ var statelessDNSConfigSchema = schematypes.Object{
 	},
 }
 
+var statelessDNSWildcardConfigSchema = schematypes.Object{
+	Title: "Stateless DNS with Wildcard Certificate",
+	Description: util.Markdown(`
+		Expose webhooks on a public port using stateless-dns-server hostnames,
+		with TLS using a wildcard certificate for 'statelessDNSDomain' loaded
+		from taskcluster-secrets.
+
+		The certificate is shared by all workers, and can be issued using the
+		DNS-01 challenge from Let's Encrypt. This avoids issuing a certificate
+		per worker, which is subject to rate-limits when spinning up large
+		worker pools. The certificate is reloaded periodically, such that renewed
+		certificates are picked up without restarting the worker.
+	`),
+	Properties: schematypes.Properties{
+		"provider":           schematypes.StringEnum{Options: []string{"stateless-dns-wildcard"}},
+		"serverIp":           statelessDNSConfigSchema.Properties["serverIp"],
+		"serverPort":         statelessDNSConfigSchema.Properties["serverPort"],
+		"networkInterface":   statelessDNSConfigSchema.Properties["networkInterface"],
+		"exposedPort":        statelessDNSConfigSchema.Properties["exposedPort"],
+		"statelessDNSSecret": statelessDNSConfigSchema.Properties["statelessDNSSecret"],
+		"statelessDNSDomain": statelessDNSConfigSchema.Properties["statelessDNSDomain"],
+		"expiration":         statelessDNSConfigSchema.Properties["expiration"],
+		"certificateSecret": schematypes.String{
+			Title: "Certificate Secret",
+			Description: util.Markdown(`
+				Name of the secret in taskcluster-secrets holding the wildcard
+				certificate. The secret must have the properties 'certificate' and
+				'key' with the PEM encoded certificate chain and private key.
+			`),
+		},
+		"secretsBaseUrl": schematypes.URI{
+			Title:       "Secrets BaseUrl",
+			Description: "BaseUrl for taskcluster-secrets, if not using the default.",
+		},
+		"certificateRefresh": schematypes.Duration{
+			Title: "Certificate Refresh Interval",
+			Description: util.Markdown(`
+				Interval between reloading the certificate from taskcluster-secrets,
+				defaults to 1 day.
+			`),
+		},
+	},
+	Required: []string{
+		"provider",
+		"serverIp",
+		"serverPort",
+		"statelessDNSSecret",
+		"statelessDNSDomain",
+		"certificateSecret",
+	},
+}
+
 // ConfigSchema specifies schema for configuration passed to NewServer.
 var ConfigSchema schematypes.Schema = schematypes.OneOf{
 	localhostConfigSchema,
 	localtunnelConfigSchema,
 	statelessDNSConfigSchema,
+	statelessDNSWildcardConfigSchema,
 	webhooktunnelConfigSchema,
+	websocktunnelConfigSchema,
 }
 
 // Server abstracts various WebHookServer implementations
@@ -94,7 +178,8 @@ type Server interface {
 // NewServer returns a Server implementing WebHookServer, choosing the
 // implemetation based on the configuration passed in.
 // Config passed must match ConfigSchema.
-// Credentials are required if the WebhookServer is Webhooktunnel.
+// Credentials are required if the WebhookServer is Webhooktunnel or uses a
+// wildcard certificate from taskcluster-secrets.
 func NewServer(config interface{}, credentials *tcclient.Credentials) (Server, error) {
 	var c struct {
 		Provider           string        `json:"provider"`
@@ -109,6 +194,13 @@ func NewServer(config interface{}, credentials *tcclient.Credentials) (Server, e
 		Expiration         time.Duration `json:"expiration"`
 		BaseURL            string        `json:"baseUrl"`
 		ProxyURL           string        `json:"proxyUrl"`
+		TunnelURL          string        `json:"tunnelUrl"`
+		TunnelSecret       string        `json:"tunnelSecret"`
+		TunnelID           string        `json:"tunnelId"`
+		Audience           string        `json:"audience"`
+		CertificateSecret  string        `json:"certificateSecret"`
+		SecretsBaseURL     string        `json:"secretsBaseUrl"`
+		CertificateRefresh time.Duration `json:"certificateRefresh"`
 	}
 	schematypes.MustValidate(ConfigSchema, config)
 	if schematypes.MustMap(localhostConfigSchema, config, &c) == nil {
@@ -121,6 +213,15 @@ func NewServer(config interface{}, credentials *tcclient.Credentials) (Server, e
 		s, err := NewWebhookTunnel(credentials)
 		return s, err
 	}
+	if schematypes.MustMap(websocktunnelConfigSchema, config, &c) == nil {
+		s, err := NewWebSockTunnel(WebSockTunnelOptions{
+			TunnelURL: c.TunnelURL,
+			Secret:    c.TunnelSecret,
+			TunnelID:  c.TunnelID,
+			Audience:  c.Audience,
+		})
+		return s, err
+	}
 	if schematypes.MustMap(statelessDNSConfigSchema, config, &c) == nil {
 		s, err := NewLocalServer(
 			net.ParseIP(c.ServerIP), c.ServerPort,
@@ -136,5 +237,29 @@ func NewServer(config interface{}, credentials *tcclient.Credentials) (Server, e
 		}
 		return s, err
 	}
+	if schematypes.MustMap(statelessDNSWildcardConfigSchema, config, &c) == nil {
+		cert, err := NewSecretCertificate(
+			credentials, c.SecretsBaseURL,
+			c.CertificateSecret, c.StatelessDNSDomain,
+			c.CertificateRefresh,
+		)
+		if err != nil {
+			return nil, err
+		}
+		s, err := NewWildcardServer(
+			net.ParseIP(c.ServerIP), c.ServerPort,
+			c.NetworkInterface, c.ExposedPort,
+			c.StatelessDNSDomain,
+			c.StatelessDNSSecret,
+			cert,
+			c.Expiration,
+		)
+		if err != nil {
+			cert.Stop()
+			return nil, err
+		}
+		go s.ListenAndServe()
+		return s, nil
+	}
 	panic("Invalid config shouldn't be valid")
 }
@@ -14,4 +14,16 @@
 // and exposes a net.Listener interface which can be used by http.Server. This
 // results in a more secure worker.
 // Webhooktunnel requires TC credentials.
+//
+// WebSockTunnel is similar to Webhooktunnel, but connects to a websocktunnel
+// server using a JWT token signed with a secret shared with the server. This
+// is useful for workers behind NAT, where machines can't be assigned public
+// IPs or per-worker DNS entries.
+//
+// Plugins that need to expose HTTP endpoints can use an EndpointSet to register
+// named sub-paths on a single hook, and WithAccessToken to restrict access.
 package webhookserver
+
+import "github.com/taskcluster/taskcluster-worker/runtime/util"
+
+var debug = util.Debug("webhookserver")
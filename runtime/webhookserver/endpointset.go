@@ -0,0 +1,101 @@
+package webhookserver
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// ErrEndpointExists is returned from EndpointSet.Register if an endpoint with
+// the given name is already registered.
+var ErrEndpointExists = errors.New("an endpoint with the given name is already registered")
+
+// ErrInvalidEndpointName is returned from EndpointSet.Register if the name
+// doesn't match EndpointNamePattern.
+var ErrInvalidEndpointName = errors.New("endpoint name must match EndpointNamePattern")
+
+// EndpointNamePattern is the pattern endpoint names must match.
+var EndpointNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,64}$`)
+
+// An EndpointSet attaches a single hook to a WebHookServer, and lets consumers
+// register handlers for named sub-paths beneath it.
+//
+// This allows plugins to expose HTTP endpoints like previews or metrics without
+// managing hooks themselves. A request for "<url>/<name>/<suffix>" will be
+// given to the handler registered as name, with the path "/<suffix>".
+type EndpointSet struct {
+	m        sync.RWMutex
+	url      string
+	detach   func()
+	handlers map[string]http.Handler
+}
+
+// NewEndpointSet returns a new EndpointSet attached to the given server,
+// callers must call Dispose() to detach it.
+func NewEndpointSet(server WebHookServer) *EndpointSet {
+	s := &EndpointSet{
+		handlers: make(map[string]http.Handler),
+	}
+	s.url, s.detach = server.AttachHook(http.HandlerFunc(s.handle))
+	return s
+}
+
+// Register adds handler as endpoint under name, and returns the url at which
+// the handler is exposed.
+func (s *EndpointSet) Register(name string, handler http.Handler) (string, error) {
+	if !EndpointNamePattern.MatchString(name) {
+		return "", ErrInvalidEndpointName
+	}
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if _, ok := s.handlers[name]; ok {
+		return "", ErrEndpointExists
+	}
+	s.handlers[name] = handler
+	return s.url + name + "/", nil
+}
+
+// Unregister removes the endpoint registered as name, if any.
+func (s *EndpointSet) Unregister(name string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.handlers, name)
+}
+
+// Dispose detaches the EndpointSet from the WebHookServer
+func (s *EndpointSet) Dispose() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.detach != nil {
+		s.detach()
+		s.detach = nil
+	}
+	s.handlers = make(map[string]http.Handler)
+}
+
+func (s *EndpointSet) handle(w http.ResponseWriter, r *http.Request) {
+	// URL Path format: "/" + name + "/" + <suffix>
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	i := strings.IndexByte(path, '/')
+	if i == -1 {
+		http.NotFound(w, r)
+		return
+	}
+	name := path[:i]
+
+	s.m.RLock()
+	handler, ok := s.handlers[name]
+	s.m.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	r.URL.Path = path[i:]
+	r.URL.RawPath = ""
+	handler.ServeHTTP(w, r)
+}
@@ -0,0 +1,52 @@
+package webhookserver
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestEndpointSet(*testing.T) {
+	s, err := NewTestServer()
+	nilOrPanic(err)
+	defer s.Stop()
+
+	endpoints := NewEndpointSet(s)
+	defer endpoints.Dispose()
+
+	path := ""
+	token := NewAccessToken()
+	url, err := endpoints.Register("preview", WithAccessToken(token, http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			path = r.URL.Path
+			w.WriteHeader(http.StatusOK)
+		},
+	)))
+	nilOrPanic(err, "failed to register endpoint")
+
+	_, err = endpoints.Register("preview", http.NotFoundHandler())
+	assert(err == ErrEndpointExists, "expected ErrEndpointExists")
+	_, err = endpoints.Register("bad/name", http.NotFoundHandler())
+	assert(err == ErrInvalidEndpointName, "expected ErrInvalidEndpointName")
+
+	res, err := http.Get(url + "file.txt")
+	nilOrPanic(err)
+	res.Body.Close()
+	assert(res.StatusCode == http.StatusUnauthorized, "expected 401, got: ", res.StatusCode)
+
+	res, err = http.Get(url + "file.txt?accessToken=wrong")
+	nilOrPanic(err)
+	res.Body.Close()
+	assert(res.StatusCode == http.StatusForbidden, "expected 403, got: ", res.StatusCode)
+
+	res, err = http.Get(url + "file.txt?accessToken=" + token)
+	nilOrPanic(err)
+	res.Body.Close()
+	assert(res.StatusCode == http.StatusOK, "expected 200, got: ", res.StatusCode)
+	assert(path == "/file.txt", "wrong path: ", path)
+
+	endpoints.Unregister("preview")
+	res, err = http.Get(url + "file.txt?accessToken=" + token)
+	nilOrPanic(err)
+	res.Body.Close()
+	assert(res.StatusCode == http.StatusNotFound, "expected 404, got: ", res.StatusCode)
+}
@@ -0,0 +1,253 @@
+package webhookserver
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/websocket"
+	"github.com/pkg/errors"
+	"github.com/taskcluster/slugid-go/slugid"
+	"github.com/taskcluster/webhooktunnel/wsmux"
+)
+
+// tokenLifetime is the validity period of the JWT tokens we sign, tokens are
+// only used when (re)connecting, so this need not be very long.
+const tokenLifetime = 30 * time.Minute
+
+// errWebSockTunnelClosed is returned from Accept() after Stop() is called
+var errWebSockTunnelClosed = errors.New("websocktunnel client has been stopped")
+
+// WebSockTunnelOptions holds the configuration for a WebSockTunnel
+type WebSockTunnelOptions struct {
+	TunnelURL string // URL for the websocktunnel server
+	Secret    string // Secret shared with the websocktunnel server
+	TunnelID  string // Identifier for the tunnel, must be unique
+	Audience  string // Audience claim for the JWT token, optional
+}
+
+// WebSockTunnel implements WebHookServer by connecting to a websocktunnel
+// server and serving requests forwarded over a multiplexed websocket.
+//
+// Requests are forwarded to the worker, so it need not have a public IP
+// address, nor any DNS entry, which makes this suitable for workers behind NAT.
+type WebSockTunnel struct {
+	m        sync.RWMutex
+	handlers map[string]http.Handler
+	options  WebSockTunnelOptions
+
+	mSession sync.Mutex
+	session  *wsmux.Session
+	url      string
+	stopped  chan struct{}
+}
+
+// NewWebSockTunnel connects to the websocktunnel server given in options
+// and returns a WebSockTunnel serving hooks through it.
+func NewWebSockTunnel(options WebSockTunnelOptions) (*WebSockTunnel, error) {
+	if options.TunnelID == "" {
+		options.TunnelID = slugid.Nice()
+	}
+	wst := &WebSockTunnel{
+		handlers: make(map[string]http.Handler),
+		options:  options,
+		stopped:  make(chan struct{}),
+	}
+
+	session, url, err := wst.connect()
+	if err != nil {
+		return nil, err
+	}
+	wst.session = session
+	wst.url = url
+
+	go func() {
+		_ = http.Serve(wst, http.HandlerFunc(wst.handle))
+	}()
+	return wst, nil
+}
+
+// token returns a signed JWT token for authenticating with the server
+func (wst *WebSockTunnel) token() (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"tid": wst.options.TunnelID,
+		"iat": now.Unix(),
+		"nbf": now.Add(-5 * time.Minute).Unix(), // allow for some clock drift
+		"exp": now.Add(tokenLifetime).Unix(),
+	}
+	if wst.options.Audience != "" {
+		claims["aud"] = wst.options.Audience
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(wst.options.Secret))
+}
+
+// connect dials the websocktunnel server and returns a new session and the
+// public URL for the tunnel.
+func (wst *WebSockTunnel) connect() (*wsmux.Session, string, error) {
+	token, err := wst.token()
+	if err != nil {
+		return nil, "", errors.Wrap(err, "failed to sign websocktunnel token")
+	}
+
+	header := make(http.Header)
+	header.Set("Authorization", "Bearer "+token)
+	header.Set("x-websocktunnel-id", wst.options.TunnelID)
+
+	debug("connecting to websocktunnel at %s", wst.options.TunnelURL)
+	conn, res, err := websocket.DefaultDialer.Dial(websocketURL(wst.options.TunnelURL), header)
+	if err != nil {
+		if res != nil {
+			return nil, "", errors.Wrapf(err, "websocktunnel connection failed, status: %d", res.StatusCode)
+		}
+		return nil, "", errors.Wrap(err, "websocktunnel connection failed")
+	}
+
+	url := strings.TrimSuffix(res.Header.Get("x-websocktunnel-client-url"), "/")
+	if url == "" {
+		_ = conn.Close()
+		return nil, "", errors.New("websocktunnel server didn't return a client url")
+	}
+	return wsmux.Client(conn, wsmux.Config{StreamBufferSize: 4 * 1024}), url, nil
+}
+
+// reconnect replaces the current session, retrying with exponential backoff
+// until it succeeds or the WebSockTunnel is stopped.
+func (wst *WebSockTunnel) reconnect() error {
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = 0 // retry until stopped
+	for {
+		session, url, err := wst.connect()
+		if err == nil {
+			wst.mSession.Lock()
+			select {
+			case <-wst.stopped:
+				wst.mSession.Unlock()
+				_ = session.Close()
+				return errWebSockTunnelClosed
+			default:
+			}
+			if wst.session != nil {
+				_ = wst.session.Close()
+			}
+			wst.session = session
+			wst.url = url
+			wst.mSession.Unlock()
+			return nil
+		}
+		debug("failed to reconnect to websocktunnel, error: %s", err)
+		select {
+		case <-wst.stopped:
+			return errWebSockTunnelClosed
+		case <-time.After(b.NextBackOff()):
+		}
+	}
+}
+
+// Accept implements net.Listener, reconnecting if the session is broken
+func (wst *WebSockTunnel) Accept() (net.Conn, error) {
+	for {
+		select {
+		case <-wst.stopped:
+			return nil, errWebSockTunnelClosed
+		default:
+		}
+
+		wst.mSession.Lock()
+		session := wst.session
+		wst.mSession.Unlock()
+
+		conn, err := session.Accept()
+		if err == nil {
+			return conn, nil
+		}
+		debug("websocktunnel session broken, error: %s", err)
+		if err := wst.reconnect(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Addr implements net.Listener
+func (wst *WebSockTunnel) Addr() net.Addr {
+	wst.mSession.Lock()
+	defer wst.mSession.Unlock()
+	return wst.session.Addr()
+}
+
+// Close implements net.Listener, use Stop() instead.
+func (wst *WebSockTunnel) Close() error {
+	wst.Stop()
+	return nil
+}
+
+// AttachHook adds a new webhook to the server
+func (wst *WebSockTunnel) AttachHook(handler http.Handler) (string, func()) {
+	id := slugid.Nice()
+	wst.m.Lock()
+	wst.handlers[id] = handler
+	wst.m.Unlock()
+
+	wst.mSession.Lock()
+	url := wst.url + "/" + id + "/"
+	wst.mSession.Unlock()
+
+	detach := func() {
+		wst.m.Lock()
+		defer wst.m.Unlock()
+		delete(wst.handlers, id)
+	}
+
+	return url, detach
+}
+
+// Stop will close the connection to the websocktunnel server
+func (wst *WebSockTunnel) Stop() {
+	wst.mSession.Lock()
+	defer wst.mSession.Unlock()
+	select {
+	case <-wst.stopped:
+		return
+	default:
+		close(wst.stopped)
+	}
+	_ = wst.session.Close()
+}
+
+func (wst *WebSockTunnel) handle(w http.ResponseWriter, r *http.Request) {
+	// URL Path format: "/" + slugid(22 characters) + <endpoint>
+	if len(r.URL.Path) < 24 || r.URL.Path[23] != '/' {
+		http.NotFound(w, r)
+		return
+	}
+
+	id, path := r.URL.Path[1:23], r.URL.Path[23:]
+
+	wst.m.RLock()
+	handler, ok := wst.handlers[id]
+	wst.m.RUnlock()
+
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	r.URL.Path = path
+	handler.ServeHTTP(w, r)
+}
+
+// websocketURL rewrites http(s):// URLs to ws(s)://
+func websocketURL(u string) string {
+	if strings.HasPrefix(u, "https://") {
+		return "wss://" + strings.TrimPrefix(u, "https://")
+	}
+	if strings.HasPrefix(u, "http://") {
+		return "ws://" + strings.TrimPrefix(u, "http://")
+	}
+	return u
+}
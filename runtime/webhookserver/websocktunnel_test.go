@@ -0,0 +1,30 @@
+package webhookserver
+
+import (
+	"testing"
+
+	jwt "github.com/dgrijalva/jwt-go"
+)
+
+func TestWebSockTunnelToken(t *testing.T) {
+	wst := &WebSockTunnel{options: WebSockTunnelOptions{
+		Secret:   "my-secret",
+		TunnelID: "my-worker",
+		Audience: "websocktunnel-test",
+	}}
+	signed, err := wst.token()
+	nilOrPanic(err, "failed to sign token")
+
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(signed, claims, func(t *jwt.Token) (interface{}, error) {
+		return []byte("my-secret"), nil
+	})
+	nilOrPanic(err, "failed to parse token")
+	assert(token.Valid, "expected token to be valid")
+	assert(token.Method == jwt.SigningMethodHS256, "expected HS256")
+	assert(claims["tid"] == "my-worker", "wrong tid: ", claims["tid"])
+	assert(claims.VerifyAudience("websocktunnel-test", true), "wrong audience")
+
+	assert(websocketURL("https://tunnel.example.com") == "wss://tunnel.example.com")
+	assert(websocketURL("http://localhost:8080") == "ws://localhost:8080")
+}
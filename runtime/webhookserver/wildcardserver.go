@@ -0,0 +1,178 @@
+package webhookserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/taskcluster/taskcluster-client-go"
+	"github.com/taskcluster/taskcluster-client-go/tcsecrets"
+)
+
+// defaultCertificateRefresh is the interval between reloading the wildcard
+// certificate from taskcluster-secrets, if not specified. Let's Encrypt
+// certificates are valid for 90 days, so reloading daily is plenty.
+const defaultCertificateRefresh = 24 * time.Hour
+
+// SecretCertificate holds a wildcard TLS certificate loaded from
+// taskcluster-secrets, and periodically reloads it, such that a renewed
+// certificate is picked up without restarting the worker.
+//
+// The secret must have the properties 'certificate' and 'key' holding the PEM
+// encoded certificate chain and private key.
+type SecretCertificate struct {
+	m        sync.RWMutex
+	cert     *tls.Certificate
+	secrets  *tcsecrets.Secrets
+	name     string
+	hostname string
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewSecretCertificate loads the certificate from the secret given by name,
+// and verifies that it is valid for subdomains of domain.
+//
+// If secretsBaseURL is non-empty it overwrites the default baseUrl for
+// taskcluster-secrets. If refresh is zero defaultCertificateRefresh is used.
+func NewSecretCertificate(
+	credentials *tcclient.Credentials,
+	secretsBaseURL, name, domain string,
+	refresh time.Duration,
+) (*SecretCertificate, error) {
+	if refresh == 0 {
+		refresh = defaultCertificateRefresh
+	}
+	c := &SecretCertificate{
+		secrets: tcsecrets.New(credentials),
+		name:    name,
+		// Any single label under domain should be covered by the certificate
+		hostname: "stateless-dns-hostname." + domain,
+		done:     make(chan struct{}),
+	}
+	if secretsBaseURL != "" {
+		c.secrets.BaseURL = secretsBaseURL
+	}
+
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	go c.refreshLoop(refresh)
+	return c, nil
+}
+
+// reload fetches the secret and replaces the current certificate
+func (c *SecretCertificate) reload() error {
+	secret, err := c.secrets.Get(c.name)
+	if err != nil {
+		return errors.Wrapf(err, "failed to load secret '%s'", c.name)
+	}
+	var s struct {
+		Certificate string `json:"certificate"`
+		Key         string `json:"key"`
+	}
+	if err = json.Unmarshal(secret.Secret, &s); err != nil {
+		return errors.Wrapf(err, "failed to parse secret '%s'", c.name)
+	}
+
+	cert, err := tls.X509KeyPair([]byte(s.Certificate), []byte(s.Key))
+	if err != nil {
+		return errors.Wrapf(err, "invalid certificate in secret '%s'", c.name)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return errors.Wrapf(err, "invalid certificate in secret '%s'", c.name)
+	}
+	if err = leaf.VerifyHostname(c.hostname); err != nil {
+		return errors.Wrapf(err, "certificate in secret '%s' isn't a wildcard certificate for the domain", c.name)
+	}
+	if time.Now().After(leaf.NotAfter) {
+		return errors.Errorf("certificate in secret '%s' expired at %s", c.name, leaf.NotAfter)
+	}
+	cert.Leaf = leaf
+
+	c.m.Lock()
+	c.cert = &cert
+	c.m.Unlock()
+	return nil
+}
+
+func (c *SecretCertificate) refreshLoop(refresh time.Duration) {
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-time.After(refresh):
+		}
+		// If reloading fails we keep using the current certificate, and try
+		// again later, the secret is likely being updated.
+		if err := c.reload(); err != nil {
+			debug("failed to reload wildcard certificate, error: %s", err)
+		}
+	}
+}
+
+// GetCertificate returns the current certificate, this is intended to be used
+// as GetCertificate in tls.Config.
+func (c *SecretCertificate) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.m.RLock()
+	defer c.m.RUnlock()
+	return c.cert, nil
+}
+
+// Stop will stop refreshing the certificate
+func (c *SecretCertificate) Stop() {
+	c.stopOnce.Do(func() {
+		close(c.done)
+	})
+}
+
+// WildcardServer is a LocalServer using stateless-dns-server hostnames and a
+// wildcard certificate shared between all workers through taskcluster-secrets.
+//
+// This avoids issuing a certificate for each worker, which is rate-limited by
+// Let's Encrypt, and thus a problem when spinning up large worker pools.
+type WildcardServer struct {
+	*LocalServer
+	certificate *SecretCertificate
+}
+
+// NewWildcardServer creates a WebHookServer similar to NewLocalServer, except
+// TLS is always enabled using the certificate given.
+func NewWildcardServer(
+	publicIP []byte,
+	publicPort int,
+	networkInterface string,
+	localPort int,
+	subdomain, dnsSecret string,
+	certificate *SecretCertificate,
+	expiration time.Duration,
+) (*WildcardServer, error) {
+	s, err := NewLocalServer(
+		publicIP, publicPort,
+		networkInterface, localPort,
+		subdomain, dnsSecret,
+		"", "",
+		expiration,
+	)
+	if err != nil {
+		return nil, err
+	}
+	s.server.TLSConfig = &tls.Config{
+		NextProtos:     []string{"http/1.1"},
+		GetCertificate: certificate.GetCertificate,
+	}
+	return &WildcardServer{
+		LocalServer: s,
+		certificate: certificate,
+	}, nil
+}
+
+// Stop will stop serving requests and stop refreshing the certificate
+func (s *WildcardServer) Stop() {
+	s.LocalServer.Stop()
+	s.certificate.Stop()
+}
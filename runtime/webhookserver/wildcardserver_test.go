@@ -0,0 +1,69 @@
+package webhookserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/taskcluster/taskcluster-client-go"
+)
+
+func makeCertificate(dnsName string) (certPEM, keyPEM string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	nilOrPanic(err)
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: dnsName},
+		DNSNames:     []string{dnsName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	nilOrPanic(err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	nilOrPanic(err)
+	certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}))
+	return
+}
+
+func TestSecretCertificate(t *testing.T) {
+	certPEM, keyPEM := makeCertificate("*.example.com")
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/secret/my/wildcard/cert" {
+			w.WriteHeader(404)
+			return
+		}
+		secret, _ := json.Marshal(map[string]string{
+			"certificate": certPEM,
+			"key":         keyPEM,
+		})
+		w.WriteHeader(200)
+		w.Write([]byte(`{"expires": "2016-09-27T00:17:53.921Z", "secret": ` + string(secret) + `}`))
+	}))
+	defer s.Close()
+
+	creds := &tcclient.Credentials{ClientID: "no-client", AccessToken: "no-secret"}
+
+	c, err := NewSecretCertificate(creds, s.URL, "my/wildcard/cert", "example.com", 0)
+	nilOrPanic(err, "failed to load certificate")
+	defer c.Stop()
+	cert, err := c.GetCertificate(nil)
+	nilOrPanic(err)
+	assert(cert != nil && cert.Leaf.Subject.CommonName == "*.example.com", "wrong certificate")
+
+	_, err = NewSecretCertificate(creds, s.URL, "my/wildcard/cert", "example.org", 0)
+	assert(err != nil, "expected an error for certificate with the wrong domain")
+
+	_, err = NewSecretCertificate(creds, s.URL, "missing/secret", "example.com", 0)
+	assert(err != nil, "expected an error for missing secret")
+}
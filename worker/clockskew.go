@@ -0,0 +1,66 @@
+package worker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+// maximumClockSkew is the clock skew tolerated before we warn and compensate
+// for the skew when computing delays from timestamps issued by the queue.
+const maximumClockSkew = 30 * time.Second
+
+// clockSkew tracks the difference between the local clock and the clock of
+// the queue, the zero-value is ready for use.
+//
+// Timestamps issued by the queue, such as takenUntil and deadline, are in the
+// time of the queue. If the local clock drifts we risk reclaiming too late,
+// causing claims to expire.
+type clockSkew struct {
+	m    sync.Mutex
+	skew time.Duration
+}
+
+// estimateSkew returns the skew implied by a timestamp issued by the server
+// between before and after in local time. As we don't know how long the
+// server spent processing the request, any timestamp within the interval is
+// considered zero skew.
+func estimateSkew(serverTime, before, after time.Time) time.Duration {
+	if serverTime.Before(before) {
+		return serverTime.Sub(before)
+	}
+	if serverTime.After(after) {
+		return serverTime.Sub(after)
+	}
+	return 0
+}
+
+// observe records the skew implied by serverTime issued by the server between
+// before and after in local time.
+func (s *clockSkew) observe(monitor runtime.Monitor, serverTime, before, after time.Time) {
+	skew := estimateSkew(serverTime, before, after)
+	monitor.Measure("clock-skew", skew.Seconds())
+
+	s.m.Lock()
+	defer s.m.Unlock()
+	if -maximumClockSkew < skew && skew < maximumClockSkew {
+		if s.skew != 0 {
+			monitor.Info("local clock is no longer skewed relative to the queue")
+		}
+		s.skew = 0
+		return
+	}
+	monitor.Warnf(
+		"local clock is skewed by %s relative to the queue, check the system clock; "+
+			"compensating for the skew when reclaiming tasks", skew,
+	)
+	s.skew = skew
+}
+
+// until returns the duration until t, given in the time of the queue
+func (s *clockSkew) until(t time.Time) time.Duration {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return time.Until(t) - s.skew
+}
@@ -0,0 +1,39 @@
+package worker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/runtime/mocks"
+)
+
+func TestEstimateSkew(t *testing.T) {
+	before := time.Now()
+	after := before.Add(2 * time.Second)
+
+	require.Equal(t, time.Duration(0), estimateSkew(before.Add(time.Second), before, after))
+	require.Equal(t, -5*time.Minute, estimateSkew(before.Add(-5*time.Minute), before, after))
+	require.Equal(t, 5*time.Minute, estimateSkew(after.Add(5*time.Minute), before, after))
+}
+
+func TestClockSkew(t *testing.T) {
+	var s clockSkew
+	monitor := mocks.NewMockMonitor(false)
+	deadline := time.Now().Add(20 * time.Minute)
+
+	// Small skew is ignored
+	now := time.Now()
+	s.observe(monitor, now.Add(5*time.Second), now, now)
+	require.InDelta(t, float64(20*time.Minute), float64(s.until(deadline)), float64(time.Second))
+
+	// Queue clock is 10 minutes ahead, so the deadline is 10 minutes closer
+	now = time.Now()
+	s.observe(monitor, now.Add(10*time.Minute), now, now)
+	require.InDelta(t, float64(10*time.Minute), float64(s.until(deadline)), float64(time.Second))
+
+	// Skew is reset when clocks are in sync again
+	now = time.Now()
+	s.observe(monitor, now, now, now)
+	require.InDelta(t, float64(20*time.Minute), float64(s.until(deadline)), float64(time.Second))
+}
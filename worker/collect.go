@@ -0,0 +1,87 @@
+package worker
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/shirou/gopsutil/disk"
+)
+
+// EvictedResource is a resource disposed by CollectGarbage()
+type EvictedResource struct {
+	Description string    `json:"description"`
+	Priority    int       `json:"priority"`
+	DiskSize    uint64    `json:"diskSize"`
+	LastUsed    time.Time `json:"lastUsed"`
+}
+
+// GarbageCollectionReport is the result of CollectGarbage()
+type GarbageCollectionReport struct {
+	FreeSpace      int64             `json:"freeSpace"`
+	DiskFreeBefore uint64            `json:"diskFreeBefore"`
+	DiskFreeAfter  uint64            `json:"diskFreeAfter"`
+	Evicted        []EvictedResource `json:"evicted"`
+}
+
+// CollectGarbage disposes cached resources not in use, until freeSpace bytes
+// of disk space is available in the temporary folder. If freeSpace is zero all
+// resources not in use will be disposed.
+//
+// This allows operators to recover from a full disk without restarting the
+// worker.
+func (w *Worker) CollectGarbage(freeSpace int64) (GarbageCollectionReport, error) {
+	r := GarbageCollectionReport{
+		FreeSpace: freeSpace,
+		Evicted:   []EvictedResource{},
+	}
+	if stat, err := disk.Usage(w.temporaryFolder); err == nil {
+		r.DiskFreeBefore = stat.Free
+	}
+
+	evicted, err := w.garbageCollector.CollectFreeSpace(freeSpace)
+	for _, e := range evicted {
+		r.Evicted = append(r.Evicted, EvictedResource{
+			Description: e.Description,
+			Priority:    int(e.Priority),
+			DiskSize:    e.DiskSize,
+			LastUsed:    e.LastUsed,
+		})
+		w.monitor.Infof("garbage collection evicted %s", e.Description)
+	}
+
+	if stat, serr := disk.Usage(w.temporaryFolder); serr == nil {
+		r.DiskFreeAfter = stat.Free
+	}
+	return r, err
+}
+
+// handleCollectGarbage handles 'POST /gc?freeSpace=<bytes>' for the control API
+func (w *Worker) handleCollectGarbage(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var freeSpace int64
+	if s := r.URL.Query().Get("freeSpace"); s != "" {
+		var err error
+		freeSpace, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || freeSpace < 0 {
+			writeJSON(rw, http.StatusBadRequest, map[string]string{
+				"message": "query parameter 'freeSpace' must be a non-negative integer",
+			})
+			return
+		}
+	}
+
+	report, err := w.CollectGarbage(freeSpace)
+	if err != nil {
+		incidentID := w.monitor.ReportError(err, "garbage collection requested through control API failed")
+		writeJSON(rw, http.StatusInternalServerError, map[string]string{
+			"message":    "garbage collection failed, see incidentId in worker logs",
+			"incidentId": incidentID,
+		})
+		return
+	}
+	writeJSON(rw, http.StatusOK, report)
+}
@@ -7,21 +7,24 @@ import (
 	tcclient "github.com/taskcluster/taskcluster-client-go"
 	"github.com/taskcluster/taskcluster-worker/engines"
 	"github.com/taskcluster/taskcluster-worker/plugins"
+	"github.com/taskcluster/taskcluster-worker/runtime/limits"
 	"github.com/taskcluster/taskcluster-worker/runtime/monitoring"
 	"github.com/taskcluster/taskcluster-worker/runtime/util"
 	"github.com/taskcluster/taskcluster-worker/runtime/webhookserver"
 )
 
 type options struct {
-	ProvisionerID       string `json:"provisionerId"`
-	WorkerType          string `json:"workerType"`
-	WorkerGroup         string `json:"workerGroup"`
-	WorkerID            string `json:"workerId"`
-	PollingInterval     int    `json:"pollingInterval"`
-	ReclaimOffset       int    `json:"reclaimOffset"`
-	MinimumReclaimDelay int    `json:"minimumReclaimDelay"`
-	Concurrency         int    `json:"concurrency"`
-	EnableSuperseding   bool   `json:"enableSuperseding"`
+	ProvisionerID       string        `json:"provisionerId"`
+	WorkerType          string        `json:"workerType"`
+	WorkerGroup         string        `json:"workerGroup"`
+	WorkerID            string        `json:"workerId"`
+	PollingInterval     int           `json:"pollingInterval"`
+	ReclaimOffset       int           `json:"reclaimOffset"`
+	MinimumReclaimDelay int           `json:"minimumReclaimDelay"`
+	DeadlineOffset      int           `json:"deadlineOffset"`
+	Concurrency         int           `json:"concurrency"`
+	EnableSuperseding   bool          `json:"enableSuperseding"`
+	AdditionalQueues    []queueOption `json:"additionalQueues"`
 }
 
 type configType struct {
@@ -30,13 +33,24 @@ type configType struct {
 	Plugins          interface{}            `json:"plugins"`
 	WebHookServer    interface{}            `json:"webHookServer"`
 	TemporaryFolder  string                 `json:"temporaryFolder"`
-	MinimumDiskSpace int64                  `json:"minimumDiskSpace"`
-	MinimumMemory    int64                  `json:"minimumMemory"`
-	Monitor          interface{}            `json:"monitor"`
-	Credentials      tcclient.Credentials   `json:"credentials"`
-	QueueBaseURL     string                 `json:"queueBaseUrl"`
-	AuthBaseURL      string                 `json:"authBaseUrl"`
-	WorkerOptions    options                `json:"worker"`
+	TemporaryStorage struct {
+		Quota      int64  `json:"quota"`
+		TaskQuota  int64  `json:"taskQuota"`
+		Encryption string `json:"encryption"`
+	} `json:"temporaryStorage"`
+	MinimumDiskSpace int64                `json:"minimumDiskSpace"`
+	MinimumMemory    int64                `json:"minimumMemory"`
+	MaximumDiskUsage int64                `json:"maximumDiskUsage"`
+	Monitor          interface{}          `json:"monitor"`
+	Credentials      tcclient.Credentials `json:"credentials"`
+	QueueBaseURL     string               `json:"queueBaseUrl"`
+	AuthBaseURL      string               `json:"authBaseUrl"`
+	WorkerOptions    options              `json:"worker"`
+	Update           *updateConfig        `json:"update"`
+	ControlPort      int                  `json:"controlPort"`
+	ControlTokenFile string               `json:"controlTokenFile"`
+	Migration        *migrationConfig     `json:"migration"`
+	Daemon           interface{}          `json:"daemon"`
 }
 
 // optionsSchema must be satisfied by Options used to construct a Worker
@@ -94,6 +108,17 @@ var optionsSchema schematypes.Schema = schematypes.Object{
 			Minimum: 0,
 			Maximum: 10 * 60,
 		},
+		"deadlineOffset": schematypes.Integer{
+			Title: "Deadline Offset",
+			Description: util.Markdown(`
+				The number of seconds prior to the task deadline that the task
+				should be aborted. This leaves time for uploading logs and artifacts
+				before the queue resolves the task 'deadline-exceeded'.
+				Defaults to 3 minutes if not given.
+			`),
+			Minimum: 1,
+			Maximum: 30 * 60,
+		},
 		"minimumReclaimDelay": schematypes.Integer{
 			Title: "Minimum Reclaim Delay",
 			Description: util.Markdown(`
@@ -120,6 +145,7 @@ var optionsSchema schematypes.Schema = schematypes.Object{
 				`/reference/platform/taskcluster-queue/docs/superseding).
 			`),
 		},
+		"additionalQueues": additionalQueuesSchema,
 	},
 	Required: []string{
 		"provisionerId",
@@ -204,6 +230,48 @@ func ConfigSchema() schematypes.Object {
 					will be overwritten.
 				`),
 			},
+			"temporaryStorage": schematypes.Object{
+				Title: "Temporary Storage",
+				Description: util.Markdown(`
+					Optional settings for the temporary storage created in
+					'temporaryFolder'.
+				`),
+				Properties: schematypes.Properties{
+					"quota": schematypes.Integer{
+						Title: "Temporary Storage Quota",
+						Description: util.Markdown(`
+							Maximum number of bytes that can be written to temporary files,
+							writes exceeding this limit will fail. If encryption is
+							'dm-crypt' this is also the size of the encrypted volume.
+							Zero implies no limit.
+						`),
+						Minimum: 0,
+						Maximum: math.MaxInt64,
+					},
+					"taskQuota": schematypes.Integer{
+						Title: "Temporary Storage Quota per Task",
+						Description: util.Markdown(`
+							Maximum number of bytes that can be written to temporary files
+							created on behalf of a single task, such as artifacts uploaded
+							from the guest in the QEMU engine. Writes exceeding this limit
+							will fail. Zero implies no limit.
+						`),
+						Minimum: 0,
+						Maximum: math.MaxInt64,
+					},
+					"encryption": schematypes.StringEnum{
+						Title: "Temporary Storage Encryption",
+						Description: util.Markdown(`
+							Encrypt temporary storage with an ephemeral key, for worker
+							types that process confidential inputs. Options are 'dm-crypt'
+							for a loopback device (requires 'quota' and root), or 'fscrypt'
+							for ext4 encryption of 'temporaryFolder' (requires fscrypt
+							and a file system with encryption enabled).
+						`),
+						Options: []string{"dm-crypt", "fscrypt"},
+					},
+				},
+			},
 			"minimumDiskSpace": schematypes.Integer{
 				Title: "Minimum Disk Space",
 				Description: util.Markdown(`
@@ -224,11 +292,63 @@ func ConfigSchema() schematypes.Object {
 				Minimum: 0,
 				Maximum: math.MaxInt64,
 			},
+			"maximumDiskUsage": schematypes.Integer{
+				Title: "Maximum Disk Usage",
+				Description: util.Markdown(`
+					The maximum amount of disk space in bytes that cached resources
+					such as images, docker images, named caches and temporary downloads
+					may use combined. Garbage collector will dispose resources
+					least-recently-used first, before starting on the next task,
+					to satisfy this limit. Zero implies no limit.
+				`),
+				Minimum: 0,
+				Maximum: math.MaxInt64,
+			},
+			"controlPort": schematypes.Integer{
+				Title: "Control API Port",
+				Description: util.Markdown(`
+					Port on localhost to expose the control API on, this allows
+					the 'taskcluster-worker status' command to query the running
+					worker, and the 'taskcluster-worker gc' command to trigger
+					garbage collection, and the 'taskcluster-worker drain' command to
+					migrate running tasks to another worker. The control API is only
+					bound to '127.0.0.1'.
+					The 'status' command defaults to port '60023'.
+					Zero (default) disables the control API.
+
+					Requests must have a token written to 'controlTokenFile', which
+					must be given if the control API is enabled.
+				`),
+				Minimum: 0,
+				Maximum: 65535,
+			},
+			"controlTokenFile": schematypes.String{
+				Title: "Control API Token File",
+				Description: util.Markdown(`
+					File to which the worker writes a random token when it starts, if
+					the control API is enabled. The file is only readable by the user
+					running the worker, and the token must be given to the control API,
+					such that processes run by tasks can't use it. The 'status', 'gc'
+					and 'drain' commands read the token from this file.
+				`),
+			},
+			"daemon": schematypes.Object{
+				Title: "Daemon Options",
+				Description: util.Markdown(`
+					Process tuning applied by 'taskcluster-worker daemon' before
+					engines are created. This allows the kernel OOM killer to kill a
+					task rather than the worker, and ensures umask and ulimits doesn't
+					vary with the init system used to start the daemon.
+				`),
+				Properties: limits.ConfigSchema.Properties,
+			},
 			"monitor":      monitoring.ConfigSchema,
 			"credentials":  credentialsSchema,
 			"queueBaseUrl": schematypes.String{},
 			"authBaseUrl":  schematypes.String{},
 			"worker":       optionsSchema,
+			"update":       updateConfigSchema(),
+			"migration":    migrationConfigSchema(),
 		},
 		Required: []string{
 			"engine",
@@ -0,0 +1,84 @@
+package worker
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// DrainedTask is the result of migrating a task with Drain()
+type DrainedTask struct {
+	TaskID   string `json:"taskId"`
+	RunID    int    `json:"runId"`
+	Migrated bool   `json:"migrated"`
+	Error    string `json:"error,omitempty"`
+}
+
+// DrainReport is the result of Drain()
+type DrainReport struct {
+	Target string        `json:"target"`
+	Tasks  []DrainedTask `json:"tasks"`
+}
+
+// Drain stops the worker gracefully and migrates all running tasks to the
+// worker at target given as 'host:port'. Tasks that can't be migrated continue
+// on this host, and the worker stops when they are done.
+//
+// This allows operators to perform planned host maintenance without killing
+// long-running tasks, it requires migration to be configured and supported by
+// the engine.
+func (w *Worker) Drain(target string) DrainReport {
+	w.StopGracefully()
+
+	w.status.m.Lock()
+	tasks := make([]activeTask, 0, len(w.status.tasks))
+	for _, t := range w.status.tasks {
+		tasks = append(tasks, t)
+	}
+	w.status.m.Unlock()
+
+	// Migrate one task at the time, as each migration saturates the network
+	r := DrainReport{Target: target, Tasks: []DrainedTask{}}
+	for _, t := range tasks {
+		monitor := w.monitor.WithTags(map[string]string{
+			"taskId": t.taskID,
+			"runId":  strconv.Itoa(t.runID),
+		})
+		monitor.Infof("migrating task to %s", target)
+		d := DrainedTask{TaskID: t.taskID, RunID: t.runID}
+		c, err := w.newMigrationClient(target, t.claim, t.state, t.run, monitor)
+		if err == nil {
+			err = t.run.Migrate(c)
+		}
+		if err != nil {
+			monitor.Warn("failed to migrate task, error: ", err)
+			d.Error = err.Error()
+		} else {
+			d.Migrated = true
+		}
+		r.Tasks = append(r.Tasks, d)
+	}
+	return r
+}
+
+// handleDrain handles 'POST /drain?target=<host:port>' for the control API
+func (w *Worker) handleDrain(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		writeJSON(rw, http.StatusBadRequest, map[string]string{
+			"message": "query parameter 'target' must be given as 'host:port'",
+		})
+		return
+	}
+	// Don't stop the worker, if tasks can't be migrated
+	if w.migrationTLS == nil || !w.engine.Capabilities().Migration {
+		writeJSON(rw, http.StatusBadRequest, map[string]string{
+			"message": "migration isn't configured, or isn't supported by the engine",
+		})
+		return
+	}
+	writeJSON(rw, http.StatusOK, w.Drain(target))
+}
@@ -0,0 +1,109 @@
+package worker
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shirou/gopsutil/disk"
+)
+
+// healthCheckInterval is the time between health checks, while the host is
+// healthy. When unhealthy, checks are repeated every polling interval.
+const healthCheckInterval = 5 * time.Minute
+
+// minimumSaneTime is a point in time the system clock should never be before,
+// if it is the real-time clock has most likely been reset.
+var minimumSaneTime = time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// healthState tracks the result of the last health check
+type healthState struct {
+	m           sync.Mutex // protects err, which is read by Status()
+	lastChecked time.Time
+	err         error
+}
+
+// progressState tracks progress of the claim loop, see Worker.Alive()
+type progressState struct {
+	m       sync.Mutex
+	last    time.Time // last time the claim loop made progress
+	waiting bool      // true, while the claim loop is waiting for tasks or polling interval
+}
+
+// update records progress, waiting is true if the claim loop is about to block
+// waiting for active tasks or the polling interval.
+func (p *progressState) update(waiting bool) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	p.last = time.Now()
+	p.waiting = waiting
+}
+
+// Alive returns true, if the claim loop has made progress within maxAge or is
+// waiting for active tasks to finish. This is intended for watchdogs that
+// should restart the worker when the claim loop stalls, ie. when claimWork,
+// garbage collection or health checks hang.
+func (w *Worker) Alive(maxAge time.Duration) bool {
+	w.progress.m.Lock()
+	defer w.progress.m.Unlock()
+	return w.progress.waiting || time.Since(w.progress.last) < maxAge
+}
+
+// healthy returns true if host prerequisites are satisfied, running health
+// checks if the last result is too old, or unhealthy.
+func (w *Worker) healthy() bool {
+	if w.health.err == nil && time.Since(w.health.lastChecked) < healthCheckInterval {
+		return true
+	}
+
+	err := w.healthCheck()
+	w.health.lastChecked = time.Now()
+	if err != nil {
+		w.monitor.Count("health-check.failed", 1)
+		if w.health.err == nil || w.health.err.Error() != err.Error() {
+			w.monitor.ReportWarning(err, "health check failed, not claiming tasks until resolved")
+		}
+	} else if w.health.err != nil {
+		w.monitor.Info("health check passed, resuming claiming of tasks")
+	}
+	w.health.m.Lock()
+	w.health.err = err
+	w.health.m.Unlock()
+	return err == nil
+}
+
+// PreflightCheck runs the health checks performed before claiming tasks, this
+// is useful for verifying a configuration without claiming tasks.
+func (w *Worker) PreflightCheck() error {
+	return w.healthCheck()
+}
+
+// healthCheck verifies the clock, available disk space and prerequisites of
+// the engine.
+func (w *Worker) healthCheck() error {
+	if time.Now().Before(minimumSaneTime) {
+		return fmt.Errorf(
+			"system clock is set to %s, which is before %s, the real-time clock has probably been reset",
+			time.Now(), minimumSaneTime,
+		)
+	}
+
+	if w.minimumDiskSpace > 0 {
+		stat, err := disk.Usage(w.temporaryFolder)
+		if err != nil {
+			return errors.Wrapf(err, "failed to read disk usage for: %s", w.temporaryFolder)
+		}
+		if int64(stat.Free) < w.minimumDiskSpace {
+			return fmt.Errorf(
+				"only %d bytes available in %s, minimumDiskSpace is %d bytes, even after garbage collection",
+				stat.Free, w.temporaryFolder, w.minimumDiskSpace,
+			)
+		}
+	}
+
+	if err := w.engine.HealthCheck(); err != nil {
+		return errors.Wrap(err, "engine health check failed")
+	}
+	return nil
+}
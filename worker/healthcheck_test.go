@@ -0,0 +1,54 @@
+package worker
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/engines"
+	"github.com/taskcluster/taskcluster-worker/runtime/mocks"
+)
+
+type unhealthyEngine struct {
+	engines.EngineBase
+	err error
+}
+
+func (e *unhealthyEngine) NewSandboxBuilder(engines.SandboxOptions) (engines.SandboxBuilder, error) {
+	panic("not implemented")
+}
+
+func (e *unhealthyEngine) HealthCheck() error {
+	return e.err
+}
+
+func TestWorkerHealthCheck(t *testing.T) {
+	e := &unhealthyEngine{err: errors.New("/dev/kvm is missing")}
+	w := &Worker{
+		engine:  e,
+		monitor: mocks.NewMockMonitor(false),
+	}
+
+	require.False(t, w.healthy(), "expected unhealthy engine to fail")
+	require.Contains(t, w.health.err.Error(), "/dev/kvm is missing")
+
+	e.err = nil
+	require.True(t, w.healthy(), "expected healthy after engine recovered")
+
+	// Results are cached while healthy
+	e.err = errors.New("docker isn't running")
+	require.True(t, w.healthy(), "expected cached health check result")
+}
+
+func TestWorkerAlive(t *testing.T) {
+	w := &Worker{}
+	require.False(t, w.Alive(time.Minute), "expected not alive without progress")
+
+	w.progress.update(false)
+	require.True(t, w.Alive(time.Minute), "expected alive after progress")
+	require.False(t, w.Alive(0), "expected not alive when progress is too old")
+
+	w.progress.update(true)
+	require.True(t, w.Alive(0), "expected alive while waiting for active tasks")
+}
@@ -0,0 +1,446 @@
+package worker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	schematypes "github.com/taskcluster/go-schematypes"
+	"github.com/taskcluster/slugid-go/slugid"
+	tcclient "github.com/taskcluster/taskcluster-client-go"
+	"github.com/taskcluster/taskcluster-worker/runtime/atomics"
+	"github.com/taskcluster/taskcluster-worker/runtime/util"
+	"github.com/taskcluster/taskcluster-worker/worker/taskrun"
+)
+
+// maxMigrationDuration is the maximum time from a task is handed over by the
+// source host until the migration must be committed, if exceeded the migration
+// is aborted and the task continues on the source host.
+const maxMigrationDuration = 60 * time.Minute
+
+// errMigrationAborted is returned when a migration from another host was
+// aborted, or failed before it was committed.
+var errMigrationAborted = errors.New("migration was aborted")
+
+type migrationConfig struct {
+	Port          int    `json:"port"`
+	CACertificate string `json:"caCertificate"`
+	Certificate   string `json:"certificate"`
+	Key           string `json:"key"`
+}
+
+func migrationConfigSchema() schematypes.Object {
+	return schematypes.Object{
+		Title: "Live Migration",
+		Description: util.Markdown(`
+			If configured the worker accepts running tasks migrated from other
+			workers with the same 'provisionerId' and 'workerType', and the
+			'taskcluster-worker drain' command can migrate running tasks to another
+			worker, before planned host maintenance. This requires an engine that
+			supports migration, such as the QEMU engine.
+
+			Workers authenticate each other with TLS client certificates, all
+			workers must have a certificate signed by the CA in 'caCertificate', and
+			the certificate must be valid for the hostname other workers use to
+			reach this worker. The task, its temporary credentials and the state of
+			the sandbox are only sent over TLS.
+		`),
+		Properties: schematypes.Properties{
+			"port": schematypes.Integer{
+				Title: "Migration Port",
+				Description: util.Markdown(`
+					Port on which tasks migrated from other workers are accepted, this
+					is exposed on all interfaces.
+				`),
+				Minimum: 1,
+				Maximum: 65535,
+			},
+			"caCertificate": schematypes.String{
+				Title: "CA Certificate",
+				Description: util.Markdown(`
+					File with the PEM encoded CA certificate used to verify the
+					certificates of other workers.
+				`),
+			},
+			"certificate": schematypes.String{
+				Title: "Certificate",
+				Description: util.Markdown(`
+					File with the PEM encoded certificate for this worker, signed by the
+					CA, this is used both as server and client certificate.
+				`),
+			},
+			"key": schematypes.String{
+				Title: "Private Key",
+				Description: util.Markdown(`
+					File with the PEM encoded private key for 'certificate'.
+				`),
+			},
+		},
+		Required: []string{"port", "caCertificate", "certificate", "key"},
+	}
+}
+
+// loadMigrationTLS returns a TLS config for the migration server and client,
+// requiring peers to present a certificate signed by the CA.
+func loadMigrationTLS(c *migrationConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.Certificate, c.Key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to load migration certificate and key")
+	}
+	ca, err := ioutil.ReadFile(c.CACertificate)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read migration CA certificate: '%s'", c.CACertificate)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no PEM encoded certificates in migration CA certificate: '%s'", c.CACertificate)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+		ClientCAs:    pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// migrationRequest is the body for 'POST /v1/migrations', handing a task over
+// to the target host.
+type migrationRequest struct {
+	ProvisionerID string    `json:"provisionerId"`
+	WorkerType    string    `json:"workerType"`
+	Claim         taskClaim `json:"claim"`
+	State         []byte    `json:"state"`
+}
+
+// migrationResponse is the response for 'POST /v1/migrations'
+type migrationResponse struct {
+	MigrationID string `json:"migrationId"`
+}
+
+// migrationCommit is the body for 'POST /v1/migrations/<id>/commit', with the
+// latest credentials for the claim, as the source host may have reclaimed the
+// task while migrating.
+type migrationCommit struct {
+	Credentials tcclient.Credentials `json:"credentials"`
+	TakenUntil  tcclient.Time        `json:"takenUntil"`
+}
+
+// incomingMigration is a task being migrated from another host, it implements
+// engines.IncomingMigration.
+type incomingMigration struct {
+	id       string
+	state    []byte
+	streams  chan incomingStream
+	ready    atomics.Once // Done when the sandbox is waiting for the stream
+	resolved atomics.Once // Done when committed or aborted
+	m        sync.Mutex
+	loaded   bool             // True, if the engine has loaded the stream
+	commit   *migrationCommit // Set if committed, nil if aborted
+	logDrain io.Writer        // Task log, set before ready
+}
+
+type incomingStream struct {
+	stream io.Reader
+	done   chan<- error
+}
+
+func newIncomingMigration(state []byte) *incomingMigration {
+	return &incomingMigration{
+		id:      slugid.Nice(),
+		state:   state,
+		streams: make(chan incomingStream),
+	}
+}
+
+func (m *incomingMigration) State() []byte {
+	return m.state
+}
+
+func (m *incomingMigration) Receive() (io.Reader, func(error), error) {
+	select {
+	case s := <-m.streams:
+		return s.stream, func(err error) {
+			m.m.Lock()
+			m.loaded = err == nil
+			m.m.Unlock()
+			s.done <- err
+		}, nil
+	case <-m.resolved.Done():
+		return nil, nil, errMigrationAborted
+	}
+}
+
+func (m *incomingMigration) Committed() error {
+	<-m.resolved.Done()
+	if m.committed() == nil {
+		return errMigrationAborted
+	}
+	return nil
+}
+
+// committed returns the commit, if the migration was committed
+func (m *incomingMigration) committed() *migrationCommit {
+	m.m.Lock()
+	defer m.m.Unlock()
+	return m.commit
+}
+
+// commitWith commits the migration, this fails if the stream wasn't loaded,
+// or if the migration was aborted. Committing twice is allowed, so the source
+// host can retry, if it didn't get a response.
+func (m *incomingMigration) commitWith(c *migrationCommit) error {
+	m.m.Lock()
+	loaded := m.loaded
+	m.m.Unlock()
+	if !loaded {
+		return errors.New("migration cannot be committed before the stream is loaded")
+	}
+	m.resolved.Do(func() {
+		m.m.Lock()
+		m.commit = c
+		m.m.Unlock()
+	})
+	m.resolved.Wait()
+	if m.committed() == nil {
+		return errMigrationAborted
+	}
+	return nil
+}
+
+// abort the migration, unless it has been committed
+func (m *incomingMigration) abort() {
+	m.resolved.Do(nil)
+}
+
+// isAborted returns true, if the migration was aborted
+func (m *incomingMigration) isAborted() bool {
+	return m.resolved.IsDone() && m.committed() == nil
+}
+
+// migrationSet tracks incoming migrations by id, the zero-value is ready for
+// use.
+type migrationSet struct {
+	m          sync.Mutex
+	migrations map[string]*incomingMigration
+}
+
+func (s *migrationSet) add(m *incomingMigration) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.migrations == nil {
+		s.migrations = make(map[string]*incomingMigration)
+	}
+	s.migrations[m.id] = m
+}
+
+func (s *migrationSet) get(id string) *incomingMigration {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.migrations[id]
+}
+
+func (s *migrationSet) remove(m *incomingMigration) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.migrations, m.id)
+}
+
+// startMigrationServer starts accepting migrations on port, requiring TLS
+// client certificates. The server is stopped when the worker is disposed.
+func (w *Worker) startMigrationServer(port int) error {
+	listener, err := tls.Listen("tcp", fmt.Sprintf(":%d", port), w.migrationTLS)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on port %d for migrations", port)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/migrations", w.handleMigrationRequest)
+	mux.HandleFunc("/v1/migrations/", w.handleMigration)
+	w.migrationServer = &http.Server{Handler: mux}
+	go func() {
+		err := w.migrationServer.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			w.monitor.ReportError(err, "migration server failed")
+		}
+	}()
+	return nil
+}
+
+// handleMigrationRequest handles 'POST /v1/migrations', the task is processed
+// as if claimed, but the sandbox waits for the stream from the source host,
+// and the resolution is discarded unless the migration is committed.
+func (w *Worker) handleMigrationRequest(rw http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var req migrationRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(rw, http.StatusBadRequest, map[string]string{
+			"message": fmt.Sprintf("invalid migration request, error: %s", err),
+		})
+		return
+	}
+	if req.ProvisionerID != w.options.ProvisionerID || req.WorkerType != w.options.WorkerType {
+		writeJSON(rw, http.StatusBadRequest, map[string]string{
+			"message": fmt.Sprintf(
+				"tasks can only be migrated between workers of the same workerType, this worker is %s/%s",
+				w.options.ProvisionerID, w.options.WorkerType,
+			),
+		})
+		return
+	}
+	if !w.engine.Capabilities().Migration {
+		writeJSON(rw, http.StatusBadRequest, map[string]string{
+			"message": "the engine on this worker doesn't support migration",
+		})
+		return
+	}
+	w.health.m.Lock()
+	healthErr := w.health.err
+	w.health.m.Unlock()
+	if w.lifeCycleTracker.StoppingGracefully.IsDone() || healthErr != nil {
+		writeJSON(rw, http.StatusServiceUnavailable, map[string]string{
+			"message": "worker is stopping or unhealthy, and doesn't accept tasks",
+		})
+		return
+	}
+	if w.activeTasks.Value() >= w.options.Concurrency {
+		writeJSON(rw, http.StatusServiceUnavailable, map[string]string{
+			"message": "worker is running the maximum number of tasks",
+		})
+		return
+	}
+
+	m := newIncomingMigration(req.State)
+	w.migrations.add(m)
+	w.activeTasks.Increment()
+	go w.processClaim(req.Claim, m)
+
+	// Wait for the sandbox to be started, it'll then wait for the stream
+	select {
+	case <-m.ready.Done():
+		writeJSON(rw, http.StatusOK, migrationResponse{MigrationID: m.id})
+	case <-m.resolved.Done():
+		writeJSON(rw, http.StatusInternalServerError, map[string]string{
+			"message": "failed to start sandbox for the task, see worker logs on the target host",
+		})
+	}
+}
+
+// handleMigration handles requests for '/v1/migrations/<id>/...' to stream the
+// sandbox and task log, and to commit or abort the migration.
+func (w *Worker) handleMigration(rw http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/migrations/"), "/")
+	m := w.migrations.get(parts[0])
+	if m == nil || !m.ready.IsDone() {
+		writeJSON(rw, http.StatusNotFound, map[string]string{
+			"message": fmt.Sprintf("migration '%s' doesn't exist", parts[0]),
+		})
+		return
+	}
+
+	switch {
+	case len(parts) == 1 && r.Method == http.MethodDelete:
+		m.abort()
+		if m.isAborted() {
+			writeJSON(rw, http.StatusOK, map[string]string{})
+		} else {
+			writeJSON(rw, http.StatusConflict, map[string]string{
+				"message": "migration has been committed",
+			})
+		}
+	case len(parts) == 2 && parts[1] == "stream" && r.Method == http.MethodPut:
+		done := make(chan error, 1)
+		select {
+		case m.streams <- incomingStream{stream: r.Body, done: done}:
+		case <-m.resolved.Done():
+			writeJSON(rw, http.StatusConflict, map[string]string{
+				"message": "migration has been aborted",
+			})
+			return
+		}
+		if err := <-done; err != nil {
+			writeJSON(rw, http.StatusInternalServerError, map[string]string{
+				"message": fmt.Sprintf("failed to load sandbox, error: %s", err),
+			})
+			return
+		}
+		writeJSON(rw, http.StatusOK, map[string]string{})
+	case len(parts) == 2 && parts[1] == "log" && r.Method == http.MethodPut:
+		// Copy until the log is closed on the source host, or if aborted
+		_, err := io.Copy(&migrationLogWriter{migration: m}, r.Body)
+		if err != nil {
+			writeJSON(rw, http.StatusConflict, map[string]string{
+				"message": fmt.Sprintf("failed to write task log, error: %s", err),
+			})
+			return
+		}
+		writeJSON(rw, http.StatusOK, map[string]string{})
+	case len(parts) == 2 && parts[1] == "commit" && r.Method == http.MethodPost:
+		var c migrationCommit
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			writeJSON(rw, http.StatusBadRequest, map[string]string{
+				"message": fmt.Sprintf("invalid commit request, error: %s", err),
+			})
+			return
+		}
+		if err := m.commitWith(&c); err != nil {
+			writeJSON(rw, http.StatusConflict, map[string]string{
+				"message": err.Error(),
+			})
+			return
+		}
+		writeJSON(rw, http.StatusOK, map[string]string{})
+	default:
+		rw.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// migrationLogWriter writes the task log from the source host to the task log
+// for an incoming migration, failing if the migration is aborted.
+type migrationLogWriter struct {
+	migration *incomingMigration
+}
+
+func (w *migrationLogWriter) Write(p []byte) (int, error) {
+	if w.migration.isAborted() {
+		return 0, errMigrationAborted
+	}
+	return w.migration.logDrain.Write(p)
+}
+
+// receiveTask starts the sandbox for a task migrated from another host, and
+// waits for the migration to be committed. If the migration is aborted the
+// TaskRun is aborted with MigrationAborted and nil is returned.
+func (w *Worker) receiveTask(run *taskrun.TaskRun, m *incomingMigration) *migrationCommit {
+	m.logDrain = run.LogDrain()
+	run.RunToStage(taskrun.StageStart)
+	if run.Stage() == "resolved" {
+		m.abort()
+		run.Abort(taskrun.MigrationAborted)
+		return nil
+	}
+	m.ready.Do(nil)
+
+	select {
+	case <-m.resolved.Done():
+	case <-time.After(maxMigrationDuration):
+		m.abort()
+	case <-w.lifeCycleTracker.StoppingNow.Done():
+		m.abort()
+	}
+	commit := m.committed()
+	if commit == nil {
+		run.Abort(taskrun.MigrationAborted)
+	}
+	return commit
+}
@@ -0,0 +1,219 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	tcclient "github.com/taskcluster/taskcluster-client-go"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/worker/taskrun"
+)
+
+// migrationRequestTimeout is the timeout for requests to commit or abort a
+// migration, other requests are bounded by maxMigrationDuration on the target.
+const migrationRequestTimeout = 60 * time.Second
+
+// migrationCommitAttempts is the number of attempts to commit a migration, if
+// the target can't be reached. Commits are idempotent, and if the target can't
+// be reached execution resumes on this host, so we must try hard.
+const migrationCommitAttempts = 3
+
+// migrationClient hands a task over to the worker on the target host, it
+// implements engines.MigrationTarget.
+type migrationClient struct {
+	client  *http.Client
+	baseURL string
+	request migrationRequest
+	state   *claimState
+	run     *taskrun.TaskRun
+	monitor runtime.Monitor
+	id      string
+	m       sync.Mutex
+	stopLog func() // Stops streaming the task log, if started
+}
+
+// newMigrationClient returns a client for migrating the task given by claim to
+// the worker at target given as 'host:port'.
+func (w *Worker) newMigrationClient(
+	target string, claim taskClaim, state *claimState, run *taskrun.TaskRun, monitor runtime.Monitor,
+) (*migrationClient, error) {
+	if w.migrationTLS == nil {
+		return nil, errors.New("migration isn't configured on this worker")
+	}
+	host, _, err := net.SplitHostPort(target)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid migration target '%s', expected 'host:port'", target)
+	}
+	config := w.migrationTLS.Clone()
+	config.ServerName = host
+	return &migrationClient{
+		client: &http.Client{Transport: &http.Transport{
+			TLSClientConfig:     config,
+			TLSHandshakeTimeout: 30 * time.Second,
+		}},
+		baseURL: fmt.Sprintf("https://%s/v1/migrations", target),
+		request: migrationRequest{
+			ProvisionerID: w.options.ProvisionerID,
+			WorkerType:    w.options.WorkerType,
+			Claim:         claim,
+		},
+		state:   state,
+		run:     run,
+		monitor: monitor,
+		stopLog: func() {},
+	}, nil
+}
+
+// do sends a request and parses the JSON response into result, if not nil. An
+// error is returned, if the target doesn't respond 200, status is zero if the
+// target didn't respond.
+func (c *migrationClient) do(req *http.Request, result interface{}) (status int, err error) {
+	res, err := c.client.Do(req)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to reach target host")
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed to read response from target host")
+	}
+	if res.StatusCode != http.StatusOK {
+		var e struct {
+			Message string `json:"message"`
+		}
+		_ = json.Unmarshal(data, &e)
+		return res.StatusCode, fmt.Errorf("target host responded %d, message: %s", res.StatusCode, e.Message)
+	}
+	if result != nil {
+		if err = json.Unmarshal(data, result); err != nil {
+			return res.StatusCode, errors.Wrap(err, "failed to parse response from target host")
+		}
+	}
+	return res.StatusCode, nil
+}
+
+func (c *migrationClient) Prepare(state []byte) error {
+	creds, takenUntil := c.state.current()
+	req := c.request
+	req.Claim.Credentials.ClientID = creds.ClientID
+	req.Claim.Credentials.AccessToken = creds.AccessToken
+	req.Claim.Credentials.Certificate = creds.Certificate
+	req.Claim.TakenUntil = tcclient.Time(takenUntil)
+	req.State = state
+	data, err := json.Marshal(req)
+	if err != nil {
+		panic(errors.Wrap(err, "failed to serialize migration request"))
+	}
+
+	r, _ := http.NewRequest(http.MethodPost, c.baseURL, bytes.NewReader(data))
+	r.Header.Set("Content-Type", "application/json")
+	var result migrationResponse
+	if _, err = c.do(r, &result); err != nil {
+		return err
+	}
+	c.id = result.MigrationID
+
+	// Stream the task log to the target, until the log is closed on this host,
+	// such that the task log on the target host is complete
+	log, err := c.run.NewLogReader()
+	if err != nil {
+		c.Abort()
+		return errors.Wrap(err, "failed to read task log")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	c.m.Lock()
+	c.stopLog = cancel
+	c.m.Unlock()
+	go func() {
+		r, _ := http.NewRequest(http.MethodPut, c.baseURL+"/"+c.id+"/log", log)
+		if _, err := c.do(r.WithContext(ctx), nil); err != nil && ctx.Err() == nil {
+			c.monitor.Warn("failed to stream task log to target host, error: ", err)
+		}
+	}()
+	return nil
+}
+
+// migrationStream is the stream returned by Transfer(), Close() returns the
+// result of loading the stream on the target host.
+type migrationStream struct {
+	*io.PipeWriter
+	done <-chan error
+}
+
+func (s *migrationStream) Close() error {
+	s.PipeWriter.Close()
+	return <-s.done
+}
+
+func (c *migrationClient) Transfer() (io.WriteCloser, error) {
+	reader, writer := io.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		// The request body is closed by the client, also if the request fails,
+		// so writes to the stream won't block if the target is unreachable
+		r, _ := http.NewRequest(http.MethodPut, c.baseURL+"/"+c.id+"/stream", reader)
+		r.Header.Set("Content-Type", "application/octet-stream")
+		_, err := c.do(r, nil)
+		done <- err
+	}()
+	return &migrationStream{PipeWriter: writer, done: done}, nil
+}
+
+func (c *migrationClient) Commit() error {
+	creds, takenUntil := c.state.current()
+	data, err := json.Marshal(migrationCommit{
+		Credentials: *creds,
+		TakenUntil:  tcclient.Time(takenUntil),
+	})
+	if err != nil {
+		panic(errors.Wrap(err, "failed to serialize migration commit"))
+	}
+
+	// Retry if the target didn't respond, as it may have committed
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), migrationRequestTimeout)
+		r, _ := http.NewRequest(http.MethodPost, c.baseURL+"/"+c.id+"/commit", bytes.NewReader(data))
+		r.Header.Set("Content-Type", "application/json")
+		var status int
+		status, err = c.do(r.WithContext(ctx), nil)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if status != 0 || attempt >= migrationCommitAttempts {
+			break
+		}
+		c.monitor.Warn("failed to commit migration, retrying, error: ", err)
+		time.Sleep(5 * time.Second)
+	}
+	c.stopLogging()
+	return err
+}
+
+func (c *migrationClient) Abort() {
+	c.stopLogging()
+	ctx, cancel := context.WithTimeout(context.Background(), migrationRequestTimeout)
+	defer cancel()
+	r, _ := http.NewRequest(http.MethodDelete, c.baseURL+"/"+c.id, nil)
+	if _, err := c.do(r.WithContext(ctx), nil); err != nil {
+		// The target aborts the migration, if not committed in time
+		c.monitor.Warn("failed to abort migration on target host, error: ", err)
+	}
+}
+
+// stopLogging stops streaming the task log to the target
+func (c *migrationClient) stopLogging() {
+	c.m.Lock()
+	stop := c.stopLog
+	c.m.Unlock()
+	stop()
+}
@@ -0,0 +1,160 @@
+package worker
+
+import (
+	"math/rand"
+	"sort"
+	"time"
+
+	schematypes "github.com/taskcluster/go-schematypes"
+	"github.com/taskcluster/taskcluster-client-go/tcqueue"
+	"github.com/taskcluster/taskcluster-worker/runtime/util"
+)
+
+// queueOption is a (provisionerId, workerType) pair to claim tasks from
+type queueOption struct {
+	ProvisionerID string `json:"provisionerId"`
+	WorkerType    string `json:"workerType"`
+	Priority      int    `json:"priority"`
+	Weight        int    `json:"weight"`
+}
+
+var additionalQueuesSchema = schematypes.Array{
+	Title: "Additional Queues",
+	Description: util.Markdown(`
+		Additional (provisionerId, workerType) pairs to claim tasks from, this is
+		useful for heterogeneous hardware where dedicating machines to a single
+		workerType would waste capacity.
+
+		Tasks are claimed from queues with higher 'priority' first, the queue
+		given by 'provisionerId' and 'workerType' has priority zero. Queues with
+		equal priority are claimed from in random order, chosen proportionally to
+		'weight', which defaults to 1.
+
+		Notice, that plugins and engines will still see the 'provisionerId' and
+		'workerType' from the top-level options.
+	`),
+	Items: schematypes.Object{
+		Properties: schematypes.Properties{
+			"provisionerId": schematypes.String{
+				Title:   "ProvisionerId",
+				Pattern: `^[a-zA-Z0-9_-]{1,22}$`,
+			},
+			"workerType": schematypes.String{
+				Title:   "WorkerType",
+				Pattern: `^[a-zA-Z0-9_-]{1,22}$`,
+			},
+			"priority": schematypes.Integer{
+				Title:       "Priority",
+				Description: "Queues with higher priority are claimed from first.",
+				Minimum:     -1000,
+				Maximum:     1000,
+			},
+			"weight": schematypes.Integer{
+				Title:       "Weight",
+				Description: "Relative weight among queues with the same priority.",
+				Minimum:     1,
+				Maximum:     1000,
+			},
+		},
+		Required: []string{"provisionerId", "workerType"},
+	},
+}
+
+// queueOrder returns the queues to claim from in the order they should be
+// claimed from.
+func (o *options) queueOrder() []queueOption {
+	queues := append([]queueOption{{
+		ProvisionerID: o.ProvisionerID,
+		WorkerType:    o.WorkerType,
+	}}, o.AdditionalQueues...)
+
+	// Weighted shuffle by sorting on random keys scaled by weight, followed by a
+	// stable sort on priority
+	keys := make([]float64, len(queues))
+	order := make([]int, len(queues))
+	for i, q := range queues {
+		weight := q.Weight
+		if weight <= 0 {
+			weight = 1
+		}
+		keys[i] = rand.ExpFloat64() / float64(weight)
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return keys[order[i]] < keys[order[j]]
+	})
+	result := make([]queueOption, len(queues))
+	for i, index := range order {
+		result[i] = queues[index]
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Priority > result[j].Priority
+	})
+	return result
+}
+
+// claimWork claims up to N tasks from the queues in order, returns the claims
+// and the first error encountered, if any.
+//
+// The queue long-polls claimWork requests for about 20 seconds, if no tasks are
+// pending. Hence, with multiple queues we only claim from queues with pending
+// tasks, see pendingQueues().
+func (w *Worker) claimWork(N int) ([]taskClaim, error) {
+	queues := w.options.queueOrder()
+	if len(queues) > 1 {
+		queues = w.pendingQueues(queues)
+	}
+
+	var claims []taskClaim
+	var firstErr error
+	for _, q := range queues {
+		if N-len(claims) <= 0 {
+			break
+		}
+		debug("queue.claimWork(%s, %s) with capacity: %d", q.ProvisionerID, q.WorkerType, N-len(claims))
+		before := time.Now()
+		result, err := w.queue.ClaimWork(q.ProvisionerID, q.WorkerType, &tcqueue.ClaimWorkRequest{
+			WorkerGroup: w.options.WorkerGroup,
+			WorkerID:    w.options.WorkerID,
+			Tasks:       int64(N - len(claims)),
+		})
+		after := time.Now()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		for _, claim := range result.Tasks {
+			// The run was started by the queue when claimed, so we can use it to
+			// detect clock skew
+			if int(claim.RunID) < len(claim.Status.Runs) {
+				started := time.Time(claim.Status.Runs[claim.RunID].Started)
+				w.skew.observe(w.monitor, started, before, after)
+			}
+			claims = append(claims, taskClaim(claim))
+		}
+	}
+	return claims, firstErr
+}
+
+// pendingQueues returns the queues that have pending tasks, or the first queue
+// if none of them have pending tasks, such that we long-poll at most one queue.
+// Queues for which pending tasks can't be counted are assumed to have pending
+// tasks, as claimWork will report the error.
+func (w *Worker) pendingQueues(queues []queueOption) []queueOption {
+	var pending []queueOption
+	for _, q := range queues {
+		result, err := w.queue.PendingTasks(q.ProvisionerID, q.WorkerType)
+		if err != nil {
+			debug("queue.pendingTasks(%s, %s) failed, error: %s", q.ProvisionerID, q.WorkerType, err)
+		}
+		if err != nil || result.PendingTasks > 0 {
+			pending = append(pending, q)
+		}
+	}
+	if len(pending) == 0 {
+		return queues[:1]
+	}
+	return pending
+}
@@ -0,0 +1,78 @@
+package worker
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-client-go/tcqueue"
+	"github.com/taskcluster/taskcluster-worker/runtime/client"
+)
+
+func TestQueueOrder(t *testing.T) {
+	o := options{
+		ProvisionerID: "my-provisioner",
+		WorkerType:    "primary",
+		AdditionalQueues: []queueOption{
+			{ProvisionerID: "my-provisioner", WorkerType: "low", Priority: -1},
+			{ProvisionerID: "my-provisioner", WorkerType: "high", Priority: 5},
+			{ProvisionerID: "my-provisioner", WorkerType: "heavy", Weight: 1000},
+		},
+	}
+
+	heavyFirst := 0
+	for i := 0; i < 100; i++ {
+		queues := o.queueOrder()
+		require.Len(t, queues, 4)
+		require.Equal(t, "high", queues[0].WorkerType)
+		require.Equal(t, "low", queues[3].WorkerType)
+		if queues[1].WorkerType == "heavy" {
+			heavyFirst++
+		}
+	}
+	require.True(t, heavyFirst > 50, "expected heavy weight to be claimed from first most of the time")
+}
+
+func TestWorkerClaimWorkPendingQueues(t *testing.T) {
+	pending := func(q *client.MockQueue, workerType string, count int64) {
+		q.On("PendingTasks", "my-provisioner", workerType).Return(
+			&tcqueue.CountPendingTasksResponse{PendingTasks: count}, nil,
+		)
+	}
+	claimWork := func(q *client.MockQueue, workerType string) {
+		q.On("ClaimWork", "my-provisioner", workerType, mock.Anything).Return(
+			&tcqueue.ClaimWorkResponse{}, nil,
+		)
+	}
+	o := options{
+		ProvisionerID: "my-provisioner",
+		WorkerType:    "primary",
+		AdditionalQueues: []queueOption{
+			{ProvisionerID: "my-provisioner", WorkerType: "high", Priority: 5},
+		},
+	}
+
+	t.Run("claim from queues with pending tasks", func(t *testing.T) {
+		q := &client.MockQueue{}
+		pending(q, "high", 0)
+		pending(q, "primary", 3)
+		claimWork(q, "primary")
+		w := &Worker{queue: q, options: o}
+		_, err := w.claimWork(2)
+		require.NoError(t, err)
+		q.AssertExpectations(t)
+		q.AssertNotCalled(t, "ClaimWork", "my-provisioner", "high", mock.Anything)
+	})
+
+	t.Run("long-poll first queue, if no tasks are pending", func(t *testing.T) {
+		q := &client.MockQueue{}
+		pending(q, "high", 0)
+		pending(q, "primary", 0)
+		claimWork(q, "high")
+		w := &Worker{queue: q, options: o}
+		_, err := w.claimWork(2)
+		require.NoError(t, err)
+		q.AssertExpectations(t)
+		q.AssertNotCalled(t, "ClaimWork", "my-provisioner", "primary", mock.Anything)
+	})
+}
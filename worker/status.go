@@ -0,0 +1,309 @@
+package worker
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	goruntime "runtime"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/shirou/gopsutil/disk"
+	"github.com/shirou/gopsutil/process"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/worker/taskrun"
+)
+
+// maxRecentErrors is the number of errors/warnings kept for status reports
+const maxRecentErrors = 10
+
+// Status is the status of a running worker, as reported by the control API
+type Status struct {
+	WorkerGroup  string          `json:"workerGroup"`
+	WorkerID     string          `json:"workerId"`
+	Started      time.Time       `json:"started"`
+	Uptime       string          `json:"uptime"`
+	Stopping     bool            `json:"stopping"`
+	Healthy      bool            `json:"healthy"`
+	HealthError  string          `json:"healthError,omitempty"`
+	ClaimedTasks int             `json:"claimedTasks"`
+	ActiveTasks  []TaskStatus    `json:"activeTasks"`
+	Resources    ResourceStatus  `json:"resources"`
+	RecentErrors []ErrorReported `json:"recentErrors"`
+}
+
+// TaskStatus is the status of a task being processed
+type TaskStatus struct {
+	TaskID  string    `json:"taskId"`
+	RunID   int       `json:"runId"`
+	Stage   string    `json:"stage"`
+	Started time.Time `json:"started"`
+}
+
+// ResourceStatus holds resource usage of the worker process and host
+type ResourceStatus struct {
+	MemoryRSS      uint64  `json:"memoryRss"`
+	Goroutines     int     `json:"goroutines"`
+	DiskFree       uint64  `json:"diskFree"`
+	DiskTotal      uint64  `json:"diskTotal"`
+	CPUUserSeconds float64 `json:"cpuUserSeconds"`
+	CPUSysSeconds  float64 `json:"cpuSystemSeconds"`
+}
+
+// ErrorReported is an error or warning reported by the worker, engine or
+// plugins.
+type ErrorReported struct {
+	Time       time.Time `json:"time"`
+	Level      string    `json:"level"`
+	Message    string    `json:"message"`
+	IncidentID string    `json:"incidentId,omitempty"`
+}
+
+// activeTask tracks a task being processed
+type activeTask struct {
+	run     *taskrun.TaskRun
+	taskID  string
+	runID   int
+	started time.Time
+	claim   taskClaim   // Claim for the task, used when migrating the task
+	state   *claimState // Latest credentials for the claim
+}
+
+// statusTracker tracks state for status reports, the zero-value is ready for
+// use.
+type statusTracker struct {
+	m            sync.Mutex
+	started      time.Time
+	claimed      int
+	tasks        map[*taskrun.TaskRun]activeTask
+	recentErrors []ErrorReported
+}
+
+// addClaimed increments the number of tasks claimed and returns the total
+func (s *statusTracker) addClaimed(n int) int {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.claimed += n
+	return s.claimed
+}
+
+func (s *statusTracker) addTask(run *taskrun.TaskRun, claim taskClaim, state *claimState) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	if s.tasks == nil {
+		s.tasks = make(map[*taskrun.TaskRun]activeTask)
+	}
+	s.tasks[run] = activeTask{
+		run:     run,
+		taskID:  claim.Status.TaskID,
+		runID:   int(claim.RunID),
+		started: time.Now(),
+		claim:   claim,
+		state:   state,
+	}
+}
+
+func (s *statusTracker) removeTask(run *taskrun.TaskRun) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	delete(s.tasks, run)
+}
+
+func (s *statusTracker) recordError(level string, err error, message []interface{}, incidentID string) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	msg := fmt.Sprint(message...)
+	if err != nil {
+		if msg != "" {
+			msg += ": "
+		}
+		msg += err.Error()
+	}
+	s.recentErrors = append(s.recentErrors, ErrorReported{
+		Time:       time.Now(),
+		Level:      level,
+		Message:    msg,
+		IncidentID: incidentID,
+	})
+	if len(s.recentErrors) > maxRecentErrors {
+		s.recentErrors = s.recentErrors[len(s.recentErrors)-maxRecentErrors:]
+	}
+}
+
+// statusMonitor wraps a runtime.Monitor recording errors and warnings for
+// status reports.
+type statusMonitor struct {
+	runtime.Monitor
+	tracker *statusTracker
+}
+
+func (m *statusMonitor) ReportError(err error, message ...interface{}) string {
+	incidentID := m.Monitor.ReportError(err, message...)
+	m.tracker.recordError("error", err, message, incidentID)
+	return incidentID
+}
+
+func (m *statusMonitor) ReportWarning(err error, message ...interface{}) string {
+	incidentID := m.Monitor.ReportWarning(err, message...)
+	m.tracker.recordError("warning", err, message, incidentID)
+	return incidentID
+}
+
+func (m *statusMonitor) CapturePanic(fn func()) string {
+	incidentID := m.Monitor.CapturePanic(fn)
+	if incidentID != "" {
+		m.tracker.recordError("panic", nil, []interface{}{"panic captured"}, incidentID)
+	}
+	return incidentID
+}
+
+func (m *statusMonitor) WithTags(tags map[string]string) runtime.Monitor {
+	return &statusMonitor{Monitor: m.Monitor.WithTags(tags), tracker: m.tracker}
+}
+
+func (m *statusMonitor) WithTag(key, value string) runtime.Monitor {
+	return &statusMonitor{Monitor: m.Monitor.WithTag(key, value), tracker: m.tracker}
+}
+
+func (m *statusMonitor) WithPrefix(prefix string) runtime.Monitor {
+	return &statusMonitor{Monitor: m.Monitor.WithPrefix(prefix), tracker: m.tracker}
+}
+
+// Status returns the current status of the worker
+func (w *Worker) Status() Status {
+	s := Status{
+		WorkerGroup:  w.options.WorkerGroup,
+		WorkerID:     w.options.WorkerID,
+		Stopping:     w.lifeCycleTracker.StoppingGracefully.IsDone(),
+		ActiveTasks:  []TaskStatus{},
+		RecentErrors: []ErrorReported{},
+	}
+	w.health.m.Lock()
+	s.Healthy = w.health.err == nil
+	if w.health.err != nil {
+		s.HealthError = w.health.err.Error()
+	}
+	w.health.m.Unlock()
+
+	w.status.m.Lock()
+	s.Started = w.status.started
+	s.ClaimedTasks = w.status.claimed
+	for _, t := range w.status.tasks {
+		s.ActiveTasks = append(s.ActiveTasks, TaskStatus{
+			TaskID:  t.taskID,
+			RunID:   t.runID,
+			Stage:   t.run.Stage(),
+			Started: t.started,
+		})
+	}
+	s.RecentErrors = append(s.RecentErrors, w.status.recentErrors...)
+	w.status.m.Unlock()
+	if !s.Started.IsZero() {
+		s.Uptime = (time.Since(s.Started) / time.Second * time.Second).String()
+	}
+
+	// Resource usage
+	s.Resources.Goroutines = goruntime.NumGoroutine()
+	if p, err := process.NewProcess(int32(os.Getpid())); err == nil {
+		if mem, err := p.MemoryInfo(); err == nil {
+			s.Resources.MemoryRSS = mem.RSS
+		}
+		if t, err := p.Times(); err == nil {
+			s.Resources.CPUUserSeconds = t.User
+			s.Resources.CPUSysSeconds = t.System
+		}
+	}
+	if stat, err := disk.Usage(w.temporaryFolder); err == nil {
+		s.Resources.DiskFree = stat.Free
+		s.Resources.DiskTotal = stat.Total
+	}
+	return s
+}
+
+// writeControlToken generates a random token for the control API and writes
+// it to file, which is only readable by the current user.
+func writeControlToken(file string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "failed to generate control API token")
+	}
+	token := hex.EncodeToString(b)
+
+	// Remove any existing file, so we don't inherit its permissions or owner
+	if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+		return "", errors.Wrapf(err, "failed to remove existing control API token file: '%s'", file)
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to create control API token file: '%s'", file)
+	}
+	if _, err = f.WriteString(token); err != nil {
+		f.Close()
+		return "", errors.Wrapf(err, "failed to write control API token file: '%s'", file)
+	}
+	if err = f.Close(); err != nil {
+		return "", errors.Wrapf(err, "failed to write control API token file: '%s'", file)
+	}
+	return token, nil
+}
+
+// requireToken wraps handler such that requests must have the header
+// 'Authorization: Bearer <token>'.
+func requireToken(token string, handler http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			rw.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(rw, http.StatusUnauthorized, map[string]string{
+				"message": "control API requires the token from 'controlTokenFile'",
+			})
+			return
+		}
+		handler.ServeHTTP(rw, r)
+	})
+}
+
+// startControlServer starts the control API on localhost:port, requiring
+// requests to have the given token. The server is stopped when the worker is
+// disposed.
+func (w *Worker) startControlServer(port int, token string) error {
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on localhost:%d for control API", port)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			rw.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		writeJSON(rw, http.StatusOK, w.Status())
+	})
+	mux.HandleFunc("/gc", w.handleCollectGarbage)
+	mux.HandleFunc("/drain", w.handleDrain)
+	w.controlServer = &http.Server{Handler: requireToken(token, mux)}
+	go func() {
+		err := w.controlServer.Serve(listener)
+		if err != nil && err != http.ErrServerClosed {
+			w.monitor.ReportError(err, "control API server failed")
+		}
+	}()
+	return nil
+}
+
+// writeJSON writes status and value as JSON to the ResponseWriter
+func writeJSON(rw http.ResponseWriter, status int, value interface{}) {
+	data, err := json.MarshalIndent(value, "", "  ")
+	if err != nil {
+		panic(errors.Wrap(err, "failed to serialize JSON response"))
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	_, _ = rw.Write(data)
+}
@@ -0,0 +1,72 @@
+package worker
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	goruntime "runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/runtime/mocks"
+)
+
+func TestStatusMonitorRecordsErrors(t *testing.T) {
+	var tracker statusTracker
+	monitor := &statusMonitor{Monitor: mocks.NewMockMonitor(false), tracker: &tracker}
+
+	monitor.WithPrefix("engine").ReportWarning(errors.New("disk is slow"), "warning")
+	require.Len(t, tracker.recentErrors, 1)
+	require.Equal(t, "warning", tracker.recentErrors[0].Level)
+	require.Equal(t, "warning: disk is slow", tracker.recentErrors[0].Message)
+
+	for i := 0; i < 2*maxRecentErrors; i++ {
+		monitor.WithTag("i", fmt.Sprint(i)).ReportError(fmt.Errorf("error %d", i))
+	}
+	require.Len(t, tracker.recentErrors, maxRecentErrors)
+	require.Equal(t, "error", tracker.recentErrors[0].Level)
+	require.Equal(t, fmt.Sprintf("error %d", 2*maxRecentErrors-1), tracker.recentErrors[maxRecentErrors-1].Message)
+}
+
+func TestControlToken(t *testing.T) {
+	folder, err := ioutil.TempDir("", "tc-worker-control-")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+
+	// Existing files are replaced, so we don't inherit permissions
+	file := filepath.Join(folder, "control.token")
+	require.NoError(t, ioutil.WriteFile(file, []byte("old-token"), 0644))
+	token, err := writeControlToken(file)
+	require.NoError(t, err)
+	require.Len(t, token, 64)
+	data, err := ioutil.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, token, string(data))
+	if goruntime.GOOS != "windows" {
+		info, serr := os.Stat(file)
+		require.NoError(t, serr)
+		require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	}
+
+	handler := requireToken(token, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.WriteHeader(http.StatusOK)
+	}))
+	for _, header := range []string{"", "Bearer old-token", token, "Bearer " + token + "x"} {
+		req := httptest.NewRequest(http.MethodGet, "/status", nil)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		rw := httptest.NewRecorder()
+		handler.ServeHTTP(rw, req)
+		require.Equal(t, http.StatusUnauthorized, rw.Code, "expected %q to be rejected", header)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/status", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusOK, rw.Code)
+}
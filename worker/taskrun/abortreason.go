@@ -10,4 +10,12 @@ const (
 	// TaskCanceled is used to abort a TaskRun when the queue reports that the
 	// task has been canceled, deadline exceeded or claim expired.
 	TaskCanceled
+	// DeadlineExceeded is used to abort a TaskRun shortly before the task
+	// deadline, such that logs and artifacts can be uploaded before the queue
+	// resolves the task deadline-exceeded.
+	DeadlineExceeded
+	// MigrationAborted is used to abort a TaskRun created for a task migrated
+	// from another host, when the migration is aborted. The TaskRun is discarded
+	// as the task continues on the source host.
+	MigrationAborted
 )
@@ -16,6 +16,9 @@ type Options struct {
 	TaskInfo      runtime.TaskInfo
 	Payload       map[string]interface{}
 	Queue         client.Queue
+	// Migration is given to the engine, if the task is migrated from another
+	// host, see engines.SandboxOptions.
+	Migration engines.IncomingMigration
 }
 
 // mustBeValid panics if Options contains empty values, this allows us to catch
@@ -69,16 +69,9 @@ func prepare(t *TaskRun) error {
 	}
 
 	// Validate payload against schema
-	verr := payloadSchema.Validate(t.payload)
-	if e, ok := verr.(*schematypes.ValidationError); ok {
-		issues := e.Issues("task.payload")
-		errs := make([]*runtime.MalformedPayloadError, len(issues))
-		for i, issue := range issues {
-			errs[i] = runtime.NewMalformedPayloadError(issue.String())
-		}
-		verr = runtime.MergeMalformedPayload(errs...)
-	} else if verr != nil {
-		verr = runtime.NewMalformedPayloadError("task.payload schema violation: ", verr)
+	var verr error
+	if e := ValidatePayload(payloadSchema, t.payload); e != nil {
+		verr = e
 	}
 
 	var err1, err2 error
@@ -95,6 +88,8 @@ func prepare(t *TaskRun) error {
 				"taskId": t.taskInfo.TaskID,
 				"runId":  strconv.Itoa(t.taskInfo.RunID),
 			}),
+			TemporaryStorage: t.environment.TemporaryStorage,
+			Migration:        t.migration,
 		})
 	}, func() {
 		// Create TaskPlugin, even if we have schema validation error, how else
@@ -143,7 +138,10 @@ func started(t *TaskRun) error {
 func waiting(t *TaskRun) error {
 	var err error
 	t.resultSet, err = t.sandbox.WaitForResult()
+	// Lock as Migrate() may access the sandbox from another thread
+	t.m.Lock()
 	t.sandbox = nil
+	t.m.Unlock()
 	return err
 }
 
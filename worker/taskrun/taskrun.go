@@ -3,6 +3,8 @@ package taskrun
 import (
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"sync"
 
 	"github.com/taskcluster/taskcluster-worker/engines"
@@ -14,8 +16,9 @@ import (
 
 // A TaskRun holds the state of a running task.
 //
-// Methods on this object is not thread-safe, with the exception of Abort() and
-// SetQueueClient() which are intended to be called from other threads.
+// Methods on this object is not thread-safe, with the exception of Abort(),
+// Migrate() and SetQueueClient() which are intended to be called from other
+// threads.
 type TaskRun struct {
 	// Constants
 	environment   runtime.Environment
@@ -24,6 +27,7 @@ type TaskRun struct {
 	monitor       runtime.Monitor
 	taskInfo      runtime.TaskInfo
 	payload       map[string]interface{}
+	migration     engines.IncomingMigration
 
 	// TaskContext
 	taskContext *runtime.TaskContext
@@ -37,6 +41,7 @@ type TaskRun struct {
 	success   bool       // true, if task is completed successfully
 	exception bool       // true, if reason has a value
 	reason    runtime.ExceptionReason
+	discarded bool // true, if the task continues on another host
 
 	// Final error to return from Dispose()
 	fatalErr    atomics.Bool // If we've seen ErrFatalInternalError
@@ -61,6 +66,7 @@ func New(options Options) *TaskRun {
 		monitor:       options.Monitor,
 		taskInfo:      options.TaskInfo,
 		payload:       options.Payload,
+		migration:     options.Migration,
 	}
 	t.c.L = &t.m
 
@@ -106,6 +112,20 @@ func (t *TaskRun) Abort(reason AbortReason) {
 	t.m.Lock()
 	defer t.m.Unlock()
 
+	// The task continues on the source host, so the resolution is discarded,
+	// even if we already resolved as nothing must be reported or uploaded
+	if reason == MigrationAborted {
+		t.stage = stageResolved
+		t.success = false
+		t.exception = false
+		t.discarded = true
+		if t.controller != nil {
+			t.controller.Cancel()
+		}
+		t.c.Broadcast()
+		return
+	}
+
 	// If we are already resolved, we won't change the resolution
 	if t.stage == stageResolved {
 		debug("ignoring TaskRun.Abort() as TaskRun is resolved")
@@ -123,6 +143,8 @@ func (t *TaskRun) Abort(reason AbortReason) {
 		t.reason = runtime.ReasonWorkerShutdown
 	case TaskCanceled:
 		t.reason = runtime.ReasonCanceled
+	case DeadlineExceeded:
+		t.reason = runtime.ReasonDeadlineExceeded
 	default:
 		panic(fmt.Sprintf("Unknown AbortReason: %d", reason))
 	}
@@ -133,6 +155,18 @@ func (t *TaskRun) Abort(reason AbortReason) {
 	t.c.Broadcast()
 }
 
+// Stage returns the name of the next stage to be run, or "resolved" if the
+// TaskRun has been resolved.
+func (t *TaskRun) Stage() string {
+	t.m.Lock()
+	defer t.m.Unlock()
+
+	if t.stage == stageResolved {
+		return "resolved"
+	}
+	return t.stage.String()
+}
+
 // RunToStage will run all stages up-to and including the given stage.
 //
 // This will not rerun previous stages, the TaskRun structure always knows what
@@ -171,6 +205,16 @@ func (t *TaskRun) RunToStage(targetStage Stage) {
 		})
 		t.m.Lock()
 
+		// The task continues on another host, so the resolution is discarded,
+		// even if we've been cancelled as nothing must be reported or uploaded
+		if err == engines.ErrSandboxMigrated && incidentID == "" {
+			err = nil
+			t.stage = stageResolved
+			t.exception = false
+			t.success = false
+			t.discarded = true
+		}
+
 		// Handle errors
 		if err != nil || incidentID != "" {
 			reason := runtime.ReasonInternalError
@@ -229,6 +273,51 @@ func (t *TaskRun) WaitForResult() (success bool, exception bool, reason runtime.
 	return
 }
 
+// Discarded returns true, if the task was migrated to another host, or if the
+// migration of the task from another host was aborted. In either case the
+// resolution must not be reported, as the task continues on another host.
+func (t *TaskRun) Discarded() bool {
+	t.m.Lock()
+	defer t.m.Unlock()
+	return t.discarded
+}
+
+// Migrate moves the running sandbox to another host, see
+// engines.Sandbox.Migrate(). If this returns nil, the TaskRun is resolved as
+// discarded, and the task continues on the target host.
+//
+// This can only be called while waiting for the sandbox to be resolved.
+func (t *TaskRun) Migrate(target engines.MigrationTarget) error {
+	t.m.Lock()
+	sandbox := t.sandbox
+	if t.stage != StageWaiting || sandbox == nil {
+		t.m.Unlock()
+		return errors.New("only tasks waiting for execution to complete can be migrated")
+	}
+	t.m.Unlock()
+
+	// Don't hold the lock, as Migrate() blocks until the migration is done
+	return sandbox.Migrate(target)
+}
+
+// NewLogReader returns a reader for the task log from the beginning, this
+// blocks waiting for more data until the log is closed.
+func (t *TaskRun) NewLogReader() (io.ReadCloser, error) {
+	if t.taskContext == nil {
+		return nil, errors.New("TaskContext was never created")
+	}
+	return t.taskContext.NewLogReader()
+}
+
+// LogDrain returns a writer for the task log, this is used to write the log
+// from the source host when a task is migrated from another host.
+func (t *TaskRun) LogDrain() io.Writer {
+	if t.taskContext == nil {
+		return ioutil.Discard
+	}
+	return t.taskContext.LogDrain()
+}
+
 func (t *TaskRun) capturePanicAndError(stage string, fn func() error) {
 	monitor := t.monitor.WithTag("stage", stage)
 	var err error
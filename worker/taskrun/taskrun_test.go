@@ -378,4 +378,103 @@ func TestTaskRun(t *testing.T) {
 
 		require.NoError(t, run.Dispose(), "run.Dispose() returned an error")
 	})
+
+	t.Run("Abort deadline-exceeded", func(t *testing.T) {
+		var run *TaskRun
+		var ctx *runtime.TaskContext
+		plugin := &mockPlugin{}
+		plugin.On("PayloadSchema").Return(schematypes.Object{})
+		plugin.On("NewTaskPlugin", taskPluginOptions).Return(plugin, func(options plugins.TaskPluginOptions) error {
+			ctx = options.TaskContext
+			return nil
+		})
+		plugin.On("BuildSandbox", mockSandboxBuilder).Return(nil)
+		plugin.On("Started", mockSandbox).Return(func(engines.Sandbox) error {
+			assert.NotNil(t, ctx, "Expected TaskContext to be present")
+			assert.NoError(t, ctx.Err(), "TaskContext is already aborted!")
+			<-time.After(5 * time.Millisecond)
+			go run.Abort(DeadlineExceeded)
+			<-ctx.Done() // Wait for TaskContext to be resolved
+			return nil
+		})
+		plugin.On("Exception", runtime.ReasonDeadlineExceeded).Return(nil)
+		plugin.On("Dispose").Return(nil)
+		defer plugin.AssertExpectations(t)
+
+		require.NoError(t, json.Unmarshal([]byte(`{
+			"delay":    50,
+			"function": "true",
+			"argument": ""
+		}`), &options.Payload), "unable to parse payload")
+
+		run = New(options)
+		run.pluginManager = plugin // hack to inject mock for PluginManager
+		success, exception, reason := run.WaitForResult()
+		assert.False(t, success, "expected success to be false")
+		assert.True(t, exception, "expected exception to be true")
+		assert.Equal(t, runtime.ReasonDeadlineExceeded, reason, "expected deadline-exceeded")
+
+		require.NoError(t, run.Dispose(), "run.Dispose() returned an error")
+	})
+
+	t.Run("Abort migration-aborted", func(t *testing.T) {
+		plugin := &mockPlugin{}
+		plugin.On("PayloadSchema").Return(schematypes.Object{})
+		plugin.On("NewTaskPlugin", taskPluginOptions).Return(plugin, nil)
+		plugin.On("BuildSandbox", mockSandboxBuilder).Return(nil)
+		plugin.On("Dispose").Return(nil)
+		defer plugin.AssertExpectations(t)
+
+		require.NoError(t, json.Unmarshal([]byte(`{
+			"delay":    50,
+			"function": "true",
+			"argument": ""
+		}`), &options.Payload), "unable to parse payload")
+
+		run := New(options)
+		run.pluginManager = plugin // hack to inject mock for PluginManager
+		run.RunToStage(StageStart)
+		run.Abort(MigrationAborted)
+		success, exception, _ := run.WaitForResult()
+		assert.False(t, success, "expected success to be false")
+		assert.False(t, exception, "expected exception to be false")
+		assert.True(t, run.Discarded(), "expected the TaskRun to be discarded")
+
+		// Exception() must not be called, as the task continues on another host
+		require.NoError(t, run.Dispose(), "run.Dispose() returned an error")
+	})
+
+	t.Run("Migrate not supported", func(t *testing.T) {
+		var run *TaskRun
+		plugin := &mockPlugin{}
+		plugin.On("PayloadSchema").Return(schematypes.Object{})
+		plugin.On("NewTaskPlugin", taskPluginOptions).Return(plugin, nil)
+		plugin.On("BuildSandbox", mockSandboxBuilder).Return(nil)
+		plugin.On("Started", mockSandbox).Return(nil)
+		plugin.On("Stopped", mockResultSet).Return(func(result engines.ResultSet) bool {
+			return result.Success()
+		}, nil)
+		plugin.On("Finished", true).Return(nil)
+		plugin.On("Dispose").Return(nil)
+		defer plugin.AssertExpectations(t)
+
+		require.NoError(t, json.Unmarshal([]byte(`{
+			"delay":    50,
+			"function": "true",
+			"argument": ""
+		}`), &options.Payload), "unable to parse payload")
+
+		run = New(options)
+		run.pluginManager = plugin // hack to inject mock for PluginManager
+		assert.Error(t, run.Migrate(nil), "expected Migrate() to fail before the sandbox is started")
+		run.RunToStage(StageStarted)
+		err := run.Migrate(nil)
+		assert.Equal(t, engines.ErrFeatureNotSupported, err, "expected ErrFeatureNotSupported")
+		success, exception, _ := run.WaitForResult()
+		assert.True(t, success, "expected success to be true")
+		assert.False(t, exception, "expected exception to be false")
+		assert.False(t, run.Discarded(), "expected the TaskRun not to be discarded")
+
+		require.NoError(t, run.Dispose(), "run.Dispose() returned an error")
+	})
 }
@@ -0,0 +1,24 @@
+package taskrun
+
+import (
+	schematypes "github.com/taskcluster/go-schematypes"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+)
+
+// ValidatePayload validates payload against payloadSchema, returning a
+// MalformedPayloadError with a message for each schema violation, or nil if
+// the payload is valid.
+func ValidatePayload(payloadSchema schematypes.Schema, payload interface{}) *runtime.MalformedPayloadError {
+	err := payloadSchema.Validate(payload)
+	if e, ok := err.(*schematypes.ValidationError); ok {
+		issues := e.Issues("task.payload")
+		errs := make([]*runtime.MalformedPayloadError, len(issues))
+		for i, issue := range issues {
+			errs[i] = runtime.NewMalformedPayloadError(issue.String())
+		}
+		return runtime.MergeMalformedPayload(errs...)
+	} else if err != nil {
+		return runtime.NewMalformedPayloadError("task.payload schema violation: ", err)
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	schematypes "github.com/taskcluster/go-schematypes"
+	"github.com/taskcluster/taskcluster-worker/runtime"
+	"github.com/taskcluster/taskcluster-worker/runtime/client"
+	"github.com/taskcluster/taskcluster-worker/runtime/fetcher"
+	"github.com/taskcluster/taskcluster-worker/runtime/util"
+	"golang.org/x/crypto/ed25519"
+)
+
+// defaultUpdateInterval is the time between checking for updates, if not
+// given in configuration.
+const defaultUpdateInterval = 60 * 60
+
+type updateConfig struct {
+	Manifest    interface{} `json:"manifest"`
+	Interval    int         `json:"interval"`
+	SigningKeys []string    `json:"signingKeys"`
+}
+
+func updateConfigSchema() schematypes.Object {
+	return schematypes.Object{
+		Title: "Self-Update",
+		Description: util.Markdown(`
+			If configured the worker will periodically fetch a release manifest, and
+			if the manifest references a binary different from the running binary,
+			the worker will download and verify the new binary, stop claiming tasks,
+			wait for active tasks to finish, and re-execute itself using the new
+			binary.
+
+			The release manifest must be a JSON document on the form:
+			'{"version": "...", "url": "https://...", "sha256": "...",
+			"signature": "..."}', where 'url' references the new binary, 'sha256'
+			is the hex encoded hash of the binary, and 'signature' is a base64
+			encoded ed25519 signature of the string 'sha256:<hex>' made with one
+			of the 'signingKeys', where '<hex>' is the hash in lower case.
+
+			The 'manifest' property references the release manifest, this can be a
+			URL or an artifact from a task or index route, the worker credentials
+			must have scopes to fetch the manifest.
+		`),
+		Properties: schematypes.Properties{
+			"manifest": fetcher.Default.Schema(),
+			"interval": schematypes.Integer{
+				Title: "Update Interval",
+				Description: util.Markdown(`
+					Number of seconds between checking the release manifest for updates,
+					defaults to 1 hour.
+				`),
+				Minimum: 60,
+				Maximum: 7 * 24 * 60 * 60,
+			},
+			"signingKeys": schematypes.Array{
+				Title: "Release Signing Keys",
+				Description: util.Markdown(`
+					List of base64 encoded ed25519 public keys, at least one key must be
+					given. Updates are only installed if the release manifest is signed
+					with one of these keys.
+				`),
+				Items: schematypes.String{
+					Pattern: `^[A-Za-z0-9+/]{43}=$`,
+				},
+			},
+		},
+		Required: []string{"manifest", "signingKeys"},
+	}
+}
+
+type releaseManifest struct {
+	Version   string `json:"version"`
+	URL       string `json:"url"`
+	SHA256    string `json:"sha256"`
+	Signature string `json:"signature"`
+}
+
+var releaseManifestSchema = schematypes.Object{
+	Properties: schematypes.Properties{
+		"version": schematypes.String{},
+		"url":     schematypes.URI{},
+		"sha256": schematypes.String{
+			Pattern: `^[0-9a-fA-F]{64}$`,
+		},
+		"signature": schematypes.String{
+			Pattern: `^[A-Za-z0-9+/]{86}==$`,
+		},
+	},
+	Required:             []string{"version", "url", "sha256", "signature"},
+	AdditionalProperties: true,
+}
+
+// parseSigningKeys returns the ed25519 public keys for base64 encoded keys
+func parseSigningKeys(keys []string) ([]ed25519.PublicKey, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("update.signingKeys must have at least one key")
+	}
+	var result []ed25519.PublicKey
+	for i, k := range keys {
+		key, err := base64.StdEncoding.DecodeString(k)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.Errorf("update.signingKeys[%d] isn't a base64 encoded ed25519 public key", i)
+		}
+		result = append(result, ed25519.PublicKey(key))
+	}
+	return result, nil
+}
+
+// verify returns an error if the release manifest isn't signed with one of
+// keys, or the binary isn't served over https.
+func (r *releaseManifest) verify(keys []ed25519.PublicKey) error {
+	if !strings.HasPrefix(r.URL, "https://") {
+		return runtime.NewMalformedPayloadError("release manifest 'url' must be https://")
+	}
+	signature, err := base64.StdEncoding.DecodeString(r.Signature)
+	if err != nil || len(signature) != ed25519.SignatureSize {
+		return runtime.NewMalformedPayloadError("release manifest 'signature' isn't a base64 encoded ed25519 signature")
+	}
+	message := []byte("sha256:" + strings.ToLower(r.SHA256))
+	for _, key := range keys {
+		if ed25519.Verify(key, message, signature) {
+			return nil
+		}
+	}
+	return runtime.NewMalformedPayloadError("release manifest isn't signed with any of the 'signingKeys'")
+}
+
+// updateContext implements fetcher.Context for fetching updates
+type updateContext struct {
+	context.Context
+	queue   client.Queue
+	monitor runtime.Monitor
+}
+
+func (c *updateContext) Queue() client.Queue {
+	return c.queue
+}
+
+func (c *updateContext) Progress(description string, percent float64) {
+	c.monitor.Infof("Fetching %s - %.0f %%", description, percent*100)
+}
+
+// bufferReseter implements fetcher.WriteReseter for a bytes.Buffer
+type bufferReseter struct {
+	bytes.Buffer
+}
+
+func (b *bufferReseter) Reset() error {
+	b.Buffer.Reset()
+	return nil
+}
+
+// UpdatedBinary returns the path to the new binary, if the worker was stopped
+// in order to update itself, otherwise it returns empty-string.
+//
+// The caller should replace the current executable with this binary and
+// re-execute it, after Start() has returned.
+func (w *Worker) UpdatedBinary() string {
+	w.updateMutex.Lock()
+	defer w.updateMutex.Unlock()
+	return w.updatedBinary
+}
+
+// checkForUpdates will periodically check for updates, until the worker is
+// stopped or an update is available, in which case it stops gracefully.
+func (w *Worker) checkForUpdates() {
+	interval := w.update.Interval
+	if interval == 0 {
+		interval = defaultUpdateInterval
+	}
+	m := w.monitor.WithPrefix("update")
+
+	for {
+		select {
+		case <-w.lifeCycleTracker.StoppingGracefully.Done():
+			return
+		case <-time.After(time.Duration(interval) * time.Second):
+		}
+
+		ctx := &updateContext{
+			Context: &lifeCycleContext{LifeCycle: &w.lifeCycleTracker},
+			queue:   w.queue,
+			monitor: m,
+		}
+		binary, err := fetchUpdate(ctx, w.update.Manifest, w.updateKeys)
+		if err != nil {
+			m.ReportWarning(err, "failed to fetch update")
+			continue
+		}
+		if binary == "" {
+			continue
+		}
+
+		w.updateMutex.Lock()
+		w.updatedBinary = binary
+		w.updateMutex.Unlock()
+
+		m.Info("update downloaded, stopping gracefully to install update")
+		w.StopGracefully()
+		return
+	}
+}
+
+// fetchUpdate fetches the release manifest and downloads the binary it
+// references, if different from the current executable and signed with one of
+// keys. Returns path to the verified binary, or empty-string, if there is no
+// update.
+func fetchUpdate(ctx fetcher.Context, manifest interface{}, keys []ed25519.PublicKey) (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", errors.Wrap(err, "unable to find current executable")
+	}
+	return fetchRelease(ctx, manifest, keys, executable)
+}
+
+func fetchRelease(ctx fetcher.Context, manifest interface{}, keys []ed25519.PublicKey, executable string) (string, error) {
+	// Fetch and parse the release manifest
+	ref, err := fetcher.Default.NewReference(ctx, manifest)
+	if err != nil {
+		return "", err
+	}
+	buf := &bufferReseter{}
+	if err = ref.Fetch(ctx, buf); err != nil {
+		return "", err
+	}
+	var data interface{}
+	if err = json.Unmarshal(buf.Bytes(), &data); err != nil {
+		return "", runtime.NewMalformedPayloadError("release manifest isn't valid JSON: ", err)
+	}
+	var release releaseManifest
+	if err = releaseManifestSchema.Map(data, &release); err != nil {
+		return "", runtime.NewMalformedPayloadError("invalid release manifest: ", err)
+	}
+	if err = release.verify(keys); err != nil {
+		return "", err
+	}
+
+	// Compare with hash of current executable
+	hash, err := hashFile(executable)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to hash current executable")
+	}
+	if strings.ToLower(release.SHA256) == hash {
+		debug("release manifest references the current executable")
+		return "", nil
+	}
+
+	// Download to the same folder as the executable, so it can be renamed into
+	// place when installing the update.
+	f, err := ioutil.TempFile(filepath.Dir(executable), ".update-")
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create file for update")
+	}
+	defer f.Close()
+
+	ref, err = fetcher.URLHash.NewReference(ctx, map[string]interface{}{
+		"url":    release.URL,
+		"sha256": release.SHA256,
+	})
+	if err == nil {
+		err = ref.Fetch(ctx, &fetcher.FileReseter{File: f})
+	}
+	if err == nil {
+		err = f.Chmod(0755)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	debug("downloaded version: %s to %s", release.Version, f.Name())
+	return f.Name(), nil
+}
+
+// hashFile returns the hex encoded sha256 of the file
+func hashFile(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// InstallUpdate replaces executable with binary, and returns the path to the
+// executable.
+func InstallUpdate(binary string) (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", errors.Wrap(err, "unable to find current executable")
+	}
+	// Some platforms don't allow overwriting a running executable, but allow it
+	// to be renamed.
+	old := executable + ".old"
+	_ = os.Remove(old)
+	if err = os.Rename(executable, old); err != nil {
+		return "", errors.Wrap(err, "failed to move current executable")
+	}
+	if err = os.Rename(binary, executable); err != nil {
+		if rerr := os.Rename(old, executable); rerr != nil {
+			return "", errors.Errorf(
+				"failed to install update, error: %s, and failed to restore executable, error: %s",
+				err, rerr,
+			)
+		}
+		return "", errors.Wrap(err, "failed to install update")
+	}
+	_ = os.Remove(old) // Will fail on windows, as it's still running
+	return executable, nil
+}
@@ -0,0 +1,136 @@
+package worker
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/taskcluster/taskcluster-worker/runtime/mocks"
+	"golang.org/x/crypto/ed25519"
+)
+
+func TestFetchRelease(t *testing.T) {
+	folder, err := ioutil.TempDir("", "tc-worker-update-")
+	require.NoError(t, err)
+	defer os.RemoveAll(folder)
+
+	current := []byte("#!/bin/sh\necho current\n")
+	executable := filepath.Join(folder, "taskcluster-worker")
+	require.NoError(t, ioutil.WriteFile(executable, current, 0755))
+
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	otherPublic, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	binary := current
+	scheme := "https"
+	s := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/release.json":
+			h := sha256.Sum256(binary)
+			hash := hex.EncodeToString(h[:])
+			data, _ := json.Marshal(releaseManifest{
+				Version:   "v1.0.0",
+				URL:       scheme + "://" + r.Host + "/binary",
+				SHA256:    hash,
+				Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(private, []byte("sha256:"+hash))),
+			})
+			w.Write(data)
+		case "/binary":
+			w.Write(binary)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer s.Close()
+
+	// Trust the test server, the fetcher uses http.DefaultClient
+	transport := http.DefaultClient.Transport
+	http.DefaultClient.Transport = s.Client().Transport
+	defer func() { http.DefaultClient.Transport = transport }()
+
+	ctx := &updateContext{
+		Context: context.Background(),
+		monitor: mocks.NewMockMonitor(true),
+	}
+	manifest := map[string]interface{}{"url": s.URL + "/release.json"}
+
+	keys := []ed25519.PublicKey{otherPublic, public}
+
+	t.Run("no update", func(t *testing.T) {
+		result, err := fetchRelease(ctx, manifest, keys, executable)
+		require.NoError(t, err)
+		require.Equal(t, "", result, "expected no update")
+	})
+
+	t.Run("update", func(t *testing.T) {
+		binary = []byte("#!/bin/sh\necho updated\n")
+		result, err := fetchRelease(ctx, manifest, keys, executable)
+		require.NoError(t, err)
+		require.NotEqual(t, "", result, "expected an update")
+		defer os.Remove(result)
+		require.Equal(t, folder, filepath.Dir(result))
+		data, err := ioutil.ReadFile(result)
+		require.NoError(t, err)
+		require.Equal(t, binary, data)
+	})
+
+	t.Run("not signed with a configured key", func(t *testing.T) {
+		result, err := fetchRelease(ctx, manifest, []ed25519.PublicKey{otherPublic}, executable)
+		require.Error(t, err)
+		require.Equal(t, "", result)
+	})
+
+	t.Run("binary not served over https", func(t *testing.T) {
+		scheme = "http"
+		defer func() { scheme = "https" }()
+		result, err := fetchRelease(ctx, manifest, keys, executable)
+		require.Error(t, err)
+		require.Equal(t, "", result)
+	})
+}
+
+func TestParseSigningKeys(t *testing.T) {
+	public, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	keys, err := parseSigningKeys([]string{base64.StdEncoding.EncodeToString(public)})
+	require.NoError(t, err)
+	require.Equal(t, []ed25519.PublicKey{public}, keys)
+
+	_, err = parseSigningKeys(nil)
+	require.Error(t, err, "expected at least one key to be required")
+	_, err = parseSigningKeys([]string{base64.StdEncoding.EncodeToString(public[:16])})
+	require.Error(t, err)
+}
+
+func TestUpdateConfigSchema(t *testing.T) {
+	schema := updateConfigSchema()
+	key := "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+	require.NoError(t, schema.Validate(map[string]interface{}{
+		"manifest":    "https://example.com/release.json",
+		"signingKeys": []interface{}{key},
+	}), "expected URL to be a valid manifest reference")
+	require.NoError(t, schema.Validate(map[string]interface{}{
+		"manifest":    map[string]interface{}{"url": "https://example.com/release.json"},
+		"interval":    600,
+		"signingKeys": []interface{}{key},
+	}))
+	require.Error(t, schema.Validate(map[string]interface{}{
+		"manifest":    42,
+		"signingKeys": []interface{}{key},
+	}))
+	require.Error(t, schema.Validate(map[string]interface{}{
+		"manifest": "https://example.com/release.json",
+	}), "expected signingKeys to be required")
+}
@@ -2,10 +2,13 @@ package worker
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -20,11 +23,13 @@ import (
 	"github.com/taskcluster/taskcluster-worker/runtime"
 	"github.com/taskcluster/taskcluster-worker/runtime/atomics"
 	"github.com/taskcluster/taskcluster-worker/runtime/client"
+	"github.com/taskcluster/taskcluster-worker/runtime/fetcher"
 	"github.com/taskcluster/taskcluster-worker/runtime/gc"
 	"github.com/taskcluster/taskcluster-worker/runtime/monitoring"
 	"github.com/taskcluster/taskcluster-worker/runtime/util"
 	"github.com/taskcluster/taskcluster-worker/runtime/webhookserver"
 	"github.com/taskcluster/taskcluster-worker/worker/taskrun"
+	"golang.org/x/crypto/ed25519"
 )
 
 // A Worker processes tasks
@@ -32,18 +37,37 @@ type Worker struct {
 	// New
 	garbageCollector *gc.GarbageCollector
 	temporaryStorage runtime.TemporaryFolder
+	fetchCache       *fetcher.Cache
 	environment      runtime.Environment
 	lifeCycleTracker runtime.LifeCycleTracker
 	webhookserver    webhookserver.Server
+	endpoints        *webhookserver.EndpointSet
 	engine           engines.Engine
 	plugin           *plugins.PluginManager
 	queue            client.Queue
 	queueBaseURL     string
 	options          options
 	monitor          runtime.Monitor
+	update           *updateConfig
+	updateKeys       []ed25519.PublicKey
+	temporaryFolder  string
+	taskQuota        int64 // Quota for the temporary folder of each task
+	minimumDiskSpace int64
 	// State
-	started     atomics.Once
-	activeTasks taskCounter
+	health        healthState
+	progress      progressState
+	skew          clockSkew
+	started       atomics.Once
+	activeTasks   taskCounter
+	updateMutex   sync.Mutex
+	updatedBinary string
+	maxTasks      int
+	status        statusTracker
+	controlServer *http.Server
+	// Migration
+	migrationTLS    *tls.Config // nil, if migration isn't configured
+	migrationServer *http.Server
+	migrations      migrationSet
 }
 
 // New creates a new Worker
@@ -56,31 +80,64 @@ func New(config interface{}) (w *Worker, err error) {
 	if c.AuthBaseURL != "" {
 		a.BaseURL = c.AuthBaseURL
 	}
-	monitor := monitoring.New(c.Monitor, a)
+	var monitor runtime.Monitor = monitoring.New(c.Monitor, a)
 
 	// Create worker
 	w = &Worker{
-		monitor:          monitor.WithPrefix("worker"),
 		garbageCollector: gc.New(c.TemporaryFolder, c.MinimumDiskSpace, c.MinimumMemory),
 		queueBaseURL:     c.QueueBaseURL,
 		options:          c.WorkerOptions,
+		update:           c.Update,
+		temporaryFolder:  c.TemporaryFolder,
+		taskQuota:        c.TemporaryStorage.TaskQuota,
+		minimumDiskSpace: c.MinimumDiskSpace,
+		progress:         progressState{last: time.Now()},
 	}
 
+	// Record errors and warnings reported, so they can be included in status
+	monitor = &statusMonitor{Monitor: monitor, tracker: &w.status}
+	w.monitor = monitor.WithPrefix("worker")
+
 	w.monitor.Info("starting up")
 
+	// Parse keys for verifying release manifests, if updates are configured
+	if c.Update != nil {
+		w.updateKeys, err = parseSigningKeys(c.Update.SigningKeys)
+		if err != nil {
+			w.monitor.ReportError(err, "worker.New() invalid update configuration")
+			err = runtime.ErrFatalInternalError
+			return
+		}
+	}
+	w.garbageCollector.SetDiskBudget(c.MaximumDiskUsage)
+
 	// Create queue client that is aborted when life-cycle ends
 	w.queue = w.newQueueClient(&lifeCycleContext{
 		LifeCycle: &w.lifeCycleTracker,
 	}, &c.Credentials)
 
 	// Create temporary storage
-	w.temporaryStorage, err = runtime.NewTemporaryStorage(c.TemporaryFolder)
+	w.temporaryStorage, err = runtime.NewTemporaryStorageWithOptions(c.TemporaryFolder, runtime.TemporaryStorageOptions{
+		Quota:      c.TemporaryStorage.Quota,
+		Encryption: runtime.EncryptionMode(c.TemporaryStorage.Encryption),
+	})
 	if err != nil {
 		w.monitor.ReportError(err, "worker.New() failed to create TemporaryStorage")
 		err = runtime.ErrFatalInternalError
 		return
 	}
 
+	// Create shared cache for fetched resources
+	cacheFolder, err := w.temporaryStorage.NewFolder()
+	if err == nil {
+		w.fetchCache, err = fetcher.NewCache(cacheFolder.Path(), w.garbageCollector)
+	}
+	if err != nil {
+		w.monitor.ReportError(err, "worker.New() failed to create fetcher cache")
+		err = runtime.ErrFatalInternalError
+		return
+	}
+
 	// Create webhookserver
 	if c.WebHookServer != nil {
 		w.webhookserver, err = webhookserver.NewServer(c.WebHookServer, &c.Credentials)
@@ -89,19 +146,24 @@ func New(config interface{}) (w *Worker, err error) {
 			err = runtime.ErrFatalInternalError
 			return
 		}
+		w.endpoints = webhookserver.NewEndpointSet(w.webhookserver)
 	}
 
 	// Create environment
 	w.environment = runtime.Environment{
 		Monitor:          monitor,
 		GarbageCollector: w.garbageCollector,
+		FetchCache:       w.fetchCache,
 		TemporaryStorage: w.temporaryStorage,
 		WebHookServer:    w.webhookserver,
+		Endpoints:        w.endpoints,
 		Worker:           &w.lifeCycleTracker,
 		WorkerGroup:      c.WorkerOptions.WorkerGroup,
 		WorkerID:         c.WorkerOptions.WorkerID,
 		ProvisionerID:    c.WorkerOptions.ProvisionerID,
 		WorkerType:       c.WorkerOptions.WorkerType,
+		QueueBaseURL:     c.QueueBaseURL,
+		AuthBaseURL:      c.AuthBaseURL,
 	}
 
 	// Create engine
@@ -144,6 +206,37 @@ func New(config interface{}) (w *Worker, err error) {
 		return
 	}
 
+	// Start control API, if enabled
+	if c.ControlPort != 0 {
+		var token string
+		if c.ControlTokenFile == "" {
+			err = errors.New("'controlTokenFile' must be given when 'controlPort' is given")
+		} else {
+			token, err = writeControlToken(c.ControlTokenFile)
+		}
+		if err == nil {
+			err = w.startControlServer(c.ControlPort, token)
+		}
+		if err != nil {
+			w.monitor.ReportError(err, "worker.New() failed to start control API")
+			err = runtime.ErrFatalInternalError
+			return
+		}
+	}
+
+	// Accept tasks migrated from other workers, if enabled
+	if c.Migration != nil {
+		w.migrationTLS, err = loadMigrationTLS(c.Migration)
+		if err == nil {
+			err = w.startMigrationServer(c.Migration.Port)
+		}
+		if err != nil {
+			w.monitor.ReportError(err, "worker.New() failed to start migration server")
+			err = runtime.ErrFatalInternalError
+			return
+		}
+	}
+
 	return
 }
 
@@ -173,6 +266,15 @@ func (w *Worker) PayloadSchema() schematypes.Schema {
 	return payloadSchema
 }
 
+// LimitTasks makes the worker stop gracefully after claiming maxTasks tasks,
+// this must be called before Start().
+func (w *Worker) LimitTasks(maxTasks int) {
+	if w.started.IsDone() {
+		panic("Worker.LimitTasks() must be called before Worker.Start()")
+	}
+	w.maxTasks = maxTasks
+}
+
 // ErrWorkerStoppedNow is used to communicate that the worker was forcefully
 // stopped. This could also be triggered by a plugin or engine.
 var ErrWorkerStoppedNow = errors.New("worker was interrupted by StopNow")
@@ -203,15 +305,49 @@ func (w *Worker) Start() error {
 		}
 	}()
 
+	// Periodically check for updates, if configured
+	if w.update != nil {
+		go w.checkForUpdates()
+	}
+
+	w.status.m.Lock()
+	w.status.started = time.Now()
+	w.status.m.Unlock()
+
+	claimedTasks := 0
 	for !w.lifeCycleTracker.StoppingGracefully.IsDone() {
+		w.progress.update(false)
+
+		// Run garbage collection between tasks, before we claim more tasks
+		w.collectGarbage()
+
+		// Don't claim tasks while the host is unhealthy, we would only fail them
+		if !w.healthy() {
+			w.progress.update(true)
+			select {
+			case <-time.After(time.Duration(w.options.PollingInterval) * time.Second):
+			case <-w.lifeCycleTracker.StoppingGracefully.Done():
+			}
+			continue
+		}
+
 		// Claim tasks
 		N := w.options.Concurrency - w.activeTasks.Value()
-		debug("queue.claimWork(%s, %s) with capacity: %d", w.options.ProvisionerID, w.options.WorkerType, N)
-		claims, err := w.queue.ClaimWork(w.options.ProvisionerID, w.options.WorkerType, &tcqueue.ClaimWorkRequest{
-			WorkerGroup: w.options.WorkerGroup,
-			WorkerID:    w.options.WorkerID,
-			Tasks:       int64(N),
-		})
+		if w.maxTasks > 0 && w.maxTasks-claimedTasks < N {
+			N = w.maxTasks - claimedTasks
+		}
+		claims, err := w.claimWork(N)
+
+		// If we have claims we MUST always handle, even if we have stopNow!
+		// This includes claims from other queues, when claimWork was canceled.
+		for _, claim := range claims {
+			// Start processing tasks
+			debug("starting to process task: %s/%d", claim.Status.TaskID, claim.RunID)
+			w.activeTasks.Increment()
+			go w.processClaim(claim, nil)
+		}
+		claimedTasks = w.status.addClaimed(len(claims))
+
 		if err != nil && w.lifeCycleTracker.StoppingGracefully.IsDone() {
 			// NOTE: err == context.Canceled || err == context.DeadlineExceeded
 			//       Should also work once taskcluster-client-go returns the context.Err()
@@ -223,21 +359,18 @@ func (w *Worker) Start() error {
 			w.plugin.ReportNonFatalError()
 		}
 
-		// If we have claims we MUST always handle, even if we have stopNow!
-		if claims != nil {
-			for _, claim := range claims.Tasks {
-				// Start processing tasks
-				debug("starting to process task: %s/%d", claim.Status.TaskID, claim.RunID)
-				w.activeTasks.Increment()
-				go w.processClaim(claim)
-			}
+		// Stop gracefully, if we have claimed the maximum number of tasks
+		if w.maxTasks > 0 && claimedTasks >= w.maxTasks {
+			w.monitor.Infof("claimed %d tasks, stopping gracefully", claimedTasks)
+			w.StopGracefully()
+			break
 		}
 
 		// If we received zero claims or encountered an error, we wait at-least
 		// pollingInterval before polling again. We start the timer here, so it's
 		// counting while we wait for capacity to be available.
 		var delay <-chan time.Time
-		if claims == nil || len(claims.Tasks) == 0 {
+		if len(claims) == 0 {
 			delay = time.After(time.Duration(w.options.PollingInterval) * time.Second)
 		} else {
 			// If we received a task from the claimWork request then we don't have to
@@ -247,6 +380,7 @@ func (w *Worker) Start() error {
 		}
 
 		// Wait for capacity to be available (delay is ticking while this happens)
+		w.progress.update(true)
 		debug("waiting for activeTasks: %d < concurrency: %d", w.activeTasks.Value(), w.options.Concurrency)
 		w.activeTasks.WaitForLessThan(w.options.Concurrency)
 
@@ -256,6 +390,7 @@ func (w *Worker) Start() error {
 		case <-delay:
 		case <-w.lifeCycleTracker.StoppingGracefully.Done():
 		}
+		w.progress.update(false)
 
 		// Report idle time to plugins (so they can manage life-cycle)
 		idle := w.activeTasks.IdleTime()
@@ -266,6 +401,7 @@ func (w *Worker) Start() error {
 
 	// Wait for tasks to be done, or stopNow happens
 	debug("waiting for active tasks to be resolved")
+	w.progress.update(true)
 	w.activeTasks.WaitForIdle()
 
 	// free resources when done running
@@ -307,7 +443,7 @@ func (w *Worker) newQueueClient(ctx context.Context, creds *tcclient.Credentials
 
 // reclaimDelay returns the delay before reclaiming given takenUntil
 func (w *Worker) reclaimDelay(takenUntil time.Time) time.Duration {
-	delay := time.Until(takenUntil) - time.Duration(w.options.ReclaimOffset)*time.Second
+	delay := w.skew.until(takenUntil) - time.Duration(w.options.ReclaimOffset)*time.Second
 	// Never delay less than MinimumReclaimDelay
 	if delay < time.Duration(w.options.MinimumReclaimDelay)*time.Second {
 		return time.Duration(w.options.MinimumReclaimDelay) * time.Second
@@ -315,16 +451,41 @@ func (w *Worker) reclaimDelay(takenUntil time.Time) time.Duration {
 	return delay
 }
 
+// defaultDeadlineOffset is the time prior to the task deadline at which the
+// task is aborted, if deadlineOffset isn't configured.
+const defaultDeadlineOffset = 3 * time.Minute
+
+// deadlineDelay returns the delay before aborting a task with given deadline
+func (w *Worker) deadlineDelay(deadline time.Time) time.Duration {
+	offset := time.Duration(w.options.DeadlineOffset) * time.Second
+	if offset == 0 {
+		offset = defaultDeadlineOffset
+	}
+	delay := w.skew.until(deadline) - offset
+	if delay < 0 {
+		return 0
+	}
+	return delay
+}
+
 // processClaim is responsible for processing a task, reclaiming the task and
 // aborting it with worker-shutdown with w.stopNow is unblocked, and decrements
-// activeTasks when done
-func (w *Worker) processClaim(claim taskClaim) {
+// activeTasks when done. If incoming is non-nil the task is migrated from
+// another host, and nothing is reported unless the migration is committed.
+func (w *Worker) processClaim(claim taskClaim, incoming *incomingMigration) {
 	// Decrement number of active tasks when we're done processing the task
 	defer w.activeTasks.Decrement()
 
-	// If superseding is enabled, find superseding if one is available
+	// Abort the migration, if we fail before it's committed
+	if incoming != nil {
+		defer w.migrations.remove(incoming)
+		defer incoming.abort()
+	}
+
+	// If superseding is enabled, find superseding if one is available, tasks
+	// migrated from another host were superseded on the source host
 	// NOTE: This can be removed when superseding is implemented in the queue
-	if w.options.EnableSuperseding {
+	if w.options.EnableSuperseding && incoming == nil {
 		var done func()
 		claim, done = w.superseding(claim)
 		defer done()
@@ -338,12 +499,104 @@ func (w *Worker) processClaim(claim taskClaim) {
 	monitor.Info("starting to process task")
 	defer monitor.Info("done processing task")
 
-	// Create task client
-	q := w.newQueueClient(context.Background(), &tcclient.Credentials{
-		ClientID:    claim.Credentials.ClientID,
-		AccessToken: claim.Credentials.AccessToken,
-		Certificate: claim.Credentials.Certificate,
+	// Capture panics while processing the task, such that a bug triggered by a
+	// single task resolves it internal-error, instead of crashing the worker.
+	// Tasks migrated from another host are resolved by the source host, until
+	// the migration is committed.
+	state := &claimState{
+		credentials: asClientCredentials(claim.Credentials),
+		takenUntil:  time.Time(claim.TakenUntil),
+		resolved:    incoming != nil,
+	}
+	incidentID := monitor.CapturePanic(func() {
+		w.processTask(claim, monitor, state, incoming)
 	})
+	if incidentID != "" {
+		w.resolveAfterPanic(claim, monitor, state, incidentID)
+	}
+}
+
+// claimState tracks the latest credentials for a claim and whether it has been
+// resolved, so the task can be resolved if processTask panics, or handed over
+// when migrating the task to another host.
+type claimState struct {
+	m           sync.Mutex
+	credentials *tcclient.Credentials
+	takenUntil  time.Time
+	resolved    bool
+}
+
+func (s *claimState) setCredentials(creds *tcclient.Credentials, takenUntil time.Time) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.credentials = creds
+	s.takenUntil = takenUntil
+}
+
+// current returns the latest credentials and takenUntil for the claim
+func (s *claimState) current() (*tcclient.Credentials, time.Time) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	return s.credentials, s.takenUntil
+}
+
+// handOver sets the credentials given when a task migrated from another host
+// is committed, after which the task must be resolved by this host.
+func (s *claimState) handOver(creds *tcclient.Credentials, takenUntil time.Time) {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.credentials = creds
+	s.takenUntil = takenUntil
+	s.resolved = false
+}
+
+func (s *claimState) setResolved() {
+	s.m.Lock()
+	defer s.m.Unlock()
+	s.resolved = true
+}
+
+// resolveAfterPanic resolves the task internal-error, unless it was resolved
+// before processTask panicked. As processTask releases resources in defers the
+// worker keeps running, but the panic is reported as a non-fatal error, such
+// that plugins like stoponerror can stop the worker gracefully.
+func (w *Worker) resolveAfterPanic(claim taskClaim, monitor runtime.Monitor, state *claimState, incidentID string) {
+	monitor.Errorf("panic while processing task, incidentId: %s", incidentID)
+	w.plugin.ReportNonFatalError()
+
+	state.m.Lock()
+	resolved := state.resolved
+	creds := state.credentials
+	state.m.Unlock()
+	if resolved {
+		return
+	}
+
+	reportInternalError(w.newQueueClient(context.Background(), creds), claim, monitor)
+}
+
+// reportInternalError resolves the task as exception with reason
+// internal-error, ignoring conflicts as the task was probably resolved by
+// deadline or cancellation.
+func reportInternalError(q client.Queue, claim taskClaim, monitor runtime.Monitor) {
+	runID := strconv.Itoa(int(claim.RunID))
+	_, err := q.ReportException(claim.Status.TaskID, runID, &tcqueue.TaskExceptionRequest{
+		Reason: runtime.ReasonInternalError.String(),
+	})
+	if e, ok := err.(httpbackoff.BadHttpResponseCode); ok && e.HttpResponseCode == 409 {
+		err = nil // task was probably resolved by deadline or cancellation
+	}
+	if err != nil {
+		monitor.ReportError(err, "failed to report exception with reason internal-error")
+	}
+}
+
+// processTask runs the task given by claim, reclaiming it and reporting the
+// resolution. If incoming is non-nil the task is started when the migration is
+// committed, see receiveTask().
+func (w *Worker) processTask(claim taskClaim, monitor runtime.Monitor, state *claimState, incoming *incomingMigration) {
+	// Create task client
+	q := w.newQueueClient(context.Background(), state.credentials)
 
 	// Convert task definition to interface{} form
 	var jsontask interface{}
@@ -355,8 +608,38 @@ func (w *Worker) processClaim(claim taskClaim) {
 	if json.Unmarshal(claim.Task.Payload, &payload) != nil {
 		panic("unable to parse payload as JSON, this shouldn't be possible")
 	}
-	run := taskrun.New(taskrun.Options{
-		Environment:   w.environment,
+	// Create a temporary folder for the task, limited by the per-task quota
+	taskStorage, err := w.temporaryStorage.NewFolderWithQuota(w.taskQuota)
+	if err != nil {
+		monitor.ReportError(err, "failed to create temporary folder for task, resolving internal-error")
+		w.plugin.ReportNonFatalError()
+		if incoming == nil {
+			reportInternalError(q, claim, monitor)
+		}
+		state.setResolved()
+		return
+	}
+	environment := w.environment
+	environment.TemporaryStorage = taskStorage
+
+	// Track the folder with the garbage collector while the task is running,
+	// such that files written by the task count towards the disk budget.
+	taskFolder := gc.NewDisposableFolder(taskStorage.Path(), gc.PriorityLow)
+	taskFolder.Acquire()
+	w.garbageCollector.Register(taskFolder)
+
+	// Cleanup is deferred, such that resources are released even if we panic,
+	// as the worker keeps running and will claim more tasks, see processClaim()
+	defer func() {
+		taskFolder.Release()
+		w.garbageCollector.Unregister(taskFolder)
+		if err := taskStorage.Remove(); err != nil {
+			monitor.ReportError(err, "failed to remove temporary folder for task")
+		}
+	}()
+
+	runOptions := taskrun.Options{
+		Environment:   environment,
 		Engine:        w.engine,
 		PluginManager: w.plugin,
 		Monitor:       monitor.WithPrefix("taskrun"),
@@ -371,12 +654,53 @@ func (w *Worker) processClaim(claim taskClaim) {
 			Scopes:   claim.Task.Scopes,
 			Task:     jsontask,
 		},
-	})
+	}
+	if incoming != nil {
+		runOptions.Migration = incoming
+	}
+	run := taskrun.New(runOptions)
 	run.SetCredentials(
 		claim.Credentials.ClientID,
 		claim.Credentials.AccessToken,
 		claim.Credentials.Certificate,
 	)
+	w.status.addTask(run, claim, state)
+	defer w.status.removeTask(run)
+
+	// Dispose all resources, after the task resolution has been reported
+	defer func() {
+		err := run.Dispose()
+		if err == runtime.ErrNonFatalInternalError {
+			// Count it, but otherwise ignore
+			w.plugin.ReportNonFatalError()
+		} else if err != nil {
+			if err != runtime.ErrFatalInternalError {
+				// This is now allowed, but let's be defensive here
+				monitor.ReportError(err, "TaskRun.Dispose() returned unhandled error")
+			}
+			monitor.Error("fatal error from TaskRun.Dispose() stopping now")
+			w.StopNow()
+		}
+	}()
+
+	// Wait for the migration to be committed, if migrating from another host
+	if incoming != nil {
+		commit := w.receiveTask(run, incoming)
+		if commit == nil {
+			monitor.Info("migration from another host was aborted, task continues on the source host")
+			return
+		}
+		claim.Credentials.ClientID = commit.Credentials.ClientID
+		claim.Credentials.AccessToken = commit.Credentials.AccessToken
+		claim.Credentials.Certificate = commit.Credentials.Certificate
+		claim.TakenUntil = commit.TakenUntil
+		creds := asClientCredentials(claim.Credentials)
+		state.handOver(creds, time.Time(claim.TakenUntil))
+		q = w.newQueueClient(context.Background(), creds)
+		run.SetQueueClient(q)
+		run.SetCredentials(creds.ClientID, creds.AccessToken, creds.Certificate)
+		monitor.Info("task was migrated from another host")
+	}
 
 	// runId as string for use in requests
 	runID := strconv.Itoa(int(claim.RunID))
@@ -384,42 +708,22 @@ func (w *Worker) processClaim(claim taskClaim) {
 	// Start reclaiming
 	stopReclaiming := make(chan struct{})
 	reclaimingDone := make(chan struct{})
+	var stopOnce sync.Once
+	stop := func() {
+		stopOnce.Do(func() { close(stopReclaiming) })
+		// Wait for reclaiming to end (we can't use q while it may be updated)
+		<-reclaimingDone
+	}
+	defer stop()
 	go func() {
 		defer close(reclaimingDone)
-		takenUntil := time.Time(claim.TakenUntil)
-		for {
-			// Wait for reclaim delay, stop of reclaiming, or stopNow called
-			select {
-			case <-stopReclaiming:
-				return
-			case <-w.lifeCycleTracker.StoppingNow.Done():
-				run.Abort(taskrun.WorkerShutdown)
-				return
-			case <-time.After(w.reclaimDelay(takenUntil)):
-			}
-
-			// Reclaim task
-			debug("queue.reclaimTask(%s, %d)", claim.Status.TaskID, claim.RunID)
-			result, err := q.ReclaimTask(claim.Status.TaskID, runID)
-			if err != nil {
-				if e, ok := err.(*tcclient.APICallException); ok && e.CallSummary.HTTPResponse.StatusCode == 409 {
-					debug("queue.reclaimTask(%s, %d) -> 409, task was canceled")
-					run.Abort(taskrun.TaskCanceled)
-					return
-				}
-				monitor.ReportWarning(err, "failed to reclaim task")
-				continue // Maybe we'll have more luck next time
-			}
-
-			// Update takenUntil and create a new queue client
-			takenUntil = time.Time(result.TakenUntil)
-			q = w.newQueueClient(context.Background(), asClientCredentials(result.Credentials))
-			run.SetQueueClient(q) // update queue client on the run
-			run.SetCredentials(
-				result.Credentials.ClientID,
-				result.Credentials.AccessToken,
-				result.Credentials.Certificate,
-			)
+		incidentID := monitor.CapturePanic(func() {
+			w.reclaim(claim, monitor, state, run, &q, stopReclaiming)
+		})
+		if incidentID != "" {
+			monitor.Errorf("panic while reclaiming task, incidentId: %s, stopping now", incidentID)
+			run.Abort(taskrun.WorkerShutdown)
+			w.StopNow()
 		}
 	}()
 
@@ -427,16 +731,20 @@ func (w *Worker) processClaim(claim taskClaim) {
 	success, exception, reason := run.WaitForResult()
 
 	// Stop reclaiming
-	close(stopReclaiming)
+	stop()
 
-	// Wait for reclaiming to end (we can't use q while it may be updated)
-	<-reclaimingDone
+	// Nothing is reported, if the task was migrated to another host
+	if run.Discarded() {
+		monitor.Info("task was migrated to another host")
+		state.setResolved()
+		return
+	}
 
 	// Report task resolution
 	debug("reporting task %s/%d resolved", claim.Status.TaskID, claim.RunID)
-	var err error
 	if exception {
-		if reason != runtime.ReasonCanceled {
+		// Tasks canceled or past their deadline are resolved by the queue
+		if reason != runtime.ReasonCanceled && reason != runtime.ReasonDeadlineExceeded {
 			_, err = q.ReportException(claim.Status.TaskID, runID, &tcqueue.TaskExceptionRequest{
 				Reason: reason.String(),
 			})
@@ -456,19 +764,62 @@ func (w *Worker) processClaim(claim taskClaim) {
 		monitor.ReportError(err, "failed to report task resolution")
 		w.plugin.ReportNonFatalError() // This is bad, but no need for it to be fatal
 	}
+	state.setResolved()
+}
 
-	// Dispose all resources
-	err = run.Dispose()
-	if err == runtime.ErrNonFatalInternalError {
-		// Count it, but otherwise ignore
-		w.plugin.ReportNonFatalError()
-	} else if err != nil {
-		if err != runtime.ErrFatalInternalError {
-			// This is now allowed, but let's be defensive here
-			monitor.ReportError(err, "TaskRun.Dispose() returned unhandled error")
+// reclaim reclaims the task until stopReclaiming is closed, updating the queue
+// client q, the credentials for the run and the claimState.
+func (w *Worker) reclaim(
+	claim taskClaim, monitor runtime.Monitor, state *claimState,
+	run *taskrun.TaskRun, q *client.Queue, stopReclaiming <-chan struct{},
+) {
+	runID := strconv.Itoa(int(claim.RunID))
+	takenUntil := time.Time(claim.TakenUntil)
+	deadline := time.After(w.deadlineDelay(time.Time(claim.Task.Deadline)))
+	for {
+		// Wait for reclaim delay, stop of reclaiming, or stopNow called
+		select {
+		case <-stopReclaiming:
+			return
+		case <-w.lifeCycleTracker.StoppingNow.Done():
+			run.Abort(taskrun.WorkerShutdown)
+			return
+		case <-deadline:
+			// The queue will resolve the task deadline-exceeded, so we abort the
+			// task run, leaving time for logs and artifacts to be uploaded. We keep
+			// reclaiming until processTask is done, or the claim could expire while
+			// artifacts are uploaded.
+			monitor.Info("task deadline is about to be exceeded, aborting task")
+			run.Abort(taskrun.DeadlineExceeded)
+			deadline = nil
+			continue
+		case <-time.After(w.reclaimDelay(takenUntil)):
 		}
-		monitor.Error("fatal error from TaskRun.Dispose() stopping now")
-		w.StopNow()
+
+		// Reclaim task
+		debug("queue.reclaimTask(%s, %d)", claim.Status.TaskID, claim.RunID)
+		result, err := (*q).ReclaimTask(claim.Status.TaskID, runID)
+		if err != nil {
+			if e, ok := err.(*tcclient.APICallException); ok && e.CallSummary.HTTPResponse.StatusCode == 409 {
+				debug("queue.reclaimTask(%s, %d) -> 409, task was canceled", claim.Status.TaskID, claim.RunID)
+				run.Abort(taskrun.TaskCanceled)
+				return
+			}
+			monitor.ReportWarning(err, "failed to reclaim task")
+			continue // Maybe we'll have more luck next time
+		}
+
+		// Update takenUntil and create a new queue client
+		takenUntil = time.Time(result.TakenUntil)
+		creds := asClientCredentials(result.Credentials)
+		*q = w.newQueueClient(context.Background(), creds)
+		run.SetQueueClient(*q) // update queue client on the run
+		state.setCredentials(creds, takenUntil)
+		run.SetCredentials(
+			result.Credentials.ClientID,
+			result.Credentials.AccessToken,
+			result.Credentials.Certificate,
+		)
 	}
 }
 
@@ -659,10 +1010,57 @@ func (w *Worker) StopGracefully() {
 	w.lifeCycleTracker.StopGracefully()
 }
 
+// collectGarbage runs garbage collection, reporting disk usage of resources
+// tracked, and stops the worker if an error is encountered.
+func (w *Worker) collectGarbage() {
+	debug("running garbage collection")
+	switch err := w.garbageCollector.Collect(); err {
+	case runtime.ErrNonFatalInternalError:
+		w.plugin.ReportNonFatalError()
+	case runtime.ErrFatalInternalError:
+		w.StopNow()
+	case nil:
+	default:
+		w.monitor.ReportError(err, "error during garbage collection")
+		w.StopNow()
+	}
+
+	if usage, err := w.garbageCollector.DiskUsage(); err == nil {
+		w.monitor.Measure("gc.disk-usage", float64(usage))
+	}
+}
+
+// Dispose frees all resources held by a Worker that hasn't been started, this
+// is useful for tools that create a Worker to inspect or test configuration.
+func (w *Worker) Dispose() error {
+	if !w.started.Do(nil) {
+		panic("Worker.Dispose() cannot be called after Worker.Start()")
+	}
+	w.dispose()
+	if w.lifeCycleTracker.StoppingNow.IsDone() {
+		return errors.New("errors occurred while disposing the worker, see log for details")
+	}
+	return nil
+}
+
 // dispose all resources
 func (w *Worker) dispose() {
 	hasErr := false
 
+	// Stop control API
+	if w.controlServer != nil {
+		if err := w.controlServer.Close(); err != nil {
+			debug("failed to close control API server, error: %s", err)
+		}
+	}
+
+	// Stop accepting migrations
+	if w.migrationServer != nil {
+		if err := w.migrationServer.Close(); err != nil {
+			debug("failed to close migration server, error: %s", err)
+		}
+	}
+
 	// Collect all garbage
 	switch err := w.garbageCollector.CollectAll(); err {
 	case runtime.ErrFatalInternalError, runtime.ErrNonFatalInternalError:
@@ -695,6 +1093,7 @@ func (w *Worker) dispose() {
 
 	// Stop webhookserver
 	if w.webhookserver != nil {
+		w.endpoints.Dispose()
 		w.webhookserver.Stop()
 	}
 